@@ -26,6 +26,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/components"
@@ -34,11 +35,21 @@ import (
 const (
 	kinesisOffsetNewest = "newest"
 	kinesisOffsetOldest = "oldest"
+
+	// Checkpoint values compatible with the Kinesis Client Library
+	kinesisCheckpointShardEnd    = "SHARD_END"
+	kinesisCheckpointTrimHorizon = "TRIM_HORIZON"
+	kinesisCheckpointLatest      = "LATEST"
 )
 
 // AwsKinesis consumer
 //
 // This consumer reads a message from an AWS Kinesis router.
+// Each shard is read by a separate worker. When a stream is resharded, child
+// shards are read from the start as soon as their parent shards have been
+// read completely. Offsets can be stored in a local file or in a DynamoDB
+// table compatible with the lease tables of the Kinesis Client Library, so
+// KCL-based applications can be replaced without losing their position.
 //
 // Parameters
 //
@@ -50,6 +61,21 @@ const (
 // is found, consuming will start after the offset stored in the file.
 // By default this parameter is set to "".
 //
+// - CheckpointTable: This value defines a DynamoDB table to store the current
+// offset per shard. The table requires a string hash key named "leaseKey",
+// which is set to the shard id. The offset is stored in the "checkpoint"
+// attribute. If set, OffsetFile is ignored.
+// By default this parameter is set to "".
+//
+// - CheckpointEndpoint: This value defines the DynamoDB endpoint to use. If
+// empty, the endpoint of the configured region is used.
+// By default this parameter is set to "".
+//
+// - ConsumerName: This value enables enhanced fan-out. Records are pushed to
+// a stream consumer of this name, which is registered if it does not exist.
+// If empty, shards are polled.
+// By default this parameter is set to "".
+//
 // - RecordsPerQuery: This value defines the number of records to pull per query.
 // By default this parameter is set to "100".
 //
@@ -66,6 +92,7 @@ const (
 // By default this parameter is set to "4".
 //
 // - CheckNewShardsSec: This value sets a timer to update shards in Kinesis.
+// Child shards of closed shards are picked up without this timer.
 // You can set this parameter to "0" for disabling.
 // By default this parameter is set to "0".
 //
@@ -85,26 +112,46 @@ const (
 //      Profile: default
 //    Region: "eu-west-1"
 //    KinesisStream: myStream
+//
+// This example continues reading from the checkpoints of a KCL application
+// using enhanced fan-out:
+//
+//  KinesisIn:
+//    Type: consumer.AwsKinesis
+//    Credential:
+//      Type: environment
+//    Region: "eu-west-1"
+//    KinesisStream: myStream
+//    CheckpointTable: myApplication
+//    ConsumerName: gollum
 type AwsKinesis struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
 
 	// AwsMultiClient is public to make AwsMultiClient.Configure() callable
 	AwsMultiClient components.AwsMultiClient `gollumdoc:"embed_type"`
 
-	stream          string        `config:"KinesisStream" default:"default"`
-	offsetFile      string        `config:"OffsetFile"`
-	recordsPerQuery int64         `config:"RecordsPerQuery" default:"100"`
-	delimiter       []byte        `config:"RecordMessageDelimiter"`
-	sleepTime       time.Duration `config:"QuerySleepTimeMs" default:"1000" metric:"ms"`
-	//retryTime       time.Duration `config:"RetrySleepTimeSec" default:"4" metric:"sec"`
-	shardTime time.Duration `config:"CheckNewShardsSec" default:"0" metric:"sec"`
+	stream             string        `config:"KinesisStream" default:"default"`
+	offsetFile         string        `config:"OffsetFile"`
+	checkpointTable    string        `config:"CheckpointTable"`
+	checkpointEndpoint string        `config:"CheckpointEndpoint"`
+	consumerName       string        `config:"ConsumerName"`
+	recordsPerQuery    int64         `config:"RecordsPerQuery" default:"100"`
+	delimiter          []byte        `config:"RecordMessageDelimiter"`
+	sleepTime          time.Duration `config:"QuerySleepTimeMs" default:"1000" metric:"ms"`
+	retryTime          time.Duration `config:"RetrySleepTimeSec" default:"4" metric:"sec"`
+	shardTime          time.Duration `config:"CheckNewShardsSec" default:"0" metric:"sec"`
 
 	client        *kinesis.Kinesis
+	dynamo        *dynamodb.DynamoDB
+	consumerARN   string
 	offsets       map[string]string
+	started       map[string]bool
 	offsetType    string
 	defaultOffset string
 	running       bool
+	stopped       chan struct{}
 	offsetsGuard  *sync.RWMutex
+	storeGuard    *sync.Mutex
 }
 
 func init() {
@@ -114,7 +161,10 @@ func init() {
 // Configure initializes this consumer with values from a plugin config.
 func (cons *AwsKinesis) Configure(conf core.PluginConfigReader) {
 	cons.offsets = make(map[string]string)
+	cons.started = make(map[string]bool)
+	cons.stopped = make(chan struct{})
 	cons.offsetsGuard = new(sync.RWMutex)
+	cons.storeGuard = new(sync.Mutex)
 
 	// Offset
 	offsetValue := strings.ToLower(conf.GetString("DefaultOffset", kinesisOffsetNewest))
@@ -137,12 +187,16 @@ func (cons *AwsKinesis) Configure(conf core.PluginConfigReader) {
 		cons.defaultOffset = offsetValue
 	}
 
+	if cons.checkpointTable != "" && cons.offsetFile != "" {
+		cons.Logger.Warning("OffsetFile is ignored as CheckpointTable is set")
+		cons.offsetFile = ""
+	}
+
 	if cons.offsetFile != "" {
 		fileContents, err := ioutil.ReadFile(cons.offsetFile)
 		if err != nil {
 			cons.Logger.Errorf("Failed to open kinesis offset file: %s", err.Error())
 		} else {
-			cons.offsetType = kinesis.ShardIteratorTypeAfterSequenceNumber
 			conf.Errors.Push(json.Unmarshal(fileContents, &cons.offsets))
 		}
 	}
@@ -154,38 +208,98 @@ func (cons *AwsKinesis) marshalOffsets() ([]byte, error) {
 	return json.Marshal(cons.offsets)
 }
 
-func (cons *AwsKinesis) storeOffsets() {
-	if cons.offsetFile != "" {
+func (cons *AwsKinesis) loadCheckpoints() error {
+	if cons.dynamo == nil {
+		return nil
+	}
+
+	query := &dynamodb.ScanInput{
+		TableName:      aws.String(cons.checkpointTable),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	// No locks required here as this is called only once on start
+	return cons.dynamo.ScanPages(query, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			shardID, checkpoint := item["leaseKey"], item["checkpoint"]
+			if shardID != nil && shardID.S != nil && checkpoint != nil && checkpoint.S != nil {
+				cons.offsets[*shardID.S] = *checkpoint.S
+			}
+		}
+		return true
+	})
+}
+
+func (cons *AwsKinesis) storeOffsets(shardID string) {
+	switch {
+	case cons.dynamo != nil:
+		cons.offsetsGuard.RLock()
+		checkpoint := cons.offsets[shardID]
+		cons.offsetsGuard.RUnlock()
+
+		if checkpoint == "" {
+			return // ### return, nothing read yet ###
+		}
+
+		_, err := cons.dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: aws.String(cons.checkpointTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"leaseKey": {S: aws.String(shardID)},
+			},
+			UpdateExpression:         aws.String("SET #checkpoint = :checkpoint"),
+			ExpressionAttributeNames: map[string]*string{"#checkpoint": aws.String("checkpoint")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":checkpoint": {S: aws.String(checkpoint)},
+			},
+		})
+		if err != nil {
+			cons.Logger.Errorf("Failed to store kinesis checkpoint for %s: %s", shardID, err.Error())
+		}
+
+	case cons.offsetFile != "":
 		fileContents, err := cons.marshalOffsets()
 		if err != nil {
 			cons.Logger.Errorf("Failed to marshal kinesis offsets: %s", err.Error())
 			return
 		}
 
+		// Shard workers write concurrently
+		cons.storeGuard.Lock()
+		defer cons.storeGuard.Unlock()
 		if err := ioutil.WriteFile(cons.offsetFile, fileContents, 0644); err != nil {
 			cons.Logger.Errorf("Failed to write kinesis offsets: %s", err.Error())
 		}
 	}
 }
 
+// getStartingPosition returns the iterator type and sequence number to start
+// reading a shard from.
+func (cons *AwsKinesis) getStartingPosition(shardID string) (string, *string) {
+	cons.offsetsGuard.RLock()
+	offset := cons.offsets[shardID]
+	cons.offsetsGuard.RUnlock()
+
+	switch offset {
+	case "":
+		return cons.offsetType, nil
+	case kinesisCheckpointTrimHorizon:
+		return kinesis.ShardIteratorTypeTrimHorizon, nil
+	case kinesisCheckpointLatest:
+		return kinesis.ShardIteratorTypeLatest, nil
+	default:
+		// starting sequence number requires ShardIteratorTypeAfterSequenceNumber
+		return kinesis.ShardIteratorTypeAfterSequenceNumber, aws.String(offset)
+	}
+}
+
 func (cons *AwsKinesis) createShardIteratorConfig(shardID string) *kinesis.GetRecordsInput {
 	for cons.running {
-		cons.offsetsGuard.RLock()
-		offset := cons.offsets[shardID]
-		cons.offsetsGuard.RUnlock()
-
+		iteratorType, sequenceNumber := cons.getStartingPosition(shardID)
 		iteratorConfig := kinesis.GetShardIteratorInput{
 			ShardId:                aws.String(shardID),
-			ShardIteratorType:      aws.String(cons.offsetType),
+			ShardIteratorType:      aws.String(iteratorType),
 			StreamName:             aws.String(cons.stream),
-			StartingSequenceNumber: aws.String(offset),
-		}
-
-		if *iteratorConfig.StartingSequenceNumber == "" {
-			iteratorConfig.StartingSequenceNumber = nil
-		} else {
-			// starting sequence number requires ShardIteratorTypeAfterSequenceNumber
-			iteratorConfig.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+			StartingSequenceNumber: sequenceNumber,
 		}
 
 		iterator, err := cons.client.GetShardIterator(&iteratorConfig)
@@ -196,21 +310,67 @@ func (cons *AwsKinesis) createShardIteratorConfig(shardID string) *kinesis.GetRe
 			}
 		}
 
-		cons.Logger.Errorf("Failed to iterate shard %s:%s - %s", *iteratorConfig.StreamName, *iteratorConfig.ShardId, err.Error())
-		time.Sleep(3 * time.Second)
+		cons.Logger.Errorf("Failed to iterate shard %s:%s - %v", *iteratorConfig.StreamName, *iteratorConfig.ShardId, err)
+		cons.sleep(cons.retryTime)
 	}
 
 	return nil
 }
 
+func (cons *AwsKinesis) sleep(duration time.Duration) {
+	select {
+	case <-cons.stopped:
+	case <-time.After(duration):
+	}
+}
+
+func (cons *AwsKinesis) processRecords(shardID string, records []*kinesis.Record) {
+	for _, record := range records {
+		if record == nil {
+			continue // ### continue ###
+		}
+
+		if len(cons.delimiter) > 0 {
+			messages := bytes.Split(record.Data, cons.delimiter)
+			for _, msg := range messages {
+				cons.Enqueue(msg)
+			}
+		} else {
+			cons.Enqueue(record.Data)
+		}
+
+		// An exclusive lock is required as shards are read concurrently and
+		// maps do not support concurrent writes, even to existing keys.
+		cons.offsetsGuard.Lock()
+		cons.offsets[shardID] = *record.SequenceNumber
+		cons.offsetsGuard.Unlock()
+	}
+}
+
+// finishShard marks a shard as completely read and starts reading its child
+// shards.
+func (cons *AwsKinesis) finishShard(shardID string) {
+	cons.Logger.Infof("Shard %s:%s has been closed", cons.stream, shardID)
+
+	cons.offsetsGuard.Lock()
+	cons.offsets[shardID] = kinesisCheckpointShardEnd
+	cons.offsetsGuard.Unlock()
+	cons.storeOffsets(shardID)
+
+	if err := cons.startShards(); err != nil {
+		cons.Logger.WithError(err).Error("Failed to start child shards")
+	}
+}
+
 func (cons *AwsKinesis) processShard(shardID string) {
-	cons.AddWorker()
 	defer cons.WorkerDone()
 	recordConfig := (*kinesis.GetRecordsInput)(nil)
 
 	for cons.running {
 		if recordConfig == nil {
-			recordConfig = cons.createShardIteratorConfig(shardID)
+			if recordConfig = cons.createShardIteratorConfig(shardID); recordConfig == nil {
+				return // ### return, stopped ###
+			}
 		}
 
 		result, err := cons.client.GetRecords(recordConfig)
@@ -221,7 +381,7 @@ func (cons *AwsKinesis) processShard(shardID string) {
 				switch AWSerr.Code() {
 				case "ProvisionedThroughputExceededException":
 					// We reached thethroughput limit
-					time.Sleep(5 * time.Second)
+					cons.sleep(5 * time.Second)
 
 				case "ExpiredIteratorException":
 					// We need to create a new iterator
@@ -231,42 +391,83 @@ func (cons *AwsKinesis) processShard(shardID string) {
 			continue // ### continue ###
 		}
 
+		cons.processRecords(shardID, result.Records)
+
 		if result.NextShardIterator == nil {
-			cons.Logger.Warningf("Shard %s:%s has been closed", cons.stream, shardID)
+			cons.finishShard(shardID)
 			return // ### return, closed ###
 		}
 
-		for _, record := range result.Records {
-			if record == nil {
-				continue // ### continue ###
-			}
+		if len(result.Records) > 0 {
+			cons.storeOffsets(shardID)
+		}
+		recordConfig.ShardIterator = result.NextShardIterator
+		cons.sleep(cons.sleepTime)
+	}
+}
 
-			if len(cons.delimiter) > 0 {
-				messages := bytes.Split(record.Data, cons.delimiter)
-				for _, msg := range messages {
-					cons.Enqueue(msg)
-				}
-			} else {
-				cons.Enqueue(record.Data)
-			}
+// subscribeShard reads a shard via enhanced fan-out. Subscriptions expire
+// after five minutes and are renewed from the last offset.
+func (cons *AwsKinesis) subscribeShard(shardID string) {
+	defer cons.WorkerDone()
 
-			// Why not an exclusive lock here?
-			// - the map already has an entry for the shardID at this point.
-			// - we are the only one writing to this field
-			// - reading an offset is always a race as it can change at any time
-			// - performance is crucial here
-			// If we could be sure this actually IS a number, we could use atomic.Store here
-			cons.offsetsGuard.RLock()
-			cons.offsets[shardID] = *record.SequenceNumber
-			cons.offsetsGuard.RUnlock()
+	for cons.running {
+		iteratorType, sequenceNumber := cons.getStartingPosition(shardID)
+		subscription, err := cons.client.SubscribeToShard(&kinesis.SubscribeToShardInput{
+			ConsumerARN: aws.String(cons.consumerARN),
+			ShardId:     aws.String(shardID),
+			StartingPosition: &kinesis.StartingPosition{
+				Type:           aws.String(iteratorType),
+				SequenceNumber: sequenceNumber,
+			},
+		})
+		if err != nil {
+			cons.Logger.Errorf("Failed to subscribe to shard %s:%s - %s", cons.stream, shardID, err.Error())
+			cons.sleep(cons.retryTime)
+			continue // ### continue, retry ###
 		}
 
-		cons.storeOffsets()
-		recordConfig.ShardIterator = result.NextShardIterator
-		time.Sleep(cons.sleepTime)
+		if closed := cons.readSubscription(shardID, subscription.EventStream); closed {
+			cons.finishShard(shardID)
+			return // ### return, closed ###
+		}
 	}
 }
 
+func (cons *AwsKinesis) readSubscription(shardID string, stream *kinesis.SubscribeToShardEventStream) bool {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-cons.stopped:
+			stream.Close()
+		case <-done:
+		}
+	}()
+	defer stream.Close()
+
+	for event := range stream.Events() {
+		shardEvent, isShardEvent := event.(*kinesis.SubscribeToShardEvent)
+		if !isShardEvent {
+			continue // ### continue, unknown event ###
+		}
+
+		cons.processRecords(shardID, shardEvent.Records)
+		if len(shardEvent.Records) > 0 {
+			cons.storeOffsets(shardID)
+		}
+
+		if shardEvent.ContinuationSequenceNumber == nil {
+			return true // ### return, closed ###
+		}
+	}
+
+	if err := stream.Err(); err != nil && cons.running {
+		cons.Logger.Warningf("Subscription to shard %s:%s ended - %s", cons.stream, shardID, err.Error())
+	}
+	return false
+}
+
 func (cons *AwsKinesis) initKinesisClient() {
 	sess, err := cons.AwsMultiClient.NewSessionWithOptions()
 	if err != nil {
@@ -275,6 +476,10 @@ func (cons *AwsKinesis) initKinesisClient() {
 
 	awsConfig := cons.AwsMultiClient.GetConfig()
 
+	if cons.checkpointTable != "" {
+		cons.dynamo = dynamodb.New(sess, awsConfig.Copy().WithEndpoint(cons.checkpointEndpoint))
+	}
+
 	// set auto endpoint to s3 if setting is empty
 	if awsConfig.Endpoint == nil || *awsConfig.Endpoint == "" {
 		awsConfig.WithEndpoint(fmt.Sprintf("kinesis.%s.amazonaws.com", *awsConfig.Region))
@@ -283,45 +488,153 @@ func (cons *AwsKinesis) initKinesisClient() {
 	cons.client = kinesis.New(sess, awsConfig)
 }
 
-func (cons *AwsKinesis) connect() error {
-	cons.initKinesisClient()
+// registerConsumer registers the enhanced fan-out consumer if necessary and
+// waits until it becomes active.
+func (cons *AwsKinesis) registerConsumer() error {
+	summary, err := cons.client.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(cons.stream),
+	})
+	if err != nil {
+		return err
+	}
+	streamARN := summary.StreamDescriptionSummary.StreamARN
+
+	for cons.running {
+		description, err := cons.client.DescribeStreamConsumer(&kinesis.DescribeStreamConsumerInput{
+			ConsumerName: aws.String(cons.consumerName),
+			StreamARN:    streamARN,
+		})
+
+		if AWSerr, isAWSerr := err.(awserr.Error); isAWSerr && AWSerr.Code() == kinesis.ErrCodeResourceNotFoundException {
+			cons.Logger.Infof("Registering stream consumer %s", cons.consumerName)
+			_, err = cons.client.RegisterStreamConsumer(&kinesis.RegisterStreamConsumerInput{
+				ConsumerName: aws.String(cons.consumerName),
+				StreamARN:    streamARN,
+			})
+			if err != nil {
+				return err
+			}
+			continue // ### continue, check status ###
+		}
 
-	// Get shard ids for stream
-	streamQuery := &kinesis.DescribeStreamInput{
+		if err != nil {
+			return err
+		}
+
+		consumer := description.ConsumerDescription
+		if *consumer.ConsumerStatus == kinesis.ConsumerStatusActive {
+			cons.consumerARN = *consumer.ConsumerARN
+			return nil
+		}
+
+		cons.Logger.Debugf("Waiting for stream consumer %s to become active", cons.consumerName)
+		cons.sleep(2 * time.Second)
+	}
+
+	return fmt.Errorf("Stopped while registering stream consumer")
+}
+
+func (cons *AwsKinesis) listShards() ([]*kinesis.Shard, error) {
+	shards := []*kinesis.Shard{}
+	query := &kinesis.ListShardsInput{
 		StreamName: aws.String(cons.stream),
 	}
 
-	streamInfo, err := cons.client.DescribeStream(streamQuery)
-	if err != nil {
-		return err
+	for {
+		result, err := cons.client.ListShards(query)
+		if err != nil {
+			return nil, err
+		}
+
+		shards = append(shards, result.Shards...)
+		if result.NextToken == nil {
+			return shards, nil
+		}
+		query = &kinesis.ListShardsInput{
+			NextToken: result.NextToken,
+		}
 	}
+}
 
-	if streamInfo.StreamDescription == nil {
-		return fmt.Errorf("StreamDescription could not be retrieved")
+// startShards starts a worker for each shard that is not read yet. Shards
+// are started only if their parents have been read completely, so that
+// records of a key are processed in order.
+func (cons *AwsKinesis) startShards() error {
+	shards, err := cons.listShards()
+	if err != nil {
+		return err
 	}
 
-	cons.running = true
-	for _, shard := range streamInfo.StreamDescription.Shards {
+	known := make(map[string]bool)
+	for _, shard := range shards {
 		if shard.ShardId == nil {
 			return fmt.Errorf("ShardId could not be retrieved")
 		}
+		known[*shard.ShardId] = true
+	}
 
-		// No locks required here as connect is called only once on start
-		if _, offsetStored := cons.offsets[*shard.ShardId]; !offsetStored {
-			cons.offsets[*shard.ShardId] = cons.defaultOffset
-		}
+	cons.offsetsGuard.Lock()
+	defer cons.offsetsGuard.Unlock()
+
+	isFinished := func(shardID *string) bool {
+		return shardID == nil || !known[*shardID] || cons.offsets[*shardID] == kinesisCheckpointShardEnd
 	}
 
-	// No locks required here updateShards is not yet running and processShard
-	// does not change the offsets structure.
-	for shardID := range cons.offsets {
+	for _, shard := range shards {
+		shardID := *shard.ShardId
+		if !cons.running || cons.started[shardID] || cons.offsets[shardID] == kinesisCheckpointShardEnd {
+			continue
+		}
+
+		if !isFinished(shard.ParentShardId) || !isFinished(shard.AdjacentParentShardId) {
+			continue // ### continue, started after parents are closed ###
+		}
+
+		if _, offsetStored := cons.offsets[shardID]; !offsetStored {
+			// Child shards must be read from the start to not lose records
+			if (shard.ParentShardId != nil && known[*shard.ParentShardId]) ||
+				(shard.AdjacentParentShardId != nil && known[*shard.AdjacentParentShardId]) {
+				cons.offsets[shardID] = kinesisCheckpointTrimHorizon
+			} else {
+				cons.offsets[shardID] = cons.defaultOffset
+			}
+		}
+
+		cons.started[shardID] = true
 		cons.Logger.Debugf("Starting consumer for %s:%s", cons.stream, shardID)
-		go cons.processShard(shardID)
+		cons.AddWorker()
+
+		if cons.consumerARN != "" {
+			go cons.subscribeShard(shardID)
+		} else {
+			go cons.processShard(shardID)
+		}
+	}
+
+	return nil
+}
+
+func (cons *AwsKinesis) connect() error {
+	cons.initKinesisClient()
+	cons.running = true
+
+	if err := cons.loadCheckpoints(); err != nil {
+		return err
+	}
+
+	if cons.consumerName != "" {
+		if err := cons.registerConsumer(); err != nil {
+			return err
+		}
+	}
+
+	if err := cons.startShards(); err != nil {
+		return err
 	}
 
 	if cons.shardTime > 0 {
 		cons.AddWorker()
-		time.AfterFunc(cons.shardTime, cons.updateShards)
+		go cons.updateShards()
 	}
 
 	return nil
@@ -330,42 +643,21 @@ func (cons *AwsKinesis) connect() error {
 func (cons *AwsKinesis) updateShards() {
 	defer cons.WorkerDone()
 
-	streamQuery := &kinesis.DescribeStreamInput{
-		StreamName: aws.String(cons.stream),
-	}
-
 	for cons.running {
-		streamInfo, err := cons.client.DescribeStream(streamQuery)
-		if err != nil {
-			cons.Logger.Warningf("StreamInfo could not be retrieved.")
-		}
-
-		if streamInfo.StreamDescription == nil {
-			cons.Logger.Warningf("StreamDescription could not be retrieved.")
-			continue
+		cons.sleep(cons.shardTime)
+		if !cons.running {
+			return
 		}
 
-		cons.running = true
-		for _, shard := range streamInfo.StreamDescription.Shards {
-			if shard.ShardId == nil {
-				cons.Logger.Warningf("ShardId could not be retrieved.")
-				continue
-			}
-
-			cons.offsetsGuard.Lock()
-			if _, offsetStored := cons.offsets[*shard.ShardId]; !offsetStored {
-				cons.offsets[*shard.ShardId] = cons.defaultOffset
-				cons.Logger.Debugf("Starting kinesis consumer for %s:%s", cons.stream, *shard.ShardId)
-				go cons.processShard(*shard.ShardId)
-			}
-			cons.offsetsGuard.Unlock()
+		if err := cons.startShards(); err != nil {
+			cons.Logger.Warningf("Shards could not be updated: %s", err.Error())
 		}
-		time.Sleep(cons.shardTime)
 	}
 }
 
 func (cons *AwsKinesis) close() {
 	cons.running = false
+	close(cons.stopped)
 	cons.WorkerDone()
 }
 
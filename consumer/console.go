@@ -15,8 +15,10 @@
 package consumer
 
 import (
+	"bytes"
 	"io"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -32,8 +34,10 @@ const (
 
 // Console consumer
 //
-// This consumer reads from stdin or a named pipe. A message is generated after
-// each newline character.
+// This consumer reads from stdin or a named pipe. By default a message is
+// generated after each newline character. Other partitioners allow reading
+// null-delimited or length-prefixed output of other tools. Entries can be
+// joined into multiline messages, e.g. to keep stack traces together.
 //
 // Metadata
 //
@@ -60,6 +64,47 @@ const (
 // performance impact on systems with high throughput.
 // By default this parameter is set to "false".
 //
+// - Partitioner: Defines how messages are separated. By default this parameter
+// is set to "delimiter". The following options are available:
+//  - "delimiter": Separates messages by Delimiter.
+//  - "null": Separates messages by null bytes, e.g. the output of "find -print0".
+//  - "binary": Reads a little endian binary length of Size bytes before each message.
+//  - "binary_le": An alias for "binary".
+//  - "binary_be": The same as "binary" but uses big endian encoding.
+//  - "varint": Reads an unsigned varint length before each message, as used by
+//  protobuf for length delimited streams.
+//  - "netstring": Reads netstrings, i.e. messages formatted as "<length>:<data>,".
+//
+// - Delimiter: Defines the delimiter used by the delimiter partitioner and to
+// join multiline messages.
+// By default this parameter is set to "\n".
+//
+// - Size: Defines the size in bytes of the length used by the binary
+// partitioners. Valid values are 1, 2, 4 and 8.
+// By default this parameter is set to 4.
+//
+// - MaxMessageSizeKB: Defines the maximum size of a message read by the varint
+// and netstring partitioners.
+// By default this parameter is set to 1024.
+//
+// - Multiline/Pattern: Defines a regular expression used to join multiple
+// entries into one message. If set to "", every entry is a message.
+// By default this parameter is set to "".
+//
+// - Multiline/Mode: Defines the meaning of Multiline/Pattern. If set to
+// "start", matching entries start a new message and all other entries are
+// appended to the previous one. If set to "continue", matching entries are
+// appended to the previous message and all other entries start a new one.
+// By default this parameter is set to "start".
+//
+// - Multiline/MaxLines: Defines the maximum number of entries joined into a
+// single message.
+// By default this parameter is set to 500.
+//
+// - Multiline/TimeoutMs: Defines the number of milliseconds after which a
+// joined message is sent if no further entry arrived.
+// By default this parameter is set to 1000.
+//
 // Examples
 //
 // This config reads data from stdin e.g. when starting gollum via unix pipe.
@@ -68,13 +113,34 @@ const (
 //    Type: consumer.Console
 //    Streams: console
 //    Pipe: stdin
+//
+// This config reads the output of a program piped to gollum, joining
+// indented lines with the line before:
+//
+//  ConsoleIn:
+//    Type: consumer.Console
+//    Streams: console
+//    Multiline:
+//      Pattern: "^\\s"
+//      Mode: continue
 type Console struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
 	pipe                *os.File
-	pipeName            string `config:"Pipe" default:"stdin"`
-	pipePerm            uint32 `config:"Permissions" default:"0644"`
-	hasToSetMetadata    bool   `config:"SetMetadata" default:"false"`
-	autoExit            bool   `config:"ExitOnEOF" default:"true"`
+	pipeName            string        `config:"Pipe" default:"stdin"`
+	pipePerm            uint32        `config:"Permissions" default:"0644"`
+	hasToSetMetadata    bool          `config:"SetMetadata" default:"false"`
+	autoExit            bool          `config:"ExitOnEOF" default:"true"`
+	delimiter           string        `config:"Delimiter" default:"\n"`
+	maxMessageSize      int           `config:"MaxMessageSizeKB" default:"1024" metric:"kb"`
+	multilineMode       string        `config:"Multiline/Mode" default:"start"`
+	multilineMax        int           `config:"Multiline/MaxLines" default:"500"`
+	multilineTimeout    time.Duration `config:"Multiline/TimeoutMs" default:"1000" metric:"ms"`
+	flags               tio.BufferedReaderFlags
+	frameParser         socketFrameParser
+	multiline           *regexp.Regexp
+	pending             [][]byte
+	lastEntry           time.Time
+	pendingGuard        *sync.Mutex
 }
 
 func init() {
@@ -90,6 +156,62 @@ func (cons *Console) Configure(conf core.PluginConfigReader) {
 	default:
 		cons.pipe = nil
 	}
+
+	partitioner := conf.GetString("Partitioner", "delimiter")
+	switch strings.ToLower(partitioner) {
+	case "delimiter":
+		if cons.delimiter == "" {
+			conf.Errors.Pushf("Delimiter must not be empty")
+		}
+
+	case "null":
+		cons.delimiter = "\x00"
+
+	case "binary_be":
+		cons.flags |= tio.BufferedReaderFlagBigEndian
+		fallthrough
+
+	case "binary", "binary_le":
+		switch conf.GetInt("Size", 4) {
+		case 1:
+			cons.flags |= tio.BufferedReaderFlagMLE8
+		case 2:
+			cons.flags |= tio.BufferedReaderFlagMLE16
+		case 4:
+			cons.flags |= tio.BufferedReaderFlagMLE32
+		case 8:
+			cons.flags |= tio.BufferedReaderFlagMLE64
+		default:
+			conf.Errors.Pushf("Size only supports the value 1,2,4 and 8")
+		}
+
+	case "varint":
+		cons.frameParser = parseVarint
+
+	case "netstring":
+		cons.frameParser = parseNetstring
+
+	default:
+		conf.Errors.Pushf("Unknown partitioner: %s", partitioner)
+	}
+
+	if pattern := conf.GetString("Multiline/Pattern", ""); pattern != "" {
+		expression, err := regexp.Compile(pattern)
+		if !conf.Errors.Push(err) {
+			cons.multiline = expression
+		}
+	}
+
+	switch cons.multilineMode {
+	case fileTailModeStart, fileTailModeContinue:
+	default:
+		conf.Errors.Pushf("Multiline/Mode must be one of %s or %s", fileTailModeStart, fileTailModeContinue)
+	}
+
+	if cons.multilineMax < 1 {
+		cons.multilineMax = 1
+	}
+	cons.pendingGuard = new(sync.Mutex)
 }
 
 // Enqueue creates a new message
@@ -104,10 +226,64 @@ func (cons *Console) Enqueue(data []byte) {
 	}
 }
 
+// appendEntry passes an entry to multiline joining or sends it directly.
+func (cons *Console) appendEntry(entry []byte) {
+	if cons.multiline == nil {
+		cons.Enqueue(entry)
+		return
+	}
+
+	cons.pendingGuard.Lock()
+	defer cons.pendingGuard.Unlock()
+
+	isContinuation := cons.multiline.Match(entry)
+	if cons.multilineMode == fileTailModeStart {
+		isContinuation = !isContinuation
+	}
+
+	if !isContinuation || len(cons.pending) >= cons.multilineMax {
+		cons.flushPending()
+	}
+
+	cons.pending = append(cons.pending, append([]byte{}, entry...))
+	cons.lastEntry = time.Now()
+}
+
+// flushPending sends the joined entries. The caller has to hold pendingGuard.
+func (cons *Console) flushPending() {
+	if len(cons.pending) == 0 {
+		return
+	}
+	cons.Enqueue(bytes.Join(cons.pending, []byte(cons.delimiter)))
+	cons.pending = nil
+}
+
+func (cons *Console) flushExpired() {
+	cons.pendingGuard.Lock()
+	defer cons.pendingGuard.Unlock()
+
+	if len(cons.pending) > 0 && time.Since(cons.lastEntry) >= cons.multilineTimeout {
+		cons.flushPending()
+	}
+}
+
+func (cons *Console) flushAll() {
+	cons.pendingGuard.Lock()
+	defer cons.pendingGuard.Unlock()
+	cons.flushPending()
+}
+
 // Consume listens to stdin.
 func (cons *Console) Consume(workers *sync.WaitGroup) {
 	go cons.readPipe()
-	cons.ControlLoop()
+
+	if cons.multiline == nil {
+		cons.ControlLoop()
+		return
+	}
+
+	defer cons.flushAll()
+	cons.TickerControlLoop(cons.multilineTimeout, cons.flushExpired)
 }
 
 func (cons *Console) readPipe() {
@@ -122,11 +298,16 @@ func (cons *Console) readPipe() {
 		defer cons.pipe.Close()
 	}
 
-	buffer := tio.NewBufferedReader(consoleBufferGrowSize, 0, 0, "\n")
+	var buffer socketReader = tio.NewBufferedReader(consoleBufferGrowSize, cons.flags, 0, cons.delimiter)
+	if cons.frameParser != nil {
+		buffer = newSocketFrameReader(cons.frameParser, cons.maxMessageSize)
+	}
+
 	for cons.IsActive() {
-		err := buffer.ReadAll(cons.pipe, cons.Enqueue)
+		err := buffer.ReadAll(cons.pipe, cons.appendEntry)
 		switch err {
 		case io.EOF:
+			cons.flushAll()
 			if cons.autoExit {
 				cons.Logger.Info("Exit triggered by EOF.")
 				tgo.ShutdownCallback()
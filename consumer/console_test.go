@@ -0,0 +1,63 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+type mockConsumerRouter struct {
+	core.SimpleRouter
+	messages []string
+}
+
+func (router *mockConsumerRouter) Enqueue(msg *core.Message) error {
+	router.messages = append(router.messages, msg.String())
+	return nil
+}
+
+func (router *mockConsumerRouter) Start() error {
+	return nil
+}
+
+func TestConsoleMultiline(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	router := &mockConsumerRouter{}
+	core.StreamRegistry.Register(router, core.StreamRegistry.GetStreamID("consoleMultiline"))
+
+	conf := core.NewPluginConfig("", "consumer.Console")
+	conf.Override("Streams", "consoleMultiline")
+	conf.Override("Multiline", map[string]interface{}{
+		"Pattern": "^START",
+		"Mode":    "start",
+	})
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*Console)
+	expect.True(casted)
+
+	for _, entry := range []string{"START 1", " at a", "START 2", "START 3", " at b"} {
+		cons.appendEntry([]byte(entry))
+	}
+	cons.flushAll()
+
+	// Entries are joined by the console's multiline settings only
+	expect.Equal([]string{"START 1\n at a", "START 2", "START 3\n at b"}, router.messages)
+}
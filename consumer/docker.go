@@ -0,0 +1,603 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+)
+
+const (
+	dockerStreamStdout = 1
+	dockerStreamStderr = 2
+	dockerRetryDelay   = 3 * time.Second
+)
+
+// Docker consumer plugin
+//
+// The Docker consumer discovers running containers through the Docker Engine
+// API and streams their stdout and stderr output. Each line becomes a
+// message. Containers are picked up as soon as they start and released when
+// they stop. Rotation of the container's log files is handled by the Docker
+// daemon; streams that end while a container is still running are resumed
+// from the timestamp of the last line read.
+//
+// Metadata
+//
+// - container_id: The full ID of the container (set)
+//
+// - container_name: The name of the container without leading slash (set)
+//
+// - image: The image the container was created from (set)
+//
+// - stream: Either "stdout" or "stderr" (set)
+//
+// - label_<name>: One key per container label (set)
+//
+// Parameters
+//
+// - Endpoint: Defines the address of the Docker Engine API. Supported schemes
+// are "unix", "tcp", "http" and "https".
+// By default this parameter is set to "unix:///var/run/docker.sock".
+//
+// - Containers: Defines a list of glob patterns matched against container
+// names. Only matching containers are read. An empty list matches all
+// containers.
+// By default this parameter is set to an empty list.
+//
+// - Exclude: Defines a list of glob patterns matched against container names.
+// Matching containers are ignored.
+// By default this parameter is set to an empty list.
+//
+// - Labels: Defines a map of labels a container must have. An empty value
+// only checks for the presence of a label.
+// By default this parameter is set to an empty map.
+//
+// - Stdout: Set to false to ignore the stdout stream of containers.
+// By default this parameter is set to true.
+//
+// - Stderr: Set to false to ignore the stderr stream of containers.
+// By default this parameter is set to true.
+//
+// - DefaultOffset: Defines where to start reading the logs of containers
+// that are already running when the consumer starts. Valid values are
+// "oldest" and "newest". Containers started later are always read from the
+// start.
+// By default this parameter is set to "newest".
+//
+// - RescanIntervalSec: Defines the number of seconds between two full
+// container listings. Container events are processed immediately, so the
+// rescan only catches events missed during reconnects.
+// By default this parameter is set to 30.
+//
+// - TlsCaLocation: Path to the CA certificate(s) used to verify "https"
+// endpoints. See core/components.NewTLSClientConfig for additional TLS
+// settings.
+// By default this parameter is set to "".
+//
+// Examples
+//
+// This example reads all containers labeled for log shipping except gollum
+// itself:
+//
+//  ContainerLogs:
+//    Type: consumer.Docker
+//    Streams: container_logs
+//    Exclude:
+//      - "gollum*"
+//    Labels:
+//      logging: enabled
+type Docker struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	endpoint       string        `config:"Endpoint" default:"unix:///var/run/docker.sock"`
+	readStdout     bool          `config:"Stdout" default:"true"`
+	readStderr     bool          `config:"Stderr" default:"true"`
+	defaultOffset  string        `config:"DefaultOffset" default:"newest"`
+	rescanInterval time.Duration `config:"RescanIntervalSec" default:"30" metric:"sec"`
+
+	include    []string
+	exclude    []string
+	labels     map[string]string
+	client     *http.Client
+	baseURL    string
+	containers map[string]*dockerContainer
+	lastSeen   map[string]time.Time
+	guard      *sync.Mutex
+	followers  *sync.WaitGroup
+	ctx        context.Context
+	cancel     context.CancelFunc
+	startTime  time.Time
+	isRunning  bool
+}
+
+// dockerContainer holds the state of a followed container.
+type dockerContainer struct {
+	id       string
+	metadata core.Metadata
+	since    time.Time
+}
+
+// dockerContainerInfo is the subset of the container list response used.
+type dockerContainerInfo struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+	State  string            `json:"State"`
+}
+
+// dockerEvent is the subset of an event stream entry used.
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID string `json:"ID"`
+	} `json:"Actor"`
+}
+
+func init() {
+	core.TypeRegistry.Register(Docker{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Docker) Configure(conf core.PluginConfigReader) {
+	cons.SetPrepareStopCallback(cons.prepareStop)
+
+	cons.include = conf.GetStringArray("Containers", []string{})
+	cons.exclude = conf.GetStringArray("Exclude", []string{})
+	cons.labels = conf.GetStringMap("Labels", map[string]string{})
+	cons.containers = make(map[string]*dockerContainer)
+	cons.lastSeen = make(map[string]time.Time)
+	cons.guard = new(sync.Mutex)
+	cons.followers = new(sync.WaitGroup)
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+
+	for _, pattern := range append(append([]string{}, cons.include...), cons.exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			conf.Errors.Pushf("Invalid glob pattern '%s': %s", pattern, err)
+		}
+	}
+
+	switch strings.ToLower(cons.defaultOffset) {
+	case fileOffsetStart, fileOffsetEnd:
+		cons.defaultOffset = strings.ToLower(cons.defaultOffset)
+	default:
+		conf.Errors.Pushf("DefaultOffset must be one of %s or %s", fileOffsetStart, fileOffsetEnd)
+	}
+
+	if !cons.readStdout && !cons.readStderr {
+		conf.Errors.Pushf("At least one of Stdout or Stderr has to be enabled")
+	}
+
+	endpoint, err := url.Parse(cons.endpoint)
+	if err != nil {
+		conf.Errors.Push(err)
+		return
+	}
+
+	transport := &http.Transport{}
+	switch endpoint.Scheme {
+	case "unix":
+		socket := endpoint.Path
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		cons.baseURL = "http://docker"
+
+	case "tcp", "http":
+		cons.baseURL = "http://" + endpoint.Host
+
+	case "https":
+		tlsConfig, err := components.NewTLSClientConfig(conf)
+		if !conf.Errors.Push(err) {
+			transport.TLSClientConfig = tlsConfig
+		}
+		cons.baseURL = "https://" + endpoint.Host
+
+	default:
+		conf.Errors.Pushf("Unsupported endpoint scheme '%s'", endpoint.Scheme)
+	}
+
+	// No timeout as log and event requests are streamed
+	cons.client = &http.Client{Transport: transport}
+}
+
+// Consume follows container logs until the consumer is stopped.
+func (cons *Docker) Consume(workers *sync.WaitGroup) {
+	cons.startTime = time.Now()
+
+	go tgo.WithRecoverShutdown(func() {
+		cons.AddMainWorker(workers)
+		defer cons.WorkerDone()
+		cons.watchEvents()
+	})
+
+	cons.TickerControlLoop(cons.rescanInterval, cons.rescan)
+}
+
+func (cons *Docker) prepareStop() {
+	cons.cancel()
+	cons.followers.Wait()
+}
+
+func (cons *Docker) isStopped() bool {
+	select {
+	case <-cons.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (cons *Docker) get(path string, query url.Values) (*http.Response, error) {
+	requestURL := cons.baseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cons.client.Do(req.WithContext(cons.ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// -- discovery --
+
+func (cons *Docker) isSelected(info dockerContainerInfo) bool {
+	name := dockerContainerName(info)
+
+	for _, pattern := range cons.exclude {
+		if match, _ := filepath.Match(pattern, name); match {
+			return false
+		}
+	}
+
+	for key, value := range cons.labels {
+		labelValue, hasLabel := info.Labels[key]
+		if !hasLabel || (value != "" && value != labelValue) {
+			return false
+		}
+	}
+
+	if len(cons.include) == 0 {
+		return true
+	}
+	for _, pattern := range cons.include {
+		if match, _ := filepath.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+func dockerContainerName(info dockerContainerInfo) string {
+	if len(info.Names) == 0 {
+		return info.ID
+	}
+	return strings.TrimPrefix(info.Names[0], "/")
+}
+
+func (cons *Docker) listContainers() ([]dockerContainerInfo, error) {
+	resp, err := cons.get("/containers/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	containers := []dockerContainerInfo{}
+	err = json.NewDecoder(resp.Body).Decode(&containers)
+	return containers, err
+}
+
+// rescan follows all running containers that are not followed yet.
+func (cons *Docker) rescan() {
+	if cons.isStopped() {
+		return
+	}
+
+	containers, err := cons.listContainers()
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to list containers")
+		return
+	}
+
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	if cons.isStopped() {
+		return // ### return, followers must not be added after stop ###
+	}
+
+	isFirstScan := !cons.isRunning
+	cons.isRunning = true
+
+	running := make(map[string]bool)
+	for _, info := range containers {
+		running[info.ID] = true
+		if _, isFollowed := cons.containers[info.ID]; isFollowed || !cons.isSelected(info) {
+			continue
+		}
+		cons.follow(info, isFirstScan)
+	}
+
+	// Forget read positions of removed containers
+	for id := range cons.lastSeen {
+		if _, isFollowed := cons.containers[id]; !isFollowed && !running[id] {
+			delete(cons.lastSeen, id)
+		}
+	}
+}
+
+// follow starts reading the logs of a container. The caller has to hold
+// guard.
+func (cons *Docker) follow(info dockerContainerInfo, isFirstScan bool) {
+	container := &dockerContainer{
+		id:       info.ID,
+		metadata: core.Metadata{},
+	}
+
+	switch lastSeen, known := cons.lastSeen[info.ID]; {
+	case known:
+		container.since = lastSeen
+	case isFirstScan && cons.defaultOffset == fileOffsetEnd:
+		container.since = cons.startTime
+	}
+
+	container.metadata.SetValue("container_id", []byte(info.ID))
+	container.metadata.SetValue("container_name", []byte(dockerContainerName(info)))
+	container.metadata.SetValue("image", []byte(info.Image))
+	for key, value := range info.Labels {
+		container.metadata.SetValue("label_"+key, []byte(value))
+	}
+
+	cons.Logger.Infof("Following container %s", dockerContainerName(info))
+	cons.containers[info.ID] = container
+	cons.followers.Add(1)
+
+	go tgo.WithRecoverShutdown(func() {
+		defer cons.followers.Done()
+		cons.readContainer(container)
+	})
+}
+
+// watchEvents reacts on container starts until the consumer is stopped.
+func (cons *Docker) watchEvents() {
+	filters := `{"type":["container"],"event":["start"]}`
+
+	for !cons.isStopped() {
+		cons.rescan()
+
+		resp, err := cons.get("/events", url.Values{"filters": {filters}})
+		if err != nil {
+			if !cons.isStopped() {
+				cons.Logger.WithError(err).Error("Failed to watch container events")
+				cons.wait(dockerRetryDelay)
+			}
+			continue
+		}
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			event := dockerEvent{}
+			if err := decoder.Decode(&event); err != nil {
+				if !cons.isStopped() {
+					cons.Logger.WithError(err).Warning("Container event stream closed")
+				}
+				break
+			}
+			if event.Type == "container" && event.Action == "start" {
+				cons.Logger.Debugf("Container %s started", event.Actor.ID)
+				cons.rescan()
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func (cons *Docker) wait(duration time.Duration) {
+	select {
+	case <-cons.ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+// -- reading --
+
+func (cons *Docker) isContainerRunning(id string) (running bool, tty bool, err error) {
+	resp, err := cons.get("/containers/"+id+"/json", nil)
+	if err != nil {
+		return false, false, err
+	}
+	defer resp.Body.Close()
+
+	info := struct {
+		State struct {
+			Running bool `json:"Running"`
+		} `json:"State"`
+		Config struct {
+			Tty bool `json:"Tty"`
+		} `json:"Config"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info.State.Running, info.Config.Tty, err
+}
+
+// readContainer streams the logs of a container until it stops or the
+// consumer is stopped.
+func (cons *Docker) readContainer(container *dockerContainer) {
+	defer cons.release(container)
+
+	for !cons.isStopped() {
+		running, tty, err := cons.isContainerRunning(container.id)
+		switch {
+		case cons.isStopped():
+			return // ### return, stopped ###
+		case err != nil:
+			cons.Logger.WithError(err).Warningf("Failed to inspect container %s", container.id)
+			return // ### return, container is gone ###
+		case !running:
+			return // ### return, container stopped ###
+		}
+
+		query := url.Values{
+			"follow":     {"1"},
+			"timestamps": {"1"},
+			"stdout":     {strconv.FormatBool(cons.readStdout)},
+			"stderr":     {strconv.FormatBool(cons.readStderr)},
+		}
+		if !container.since.IsZero() {
+			query.Set("since", fmt.Sprintf("%d.%09d", container.since.Unix(), container.since.Nanosecond()))
+		}
+
+		resp, err := cons.get("/containers/"+container.id+"/logs", query)
+		if err != nil {
+			if !cons.isStopped() {
+				cons.Logger.WithError(err).Errorf("Failed to read logs of container %s", container.id)
+				cons.wait(dockerRetryDelay)
+			}
+			continue
+		}
+
+		if tty {
+			err = cons.readLines(container, resp.Body, "stdout")
+		} else {
+			err = cons.readMultiplexed(container, resp.Body)
+		}
+		resp.Body.Close()
+
+		if err != nil && err != io.EOF && !cons.isStopped() {
+			cons.Logger.WithError(err).Warningf("Log stream of container %s interrupted", container.id)
+			cons.wait(dockerRetryDelay)
+		}
+	}
+}
+
+func (cons *Docker) release(container *dockerContainer) {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	delete(cons.containers, container.id)
+	if !container.since.IsZero() {
+		cons.lastSeen[container.id] = container.since
+	}
+	if !cons.isStopped() {
+		cons.Logger.Infof("Stopped following container %s", container.metadata.GetValueString("container_name"))
+	}
+}
+
+// readMultiplexed splits the stdout and stderr frames of a log stream created
+// without TTY.
+func (cons *Docker) readMultiplexed(container *dockerContainer, reader io.Reader) error {
+	header := make([]byte, 8)
+	partial := map[byte][]byte{}
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+
+		frame := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return err
+		}
+
+		streamType := header[0]
+		streamName := "stdout"
+		if streamType == dockerStreamStderr {
+			streamName = "stderr"
+		} else if streamType != dockerStreamStdout {
+			continue // ### continue, stdin is not read ###
+		}
+
+		// Long lines are split into several frames
+		data := append(partial[streamType], frame...)
+		for {
+			idx := bytes.IndexByte(data, '\n')
+			if idx == -1 {
+				break
+			}
+			cons.enqueueLine(container, data[:idx], streamName)
+			data = data[idx+1:]
+		}
+		partial[streamType] = append([]byte{}, data...)
+	}
+}
+
+// readLines reads a raw log stream as created for containers with TTY.
+func (cons *Docker) readLines(container *dockerContainer, reader io.Reader, streamName string) error {
+	lines := bufio.NewReader(reader)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		cons.enqueueLine(container, bytes.TrimRight(line, "\r\n"), streamName)
+	}
+}
+
+// enqueueLine strips the timestamp from a log line and sends it. Lines older
+// than the last line sent are skipped as they were sent before a reconnect.
+func (cons *Docker) enqueueLine(container *dockerContainer, line []byte, streamName string) {
+	timestamp := time.Time{}
+	if idx := bytes.IndexByte(line, ' '); idx > 0 {
+		if parsed, err := time.Parse(time.RFC3339Nano, string(line[:idx])); err == nil {
+			timestamp = parsed
+			line = line[idx+1:]
+		}
+	}
+
+	if !timestamp.IsZero() {
+		if !timestamp.After(container.since) {
+			return // ### return, already sent ###
+		}
+		container.since = timestamp
+	}
+
+	metaData := container.metadata.Clone()
+	metaData.SetValue("stream", []byte(streamName))
+	cons.EnqueueWithMetadata(line, metaData)
+}
@@ -0,0 +1,345 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+)
+
+const (
+	eventHubsOffsetOldest = "oldest"
+	eventHubsOffsetNewest = "newest"
+)
+
+// EventHubs consumer plugin
+//
+// The EventHubs consumer reads events from all or selected partitions of an
+// Azure Event Hub using AMQP 1.0. Each event becomes a message containing the
+// event's body. Each partition is read over a separate connection. The
+// offset of the last event passed on is stored per partition in a checkpoint
+// file, so that reading continues there after a restart. Partitions are not
+// balanced between multiple instances; use separate consumer groups or assign
+// partitions to instances via Partitions.
+//
+// Metadata
+//
+// - partition: The ID of the partition the event was read from (set)
+//
+// - offset: The offset of the event (set)
+//
+// - sequence: The sequence number of the event (set)
+//
+// - partition_key: The partition key of the event, if set by the sender (set)
+//
+// Parameters
+//
+// - ConsumerGroup: Defines the consumer group to read with.
+// By default this parameter is set to "$Default".
+//
+// - Partitions: Defines the IDs of the partitions to read. If empty, all
+// partitions are read.
+// By default this parameter is set to an empty list.
+//
+// - DefaultOffset: Defines where to start reading partitions without a
+// checkpoint. Valid values are "oldest" and "newest".
+// By default this parameter is set to "newest".
+//
+// - CheckpointFile: Defines the path to the file the offsets of all
+// partitions are written to. If empty, no checkpoint is kept.
+// By default this parameter is set to "".
+//
+// - CheckpointIntervalSec: Defines the number of seconds between two writes
+// of the checkpoint file. The checkpoint is always written when the consumer
+// stops.
+// By default this parameter is set to 5.
+//
+// - Prefetch: Defines the number of events requested from a partition in
+// advance.
+// By default this parameter is set to 300.
+//
+// - RetryIntervalSec: Defines the number of seconds to wait before
+// reconnecting after a connection failed.
+// By default this parameter is set to 5.
+//
+// Examples
+//
+// This example reads the "logs" event hub and keeps a checkpoint:
+//
+//  AzureLogs:
+//    Type: consumer.EventHubs
+//    Streams: logs
+//    ConnectionString: "Endpoint=sb://example.servicebus.windows.net/;SharedAccessKeyName=gollum;SharedAccessKey=secret;EntityPath=logs"
+//    ConsumerGroup: gollum
+//    DefaultOffset: oldest
+//    CheckpointFile: /var/gollum/logs.offsets
+type EventHubs struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+	// EventHubsClient is public to make EventHubsClient.Configure() callable
+	EventHubsClient components.EventHubsClient `gollumdoc:"embed_type"`
+
+	consumerGroup      string        `config:"ConsumerGroup" default:"$Default"`
+	defaultOffset      string        `config:"DefaultOffset" default:"newest"`
+	checkpointFile     string        `config:"CheckpointFile"`
+	checkpointInterval time.Duration `config:"CheckpointIntervalSec" default:"5" metric:"sec"`
+	prefetch           uint32        `config:"Prefetch" default:"300"`
+	retryInterval      time.Duration `config:"RetryIntervalSec" default:"5" metric:"sec"`
+
+	partitions []string
+	offsets    map[string]string
+	guard      *sync.Mutex
+	ctx        context.Context
+	cancel     context.CancelFunc
+	readers    *sync.WaitGroup
+}
+
+func init() {
+	core.TypeRegistry.Register(EventHubs{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *EventHubs) Configure(conf core.PluginConfigReader) {
+	cons.SetPrepareStopCallback(cons.prepareStop)
+	cons.partitions = conf.GetStringArray("Partitions", []string{})
+	cons.offsets = make(map[string]string)
+	cons.guard = new(sync.Mutex)
+	cons.readers = new(sync.WaitGroup)
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+
+	cons.defaultOffset = strings.ToLower(cons.defaultOffset)
+	switch cons.defaultOffset {
+	case eventHubsOffsetOldest, eventHubsOffsetNewest:
+	default:
+		conf.Errors.Pushf("DefaultOffset must be one of %s or %s", eventHubsOffsetOldest, eventHubsOffsetNewest)
+	}
+
+	if !cons.EventHubsClient.IsConfigured() {
+		cons.Logger.Warning("No event hub configured")
+	}
+
+	if cons.checkpointFile != "" {
+		data, err := ioutil.ReadFile(cons.checkpointFile)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			conf.Errors.Push(err)
+		default:
+			if err := json.Unmarshal(data, &cons.offsets); err != nil {
+				conf.Errors.Pushf("Failed to parse checkpoint %s: %s", cons.checkpointFile, err)
+			}
+		}
+	}
+}
+
+// Consume reads all partitions until the consumer is stopped.
+func (cons *EventHubs) Consume(workers *sync.WaitGroup) {
+	go tgo.WithRecoverShutdown(func() {
+		cons.AddMainWorker(workers)
+		defer cons.WorkerDone()
+		cons.run()
+	})
+
+	defer cons.writeCheckpoint()
+	cons.TickerControlLoop(cons.checkpointInterval, cons.writeCheckpoint)
+}
+
+// prepareStop closes all connections and waits until the current events
+// have been processed.
+func (cons *EventHubs) prepareStop() {
+	cons.cancel()
+	cons.readers.Wait()
+}
+
+func (cons *EventHubs) run() {
+	if !cons.EventHubsClient.IsConfigured() {
+		return // ### return, nothing to read ###
+	}
+
+	for len(cons.partitions) == 0 {
+		partitions, err := cons.getPartitionIDs()
+		if err == nil {
+			cons.partitions = partitions
+			break
+		}
+
+		cons.Logger.WithError(err).Errorf("Failed to read partitions of %s", cons.EventHubsClient.GetHub())
+		select {
+		case <-cons.ctx.Done():
+			return // ### return, stopped ###
+		case <-time.After(cons.retryInterval):
+		}
+	}
+
+	for _, partition := range cons.partitions {
+		cons.readers.Add(1)
+		go tgo.WithRecoverShutdown(func(partition string) func() {
+			return func() {
+				defer cons.readers.Done()
+				cons.readPartition(partition)
+			}
+		}(partition))
+	}
+	cons.readers.Wait()
+}
+
+func (cons *EventHubs) getPartitionIDs() ([]string, error) {
+	conn, err := cons.EventHubsClient.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return cons.EventHubsClient.GetPartitionIDs(conn, 30*time.Second)
+}
+
+// readPartition reads a partition and reconnects on errors until the
+// consumer is stopped.
+func (cons *EventHubs) readPartition(partition string) {
+	for {
+		if err := cons.receive(partition); err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to read partition %s", partition)
+		}
+
+		select {
+		case <-cons.ctx.Done():
+			return // ### return, stopped ###
+		case <-time.After(cons.retryInterval):
+		}
+	}
+}
+
+func (cons *EventHubs) receive(partition string) error {
+	conn, err := cons.EventHubsClient.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return err
+	}
+
+	address := fmt.Sprintf("%s/ConsumerGroups/%s/Partitions/%s", cons.EventHubsClient.GetHub(), cons.consumerGroup, partition)
+	receiver, err := session.NewReceiver(
+		amqp.LinkSourceAddress(address),
+		amqp.LinkCredit(cons.prefetch),
+		amqp.LinkSelectorFilter(cons.getSelector(partition)))
+	if err != nil {
+		return err
+	}
+
+	for {
+		event, err := receiver.Receive(cons.ctx)
+		if err != nil {
+			if cons.ctx.Err() != nil {
+				return nil // ### return, stopped ###
+			}
+			return err
+		}
+
+		metaData := core.Metadata{}
+		metaData.SetValue("partition", []byte(partition))
+		offset := eventHubsAnnotation(event, "x-opt-offset")
+		metaData.SetValue("offset", []byte(offset))
+		metaData.SetValue("sequence", []byte(eventHubsAnnotation(event, "x-opt-sequence-number")))
+		if key := eventHubsAnnotation(event, "x-opt-partition-key"); key != "" {
+			metaData.SetValue("partition_key", []byte(key))
+		}
+
+		for _, data := range event.Data {
+			cons.EnqueueWithMetadata(data, metaData.Clone())
+		}
+		event.Accept(context.Background())
+
+		cons.guard.Lock()
+		cons.offsets[partition] = offset
+		cons.guard.Unlock()
+	}
+}
+
+// getSelector returns the filter selecting all events after the last
+// processed one.
+func (cons *EventHubs) getSelector(partition string) string {
+	cons.guard.Lock()
+	offset, hasOffset := cons.offsets[partition]
+	cons.guard.Unlock()
+
+	switch {
+	case hasOffset:
+		return fmt.Sprintf("amqp.annotation.x-opt-offset > '%s'", offset)
+	case cons.defaultOffset == eventHubsOffsetOldest:
+		return "amqp.annotation.x-opt-offset > '-1'"
+	default:
+		return "amqp.annotation.x-opt-offset > '@latest'"
+	}
+}
+
+func (cons *EventHubs) writeCheckpoint() {
+	if cons.checkpointFile == "" {
+		return
+	}
+
+	cons.guard.Lock()
+	data, err := json.Marshal(cons.offsets)
+	cons.guard.Unlock()
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to encode checkpoint")
+		return
+	}
+
+	fileDir := path.Dir(cons.checkpointFile)
+	if err := os.MkdirAll(fileDir, 0755); err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to create %s", fileDir)
+		return
+	}
+
+	// Write to a temporary file first so that a crash cannot leave a
+	// partially written checkpoint.
+	tempFile := cons.checkpointFile + ".tmp"
+	if err := ioutil.WriteFile(tempFile, data, 0644); err != nil {
+		cons.Logger.WithError(err).Error("Failed to write checkpoint")
+		return
+	}
+	if err := os.Rename(tempFile, cons.checkpointFile); err != nil {
+		cons.Logger.WithError(err).Error("Failed to write checkpoint")
+	}
+}
+
+// eventHubsAnnotation returns a message annotation as string.
+func eventHubsAnnotation(event *amqp.Message, key string) string {
+	switch value := event.Annotations[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case int64:
+		return strconv.FormatInt(value, 10)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+)
+
+const (
+	execModeOnce      = "once"
+	execModeInterval  = "interval"
+	execModeSupervise = "supervise"
+)
+
+// Exec consumer plugin
+//
+// The Exec consumer runs a command and generates one message per line written
+// to stdout or stderr. The command can be run once, on an interval or be
+// supervised, i.e. restarted whenever it exits. Restarts are delayed with an
+// exponential backoff. When run once or on an interval, the output of a run
+// is passed on after the command exited, so that the exit status can be
+// attached to each line. Supervised commands are expected to run for a long
+// time, so their output is passed on immediately. Running commands are killed
+// when gollum stops.
+//
+// Metadata
+//
+// - command: The command as configured (set)
+//
+// - stream: Either "stdout" or "stderr" (set)
+//
+// - exit_code: The exit status of the command, -1 if it could not be started
+// or was killed (set, once and interval mode only)
+//
+// Parameters
+//
+// - Command: Defines the executable to run. If Shell is enabled, this is
+// passed to the shell instead.
+// By default this parameter is set to "".
+//
+// - Arguments: Defines a list of arguments passed to the command.
+// By default this parameter is set to an empty list.
+//
+// - Shell: Set to true to run Command with "/bin/sh -c".
+// By default this parameter is set to false.
+//
+// - Mode: Defines how the command is run. Valid values are "once",
+// "interval" and "supervise".
+// By default this parameter is set to "interval".
+//
+// - IntervalSec: Defines the number of seconds between the start of two
+// runs in interval mode.
+// By default this parameter is set to 60.
+//
+// - TimeoutSec: Defines the number of seconds after which a command is killed
+// in once or interval mode. Set to 0 to disable.
+// By default this parameter is set to 0.
+//
+// - Stdout: Set to false to ignore stdout.
+// By default this parameter is set to true.
+//
+// - Stderr: Set to false to ignore stderr.
+// By default this parameter is set to true.
+//
+// - Environment: Defines a map of environment variables added to the
+// environment of gollum.
+// By default this parameter is set to an empty map.
+//
+// - WorkDir: Defines the working directory of the command. If empty, the
+// working directory of gollum is used.
+// By default this parameter is set to "".
+//
+// - MaxLineSizeKB: Defines the maximum length of a line. Longer lines are
+// split.
+// By default this parameter is set to 64.
+//
+// - RestartDelayMs: Defines the delay before a supervised command is
+// restarted. The delay is doubled with every restart until RestartMaxDelaySec
+// is reached. It is reset once a command ran longer than RestartMaxDelaySec.
+// By default this parameter is set to 1000.
+//
+// - RestartMaxDelaySec: Defines the maximum delay between two restarts.
+// By default this parameter is set to 60.
+//
+// Examples
+//
+// This example polls a legacy status tool every 5 minutes:
+//
+//  LegacyStatus:
+//    Type: consumer.Exec
+//    Streams: status
+//    Command: /opt/legacy/bin/status
+//    Arguments: ["--all", "--format=json"]
+//    Mode: interval
+//    IntervalSec: 300
+//    TimeoutSec: 60
+//
+// This example keeps a log follower running:
+//
+//  Journal:
+//    Type: consumer.Exec
+//    Streams: journal
+//    Command: journalctl -f -o json
+//    Shell: true
+//    Mode: supervise
+//    Stderr: false
+type Exec struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	command         string        `config:"Command"`
+	shell           bool          `config:"Shell" default:"false"`
+	mode            string        `config:"Mode" default:"interval"`
+	interval        time.Duration `config:"IntervalSec" default:"60" metric:"sec"`
+	timeout         time.Duration `config:"TimeoutSec" default:"0" metric:"sec"`
+	readStdout      bool          `config:"Stdout" default:"true"`
+	readStderr      bool          `config:"Stderr" default:"true"`
+	workDir         string        `config:"WorkDir"`
+	maxLineSize     int           `config:"MaxLineSizeKB" default:"64" metric:"kb"`
+	restartDelay    time.Duration `config:"RestartDelayMs" default:"1000" metric:"ms"`
+	restartMaxDelay time.Duration `config:"RestartMaxDelaySec" default:"60" metric:"sec"`
+
+	executable  string
+	arguments   []string
+	environment []string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	stopped     chan struct{}
+}
+
+// execLine is a line of output kept until the command exited.
+type execLine struct {
+	data   []byte
+	stream string
+}
+
+func init() {
+	core.TypeRegistry.Register(Exec{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Exec) Configure(conf core.PluginConfigReader) {
+	cons.SetPrepareStopCallback(cons.prepareStop)
+
+	cons.arguments = conf.GetStringArray("Arguments", []string{})
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+	cons.stopped = make(chan struct{})
+
+	cons.environment = os.Environ()
+	for key, value := range conf.GetStringMap("Environment", map[string]string{}) {
+		cons.environment = append(cons.environment, key+"="+value)
+	}
+
+	cons.executable = cons.command
+	if cons.shell {
+		cons.arguments = append([]string{"-c", cons.command}, cons.arguments...)
+		cons.executable = "/bin/sh"
+	}
+
+	cons.mode = strings.ToLower(cons.mode)
+	switch cons.mode {
+	case execModeOnce, execModeInterval, execModeSupervise:
+	default:
+		conf.Errors.Pushf("Mode must be one of %s, %s or %s", execModeOnce, execModeInterval, execModeSupervise)
+	}
+
+	if cons.command == "" {
+		cons.Logger.Warning("No command set")
+	}
+}
+
+// Consume runs the command until the consumer is stopped.
+func (cons *Exec) Consume(workers *sync.WaitGroup) {
+	go tgo.WithRecoverShutdown(func() {
+		cons.AddMainWorker(workers)
+		defer cons.WorkerDone()
+		defer close(cons.stopped)
+		cons.run()
+	})
+
+	cons.ControlLoop()
+}
+
+// prepareStop kills running commands and waits until their output has been
+// processed.
+func (cons *Exec) prepareStop() {
+	cons.cancel()
+	<-cons.stopped
+}
+
+func (cons *Exec) run() {
+	if cons.command == "" {
+		return // ### return, nothing to do ###
+	}
+
+	switch cons.mode {
+	case execModeOnce:
+		cons.execute(false)
+
+	case execModeInterval:
+		for {
+			start := time.Now()
+			cons.execute(false)
+			if !cons.wait(cons.interval - time.Since(start)) {
+				return // ### return, stopped ###
+			}
+		}
+
+	case execModeSupervise:
+		delay := cons.restartDelay
+		for {
+			start := time.Now()
+			exitCode := cons.execute(true)
+			if cons.ctx.Err() != nil {
+				return // ### return, stopped ###
+			}
+
+			if time.Since(start) > cons.restartMaxDelay {
+				delay = cons.restartDelay
+			}
+			cons.Logger.Warningf("Command exited with status %d, restarting in %s", exitCode, delay)
+			if !cons.wait(delay) {
+				return // ### return, stopped ###
+			}
+			if delay *= 2; delay > cons.restartMaxDelay {
+				delay = cons.restartMaxDelay
+			}
+		}
+	}
+}
+
+// wait returns false if the consumer was stopped before duration passed.
+func (cons *Exec) wait(duration time.Duration) bool {
+	if duration <= 0 {
+		return cons.ctx.Err() == nil
+	}
+	select {
+	case <-cons.ctx.Done():
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
+// execute runs the command once and returns its exit status. Output is
+// passed on immediately if isStreaming is set, otherwise after the command
+// exited.
+func (cons *Exec) execute(isStreaming bool) int {
+	ctx := cons.ctx
+	if cons.timeout > 0 && !isStreaming {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cons.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, cons.executable, cons.arguments...)
+	cmd.Env = cons.environment
+	cmd.Dir = cons.workDir
+
+	var (
+		lines   []execLine
+		guard   = new(sync.Mutex)
+		readers = new(sync.WaitGroup)
+	)
+
+	onLine := func(data []byte, stream string) {
+		if isStreaming {
+			cons.enqueue(data, stream, "")
+			return
+		}
+		guard.Lock()
+		lines = append(lines, execLine{data, stream})
+		guard.Unlock()
+	}
+
+	readPipe := func(pipe io.Reader, stream string) {
+		defer readers.Done()
+		scanner := bufio.NewScanner(pipe)
+		scanner.Buffer(make([]byte, 0, 4096), cons.maxLineSize)
+		scanner.Split(execScanLines(cons.maxLineSize))
+		for scanner.Scan() {
+			onLine(append([]byte{}, scanner.Bytes()...), stream)
+		}
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			cons.Logger.WithError(err).Warningf("Failed to read %s", stream)
+		}
+	}
+
+	for _, output := range []struct {
+		isEnabled bool
+		stream    string
+		pipe      func() (io.ReadCloser, error)
+	}{
+		{cons.readStdout, "stdout", cmd.StdoutPipe},
+		{cons.readStderr, "stderr", cmd.StderrPipe},
+	} {
+		if !output.isEnabled {
+			continue
+		}
+		pipe, err := output.pipe()
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to open %s", output.stream)
+			return -1
+		}
+		readers.Add(1)
+		go readPipe(pipe, output.stream)
+	}
+
+	exitCode := 0
+	if err := cmd.Start(); err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to run %s", cons.command)
+		return -1
+	}
+
+	// Children of a killed command may keep the pipes open. Waiting for the
+	// command closes them, so don't wait for the readers in that case.
+	readersDone := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(readersDone)
+	}()
+	select {
+	case <-readersDone:
+	case <-ctx.Done():
+	}
+
+	err := cmd.Wait()
+	<-readersDone
+	if err != nil {
+		exitCode = -1
+		if exitErr, isExitErr := err.(*exec.ExitError); isExitErr {
+			if status, hasStatus := exitErr.Sys().(interface{ ExitStatus() int }); hasStatus {
+				exitCode = status.ExitStatus()
+			}
+		}
+	}
+
+	status := strconv.Itoa(exitCode)
+	for _, line := range lines {
+		cons.enqueue(line.data, line.stream, status)
+	}
+	return exitCode
+}
+
+func (cons *Exec) enqueue(data []byte, stream string, exitCode string) {
+	metaData := core.Metadata{}
+	metaData.SetValue("command", []byte(cons.command))
+	metaData.SetValue("stream", []byte(stream))
+	if exitCode != "" {
+		metaData.SetValue("exit_code", []byte(exitCode))
+	}
+	cons.EnqueueWithMetadata(data, metaData)
+}
+
+// execScanLines works like bufio.ScanLines but splits lines longer than
+// maxSize instead of failing.
+func execScanLines(maxSize int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && token == nil && err == nil && len(data) >= maxSize {
+			return maxSize, data[:maxSize], nil
+		}
+		return advance, token, err
+	}
+}
@@ -0,0 +1,726 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+)
+
+const (
+	fileTailReadSize      = 64 << 10
+	fileTailMaxReadPerRun = 1 << 20
+	fileTailModeStart     = "start"
+	fileTailModeContinue  = "continue"
+)
+
+// FileTail consumer plugin
+//
+// The FileTail consumer follows all files matching a set of glob patterns and
+// creates a message for each delimited entry. Files are tracked by their
+// identity (device and inode) instead of their name, so rotated files are
+// read to the end before they are released, while the file created in their
+// place is picked up from the beginning. Truncated files are read again from
+// the start. Read offsets can be persisted to a registry file so that
+// reading continues where it stopped after a restart. Entries spanning
+// multiple lines, like stack traces, can be joined into a single message.
+//
+// Metadata
+//
+// - path: The full path of the consumed file (set)
+//
+// - file: The file name of the consumed file (set)
+//
+// - dir: The directory of the consumed file (set)
+//
+// Parameters
+//
+// - Files: Defines a list of glob patterns matching the files to read.
+// By default this parameter is set to "/var/log/*.log".
+//
+// - Exclude: Defines a list of glob patterns matched against the full path
+// of each file found. Matching files are ignored.
+// By default this parameter is set to an empty list.
+//
+// - RegistryFile: Defines the path to a file that stores the read offset of
+// every tracked file. If set to "", offsets are not persisted.
+// By default this parameter is set to "".
+//
+// - RegistryFlushMs: Defines the minimum number of milliseconds between two
+// writes of the registry file.
+// By default this parameter is set to 1000.
+//
+// - DefaultOffset: Defines where to start reading files found during the
+// first scan that are not known to the registry. Valid values are "oldest"
+// and "newest". Files found by later scans are always read from the start.
+// By default this parameter is set to "newest".
+//
+// - Delimiter: Defines the delimiter sequence to expect at the end of each
+// entry.
+// By default this parameter is set to "\n".
+//
+// - ScanIntervalSec: Defines the number of seconds between two scans for new,
+// rotated or removed files.
+// By default this parameter is set to 10.
+//
+// - PollingDelayMs: Defines the number of milliseconds to wait when no file
+// has new content.
+// By default this parameter is set to 250.
+//
+// - CloseInactiveSec: Defines the number of seconds after which the handle of
+// a file without new content is closed. The file is opened again as soon as
+// a scan detects new content. Set to 0 to keep files open.
+// By default this parameter is set to 300.
+//
+// - MaxMessageSizeKB: Defines the maximum size of a message. Longer entries
+// are split.
+// By default this parameter is set to 1024.
+//
+// - Multiline/Pattern: Defines a regular expression used to join multiple
+// entries into one message. If set to "", every entry is a message.
+// By default this parameter is set to "".
+//
+// - Multiline/Mode: Defines the meaning of Multiline/Pattern. If set to
+// "start", matching entries start a new message and all other entries are
+// appended to the previous one. If set to "continue", matching entries are
+// appended to the previous message and all other entries start a new one.
+// By default this parameter is set to "start".
+//
+// - Multiline/MaxLines: Defines the maximum number of entries joined into a
+// single message.
+// By default this parameter is set to 500.
+//
+// - Multiline/TimeoutMs: Defines the number of milliseconds after which a
+// joined message is sent if no further entry arrived.
+// By default this parameter is set to 1000.
+//
+// Examples
+//
+// This example follows all application logs, joins Java stack traces with
+// the log entry they belong to and continues reading after a restart:
+//
+//  AppLogs:
+//    Type: consumer.FileTail
+//    Streams: app_logs
+//    Files:
+//      - /var/log/app/*.log
+//      - /var/log/app/*.log.1
+//    Exclude:
+//      - "*debug*"
+//    RegistryFile: /var/lib/gollum/filetail.json
+//    DefaultOffset: oldest
+//    Multiline:
+//      Pattern: "^\\d{4}-\\d{2}-\\d{2}"
+//      Mode: start
+type FileTail struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	registryFile     string        `config:"RegistryFile"`
+	registryInterval time.Duration `config:"RegistryFlushMs" default:"1000" metric:"ms"`
+	defaultOffset    string        `config:"DefaultOffset" default:"newest"`
+	delimiter        string        `config:"Delimiter" default:"\n"`
+	scanInterval     time.Duration `config:"ScanIntervalSec" default:"10" metric:"sec"`
+	pollingDelay     time.Duration `config:"PollingDelayMs" default:"250" metric:"ms"`
+	closeInactive    time.Duration `config:"CloseInactiveSec" default:"300" metric:"sec"`
+	maxMessageSize   int           `config:"MaxMessageSizeKB" default:"1024" metric:"kb"`
+	multilineMode    string        `config:"Multiline/Mode" default:"start"`
+	multilineMax     int           `config:"Multiline/MaxLines" default:"500"`
+	multilineTimeout time.Duration `config:"Multiline/TimeoutMs" default:"1000" metric:"ms"`
+
+	patterns       []string
+	exclude        []string
+	multiline      *regexp.Regexp
+	files          map[string]*tailedFile
+	registry       map[string]fileTailEntry
+	registryDirty  bool
+	lastRegistry   time.Time
+	lastScan       time.Time
+	firstScan      bool
+	rescan         chan struct{}
+	stop           chan struct{}
+	stopped        chan struct{}
+	printScanError bool
+
+	// decode extracts the payload and metadata of an entry. If false is
+	// returned, the entry is a fragment that is completed by later entries.
+	decode func(tracked *tailedFile, entry []byte) ([]byte, core.Metadata, bool)
+	// describe returns the metadata of messages read from a file.
+	describe func(tracked *tailedFile) core.Metadata
+}
+
+// fileTailEntry is the registry record of a tracked file.
+type fileTailEntry struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+}
+
+// tailedFile holds the read state of a tracked file.
+type tailedFile struct {
+	id        string
+	path      string
+	file      *os.File
+	offset    int64 // position of the next byte to read
+	committed int64 // position after the last byte sent
+	partial   []byte
+	fragments []byte
+	pending   [][]byte
+	pendMeta  core.Metadata
+	pendingAt int64 // position after the last pending entry
+	lastEntry time.Time
+	lastRead  time.Time
+	orphaned  bool
+}
+
+func init() {
+	core.TypeRegistry.Register(FileTail{})
+}
+
+// rewind resets the read state after the file was truncated.
+func (tracked *tailedFile) rewind() {
+	tracked.offset = 0
+	tracked.committed = 0
+	tracked.partial = nil
+	tracked.fragments = nil
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *FileTail) Configure(conf core.PluginConfigReader) {
+	cons.SetRollCallback(cons.onRoll)
+	cons.SetPrepareStopCallback(cons.prepareStop)
+
+	cons.patterns = conf.GetStringArray("Files", []string{"/var/log/*.log"})
+	cons.exclude = conf.GetStringArray("Exclude", []string{})
+	cons.files = make(map[string]*tailedFile)
+	cons.registry = make(map[string]fileTailEntry)
+	cons.firstScan = true
+	cons.printScanError = true
+	cons.describe = fileTailMetadata
+	cons.rescan = make(chan struct{}, 1)
+	cons.stop = make(chan struct{})
+	cons.stopped = make(chan struct{})
+
+	for _, pattern := range append(append([]string{}, cons.patterns...), cons.exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			conf.Errors.Pushf("Invalid glob pattern '%s': %s", pattern, err)
+		}
+	}
+
+	switch strings.ToLower(cons.defaultOffset) {
+	case fileOffsetStart, fileOffsetEnd:
+		cons.defaultOffset = strings.ToLower(cons.defaultOffset)
+	default:
+		conf.Errors.Pushf("DefaultOffset must be one of %s or %s", fileOffsetStart, fileOffsetEnd)
+	}
+
+	if cons.delimiter == "" {
+		conf.Errors.Pushf("Delimiter must not be empty")
+	}
+
+	if pattern := conf.GetString("Multiline/Pattern", ""); pattern != "" {
+		expression, err := regexp.Compile(pattern)
+		if !conf.Errors.Push(err) {
+			cons.multiline = expression
+		}
+	}
+
+	switch cons.multilineMode {
+	case fileTailModeStart, fileTailModeContinue:
+	default:
+		conf.Errors.Pushf("Multiline/Mode must be one of %s or %s", fileTailModeStart, fileTailModeContinue)
+	}
+
+	if cons.multilineMax < 1 {
+		cons.multilineMax = 1
+	}
+	if cons.maxMessageSize < len(cons.delimiter) {
+		cons.maxMessageSize = fileTailReadSize
+	}
+}
+
+// Consume follows the configured files until the consumer is stopped.
+func (cons *FileTail) Consume(workers *sync.WaitGroup) {
+	cons.loadRegistry()
+
+	go tgo.WithRecoverShutdown(func() {
+		cons.AddMainWorker(workers)
+		cons.tail()
+	})
+
+	cons.ControlLoop()
+}
+
+func (cons *FileTail) onRoll() {
+	select {
+	case cons.rescan <- struct{}{}:
+	default:
+	}
+}
+
+func (cons *FileTail) prepareStop() {
+	close(cons.stop)
+	<-cons.stopped
+}
+
+func (cons *FileTail) tail() {
+	defer cons.WorkerDone()
+	defer close(cons.stopped)
+	defer cons.close()
+
+	for {
+		if cons.firstScan || time.Since(cons.lastScan) >= cons.scanInterval {
+			cons.scan()
+		}
+
+		hasRead := false
+		for _, id := range cons.sortedFileIDs() {
+			if cons.readFile(cons.files[id]) {
+				hasRead = true
+			}
+		}
+
+		cons.flushExpired()
+		if time.Since(cons.lastRegistry) >= cons.registryInterval {
+			cons.storeRegistry()
+		}
+
+		if hasRead {
+			select {
+			case <-cons.stop:
+				return // ### return, stopped ###
+			default:
+				continue // ### continue, more data might be available ###
+			}
+		}
+
+		select {
+		case <-cons.stop:
+			return // ### return, stopped ###
+		case <-cons.rescan:
+			cons.scan()
+		case <-time.After(cons.pollingDelay):
+		}
+	}
+}
+
+func (cons *FileTail) close() {
+	for _, id := range cons.sortedFileIDs() {
+		tracked := cons.files[id]
+		cons.flushPending(tracked)
+		if tracked.file != nil {
+			tracked.file.Close()
+			tracked.file = nil
+		}
+	}
+	cons.storeRegistry()
+}
+
+func (cons *FileTail) sortedFileIDs() []string {
+	ids := make([]string, 0, len(cons.files))
+	for id := range cons.files {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// -- scanning --
+
+func (cons *FileTail) isExcluded(path string) bool {
+	for _, pattern := range cons.exclude {
+		if match, _ := filepath.Match(pattern, path); match {
+			return true
+		}
+		if match, _ := filepath.Match(pattern, filepath.Base(path)); match {
+			return true
+		}
+	}
+	return false
+}
+
+func (cons *FileTail) matchingFiles() map[string]os.FileInfo {
+	matches := make(map[string]os.FileInfo)
+	for _, pattern := range cons.patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to scan %s", pattern)
+			continue
+		}
+		for _, path := range paths {
+			if absPath, err := filepath.Abs(path); err == nil {
+				path = absPath
+			}
+			if cons.isExcluded(path) {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			matches[path] = info
+		}
+	}
+	return matches
+}
+
+// scan matches the configured patterns against the file system. New files
+// are tracked, files that moved out of the patterns are marked as orphaned
+// and closed files with new content are reopened.
+func (cons *FileTail) scan() {
+	defer func() {
+		cons.firstScan = false
+		cons.lastScan = time.Now()
+	}()
+
+	found := make(map[string]bool)
+	for path, info := range cons.matchingFiles() {
+		id, err := fileTailID(path, info)
+		if err != nil {
+			if cons.printScanError {
+				cons.Logger.WithError(err).Warningf("Failed to identify %s", path)
+				cons.printScanError = false
+			}
+			continue
+		}
+		found[id] = true
+
+		tracked, known := cons.files[id]
+		if !known {
+			cons.track(id, path, info)
+			continue
+		}
+
+		if tracked.path != path {
+			cons.Logger.Debugf("%s was renamed to %s", tracked.path, path)
+			tracked.path = path
+			cons.registryDirty = true
+		}
+		tracked.orphaned = false
+
+		if tracked.file == nil && info.Size() != tracked.offset {
+			cons.open(tracked)
+		}
+	}
+
+	for id, tracked := range cons.files {
+		if !found[id] {
+			tracked.orphaned = true
+			if tracked.file == nil {
+				cons.release(tracked)
+			}
+		}
+	}
+}
+
+func (cons *FileTail) track(id, path string, info os.FileInfo) {
+	tracked := &tailedFile{
+		id:       id,
+		path:     path,
+		lastRead: time.Now(),
+	}
+
+	switch entry, known := cons.registry[id]; {
+	case known && entry.Offset <= info.Size():
+		tracked.offset = entry.Offset
+	case known:
+		cons.Logger.Infof("%s is smaller than the stored offset, reading from start", path)
+	case cons.firstScan && cons.defaultOffset == fileOffsetEnd:
+		tracked.offset = info.Size()
+	}
+	tracked.committed = tracked.offset
+
+	cons.Logger.WithField("offset", tracked.offset).Infof("Following %s", path)
+	cons.files[id] = tracked
+	cons.registryDirty = true
+	cons.open(tracked)
+}
+
+func (cons *FileTail) open(tracked *tailedFile) {
+	file, err := os.Open(tracked.path)
+	if err != nil {
+		cons.Logger.WithError(err).Warningf("Failed to open %s", tracked.path)
+		return
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		cons.Logger.WithError(err).Warningf("Failed to open %s", tracked.path)
+		return
+	}
+
+	// The path might point to a different file since the last scan
+	if id, err := fileTailID(tracked.path, info); err != nil || id != tracked.id {
+		file.Close()
+		return
+	}
+
+	if info.Size() < tracked.offset {
+		cons.Logger.Infof("%s was truncated, reading from start", tracked.path)
+		tracked.rewind()
+	}
+
+	if _, err := file.Seek(tracked.offset, io.SeekStart); err != nil {
+		file.Close()
+		cons.Logger.WithError(err).Warningf("Failed to seek in %s", tracked.path)
+		return
+	}
+
+	tracked.file = file
+	tracked.lastRead = time.Now()
+}
+
+// release stops tracking a file. Incomplete entries are sent.
+func (cons *FileTail) release(tracked *tailedFile) {
+	if len(tracked.partial) > 0 {
+		cons.appendEntry(tracked, tracked.partial, tracked.offset)
+		tracked.partial = nil
+	}
+	cons.flushPending(tracked)
+
+	if tracked.file != nil {
+		tracked.file.Close()
+	}
+	cons.Logger.Infof("Stopped following %s", tracked.path)
+	delete(cons.files, tracked.id)
+	cons.registryDirty = true
+}
+
+// -- reading --
+
+// readFile reads new content of a file and returns true if data was read.
+func (cons *FileTail) readFile(tracked *tailedFile) bool {
+	if tracked.file == nil {
+		return false
+	}
+
+	buffer := make([]byte, fileTailReadSize)
+	totalRead := 0
+
+	for totalRead < fileTailMaxReadPerRun {
+		size, err := tracked.file.Read(buffer)
+		if size > 0 {
+			totalRead += size
+			tracked.offset += int64(size)
+			cons.split(tracked, buffer[:size])
+		}
+
+		switch {
+		case err == nil:
+			continue
+		case err == io.EOF:
+			cons.onEOF(tracked)
+		default:
+			cons.Logger.WithError(err).Errorf("Failed to read %s", tracked.path)
+			tracked.file.Close()
+			tracked.file = nil
+		}
+		break
+	}
+
+	if totalRead > 0 {
+		tracked.lastRead = time.Now()
+		return true
+	}
+	return false
+}
+
+func (cons *FileTail) onEOF(tracked *tailedFile) {
+	if info, err := tracked.file.Stat(); err == nil && info.Size() < tracked.offset {
+		cons.Logger.Infof("%s was truncated, reading from start", tracked.path)
+		tracked.file.Seek(0, io.SeekStart)
+		tracked.rewind()
+		cons.registryDirty = true
+		return
+	}
+
+	switch {
+	case tracked.orphaned:
+		cons.release(tracked)
+
+	case cons.closeInactive > 0 && time.Since(tracked.lastRead) > cons.closeInactive:
+		cons.Logger.Debugf("Closing inactive file %s", tracked.path)
+		tracked.file.Close()
+		tracked.file = nil
+	}
+}
+
+// split separates the given data into delimited entries.
+func (cons *FileTail) split(tracked *tailedFile, data []byte) {
+	delimiter := []byte(cons.delimiter)
+	entryEnd := tracked.offset - int64(len(data)) - int64(len(tracked.partial))
+	tracked.partial = append(tracked.partial, data...)
+
+	for {
+		idx := bytes.Index(tracked.partial, delimiter)
+		if idx == -1 {
+			break
+		}
+		entryEnd += int64(idx + len(delimiter))
+		cons.appendEntry(tracked, tracked.partial[:idx], entryEnd)
+		tracked.partial = tracked.partial[idx+len(delimiter):]
+	}
+
+	for len(tracked.partial) >= cons.maxMessageSize {
+		entryEnd += int64(cons.maxMessageSize)
+		cons.appendEntry(tracked, tracked.partial[:cons.maxMessageSize], entryEnd)
+		tracked.partial = tracked.partial[cons.maxMessageSize:]
+	}
+
+	// Don't keep the read buffer alive
+	tracked.partial = append([]byte{}, tracked.partial...)
+}
+
+// appendEntry passes an entry ending at the given offset to multiline
+// joining or sends it directly.
+func (cons *FileTail) appendEntry(tracked *tailedFile, entry []byte, entryEnd int64) {
+	entry = append([]byte{}, entry...)
+
+	var entryMeta core.Metadata
+	if cons.decode != nil {
+		var isComplete bool
+		if entry, entryMeta, isComplete = cons.decode(tracked, entry); !isComplete {
+			return // ### return, fragment ###
+		}
+	}
+
+	if cons.multiline == nil {
+		cons.enqueue(tracked, entry, entryMeta)
+		tracked.committed = entryEnd
+		cons.registryDirty = true
+		return
+	}
+
+	isContinuation := cons.multiline.Match(entry)
+	if cons.multilineMode == fileTailModeStart {
+		isContinuation = !isContinuation
+	}
+
+	if !isContinuation || len(tracked.pending) >= cons.multilineMax {
+		cons.flushPending(tracked)
+	}
+
+	if len(tracked.pending) == 0 {
+		tracked.pendMeta = entryMeta
+	}
+	tracked.pending = append(tracked.pending, entry)
+	tracked.pendingAt = entryEnd
+	tracked.lastEntry = time.Now()
+}
+
+func (cons *FileTail) flushPending(tracked *tailedFile) {
+	if len(tracked.pending) == 0 {
+		return
+	}
+	cons.enqueue(tracked, bytes.Join(tracked.pending, []byte(cons.delimiter)), tracked.pendMeta)
+	tracked.pending = nil
+	tracked.pendMeta = nil
+	tracked.committed = tracked.pendingAt
+	cons.registryDirty = true
+}
+
+func (cons *FileTail) flushExpired() {
+	for _, id := range cons.sortedFileIDs() {
+		tracked := cons.files[id]
+		if len(tracked.pending) > 0 && time.Since(tracked.lastEntry) >= cons.multilineTimeout {
+			cons.flushPending(tracked)
+		}
+	}
+}
+
+func (cons *FileTail) enqueue(tracked *tailedFile, data []byte, entryMeta core.Metadata) {
+	metaData := cons.describe(tracked)
+	for key, value := range entryMeta {
+		metaData.SetValue(key, value)
+	}
+	cons.EnqueueWithMetadata(data, metaData)
+}
+
+func fileTailMetadata(tracked *tailedFile) core.Metadata {
+	metaData := core.Metadata{}
+	dir, file := filepath.Split(tracked.path)
+	metaData.SetValue("path", []byte(tracked.path))
+	metaData.SetValue("file", []byte(file))
+	metaData.SetValue("dir", []byte(dir))
+	return metaData
+}
+
+// -- registry --
+
+func (cons *FileTail) loadRegistry() {
+	if cons.registryFile == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(cons.registryFile)
+	switch {
+	case os.IsNotExist(err):
+		return
+	case err != nil:
+		cons.Logger.WithError(err).Error("Failed to read registry")
+		return
+	}
+
+	if err := json.Unmarshal(data, &cons.registry); err != nil {
+		cons.Logger.WithError(err).Error("Failed to parse registry")
+	}
+}
+
+// storeRegistry writes the committed offsets of all tracked files. The file
+// is replaced atomically so that a crash never leaves a partial registry.
+func (cons *FileTail) storeRegistry() {
+	cons.lastRegistry = time.Now()
+	if cons.registryFile == "" || !cons.registryDirty {
+		return
+	}
+
+	registry := make(map[string]fileTailEntry, len(cons.files))
+	for id, tracked := range cons.files {
+		registry[id] = fileTailEntry{
+			Path:   tracked.path,
+			Offset: tracked.committed,
+		}
+	}
+
+	data, err := json.Marshal(registry)
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to encode registry")
+		return
+	}
+
+	tempFile := cons.registryFile + ".tmp"
+	if err := ioutil.WriteFile(tempFile, data, 0644); err != nil {
+		cons.Logger.WithError(err).Error("Failed to store registry")
+		return
+	}
+	if err := os.Rename(tempFile, cons.registryFile); err != nil {
+		cons.Logger.WithError(err).Error("Failed to store registry")
+		return
+	}
+
+	cons.registry = registry
+	cons.registryDirty = false
+}
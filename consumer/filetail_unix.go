@@ -0,0 +1,32 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package consumer
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileTailID returns a string identifying a file independent of its name.
+func fileTailID(path string, info os.FileInfo) (string, error) {
+	stat, isStat := info.Sys().(*syscall.Stat_t)
+	if !isStat {
+		return "", fmt.Errorf("no inode information for %s", path)
+	}
+	return fmt.Sprintf("%d:%d", uint64(stat.Dev), uint64(stat.Ino)), nil
+}
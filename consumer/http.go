@@ -16,22 +16,50 @@ package consumer
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/abbot/go-http-auth"
 	"github.com/trivago/gollum/core"
-	"github.com/trivago/tgo/tnet"
 )
 
 // HTTP consumer plugin
 //
 // This consumer opens up an HTTP 1.1 server and processes the contents of any
-// incoming HTTP request.
+// incoming HTTP request. Request bodies compressed with gzip or deflate are
+// decompressed as indicated by the Content-Encoding header.
+//
+// Requests can be authenticated by HTTP Basic Authentication, bearer tokens
+// and HMAC signatures. If more than one method is configured, a request has
+// to pass one of them. Requests failing authentication are answered with 401.
+//
+// If WaitForAck is set, the response is sent after all messages of a request
+// have been accepted by a producer. See core.Message.SetAckCallback for
+// details. Requests that are not accepted in time are answered with 503.
+//
+// Metadata
+//
+// - Metadata is set as configured by HeaderMetadata and QueryMetadata.
 //
 // Parameters
 //
@@ -40,6 +68,10 @@ import (
 //
 // Syntax: [hostname|address]:<port>
 //
+// To use a socket passed by systemd socket activation, set the address to
+// "systemd://<name>", where name is the FileDescriptorName of the socket or
+// its index.
+//
 // - ReadTimeoutSec: Defines the maximum duration in seconds before timing out
 // the HTTP read request. Sets http.Server.ReadTimeout; for details, see its
 // Go documentation.
@@ -60,6 +92,53 @@ import (
 // - PrivateKey: Path to an X509 formatted private key file. Meaningful only in
 // conjunction with Certificate.
 //
+// - BearerTokens: Defines a list of tokens accepted in an
+// "Authorization: Bearer <token>" header.
+// By default this parameter is set to an empty list.
+//
+// - HmacSecret: Defines the secret used to verify HMAC signatures of the
+// request body. The body is signed as sent, i.e. before decompression. If
+// empty, signatures are not verified.
+// By default this parameter is set to "".
+//
+// - HmacHeader: Defines the header holding the hex encoded signature. The
+// signature may be prefixed by the name of the algorithm and "=", e.g.
+// "sha256=...".
+// By default this parameter is set to "X-Signature".
+//
+// - HmacAlgorithm: Defines the hash function used for signatures. Valid values
+// are "sha1", "sha256" and "sha512".
+// By default this parameter is set to "sha256".
+//
+// - Split: Defines how a request body is split into multiple messages. This
+// setting requires WithHeaders to be false. By default this parameter is set
+// to "none". The following options are available:
+//  - "none": Each request becomes a single message.
+//  - "lines": Each non-empty line of the body becomes a message.
+//  - "json_array": The body has to be a JSON array. Each element becomes a message.
+//
+// - HeaderMetadata: Defines a map of request headers to metadata keys. The
+// value of each header is stored in the given metadata key.
+// By default this parameter is set to an empty map.
+//
+// - QueryMetadata: Defines a map of query parameters to metadata keys. The
+// value of each parameter is stored in the given metadata key.
+// By default this parameter is set to an empty map.
+//
+// - WaitForAck: If true, the response is withheld until all messages of the
+// request have been accepted by a producer. This is always enabled if one of
+// Streams is routed by a router with AtLeastOnce set.
+// By default this parameter is set to false.
+//
+// - AckTimeoutSec: Defines the number of seconds to wait for messages to be
+// accepted if WaitForAck is set. Requests timing out are answered with 503.
+// By default this parameter is set to 10.
+//
+// - MaxBodySizeKB: Defines the maximum size of a request body. The limit is
+// applied to the body as sent and after decompression. Larger requests are
+// answered with 413.
+// By default this parameter is set to 10240.
+//
 // Examples
 //
 // This example listens on port 9090 and writes to the stream "http_in_00".
@@ -70,6 +149,33 @@ import (
 //     Address: "localhost:9090"
 //     WithHeaders: false
 //
+// This example accepts batches of JSON events signed by the sender, storing
+// the sending service in the metadata:
+//
+//   "HttpIn01":
+//     Type: "consumer.HTTP"
+//     Streams: "events"
+//     Address: ":9091"
+//     WithHeaders: false
+//     Split: "json_array"
+//     HmacSecret: "secret"
+//     HmacHeader: "X-Hub-Signature-256"
+//     HeaderMetadata:
+//       X-Service: "service"
+//     QueryMetadata:
+//       env: "environment"
+//
+// This example answers requests only after the messages have been passed to
+// the producer of the "orders" stream:
+//
+//   "HttpIn02":
+//     Type: "consumer.HTTP"
+//     Streams: "orders"
+//     Address: ":9092"
+//     WithHeaders: false
+//     WaitForAck: true
+//     AckTimeoutSec: 5
+//
 type HTTP struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
 	address             string        `config:"Address" default:":80"`
@@ -77,17 +183,31 @@ type HTTP struct {
 	withHeaders         bool          `config:"WithHeaders" default:"true"`
 	htpasswd            string        `config:"Htpasswd"`
 	basicRealm          string        `config:"BasicRealm"`
+	hmacSecret          string        `config:"HmacSecret"`
+	hmacHeader          string        `config:"HmacHeader" default:"X-Signature"`
+	split               string        `config:"Split" default:"none"`
+	waitForAck          bool          `config:"WaitForAck" default:"false"`
+	ackTimeout          time.Duration `config:"AckTimeoutSec" default:"10" metric:"sec"`
+	maxBodySize         int           `config:"MaxBodySizeKB" default:"10240" metric:"kb"`
 	secrets             auth.SecretProvider
-	listen              *tnet.StopListener
+	bearerTokens        []string
+	hmacHash            func() hash.Hash
+	headerMetadata      map[string]string
+	queryMetadata       map[string]string
+	listen              net.Listener
 	certificate         *tls.Config
 }
 
+var errHTTPBodyTooLarge = errors.New("request body exceeds MaxBodySizeKB")
+
 func init() {
 	core.TypeRegistry.Register(HTTP{})
 }
 
 // Configure initializes this consumer with values from a plugin config.
 func (cons *HTTP) Configure(conf core.PluginConfigReader) {
+	cons.waitForAck = cons.waitForAck || cons.IsAtLeastOnce()
+
 	if cons.htpasswd != "" {
 		if _, fileErr := os.Stat(cons.htpasswd); os.IsNotExist(fileErr) {
 			conf.Errors.Pushf("htpasswd file does not exist: %s", cons.htpasswd)
@@ -96,6 +216,33 @@ func (cons *HTTP) Configure(conf core.PluginConfigReader) {
 		cons.secrets = auth.HtpasswdFileProvider(cons.htpasswd)
 	}
 
+	cons.bearerTokens = conf.GetStringArray("BearerTokens", []string{})
+	cons.headerMetadata = conf.GetStringMap("HeaderMetadata", map[string]string{})
+	cons.queryMetadata = conf.GetStringMap("QueryMetadata", map[string]string{})
+
+	hmacAlgorithm := conf.GetString("HmacAlgorithm", "sha256")
+	switch strings.ToLower(hmacAlgorithm) {
+	case "sha1":
+		cons.hmacHash = sha1.New
+	case "sha256":
+		cons.hmacHash = sha256.New
+	case "sha512":
+		cons.hmacHash = sha512.New
+	default:
+		conf.Errors.Pushf("Unknown HmacAlgorithm: %s", hmacAlgorithm)
+	}
+
+	cons.split = strings.ToLower(cons.split)
+	switch cons.split {
+	case "none":
+	case "lines", "json_array":
+		if cons.withHeaders {
+			conf.Errors.Pushf("Split requires WithHeaders to be false")
+		}
+	default:
+		conf.Errors.Pushf("Unknown Split method: %s", cons.split)
+	}
+
 	certificateFile := conf.GetString("Certificate", "")
 	keyFile := conf.GetString("PrivateKey", "")
 
@@ -120,44 +267,252 @@ func (cons *HTTP) checkAuth(r *http.Request) bool {
 	return a.CheckAuth(r) != ""
 }
 
+func (cons *HTTP) hasAuth() bool {
+	return cons.htpasswd != "" || len(cons.bearerTokens) > 0 || cons.hmacSecret != ""
+}
+
+// isAuthorized returns true if the request passes one of the configured
+// authentication methods.
+func (cons *HTTP) isAuthorized(req *http.Request, body []byte) bool {
+	if cons.htpasswd != "" && cons.checkAuth(req) {
+		return true
+	}
+
+	if len(cons.bearerTokens) > 0 {
+		authHeader := req.Header.Get("Authorization")
+		if len(authHeader) > 7 && strings.EqualFold(authHeader[:7], "Bearer ") {
+			token := []byte(strings.TrimSpace(authHeader[7:]))
+			for _, validToken := range cons.bearerTokens {
+				if subtle.ConstantTimeCompare(token, []byte(validToken)) == 1 {
+					return true
+				}
+			}
+		}
+	}
+
+	if cons.hmacSecret != "" {
+		signature := req.Header.Get(cons.hmacHeader)
+		if sepIdx := strings.IndexByte(signature, '='); sepIdx >= 0 {
+			signature = signature[sepIdx+1:]
+		}
+		if expected, err := hex.DecodeString(signature); err == nil {
+			mac := hmac.New(cons.hmacHash, []byte(cons.hmacSecret))
+			mac.Write(body)
+			if hmac.Equal(mac.Sum(nil), expected) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// decompress returns the body decoded as given by the Content-Encoding header.
+func (cons *HTTP) decompress(req *http.Request, body []byte) ([]byte, error) {
+	var reader io.Reader
+	switch encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return body, nil // ### return, not compressed ###
+
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		reader = gzipReader
+
+	case "deflate":
+		// Some clients send raw deflate data instead of zlib wrapped data
+		zlibReader, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(body))
+		} else {
+			reader = zlibReader
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding: %s", encoding)
+	}
+
+	return cons.readBody(reader)
+}
+
+// readBody reads the given reader up to MaxBodySizeKB. If the reader returns
+// more data errHTTPBodyTooLarge is returned.
+func (cons *HTTP) readBody(reader io.Reader) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(reader, int64(cons.maxBodySize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > cons.maxBodySize {
+		return nil, errHTTPBodyTooLarge
+	}
+	return body, nil
+}
+
+// splitBody splits a request body into messages as configured by Split.
+func (cons *HTTP) splitBody(body []byte) ([][]byte, error) {
+	switch cons.split {
+	case "lines":
+		messages := [][]byte{}
+		for _, line := range bytes.Split(body, []byte{'\n'}) {
+			if line = bytes.TrimRight(line, "\r"); len(line) > 0 {
+				messages = append(messages, line)
+			}
+		}
+		return messages, nil
+
+	case "json_array":
+		elements := []json.RawMessage{}
+		if err := json.Unmarshal(body, &elements); err != nil {
+			return nil, err
+		}
+		messages := make([][]byte, 0, len(elements))
+		for _, element := range elements {
+			messages = append(messages, []byte(element))
+		}
+		return messages, nil
+
+	default:
+		return [][]byte{body}, nil
+	}
+}
+
+// getMetadata returns the metadata configured by HeaderMetadata and
+// QueryMetadata.
+func (cons *HTTP) getMetadata(req *http.Request) core.Metadata {
+	if len(cons.headerMetadata) == 0 && len(cons.queryMetadata) == 0 {
+		return nil
+	}
+
+	metaData := core.Metadata{}
+	for header, key := range cons.headerMetadata {
+		if value := req.Header.Get(header); value != "" {
+			metaData.SetValue(key, []byte(value))
+		}
+	}
+
+	query := req.URL.Query()
+	for param, key := range cons.queryMetadata {
+		if value := query.Get(param); value != "" {
+			metaData.SetValue(key, []byte(value))
+		}
+	}
+	return metaData
+}
+
 // requestHandler will handle a single web request.
 func (cons *HTTP) requestHandler(resp http.ResponseWriter, req *http.Request) {
-	if cons.htpasswd != "" {
-		if !cons.checkAuth(req) {
-			resp.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	if req.Body == nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return // ### return, missing body ###
 	}
 
+	body, err := cons.readBody(req.Body)
+	req.Body.Close()
+	if err == errHTTPBodyTooLarge {
+		resp.WriteHeader(http.StatusRequestEntityTooLarge)
+		return // ### return, body too large ###
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		cons.Logger.Error(err)
+		return // ### return, missing body or bad write ###
+	}
+
+	if cons.hasAuth() && !cons.isAuthorized(req, body) {
+		resp.WriteHeader(http.StatusUnauthorized)
+		return // ### return, not authorized ###
+	}
+
+	body, err = cons.decompress(req, body)
+	if err == errHTTPBodyTooLarge {
+		resp.WriteHeader(http.StatusRequestEntityTooLarge)
+		cons.Logger.Warning("Decompressed request body exceeds MaxBodySizeKB")
+		return // ### return, body too large ###
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusUnsupportedMediaType)
+		cons.Logger.WithError(err).Warning("Failed to decompress request body")
+		return // ### return, bad encoding ###
+	}
+
+	var messages [][]byte
 	if cons.withHeaders {
 		// Read the whole package
+		req.Header.Del("Content-Encoding")
+		req.ContentLength = int64(len(body))
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
 		requestBuffer := bytes.NewBuffer(nil)
 		if err := req.Write(requestBuffer); err != nil {
 			resp.WriteHeader(http.StatusBadRequest)
 			cons.Logger.Error(err)
 			return // ### return, missing body or bad write ###
 		}
-
-		cons.Enqueue(requestBuffer.Bytes())
-		resp.WriteHeader(http.StatusOK)
+		messages = [][]byte{requestBuffer.Bytes()}
 	} else {
 		// Read only the message body
-		if req.Body == nil {
+		if messages, err = cons.splitBody(body); err != nil {
 			resp.WriteHeader(http.StatusBadRequest)
-			return // ### return, missing body ###
+			cons.Logger.WithError(err).Warning("Failed to split request body")
+			return // ### return, malformed body ###
 		}
+	}
 
-		body, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			resp.WriteHeader(http.StatusBadRequest)
-			cons.Logger.Error(err)
-			return // ### return, missing body or bad write ###
+	metaData := cons.getMetadata(req)
+	if cons.waitForAck {
+		if !cons.enqueueAndWait(messages, metaData) {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return // ### return, not accepted ###
 		}
-		defer req.Body.Close()
-
-		cons.Enqueue(body)
 		resp.WriteHeader(http.StatusOK)
+		return
+	}
+
+	for _, message := range messages {
+		if metaData == nil {
+			cons.Enqueue(message)
+		} else {
+			cons.EnqueueWithMetadata(message, metaData.Clone())
+		}
 	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+// enqueueAndWait enqueues all messages and waits until they have been
+// accepted by a producer. False is returned if a message was lost or if the
+// messages were not accepted in time.
+func (cons *HTTP) enqueueAndWait(messages [][]byte, metaData core.Metadata) bool {
+	results := make(chan bool, len(messages))
+	onAck := func(acked bool) {
+		results <- acked
+	}
+
+	for _, message := range messages {
+		if metaData == nil {
+			cons.EnqueueWithAck(message, nil, onAck)
+		} else {
+			cons.EnqueueWithAck(message, metaData.Clone(), onAck)
+		}
+	}
+
+	timeout := time.NewTimer(cons.ackTimeout)
+	defer timeout.Stop()
+
+	for range messages {
+		select {
+		case acked := <-results:
+			if !acked {
+				cons.Logger.Warning("Message of request has been lost")
+				return false // ### return, lost ###
+			}
+		case <-timeout.C:
+			cons.Logger.Warning("Timed out waiting for messages to be accepted")
+			return false // ### return, timeout ###
+		}
+	}
+	return true
 }
 
 func (cons *HTTP) serve() {
@@ -170,15 +525,22 @@ func (cons *HTTP) serve() {
 		TLSConfig:   cons.certificate,
 	}
 
-	err := srv.Serve(cons.listen)
-	if _, isStopRequest := err.(tnet.StopRequestError); err != nil && !isStopRequest {
+	// Errors caused by closing the listener on shutdown are ignored
+	if err := srv.Serve(cons.listen); err != nil && cons.IsActive() {
 		cons.Logger.Error(err)
 	}
 }
 
+func (cons *HTTP) openListener() (net.Listener, error) {
+	if name, isActivated := parseSocketActivationAddress(cons.address); isActivated {
+		return socketActivationListener(name)
+	}
+	return net.Listen("tcp", cons.address)
+}
+
 // Consume opens a new http server listen on specified ip and port (address)
 func (cons HTTP) Consume(workers *sync.WaitGroup) {
-	listen, err := tnet.NewStopListener(cons.address)
+	listen, err := cons.openListener()
 	if err != nil {
 		cons.Logger.Error(err)
 		return // ### return, could not connect ###
@@ -0,0 +1,62 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestHTTPMaxBodySize(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("", "consumer.HTTP")
+	conf.Override("Streams", "httpMaxBodySize")
+	conf.Override("WithHeaders", false)
+	conf.Override("MaxBodySizeKB", 1)
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	cons, casted := plugin.(*HTTP)
+	expect.True(casted)
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(make([]byte, 2048)))
+	resp := httptest.NewRecorder()
+	cons.requestHandler(resp, req)
+	expect.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+
+	// A small body decompressing to more than MaxBodySizeKB
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(make([]byte, 256*1024))
+	writer.Close()
+	expect.Less(compressed.Len(), 1024)
+
+	req = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compressed.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	resp = httptest.NewRecorder()
+	cons.requestHandler(resp, req)
+	expect.Equal(http.StatusRequestEntityTooLarge, resp.Code)
+
+	body, err := cons.readBody(bytes.NewReader(make([]byte, 1024)))
+	expect.NoError(err)
+	expect.Equal(1024, len(body))
+}
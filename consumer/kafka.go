@@ -30,6 +30,7 @@ import (
 	kafka "github.com/Shopify/sarama"
 	cluster "github.com/bsm/sarama-cluster"
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
 	"github.com/trivago/tgo/tsync"
 )
 
@@ -51,6 +52,14 @@ const (
 //
 // - key: Contains the key of the kafka message
 //
+// - partition: Contains the partition the message was read from
+//
+// - offset: Contains the offset of the message
+//
+// - Record headers are stored using the header name as key. Headers named
+// like one of the fields above are overwritten by these fields. Headers
+// require Version to be set to at least "0.11".
+//
 // Parameters
 //
 // - Servers: Defines the list of all kafka brokers to initially connect to when
@@ -95,6 +104,15 @@ const (
 // - FolderPermissions: Used to create the path to the offset file if necessary.
 // By default this parameter is set to "0755".
 //
+// - CommitAfterAck: If set to true, offsets are only committed, respectively
+// written to OffsetFile, after the messages have been accepted by a producer.
+// See core.Message.SetAckCallback. Offsets advance only up to the first
+// message not accepted yet, so messages that are lost after they have been read
+// are read again after a restart. If a message is never accepted, the offset of
+// its partition does not advance until the consumer is restarted. This is
+// always enabled if one of Streams is routed by a router with AtLeastOnce set.
+// By default this parameter is set to false.
+//
 // - Ordered: Forces partitions to be read one-by-one in a round robin fashion
 // instead of reading them all in parallel. Please note that this may restore
 // the original ordering but does not necessarily do so. The term "ordered" refers
@@ -150,7 +168,8 @@ const (
 // By default this parameter is set to false.
 //
 // - TlsKeyLocation: Defines the path to the client's PEM-formatted private key
-// used for TLS based authentication.
+// used for TLS based authentication. Requires TlsCertificateLocation to be
+// set, too.
 // By default this parameter is set to "".
 //
 // - TlsCertificateLocation: Defines the path to the client's PEM-formatted
@@ -158,7 +177,8 @@ const (
 // By default this parameter is set to "".
 //
 // - TlsCaLocation: Defines the path to the CA certificate(s) for verifying a
-// broker's key when using TLS based authentication.
+// broker's key when using TLS based authentication. If not set, the system's
+// root certificates are used.
 // By default this parameter is set to "".
 //
 // - TlsServerName: Defines the expected hostname used by hostname verification
@@ -173,10 +193,37 @@ const (
 // communicating with brokers.
 // By default this parameter is set to false.
 //
-// - SaslUsername: Defines the username for SASL/PLAIN authentication.
+// - SaslUsername: Defines the username for SASL/PLAIN and SASL/SCRAM
+// authentication.
 // By default this parameter is set to "gollum".
 //
-// - SaslPassword: Defines the password for SASL/PLAIN authentication.
+// - SaslPassword: Defines the password for SASL/PLAIN and SASL/SCRAM
+// authentication.
+// By default this parameter is set to "".
+//
+// - SaslMechanism: Defines the SASL mechanism to use. Valid values are
+// "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512" and "OAUTHBEARER". SCRAM and
+// OAUTHBEARER require Version to be set to at least "1.0".
+// By default this parameter is set to "PLAIN".
+//
+// - SaslOAuthTokenURL: Defines the URL of an OAuth2 token endpoint used to
+// fetch access tokens for OAUTHBEARER via the client credentials flow.
+// Tokens are refreshed before they expire.
+// By default this parameter is set to "".
+//
+// - SaslOAuthClientID: Defines the client ID sent to SaslOAuthTokenURL.
+// By default this parameter is set to "".
+//
+// - SaslOAuthClientSecret: Defines the client secret sent to
+// SaslOAuthTokenURL.
+// By default this parameter is set to "".
+//
+// - SaslOAuthScopes: Defines the scopes requested from SaslOAuthTokenURL.
+// By default this parameter is set to an empty list.
+//
+// - SaslOAuthTokenFile: Defines a file containing the OAUTHBEARER access
+// token. The file is read on every new connection so it can be refreshed by
+// an external process. Ignored if SaslOAuthTokenURL is set.
 // By default this parameter is set to "".
 //
 // Examples
@@ -213,6 +260,54 @@ type Kafka struct {
 	MaxPartitionID      int32
 	orderedRead         bool `config:"Ordered"`
 	hasToSetMetadata    bool `config:"SetMetadata" default:"false"`
+	commitAfterAck      bool `config:"CommitAfterAck" default:"false"`
+	ackTrackers         map[int32]*kafkaAckTracker
+	ackGuard            *sync.Mutex
+}
+
+// kafkaAckTracker tracks the acknowledgment of messages read from a partition.
+type kafkaAckTracker struct {
+	guard   *sync.Mutex
+	pending []int64
+	acked   map[int64]bool
+}
+
+func newKafkaAckTracker() *kafkaAckTracker {
+	return &kafkaAckTracker{
+		guard: new(sync.Mutex),
+		acked: make(map[int64]bool),
+	}
+}
+
+// add registers an offset that has been read. If the offset is not larger
+// than the last one, the partition is read again from an earlier position and
+// all pending offsets are discarded.
+func (tracker *kafkaAckTracker) add(offset int64) {
+	tracker.guard.Lock()
+	defer tracker.guard.Unlock()
+
+	if numPending := len(tracker.pending); numPending > 0 && tracker.pending[numPending-1] >= offset {
+		tracker.pending = tracker.pending[:0]
+		tracker.acked = make(map[int64]bool)
+	}
+	tracker.pending = append(tracker.pending, offset)
+}
+
+// ack marks an offset as acknowledged. If all offsets up to and including a
+// given offset have been acknowledged, this offset is returned along with
+// true.
+func (tracker *kafkaAckTracker) ack(offset int64) (int64, bool) {
+	tracker.guard.Lock()
+	defer tracker.guard.Unlock()
+
+	tracker.acked[offset] = true
+	committed, advanced := int64(0), false
+	for len(tracker.pending) > 0 && tracker.acked[tracker.pending[0]] {
+		committed, advanced = tracker.pending[0], true
+		delete(tracker.acked, committed)
+		tracker.pending = tracker.pending[1:]
+	}
+	return committed, advanced
 }
 
 func init() {
@@ -222,7 +317,10 @@ func init() {
 // Configure initializes this consumer with values from a plugin config.
 func (cons *Kafka) Configure(conf core.PluginConfigReader) {
 	cons.offsets = make(map[int32]*int64)
+	cons.ackTrackers = make(map[int32]*kafkaAckTracker)
+	cons.ackGuard = new(sync.Mutex)
 	cons.MaxPartitionID = 0
+	cons.commitAfterAck = cons.commitAfterAck || cons.IsAtLeastOnce()
 
 	cons.config = kafka.NewConfig()
 	cons.config.ClientID = conf.GetString("ClientId", "gollum")
@@ -269,35 +367,33 @@ func (cons *Kafka) Configure(conf core.PluginConfigReader) {
 
 		keyFile := conf.GetString("TlsKeyLocation", "")
 		certFile := conf.GetString("TlsCertificateLocation", "")
-		if keyFile != "" && certFile != "" {
+		switch {
+		case keyFile != "" && certFile != "":
 			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 			if conf.Errors.Push(err) {
 				return
 			}
 			cons.config.Net.TLS.Config.Certificates = []tls.Certificate{cert}
-		} else if certFile == "" {
+		case keyFile != "":
 			conf.Errors.Pushf("Cannot specify TlsKeyLocation without TlsCertificateLocation")
 			return
-		} else if keyFile == "" {
+		case certFile != "":
 			conf.Errors.Pushf("Cannot specify TlsCertificateLocation without TlsKeyLocation")
 			return
 		}
 
-		caFile := conf.GetString("TlsCaLocation", "")
-		if caFile == "" {
-			conf.Errors.Pushf("TlsEnable is set to true, but no TlsCaLocation was specified")
-			return
-		}
+		// Without a CA file the system's root certificates are used
+		if caFile := conf.GetString("TlsCaLocation", ""); caFile != "" {
+			caCert, err := ioutil.ReadFile(caFile)
+			if conf.Errors.Push(err) {
+				return
+			}
 
-		caCert, err := ioutil.ReadFile(caFile)
-		if conf.Errors.Push(err) {
-			return
+			caCertPool := x509.NewCertPool()
+			caCertPool.AppendCertsFromPEM(caCert)
+			cons.config.Net.TLS.Config.RootCAs = caCertPool
 		}
 
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		cons.config.Net.TLS.Config.RootCAs = caCertPool
-
 		serverName := conf.GetString("TlsServerName", "")
 		if serverName != "" {
 			cons.config.Net.TLS.Config.ServerName = serverName
@@ -308,8 +404,9 @@ func (cons *Kafka) Configure(conf core.PluginConfigReader) {
 
 	cons.config.Net.SASL.Enable = conf.GetBool("SaslEnable", false)
 	if cons.config.Net.SASL.Enable {
-		cons.config.Net.SASL.User = conf.GetString("SaslUser", "gollum")
+		cons.config.Net.SASL.User = conf.GetString("SaslUsername", conf.GetString("SaslUser", "gollum"))
 		cons.config.Net.SASL.Password = conf.GetString("SaslPassword", "")
+		components.ConfigureKafkaSASLMechanism(conf, cons.config)
 	}
 
 	cons.config.Metadata.Retry.Max = int(conf.GetInt("ElectRetries", 3))
@@ -401,8 +498,9 @@ func (cons *Kafka) readFromGroup() {
 		select {
 		case event, ok := <-consumer.Messages():
 			if ok {
-				cons.enqueueEvent(event)
-				consumer.MarkOffset(event, "")
+				cons.enqueueEvent(event, func(partition int32, offset int64) {
+					consumer.MarkPartitionOffset(event.Topic, partition, offset, "")
+				})
 			}
 
 		case err := <-consumer.Errors():
@@ -465,8 +563,7 @@ func (cons *Kafka) readFromPartition(partitionID int32) {
 				continue
 			}
 
-			atomic.StoreInt64(cons.offsets[partitionID], event.Offset)
-			cons.enqueueEvent(event)
+			cons.enqueueEvent(event, cons.storeOffset)
 
 		case err := <-partCons.Errors():
 			cons.Logger.Error("Kafka consumer error:", err)
@@ -503,8 +600,7 @@ func (cons *Kafka) readPartitions(partitions []int32) {
 
 			select {
 			case event := <-consumer.Messages():
-				atomic.StoreInt64(cons.offsets[partition], event.Offset)
-				cons.enqueueEvent(event)
+				cons.enqueueEvent(event, cons.storeOffset)
 
 			case err := <-consumer.Errors():
 				cons.Logger.Error("Kafka consumer error:", err)
@@ -522,17 +618,64 @@ func (cons *Kafka) readPartitions(partitions []int32) {
 	}
 }
 
-func (cons *Kafka) enqueueEvent(event *kafka.ConsumerMessage) {
+// enqueueEvent enqueues a message read from kafka. The commit function is
+// called with the offset up to which all messages have been processed.
+func (cons *Kafka) enqueueEvent(event *kafka.ConsumerMessage, commit func(partition int32, offset int64)) {
+	var metaData core.Metadata
 	if cons.hasToSetMetadata {
-		metaData := core.Metadata{}
+		metaData = core.Metadata{}
+		for _, header := range event.Headers {
+			if header != nil {
+				metaData.SetValue(string(header.Key), header.Value)
+			}
+		}
 
 		metaData.SetValue("topic", []byte(event.Topic))
 		metaData.SetValue("key", event.Key)
+		metaData.SetValue("partition", []byte(strconv.Itoa(int(event.Partition))))
+		metaData.SetValue("offset", []byte(strconv.FormatInt(event.Offset, 10)))
+	}
 
-		cons.EnqueueWithMetadata(event.Value, metaData)
-	} else {
-		cons.SimpleConsumer.Enqueue(event.Value)
+	if !cons.commitAfterAck {
+		commit(event.Partition, event.Offset)
+		if metaData != nil {
+			cons.EnqueueWithMetadata(event.Value, metaData)
+		} else {
+			cons.SimpleConsumer.Enqueue(event.Value)
+		}
+		return // ### return, committed ###
+	}
+
+	tracker := cons.getAckTracker(event.Partition)
+	tracker.add(event.Offset)
+
+	partition, offset := event.Partition, event.Offset
+	cons.EnqueueWithAck(event.Value, metaData, func(acked bool) {
+		if !acked {
+			cons.Logger.Warningf("Message at offset %d of partition %d has been lost", offset, partition)
+			return
+		}
+		if committed, advanced := tracker.ack(offset); advanced {
+			commit(partition, committed)
+		}
+	})
+}
+
+func (cons *Kafka) getAckTracker(partition int32) *kafkaAckTracker {
+	cons.ackGuard.Lock()
+	defer cons.ackGuard.Unlock()
+
+	tracker, exists := cons.ackTrackers[partition]
+	if !exists {
+		tracker = newKafkaAckTracker()
+		cons.ackTrackers[partition] = tracker
 	}
+	return tracker
+}
+
+// storeOffset stores the offset of a partition for OffsetFile.
+func (cons *Kafka) storeOffset(partition int32, offset int64) {
+	atomic.StoreInt64(cons.offsets[partition], offset)
 }
 
 func (cons *Kafka) startReadTopic(topic string) {
@@ -0,0 +1,347 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+var (
+	kubernetesContainerLog = regexp.MustCompile(`([^/_]+)_([^/_]+)_([^/]+)-([0-9a-f]{64})\.log$`)
+	kubernetesPodLog       = regexp.MustCompile(`([^/_]+)_([^/_]+)_([0-9a-f-]+)/([^/]+)/[0-9]+\.log$`)
+)
+
+// Kubernetes consumer plugin
+//
+// The Kubernetes consumer reads the container log files written by the
+// kubelet on the local node. Both the CRI format and the json-file format of
+// the Docker runtime are supported. Lines that were split by the container
+// runtime are joined again. Messages are enriched with the namespace, pod and
+// container parsed from the file name and with pod labels and annotations
+// fetched from the API server. Pod data is cached.
+// All parameters of consumer.FileTail are supported, as this consumer uses
+// its file handling. Namespaces or pods can be ignored by using Exclude, e.g.
+// "*_kube-system_*".
+//
+// Metadata
+//
+// - namespace: The namespace of the pod (set)
+//
+// - pod: The name of the pod (set)
+//
+// - container: The name of the container (set)
+//
+// - container_id: The ID of the container, if part of the file name (set)
+//
+// - pod_uid: The UID of the pod (set)
+//
+// - node: The node the pod is scheduled on (set)
+//
+// - stream: Either "stdout" or "stderr" (set)
+//
+// - label_<name>: One key per selected pod label (set)
+//
+// - annotation_<name>: One key per selected pod annotation (set)
+//
+// Parameters
+//
+// - Files: Defines a list of glob patterns matching the log files to read.
+// By default this parameter is set to "/var/log/containers/*.log".
+//
+// - APIServer: Defines the URL of the Kubernetes API server. If empty, the
+// in-cluster address is used. If gollum does not run in a cluster, messages
+// are not enriched with API data.
+// By default this parameter is set to "".
+//
+// - TokenFile: Defines the file containing the bearer token used to access
+// the API server. The file is read on every request so that rotated tokens
+// are picked up.
+// By default this parameter is set to "/var/run/secrets/kubernetes.io/serviceaccount/token".
+//
+// - CAFile: Defines the CA certificate used to verify the API server. Set
+// TlsCaLocation instead to use a custom TLS configuration. See
+// core/components.NewTLSClientConfig for additional TLS settings.
+// By default this parameter is set to "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt".
+//
+// - Labels: Defines a list of pod labels to add as metadata. Set to "*" to add
+// all labels.
+// By default this parameter is set to "*".
+//
+// - Annotations: Defines a list of pod annotations to add as metadata. Set to
+// "*" to add all annotations.
+// By default this parameter is set to an empty list.
+//
+// - CacheTTLSec: Defines the number of seconds pod data is cached.
+// By default this parameter is set to 300.
+//
+// - TimeoutSec: Defines the timeout for API server requests.
+// By default this parameter is set to 5.
+//
+// Examples
+//
+// This example runs as a DaemonSet, reads all pods except system pods and
+// adds the "app" label and the "team" annotation to each message:
+//
+//  PodLogs:
+//    Type: consumer.Kubernetes
+//    Streams: pod_logs
+//    RegistryFile: /var/lib/gollum/kubernetes.json
+//    Exclude:
+//      - "*_kube-system_*"
+//    Labels:
+//      - app
+//    Annotations:
+//      - team
+type Kubernetes struct {
+	FileTail `gollumdoc:"embed_type"`
+
+	apiServer string        `config:"APIServer"`
+	tokenFile string        `config:"TokenFile" default:"/var/run/secrets/kubernetes.io/serviceaccount/token"`
+	caFile    string        `config:"CAFile" default:"/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"`
+	cacheTTL  time.Duration `config:"CacheTTLSec" default:"300" metric:"sec"`
+	timeout   time.Duration `config:"TimeoutSec" default:"5" metric:"sec"`
+
+	labels      []string
+	annotations []string
+	client      *http.Client
+	pods        map[string]kubernetesPod
+}
+
+// kubernetesPod holds the cached API data of a pod.
+type kubernetesPod struct {
+	Metadata struct {
+		UID         string            `json:"uid"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	fetched time.Time
+	found   bool
+}
+
+// kubernetesJSONLine is a line written by the json-file logging driver.
+type kubernetesJSONLine struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+}
+
+func init() {
+	core.TypeRegistry.Register(Kubernetes{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Kubernetes) Configure(conf core.PluginConfigReader) {
+	cons.patterns = conf.GetStringArray("Files", []string{"/var/log/containers/*.log"})
+	cons.labels = conf.GetStringArray("Labels", []string{"*"})
+	cons.annotations = conf.GetStringArray("Annotations", []string{})
+	cons.pods = make(map[string]kubernetesPod)
+	cons.decode = cons.decodeLine
+	cons.describe = cons.describeFile
+
+	if cons.apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			cons.Logger.Warning("Not running in a cluster and no APIServer set. Pod data is not added.")
+			return
+		}
+		cons.apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+	cons.apiServer = strings.TrimSuffix(cons.apiServer, "/")
+
+	tlsConfig, err := components.NewTLSClientConfig(conf)
+	if conf.Errors.Push(err) {
+		return
+	}
+
+	if tlsConfig.RootCAs == nil {
+		if caCert, err := ioutil.ReadFile(cons.caFile); err == nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM(caCert)
+		}
+	}
+
+	cons.client = &http.Client{
+		Timeout:   cons.timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+}
+
+// decodeLine extracts the payload of a CRI or json-file log line. Partial
+// lines are kept until the final part was read.
+func (cons *Kubernetes) decodeLine(tracked *tailedFile, entry []byte) ([]byte, core.Metadata, bool) {
+	var (
+		payload   []byte
+		stream    string
+		isPartial bool
+	)
+
+	if len(entry) > 0 && entry[0] == '{' {
+		line := kubernetesJSONLine{}
+		if err := json.Unmarshal(entry, &line); err != nil {
+			return entry, nil, true // ### return, unknown format ###
+		}
+		payload = []byte(line.Log)
+		stream = line.Stream
+		isPartial = !bytes.HasSuffix(payload, []byte{'\n'})
+		payload = bytes.TrimSuffix(payload, []byte{'\n'})
+	} else {
+		// <time> <stream> <P|F> <log>
+		parts := bytes.SplitN(entry, []byte{' '}, 4)
+		if len(parts) < 3 {
+			return entry, nil, true // ### return, unknown format ###
+		}
+		stream = string(parts[1])
+		isPartial = string(parts[2]) == "P"
+		if len(parts) == 4 {
+			payload = parts[3]
+		}
+	}
+
+	if isPartial {
+		tracked.fragments = append(tracked.fragments, payload...)
+		return nil, nil, false
+	}
+
+	if len(tracked.fragments) > 0 {
+		payload = append(tracked.fragments, payload...)
+		tracked.fragments = nil
+	}
+
+	metaData := core.Metadata{}
+	metaData.SetValue("stream", []byte(stream))
+	return payload, metaData, true
+}
+
+// describeFile returns the metadata of a log file. Pod data is fetched from
+// the API server if it is not cached.
+func (cons *Kubernetes) describeFile(tracked *tailedFile) core.Metadata {
+	metaData := fileTailMetadata(tracked)
+
+	var namespace, pod string
+	if match := kubernetesContainerLog.FindStringSubmatch(tracked.path); match != nil {
+		pod, namespace = match[1], match[2]
+		metaData.SetValue("container", []byte(match[3]))
+		metaData.SetValue("container_id", []byte(match[4]))
+	} else if match := kubernetesPodLog.FindStringSubmatch(tracked.path); match != nil {
+		namespace, pod = match[1], match[2]
+		metaData.SetValue("pod_uid", []byte(match[3]))
+		metaData.SetValue("container", []byte(match[4]))
+	} else {
+		return metaData // ### return, not a container log ###
+	}
+
+	metaData.SetValue("namespace", []byte(namespace))
+	metaData.SetValue("pod", []byte(pod))
+
+	podData, found := cons.getPod(namespace, pod)
+	if !found {
+		return metaData // ### return, no pod data ###
+	}
+
+	if podData.Metadata.UID != "" {
+		metaData.SetValue("pod_uid", []byte(podData.Metadata.UID))
+	}
+	if podData.Spec.NodeName != "" {
+		metaData.SetValue("node", []byte(podData.Spec.NodeName))
+	}
+	kubernetesCopySelected(metaData, "label_", cons.labels, podData.Metadata.Labels)
+	kubernetesCopySelected(metaData, "annotation_", cons.annotations, podData.Metadata.Annotations)
+
+	return metaData
+}
+
+func kubernetesCopySelected(metaData core.Metadata, prefix string, selected []string, values map[string]string) {
+	for _, key := range selected {
+		if key == "*" {
+			for name, value := range values {
+				metaData.SetValue(prefix+name, []byte(value))
+			}
+			return
+		}
+		if value, found := values[key]; found {
+			metaData.SetValue(prefix+key, []byte(value))
+		}
+	}
+}
+
+// getPod returns the cached data of a pod. Failed lookups are cached, too,
+// so that an unavailable API server does not slow down reading.
+func (cons *Kubernetes) getPod(namespace, name string) (kubernetesPod, bool) {
+	if cons.client == nil {
+		return kubernetesPod{}, false
+	}
+
+	key := namespace + "/" + name
+	if pod, cached := cons.pods[key]; cached && time.Since(pod.fetched) < cons.cacheTTL {
+		return pod, pod.found
+	}
+
+	pod, err := cons.fetchPod(namespace, name)
+	if err != nil {
+		cons.Logger.WithError(err).Warningf("Failed to fetch pod %s", key)
+	}
+	pod.fetched = time.Now()
+	pod.found = err == nil
+	cons.pods[key] = pod
+
+	// Remove expired entries of deleted pods
+	for cachedKey, cachedPod := range cons.pods {
+		if time.Since(cachedPod.fetched) >= cons.cacheTTL {
+			delete(cons.pods, cachedKey)
+		}
+	}
+
+	return pod, pod.found
+}
+
+func (cons *Kubernetes) fetchPod(namespace, name string) (kubernetesPod, error) {
+	pod := kubernetesPod{}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s", cons.apiServer, namespace, name), nil)
+	if err != nil {
+		return pod, err
+	}
+
+	if token, err := ioutil.ReadFile(cons.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := cons.client.Do(req)
+	if err != nil {
+		return pod, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return pod, fmt.Errorf("API server returned %s", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&pod)
+	return pod, err
+}
@@ -0,0 +1,385 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	lumberjackFrameWindow     = 'W'
+	lumberjackFrameCompressed = 'C'
+	lumberjackFrameJSON       = 'J'
+	lumberjackFrameData       = 'D'
+	lumberjackFrameAck        = 'A'
+)
+
+// Lumberjack consumer plugin
+//
+// The Lumberjack consumer accepts events sent by Elastic Beats like filebeat
+// or winlogbeat using the lumberjack protocol, as Logstash does. Each event
+// becomes a message containing the event's JSON document. Events are
+// acknowledged per window after they have been passed on, so beats resend
+// events that were not acknowledged when a connection breaks. Both protocol
+// versions 1 and 2 are supported; key/value events of version 1 are converted
+// to JSON.
+//
+// Metadata
+//
+// - remote_addr: The address of the sending beat (set)
+//
+// - beat: The name of the beat that sent the event, e.g. "filebeat" (set)
+//
+// Parameters
+//
+// - Address: Defines the host and port to listen on.
+// By default this parameter is set to "0.0.0.0:5044".
+//
+// - TlsEnable: Enables TLS. TlsKeyLocation and TlsCertificateLocation are
+// required. If TlsCaLocation is set, beats have to present a client
+// certificate signed by this CA. See core/components.NewTLSServerConfig.
+// By default this parameter is set to false.
+//
+// - IdleTimeoutSec: Defines the number of seconds after which idle
+// connections are closed.
+// By default this parameter is set to 60.
+//
+// - KeepaliveSec: Defines the number of seconds after which a partial
+// acknowledgement is sent while a window is being processed. This prevents
+// beats from timing out while gollum applies backpressure.
+// By default this parameter is set to 5.
+//
+// - MaxPayloadSizeKB: Defines the maximum size of a single event or
+// compressed frame. Connections sending larger frames are closed.
+// By default this parameter is set to 10240.
+//
+// Examples
+//
+// This example accepts events from filebeat over TLS with client
+// certificates:
+//
+//  Beats:
+//    Type: consumer.Lumberjack
+//    Streams: beats
+//    Address: 0.0.0.0:5044
+//    TlsEnable: true
+//    TlsCertificateLocation: /etc/gollum/server.crt
+//    TlsKeyLocation: /etc/gollum/server.key
+//    TlsCaLocation: /etc/gollum/beats-ca.crt
+//
+// The matching filebeat configuration is:
+//
+//  output.logstash:
+//    hosts: ["gollum:5044"]
+//    ssl.certificate_authorities: ["/etc/filebeat/gollum-ca.crt"]
+type Lumberjack struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	address        string        `config:"Address" default:"0.0.0.0:5044"`
+	tlsEnable      bool          `config:"TlsEnable" default:"false"`
+	idleTimeout    time.Duration `config:"IdleTimeoutSec" default:"60" metric:"sec"`
+	keepalive      time.Duration `config:"KeepaliveSec" default:"5" metric:"sec"`
+	maxPayloadSize int           `config:"MaxPayloadSizeKB" default:"10240" metric:"kb"`
+
+	tlsConfig *tls.Config
+	listener  net.Listener
+	clients   map[net.Conn]struct{}
+	guard     *sync.Mutex
+}
+
+// lumberjackClient holds the state of a single beat connection.
+type lumberjackClient struct {
+	conn     net.Conn
+	version  byte
+	window   uint32
+	received uint32
+	lastSeq  uint32
+	lastAck  time.Time
+	metadata core.Metadata
+}
+
+// lumberjackEvent is the subset of a beats event read for metadata.
+type lumberjackEvent struct {
+	Metadata struct {
+		Beat string `json:"beat"`
+	} `json:"@metadata"`
+}
+
+func init() {
+	core.TypeRegistry.Register(Lumberjack{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Lumberjack) Configure(conf core.PluginConfigReader) {
+	cons.SetPrepareStopCallback(cons.close)
+	cons.clients = make(map[net.Conn]struct{})
+	cons.guard = new(sync.Mutex)
+
+	if cons.tlsEnable {
+		var err error
+		cons.tlsConfig, err = components.NewTLSServerConfig(conf)
+		conf.Errors.Push(err)
+	}
+}
+
+// Consume listens for beats connections until the consumer is stopped.
+func (cons *Lumberjack) Consume(workers *sync.WaitGroup) {
+	listener, err := net.Listen("tcp", cons.address)
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+		cons.ControlLoop()
+		return
+	}
+
+	if cons.tlsConfig != nil {
+		listener = tls.NewListener(listener, cons.tlsConfig)
+	}
+
+	cons.guard.Lock()
+	cons.listener = listener
+	cons.guard.Unlock()
+
+	go tgo.WithRecoverShutdown(func() {
+		cons.AddMainWorker(workers)
+		defer cons.WorkerDone()
+		cons.accept(listener)
+	})
+
+	cons.ControlLoop()
+}
+
+// close stops accepting connections and closes all client connections.
+// Events of unfinished windows are resent by the beats.
+func (cons *Lumberjack) close() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	if cons.listener != nil {
+		cons.listener.Close()
+	}
+	for conn := range cons.clients {
+		conn.Close()
+	}
+}
+
+func (cons *Lumberjack) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !cons.IsStopping() {
+				cons.Logger.WithError(err).Errorf("Failed to accept connection on %s", cons.address)
+				time.Sleep(time.Second)
+				continue
+			}
+			return // ### return, stopped ###
+		}
+
+		cons.guard.Lock()
+		cons.clients[conn] = struct{}{}
+		cons.guard.Unlock()
+
+		cons.AddWorker()
+		go tgo.WithRecoverShutdown(func() {
+			defer cons.WorkerDone()
+			cons.serve(conn)
+		})
+	}
+}
+
+func (cons *Lumberjack) serve(conn net.Conn) {
+	defer func() {
+		cons.guard.Lock()
+		delete(cons.clients, conn)
+		cons.guard.Unlock()
+		conn.Close()
+	}()
+
+	client := &lumberjackClient{
+		conn:     conn,
+		metadata: core.Metadata{},
+	}
+	client.metadata.SetValue("remote_addr", []byte(conn.RemoteAddr().String()))
+	reader := bufio.NewReader(conn)
+
+	for !cons.IsStopping() {
+		conn.SetReadDeadline(time.Now().Add(cons.idleTimeout))
+		if err := cons.readFrame(client, reader); err != nil {
+			if !tnet.IsDisconnectedError(err) && !cons.IsStopping() {
+				cons.Logger.WithError(err).Warningf("Closing connection to %s", conn.RemoteAddr())
+			}
+			return
+		}
+	}
+}
+
+// readFrame reads and processes a single frame. Compressed frames are read
+// recursively.
+func (cons *Lumberjack) readFrame(client *lumberjackClient, reader io.Reader) error {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return err
+	}
+
+	version, frameType := header[0], header[1]
+	if version != '1' && version != '2' {
+		return fmt.Errorf("unsupported protocol version %q", version)
+	}
+	client.version = version
+
+	switch frameType {
+	case lumberjackFrameWindow:
+		window, err := lumberjackReadUint32(reader)
+		if err != nil {
+			return err
+		}
+		client.window, client.received = window, 0
+		client.lastAck = time.Now()
+		return nil
+
+	case lumberjackFrameCompressed:
+		size, err := lumberjackReadUint32(reader)
+		if err != nil {
+			return err
+		}
+		if int(size) > cons.maxPayloadSize {
+			return fmt.Errorf("compressed frame of %d bytes exceeds the limit", size)
+		}
+
+		compressed := io.LimitReader(reader, int64(size))
+		inflater, err := zlib.NewReader(compressed)
+		if err != nil {
+			return err
+		}
+		defer inflater.Close()
+
+		buffered := bufio.NewReader(inflater)
+		for {
+			if _, err := buffered.Peek(1); err == io.EOF {
+				break
+			}
+			if err := cons.readFrame(client, buffered); err != nil {
+				return err
+			}
+		}
+		_, err = io.Copy(ioutil.Discard, compressed)
+		return err
+
+	case lumberjackFrameJSON:
+		seq, err := lumberjackReadUint32(reader)
+		if err != nil {
+			return err
+		}
+		payload, err := cons.readPayload(reader)
+		if err != nil {
+			return err
+		}
+		return cons.processEvent(client, seq, payload)
+
+	case lumberjackFrameData:
+		seq, err := lumberjackReadUint32(reader)
+		if err != nil {
+			return err
+		}
+		pairs, err := lumberjackReadUint32(reader)
+		if err != nil {
+			return err
+		}
+		fields := make(map[string]string, pairs)
+		for i := uint32(0); i < pairs; i++ {
+			key, err := cons.readPayload(reader)
+			if err != nil {
+				return err
+			}
+			value, err := cons.readPayload(reader)
+			if err != nil {
+				return err
+			}
+			fields[string(key)] = string(value)
+		}
+		payload, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		return cons.processEvent(client, seq, payload)
+
+	default:
+		return fmt.Errorf("unknown frame type %q", frameType)
+	}
+}
+
+func (cons *Lumberjack) readPayload(reader io.Reader) ([]byte, error) {
+	size, err := lumberjackReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+	if int(size) > cons.maxPayloadSize {
+		return nil, fmt.Errorf("payload of %d bytes exceeds the limit", size)
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(reader, payload)
+	return payload, err
+}
+
+// processEvent enqueues an event and acknowledges the window once all of its
+// events have been enqueued.
+func (cons *Lumberjack) processEvent(client *lumberjackClient, seq uint32, payload []byte) error {
+	metaData := client.metadata.Clone()
+	event := lumberjackEvent{}
+	if err := json.Unmarshal(payload, &event); err == nil && event.Metadata.Beat != "" {
+		metaData.SetValue("beat", []byte(event.Metadata.Beat))
+	}
+
+	cons.EnqueueWithMetadata(payload, metaData)
+	client.lastSeq = seq
+	client.received++
+
+	if client.received >= client.window || time.Since(client.lastAck) >= cons.keepalive {
+		return cons.sendAck(client)
+	}
+	return nil
+}
+
+func (cons *Lumberjack) sendAck(client *lumberjackClient) error {
+	ack := [6]byte{client.version, lumberjackFrameAck}
+	binary.BigEndian.PutUint32(ack[2:], client.lastSeq)
+
+	client.conn.SetWriteDeadline(time.Now().Add(cons.idleTimeout))
+	_, err := client.conn.Write(ack[:])
+	client.lastAck = time.Now()
+	return err
+}
+
+func lumberjackReadUint32(reader io.Reader) (uint32, error) {
+	var value [4]byte
+	if _, err := io.ReadFull(reader, value[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(value[:]), nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// MQTT consumer plugin
+//
+// The MQTT consumer subscribes to topic filters on an MQTT broker. Messages
+// with QoS 1 or 2 are acknowledged after they have been passed on. With a
+// persistent session (CleanSession set to false) the broker keeps the
+// subscriptions and queues messages while gollum is disconnected. Shared
+// subscriptions ("$share/<group>/<filter>") can be used to distribute messages
+// between multiple gollum instances if the broker supports them.
+//
+// Metadata
+//
+// - topic: The topic the message was published to (set)
+//
+// - qos: The QoS level the message was delivered with (set)
+//
+// - retained: "true" if the message was retained by the broker (set)
+//
+// - <name>: One key per entry in TopicLevels (set)
+//
+// Parameters
+//
+// - Brokers: Defines a list of broker URLs. Supported schemes are "tcp",
+// "ssl", "ws" and "wss".
+// By default this parameter is set to "tcp://localhost:1883".
+//
+// - Topics: Defines a list of topic filters to subscribe to. The wildcards
+// "+" and "#" are supported.
+// By default this parameter is set to "gollum".
+//
+// - QoS: Defines the QoS level used for all subscriptions. Valid values are
+// 0, 1 and 2.
+// By default this parameter is set to 1.
+//
+// - TopicLevels: Defines a list of metadata keys for the levels of a topic.
+// The n-th key is set to the n-th level of the topic. Empty keys are skipped,
+// e.g. ["", "site", "device"] stores "berlin" as "site" and "t1" as "device"
+// for the topic "sensors/berlin/t1/temperature".
+// By default this parameter is set to an empty list.
+//
+// - ClientID: Defines the client ID sent to the broker. Persistent sessions
+// are bound to this ID, so it has to be unique and must not change between
+// restarts. If empty, "gollum-" followed by the hostname is used.
+// By default this parameter is set to "".
+//
+// - CleanSession: Set to false to use a persistent session.
+// By default this parameter is set to true.
+//
+// - StoreDir: Defines a directory to store the state of in-flight QoS 2
+// messages in. If empty, the state is kept in memory.
+// By default this parameter is set to "".
+//
+// - User: Defines the user name used for authentication.
+// By default this parameter is set to "".
+//
+// - Password: Defines the password used for authentication.
+// By default this parameter is set to "".
+//
+// - KeepAliveSec: Defines the number of seconds between keep alive pings.
+// By default this parameter is set to 30.
+//
+// - ConnectTimeoutSec: Defines the timeout for connection attempts.
+// By default this parameter is set to 30.
+//
+// - MaxReconnectIntervalSec: Defines the maximum number of seconds to wait
+// between two reconnection attempts.
+// By default this parameter is set to 60.
+//
+// - TlsEnable: Enables the TLS settings for "ssl" and "wss" brokers. See
+// core/components.NewTLSClientConfig for the available settings.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example reads sensor data of all sites using a persistent session and
+// adds the site and device to the metadata:
+//
+//  Sensors:
+//    Type: consumer.MQTT
+//    Streams: sensors
+//    Brokers:
+//      - ssl://broker:8883
+//    Topics:
+//      - "sensors/+/+/#"
+//    TopicLevels: ["", "site", "device"]
+//    ClientID: gollum-ingest-1
+//    CleanSession: false
+//    TlsEnable: true
+//    TlsCaLocation: /etc/ssl/broker-ca.pem
+type MQTT struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	qos                  int           `config:"QoS" default:"1"`
+	clientID             string        `config:"ClientID"`
+	cleanSession         bool          `config:"CleanSession" default:"true"`
+	storeDir             string        `config:"StoreDir"`
+	user                 string        `config:"User"`
+	password             string        `config:"Password"`
+	keepAlive            time.Duration `config:"KeepAliveSec" default:"30" metric:"sec"`
+	connectTimeout       time.Duration `config:"ConnectTimeoutSec" default:"30" metric:"sec"`
+	maxReconnectInterval time.Duration `config:"MaxReconnectIntervalSec" default:"60" metric:"sec"`
+	tlsEnable            bool          `config:"TlsEnable" default:"false"`
+
+	topics      []string
+	topicLevels []string
+	options     *mqtt.ClientOptions
+	client      mqtt.Client
+}
+
+func init() {
+	core.TypeRegistry.Register(MQTT{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *MQTT) Configure(conf core.PluginConfigReader) {
+	cons.SetStopCallback(cons.disconnect)
+
+	brokers := conf.GetStringArray("Brokers", []string{"tcp://localhost:1883"})
+	cons.topics = conf.GetStringArray("Topics", []string{"gollum"})
+	cons.topicLevels = conf.GetStringArray("TopicLevels", []string{})
+
+	if cons.qos < 0 || cons.qos > 2 {
+		conf.Errors.Pushf("QoS must be 0, 1 or 2")
+	}
+
+	if cons.clientID == "" {
+		hostname, _ := os.Hostname()
+		cons.clientID = "gollum-" + hostname
+	}
+
+	cons.options = mqtt.NewClientOptions().
+		SetClientID(cons.clientID).
+		SetCleanSession(cons.cleanSession).
+		SetUsername(cons.user).
+		SetPassword(cons.password).
+		SetKeepAlive(cons.keepAlive).
+		SetConnectTimeout(cons.connectTimeout).
+		SetMaxReconnectInterval(cons.maxReconnectInterval).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetResumeSubs(true).
+		SetOnConnectHandler(cons.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			cons.Logger.WithError(err).Warning("Connection lost")
+		})
+
+	for _, broker := range brokers {
+		cons.options.AddBroker(broker)
+	}
+
+	if cons.storeDir != "" {
+		cons.options.SetStore(mqtt.NewFileStore(cons.storeDir))
+	}
+
+	if cons.tlsEnable {
+		tlsConfig, err := components.NewTLSClientConfig(conf)
+		if !conf.Errors.Push(err) {
+			cons.options.SetTLSConfig(tlsConfig)
+		}
+	}
+}
+
+// Consume connects to the broker and reads messages until the consumer is
+// stopped. Connection attempts are retried in the background.
+func (cons *MQTT) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	defer cons.WorkerDone()
+
+	cons.client = mqtt.NewClient(cons.options)
+	cons.client.Connect()
+
+	cons.ControlLoop()
+}
+
+func (cons *MQTT) disconnect() {
+	if cons.client != nil {
+		cons.client.Disconnect(uint(cons.GetShutdownTimeout() / time.Millisecond))
+	}
+}
+
+// subscribe is called after each (re)connect. Subscriptions of persistent
+// sessions are kept by the broker but renewing them does no harm.
+func (cons *MQTT) subscribe(client mqtt.Client) {
+	cons.Logger.Info("Connected to broker")
+
+	filters := make(map[string]byte, len(cons.topics))
+	for _, topic := range cons.topics {
+		filters[topic] = byte(cons.qos)
+	}
+
+	token := client.SubscribeMultiple(filters, cons.onMessage)
+	go func() {
+		if token.Wait(); token.Error() != nil {
+			cons.Logger.WithError(token.Error()).Error("Failed to subscribe")
+		}
+	}()
+}
+
+// onMessage is called for every message received. The message is
+// acknowledged by the client after this function returns.
+func (cons *MQTT) onMessage(_ mqtt.Client, msg mqtt.Message) {
+	metaData := core.Metadata{}
+	metaData.SetValue("topic", []byte(msg.Topic()))
+	metaData.SetValue("qos", []byte(strconv.Itoa(int(msg.Qos()))))
+	metaData.SetValue("retained", []byte(strconv.FormatBool(msg.Retained())))
+
+	if len(cons.topicLevels) > 0 {
+		levels := strings.Split(msg.Topic(), "/")
+		for i, key := range cons.topicLevels {
+			if i >= len(levels) {
+				break
+			}
+			if key != "" {
+				metaData.SetValue(key, []byte(levels[i]))
+			}
+		}
+	}
+
+	cons.EnqueueWithMetadata(msg.Payload(), metaData)
+}
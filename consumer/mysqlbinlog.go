@@ -0,0 +1,511 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/siddontang/go-mysql/client"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
+)
+
+// MySQLBinlog consumer plugin
+//
+// The MySQLBinlog consumer connects to a MySQL or MariaDB server as a replica
+// and generates one JSON message per inserted, updated or deleted row and per
+// schema change. The server has to use row based logging (binlog_format=ROW)
+// with GTIDs enabled. The GTID set of all transactions passed on is written to
+// a checkpoint file, so that gollum continues where it stopped after a
+// restart. Without a checkpoint, reading starts at the server's current
+// position.
+//
+// Each message has the following fields:
+//
+//  {
+//    "op": "insert|update|delete|ddl",
+//    "schema": "shop",
+//    "table": "orders",
+//    "gtid": "3e11fa47-71ca-11e1-9e33-c80aa9429562:23",
+//    "timestamp": 1528372800,
+//    "columns": {"id": 1, "state": "paid"},
+//    "old": {"id": 1, "state": "new"},
+//    "query": "ALTER TABLE orders ADD state VARCHAR(16)"
+//  }
+//
+// "old" is only set for updates, "query" only for schema changes. Row events
+// don't contain column names, so these are read from information_schema and
+// cached until the next schema change. Rows written before a schema change
+// that are read after it, e.g. after a restart, may therefore be named
+// according to the current schema. Columns that cannot be named are named by
+// their position.
+//
+// Metadata
+//
+// - op: The operation, i.e. "insert", "update", "delete" or "ddl" (set)
+//
+// - schema: The schema (database) of the change (set)
+//
+// - table: The name of the changed table, empty for schema changes (set)
+//
+// - gtid: The GTID of the transaction (set)
+//
+// Parameters
+//
+// - Address: Defines the host and port of the server.
+// By default this parameter is set to "localhost:3306".
+//
+// - User: Defines the user to connect with. The user requires the
+// REPLICATION SLAVE and REPLICATION CLIENT privileges.
+// By default this parameter is set to "".
+//
+// - Password: Defines the password of the user.
+// By default this parameter is set to "".
+//
+// - Flavor: Defines the server type. Valid values are "mysql" and "mariadb".
+// By default this parameter is set to "mysql".
+//
+// - ServerID: Defines the server ID gollum uses as a replica. The ID has to
+// be unique among all replicas of the server.
+// By default this parameter is set to 1001.
+//
+// - Databases: Defines a list of databases to read changes from. If empty,
+// changes of all databases are read.
+// By default this parameter is set to an empty list.
+//
+// - CheckpointFile: Defines the path to the file the GTID set of all
+// processed transactions is written to. If empty, no checkpoint is kept.
+// By default this parameter is set to "".
+//
+// - CheckpointIntervalMs: Defines the minimum number of milliseconds between
+// two writes of the checkpoint file. The checkpoint is always written when
+// the consumer stops.
+// By default this parameter is set to 1000.
+//
+// - RetryIntervalSec: Defines the number of seconds to wait before
+// reconnecting after the connection failed.
+// By default this parameter is set to 5.
+//
+// - TlsEnable: Enables TLS. See core/components.NewTLSClientConfig for
+// the available settings.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example streams all changes of the "shop" database:
+//
+//  ShopChanges:
+//    Type: consumer.MySQLBinlog
+//    Streams: shop_changes
+//    Address: db01:3306
+//    User: gollum
+//    Password: secret
+//    ServerID: 4711
+//    Databases:
+//      - shop
+//    CheckpointFile: /var/gollum/shop.gtid
+type MySQLBinlog struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	address            string        `config:"Address" default:"localhost:3306"`
+	user               string        `config:"User"`
+	password           string        `config:"Password"`
+	flavor             string        `config:"Flavor" default:"mysql"`
+	serverID           uint32        `config:"ServerID" default:"1001"`
+	checkpointFile     string        `config:"CheckpointFile"`
+	checkpointInterval time.Duration `config:"CheckpointIntervalMs" default:"1000" metric:"ms"`
+	retryInterval      time.Duration `config:"RetryIntervalSec" default:"5" metric:"sec"`
+	tlsEnable          bool          `config:"TlsEnable" default:"false"`
+
+	databases      map[string]bool
+	tlsConfig      *tls.Config
+	metaConn       *client.Conn
+	columnNames    map[string][]string
+	gtidSet        mysql.GTIDSet
+	currentGTID    string
+	lastCheckpoint time.Time
+	ctx            context.Context
+	cancel         context.CancelFunc
+	stopped        chan struct{}
+}
+
+// mysqlChange is a single row change or schema change.
+type mysqlChange struct {
+	Op        string                 `json:"op"`
+	Schema    string                 `json:"schema"`
+	Table     string                 `json:"table,omitempty"`
+	GTID      string                 `json:"gtid"`
+	Timestamp uint32                 `json:"timestamp"`
+	Columns   map[string]interface{} `json:"columns,omitempty"`
+	Old       map[string]interface{} `json:"old,omitempty"`
+	Query     string                 `json:"query,omitempty"`
+}
+
+func init() {
+	core.TypeRegistry.Register(MySQLBinlog{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *MySQLBinlog) Configure(conf core.PluginConfigReader) {
+	cons.SetPrepareStopCallback(cons.prepareStop)
+	cons.columnNames = make(map[string][]string)
+	cons.ctx, cons.cancel = context.WithCancel(context.Background())
+	cons.stopped = make(chan struct{})
+
+	cons.databases = make(map[string]bool)
+	for _, database := range conf.GetStringArray("Databases", []string{}) {
+		cons.databases[database] = true
+	}
+
+	cons.flavor = strings.ToLower(cons.flavor)
+	switch cons.flavor {
+	case mysql.MySQLFlavor, mysql.MariaDBFlavor:
+	default:
+		conf.Errors.Pushf("Flavor must be one of %s or %s", mysql.MySQLFlavor, mysql.MariaDBFlavor)
+	}
+
+	if cons.tlsEnable {
+		var err error
+		cons.tlsConfig, err = components.NewTLSClientConfig(conf)
+		conf.Errors.Push(err)
+	}
+
+	if cons.checkpointFile != "" {
+		data, err := ioutil.ReadFile(cons.checkpointFile)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			conf.Errors.Push(err)
+		default:
+			cons.gtidSet, err = mysql.ParseGTIDSet(cons.flavor, strings.TrimSpace(string(data)))
+			if err != nil {
+				conf.Errors.Pushf("Failed to parse checkpoint %s: %s", cons.checkpointFile, err)
+			}
+		}
+	}
+}
+
+// Consume reads the binlog until the consumer is stopped.
+func (cons *MySQLBinlog) Consume(workers *sync.WaitGroup) {
+	go tgo.WithRecoverShutdown(func() {
+		cons.AddMainWorker(workers)
+		defer cons.WorkerDone()
+		defer close(cons.stopped)
+		cons.run()
+	})
+
+	cons.ControlLoop()
+}
+
+// prepareStop closes the connection and writes the checkpoint.
+func (cons *MySQLBinlog) prepareStop() {
+	cons.cancel()
+	<-cons.stopped
+}
+
+func (cons *MySQLBinlog) run() {
+	defer cons.writeCheckpoint()
+	defer cons.closeMetaConn()
+
+	for {
+		if err := cons.sync(); err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to read binlog from %s", cons.address)
+		}
+
+		select {
+		case <-cons.ctx.Done():
+			return // ### return, stopped ###
+		case <-time.After(cons.retryInterval):
+		}
+	}
+}
+
+// sync reads the binlog starting after the last processed transaction.
+func (cons *MySQLBinlog) sync() error {
+	if cons.gtidSet == nil {
+		gtidSet, err := cons.serverPosition()
+		if err != nil {
+			return err
+		}
+		cons.gtidSet = gtidSet
+		cons.Logger.Infof("Starting at %s", gtidSet)
+	}
+
+	host, port := cons.address, uint64(3306)
+	if colon := strings.LastIndex(cons.address, ":"); colon >= 0 {
+		host = cons.address[:colon]
+		parsedPort, err := strconv.ParseUint(cons.address[colon+1:], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port in %s", cons.address)
+		}
+		port = parsedPort
+	}
+
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID:  cons.serverID,
+		Flavor:    cons.flavor,
+		Host:      host,
+		Port:      uint16(port),
+		User:      cons.user,
+		Password:  cons.password,
+		TLSConfig: cons.tlsConfig,
+	})
+	defer syncer.Close()
+
+	streamer, err := syncer.StartSyncGTID(cons.gtidSet.Clone())
+	if err != nil {
+		return err
+	}
+
+	for {
+		event, err := streamer.GetEvent(cons.ctx)
+		if err != nil {
+			if cons.ctx.Err() != nil {
+				return nil // ### return, stopped ###
+			}
+			return err
+		}
+		cons.processEvent(event)
+	}
+}
+
+// serverPosition returns the GTID set of all transactions executed by the
+// server.
+func (cons *MySQLBinlog) serverPosition() (mysql.GTIDSet, error) {
+	variable := "@@GLOBAL.gtid_executed"
+	if cons.flavor == mysql.MariaDBFlavor {
+		variable = "@@GLOBAL.gtid_current_pos"
+	}
+
+	result, err := cons.query("SELECT " + variable)
+	if err != nil {
+		return nil, err
+	}
+	gtids, err := result.GetString(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return mysql.ParseGTIDSet(cons.flavor, gtids)
+}
+
+func (cons *MySQLBinlog) processEvent(event *replication.BinlogEvent) {
+	switch data := event.Event.(type) {
+	case *replication.GTIDEvent:
+		sid, err := uuid.FromBytes(data.SID)
+		if err == nil {
+			cons.currentGTID = fmt.Sprintf("%s:%d", sid, data.GNO)
+		}
+
+	case *replication.MariadbGTIDEvent:
+		cons.currentGTID = fmt.Sprintf("%d-%d-%d", data.GTID.DomainID, data.GTID.ServerID, data.GTID.SequenceNumber)
+
+	case *replication.RowsEvent:
+		cons.processRows(event.Header, data)
+
+	case *replication.QueryEvent:
+		query := strings.TrimSpace(string(data.Query))
+		if strings.EqualFold(query, "BEGIN") {
+			return // ### return, transaction start ###
+		}
+
+		// Any other statement logged as query is a schema change, so the
+		// column names have to be read again.
+		cons.columnNames = make(map[string][]string)
+		if cons.isIncluded(string(data.Schema)) {
+			cons.enqueue(mysqlChange{
+				Op:        "ddl",
+				Schema:    string(data.Schema),
+				GTID:      cons.currentGTID,
+				Timestamp: event.Header.Timestamp,
+				Query:     query,
+			})
+		}
+		cons.commit(data.GSet)
+
+	case *replication.XIDEvent:
+		cons.commit(data.GSet)
+	}
+}
+
+func (cons *MySQLBinlog) processRows(header *replication.EventHeader, event *replication.RowsEvent) {
+	schema, table := string(event.Table.Schema), string(event.Table.Table)
+	if !cons.isIncluded(schema) {
+		return // ### return, database not included ###
+	}
+
+	var op string
+	switch header.EventType {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		op = "insert"
+	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		op = "update"
+	case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		op = "delete"
+	default:
+		return // ### return, unknown rows event ###
+	}
+
+	names := cons.getColumnNames(schema, table)
+	for i := 0; i < len(event.Rows); i++ {
+		change := mysqlChange{
+			Op:        op,
+			Schema:    schema,
+			Table:     table,
+			GTID:      cons.currentGTID,
+			Timestamp: header.Timestamp,
+		}
+
+		// Updates contain the row before and after the change.
+		if op == "update" && i+1 < len(event.Rows) {
+			change.Old = mysqlNamedRow(names, event.Rows[i])
+			i++
+		}
+		change.Columns = mysqlNamedRow(names, event.Rows[i])
+		cons.enqueue(change)
+	}
+}
+
+// commit updates the checkpoint after a transaction has been processed.
+func (cons *MySQLBinlog) commit(gtidSet mysql.GTIDSet) {
+	if gtidSet == nil {
+		return
+	}
+	cons.gtidSet = gtidSet
+	if time.Since(cons.lastCheckpoint) >= cons.checkpointInterval {
+		cons.writeCheckpoint()
+	}
+}
+
+func (cons *MySQLBinlog) writeCheckpoint() {
+	if cons.checkpointFile == "" || cons.gtidSet == nil {
+		return
+	}
+	cons.lastCheckpoint = time.Now()
+
+	fileDir := path.Dir(cons.checkpointFile)
+	if err := os.MkdirAll(fileDir, 0755); err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to create %s", fileDir)
+		return
+	}
+
+	// Write to a temporary file first so that a crash cannot leave a
+	// partially written checkpoint.
+	tempFile := cons.checkpointFile + ".tmp"
+	if err := ioutil.WriteFile(tempFile, []byte(cons.gtidSet.String()), 0644); err != nil {
+		cons.Logger.WithError(err).Error("Failed to write checkpoint")
+		return
+	}
+	if err := os.Rename(tempFile, cons.checkpointFile); err != nil {
+		cons.Logger.WithError(err).Error("Failed to write checkpoint")
+	}
+}
+
+func (cons *MySQLBinlog) isIncluded(database string) bool {
+	return len(cons.databases) == 0 || cons.databases[database]
+}
+
+// getColumnNames returns the column names of a table, nil if they could not
+// be read.
+func (cons *MySQLBinlog) getColumnNames(schema, table string) []string {
+	key := schema + "." + table
+	if names, isCached := cons.columnNames[key]; isCached {
+		return names
+	}
+
+	result, err := cons.query("SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", schema, table)
+	if err != nil {
+		cons.Logger.WithError(err).Warningf("Failed to read columns of %s", key)
+		return nil
+	}
+
+	names := make([]string, result.RowNumber())
+	for i := range names {
+		names[i], _ = result.GetString(i, 0)
+	}
+	cons.columnNames[key] = names
+	return names
+}
+
+// query runs a query on the connection used for reading server state.
+func (cons *MySQLBinlog) query(query string, args ...interface{}) (*mysql.Result, error) {
+	if cons.metaConn == nil {
+		conn, err := client.Connect(cons.address, cons.user, cons.password, "", func(conn *client.Conn) {
+			conn.SetTLSConfig(cons.tlsConfig)
+		})
+		if err != nil {
+			return nil, err
+		}
+		cons.metaConn = conn
+	}
+
+	result, err := cons.metaConn.Execute(query, args...)
+	if err != nil {
+		cons.closeMetaConn()
+	}
+	return result, err
+}
+
+func (cons *MySQLBinlog) closeMetaConn() {
+	if cons.metaConn != nil {
+		cons.metaConn.Close()
+		cons.metaConn = nil
+	}
+}
+
+func (cons *MySQLBinlog) enqueue(change mysqlChange) {
+	payload, err := json.Marshal(change)
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to encode change of %s.%s", change.Schema, change.Table)
+		return
+	}
+
+	metaData := core.Metadata{}
+	metaData.SetValue("op", []byte(change.Op))
+	metaData.SetValue("schema", []byte(change.Schema))
+	metaData.SetValue("table", []byte(change.Table))
+	metaData.SetValue("gtid", []byte(change.GTID))
+	cons.EnqueueWithMetadata(payload, metaData)
+}
+
+// mysqlNamedRow maps the values of a row to their column names. Binary values
+// are converted to strings.
+func mysqlNamedRow(names []string, row []interface{}) map[string]interface{} {
+	named := make(map[string]interface{}, len(row))
+	for i, value := range row {
+		name := strconv.Itoa(i)
+		if i < len(names) {
+			name = names[i]
+		}
+		if binary, isBinary := value.([]byte); isBinary {
+			value = string(binary)
+		}
+		named[name] = value
+	}
+	return named
+}
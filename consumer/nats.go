@@ -0,0 +1,455 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// NATS consumer plugin
+//
+// The NATS consumer subscribes to one or more subjects of a NATS server. Core
+// NATS subscriptions deliver messages at most once. When JetStream is enabled,
+// a durable consumer is used instead and each message is acknowledged after it
+// has been passed on, so messages are redelivered if gollum stops before that.
+// Multiple gollum instances using the same QueueGroup share the load of a
+// subject.
+//
+// Metadata
+//
+// - subject: The subject the message was published to (set)
+//
+// - reply: The reply subject of the message, if any (set)
+//
+// - header_<name>: One key per message header (set)
+//
+// - stream: The JetStream stream the message was read from (set, JetStream only)
+//
+// - sequence: The stream sequence number of the message (set, JetStream only)
+//
+// Parameters
+//
+// - Servers: Defines a list of server URLs to connect to.
+// By default this parameter is set to "nats://localhost:4222".
+//
+// - Subjects: Defines a list of subjects to subscribe to. The wildcards "*"
+// and ">" are supported.
+// By default this parameter is set to "gollum".
+//
+// - QueueGroup: Defines the queue group to join. Messages are distributed
+// between all members of the group. If empty, every consumer receives all
+// messages.
+// By default this parameter is set to "".
+//
+// - StreamMapping: Defines a map of subject patterns to gollum streams.
+// Messages on matching subjects are sent to the mapped stream instead of the
+// streams bound to this consumer. More specific patterns take precedence.
+// By default this parameter is set to an empty map.
+//
+// - Name: Defines the client name reported to the server.
+// By default this parameter is set to "gollum".
+//
+// - User: Defines the user name used for authentication.
+// By default this parameter is set to "".
+//
+// - Password: Defines the password used for authentication.
+// By default this parameter is set to "".
+//
+// - Token: Defines the token used for authentication.
+// By default this parameter is set to "".
+//
+// - CredentialsFile: Defines the path to a credentials file containing a user
+// JWT and NKey seed.
+// By default this parameter is set to "".
+//
+// - NKeyFile: Defines the path to a file containing an NKey seed.
+// By default this parameter is set to "".
+//
+// - RetryIntervalSec: Defines the number of seconds to wait before retrying
+// a failed subscription. Lost connections are reestablished automatically.
+// By default this parameter is set to 5.
+//
+// - TlsEnable: Enables TLS when connecting to the servers. See
+// core/components.NewTLSClientConfig for additional TLS settings.
+// By default this parameter is set to false.
+//
+// - JetStream/Enable: Set to true to use JetStream durable consumers.
+// By default this parameter is set to false.
+//
+// - JetStream/Stream: Defines the JetStream stream to bind to. If empty, the
+// stream is looked up by subject.
+// By default this parameter is set to "".
+//
+// - JetStream/Durable: Defines the name of the durable consumer. If more than
+// one subject is configured, the subject is appended to the name.
+// By default this parameter is set to "gollum".
+//
+// - JetStream/DeliverPolicy: Defines where a new durable consumer starts
+// reading. Valid values are "all", "new" and "last".
+// By default this parameter is set to "all".
+//
+// - JetStream/AckWaitSec: Defines the number of seconds the server waits for
+// an acknowledgement before a message is redelivered.
+// By default this parameter is set to 30.
+//
+// - JetStream/MaxAckPending: Defines the maximum number of messages that are
+// delivered but not yet acknowledged.
+// By default this parameter is set to 1000.
+//
+// Examples
+//
+// This example reads all order events from a JetStream stream, shares them
+// between all gollum instances and sends refunds to a separate stream:
+//
+//  NatsIn:
+//    Type: consumer.NATS
+//    Streams: orders
+//    Servers:
+//      - nats://nats-1:4222
+//      - nats://nats-2:4222
+//    Subjects:
+//      - "orders.>"
+//    QueueGroup: gollum
+//    StreamMapping:
+//      "orders.refund.>": refunds
+//    JetStream:
+//      Enable: true
+//      Stream: ORDERS
+type NATS struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	name            string        `config:"Name" default:"gollum"`
+	queueGroup      string        `config:"QueueGroup"`
+	user            string        `config:"User"`
+	password        string        `config:"Password"`
+	token           string        `config:"Token"`
+	credentialsFile string        `config:"CredentialsFile"`
+	nkeyFile        string        `config:"NKeyFile"`
+	retryInterval   time.Duration `config:"RetryIntervalSec" default:"5" metric:"sec"`
+	tlsEnable       bool          `config:"TlsEnable" default:"false"`
+	jsEnable        bool          `config:"JetStream/Enable" default:"false"`
+	jsStream        string        `config:"JetStream/Stream"`
+	jsDurable       string        `config:"JetStream/Durable" default:"gollum"`
+	jsDeliverPolicy string        `config:"JetStream/DeliverPolicy" default:"all"`
+	jsAckWait       time.Duration `config:"JetStream/AckWaitSec" default:"30" metric:"sec"`
+	jsMaxAckPending int           `config:"JetStream/MaxAckPending" default:"1000"`
+
+	servers  []string
+	subjects []string
+	mapping  []natsMapping
+	options  []nats.Option
+	conn     *nats.Conn
+	subs     map[string]*nats.Subscription
+	closed   chan struct{}
+	guard    *sync.Mutex
+}
+
+// natsMapping assigns messages on subjects matching pattern to a stream.
+type natsMapping struct {
+	pattern  []string
+	streamID core.MessageStreamID
+}
+
+func init() {
+	core.TypeRegistry.Register(NATS{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *NATS) Configure(conf core.PluginConfigReader) {
+	cons.SetPrepareStopCallback(cons.close)
+
+	cons.servers = conf.GetStringArray("Servers", []string{nats.DefaultURL})
+	cons.subjects = conf.GetStringArray("Subjects", []string{"gollum"})
+	cons.subs = make(map[string]*nats.Subscription)
+	cons.closed = make(chan struct{})
+	cons.guard = new(sync.Mutex)
+
+	for pattern, stream := range conf.GetStringMap("StreamMapping", map[string]string{}) {
+		cons.mapping = append(cons.mapping, natsMapping{
+			pattern:  strings.Split(pattern, "."),
+			streamID: core.GetStreamID(stream),
+		})
+	}
+	sort.Slice(cons.mapping, func(i, j int) bool {
+		return natsIsMoreSpecific(cons.mapping[i].pattern, cons.mapping[j].pattern)
+	})
+
+	switch strings.ToLower(cons.jsDeliverPolicy) {
+	case "all", "new", "last":
+		cons.jsDeliverPolicy = strings.ToLower(cons.jsDeliverPolicy)
+	default:
+		conf.Errors.Pushf("JetStream/DeliverPolicy must be one of all, new or last")
+	}
+
+	cons.options = []nats.Option{
+		nats.Name(cons.name),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(cons.retryInterval),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				cons.Logger.WithError(err).Warning("Disconnected from server")
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			cons.Logger.Infof("Reconnected to %s", conn.ConnectedUrl())
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, sub *nats.Subscription, err error) {
+			cons.Logger.WithError(err).Errorf("Error on subject %s", sub.Subject)
+		}),
+		nats.ClosedHandler(func(*nats.Conn) {
+			close(cons.closed)
+		}),
+	}
+
+	switch {
+	case cons.credentialsFile != "":
+		cons.options = append(cons.options, nats.UserCredentials(cons.credentialsFile))
+	case cons.nkeyFile != "":
+		option, err := nats.NkeyOptionFromSeed(cons.nkeyFile)
+		if !conf.Errors.Push(err) {
+			cons.options = append(cons.options, option)
+		}
+	case cons.token != "":
+		cons.options = append(cons.options, nats.Token(cons.token))
+	case cons.user != "":
+		cons.options = append(cons.options, nats.UserInfo(cons.user, cons.password))
+	}
+
+	if cons.tlsEnable {
+		tlsConfig, err := components.NewTLSClientConfig(conf)
+		if !conf.Errors.Push(err) {
+			cons.options = append(cons.options, nats.Secure(tlsConfig))
+		}
+	}
+}
+
+// Consume subscribes to all subjects until the consumer is stopped.
+func (cons *NATS) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	defer cons.WorkerDone()
+
+	conn, err := nats.Connect(strings.Join(cons.servers, ","), cons.options...)
+	if err != nil {
+		cons.Logger.WithError(err).Error("Failed to connect")
+		cons.ControlLoop()
+		return
+	}
+	cons.guard.Lock()
+	cons.conn = conn
+	cons.guard.Unlock()
+
+	cons.subscribe()
+	cons.TickerControlLoop(cons.retryInterval, cons.subscribe)
+}
+
+// close drains all subscriptions so that messages already received are
+// processed and acknowledged before the connection is closed.
+func (cons *NATS) close() {
+	cons.guard.Lock()
+	conn := cons.conn
+	cons.guard.Unlock()
+
+	if conn == nil {
+		return // ### return, never connected ###
+	}
+
+	if err := conn.Drain(); err != nil {
+		conn.Close()
+	}
+
+	select {
+	case <-cons.closed:
+	case <-time.After(cons.GetShutdownTimeout()):
+		cons.Logger.Warning("Timeout while draining subscriptions")
+		conn.Close()
+	}
+}
+
+// subscribe creates all subscriptions that do not exist yet. JetStream
+// subscriptions fail while the server is not reachable, so this is retried
+// periodically.
+func (cons *NATS) subscribe() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	if len(cons.subs) == len(cons.subjects) || !cons.conn.IsConnected() {
+		return // ### return, nothing to do ###
+	}
+
+	var js nats.JetStreamContext
+	if cons.jsEnable {
+		var err error
+		if js, err = cons.conn.JetStream(); err != nil {
+			cons.Logger.WithError(err).Error("Failed to access JetStream")
+			return
+		}
+	}
+
+	for _, subject := range cons.subjects {
+		if _, exists := cons.subs[subject]; exists {
+			continue
+		}
+
+		var (
+			sub *nats.Subscription
+			err error
+		)
+		if js != nil {
+			sub, err = cons.subscribeJetStream(js, subject)
+		} else if cons.queueGroup != "" {
+			sub, err = cons.conn.QueueSubscribe(subject, cons.queueGroup, cons.onMessage)
+		} else {
+			sub, err = cons.conn.Subscribe(subject, cons.onMessage)
+		}
+
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to subscribe to %s", subject)
+			continue
+		}
+		cons.subs[subject] = sub
+	}
+}
+
+func (cons *NATS) subscribeJetStream(js nats.JetStreamContext, subject string) (*nats.Subscription, error) {
+	durable := cons.jsDurable
+	if len(cons.subjects) > 1 {
+		durable += "_" + natsDurableSuffix.Replace(subject)
+	}
+
+	options := []nats.SubOpt{
+		nats.Durable(durable),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.AckWait(cons.jsAckWait),
+		nats.MaxAckPending(cons.jsMaxAckPending),
+	}
+
+	switch cons.jsDeliverPolicy {
+	case "new":
+		options = append(options, nats.DeliverNew())
+	case "last":
+		options = append(options, nats.DeliverLast())
+	default:
+		options = append(options, nats.DeliverAll())
+	}
+
+	if cons.jsStream != "" {
+		options = append(options, nats.BindStream(cons.jsStream))
+	}
+
+	if cons.queueGroup != "" {
+		return js.QueueSubscribe(subject, cons.queueGroup, cons.onMessage, options...)
+	}
+	return js.Subscribe(subject, cons.onMessage, options...)
+}
+
+// natsDurableSuffix converts a subject into characters allowed in durable
+// names.
+var natsDurableSuffix = strings.NewReplacer(".", "_", "*", "any", ">", "all")
+
+func (cons *NATS) onMessage(msg *nats.Msg) {
+	metaData := core.Metadata{}
+	metaData.SetValue("subject", []byte(msg.Subject))
+	if msg.Reply != "" {
+		metaData.SetValue("reply", []byte(msg.Reply))
+	}
+	for key, values := range msg.Header {
+		if len(values) > 0 {
+			metaData.SetValue("header_"+key, []byte(values[0]))
+		}
+	}
+
+	isJetStream := cons.jsEnable && msg.Reply != ""
+	if isJetStream {
+		if info, err := msg.Metadata(); err == nil {
+			metaData.SetValue("stream", []byte(info.Stream))
+			metaData.SetValue("sequence", []byte(strconv.FormatUint(info.Sequence.Stream, 10)))
+		}
+	}
+
+	if streamID := cons.getStreamID(msg.Subject); streamID != core.InvalidStreamID {
+		cons.EnqueueWithStream(msg.Data, metaData, streamID)
+	} else {
+		cons.EnqueueWithMetadata(msg.Data, metaData)
+	}
+
+	if isJetStream {
+		if err := msg.Ack(); err != nil {
+			cons.Logger.WithError(err).Warningf("Failed to acknowledge message on %s", msg.Subject)
+		}
+	}
+}
+
+// getStreamID returns the stream mapped to the given subject or
+// core.InvalidStreamID if no mapping matches.
+func (cons *NATS) getStreamID(subject string) core.MessageStreamID {
+	if len(cons.mapping) == 0 {
+		return core.InvalidStreamID
+	}
+
+	tokens := strings.Split(subject, ".")
+	for _, mapping := range cons.mapping {
+		if natsSubjectMatches(mapping.pattern, tokens) {
+			return mapping.streamID
+		}
+	}
+	return core.InvalidStreamID
+}
+
+// natsSubjectMatches returns true if the subject tokens match the pattern
+// tokens. "*" matches a single token, ">" matches all remaining tokens.
+func natsSubjectMatches(pattern, subject []string) bool {
+	for i, token := range pattern {
+		switch {
+		case token == ">":
+			return len(subject) > i
+		case i >= len(subject):
+			return false
+		case token != "*" && token != subject[i]:
+			return false
+		}
+	}
+	return len(pattern) == len(subject)
+}
+
+// natsIsMoreSpecific orders patterns so that literal tokens come before
+// wildcards and longer patterns come before shorter ones.
+func natsIsMoreSpecific(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		aWild, bWild := a[i] == "*" || a[i] == ">", b[i] == "*" || b[i] == ">"
+		if aWild != bWild {
+			return bWild
+		}
+		if a[i] == ">" && b[i] == "*" {
+			return false
+		}
+		if a[i] == "*" && b[i] == ">" {
+			return true
+		}
+	}
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return strings.Join(a, ".") < strings.Join(b, ".")
+}
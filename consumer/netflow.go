@@ -0,0 +1,863 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+)
+
+const (
+	netflowTypeV5    = "netflow_v5"
+	netflowTypeV9    = "netflow_v9"
+	netflowTypeIPFIX = "ipfix"
+	netflowTypeSFlow = "sflow"
+)
+
+// Netflow consumer plugin
+//
+// The Netflow consumer collects flow data sent via UDP and generates one JSON
+// message per flow record or sFlow sample. NetFlow v5, NetFlow v9, IPFIX and
+// sFlow v5 are detected automatically, so a single consumer can receive all
+// of them. Templates of NetFlow v9 and IPFIX are cached per exporter and
+// observation domain; data records received before their template are
+// dropped.
+//
+// Fields are named after the IPFIX information elements defined by IANA,
+// e.g. "sourceIPv4Address" or "octetDeltaCount", for all protocols. Unknown
+// fields are named "field_<id>", enterprise specific IPFIX fields are named
+// "<enterprise>_<id>". Addresses are written as strings, numbers of up to 8
+// bytes as numbers and all other values as hex strings. The following
+// fields are added to every record:
+//
+// - flow_type: One of "netflow_v5", "netflow_v9", "ipfix" or "sflow"
+//
+// - exporter: The address of the exporter, i.e. the sFlow agent address or
+// the source address of the datagram
+//
+// - sequence: The sequence number of the datagram
+//
+// - export_time: The export time in seconds since epoch (not for sFlow)
+//
+// NetFlow v5 and v9 records with relative flow times additionally contain
+// the absolute times as "flowStartMilliseconds" and "flowEndMilliseconds".
+// sFlow flow samples contain the sample's attributes like "sampling_rate"
+// and the addresses, ports and protocol read from the sampled packet header.
+// sFlow counter samples contain the generic interface counters, e.g.
+// "if_in_octets".
+//
+// Metadata
+//
+// - exporter: The source address of the datagram (set)
+//
+// - flow_type: One of "netflow_v5", "netflow_v9", "ipfix" or "sflow" (set)
+//
+// Parameters
+//
+// - Address: Defines the host and port to listen on.
+// By default this parameter is set to ":2055".
+//
+// - TemplateTimeoutSec: Defines the number of seconds after which a template
+// that has not been refreshed by the exporter is discarded.
+// By default this parameter is set to 1800.
+//
+// - ReceiveBufferSizeKB: Defines the size of the socket's receive buffer.
+// Exporters send datagrams in bursts, so a large buffer prevents losses.
+// By default this parameter is set to 1024.
+//
+// Examples
+//
+// This example collects flows sent by routers to port 2055 and sFlow samples
+// sent by switches to port 6343:
+//
+//  RouterFlows:
+//    Type: consumer.Netflow
+//    Streams: flows
+//    Address: ":2055"
+//
+//  SwitchFlows:
+//    Type: consumer.Netflow
+//    Streams: flows
+//    Address: ":6343"
+type Netflow struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	address           string        `config:"Address" default:":2055"`
+	templateTimeout   time.Duration `config:"TemplateTimeoutSec" default:"1800" metric:"sec"`
+	receiveBufferSize int           `config:"ReceiveBufferSizeKB" default:"1024" metric:"kb"`
+
+	conn      *net.UDPConn
+	templates map[string]*netflowTemplate
+}
+
+// netflowTemplate describes the records of a NetFlow v9 or IPFIX data set.
+type netflowTemplate struct {
+	fields  []netflowField
+	updated time.Time
+}
+
+// netflowField is a single field of a template. Scope fields of NetFlow v9
+// options templates use their own numbering.
+type netflowField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+	isScope    bool
+}
+
+// netflowRecord is a decoded flow record or sFlow sample.
+type netflowRecord map[string]interface{}
+
+// netflowVariableLength marks IPFIX fields with variable length.
+const netflowVariableLength = 0xffff
+
+// netflowFieldNames maps information element IDs to IANA names.
+var netflowFieldNames = map[uint16]string{
+	1: "octetDeltaCount", 2: "packetDeltaCount", 3: "deltaFlowCount",
+	4: "protocolIdentifier", 5: "ipClassOfService", 6: "tcpControlBits",
+	7: "sourceTransportPort", 8: "sourceIPv4Address", 9: "sourceIPv4PrefixLength",
+	10: "ingressInterface", 11: "destinationTransportPort", 12: "destinationIPv4Address",
+	13: "destinationIPv4PrefixLength", 14: "egressInterface", 15: "ipNextHopIPv4Address",
+	16: "bgpSourceAsNumber", 17: "bgpDestinationAsNumber", 18: "bgpNextHopIPv4Address",
+	19: "postMCastPacketDeltaCount", 20: "postMCastOctetDeltaCount", 21: "flowEndSysUpTime",
+	22: "flowStartSysUpTime", 23: "postOctetDeltaCount", 24: "postPacketDeltaCount",
+	25: "minimumIpTotalLength", 26: "maximumIpTotalLength", 27: "sourceIPv6Address",
+	28: "destinationIPv6Address", 29: "sourceIPv6PrefixLength", 30: "destinationIPv6PrefixLength",
+	31: "flowLabelIPv6", 32: "icmpTypeCodeIPv4", 33: "igmpType",
+	34: "samplingInterval", 35: "samplingAlgorithm", 36: "flowActiveTimeout",
+	37: "flowIdleTimeout", 38: "engineType", 39: "engineId",
+	40: "exportedOctetTotalCount", 41: "exportedMessageTotalCount", 42: "exportedFlowRecordTotalCount",
+	44: "sourceIPv4Prefix", 45: "destinationIPv4Prefix", 46: "mplsTopLabelType",
+	47: "mplsTopLabelIPv4Address", 48: "samplerId", 49: "samplerMode",
+	50: "samplerRandomInterval", 52: "minimumTTL", 53: "maximumTTL",
+	54: "fragmentIdentification", 55: "postIpClassOfService", 56: "sourceMacAddress",
+	57: "postDestinationMacAddress", 58: "vlanId", 59: "postVlanId",
+	60: "ipVersion", 61: "flowDirection", 62: "ipNextHopIPv6Address",
+	63: "bgpNextHopIPv6Address", 64: "ipv6ExtensionHeaders", 70: "mplsTopLabelStackSection",
+	80: "destinationMacAddress", 81: "postSourceMacAddress", 82: "interfaceName",
+	83: "interfaceDescription", 84: "samplerName", 85: "octetTotalCount",
+	86: "packetTotalCount", 88: "fragmentOffset", 89: "forwardingStatus",
+	94: "applicationDescription", 95: "applicationId", 96: "applicationName",
+	130: "exporterIPv4Address", 131: "exporterIPv6Address", 136: "flowEndReason",
+	148: "flowId", 150: "flowStartSeconds", 151: "flowEndSeconds",
+	152: "flowStartMilliseconds", 153: "flowEndMilliseconds", 176: "icmpTypeIPv4",
+	177: "icmpCodeIPv4", 225: "postNATSourceIPv4Address", 226: "postNATDestinationIPv4Address",
+	227: "postNAPTSourceTransportPort", 228: "postNAPTDestinationTransportPort",
+}
+
+// netflowScopeNames maps the scope field types of NetFlow v9 options
+// templates to names.
+var netflowScopeNames = map[uint16]string{
+	1: "scopeSystem", 2: "scopeInterface", 3: "scopeLineCard", 4: "scopeCache", 5: "scopeTemplate",
+}
+
+const (
+	netflowKindIPv4 = iota + 1
+	netflowKindIPv6
+	netflowKindMAC
+	netflowKindString
+)
+
+// netflowFieldKinds defines the information elements that are not decoded
+// as numbers.
+var netflowFieldKinds = map[uint16]int{
+	8: netflowKindIPv4, 12: netflowKindIPv4, 15: netflowKindIPv4, 18: netflowKindIPv4,
+	44: netflowKindIPv4, 45: netflowKindIPv4, 47: netflowKindIPv4, 130: netflowKindIPv4,
+	225: netflowKindIPv4, 226: netflowKindIPv4,
+	27: netflowKindIPv6, 28: netflowKindIPv6, 62: netflowKindIPv6, 63: netflowKindIPv6,
+	131: netflowKindIPv6,
+	56:  netflowKindMAC, 57: netflowKindMAC, 80: netflowKindMAC, 81: netflowKindMAC,
+	82: netflowKindString, 83: netflowKindString, 84: netflowKindString,
+	94: netflowKindString, 96: netflowKindString,
+}
+
+func init() {
+	core.TypeRegistry.Register(Netflow{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *Netflow) Configure(conf core.PluginConfigReader) {
+	cons.SetPrepareStopCallback(cons.close)
+	cons.templates = make(map[string]*netflowTemplate)
+}
+
+// Consume listens for datagrams until the consumer is stopped.
+func (cons *Netflow) Consume(workers *sync.WaitGroup) {
+	addr, err := net.ResolveUDPAddr("udp", cons.address)
+	if err == nil {
+		cons.conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+		cons.ControlLoop()
+		return
+	}
+
+	if err := cons.conn.SetReadBuffer(cons.receiveBufferSize); err != nil {
+		cons.Logger.WithError(err).Warning("Failed to set receive buffer size")
+	}
+
+	go tgo.WithRecoverShutdown(func() {
+		cons.AddMainWorker(workers)
+		defer cons.WorkerDone()
+		cons.read()
+	})
+
+	cons.ControlLoop()
+}
+
+func (cons *Netflow) close() {
+	if cons.conn != nil {
+		cons.conn.Close()
+	}
+}
+
+func (cons *Netflow) read() {
+	buffer := make([]byte, 65535)
+	for {
+		size, addr, err := cons.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if !cons.IsStopping() {
+				cons.Logger.WithError(err).Errorf("Failed to read from %s", cons.address)
+				time.Sleep(time.Second)
+				continue
+			}
+			return // ### return, stopped ###
+		}
+
+		exporter := addr.IP.String()
+		flowType, records, err := cons.decode(buffer[:size], exporter)
+		if err != nil {
+			cons.Logger.WithError(err).Warningf("Failed to decode datagram from %s", exporter)
+		}
+
+		for _, record := range records {
+			payload, err := json.Marshal(record)
+			if err != nil {
+				cons.Logger.WithError(err).Errorf("Failed to encode record from %s", exporter)
+				continue
+			}
+
+			metaData := core.Metadata{}
+			metaData.SetValue("exporter", []byte(exporter))
+			metaData.SetValue("flow_type", []byte(flowType))
+			cons.EnqueueWithMetadata(payload, metaData)
+		}
+	}
+}
+
+// decode detects the protocol of a datagram and returns its records.
+// Records decoded before an error occurred are returned, too.
+func (cons *Netflow) decode(data []byte, exporter string) (string, []netflowRecord, error) {
+	if len(data) < 4 {
+		return "", nil, fmt.Errorf("datagram too short")
+	}
+
+	switch binary.BigEndian.Uint16(data) {
+	case 5:
+		records, err := netflowDecodeV5(data, exporter)
+		return netflowTypeV5, records, err
+	case 9:
+		records, err := cons.decodeV9(data, exporter)
+		return netflowTypeV9, records, err
+	case 10:
+		records, err := cons.decodeIPFIX(data, exporter)
+		return netflowTypeIPFIX, records, err
+	}
+
+	if binary.BigEndian.Uint32(data) == 5 {
+		records, err := netflowDecodeSFlow(data)
+		return netflowTypeSFlow, records, err
+	}
+	return "", nil, fmt.Errorf("unknown protocol version")
+}
+
+// netflowReader reads big endian values and remembers the first error.
+type netflowReader struct {
+	data []byte
+	err  error
+}
+
+func (r *netflowReader) bytes(size int) []byte {
+	if r.err != nil || size < 0 || len(r.data) < size {
+		r.err = fmt.Errorf("datagram too short")
+		r.data = nil
+		return make([]byte, size&0xffff)
+	}
+	value := r.data[:size]
+	r.data = r.data[size:]
+	return value
+}
+
+func (r *netflowReader) uint8() uint8   { return r.bytes(1)[0] }
+func (r *netflowReader) uint16() uint16 { return binary.BigEndian.Uint16(r.bytes(2)) }
+func (r *netflowReader) uint32() uint32 { return binary.BigEndian.Uint32(r.bytes(4)) }
+func (r *netflowReader) uint64() uint64 { return binary.BigEndian.Uint64(r.bytes(8)) }
+func (r *netflowReader) ip(size int) string {
+	return net.IP(r.bytes(size)).String()
+}
+
+func netflowDecodeV5(data []byte, exporter string) ([]netflowRecord, error) {
+	r := &netflowReader{data: data}
+	r.uint16() // version
+	count := int(r.uint16())
+	uptime := r.uint32()
+	exportTime := r.uint32()
+	r.uint32() // nanoseconds
+	sequence := r.uint32()
+	engineType := r.uint8()
+	engineID := r.uint8()
+	samplingInterval := r.uint16() & 0x3fff
+
+	records := make([]netflowRecord, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		record := netflowRecord{
+			"flow_type":        netflowTypeV5,
+			"exporter":         exporter,
+			"sequence":         sequence,
+			"export_time":      exportTime,
+			"engineType":       engineType,
+			"engineId":         engineID,
+			"samplingInterval": samplingInterval,
+		}
+		record["sourceIPv4Address"] = r.ip(4)
+		record["destinationIPv4Address"] = r.ip(4)
+		record["ipNextHopIPv4Address"] = r.ip(4)
+		record["ingressInterface"] = r.uint16()
+		record["egressInterface"] = r.uint16()
+		record["packetDeltaCount"] = r.uint32()
+		record["octetDeltaCount"] = r.uint32()
+		record["flowStartSysUpTime"] = r.uint32()
+		record["flowEndSysUpTime"] = r.uint32()
+		record["sourceTransportPort"] = r.uint16()
+		record["destinationTransportPort"] = r.uint16()
+		r.uint8() // padding
+		record["tcpControlBits"] = r.uint8()
+		record["protocolIdentifier"] = r.uint8()
+		record["ipClassOfService"] = r.uint8()
+		record["bgpSourceAsNumber"] = r.uint16()
+		record["bgpDestinationAsNumber"] = r.uint16()
+		record["sourceIPv4PrefixLength"] = r.uint8()
+		record["destinationIPv4PrefixLength"] = r.uint8()
+		r.uint16() // padding
+
+		if r.err == nil {
+			netflowAddAbsoluteTimes(record, exportTime, uptime)
+			records = append(records, record)
+		}
+	}
+	return records, r.err
+}
+
+func (cons *Netflow) decodeV9(data []byte, exporter string) ([]netflowRecord, error) {
+	r := &netflowReader{data: data}
+	r.uint16() // version
+	r.uint16() // count
+	uptime := r.uint32()
+	exportTime := r.uint32()
+	sequence := r.uint32()
+	sourceID := r.uint32()
+
+	var records []netflowRecord
+	for len(r.data) >= 4 && r.err == nil {
+		setID := r.uint16()
+		length := int(r.uint16())
+		if length < 4 {
+			return records, fmt.Errorf("invalid flowset length %d", length)
+		}
+		set := &netflowReader{data: r.bytes(length - 4)}
+		if r.err != nil {
+			break
+		}
+
+		switch {
+		case setID == 0:
+			for len(set.data) >= 4 && set.err == nil {
+				templateID := set.uint16()
+				fields := make([]netflowField, set.uint16())
+				for i := range fields {
+					fields[i] = netflowField{id: set.uint16(), length: set.uint16()}
+				}
+				if set.err == nil {
+					cons.setTemplate(exporter, 9, sourceID, templateID, fields)
+				}
+			}
+
+		case setID == 1:
+			for len(set.data) >= 6 && set.err == nil {
+				templateID := set.uint16()
+				scopeLength := int(set.uint16())
+				optionLength := int(set.uint16())
+				if templateID == 0 {
+					break // padding
+				}
+				var fields []netflowField
+				for i := 0; i < scopeLength/4; i++ {
+					fields = append(fields, netflowField{id: set.uint16(), length: set.uint16(), isScope: true})
+				}
+				for i := 0; i < optionLength/4; i++ {
+					fields = append(fields, netflowField{id: set.uint16(), length: set.uint16()})
+				}
+				if set.err == nil {
+					cons.setTemplate(exporter, 9, sourceID, templateID, fields)
+				}
+			}
+
+		case setID >= 256:
+			template := cons.getTemplate(exporter, 9, sourceID, setID)
+			if template == nil {
+				cons.Logger.Debugf("Dropping flowset of unknown template %d from %s", setID, exporter)
+				continue
+			}
+			for _, record := range netflowDecodeDataSet(set, template) {
+				record["flow_type"] = netflowTypeV9
+				record["exporter"] = exporter
+				record["sequence"] = sequence
+				record["export_time"] = exportTime
+				netflowAddAbsoluteTimes(record, exportTime, uptime)
+				records = append(records, record)
+			}
+		}
+
+		if set.err != nil {
+			return records, set.err
+		}
+	}
+	return records, r.err
+}
+
+func (cons *Netflow) decodeIPFIX(data []byte, exporter string) ([]netflowRecord, error) {
+	r := &netflowReader{data: data}
+	r.uint16() // version
+	length := int(r.uint16())
+	exportTime := r.uint32()
+	sequence := r.uint32()
+	domainID := r.uint32()
+	if length < 16 || length > len(data) {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+	r.data = r.data[:length-16]
+
+	var records []netflowRecord
+	for len(r.data) >= 4 && r.err == nil {
+		setID := r.uint16()
+		setLength := int(r.uint16())
+		if setLength < 4 {
+			return records, fmt.Errorf("invalid set length %d", setLength)
+		}
+		set := &netflowReader{data: r.bytes(setLength - 4)}
+		if r.err != nil {
+			break
+		}
+
+		switch {
+		case setID == 2 || setID == 3:
+			for len(set.data) >= 4 && set.err == nil {
+				templateID := set.uint16()
+				fieldCount := int(set.uint16())
+				if fieldCount == 0 {
+					cons.deleteTemplate(exporter, 10, domainID, templateID)
+					continue // template withdrawal
+				}
+				if setID == 3 {
+					set.uint16() // scope field count
+				}
+
+				fields := make([]netflowField, fieldCount)
+				for i := range fields {
+					fields[i] = netflowField{id: set.uint16(), length: set.uint16()}
+					if fields[i].id&0x8000 != 0 {
+						fields[i].id &= 0x7fff
+						fields[i].enterprise = set.uint32()
+					}
+				}
+				if set.err == nil {
+					cons.setTemplate(exporter, 10, domainID, templateID, fields)
+				}
+			}
+
+		case setID >= 256:
+			template := cons.getTemplate(exporter, 10, domainID, setID)
+			if template == nil {
+				cons.Logger.Debugf("Dropping set of unknown template %d from %s", setID, exporter)
+				continue
+			}
+			for _, record := range netflowDecodeDataSet(set, template) {
+				record["flow_type"] = netflowTypeIPFIX
+				record["exporter"] = exporter
+				record["sequence"] = sequence
+				record["export_time"] = exportTime
+				records = append(records, record)
+			}
+		}
+
+		if set.err != nil {
+			return records, set.err
+		}
+	}
+	return records, r.err
+}
+
+func netflowTemplateKey(exporter string, version uint16, domainID uint32, templateID uint16) string {
+	return fmt.Sprintf("%s/%d/%d/%d", exporter, version, domainID, templateID)
+}
+
+func (cons *Netflow) setTemplate(exporter string, version uint16, domainID uint32, templateID uint16, fields []netflowField) {
+	if templateID < 256 {
+		return // reserved for set IDs
+	}
+	cons.templates[netflowTemplateKey(exporter, version, domainID, templateID)] = &netflowTemplate{
+		fields:  fields,
+		updated: time.Now(),
+	}
+}
+
+func (cons *Netflow) getTemplate(exporter string, version uint16, domainID uint32, templateID uint16) *netflowTemplate {
+	key := netflowTemplateKey(exporter, version, domainID, templateID)
+	template, exists := cons.templates[key]
+	if !exists {
+		return nil
+	}
+	if time.Since(template.updated) > cons.templateTimeout {
+		delete(cons.templates, key)
+		return nil
+	}
+	return template
+}
+
+func (cons *Netflow) deleteTemplate(exporter string, version uint16, domainID uint32, templateID uint16) {
+	delete(cons.templates, netflowTemplateKey(exporter, version, domainID, templateID))
+}
+
+// netflowDecodeDataSet decodes all records of a data set. Trailing padding
+// is ignored.
+func netflowDecodeDataSet(set *netflowReader, template *netflowTemplate) []netflowRecord {
+	minLength := 0
+	for _, field := range template.fields {
+		if field.length == netflowVariableLength {
+			minLength++
+		} else {
+			minLength += int(field.length)
+		}
+	}
+	if minLength == 0 {
+		return nil
+	}
+
+	var records []netflowRecord
+	for len(set.data) >= minLength && set.err == nil {
+		record := netflowRecord{}
+		for _, field := range template.fields {
+			length := int(field.length)
+			if field.length == netflowVariableLength {
+				if length = int(set.uint8()); length == 255 {
+					length = int(set.uint16())
+				}
+			}
+			name, value := netflowDecodeField(field, set.bytes(length))
+			record[name] = value
+		}
+		if set.err == nil {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// netflowDecodeField returns the name and the decoded value of a field.
+func netflowDecodeField(field netflowField, data []byte) (string, interface{}) {
+	var name string
+	switch {
+	case field.enterprise != 0:
+		return fmt.Sprintf("%d_%d", field.enterprise, field.id), netflowDecodeNumber(data)
+	case field.isScope:
+		if name = netflowScopeNames[field.id]; name == "" {
+			name = fmt.Sprintf("scope_%d", field.id)
+		}
+		return name, netflowDecodeNumber(data)
+	}
+
+	if name = netflowFieldNames[field.id]; name == "" {
+		name = fmt.Sprintf("field_%d", field.id)
+	}
+
+	switch netflowFieldKinds[field.id] {
+	case netflowKindIPv4, netflowKindIPv6:
+		if len(data) == net.IPv4len || len(data) == net.IPv6len {
+			return name, net.IP(data).String()
+		}
+	case netflowKindMAC:
+		if len(data) == 6 {
+			return name, net.HardwareAddr(data).String()
+		}
+	case netflowKindString:
+		return name, strings.TrimRight(string(data), "\x00")
+	}
+	return name, netflowDecodeNumber(data)
+}
+
+// netflowDecodeNumber decodes unsigned integers of up to 8 bytes. Longer
+// values are returned as hex string.
+func netflowDecodeNumber(data []byte) interface{} {
+	if len(data) > 8 || len(data) == 0 {
+		return hex.EncodeToString(data)
+	}
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// netflowAddAbsoluteTimes converts the flow times relative to the system
+// uptime of NetFlow records into milliseconds since epoch.
+func netflowAddAbsoluteTimes(record netflowRecord, exportTime, uptime uint32) {
+	bootTime := int64(exportTime)*1000 - int64(uptime)
+	for relative, absolute := range map[string]string{
+		"flowStartSysUpTime": "flowStartMilliseconds",
+		"flowEndSysUpTime":   "flowEndMilliseconds",
+	} {
+		if _, exists := record[absolute]; exists {
+			continue
+		}
+		switch value := record[relative].(type) {
+		case uint32:
+			record[absolute] = bootTime + int64(value)
+		case uint64:
+			record[absolute] = bootTime + int64(value)
+		}
+	}
+}
+
+func netflowDecodeSFlow(data []byte) ([]netflowRecord, error) {
+	r := &netflowReader{data: data}
+	r.uint32() // version
+
+	var agent string
+	switch addressType := r.uint32(); addressType {
+	case 1:
+		agent = r.ip(net.IPv4len)
+	case 2:
+		agent = r.ip(net.IPv6len)
+	default:
+		return nil, fmt.Errorf("unknown agent address type %d", addressType)
+	}
+	subAgentID := r.uint32()
+	sequence := r.uint32()
+	r.uint32() // uptime
+	numSamples := int(r.uint32())
+
+	var records []netflowRecord
+	for i := 0; i < numSamples && r.err == nil; i++ {
+		tag := r.uint32()
+		sample := &netflowReader{data: r.bytes(int(r.uint32()))}
+		if r.err != nil {
+			break
+		}
+		if tag>>12 != 0 {
+			continue // enterprise specific sample
+		}
+
+		record := netflowRecord{
+			"flow_type":    netflowTypeSFlow,
+			"exporter":     agent,
+			"sub_agent_id": subAgentID,
+			"sequence":     sequence,
+		}
+
+		switch format := tag & 0xfff; format {
+		case 1, 3:
+			netflowDecodeSFlowFlowSample(sample, record, format == 3)
+		case 2, 4:
+			if !netflowDecodeSFlowCounterSample(sample, record, format == 4) {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if sample.err != nil {
+			return records, sample.err
+		}
+		records = append(records, record)
+	}
+	return records, r.err
+}
+
+func netflowDecodeSFlowSampleHeader(sample *netflowReader, record netflowRecord, isExpanded bool) {
+	record["sample_sequence"] = sample.uint32()
+	if isExpanded {
+		record["source_id_type"] = sample.uint32()
+		record["source_id_index"] = sample.uint32()
+	} else {
+		sourceID := sample.uint32()
+		record["source_id_type"] = sourceID >> 24
+		record["source_id_index"] = sourceID & 0xffffff
+	}
+}
+
+func netflowDecodeSFlowFlowSample(sample *netflowReader, record netflowRecord, isExpanded bool) {
+	record["sample_type"] = "flow"
+	netflowDecodeSFlowSampleHeader(sample, record, isExpanded)
+	record["sampling_rate"] = sample.uint32()
+	record["sample_pool"] = sample.uint32()
+	record["drops"] = sample.uint32()
+	if isExpanded {
+		sample.uint32() // input format
+		record["ingressInterface"] = sample.uint32()
+		sample.uint32() // output format
+		record["egressInterface"] = sample.uint32()
+	} else {
+		record["ingressInterface"] = sample.uint32() & 0x3fffffff
+		record["egressInterface"] = sample.uint32() & 0x3fffffff
+	}
+
+	numRecords := int(sample.uint32())
+	for i := 0; i < numRecords && sample.err == nil; i++ {
+		tag := sample.uint32()
+		flow := &netflowReader{data: sample.bytes(int(sample.uint32()))}
+		if sample.err != nil {
+			break
+		}
+
+		switch tag {
+		case 1: // raw packet header
+			protocol := flow.uint32()
+			record["frame_length"] = flow.uint32()
+			flow.uint32() // stripped
+			header := flow.bytes(int(flow.uint32()))
+			if protocol == 1 && flow.err == nil {
+				netflowDecodeEthernet(record, header)
+			}
+
+		case 3: // IPv4 data
+			record["ipTotalLength"] = flow.uint32()
+			record["protocolIdentifier"] = flow.uint32()
+			record["sourceIPv4Address"] = flow.ip(net.IPv4len)
+			record["destinationIPv4Address"] = flow.ip(net.IPv4len)
+			record["sourceTransportPort"] = flow.uint32()
+			record["destinationTransportPort"] = flow.uint32()
+			record["tcpControlBits"] = flow.uint32()
+			record["ipClassOfService"] = flow.uint32()
+
+		case 1001: // extended switch data
+			record["vlanId"] = flow.uint32()
+			flow.uint32() // source priority
+			record["postVlanId"] = flow.uint32()
+		}
+	}
+}
+
+func netflowDecodeSFlowCounterSample(sample *netflowReader, record netflowRecord, isExpanded bool) bool {
+	record["sample_type"] = "counter"
+	netflowDecodeSFlowSampleHeader(sample, record, isExpanded)
+
+	hasCounters := false
+	numRecords := int(sample.uint32())
+	for i := 0; i < numRecords && sample.err == nil; i++ {
+		tag := sample.uint32()
+		counters := &netflowReader{data: sample.bytes(int(sample.uint32()))}
+		if sample.err != nil || tag != 1 {
+			continue // not generic interface counters
+		}
+
+		record["if_index"] = counters.uint32()
+		record["if_type"] = counters.uint32()
+		record["if_speed"] = counters.uint64()
+		record["if_direction"] = counters.uint32()
+		record["if_status"] = counters.uint32()
+		record["if_in_octets"] = counters.uint64()
+		record["if_in_ucast_pkts"] = counters.uint32()
+		record["if_in_multicast_pkts"] = counters.uint32()
+		record["if_in_broadcast_pkts"] = counters.uint32()
+		record["if_in_discards"] = counters.uint32()
+		record["if_in_errors"] = counters.uint32()
+		record["if_in_unknown_protos"] = counters.uint32()
+		record["if_out_octets"] = counters.uint64()
+		record["if_out_ucast_pkts"] = counters.uint32()
+		record["if_out_multicast_pkts"] = counters.uint32()
+		record["if_out_broadcast_pkts"] = counters.uint32()
+		record["if_out_discards"] = counters.uint32()
+		record["if_out_errors"] = counters.uint32()
+		record["if_promiscuous_mode"] = counters.uint32()
+		hasCounters = counters.err == nil
+	}
+	return hasCounters
+}
+
+// netflowDecodeEthernet adds the addresses, ports and protocol of a sampled
+// ethernet frame to a record. Truncated headers are decoded as far as
+// possible.
+func netflowDecodeEthernet(record netflowRecord, frame []byte) {
+	if len(frame) < 14 {
+		return
+	}
+	record["destinationMacAddress"] = net.HardwareAddr(frame[0:6]).String()
+	record["sourceMacAddress"] = net.HardwareAddr(frame[6:12]).String()
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	payload := frame[14:]
+
+	if etherType == 0x8100 && len(payload) >= 4 {
+		record["vlanId"] = binary.BigEndian.Uint16(payload[0:2]) & 0x0fff
+		etherType = binary.BigEndian.Uint16(payload[2:4])
+		payload = payload[4:]
+	}
+	record["ethernetType"] = etherType
+
+	var (
+		protocol  uint8
+		transport []byte
+	)
+	switch {
+	case etherType == 0x0800 && len(payload) >= 20:
+		headerLength := int(payload[0]&0x0f) * 4
+		protocol = payload[9]
+		record["ipVersion"] = 4
+		record["ipClassOfService"] = payload[1]
+		record["ipTotalLength"] = binary.BigEndian.Uint16(payload[2:4])
+		record["ipTTL"] = payload[8]
+		record["protocolIdentifier"] = protocol
+		record["sourceIPv4Address"] = net.IP(payload[12:16]).String()
+		record["destinationIPv4Address"] = net.IP(payload[16:20]).String()
+		if headerLength <= len(payload) {
+			transport = payload[headerLength:]
+		}
+
+	case etherType == 0x86dd && len(payload) >= 40:
+		protocol = payload[6]
+		record["ipVersion"] = 6
+		record["protocolIdentifier"] = protocol
+		record["sourceIPv6Address"] = net.IP(payload[8:24]).String()
+		record["destinationIPv6Address"] = net.IP(payload[24:40]).String()
+		transport = payload[40:]
+	}
+
+	if (protocol == 6 || protocol == 17) && len(transport) >= 4 {
+		record["sourceTransportPort"] = binary.BigEndian.Uint16(transport[0:2])
+		record["destinationTransportPort"] = binary.BigEndian.Uint16(transport[2:4])
+		if protocol == 6 && len(transport) >= 14 {
+			record["tcpControlBits"] = transport[13]
+		}
+	}
+}
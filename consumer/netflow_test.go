@@ -0,0 +1,179 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// netflowTestData encodes the given values in network byte order.
+func netflowTestData(values ...interface{}) []byte {
+	buffer := bytes.Buffer{}
+	for _, value := range values {
+		binary.Write(&buffer, binary.BigEndian, value)
+	}
+	return buffer.Bytes()
+}
+
+// netflowTestSet prefixes the given content by a set or flowset header.
+func netflowTestSet(setID uint16, content ...interface{}) []byte {
+	data := netflowTestData(content...)
+	return append(netflowTestData(setID, uint16(len(data)+4)), data...)
+}
+
+func netflowTestV9(sets ...[]byte) []byte {
+	// version, count, uptime, export time, sequence, source id
+	data := netflowTestData(uint16(9), uint16(len(sets)), uint32(1000), uint32(1500000000), uint32(42), uint32(0))
+	return append(data, bytes.Join(sets, nil)...)
+}
+
+func netflowTestIPFIX(sets ...[]byte) []byte {
+	content := bytes.Join(sets, nil)
+	// version, length, export time, sequence, domain id
+	data := netflowTestData(uint16(10), uint16(len(content)+16), uint32(1500000000), uint32(42), uint32(1))
+	return append(data, content...)
+}
+
+func TestNetflowDecode(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	v5Header := netflowTestData(uint16(5), uint16(1), uint32(1000), uint32(1500000000), uint32(0), uint32(42),
+		uint8(1), uint8(2), uint16(0x4000|100))
+	v5Record := netflowTestData([]byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}, []byte{0, 0, 0, 0},
+		uint16(1), uint16(2), uint32(10), uint32(1000), uint32(500), uint32(900),
+		uint16(1234), uint16(80), uint8(0), uint8(0x12), uint8(6), uint8(0),
+		uint16(0), uint16(0), uint8(24), uint8(24), uint16(0))
+
+	v9Template := netflowTestSet(0, uint16(256), uint16(3), uint16(8), uint16(4), uint16(12), uint16(4), uint16(1), uint16(4))
+	v9TruncatedTemplate := netflowTestSet(0, uint16(256), uint16(3), uint16(8), uint16(4), uint16(12), uint16(4))
+	v9Data := netflowTestSet(256, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}, uint32(500))
+	v9Options := netflowTestSet(1, uint16(257), uint16(4), uint16(4), uint16(1), uint16(4), uint16(34), uint16(4), uint16(0))
+	v9OptionsData := netflowTestSet(257, uint32(3), uint32(100))
+
+	ipfixTemplate := netflowTestSet(2, uint16(300), uint16(3), uint16(8), uint16(4), uint16(82), uint16(0xffff),
+		uint16(0x8000|100), uint16(2), uint32(9))
+	ipfixData := netflowTestSet(300, []byte{10, 0, 0, 1}, uint8(3), []byte("eth"), uint16(7))
+	ipfixWithdrawal := netflowTestSet(2, uint16(300), uint16(0))
+
+	sflowFrame := netflowTestData(
+		[]byte{1, 2, 3, 4, 5, 6}, []byte{6, 5, 4, 3, 2, 1}, uint16(0x0800),
+		[]byte{0x45, 0, 0, 40, 0, 0, 0, 0, 64, 6, 0, 0}, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2},
+		uint16(1234), uint16(443), uint32(0), uint32(0), uint8(0x50), uint8(0x02))
+	sflowRaw := netflowTestData(uint32(1), uint32(len(sflowFrame)+16), uint32(1), uint32(1500), uint32(0), uint32(len(sflowFrame)), sflowFrame)
+	sflowSample := netflowTestData(uint32(7), uint32(3), uint32(100), uint32(1000), uint32(0), uint32(1), uint32(2), uint32(1), sflowRaw)
+	sflowHeader := netflowTestData(uint32(5), uint32(1), []byte{192, 0, 2, 1}, uint32(0), uint32(42), uint32(1000))
+	sflow := append(append([]byte{}, sflowHeader...), netflowTestData(uint32(1), uint32(1), uint32(len(sflowSample)), sflowSample)...)
+
+	tests := []struct {
+		name    string
+		packets [][]byte
+		records int
+		isValid bool
+		fields  map[string]interface{}
+	}{
+		{"v5", [][]byte{append(v5Header, v5Record...)}, 1, true, map[string]interface{}{
+			"flow_type":             netflowTypeV5,
+			"sourceIPv4Address":     "10.0.0.1",
+			"octetDeltaCount":       uint32(1000),
+			"samplingInterval":      uint16(100),
+			"tcpControlBits":        uint8(0x12),
+			"flowStartMilliseconds": int64(1500000000*1000 - 1000 + 500),
+		}},
+		{"v5 truncated record", [][]byte{append(v5Header, v5Record[:20]...)}, 0, false, nil},
+		{"v5 missing record", [][]byte{append(netflowTestData(uint16(5), uint16(2)), append(v5Header[4:], v5Record...)...)}, 1, false, nil},
+		{"v5 truncated header", [][]byte{v5Header[:10]}, 0, false, nil},
+
+		{"v9", [][]byte{netflowTestV9(v9Template, v9Data)}, 1, true, map[string]interface{}{
+			"flow_type":              netflowTypeV9,
+			"exporter":               "192.0.2.1",
+			"sourceIPv4Address":      "10.0.0.1",
+			"destinationIPv4Address": "10.0.0.2",
+			"octetDeltaCount":        uint64(500),
+		}},
+		{"v9 template in previous datagram", [][]byte{netflowTestV9(v9Template), netflowTestV9(v9Data)}, 1, true, nil},
+		{"v9 options", [][]byte{netflowTestV9(v9Options, v9OptionsData)}, 1, true, map[string]interface{}{
+			"scopeSystem":      uint64(3),
+			"samplingInterval": uint64(100),
+		}},
+		{"v9 unknown template", [][]byte{netflowTestV9(netflowTestSet(258, uint32(1)))}, 0, true, nil},
+		{"v9 truncated template", [][]byte{netflowTestV9(v9Template[:14]), netflowTestV9(v9Data)}, 0, true, nil},
+		{"v9 truncated template fields", [][]byte{netflowTestV9(v9TruncatedTemplate), netflowTestV9(v9Data)}, 0, true, nil},
+		{"v9 truncated flowset", [][]byte{netflowTestV9(v9Template, v9Data[:10])}, 0, false, nil},
+		{"v9 invalid flowset length", [][]byte{netflowTestV9(netflowTestData(uint16(256), uint16(2)))}, 0, false, nil},
+
+		{"ipfix", [][]byte{netflowTestIPFIX(ipfixTemplate, ipfixData)}, 1, true, map[string]interface{}{
+			"flow_type":         netflowTypeIPFIX,
+			"sourceIPv4Address": "10.0.0.1",
+			"interfaceName":     "eth",
+			"9_100":             uint64(7),
+		}},
+		{"ipfix template withdrawal", [][]byte{netflowTestIPFIX(ipfixTemplate, ipfixWithdrawal, ipfixData)}, 0, true, nil},
+		{"ipfix truncated template", [][]byte{netflowTestIPFIX(netflowTestSet(2, uint16(300), uint16(3), uint16(8), uint16(4)), ipfixData)}, 0, false, nil},
+		{"ipfix truncated message", [][]byte{netflowTestIPFIX(ipfixTemplate, ipfixData)[:40]}, 0, false, nil},
+		{"ipfix invalid message length", [][]byte{netflowTestData(uint16(10), uint16(8), uint32(0), uint32(0), uint32(0))}, 0, false, nil},
+		{"ipfix invalid set length", [][]byte{netflowTestIPFIX(netflowTestData(uint16(2), uint16(3)))}, 0, false, nil},
+		{"ipfix truncated variable length field", [][]byte{netflowTestIPFIX(ipfixTemplate, netflowTestSet(300, []byte{10, 0, 0, 1}, uint8(255), uint8(0)))}, 0, true, nil},
+
+		{"sflow", [][]byte{sflow}, 1, true, map[string]interface{}{
+			"flow_type":                netflowTypeSFlow,
+			"exporter":                 "192.0.2.1",
+			"sample_type":              "flow",
+			"sampling_rate":            uint32(100),
+			"source_id_index":          uint32(3),
+			"sourceMacAddress":         "06:05:04:03:02:01",
+			"sourceIPv4Address":        "10.0.0.1",
+			"destinationTransportPort": uint16(443),
+			"tcpControlBits":           uint8(0x02),
+		}},
+		{"sflow enterprise sample", [][]byte{append(append([]byte{}, sflowHeader...), netflowTestData(uint32(1), uint32(1<<12|1), uint32(4), uint32(0))...)}, 0, true, nil},
+		{"sflow truncated sample", [][]byte{sflow[:len(sflow)-8]}, 0, false, nil},
+		{"sflow unknown address type", [][]byte{netflowTestData(uint32(5), uint32(3), uint32(0))}, 0, false, nil},
+
+		{"too short", [][]byte{{0, 5, 0}}, 0, false, nil},
+		{"unknown version", [][]byte{netflowTestData(uint16(7), uint16(0), uint32(0))}, 0, false, nil},
+	}
+
+	for _, test := range tests {
+		conf := core.NewPluginConfig("", "consumer.Netflow")
+
+		plugin, err := core.NewPluginWithConfig(conf)
+		expect.NoError(err)
+		cons, casted := plugin.(*Netflow)
+		expect.True(casted)
+
+		var records []netflowRecord
+		for _, packet := range test.packets {
+			_, records, err = cons.decode(packet, "192.0.2.1")
+		}
+
+		if (err == nil) != test.isValid {
+			t.Errorf("%s: unexpected error result %v", test.name, err)
+		}
+		if len(records) != test.records {
+			t.Errorf("%s: expected %d records, got %d", test.name, test.records, len(records))
+			continue
+		}
+		for key, value := range test.fields {
+			if records[0][key] != value {
+				t.Errorf("%s: expected %s to be %#v, got %#v", test.name, key, value, records[0][key])
+			}
+		}
+	}
+}
@@ -0,0 +1,506 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq" // postgres driver
+	"github.com/trivago/gollum/core"
+)
+
+const (
+	postgresCDCPgoutput = "pgoutput"
+	postgresCDCWal2json = "wal2json"
+)
+
+// PostgresCDC consumer plugin
+//
+// The PostgresCDC consumer reads row changes from a logical replication slot
+// and generates one JSON message per inserted, updated, deleted or truncated
+// row. Changes are read in whole transactions. The slot is only advanced
+// after all changes read have been passed on, so the slot's position acts as
+// checkpoint and changes are read again if gollum stops before that.
+// Both the built-in "pgoutput" plugin and "wal2json" are supported. Changes
+// are read using the SQL interface to logical decoding, so no replication
+// connection is required, but the user needs the REPLICATION attribute.
+//
+// Each message has the following fields:
+//
+//  {
+//    "op": "insert|update|delete|truncate",
+//    "schema": "public",
+//    "table": "orders",
+//    "lsn": "0/16B3748",
+//    "xid": 741,
+//    "columns": {"id": "1", "state": "paid"},
+//    "old": {"id": "1"}
+//  }
+//
+// "old" contains the replica identity of updated and deleted rows. With
+// pgoutput, all values are strings in PostgreSQL's text representation and
+// unchanged TOAST values are omitted. With wal2json, values are typed.
+//
+// Metadata
+//
+// - op: The operation, i.e. "insert", "update", "delete" or "truncate" (set)
+//
+// - schema: The schema of the changed table (set)
+//
+// - table: The name of the changed table (set)
+//
+// - lsn: The log sequence number of the change (set)
+//
+// Parameters
+//
+// - Connection: Defines the connection string or URL used to connect to the
+// database. See https://godoc.org/github.com/lib/pq for all supported options.
+// By default this parameter is set to "postgres://localhost:5432/postgres?sslmode=disable".
+//
+// - Slot: Defines the name of the logical replication slot.
+// By default this parameter is set to "gollum".
+//
+// - Plugin: Defines the output plugin of the slot. Valid values are
+// "pgoutput" and "wal2json".
+// By default this parameter is set to "pgoutput".
+//
+// - Publication: Defines the publication to read when using pgoutput. The
+// publication defines the tables changes are read from.
+// By default this parameter is set to "gollum".
+//
+// - CreateSlot: Set to false to fail instead of creating a missing slot.
+// By default this parameter is set to true.
+//
+// - PollIntervalMs: Defines the number of milliseconds to wait before
+// checking for new changes after all changes have been read.
+// By default this parameter is set to 1000.
+//
+// - BatchSize: Defines the number of changes read at once. Transactions are
+// never split, so batches can be larger.
+// By default this parameter is set to 1000.
+//
+// Examples
+//
+// This example streams all changes of the tables in the "orders" publication:
+//
+//  OrderChanges:
+//    Type: consumer.PostgresCDC
+//    Streams: order_changes
+//    Connection: "postgres://gollum@db01/shop?sslmode=require"
+//    Slot: gollum_orders
+//    Publication: orders
+//
+// The publication has to be created beforehand:
+//
+//  CREATE PUBLICATION orders FOR TABLE orders, order_items;
+type PostgresCDC struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	connection   string        `config:"Connection" default:"postgres://localhost:5432/postgres?sslmode=disable"`
+	slot         string        `config:"Slot" default:"gollum"`
+	plugin       string        `config:"Plugin" default:"pgoutput"`
+	publication  string        `config:"Publication" default:"gollum"`
+	createSlot   bool          `config:"CreateSlot" default:"true"`
+	pollInterval time.Duration `config:"PollIntervalMs" default:"1000" metric:"ms"`
+	batchSize    int           `config:"BatchSize" default:"1000"`
+
+	db            *sql.DB
+	peekQuery     string
+	confirmQuery  string
+	pluginOptions []interface{}
+	slotReady     bool
+	guard         *sync.Mutex
+}
+
+// postgresChange is a single row change.
+type postgresChange struct {
+	Op      string                 `json:"op"`
+	Schema  string                 `json:"schema"`
+	Table   string                 `json:"table"`
+	LSN     string                 `json:"lsn"`
+	XID     int64                  `json:"xid"`
+	Columns map[string]interface{} `json:"columns,omitempty"`
+	Old     map[string]interface{} `json:"old,omitempty"`
+}
+
+// postgresRelation is the table description sent by pgoutput.
+type postgresRelation struct {
+	schema  string
+	table   string
+	columns []string
+}
+
+// postgresWal2jsonChange is a change in wal2json format version 2.
+type postgresWal2jsonChange struct {
+	Action   string                   `json:"action"`
+	Schema   string                   `json:"schema"`
+	Table    string                   `json:"table"`
+	Columns  []postgresWal2jsonColumn `json:"columns"`
+	Identity []postgresWal2jsonColumn `json:"identity"`
+}
+
+type postgresWal2jsonColumn struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+func init() {
+	core.TypeRegistry.Register(PostgresCDC{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *PostgresCDC) Configure(conf core.PluginConfigReader) {
+	cons.SetPrepareStopCallback(cons.prepareStop)
+	cons.guard = new(sync.Mutex)
+	cons.plugin = strings.ToLower(cons.plugin)
+
+	switch cons.plugin {
+	case postgresCDCPgoutput:
+		cons.pluginOptions = []interface{}{"proto_version", "1", "publication_names", cons.publication}
+		cons.peekQuery = "SELECT lsn::text, xid::text, data FROM pg_logical_slot_peek_binary_changes($1, NULL, $2, $3, $4, $5, $6)"
+		cons.confirmQuery = "SELECT count(*) FROM pg_logical_slot_get_binary_changes($1, $2::pg_lsn, NULL, $3, $4, $5, $6)"
+
+	case postgresCDCWal2json:
+		cons.pluginOptions = []interface{}{"format-version", "2"}
+		cons.peekQuery = "SELECT lsn::text, xid::text, convert_to(data, 'UTF8') FROM pg_logical_slot_peek_changes($1, NULL, $2, $3, $4)"
+		cons.confirmQuery = "SELECT count(*) FROM pg_logical_slot_get_changes($1, $2::pg_lsn, NULL, $3, $4)"
+
+	default:
+		conf.Errors.Pushf("Plugin must be one of %s or %s", postgresCDCPgoutput, postgresCDCWal2json)
+	}
+
+	if cons.batchSize < 1 {
+		conf.Errors.Pushf("BatchSize must be at least 1")
+	}
+
+	db, err := sql.Open("postgres", cons.connection)
+	if !conf.Errors.Push(err) {
+		db.SetMaxOpenConns(1)
+		cons.db = db
+	}
+}
+
+// Consume reads changes until the consumer is stopped.
+func (cons *PostgresCDC) Consume(workers *sync.WaitGroup) {
+	cons.AddMainWorker(workers)
+	defer cons.WorkerDone()
+	defer cons.db.Close()
+
+	cons.TickerControlLoop(cons.pollInterval, cons.poll)
+}
+
+// prepareStop waits until the current batch has been processed.
+func (cons *PostgresCDC) prepareStop() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+}
+
+// poll reads changes until no more changes are available.
+func (cons *PostgresCDC) poll() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	if !cons.slotReady {
+		if err := cons.prepareSlot(); err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to prepare slot %s", cons.slot)
+			return
+		}
+		cons.slotReady = true
+	}
+
+	for cons.IsActive() {
+		numChanges, err := cons.readBatch()
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to read changes from slot %s", cons.slot)
+			return
+		}
+		if numChanges < cons.batchSize {
+			return // ### return, all changes read ###
+		}
+	}
+}
+
+func (cons *PostgresCDC) prepareSlot() error {
+	var exists bool
+	err := cons.db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)", cons.slot).Scan(&exists)
+	switch {
+	case err != nil:
+		return err
+	case exists:
+		return nil
+	case !cons.createSlot:
+		return fmt.Errorf("slot does not exist")
+	}
+
+	_, err = cons.db.Exec("SELECT pg_create_logical_replication_slot($1, $2)", cons.slot, cons.plugin)
+	if err == nil {
+		cons.Logger.Infof("Created replication slot %s", cons.slot)
+	}
+	return err
+}
+
+// readBatch reads a batch of changes without consuming them. The slot is
+// advanced after all changes have been enqueued. The number of changes read
+// is returned.
+func (cons *PostgresCDC) readBatch() (int, error) {
+	args := append([]interface{}{cons.slot, cons.batchSize}, cons.pluginOptions...)
+	rows, err := cons.db.Query(cons.peekQuery, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var (
+		numChanges int
+		lastLSN    string
+		relations  = make(map[uint32]postgresRelation)
+	)
+
+	for rows.Next() {
+		var (
+			lsn, xid string
+			data     []byte
+		)
+		if err := rows.Scan(&lsn, &xid, &data); err != nil {
+			return numChanges, err
+		}
+		numChanges++
+		lastLSN = lsn
+
+		xidValue, _ := strconv.ParseInt(xid, 10, 64)
+		var changes []postgresChange
+		if cons.plugin == postgresCDCPgoutput {
+			changes, err = postgresDecodePgoutput(data, relations)
+		} else {
+			changes, err = postgresDecodeWal2json(data)
+		}
+		if err != nil {
+			return numChanges, fmt.Errorf("failed to decode change at %s: %s", lsn, err)
+		}
+
+		for _, change := range changes {
+			change.LSN, change.XID = lsn, xidValue
+			cons.enqueue(change)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return numChanges, err
+	}
+	rows.Close()
+
+	if lastLSN != "" {
+		args = append([]interface{}{cons.slot, lastLSN}, cons.pluginOptions...)
+		if _, err := cons.db.Exec(cons.confirmQuery, args...); err != nil {
+			return numChanges, err
+		}
+	}
+	return numChanges, nil
+}
+
+func (cons *PostgresCDC) enqueue(change postgresChange) {
+	payload, err := json.Marshal(change)
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to encode change of %s.%s", change.Schema, change.Table)
+		return
+	}
+
+	metaData := core.Metadata{}
+	metaData.SetValue("op", []byte(change.Op))
+	metaData.SetValue("schema", []byte(change.Schema))
+	metaData.SetValue("table", []byte(change.Table))
+	metaData.SetValue("lsn", []byte(change.LSN))
+	cons.EnqueueWithMetadata(payload, metaData)
+}
+
+// postgresDecodeWal2json converts a wal2json format version 2 change.
+// Transaction boundaries and messages are ignored.
+func postgresDecodeWal2json(data []byte) ([]postgresChange, error) {
+	raw := postgresWal2jsonChange{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	change := postgresChange{
+		Schema: raw.Schema,
+		Table:  raw.Table,
+	}
+	switch raw.Action {
+	case "I":
+		change.Op = "insert"
+	case "U":
+		change.Op = "update"
+	case "D":
+		change.Op = "delete"
+	case "T":
+		change.Op = "truncate"
+	default:
+		return nil, nil
+	}
+
+	if len(raw.Columns) > 0 {
+		change.Columns = make(map[string]interface{}, len(raw.Columns))
+		for _, column := range raw.Columns {
+			change.Columns[column.Name] = column.Value
+		}
+	}
+	if len(raw.Identity) > 0 {
+		change.Old = make(map[string]interface{}, len(raw.Identity))
+		for _, column := range raw.Identity {
+			change.Old[column.Name] = column.Value
+		}
+	}
+	return []postgresChange{change}, nil
+}
+
+// postgresReader reads the data types of the logical replication protocol.
+type postgresReader struct {
+	data []byte
+	err  error
+}
+
+func (r *postgresReader) next(size int) []byte {
+	if r.err != nil || len(r.data) < size {
+		r.err = fmt.Errorf("message too short")
+		return make([]byte, size)
+	}
+	value := r.data[:size]
+	r.data = r.data[size:]
+	return value
+}
+
+func (r *postgresReader) uint8() uint8   { return r.next(1)[0] }
+func (r *postgresReader) uint16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *postgresReader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+
+func (r *postgresReader) string() string {
+	end := 0
+	for end < len(r.data) && r.data[end] != 0 {
+		end++
+	}
+	if end == len(r.data) {
+		r.err = fmt.Errorf("unterminated string")
+		return ""
+	}
+	value := string(r.data[:end])
+	r.data = r.data[end+1:]
+	return value
+}
+
+// tuple reads a TupleData structure. Unchanged TOAST values are omitted.
+func (r *postgresReader) tuple(relation postgresRelation) map[string]interface{} {
+	numColumns := int(r.uint16())
+	tuple := make(map[string]interface{}, numColumns)
+	for i := 0; i < numColumns && r.err == nil; i++ {
+		name := strconv.Itoa(i)
+		if i < len(relation.columns) {
+			name = relation.columns[i]
+		}
+
+		switch kind := r.uint8(); kind {
+		case 'n':
+			tuple[name] = nil
+		case 'u':
+			// unchanged TOAST value
+		case 't':
+			tuple[name] = string(r.next(int(r.uint32())))
+		default:
+			r.err = fmt.Errorf("unknown column kind %q", kind)
+		}
+	}
+	return tuple
+}
+
+// postgresDecodePgoutput converts a pgoutput message. Relation messages are
+// stored in relations, as later changes only refer to the relation ID.
+func postgresDecodePgoutput(data []byte, relations map[uint32]postgresRelation) ([]postgresChange, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+	reader := &postgresReader{data: data[1:]}
+
+	var changes []postgresChange
+	switch data[0] {
+	case 'R':
+		relationID := reader.uint32()
+		relation := postgresRelation{
+			schema: reader.string(),
+			table:  reader.string(),
+		}
+		reader.uint8() // replica identity
+		numColumns := int(reader.uint16())
+		for i := 0; i < numColumns && reader.err == nil; i++ {
+			reader.uint8() // flags
+			relation.columns = append(relation.columns, reader.string())
+			reader.next(8) // type and modifier
+		}
+		relations[relationID] = relation
+
+	case 'I', 'U', 'D':
+		relation, known := relations[reader.uint32()]
+		if !known {
+			return nil, fmt.Errorf("change for unknown relation")
+		}
+		change := postgresChange{
+			Schema: relation.schema,
+			Table:  relation.table,
+		}
+
+		switch data[0] {
+		case 'I':
+			change.Op = "insert"
+		case 'U':
+			change.Op = "update"
+		case 'D':
+			change.Op = "delete"
+		}
+
+		for reader.err == nil && len(reader.data) > 0 {
+			switch kind := reader.uint8(); kind {
+			case 'K', 'O':
+				change.Old = reader.tuple(relation)
+			case 'N':
+				change.Columns = reader.tuple(relation)
+			default:
+				reader.err = fmt.Errorf("unknown tuple type %q", kind)
+			}
+		}
+		changes = append(changes, change)
+
+	case 'T':
+		numRelations := int(reader.uint32())
+		reader.uint8() // options
+		for i := 0; i < numRelations && reader.err == nil; i++ {
+			if relation, known := relations[reader.uint32()]; known {
+				changes = append(changes, postgresChange{
+					Op:     "truncate",
+					Schema: relation.schema,
+					Table:  relation.table,
+				})
+			}
+		}
+
+	default:
+		// Begin, commit, origin, type and logical decoding messages
+	}
+
+	return changes, reader.err
+}
@@ -0,0 +1,393 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	promFormatJSON   = "json"
+	promFormatInflux = "influx"
+)
+
+// PromRemoteWrite consumer plugin
+//
+// The PromRemoteWrite consumer accepts Prometheus remote_write requests and
+// converts each sample into a message. Requests are answered after all
+// samples have been passed on, so Prometheus retries requests that failed.
+// Only float samples are converted; exemplars and native histograms are
+// ignored.
+//
+// Metadata
+//
+// - metric: The name of the metric (set)
+//
+// Parameters
+//
+// - Address: Defines the host and port to listen on.
+// By default this parameter is set to ":9201".
+//
+// - Path: Defines the URL path requests are accepted on.
+// By default this parameter is set to "/api/v1/write".
+//
+// - Format: Defines the format of the generated messages. Valid values are
+// "json" and "influx". JSON messages contain the fields "name", "labels",
+// "value" and "timestamp" in milliseconds; non-finite values are written as
+// strings. "influx" generates InfluxDB line protocol with the labels as tags,
+// a single "value" field and a timestamp in nanoseconds. Non-finite values
+// are dropped in this format, as line protocol cannot represent them.
+// By default this parameter is set to "json".
+//
+// - DropStaleMarkers: Set to true to ignore the staleness markers Prometheus
+// sends when a series disappears.
+// By default this parameter is set to false.
+//
+// - ReadTimeoutSec: Defines the maximum duration for reading a request.
+// By default this parameter is set to 10.
+//
+// - MaxRequestSizeKB: Defines the maximum size of a compressed request.
+// By default this parameter is set to 10240.
+//
+// - TlsEnable: Enables TLS. See core/components.NewTLSServerConfig for the
+// required settings.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example accepts samples and converts them to line protocol:
+//
+//  PromIn:
+//    Type: consumer.PromRemoteWrite
+//    Streams: metrics
+//    Address: ":9201"
+//    Format: influx
+//    DropStaleMarkers: true
+//
+// The matching Prometheus configuration is:
+//
+//  remote_write:
+//    - url: http://gollum:9201/api/v1/write
+type PromRemoteWrite struct {
+	core.SimpleConsumer `gollumdoc:"embed_type"`
+
+	address          string        `config:"Address" default:":9201"`
+	path             string        `config:"Path" default:"/api/v1/write"`
+	format           string        `config:"Format" default:"json"`
+	dropStaleMarkers bool          `config:"DropStaleMarkers" default:"false"`
+	readTimeout      time.Duration `config:"ReadTimeoutSec" default:"10" metric:"sec"`
+	maxRequestSize   int64         `config:"MaxRequestSizeKB" default:"10240" metric:"kb"`
+	tlsEnable        bool          `config:"TlsEnable" default:"false"`
+
+	tlsConfig *tls.Config
+	listen    *tnet.StopListener
+}
+
+// promSample is a single sample of a time series.
+type promSample struct {
+	name      string
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// promStaleMarker is the NaN value Prometheus uses to mark stale series.
+const promStaleMarker = 0x7ff0000000000002
+
+func init() {
+	core.TypeRegistry.Register(PromRemoteWrite{})
+}
+
+// Configure initializes this consumer with values from a plugin config.
+func (cons *PromRemoteWrite) Configure(conf core.PluginConfigReader) {
+	cons.format = strings.ToLower(cons.format)
+	switch cons.format {
+	case promFormatJSON, promFormatInflux:
+	default:
+		conf.Errors.Pushf("Format must be one of %s or %s", promFormatJSON, promFormatInflux)
+	}
+
+	if cons.tlsEnable {
+		var err error
+		cons.tlsConfig, err = components.NewTLSServerConfig(conf)
+		conf.Errors.Push(err)
+	}
+}
+
+// Consume opens the HTTP server and accepts requests until the consumer is
+// stopped.
+func (cons *PromRemoteWrite) Consume(workers *sync.WaitGroup) {
+	listen, err := tnet.NewStopListener(cons.address)
+	if err != nil {
+		cons.Logger.Error(err)
+		cons.ControlLoop()
+		return // ### return, could not listen ###
+	}
+
+	cons.listen = listen
+	cons.AddMainWorker(workers)
+
+	go cons.serve()
+	defer cons.listen.Close()
+
+	cons.ControlLoop()
+}
+
+func (cons *PromRemoteWrite) serve() {
+	defer cons.WorkerDone()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(cons.path, cons.requestHandler)
+
+	srv := http.Server{
+		Addr:        cons.address,
+		Handler:     mux,
+		ReadTimeout: cons.readTimeout,
+		TLSConfig:   cons.tlsConfig,
+	}
+
+	var err error
+	if cons.tlsConfig != nil {
+		err = srv.ServeTLS(cons.listen, "", "")
+	} else {
+		err = srv.Serve(cons.listen)
+	}
+	if _, isStopRequest := err.(tnet.StopRequestError); err != nil && !isStopRequest {
+		cons.Logger.Error(err)
+	}
+}
+
+func (cons *PromRemoteWrite) requestHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return // ### return, wrong method ###
+	}
+	defer req.Body.Close()
+
+	compressed, err := ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, cons.maxRequestSize))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return // ### return, bad body ###
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return // ### return, not snappy compressed ###
+	}
+
+	samples, err := promDecodeWriteRequest(data)
+	if err != nil {
+		cons.Logger.WithError(err).Warning("Received invalid write request")
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return // ### return, invalid protobuf ###
+	}
+
+	for _, sample := range samples {
+		if cons.dropStaleMarkers && math.Float64bits(sample.value) == promStaleMarker {
+			continue
+		}
+
+		payload, err := cons.encode(sample)
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to encode sample of %s", sample.name)
+			continue
+		}
+		if payload == nil {
+			continue // value not supported by format
+		}
+
+		metaData := core.Metadata{}
+		metaData.SetValue("metric", []byte(sample.name))
+		cons.EnqueueWithMetadata(payload, metaData)
+	}
+
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+func (cons *PromRemoteWrite) encode(sample promSample) ([]byte, error) {
+	isFinite := !math.IsNaN(sample.value) && !math.IsInf(sample.value, 0)
+	if cons.format == promFormatInflux {
+		if !isFinite {
+			return nil, nil
+		}
+		return promEncodeInflux(sample), nil
+	}
+
+	var value interface{} = sample.value
+	if !isFinite {
+		value = strconv.FormatFloat(sample.value, 'f', -1, 64)
+	}
+
+	return json.Marshal(struct {
+		Name      string            `json:"name"`
+		Labels    map[string]string `json:"labels"`
+		Value     interface{}       `json:"value"`
+		Timestamp int64             `json:"timestamp"`
+	}{sample.name, sample.labels, value, sample.timestamp})
+}
+
+var (
+	promInfluxMeasurementEscape = strings.NewReplacer(",", `\,`, " ", `\ `)
+	promInfluxTagEscape         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+func promEncodeInflux(sample promSample) []byte {
+	keys := make([]string, 0, len(sample.labels))
+	for key := range sample.labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	line := bytes.NewBufferString(promInfluxMeasurementEscape.Replace(sample.name))
+	for _, key := range keys {
+		if sample.labels[key] == "" {
+			continue // empty tag values are not allowed
+		}
+		fmt.Fprintf(line, ",%s=%s", promInfluxTagEscape.Replace(key), promInfluxTagEscape.Replace(sample.labels[key]))
+	}
+	fmt.Fprintf(line, " value=%s %d", strconv.FormatFloat(sample.value, 'f', -1, 64), sample.timestamp*int64(time.Millisecond))
+	return line.Bytes()
+}
+
+// promDecodeWriteRequest returns the samples of a prometheus.WriteRequest
+// message.
+func promDecodeWriteRequest(data []byte) ([]promSample, error) {
+	samples := []promSample{}
+	err := promDecodeFields(data, func(number int, value []byte, _ uint64) error {
+		if number != 1 || value == nil {
+			return nil // not a TimeSeries
+		}
+
+		name := ""
+		labels := make(map[string]string)
+		seriesSamples := []promSample{}
+		err := promDecodeFields(value, func(number int, value []byte, _ uint64) error {
+			switch {
+			case number == 1 && value != nil:
+				var labelName, labelValue string
+				err := promDecodeFields(value, func(number int, value []byte, _ uint64) error {
+					switch number {
+					case 1:
+						labelName = string(value)
+					case 2:
+						labelValue = string(value)
+					}
+					return nil
+				})
+				if labelName == "__name__" {
+					name = labelValue
+				} else {
+					labels[labelName] = labelValue
+				}
+				return err
+
+			case number == 2 && value != nil:
+				sample := promSample{}
+				err := promDecodeFields(value, func(number int, _ []byte, scalar uint64) error {
+					switch number {
+					case 1:
+						sample.value = math.Float64frombits(scalar)
+					case 2:
+						sample.timestamp = int64(scalar)
+					}
+					return nil
+				})
+				seriesSamples = append(seriesSamples, sample)
+				return err
+			}
+			return nil
+		})
+
+		for _, sample := range seriesSamples {
+			sample.name, sample.labels = name, labels
+			samples = append(samples, sample)
+		}
+		return err
+	})
+
+	return samples, err
+}
+
+// promDecodeFields calls onField for each field of a protobuf message.
+// Length delimited fields are passed as value, all other fields as scalar.
+func promDecodeFields(data []byte, onField func(number int, value []byte, scalar uint64) error) error {
+	for len(data) > 0 {
+		key, size := proto.DecodeVarint(data)
+		if size == 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		data = data[size:]
+
+		var (
+			value  []byte
+			scalar uint64
+		)
+		switch key & 7 {
+		case proto.WireVarint:
+			scalar, size = proto.DecodeVarint(data)
+			if size == 0 {
+				return fmt.Errorf("invalid varint")
+			}
+
+		case proto.WireFixed64:
+			if size = 8; len(data) < size {
+				return fmt.Errorf("invalid fixed64")
+			}
+			scalar = binary.LittleEndian.Uint64(data)
+
+		case proto.WireFixed32:
+			if size = 4; len(data) < size {
+				return fmt.Errorf("invalid fixed32")
+			}
+			scalar = uint64(binary.LittleEndian.Uint32(data))
+
+		case proto.WireBytes:
+			length, lengthSize := proto.DecodeVarint(data)
+			if lengthSize == 0 || uint64(len(data)-lengthSize) < length {
+				return fmt.Errorf("invalid length delimited field")
+			}
+			value = data[lengthSize : lengthSize+int(length)]
+			size = lengthSize + int(length)
+
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+
+		data = data[size:]
+		if err := onField(int(key>>3), value, scalar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
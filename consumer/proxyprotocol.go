@@ -0,0 +1,135 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolConn is a connection whose first bytes have been read into a
+// buffer while parsing the PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *proxyProtocolConn) Read(data []byte) (int, error) {
+	return conn.reader.Read(data)
+}
+
+// readProxyProtocolHeader reads a PROXY protocol v1 or v2 header as sent by
+// HAProxy and other load balancers. The address of the original client is
+// returned. The address is nil if the load balancer did not pass on an
+// address, e.g. for health checks.
+// See https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	start, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(start, proxyProtocolV2Signature):
+		return readProxyProtocolV2(reader)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyProtocolV1(reader)
+	default:
+		return nil, fmt.Errorf("missing PROXY protocol header")
+	}
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	// The header is at most 107 bytes long, including CRLF
+	line := make([]byte, 0, 107)
+	for len(line) < cap(line) {
+		char, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, char)
+		if char == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid source address in PROXY protocol v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	version, command := header[12]>>4, header[12]&0x0f
+	family, transport := header[13]>>4, header[13]&0x0f
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	if command == 0 {
+		return nil, nil // LOCAL, e.g. health checks
+	}
+
+	var (
+		ip   net.IP
+		port uint16
+	)
+	switch {
+	case family == 1 && len(payload) >= 12:
+		ip = net.IP(payload[0:4])
+		port = binary.BigEndian.Uint16(payload[8:10])
+	case family == 2 && len(payload) >= 36:
+		ip = net.IP(payload[0:16])
+		port = binary.BigEndian.Uint16(payload[32:34])
+	default:
+		return nil, nil // unspecified or unix addresses
+	}
+
+	if transport == 2 {
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
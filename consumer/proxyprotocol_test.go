@@ -0,0 +1,92 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+func newTestProxyProtocolV2(command, family byte, payload []byte, data string) string {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(payload)))
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, command, family)
+	header = append(header, length...)
+	return string(header) + string(payload) + data
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	ipv4 := []byte{127, 0, 0, 1, 10, 0, 0, 1, 0x1f, 0x90, 0x00, 0x50}
+	ipv6 := make([]byte, 36)
+	ipv6[15], ipv6[31], ipv6[33] = 1, 2, 53
+
+	valid := map[string]string{
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\ndata":       "tcp 192.168.0.1:56324",
+		"PROXY TCP6 ::1 ::2 1234 80\r\ndata":                          "tcp [::1]:1234",
+		"PROXY UNKNOWN\r\ndata":                                       "",
+		"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\ndata":                   "",
+		newTestProxyProtocolV2(0x21, 0x11, ipv4, "data"):              "tcp 127.0.0.1:8080",
+		newTestProxyProtocolV2(0x21, 0x22, ipv6, "data"):              "udp [::1]:53",
+		newTestProxyProtocolV2(0x20, 0x00, nil, "data"):               "",
+		newTestProxyProtocolV2(0x21, 0x31, make([]byte, 216), "data"): "",
+	}
+
+	for input, expected := range valid {
+		reader := bufio.NewReader(strings.NewReader(input))
+		addr, err := readProxyProtocolHeader(reader)
+		expect.NoError(err)
+
+		if expected == "" {
+			expect.Nil(addr)
+		} else if expect.NotNil(addr) {
+			expect.Equal(expected, addr.Network()+" "+addr.String())
+		}
+
+		// The data following the header has to be kept
+		data, _ := ioutil.ReadAll(reader)
+		expect.Equal("data", string(data))
+	}
+
+	invalid := []string{
+		"",
+		"PROX",
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 192.168.0.1 192.1",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1 2\ndata",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n",
+		"PROXY TCP4 1.2.3 5.6.7.8 1 2\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 99999 2\r\n",
+		"PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		string(proxyProtocolV2Signature) + "\x21",
+		newTestProxyProtocolV2(0x21, 0x11, ipv4, "")[:20],
+		newTestProxyProtocolV2(0x11, 0x11, ipv4, "data"),
+	}
+
+	for _, input := range invalid {
+		_, err := readProxyProtocolHeader(bufio.NewReader(strings.NewReader(input)))
+		if err == nil {
+			t.Errorf("Header %q has been accepted", input)
+		}
+	}
+}
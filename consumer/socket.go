@@ -15,6 +15,8 @@
 package consumer
 
 import (
+	"bufio"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -24,6 +26,7 @@ import (
 	"time"
 
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
 	"github.com/trivago/tgo"
 	"github.com/trivago/tgo/tio"
 	"github.com/trivago/tgo/tnet"
@@ -37,7 +40,23 @@ const (
 //
 // The socket consumer reads messages as-is from a given network or filesystem
 // socket. Messages are separated from the stream by using a specific partitioner
-// method.
+// method. TCP connections can be secured with TLS and may be preceded by a
+// PROXY protocol header when the consumer runs behind a load balancer.
+//
+// Metadata
+//
+// Metadata is only set if TlsEnable or ProxyProtocol is set.
+//
+// - remote_addr: The address of the client. With ProxyProtocol this is the
+// address of the original client as reported by the load balancer (set)
+//
+// - proxy_addr: The address of the load balancer (set if ProxyProtocol is set)
+//
+// - tls_peer: The common name of the client certificate (set if a client
+// certificate was presented)
+//
+// - tls_server_name: The server name requested by the client via SNI (set if
+// the client sent one)
 //
 // Parameters
 //
@@ -45,6 +64,9 @@ const (
 // This can either be any ip address and port like "localhost:5880" or a file
 // like "unix:///var/gollum.socket". Valid protocols can be derived from the
 // golang net package documentation. Common values are "udp", "tcp" and "unix".
+// Sockets passed by systemd socket activation can be used by setting the
+// address to "systemd://<name>", where name is the FileDescriptorName of the
+// socket or its index. The protocol is derived from the socket.
 // By default this parameter is set to "tcp://0.0.0.0:5880".
 //
 // - Permissions: This value sets the filesystem permissions for UNIX domain
@@ -66,11 +88,26 @@ const (
 //  - "binary_le": An alias for "binary".
 //  - "binary_be": The same as "binary" but uses big endian encoding.
 //  - "fixed": Assumes fixed size messages.
+//  - "netstring": Reads netstrings, i.e. messages formatted as "<length>:<data>,".
+//  - "varint": Reads messages prefixed by their length as unsigned varint, as
+//  used by protobuf for length delimited streams.
+//  - "escaped": The same as "delimiter" but a delimiter preceded by the Escape
+//  sequence is part of the message. The escape sequence is removed from the
+//  message if it is followed by the delimiter or by another escape sequence.
 //
-// - Delimiter: This value defines the delimiter used by the text and delimiter
-// partitioners.
+// - Delimiter: This value defines the delimiter used by the text, delimiter
+// and escaped partitioners.
 // By default this parameter is set to "\n".
 //
+// - Escape: This value defines the escape sequence used by the escaped
+// partitioner.
+// By default this parameter is set to "\\".
+//
+// - MaxMessageSizeKB: This value defines the maximum size of a message read
+// by the netstring, varint and escaped partitioners. Connections sending
+// larger messages are closed.
+// By default this parameter is set to "1024".
+//
 // - Offset: This value defines the offset used by the binary and text partitioners.
 // This setting is ignored by the fixed partitioner.
 // By default this parameter is set to "0".
@@ -96,6 +133,38 @@ const (
 // socket (unix://<path>) is removed prior to connecting.
 // By default this parameter is set to "true".
 //
+// - TlsEnable: Enables TLS for TCP and unix connections. TlsKeyLocation and
+// TlsCertificateLocation are required. If TlsCaLocation is set, clients have
+// to present a certificate signed by this CA. See
+// core/components.NewTLSServerConfig.
+// By default this parameter is set to false.
+//
+// - TlsServerNameStreams: Maps server names requested via SNI to the stream
+// messages of that connection are sent to. Connections using other names are
+// sent to the configured streams.
+// By default this parameter is set to an empty map.
+//
+// - ProxyProtocol: If set to true, each connection has to start with a PROXY
+// protocol v1 or v2 header as sent by HAProxy and other load balancers.
+// Connections without a valid header are closed. The header is expected
+// before the TLS handshake.
+// By default this parameter is set to false.
+//
+// - HandshakeTimeoutSec: Defines the number of seconds to wait for the PROXY
+// protocol header and the TLS handshake to complete.
+// By default this parameter is set to 10.
+//
+// - ReusePortSockets: Defines the number of UDP sockets bound to Address using
+// SO_REUSEPORT. Each socket is read by a separate goroutine using a separate
+// buffer, so that datagrams can be received in parallel. A value of 1 binds a
+// single socket without SO_REUSEPORT. This setting is ignored for other
+// protocols and not supported on Windows.
+// By default this parameter is set to 1.
+//
+// - ReceiveBufferSizeKB: Defines the size of the receive buffer of each UDP
+// socket. A large buffer prevents losses when datagrams arrive in bursts. If
+// set to 0, the system default is used.
+// By default this parameter is set to 0.
 //
 // Examples
 //
@@ -107,20 +176,63 @@ const (
 //    Partitioner: fixed
 //    Size: 256
 //
+// This example accepts TLS connections from clients with a valid certificate
+// behind a load balancer, sending connections to "audit.example.com" to a
+// separate stream:
+//
+//  socketIn:
+//    Type: consumer.Socket
+//    Streams: logs
+//    Address: tcp://0.0.0.0:6514
+//    ProxyProtocol: true
+//    TlsEnable: true
+//    TlsCertificateLocation: /etc/gollum/server.crt
+//    TlsKeyLocation: /etc/gollum/server.key
+//    TlsCaLocation: /etc/gollum/clients-ca.crt
+//    TlsServerNameStreams:
+//      audit.example.com: audit
+//
+// This example receives UDP datagrams on four sockets in parallel:
+//
+//  socketIn:
+//    Type: consumer.Socket
+//    Address: udp://0.0.0.0:5880
+//    ReusePortSockets: 4
+//    ReceiveBufferSizeKB: 4096
+//
+// This example reads from a socket passed by systemd, configured in a socket
+// unit with "FileDescriptorName=gollum-logs":
+//
+//  socketIn:
+//    Type: consumer.Socket
+//    Address: systemd://gollum-logs
+//
 type Socket struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
 	listener            io.Closer
 	protocol            string
 	address             string
+	activationName      string
+	activated           bool
 	acknowledge         string        `config:"Acknowledge" default:""`
 	delimiter           string        `config:"Delimiter" default:"\n"`
+	escape              string        `config:"Escape" default:"\\"`
+	maxMessageSize      int           `config:"MaxMessageSizeKB" default:"1024" metric:"kb"`
 	reconnectTime       time.Duration `config:"ReconnectAfterSec" default:"2" metric:"sec"`
 	ackTimeout          time.Duration `config:"AckTimeoutSec" default:"1" metric:"sec"`
 	readTimeout         time.Duration `config:"ReadTimeoutSec" default:"2" metric:"sec"`
 	fileFlags           os.FileMode   `config:"Permissions" default:"0770"`
 	offset              int           `config:"Offset" default:"0"`
 	flags               tio.BufferedReaderFlags
-	clearSocket         bool `config:"RemoveOldSocket" default:"true"`
+	frameParser         socketFrameParser
+	clearSocket         bool          `config:"RemoveOldSocket" default:"true"`
+	tlsEnable           bool          `config:"TlsEnable" default:"false"`
+	proxyProtocol       bool          `config:"ProxyProtocol" default:"false"`
+	handshakeTimeout    time.Duration `config:"HandshakeTimeoutSec" default:"10" metric:"sec"`
+	reusePortSockets    int           `config:"ReusePortSockets" default:"1"`
+	receiveBufferSize   int           `config:"ReceiveBufferSizeKB" default:"0" metric:"kb"`
+	tlsConfig           *tls.Config
+	serverNameStreams   map[string]core.MessageStreamID
 }
 
 func init() {
@@ -129,13 +241,50 @@ func init() {
 
 // Configure initializes this consumer with values from a plugin config.
 func (cons *Socket) Configure(conf core.PluginConfigReader) {
+	address := conf.GetString("Address", "tcp://0.0.0.0:5880")
+	cons.protocol, cons.address = tnet.ParseAddress(address, "tcp")
+	cons.flags = 0
+
+	if cons.activationName, cons.activated = parseSocketActivationAddress(address); cons.activated {
+		cons.address = address
+		protocol, err := getSocketActivationProtocol(cons.activationName)
+		if !conf.Errors.Push(err) {
+			cons.protocol = protocol
+		}
+		if cons.reusePortSockets > 1 {
+			conf.Errors.Pushf("ReusePortSockets cannot be used with socket activation")
+		}
+	}
+
 	if len(cons.acknowledge) > 0 && cons.protocol == "udp" {
 		conf.Errors.Pushf("UDP sockets do not support acknowledgment.")
 	}
 
-	address := conf.GetString("Address", "tcp://0.0.0.0:5880")
-	cons.protocol, cons.address = tnet.ParseAddress(address, "tcp")
-	cons.flags = 0
+	if cons.maxMessageSize <= 0 {
+		conf.Errors.Pushf("MaxMessageSizeKB must be greater than 0")
+	}
+
+	if cons.reusePortSockets < 1 {
+		conf.Errors.Pushf("ReusePortSockets must be at least 1")
+	}
+
+	if cons.proxyProtocol && cons.protocol == "udp" {
+		conf.Errors.Pushf("UDP sockets do not support the PROXY protocol")
+	}
+
+	cons.serverNameStreams = make(map[string]core.MessageStreamID)
+	for serverName, streamName := range conf.GetStringMap("TlsServerNameStreams", map[string]string{}) {
+		cons.serverNameStreams[strings.ToLower(serverName)] = core.GetStreamID(streamName)
+	}
+
+	if cons.tlsEnable {
+		if cons.protocol == "udp" {
+			conf.Errors.Pushf("UDP sockets do not support TLS")
+		}
+		var err error
+		cons.tlsConfig, err = components.NewTLSServerConfig(conf)
+		conf.Errors.Push(err)
+	}
 
 	partitioner := conf.GetString("Partitioner", "delimiter")
 	switch strings.ToLower(partitioner) {
@@ -168,6 +317,18 @@ func (cons *Socket) Configure(conf core.PluginConfigReader) {
 	case "delimiter":
 		// Nothing to add
 
+	case "netstring":
+		cons.frameParser = parseNetstring
+
+	case "varint":
+		cons.frameParser = parseVarint
+
+	case "escaped":
+		if len(cons.delimiter) == 0 || len(cons.escape) == 0 {
+			conf.Errors.Pushf("The escaped partitioner requires Delimiter and Escape to be set")
+		}
+		cons.frameParser = newEscapedDelimiterParser([]byte(cons.delimiter), []byte(cons.escape))
+
 	default:
 		conf.Errors.Pushf("Unknown partitioner: %s", partitioner)
 	}
@@ -175,33 +336,57 @@ func (cons *Socket) Configure(conf core.PluginConfigReader) {
 
 func (cons *Socket) listenUDP() {
 	defer cons.WorkerDone()
+
+	for cons.IsActive() {
+		// (re)open a UDP connection
+		socket, err := cons.openUDPSocket()
+		if err != nil {
+			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
+			time.Sleep(cons.reconnectTime)
+			continue // continue, retry
+		}
+
+		cons.Logger.Debugf("Listening to %s", cons.address)
+		cons.readFromConnection(socket, nil, cons.Enqueue)
+		cons.Logger.Debugf("Closing socket %s", cons.address)
+		socket.Close()
+	}
+}
+
+func (cons *Socket) openUDPSocket() (*net.UDPConn, error) {
 	var (
+		socket *net.UDPConn
 		err    error
-		socket net.Conn
 	)
 
-	addr, _ := net.ResolveUDPAddr(cons.protocol, cons.address)
-	for cons.IsActive() {
-		// (re)open a UDP connection
-		for cons.listener == nil {
-			if !cons.IsActive() {
-				return // return, abort
+	switch {
+	case cons.activated:
+		var conn net.PacketConn
+		if conn, err = socketActivationPacketConn(cons.activationName); err == nil {
+			var isUDP bool
+			if socket, isUDP = conn.(*net.UDPConn); !isUDP {
+				conn.Close()
+				err = fmt.Errorf("socket %s is not a UDP socket", cons.activationName)
 			}
-
+		}
+	case cons.reusePortSockets > 1:
+		socket, err = listenUDPReusePort(cons.protocol, cons.address)
+	default:
+		var addr *net.UDPAddr
+		if addr, err = net.ResolveUDPAddr(cons.protocol, cons.address); err == nil {
 			socket, err = net.ListenUDP(cons.protocol, addr)
-			if err == nil {
-				cons.listener = socket
-				cons.Logger.Debugf("Listening to %s", cons.address)
-				break // break, listening
-			}
-
-			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
-			time.Sleep(cons.reconnectTime)
 		}
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		cons.readFromConnection(socket, nil)
-		cons.closeListener()
+	if cons.receiveBufferSize > 0 {
+		if err := socket.SetReadBuffer(cons.receiveBufferSize); err != nil {
+			cons.Logger.WithError(err).Warning("Failed to set receive buffer size")
+		}
 	}
+	return socket, nil
 }
 
 func (cons *Socket) listen() {
@@ -220,10 +405,7 @@ func (cons *Socket) listen() {
 				return // return, abort
 			}
 
-			socket, err = net.Listen(cons.protocol, cons.address)
-			if err == nil && cons.protocol == "unix" {
-				err = os.Chmod(cons.address, cons.fileFlags)
-			}
+			socket, err = cons.openListener()
 
 			if err == nil {
 				cons.listener = socket
@@ -233,7 +415,7 @@ func (cons *Socket) listen() {
 			}
 
 			cons.Logger.WithError(err).Errorf("Failed to listen to %s", cons.address)
-			if cons.clearSocket && cons.protocol == "unix" {
+			if cons.clearSocket && cons.protocol == "unix" && !cons.activated {
 				cons.tryRemoveUnixSocket()
 			}
 			time.Sleep(cons.reconnectTime)
@@ -258,23 +440,106 @@ func (cons *Socket) listen() {
 	}
 }
 
+func (cons *Socket) openListener() (net.Listener, error) {
+	if cons.activated {
+		return socketActivationListener(cons.activationName)
+	}
+
+	socket, err := net.Listen(cons.protocol, cons.address)
+	if err == nil && cons.protocol == "unix" {
+		if err = os.Chmod(cons.address, cons.fileFlags); err != nil {
+			socket.Close()
+		}
+	}
+	return socket, err
+}
+
 func (cons *Socket) readFromClientConnection(conn net.Conn, forceClose *bool) {
 	defer func() {
 		conn.Close()
 		cons.Logger.Debugf("Closed client connection to %s on %s", conn.RemoteAddr(), cons.address)
 		cons.WorkerDone()
 	}()
-	cons.readFromConnection(conn, forceClose)
+
+	conn, enqueue, err := cons.prepareConnection(conn)
+	if err != nil {
+		cons.Logger.WithError(err).Warningf("Rejected client connection from %s", conn.RemoteAddr())
+		return // ### return, handshake failed ###
+	}
+	cons.readFromConnection(conn, forceClose, enqueue)
+}
+
+// prepareConnection reads the PROXY protocol header and runs the TLS handshake
+// if required. The returned function enqueues messages read from the returned
+// connection along with the connection's metadata.
+func (cons *Socket) prepareConnection(conn net.Conn) (net.Conn, func([]byte), error) {
+	if !cons.proxyProtocol && cons.tlsConfig == nil {
+		return conn, cons.Enqueue, nil
+	}
+
+	metaData := core.Metadata{}
+	streamID := core.InvalidStreamID
+	if remote := conn.RemoteAddr(); remote != nil {
+		metaData.SetValue("remote_addr", []byte(remote.String()))
+	}
+
+	conn.SetDeadline(time.Now().Add(cons.handshakeTimeout))
+
+	if cons.proxyProtocol {
+		reader := bufio.NewReader(conn)
+		client, err := readProxyProtocolHeader(reader)
+		if err != nil {
+			return conn, nil, err
+		}
+		metaData.SetValue("proxy_addr", metaData.GetValue("remote_addr"))
+		if client != nil {
+			metaData.SetValue("remote_addr", []byte(client.String()))
+		}
+		conn = &proxyProtocolConn{Conn: conn, reader: reader}
+	}
+
+	if cons.tlsConfig != nil {
+		tlsConn := tls.Server(conn, cons.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return conn, nil, err
+		}
+
+		state := tlsConn.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			metaData.SetValue("tls_peer", []byte(state.PeerCertificates[0].Subject.CommonName))
+		}
+		if state.ServerName != "" {
+			metaData.SetValue("tls_server_name", []byte(state.ServerName))
+			if sniStreamID, isMapped := cons.serverNameStreams[strings.ToLower(state.ServerName)]; isMapped {
+				streamID = sniStreamID
+			}
+		}
+		conn = tlsConn
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	if streamID != core.InvalidStreamID {
+		return conn, func(data []byte) {
+			cons.EnqueueWithStream(data, metaData.Clone(), streamID)
+		}, nil
+	}
+	return conn, func(data []byte) {
+		cons.EnqueueWithMetadata(data, metaData.Clone())
+	}, nil
 }
 
-func (cons *Socket) readFromConnection(conn net.Conn, forceClose *bool) {
-	buffer := tio.NewBufferedReader(socketBufferGrowSize, cons.flags, cons.offset, cons.delimiter)
+func (cons *Socket) readFromConnection(conn net.Conn, forceClose *bool, enqueue func([]byte)) {
+	var buffer socketReader = tio.NewBufferedReader(socketBufferGrowSize, cons.flags, cons.offset, cons.delimiter)
+	if cons.frameParser != nil {
+		buffer = newSocketFrameReader(cons.frameParser, cons.maxMessageSize)
+	}
 
 	for cons.IsActive() && (forceClose == nil || !*forceClose) {
 		// Read from connection
 		// Time out in regular intervals so we can stop the loop on shutdown
 		conn.SetReadDeadline(time.Now().Add(cons.readTimeout))
-		if err := buffer.ReadAll(conn, cons.Enqueue); err != nil {
+		if err := buffer.ReadAll(conn, enqueue); err != nil {
 			netErr, isNetErr := err.(net.Error)
 			switch {
 			case !cons.IsActive():
@@ -355,6 +620,10 @@ func (cons *Socket) Consume(workers *sync.WaitGroup) {
 
 	if cons.protocol == "udp" {
 		go tgo.WithRecoverShutdown(cons.listenUDP)
+		for i := 1; i < cons.reusePortSockets; i++ {
+			cons.AddWorker()
+			go tgo.WithRecoverShutdown(cons.listenUDP)
+		}
 	} else {
 		go tgo.WithRecoverShutdown(cons.listen)
 	}
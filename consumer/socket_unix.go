@@ -0,0 +1,71 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package consumer
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDPReusePort opens a UDP socket with SO_REUSEPORT set, so that
+// multiple sockets can be bound to the same address. The kernel distributes
+// incoming datagrams between these sockets.
+func listenUDPReusePort(protocol string, address string) (*net.UDPConn, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var sockErr error
+			err := conn.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	conn, err := config.ListenPacket(context.Background(), protocol, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// getListenFiles returns the sockets passed by systemd via LISTEN_FDS if they
+// have been passed to this process.
+func getListenFiles() []*os.File {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+
+	numFds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFds <= 0 {
+		return nil
+	}
+
+	files := make([]*os.File, 0, numFds)
+	for fd := socketActivationFdStart; fd < socketActivationFdStart+numFds; fd++ {
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+	}
+	return files
+}
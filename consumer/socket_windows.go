@@ -0,0 +1,30 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package consumer
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// listenUDPReusePort is not supported on windows as there is no SO_REUSEPORT.
+func listenUDPReusePort(protocol string, address string) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("SO_REUSEPORT is not supported on windows")
+}
+
+// getListenFiles returns nil as socket activation is not supported on windows.
+func getListenFiles() []*os.File {
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package consumer
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// socketActivationPrefix marks addresses referring to sockets passed by
+// systemd, e.g. "systemd://gollum-http". The name is either the
+// FileDescriptorName of the socket or its index.
+const socketActivationPrefix = "systemd://"
+
+var (
+	socketActivationOnce  = new(sync.Once)
+	socketActivationFiles = map[string]*os.File{}
+)
+
+// socketActivationFdStart is the first file descriptor passed by systemd.
+const socketActivationFdStart = 3
+
+// parseSocketActivationAddress returns the name of the socket if the given
+// address refers to a socket passed by systemd.
+func parseSocketActivationAddress(address string) (string, bool) {
+	if !strings.HasPrefix(strings.ToLower(address), socketActivationPrefix) {
+		return "", false
+	}
+	return address[len(socketActivationPrefix):], true
+}
+
+// getSocketActivationFile returns the socket passed by systemd with the given
+// name or index. An empty name refers to the first socket. Sockets are read
+// from LISTEN_FDS and LISTEN_FDNAMES on first use and stay open so that
+// consumers can recreate their listeners.
+// See https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+func getSocketActivationFile(name string) (*os.File, error) {
+	socketActivationOnce.Do(func() {
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for idx, file := range getListenFiles() {
+			socketActivationFiles[strconv.Itoa(idx)] = file
+			if idx < len(names) && names[idx] != "" {
+				if _, exists := socketActivationFiles[names[idx]]; !exists {
+					socketActivationFiles[names[idx]] = file
+				}
+			}
+		}
+	})
+
+	if name == "" {
+		name = "0"
+	}
+	if file, exists := socketActivationFiles[name]; exists {
+		return file, nil
+	}
+	if len(socketActivationFiles) == 0 {
+		return nil, fmt.Errorf("no sockets have been passed by systemd")
+	}
+	return nil, fmt.Errorf("no socket named %s has been passed by systemd", name)
+}
+
+// socketActivationListener returns a new listener for a stream socket passed
+// by systemd.
+func socketActivationListener(name string) (net.Listener, error) {
+	file, err := getSocketActivationFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return net.FileListener(file)
+}
+
+// socketActivationPacketConn returns a new connection for a datagram socket
+// passed by systemd.
+func socketActivationPacketConn(name string) (net.PacketConn, error) {
+	file, err := getSocketActivationFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return net.FilePacketConn(file)
+}
+
+// getSocketActivationProtocol returns the protocol of a socket passed by
+// systemd, i.e. "tcp", "unix" or "udp".
+func getSocketActivationProtocol(name string) (string, error) {
+	if listener, err := socketActivationListener(name); err == nil {
+		defer listener.Close()
+		return listener.Addr().Network(), nil
+	}
+
+	conn, err := socketActivationPacketConn(name)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().Network(), nil
+}
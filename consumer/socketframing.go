@@ -0,0 +1,187 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/trivago/tgo/tio"
+)
+
+// socketReader reads messages from a stream and passes them to a callback.
+// It is implemented by tio.BufferedReader and socketFrameReader.
+type socketReader interface {
+	ReadAll(reader io.Reader, callback tio.BufferReadCallback) error
+}
+
+// socketFrameParser extracts the first message from data. The number of
+// bytes consumed is returned along with the message. If data does not hold a
+// complete message, 0 is returned. If data is malformed, -1 is returned.
+type socketFrameParser func(data []byte) (message []byte, consumed int)
+
+// socketFrameReader is a socketReader for framing methods not supported by
+// tio.BufferedReader.
+type socketFrameReader struct {
+	data           []byte
+	end            int
+	maxMessageSize int
+	parse          socketFrameParser
+}
+
+func newSocketFrameReader(parse socketFrameParser, maxMessageSize int) *socketFrameReader {
+	return &socketFrameReader{
+		data:           make([]byte, socketBufferGrowSize),
+		maxMessageSize: maxMessageSize,
+		parse:          parse,
+	}
+}
+
+// ReadAll reads from the given stream until all data read has been processed
+// or an error occurs. Complete messages are passed to callback. tio.BufferDataInvalid is returned for
+// malformed or too large messages.
+func (buffer *socketFrameReader) ReadAll(reader io.Reader, callback tio.BufferReadCallback) error {
+	for {
+		if buffer.end == len(buffer.data) {
+			if buffer.end >= buffer.maxMessageSize+socketBufferGrowSize {
+				return tio.BufferDataInvalid // ### return, message too large ###
+			}
+			buffer.data = append(buffer.data, make([]byte, len(buffer.data))...)
+		}
+
+		bytesRead, err := reader.Read(buffer.data[buffer.end:])
+		buffer.end += bytesRead
+
+		start := 0
+		for start < buffer.end {
+			message, consumed := buffer.parse(buffer.data[start:buffer.end])
+			if consumed < 0 || len(message) > buffer.maxMessageSize {
+				buffer.end = 0
+				return tio.BufferDataInvalid // ### return, malformed ###
+			}
+			if consumed == 0 {
+				break // break, incomplete
+			}
+			start += consumed
+			callback(message)
+		}
+
+		if start > 0 {
+			buffer.end = copy(buffer.data, buffer.data[start:buffer.end])
+		}
+		if err != nil {
+			return err // ### return, error reading ###
+		}
+		if buffer.end == 0 {
+			return nil // ### return, all data processed ###
+		}
+	}
+}
+
+// parseNetstring parses messages formatted as "<length>:<data>,".
+// See https://cr.yp.to/proto/netstrings.txt
+func parseNetstring(data []byte) ([]byte, int) {
+	colonIdx := bytes.IndexByte(data, ':')
+	if colonIdx < 0 {
+		if len(data) > 10 {
+			return nil, -1 // ### return, no length ###
+		}
+		return nil, 0 // ### return, incomplete ###
+	}
+	if colonIdx == 0 || colonIdx > 10 || (colonIdx > 1 && data[0] == '0') {
+		return nil, -1 // ### return, invalid length ###
+	}
+
+	length := 0
+	for _, digit := range data[:colonIdx] {
+		if digit < '0' || digit > '9' {
+			return nil, -1 // ### return, invalid length ###
+		}
+		length = length*10 + int(digit-'0')
+	}
+
+	end := colonIdx + 1 + length
+	if end >= len(data) {
+		return nil, 0 // ### return, incomplete ###
+	}
+	if data[end] != ',' {
+		return nil, -1 // ### return, missing terminator ###
+	}
+
+	message := make([]byte, length)
+	copy(message, data[colonIdx+1:end])
+	return message, end + 1
+}
+
+// parseVarint parses messages prefixed by their length encoded as unsigned
+// varint, as used by protobuf for length delimited streams.
+func parseVarint(data []byte) ([]byte, int) {
+	length, prefixLen := binary.Uvarint(data)
+	switch {
+	case prefixLen == 0:
+		return nil, 0 // ### return, incomplete ###
+	case prefixLen < 0 || length > math.MaxInt32:
+		return nil, -1 // ### return, overflow ###
+	}
+
+	end := prefixLen + int(length)
+	if end > len(data) {
+		return nil, 0 // ### return, incomplete ###
+	}
+
+	message := make([]byte, length)
+	copy(message, data[prefixLen:end])
+	return message, end
+}
+
+// newEscapedDelimiterParser returns a parser for messages separated by a
+// delimiter. An escape sequence followed by the delimiter or by the escape
+// sequence itself is replaced by the escaped sequence. Escape sequences
+// followed by other data are kept as-is.
+func newEscapedDelimiterParser(delimiter []byte, escape []byte) socketFrameParser {
+	return func(data []byte) ([]byte, int) {
+		message := make([]byte, 0, len(data))
+		for idx := 0; idx < len(data); {
+			remains := data[idx:]
+			switch {
+			case bytes.HasPrefix(remains, delimiter):
+				return message, idx + len(delimiter)
+
+			case bytes.HasPrefix(remains, escape):
+				escaped := remains[len(escape):]
+				switch {
+				case bytes.HasPrefix(escaped, delimiter):
+					message = append(message, delimiter...)
+					idx += len(escape) + len(delimiter)
+				case bytes.HasPrefix(escaped, escape):
+					message = append(message, escape...)
+					idx += 2 * len(escape)
+				case len(escaped) < len(delimiter) && bytes.HasPrefix(delimiter, escaped),
+					len(escaped) < len(escape) && bytes.HasPrefix(escape, escaped):
+					return nil, 0 // ### return, incomplete escape sequence ###
+				default:
+					message = append(message, escape...)
+					idx += len(escape)
+				}
+
+			default:
+				message = append(message, data[idx])
+				idx++
+			}
+		}
+		return nil, 0 // ### return, incomplete ###
+	}
+}
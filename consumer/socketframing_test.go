@@ -0,0 +1,135 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumer
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/trivago/tgo/tio"
+	"github.com/trivago/tgo/ttesting"
+)
+
+type socketFrameTest struct {
+	input    string
+	message  string
+	consumed int
+}
+
+func testSocketFrameParser(t *testing.T, name string, parse socketFrameParser, tests []socketFrameTest) {
+	for _, test := range tests {
+		message, consumed := parse([]byte(test.input))
+		if consumed != test.consumed || string(message) != test.message {
+			t.Errorf("%s parsed %q as %q (%d) instead of %q (%d)", name, test.input, message, consumed, test.message, test.consumed)
+		}
+	}
+}
+
+func TestSocketFrameParsers(t *testing.T) {
+	testSocketFrameParser(t, "netstring", parseNetstring, []socketFrameTest{
+		{"3:abc,", "abc", 6},
+		{"0:,", "", 3},
+		{"3:abc,5:hello,", "abc", 6},
+		{"12:hello, world,", "hello, world", 16},
+		// Truncated
+		{"", "", 0},
+		{"3", "", 0},
+		{"3:", "", 0},
+		{"3:ab", "", 0},
+		{"3:abc", "", 0},
+		// Malformed
+		{":abc,", "", -1},
+		{"03:abc,", "", -1},
+		{"x:abc,", "", -1},
+		{"3:abcd", "", -1},
+		{"12345678901:", "", -1},
+		{"12345678901", "", -1},
+	})
+
+	testSocketFrameParser(t, "varint", parseVarint, []socketFrameTest{
+		{"\x03abc", "abc", 4},
+		{"\x00", "", 1},
+		{"\x03abc\x01d", "abc", 4},
+		{"\x80\x01" + strings.Repeat("x", 128), strings.Repeat("x", 128), 130},
+		// Truncated
+		{"", "", 0},
+		{"\x80", "", 0},
+		{"\x03ab", "", 0},
+		// Malformed
+		{"\x80\x80\x80\x80\x80\x80\x80\x80\x80\x80\x01", "", -1},
+		{"\x80\x80\x80\x80\x10", "", -1},
+	})
+
+	testSocketFrameParser(t, "escaped", newEscapedDelimiterParser([]byte("\n"), []byte("\\")), []socketFrameTest{
+		{"abc\ndef", "abc", 4},
+		{"\n", "", 1},
+		{"a\\\nb\n", "a\nb", 5},
+		{"a\\\\b\n", "a\\b", 5},
+		{"a\\xb\n", "a\\xb", 5},
+		// Truncated
+		{"", "", 0},
+		{"abc", "", 0},
+		{"abc\\", "", 0},
+		{"abc\\\n", "", 0},
+	})
+
+	testSocketFrameParser(t, "escaped CRLF", newEscapedDelimiterParser([]byte("\r\n"), []byte("\\")), []socketFrameTest{
+		{"abc\r\n", "abc", 5},
+		{"a\\\r\nb\r\n", "a\r\nb", 7},
+		{"a\rb\r\n", "a\rb", 5},
+		// Truncated
+		{"abc\r", "", 0},
+		{"abc\\\r", "", 0},
+	})
+}
+
+func TestSocketFrameReader(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	tests := []struct {
+		input    string
+		parse    socketFrameParser
+		messages []string
+		err      error
+	}{
+		{"3:abc,0:,4:hell,", parseNetstring, []string{"abc", "", "hell"}, io.EOF},
+		{"3:abc,5:hel", parseNetstring, []string{"abc"}, io.EOF},
+		{"3:abc,x:abc,", parseNetstring, []string{"abc"}, tio.BufferDataInvalid},
+		{"3:abc,5:hello,", parseNetstring, []string{"abc"}, tio.BufferDataInvalid},
+		{"\x03abc\x02de", parseVarint, []string{"abc", "de"}, io.EOF},
+		{"\x03abc\x7f" + strings.Repeat("x", 1024), parseVarint, []string{"abc"}, tio.BufferDataInvalid},
+		{"abc" + strings.Repeat("x", 1024), parseVarint, []string{}, tio.BufferDataInvalid},
+	}
+
+	for _, test := range tests {
+		var err error
+		messages := []string{}
+		reader := newSocketFrameReader(test.parse, 4)
+
+		// Read byte by byte so that messages are split across reads
+		input := iotest.OneByteReader(bytes.NewBufferString(test.input))
+		for err == nil {
+			err = reader.ReadAll(input, func(message []byte) {
+				messages = append(messages, string(message))
+			})
+		}
+
+		expect.Equal(test.err, err)
+		expect.Equal(test.messages, messages)
+	}
+}
@@ -15,12 +15,21 @@
 package consumer
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo"
 	"github.com/trivago/tgo/tnet"
 	syslog "gopkg.in/mcuadros/go-syslog.v2"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
@@ -30,13 +39,16 @@ import (
 //
 // The syslogd consumer creates a syslogd-compatible log server and
 // receives messages on a TCP or UDP port or a UNIX filesystem socket.
+// TCP connections support both framing methods of RFC6587: octet counting,
+// where each message is prefixed by its length, and non-transparent framing,
+// where messages are separated by a newline. The method is detected per
+// message.
 //
 // Parameters
 //
 // - Address: Defines the IP address or UNIX socket to listen to.
 // This can take one of the four forms below, to listen on a TCP, UDP
-// or UNIX domain socket. However, see the "Format" option for details on
-// transport support by different formats.
+// or UNIX domain socket.
 // * [hostname|ip]:<tcp-port>
 // * tcp://<hostname|ip>:<tcp-port>
 // * udp://<hostname|ip>:<udp-port>
@@ -44,25 +56,37 @@ import (
 // By default this parameter is set to "udp://0.0.0.0:514"
 //
 // - Format: Defines which syslog standard the server will support.
-// Three standards, listed below, are currently available.  All
-// standards support listening to UDP and UNIX domain sockets.
-// RFC6587 additionally supports TCP sockets. Default: "RFC6587".
-// * RFC3164 (https://tools.ietf.org/html/rfc3164) - unix, udp
-// * RFC5424 (https://tools.ietf.org/html/rfc5424) - unix, udp
-// * RFC6587 (https://tools.ietf.org/html/rfc6587) - unix, upd, tcp
+// Three standards, listed below, are currently available. All standards
+// can be used with all protocols.
+// * RFC3164 (https://tools.ietf.org/html/rfc3164)
+// * RFC5424 (https://tools.ietf.org/html/rfc5424)
+// * RFC6587 (https://tools.ietf.org/html/rfc6587) - RFC5424 messages over TCP
 // By default this parameter is set to "RFC6587".
 //
 // - SetMetadata: When set to true, syslog based metadata will be attached to
 // the message. The metadata fields added depend on the protocol version used.
 // RFC3164 supports: tag, timestamp, hostname, priority, facility, severity.
 // RFC5424 and RFC6587 support: app_name, version, proc_id , msg_id, timestamp,
-// hostname, priority, facility, severity.
+// hostname, priority, facility, severity, structured_data and one field
+// "sd_<id>_<param>" per structured data parameter, e.g.
+// "sd_origin_ip". All formats support tls_peer, containing the common name of
+// the client certificate if TLS client verification is used.
 // By default this parameter is set to "false".
 //
 // - TimestampFormat: When using SetMetadata this string denotes the go time
 // format used to convert syslog timestamps into strings.
 // By default this parameter is set to "2006-01-02T15:04:05.000 MST".
 //
+// - MaxMessageSizeKB: Defines the maximum size of a single message. Larger
+// messages are dropped.
+// By default this parameter is set to 64.
+//
+// - TlsEnable: Enables TLS for TCP connections. TlsKeyLocation and
+// TlsCertificateLocation are required. If TlsCaLocation is set, clients have
+// to present a certificate signed by this CA. See
+// core/components.NewTLSServerConfig.
+// By default this parameter is set to false.
+//
 // Examples
 //
 // Replace the system's standard syslogd with Gollum
@@ -81,6 +105,19 @@ import (
 //    Address: "tcp://0.0.0.0:5599"
 //    Format: "RFC6587"
 //
+// Accept RFC5424 messages over TLS from clients with a valid certificate
+//
+//  SyslogdTLSConsumer:
+//    Type: consumer.Syslogd
+//    Streams: "tls_syslog"
+//    Address: "tcp://0.0.0.0:6514"
+//    Format: "RFC5424"
+//    SetMetadata: true
+//    TlsEnable: true
+//    TlsCertificateLocation: /etc/gollum/syslog.crt
+//    TlsKeyLocation: /etc/gollum/syslog.key
+//    TlsCaLocation: /etc/gollum/clients-ca.crt
+//
 type Syslogd struct {
 	core.SimpleConsumer `gollumdoc:"embed_type"`
 	format              format.Format // RFC3164, RFC5424 or RFC6587?
@@ -88,6 +125,12 @@ type Syslogd struct {
 	address             string
 	withMetadata        bool   `config:"SetMetadata" default:"false"`
 	timestampFormat     string `config:"TimestampFormat" default:"2006-01-02T15:04:05.000 MST"`
+	maxMessageSize      int    `config:"MaxMessageSizeKB" default:"64" metric:"kb"`
+	tlsEnable           bool   `config:"TlsEnable" default:"false"`
+	tlsConfig           *tls.Config
+	listener            io.Closer
+	clients             map[net.Conn]struct{}
+	guard               *sync.Mutex
 }
 
 func init() {
@@ -96,6 +139,10 @@ func init() {
 
 // Configure initializes this consumer with values from a plugin config.
 func (cons *Syslogd) Configure(conf core.PluginConfigReader) {
+	cons.SetPrepareStopCallback(cons.close)
+	cons.clients = make(map[net.Conn]struct{})
+	cons.guard = new(sync.Mutex)
+
 	cons.protocol, cons.address = tnet.ParseAddress(
 		conf.GetString("Address", "udp://0.0.0.0:514"), "tcp")
 
@@ -111,18 +158,10 @@ func (cons *Syslogd) Configure(conf core.PluginConfigReader) {
 	// http://www.ietf.org/rfc/rfc3164.txt
 	case "RFC3164":
 		cons.format = syslog.RFC3164
-		if cons.protocol == "tcp" {
-			cons.Logger.Warning("RFC3164 demands UDP")
-			cons.protocol = "udp"
-		}
 
 	// https://tools.ietf.org/html/rfc5424
 	case "RFC5424":
 		cons.format = syslog.RFC5424
-		if cons.protocol == "tcp" {
-			cons.Logger.Warning("RFC5424 demands UDP")
-			cons.protocol = "udp"
-		}
 
 	// https://tools.ietf.org/html/rfc6587
 	case "RFC6587":
@@ -131,6 +170,15 @@ func (cons *Syslogd) Configure(conf core.PluginConfigReader) {
 	default:
 		conf.Errors.Pushf("Format %s is not supported", syslogFormat)
 	}
+
+	if cons.tlsEnable {
+		if cons.protocol != "tcp" {
+			conf.Errors.Pushf("TLS requires a TCP address")
+		}
+		var err error
+		cons.tlsConfig, err = components.NewTLSServerConfig(conf)
+		conf.Errors.Push(err)
+	}
 }
 
 // Handle implements the syslog handle interface
@@ -166,16 +214,17 @@ func (cons *Syslogd) Handle(parts format.LogParts, code int64, err error) {
 		if cons.withMetadata {
 			hostname, _ := parts["hostname"].(string)
 			app, _ := parts["app_name"].(string)
-			version, _ := parts["version"].(string)
+			version, _ := parts["version"].(int)
 			procID, _ := parts["proc_id"].(string)
 			msgID, _ := parts["msg_id"].(string)
 			priority, _ := parts["priority"].(int)
 			facility, _ := parts["facility"].(int)
 			severity, _ := parts["severity"].(int)
 			timestamp, _ := parts["timestamp"].(time.Time)
+			structuredData, _ := parts["structured_data"].(string)
 
 			metaData.SetValue("app_name", []byte(app))
-			metaData.SetValue("version", []byte(version))
+			metaData.SetValue("version", []byte(strconv.Itoa(version)))
 			metaData.SetValue("proc_id", []byte(procID))
 			metaData.SetValue("msg_id", []byte(msgID))
 			metaData.SetValue("timestamp", []byte(timestamp.Format(cons.timestampFormat)))
@@ -184,6 +233,13 @@ func (cons *Syslogd) Handle(parts format.LogParts, code int64, err error) {
 			metaData.SetValue("priority", []byte(strconv.Itoa(priority)))
 			metaData.SetValue("facility", []byte(strconv.Itoa(facility)))
 			metaData.SetValue("severity", []byte(strconv.Itoa(severity)))
+
+			if structuredData != "" && structuredData != "-" {
+				metaData.SetValue("structured_data", []byte(structuredData))
+				for key, value := range syslogParseStructuredData(structuredData) {
+					metaData.SetValue(key, []byte(value))
+				}
+			}
 		}
 
 	default:
@@ -196,46 +252,306 @@ func (cons *Syslogd) Handle(parts format.LogParts, code int64, err error) {
 	}
 
 	if cons.withMetadata {
+		if tlsPeer, _ := parts["tls_peer"].(string); tlsPeer != "" {
+			metaData.SetValue("tls_peer", []byte(tlsPeer))
+		}
 		cons.EnqueueWithMetadata([]byte(content), metaData)
 	} else {
 		cons.Enqueue([]byte(content))
 	}
 }
 
+// parse converts a single syslog message and passes it to Handle.
+func (cons *Syslogd) parse(line []byte, client string, tlsPeer string) {
+	parser := cons.format.GetParser(line)
+	err := parser.Parse()
+
+	parts := parser.Dump()
+	if hostname, _ := parts["hostname"].(string); hostname == "" && cons.format == syslog.RFC3164 {
+		if host, _, splitErr := net.SplitHostPort(client); splitErr == nil {
+			parts["hostname"] = host
+		} else {
+			parts["hostname"] = client
+		}
+	}
+	parts["client"] = client
+	parts["tls_peer"] = tlsPeer
+
+	cons.Handle(parts, int64(len(line)), err)
+}
+
 // Consume opens a new syslog socket.
-// Messages are expected to be separated by \n.
 func (cons *Syslogd) Consume(workers *sync.WaitGroup) {
-	server := syslog.NewServer()
-	server.SetFormat(cons.format)
-	server.SetHandler(cons)
+	cons.AddMainWorker(workers)
 
+	var err error
 	switch cons.protocol {
 	case "unix":
-		if err := server.ListenUnixgram(cons.address); err != nil {
+		err = cons.listenDatagrams("unixgram")
+		if err != nil {
 			if errRemove := os.Remove(cons.address); errRemove != nil {
 				cons.Logger.WithError(errRemove).Error("Failed to remove exisiting socket")
 			} else {
 				cons.Logger.Warning("Found existing socket ", cons.address, ". Removing.")
-				err = server.ListenUnixgram(cons.address)
+				err = cons.listenDatagrams("unixgram")
 			}
+		}
+	case "udp":
+		err = cons.listenDatagrams("udp")
+	case "tcp":
+		err = cons.listenStream()
+	}
 
+	if err != nil {
+		cons.Logger.WithError(err).Errorf("Failed to open %s://%s", cons.protocol, cons.address)
+		cons.WorkerDone()
+	}
+
+	cons.ControlLoop()
+}
+
+// close stops listening and closes all client connections.
+func (cons *Syslogd) close() {
+	cons.guard.Lock()
+	defer cons.guard.Unlock()
+
+	if cons.listener != nil {
+		cons.listener.Close()
+	}
+	for conn := range cons.clients {
+		conn.Close()
+	}
+}
+
+func (cons *Syslogd) listenDatagrams(network string) error {
+	conn, err := net.ListenPacket(network, cons.address)
+	if err != nil {
+		return err
+	}
+	cons.listener = conn
+
+	go tgo.WithRecoverShutdown(func() {
+		defer cons.WorkerDone()
+		buffer := make([]byte, cons.maxMessageSize+1)
+		for {
+			size, addr, err := conn.ReadFrom(buffer)
 			if err != nil {
-				cons.Logger.WithError(err).Error("Failed to open unix://", cons.address)
+				if !cons.IsStopping() {
+					cons.Logger.WithError(err).Error("Failed to read datagram")
+					continue
+				}
+				return // ### return, stopped ###
 			}
+
+			if size > cons.maxMessageSize {
+				cons.Logger.Warningf("Dropped message exceeding %d bytes", cons.maxMessageSize)
+				continue
+			}
+
+			client := ""
+			if addr != nil {
+				client = addr.String()
+			}
+			line := bytes.TrimRight(buffer[:size], "\r\n\x00")
+			cons.parse(append([]byte{}, line...), client, "")
 		}
-	case "udp":
-		if err := server.ListenUDP(cons.address); err != nil {
-			cons.Logger.Error("Failed to open udp://", cons.address)
+	})
+	return nil
+}
+
+func (cons *Syslogd) listenStream() error {
+	listener, err := net.Listen("tcp", cons.address)
+	if err != nil {
+		return err
+	}
+	if cons.tlsConfig != nil {
+		listener = tls.NewListener(listener, cons.tlsConfig)
+	}
+	cons.listener = listener
+
+	go tgo.WithRecoverShutdown(func() {
+		defer cons.WorkerDone()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !cons.IsStopping() {
+					cons.Logger.WithError(err).Error("Failed to accept connection")
+					time.Sleep(time.Second)
+					continue
+				}
+				return // ### return, stopped ###
+			}
+
+			cons.guard.Lock()
+			cons.clients[conn] = struct{}{}
+			cons.guard.Unlock()
+
+			cons.AddWorker()
+			go tgo.WithRecoverShutdown(func() {
+				defer cons.WorkerDone()
+				cons.readStream(conn)
+			})
 		}
-	case "tcp":
-		if err := server.ListenTCP(cons.address); err != nil {
-			cons.Logger.Error("Failed to open tcp://", cons.address)
+	})
+	return nil
+}
+
+// readStream reads messages from a TCP connection. Each message is either
+// prefixed by its length or terminated by a newline.
+func (cons *Syslogd) readStream(conn net.Conn) {
+	defer func() {
+		cons.guard.Lock()
+		delete(cons.clients, conn)
+		cons.guard.Unlock()
+		conn.Close()
+	}()
+
+	tlsPeer := ""
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+		if err := tlsConn.Handshake(); err != nil {
+			cons.Logger.WithError(err).Warningf("TLS handshake with %s failed", conn.RemoteAddr())
+			return // ### return, handshake failed ###
+		}
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			tlsPeer = certs[0].Subject.CommonName
+		}
+	}
+
+	client := conn.RemoteAddr().String()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := cons.readFrame(reader)
+		switch {
+		case err == errSyslogFrameTooLarge:
+			cons.Logger.Warningf("Dropped message from %s exceeding %d bytes", client, cons.maxMessageSize)
+		case err != nil:
+			if err != io.EOF && !tnet.IsDisconnectedError(err) && !cons.IsStopping() {
+				cons.Logger.WithError(err).Warningf("Closing connection to %s", client)
+			}
+			return // ### return, connection closed ###
+		case len(line) > 0:
+			cons.parse(line, client, tlsPeer)
 		}
 	}
+}
 
-	server.Boot()
-	defer server.Kill()
+var errSyslogFrameTooLarge = fmt.Errorf("message too large")
 
-	cons.ControlLoop()
-	server.Wait()
+// readFrame reads a single octet counted or newline terminated message.
+// Messages exceeding the maximum size are skipped and errSyslogFrameTooLarge
+// is returned.
+func (cons *Syslogd) readFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '1' && first[0] <= '9' {
+		prefix, err := reader.ReadSlice(' ')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(string(prefix[:len(prefix)-1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid octet count %q", prefix)
+		}
+		if length > cons.maxMessageSize {
+			_, err := reader.Discard(length)
+			if err != nil {
+				return nil, err
+			}
+			return nil, errSyslogFrameTooLarge
+		}
+		frame := make([]byte, length)
+		_, err = io.ReadFull(reader, frame)
+		return bytes.TrimRight(frame, "\r\n"), err
+	}
+
+	var frame []byte
+	isTooLarge := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !isTooLarge {
+			if len(frame)+len(chunk) > cons.maxMessageSize+2 {
+				isTooLarge, frame = true, nil
+			} else {
+				frame = append(frame, chunk...)
+			}
+		}
+
+		switch err {
+		case bufio.ErrBufferFull:
+			continue
+		case nil:
+			if isTooLarge {
+				return nil, errSyslogFrameTooLarge
+			}
+			return bytes.TrimRight(frame, "\r\n\x00"), nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// syslogParseStructuredData converts RFC5424 structured data into a map of
+// "sd_<id>_<param>" keys. Parsing stops at the first malformed element.
+func syslogParseStructuredData(data string) map[string]string {
+	params := make(map[string]string)
+	for len(data) > 0 && data[0] == '[' {
+		end := syslogElementEnd(data)
+		if end < 0 {
+			return params // ### return, unterminated element ###
+		}
+		element := data[1:end]
+		data = data[end+1:]
+
+		idEnd := strings.IndexByte(element, ' ')
+		if idEnd < 0 {
+			continue // element without parameters
+		}
+		id, rest := element[:idEnd], element[idEnd+1:]
+
+		for {
+			rest = strings.TrimLeft(rest, " ")
+			nameEnd := strings.Index(rest, "=\"")
+			if nameEnd < 0 {
+				break
+			}
+			name := rest[:nameEnd]
+			rest = rest[nameEnd+2:]
+
+			value := make([]byte, 0, len(rest))
+			valueEnd := 0
+			for ; valueEnd < len(rest) && rest[valueEnd] != '"'; valueEnd++ {
+				if rest[valueEnd] == '\\' && valueEnd+1 < len(rest) && strings.IndexByte(`"\]`, rest[valueEnd+1]) >= 0 {
+					valueEnd++
+				}
+				value = append(value, rest[valueEnd])
+			}
+			params["sd_"+id+"_"+name] = string(value)
+
+			if valueEnd >= len(rest) {
+				break
+			}
+			rest = rest[valueEnd+1:]
+		}
+	}
+	return params
+}
+
+// syslogElementEnd returns the index of the bracket closing the structured
+// data element data starts with or -1.
+func syslogElementEnd(data string) int {
+	inQuotes := false
+	for i := 1; i < len(data); i++ {
+		switch {
+		case data[i] == '\\':
+			i++
+		case data[i] == '"':
+			inQuotes = !inQuotes
+		case data[i] == ']' && !inQuotes:
+			return i
+		}
+	}
+	return -1
 }
@@ -39,9 +39,10 @@ const (
 )
 
 const (
-	signalNone = signalType(iota)
-	signalExit = signalType(iota)
-	signalRoll = signalType(iota)
+	signalNone   = signalType(iota)
+	signalExit   = signalType(iota)
+	signalRoll   = signalType(iota)
+	signalReload = signalType(iota)
 )
 
 type coordinatorState byte
@@ -58,6 +59,9 @@ type Coordinator struct {
 	logConsumer    *core.LogConsumer
 	state          coordinatorState
 	signal         chan os.Signal
+	stopReport     func()
+	config         *core.Config
+	reloadRequests chan chan reloadResult
 }
 
 // NewCoordinator creates a new multplexer
@@ -66,6 +70,7 @@ func NewCoordinator() Coordinator {
 		consumerWorker: new(sync.WaitGroup),
 		producerWorker: new(sync.WaitGroup),
 		state:          coordinatorStateConfigure,
+		reloadRequests: make(chan chan reloadResult),
 	}
 }
 
@@ -104,6 +109,7 @@ func (co *Coordinator) Configure(conf *core.Config) error {
 	// created beyond this point must use StreamRegistry.AddWildcardProducersToRouter.
 
 	core.StreamRegistry.AddAllWildcardProducersToAllRouters()
+	co.config = conf
 	return errors.OrNil()
 }
 
@@ -141,6 +147,11 @@ func (co *Coordinator) StartPlugins() {
 		logrusHookBuffer.Purge()
 	}
 
+	// Report metrics if the _GOLLUM_METRICS_ stream has listeners
+	if core.StreamRegistry.IsStreamRegistered(core.MetricsInternalStreamID) && *flagMetricsReport > 0 {
+		co.stopReport = core.StartMetricsReport(time.Duration(*flagMetricsReport) * time.Second)
+	}
+
 	// Launch consumers
 	co.state = coordinatorStateStartConsumers
 	for _, consumer := range co.consumers {
@@ -150,10 +161,13 @@ func (co *Coordinator) StartPlugins() {
 			consumer.Consume(co.consumerWorker)
 		})
 	}
+
+	core.HealthRegistry.SetReady(true)
 }
 
 // Run is essentially the Coordinator main loop.
-// It listens for shutdown signals and updates global metrics
+// It listens for shutdown, roll and reload signals as well as config reload
+// requests.
 func (co *Coordinator) Run() {
 	co.signal = newSignalHandler()
 	defer signal.Stop(co.signal)
@@ -161,12 +175,26 @@ func (co *Coordinator) Run() {
 	logrus.Info("We be nice to them, if they be nice to us. (startup)")
 
 	for {
-		sig := <-co.signal
+		var sig os.Signal
+		select {
+		case sig = <-co.signal:
+		case result := <-co.reloadRequests:
+			diff, err := co.Reload(*flagConfigFile)
+			result <- reloadResult{diff, err}
+			continue
+		}
+
 		switch translateSignal(sig) {
 		case signalExit:
 			logrus.Info("Master betrayed us. Wicked. Tricksy, False. (signal)")
 			return // ### return, exit requested ###
 
+		case signalReload:
+			if _, err := co.Reload(*flagConfigFile); err != nil {
+				logrus.WithError(err).Error("Failed to reload config")
+			}
+			fallthrough
+
 		case signalRoll:
 			for _, consumer := range co.consumers {
 				consumer.Control() <- core.PluginControlRoll
@@ -174,6 +202,11 @@ func (co *Coordinator) Run() {
 			for _, producer := range co.producers {
 				producer.Control() <- core.PluginControlRoll
 			}
+			for _, router := range co.routers {
+				if roller, isRoller := router.(core.RouterRoller); isRoller {
+					roller.Roll()
+				}
+			}
 
 		default:
 		}
@@ -190,6 +223,11 @@ func (co *Coordinator) Shutdown() {
 
 	stateAtShutdown := co.state
 	co.state = coordinatorStateShutdown
+	core.HealthRegistry.SetReady(false)
+
+	if co.stopReport != nil {
+		co.stopReport()
+	}
 
 	co.shutdownConsumers(stateAtShutdown)
 
@@ -202,6 +240,12 @@ func (co *Coordinator) Shutdown() {
 	// Shutdown producers
 	co.shutdownProducers(stateAtShutdown)
 
+	for _, router := range co.routers {
+		if stopper, isStopper := router.(core.RouterStopper); isStopper {
+			stopper.Stop()
+		}
+	}
+
 	co.state = coordinatorStateStopped
 }
 
@@ -261,31 +305,34 @@ func (co *Coordinator) configureProducers(conf *core.Config) bool {
 		producer, _ := plugin.(core.Producer)
 		co.producers = append(co.producers, producer)
 		core.CountProducers()
+		attachProducer(producer, wildcardStream)
+	}
 
-		// Attach producer to streams
-		streams := producer.Streams()
-		for _, streamID := range streams {
-			if streamID == core.WildcardStreamID {
-				core.StreamRegistry.RegisterWildcardProducer(producer)
-			} else {
-				router := core.StreamRegistry.GetRouterOrFallback(streamID)
-				router.AddProducer(producer)
-			}
-		}
+	return allFine
+}
 
-		// Add producer to wildcard stream unless it only listens to internal streams
-	searchinternal:
-		for _, streamID := range streams {
-			switch streamID {
-			case core.LogInternalStreamID:
-			default:
-				wildcardStream.AddProducer(producer)
-				break searchinternal
-			}
+// attachProducer adds a producer to the routers of all streams it listens to.
+func attachProducer(producer core.Producer, wildcardStream core.Router) {
+	streams := producer.Streams()
+	for _, streamID := range streams {
+		if streamID == core.WildcardStreamID {
+			core.StreamRegistry.RegisterWildcardProducer(producer)
+		} else {
+			router := core.StreamRegistry.GetRouterOrFallback(streamID)
+			router.AddProducer(producer)
 		}
 	}
 
-	return allFine
+	// Add producer to wildcard stream unless it only listens to internal streams
+searchinternal:
+	for _, streamID := range streams {
+		switch streamID {
+		case core.LogInternalStreamID, core.MetricsInternalStreamID:
+		default:
+			wildcardStream.AddProducer(producer)
+			break searchinternal
+		}
+	}
 }
 
 func (co *Coordinator) configureConsumers(conf *core.Config) bool {
@@ -303,7 +350,7 @@ func (co *Coordinator) configureConsumers(conf *core.Config) bool {
 		logrus.Debug("Instantiating ", config.ID)
 		plugin, err := core.NewPluginWithConfig(config)
 		if err != nil {
-			logrus.WithError(err).Errorf("Failed to instantiate producer '%s'", config.ID)
+			logrus.WithError(err).Errorf("Failed to instantiate consumer '%s'", config.ID)
 			allFine = false
 			continue // ### continue ###
 		}
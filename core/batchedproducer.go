@@ -50,14 +50,17 @@ type BatchedProducer struct {
 	batchFlushCount int           `config:"Batch/FlushCount" default:"4096"`
 	batchTimeout    time.Duration `config:"Batch/TimeoutSec" default:"5" metric:"sec"`
 	onBatchFlush    func() AssemblyFunc
+	flushDuration   *Histogram
 }
 
 // Configure initializes the standard producer config values.
 func (prod *BatchedProducer) Configure(conf PluginConfigReader) {
 	prod.SetStopCallback(prod.DefaultClose)
+	prod.onPersistedMessage = prod.enqueueMessage
 
 	prod.batchFlushCount = tmath.MinI(prod.batchFlushCount, prod.batchMaxCount)
 	prod.Batch = NewMessageBatch(prod.batchMaxCount)
+	prod.flushDuration = NewHistogram("producer_flush_seconds", MetricLabels{"plugin_id": prod.GetID()}, nil)
 }
 
 // Enqueue will add the message to the internal channel so it can be processed
@@ -72,10 +75,15 @@ func (prod *BatchedProducer) Enqueue(msg *Message, timeout time.Duration) {
 		return // ### return, closing down ###
 	}
 
-	if !prod.HasContinueAfterModulate(msg) {
+	if !prod.HasContinueAfterModulate(msg) || prod.persistMessage(msg) {
 		return
 	}
 
+	prod.enqueueMessage(msg)
+}
+
+// enqueueMessage adds a modulated message to the batch.
+func (prod *BatchedProducer) enqueueMessage(msg *Message) {
 	prod.appendMessage(msg)
 	MessageTrace(msg, prod.GetID(), "Enqueued by batched producer")
 }
@@ -87,7 +95,26 @@ func (prod *BatchedProducer) appendMessage(msg *Message) {
 
 // flushBatch is the used function pointer to flush the batch
 func (prod *BatchedProducer) flushBatch() {
-	prod.Batch.Flush(prod.onBatchFlush())
+	prod.Batch.Flush(AcknowledgeAssembly(prod.timedAssembly(prod.onBatchFlush())))
+}
+
+// GetBacklog returns the number of messages waiting in the active batch.
+func (prod *BatchedProducer) GetBacklog() int {
+	return prod.Batch.getActiveBufferCount()
+}
+
+// timedAssembly wraps an assembly function so that the duration of each
+// flush is stored in the producer's flush duration histogram and successful
+// flushes are reported to the HealthRegistry.
+func (prod *BatchedProducer) timedAssembly(assemble AssemblyFunc) AssemblyFunc {
+	return func(messages []*Message) {
+		start := time.Now()
+		assemble(messages)
+		if prod.flushDuration != nil {
+			prod.flushDuration.ObserveSince(start)
+		}
+		HealthRegistry.SetFlushed(prod.GetID(), start)
+	}
 }
 
 // flushBatchOnTimeOut is the used function pointer to flush the batch on timeout or reached max size
@@ -108,5 +135,5 @@ func (prod *BatchedProducer) BatchMessageLoop(workers *sync.WaitGroup, onBatchFl
 // DefaultClose defines the default closing process
 func (prod *BatchedProducer) DefaultClose() {
 	defer prod.WorkerDone()
-	prod.Batch.Close(prod.onBatchFlush(), prod.GetShutdownTimeout())
+	prod.Batch.Close(AcknowledgeAssembly(prod.timedAssembly(prod.onBatchFlush())), prod.GetShutdownTimeout())
 }
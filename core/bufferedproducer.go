@@ -46,6 +46,7 @@ type BufferedProducer struct {
 func (prod *BufferedProducer) Configure(conf PluginConfigReader) {
 	prod.onPrepareStop = prod.DefaultDrain
 	prod.onStop = prod.DefaultClose
+	prod.onPersistedMessage = prod.enqueuePersistedMessage
 	prod.messages = NewMessageQueue(int(conf.GetInt("Channel", 8192)))
 }
 
@@ -56,6 +57,20 @@ func (prod *BufferedProducer) GetQueueTimeout() time.Duration {
 	return prod.channelTimeout
 }
 
+// GetQueueLoad returns the fill level of the message buffer as a value
+// between 0 (empty) and 1 (full).
+func (prod *BufferedProducer) GetQueueLoad() float64 {
+	if cap(prod.messages) == 0 {
+		return 0
+	}
+	return float64(len(prod.messages)) / float64(cap(prod.messages))
+}
+
+// GetBacklog returns the number of messages waiting in the message buffer.
+func (prod *BufferedProducer) GetBacklog() int {
+	return prod.messages.GetNumQueued()
+}
+
 // Enqueue will add the message to the internal channel so it can be processed
 // by the producer main loop. A timeout value != nil will overwrite the channel
 // timeout value for this call.
@@ -68,7 +83,7 @@ func (prod *BufferedProducer) Enqueue(msg *Message, timeout time.Duration) {
 		return // ### return, closing down ###
 	}
 
-	if !prod.HasContinueAfterModulate(msg) {
+	if !prod.HasContinueAfterModulate(msg) || prod.persistMessage(msg) {
 		return
 	}
 
@@ -85,6 +100,7 @@ func (prod *BufferedProducer) Enqueue(msg *Message, timeout time.Duration) {
 
 	case MessageQueueDiscard:
 		CountMessageDiscarded()
+		msg.Reject()
 		prod.setState(PluginStateWaiting)
 
 	default:
@@ -94,6 +110,19 @@ func (prod *BufferedProducer) Enqueue(msg *Message, timeout time.Duration) {
 	MessageTrace(msg, prod.GetID(), "Enqueued by buffered producer")
 }
 
+// enqueuePersistedMessage adds a message read from the persistent queue to
+// the internal channel. The call blocks until the channel accepts the
+// message. If the producer stops before, the message stays in the persistent
+// queue.
+func (prod *BufferedProducer) enqueuePersistedMessage(msg *Message) {
+	for prod.messages.Push(msg, persistentQueuePollTimeout) != MessageQueueOk {
+		if prod.IsStopping() {
+			return // ### return, processed after restart ###
+		}
+	}
+	MessageTrace(msg, prod.GetID(), "Enqueued by buffered producer")
+}
+
 // DefaultDrain is the function registered to onPrepareStop by default.
 // It calls DrainMessageChannel with the message handling function passed to
 // Any of the control functions. If no such call happens, this function does
@@ -109,6 +138,7 @@ func (prod *BufferedProducer) DefaultDrain() {
 // has been closed and no more messages are available. The return value
 // indicates wether the channel is empty or not.
 func (prod *BufferedProducer) DrainMessageChannel(handleMessage func(*Message), timeout time.Duration) bool {
+	handleMessage = ackMessageHandler(handleMessage)
 	for {
 		if msg, ok := prod.messages.PopWithTimeout(timeout); ok {
 			if !tgo.ReturnAfter(prod.shutdownTimeout, func() { handleMessage(msg) }) {
@@ -137,6 +167,7 @@ func (prod *BufferedProducer) DefaultClose() {
 func (prod *BufferedProducer) CloseMessageChannel(handleMessage func(*Message)) (empty bool) {
 	prod.DrainMessageChannel(handleMessage, prod.shutdownTimeout)
 	prod.messages.Close()
+	handleMessage = ackMessageHandler(handleMessage)
 
 	defer func() {
 		if !prod.messages.IsEmpty() {
@@ -180,6 +211,7 @@ func (prod *BufferedProducer) messageLoop(onMessage func(*Message)) {
 		msg, more := prod.messages.Pop()
 		if more {
 			onMessage(msg)
+			msg.acknowledgeDelivered()
 		}
 	}
 }
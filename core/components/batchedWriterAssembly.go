@@ -114,11 +114,18 @@ func (bwa *BatchedWriterAssembly) GetWriter() BatchedWriter {
 	return bwa.writer
 }
 
+// AppendOrFlush adds a message to the batch and flushes the batch if it is
+// full. Messages are acknowledged after they have been written.
+func (bwa *BatchedWriterAssembly) AppendOrFlush(msg *core.Message, canBlock func() bool, tryFallback func(*core.Message)) {
+	msg.DeferAcknowledge()
+	bwa.Batch.AppendOrFlush(msg, bwa.Flush, canBlock, tryFallback)
+}
+
 // Flush flush the batch
 func (bwa *BatchedWriterAssembly) Flush() {
 	if bwa.writer != nil {
 		bwa.assembly.SetWriter(bwa.writer)
-		bwa.Batch.Flush(bwa.assembly.Write)
+		bwa.Batch.Flush(core.AcknowledgeAssembly(bwa.assembly.Write))
 	} else {
 		bwa.Batch.Flush(bwa.assembly.Flush)
 	}
@@ -128,7 +135,7 @@ func (bwa *BatchedWriterAssembly) Flush() {
 func (bwa *BatchedWriterAssembly) Close() {
 	if bwa.writer != nil {
 		bwa.assembly.SetWriter(bwa.writer)
-		bwa.Batch.Close(bwa.assembly.Write, bwa.config.BatchFlushTimeout)
+		bwa.Batch.Close(core.AcknowledgeAssembly(bwa.assembly.Write), bwa.config.BatchFlushTimeout)
 	} else {
 		bwa.Batch.Close(bwa.assembly.Flush, bwa.config.BatchFlushTimeout)
 	}
@@ -0,0 +1,194 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/trivago/gollum/core"
+)
+
+// EventHubsClient component
+//
+// The EventHubsClient is a helper component to connect to Azure Event Hubs
+// via AMQP 1.0. Clients authenticate with a shared access policy. Settings
+// given as parameters take precedence over the settings in ConnectionString.
+//
+// Parameters
+//
+// - ConnectionString: Defines a connection string as shown in the Azure
+// portal, e.g. "Endpoint=sb://example.servicebus.windows.net/;
+// SharedAccessKeyName=gollum;SharedAccessKey=...;EntityPath=logs". Set
+// "UseDevelopmentEmulator=true" to connect to the Event Hubs emulator
+// without TLS.
+// By default this parameter is set to "".
+//
+// - Namespace: Defines the fully qualified namespace, e.g.
+// "example.servicebus.windows.net".
+// By default this parameter is set to "".
+//
+// - Hub: Defines the name of the event hub.
+// By default this parameter is set to "".
+//
+// - KeyName: Defines the name of the shared access policy.
+// By default this parameter is set to "".
+//
+// - Key: Defines the key of the shared access policy.
+// By default this parameter is set to "".
+//
+type EventHubsClient struct {
+	connectionString string `config:"ConnectionString"`
+	namespace        string `config:"Namespace"`
+	hub              string `config:"Hub"`
+	keyName          string `config:"KeyName"`
+	key              string `config:"Key"`
+	useEmulator      bool
+}
+
+// Configure method
+func (client *EventHubsClient) Configure(conf core.PluginConfigReader) {
+	if client.connectionString == "" {
+		return
+	}
+
+	for _, part := range strings.Split(client.connectionString, ";") {
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(keyValue[1])
+
+		switch strings.ToLower(strings.TrimSpace(keyValue[0])) {
+		case "endpoint":
+			endpoint, err := url.Parse(value)
+			if err != nil {
+				conf.Errors.Pushf("Invalid endpoint in ConnectionString: %s", err)
+				continue
+			}
+			if client.namespace == "" {
+				client.namespace = endpoint.Host
+			}
+		case "sharedaccesskeyname":
+			if client.keyName == "" {
+				client.keyName = value
+			}
+		case "sharedaccesskey":
+			if client.key == "" {
+				client.key = value
+			}
+		case "entitypath":
+			if client.hub == "" {
+				client.hub = value
+			}
+		case "usedevelopmentemulator":
+			client.useEmulator = strings.EqualFold(value, "true")
+		}
+	}
+}
+
+// IsConfigured returns true if namespace and hub are set.
+func (client *EventHubsClient) IsConfigured() bool {
+	return client.namespace != "" && client.hub != ""
+}
+
+// GetHub returns the name of the event hub.
+func (client *EventHubsClient) GetHub() string {
+	return client.hub
+}
+
+// Dial opens a new AMQP connection to the namespace.
+func (client *EventHubsClient) Dial() (*amqp.Client, error) {
+	address := "amqps://" + client.namespace
+	if client.useEmulator {
+		address = "amqp://" + client.namespace
+	}
+
+	return amqp.Dial(address,
+		amqp.ConnSASLPlain(client.keyName, client.key),
+		amqp.ConnIdleTimeout(0),
+		amqp.ConnConnectTimeout(30*time.Second))
+}
+
+// GetPartitionIDs reads the IDs of all partitions of the event hub using
+// the management node.
+func (client *EventHubsClient) GetPartitionIDs(conn *amqp.Client, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close(ctx)
+
+	replyTo := fmt.Sprintf("gollum-%d", time.Now().UnixNano())
+	receiver, err := session.NewReceiver(
+		amqp.LinkSourceAddress("$management"),
+		amqp.LinkTargetAddress(replyTo))
+	if err != nil {
+		return nil, err
+	}
+	defer receiver.Close(ctx)
+
+	sender, err := session.NewSender(amqp.LinkTargetAddress("$management"))
+	if err != nil {
+		return nil, err
+	}
+	defer sender.Close(ctx)
+
+	request := &amqp.Message{
+		Properties: &amqp.MessageProperties{
+			MessageID: replyTo,
+			ReplyTo:   replyTo,
+		},
+		ApplicationProperties: map[string]interface{}{
+			"operation": "READ",
+			"name":      client.hub,
+			"type":      "com.microsoft:eventhub",
+		},
+	}
+	if err := sender.Send(ctx, request); err != nil {
+		return nil, err
+	}
+
+	response, err := receiver.Receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response.Accept(ctx)
+
+	if status, hasStatus := response.ApplicationProperties["status-code"]; hasStatus && fmt.Sprint(status) != "200" {
+		return nil, fmt.Errorf("management request failed with status %v: %v", status, response.ApplicationProperties["status-description"])
+	}
+
+	var partitions interface{}
+	switch value := response.Value.(type) {
+	case map[string]interface{}:
+		partitions = value["partition_ids"]
+	case map[interface{}]interface{}:
+		partitions = value["partition_ids"]
+	}
+
+	partitionIDs, isList := partitions.([]string)
+	if !isList || len(partitionIDs) == 0 {
+		return nil, fmt.Errorf("management response contains no partitions")
+	}
+	return partitionIDs, nil
+}
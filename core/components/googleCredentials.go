@@ -0,0 +1,245 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+const (
+	googleMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	googleDefaultTokenURL  = "https://oauth2.googleapis.com/token"
+	googleJWTGrantType     = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// GoogleCredentials component
+//
+// The GoogleCredentials is a helper component to retrieve OAuth2 access tokens
+// for Google Cloud APIs. Tokens are either created from a service account key
+// file or requested from the GCE metadata server.
+//
+// Parameters
+//
+// - Credential/File: Defines the path to a service account JSON key file.
+// If this value is empty, tokens are requested from the metadata server of
+// the instance gollum is running on.
+// By default this parameter is set to "".
+//
+// - Credential/Scopes: Defines the OAuth2 scopes to request.
+// By default this parameter is set to "https://www.googleapis.com/auth/cloud-platform".
+//
+type GoogleCredentials struct {
+	file    string   `config:"Credential/File" default:""`
+	scopes  []string `config:"Credential/Scopes" default:"https://www.googleapis.com/auth/cloud-platform"`
+	account googleServiceAccount
+	key     *rsa.PrivateKey
+	token   string
+	expiry  time.Time
+	guard   *sync.Mutex
+	client  http.Client
+}
+
+type googleServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+type googleToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Configure method
+func (cred *GoogleCredentials) Configure(conf core.PluginConfigReader) {
+	cred.guard = new(sync.Mutex)
+	cred.client.Timeout = 30 * time.Second
+
+	if cred.file == "" {
+		return // ### return, use metadata server ###
+	}
+
+	data, err := ioutil.ReadFile(cred.file)
+	if conf.Errors.Push(err) {
+		return // ### return, file not readable ###
+	}
+
+	if err := json.Unmarshal(data, &cred.account); conf.Errors.Push(err) {
+		return // ### return, invalid key file ###
+	}
+
+	if cred.account.TokenURI == "" {
+		cred.account.TokenURI = googleDefaultTokenURL
+	}
+
+	cred.key, err = ParseRSAPrivateKey([]byte(cred.account.PrivateKey))
+	conf.Errors.Push(err)
+}
+
+// ParseRSAPrivateKey parses a PEM encoded PKCS#1 or PKCS#8 RSA private key.
+func ParseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, isRSA := parsed.(*rsa.PrivateKey)
+	if !isRSA {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// SignJWT creates an RS256 signed JSON web token from the given header
+// fields and claims.
+func SignJWT(key *rsa.PrivateKey, header map[string]interface{}, claims map[string]interface{}) (string, error) {
+	jwtHeader := map[string]interface{}{"alg": "RS256", "typ": "JWT"}
+	for k, v := range header {
+		jwtHeader[k] = v
+	}
+
+	headerJSON, err := json.Marshal(jwtHeader)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(headerJSON) + "." + encoding.EncodeToString(claimsJSON)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
+
+// GetToken returns a valid access token. Tokens are cached until shortly
+// before they expire.
+func (cred *GoogleCredentials) GetToken() (string, error) {
+	cred.guard.Lock()
+	defer cred.guard.Unlock()
+
+	if cred.token != "" && time.Now().Before(cred.expiry) {
+		return cred.token, nil // ### return, cached ###
+	}
+
+	var (
+		token googleToken
+		err   error
+	)
+
+	if cred.key == nil {
+		token, err = cred.requestMetadataToken()
+	} else {
+		token, err = cred.requestServiceAccountToken()
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	cred.token = token.AccessToken
+	cred.expiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return cred.token, nil
+}
+
+func (cred *GoogleCredentials) requestMetadataToken() (googleToken, error) {
+	req, err := http.NewRequest(http.MethodGet, googleMetadataTokenURL, nil)
+	if err != nil {
+		return googleToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return cred.requestToken(req)
+}
+
+func (cred *GoogleCredentials) requestServiceAccountToken() (googleToken, error) {
+	now := time.Now()
+	assertion, err := SignJWT(cred.key,
+		map[string]interface{}{"kid": cred.account.PrivateKeyID},
+		map[string]interface{}{
+			"iss":   cred.account.ClientEmail,
+			"scope": strings.Join(cred.scopes, " "),
+			"aud":   cred.account.TokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		})
+	if err != nil {
+		return googleToken{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", googleJWTGrantType)
+	form.Set("assertion", assertion)
+
+	req, err := http.NewRequest(http.MethodPost, cred.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return googleToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return cred.requestToken(req)
+}
+
+func (cred *GoogleCredentials) requestToken(req *http.Request) (googleToken, error) {
+	token := googleToken{}
+	resp, err := cred.client.Do(req)
+	if err != nil {
+		return token, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return token, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return token, fmt.Errorf("token request failed with %s: %s", resp.Status, string(body))
+	}
+
+	err = json.Unmarshal(body, &token)
+	return token, err
+}
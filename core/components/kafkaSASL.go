@@ -0,0 +1,311 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	kafka "github.com/Shopify/sarama"
+	"github.com/trivago/gollum/core"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ConfigureKafkaSASLMechanism reads the SaslMechanism and SaslOAuth* settings
+// shared by the kafka consumer and producer and applies them to the given
+// kafka config. User name and password have to be set by the caller.
+func ConfigureKafkaSASLMechanism(conf core.PluginConfigReader, config *kafka.Config) {
+	mechanism := strings.ToUpper(conf.GetString("SaslMechanism", kafka.SASLTypePlaintext))
+
+	switch mechanism {
+	case kafka.SASLTypePlaintext:
+		config.Net.SASL.Mechanism = kafka.SASLTypePlaintext
+
+	case kafka.SASLTypeSCRAMSHA256:
+		config.Net.SASL.Mechanism = kafka.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = NewKafkaSCRAMClientGenerator(sha256.New)
+
+	case kafka.SASLTypeSCRAMSHA512:
+		config.Net.SASL.Mechanism = kafka.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = NewKafkaSCRAMClientGenerator(sha512.New)
+
+	case kafka.SASLTypeOAuth:
+		config.Net.SASL.Mechanism = kafka.SASLTypeOAuth
+		provider := &KafkaTokenProvider{
+			TokenURL:     conf.GetString("SaslOAuthTokenURL", ""),
+			ClientID:     conf.GetString("SaslOAuthClientID", ""),
+			ClientSecret: conf.GetString("SaslOAuthClientSecret", ""),
+			Scopes:       conf.GetStringArray("SaslOAuthScopes", []string{}),
+			TokenFile:    conf.GetString("SaslOAuthTokenFile", ""),
+		}
+		if provider.TokenURL == "" && provider.TokenFile == "" {
+			conf.Errors.Pushf("SaslOAuthTokenURL or SaslOAuthTokenFile must be set when using OAUTHBEARER")
+		}
+		config.Net.SASL.TokenProvider = provider
+
+	default:
+		conf.Errors.Pushf("Unknown SaslMechanism: %s", mechanism)
+	}
+}
+
+// KafkaSCRAMClient implements the client side of a SCRAM authentication
+// as defined by RFC5802. The password is expected to not require SASLprep
+// normalization.
+type KafkaSCRAMClient struct {
+	hash            func() hash.Hash
+	user            string
+	password        string
+	authzID         string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+	step            int
+	done            bool
+}
+
+// NewKafkaSCRAMClientGenerator returns a function creating SCRAM clients
+// using the given hash function.
+func NewKafkaSCRAMClientGenerator(hash func() hash.Hash) func() kafka.SCRAMClient {
+	return func() kafka.SCRAMClient {
+		return &KafkaSCRAMClient{hash: hash}
+	}
+}
+
+// Begin prepares the client for the SCRAM exchange.
+func (client *KafkaSCRAMClient) Begin(user, password, authzID string) error {
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	client.user = user
+	client.password = password
+	client.authzID = authzID
+	client.nonce = base64.StdEncoding.EncodeToString(nonce)
+	client.step = 0
+	client.done = false
+	return nil
+}
+
+// Step processes a server challenge and returns the next client message.
+func (client *KafkaSCRAMClient) Step(challenge string) (string, error) {
+	client.step++
+	switch client.step {
+	case 1:
+		return client.clientFirstMessage(), nil
+	case 2:
+		return client.clientFinalMessage(challenge)
+	case 3:
+		return "", client.verifyServerFinal(challenge)
+	default:
+		return "", fmt.Errorf("unexpected SCRAM step %d", client.step)
+	}
+}
+
+// Done returns true if the SCRAM exchange has been completed.
+func (client *KafkaSCRAMClient) Done() bool {
+	return client.done
+}
+
+func scramEscape(value string) string {
+	value = strings.Replace(value, "=", "=3D", -1)
+	return strings.Replace(value, ",", "=2C", -1)
+}
+
+func (client *KafkaSCRAMClient) gs2Header() string {
+	if client.authzID == "" {
+		return "n,,"
+	}
+	return "n,a=" + scramEscape(client.authzID) + ","
+}
+
+func (client *KafkaSCRAMClient) hmac(key []byte, data string) []byte {
+	mac := hmac.New(client.hash, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (client *KafkaSCRAMClient) clientFirstMessage() string {
+	client.clientFirstBare = "n=" + scramEscape(client.user) + ",r=" + client.nonce
+	return client.gs2Header() + client.clientFirstBare
+}
+
+func (client *KafkaSCRAMClient) clientFinalMessage(serverFirst string) (string, error) {
+	var (
+		serverNonce string
+		salt        []byte
+		iterations  int
+		err         error
+	)
+
+	for _, attribute := range strings.Split(serverFirst, ",") {
+		if len(attribute) < 2 || attribute[1] != '=' {
+			continue
+		}
+		switch value := attribute[2:]; attribute[0] {
+		case 'r':
+			serverNonce = value
+		case 's':
+			if salt, err = base64.StdEncoding.DecodeString(value); err != nil {
+				return "", err
+			}
+		case 'i':
+			if _, err = fmt.Sscanf(value, "%d", &iterations); err != nil {
+				return "", err
+			}
+		case 'e':
+			return "", fmt.Errorf("SCRAM server error: %s", value)
+		}
+	}
+
+	if !strings.HasPrefix(serverNonce, client.nonce) {
+		return "", fmt.Errorf("SCRAM server nonce does not match client nonce")
+	}
+	if len(salt) == 0 || iterations <= 0 {
+		return "", fmt.Errorf("invalid SCRAM server first message")
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(client.password), salt, iterations, client.hash().Size(), client.hash)
+	clientKey := client.hmac(saltedPassword, "Client Key")
+	storedKey := client.hash()
+	storedKey.Write(clientKey)
+
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(client.gs2Header())) + ",r=" + serverNonce
+	authMessage := client.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	clientSignature := client.hmac(storedKey.Sum(nil), authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverKey := client.hmac(saltedPassword, "Server Key")
+	client.serverSignature = client.hmac(serverKey, authMessage)
+
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (client *KafkaSCRAMClient) verifyServerFinal(serverFinal string) error {
+	switch {
+	case strings.HasPrefix(serverFinal, "e="):
+		return fmt.Errorf("SCRAM server error: %s", serverFinal[2:])
+
+	case strings.HasPrefix(serverFinal, "v="):
+		signature, err := base64.StdEncoding.DecodeString(serverFinal[2:])
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(signature, client.serverSignature) {
+			return fmt.Errorf("SCRAM server signature does not match")
+		}
+		client.done = true
+		return nil
+
+	default:
+		return fmt.Errorf("invalid SCRAM server final message")
+	}
+}
+
+// KafkaTokenProvider implements kafka.AccessTokenProvider for SASL/OAUTHBEARER
+// authentication. Tokens are either requested from an OAuth2 token endpoint
+// using the client credentials flow or read from a file.
+type KafkaTokenProvider struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	TokenFile    string
+	token        string
+	expiry       time.Time
+	guard        sync.Mutex
+}
+
+// Token returns a valid access token.
+func (provider *KafkaTokenProvider) Token() (*kafka.AccessToken, error) {
+	if provider.TokenURL == "" {
+		data, err := ioutil.ReadFile(provider.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return &kafka.AccessToken{Token: strings.TrimSpace(string(data))}, nil
+	}
+
+	provider.guard.Lock()
+	defer provider.guard.Unlock()
+
+	if provider.token == "" || time.Now().After(provider.expiry) {
+		if err := provider.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return &kafka.AccessToken{Token: provider.token}, nil
+}
+
+func (provider *KafkaTokenProvider) refresh() error {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(provider.Scopes) > 0 {
+		form.Set("scope", strings.Join(provider.Scopes, " "))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, provider.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(provider.ClientID), url.QueryEscape(provider.ClientSecret))
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request failed with %s: %s", resp.Status, string(body))
+	}
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return err
+	}
+
+	// Refresh tokens before they expire to not fail on connections made
+	// shortly before the expiry date.
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	provider.token = token.AccessToken
+	provider.expiry = time.Now().Add(lifetime - lifetime/10)
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package components
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/trivago/gollum/core"
+)
+
+// NewTLSClientConfig creates a TLS configuration for client connections from
+// the following plugin settings:
+//
+// - TlsKeyLocation: Path to the client's PEM-formatted private key. Requires
+// TlsCertificateLocation to be set, too.
+//
+// - TlsCertificateLocation: Path to the client's PEM-formatted certificate.
+//
+// - TlsCaLocation: Path to the CA certificate(s) used to verify the server.
+// If not set, the system's root certificates are used.
+//
+// - TlsServerName: Expected host name of the server certificate.
+//
+// - TlsInsecureSkipVerify: Disables verification of the server certificate.
+func NewTLSClientConfig(conf core.PluginConfigReader) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         conf.GetString("TlsServerName", ""),
+		InsecureSkipVerify: conf.GetBool("TlsInsecureSkipVerify", false),
+	}
+
+	keyFile := conf.GetString("TlsKeyLocation", "")
+	certFile := conf.GetString("TlsCertificateLocation", "")
+	switch {
+	case keyFile != "" && certFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case keyFile != "":
+		return nil, fmt.Errorf("cannot specify TlsKeyLocation without TlsCertificateLocation")
+	case certFile != "":
+		return nil, fmt.Errorf("cannot specify TlsCertificateLocation without TlsKeyLocation")
+	}
+
+	if caFile := conf.GetString("TlsCaLocation", ""); caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewTLSServerConfig creates a TLS configuration for listeners from the
+// following plugin settings:
+//
+// - TlsKeyLocation: Path to the server's PEM-formatted private key.
+//
+// - TlsCertificateLocation: Path to the server's PEM-formatted certificate.
+//
+// - TlsCaLocation: Path to the CA certificate(s) used to verify clients. If
+// set, clients have to present a valid certificate.
+func NewTLSServerConfig(conf core.PluginConfigReader) (*tls.Config, error) {
+	keyFile := conf.GetString("TlsKeyLocation", "")
+	certFile := conf.GetString("TlsCertificateLocation", "")
+	if keyFile == "" || certFile == "" {
+		return nil, fmt.Errorf("TlsKeyLocation and TlsCertificateLocation are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if caFile := conf.GetString("TlsCaLocation", ""); caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
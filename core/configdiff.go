@@ -0,0 +1,202 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/trivago/tgo/tcontainer"
+)
+
+// ConfigDiff holds the plugins that differ between two configs. Disabled
+// plugins are treated as if they were not configured.
+type ConfigDiff struct {
+	// Added holds the configs of plugins only found in the new config
+	Added Config
+	// Removed holds the configs of plugins only found in the current config
+	Removed Config
+	// Changed holds the new configs of plugins with changed settings
+	Changed Config
+}
+
+// DiffConfig compares the plugins of the current and the next config by
+// their IDs. Plugins are sorted by ID in all lists of the result.
+func DiffConfig(current, next *Config) ConfigDiff {
+	diff := ConfigDiff{}
+	currentPlugins := getEnabledPlugins(current)
+	nextPlugins := getEnabledPlugins(next)
+
+	for ID, config := range nextPlugins {
+		currentConfig, exists := currentPlugins[ID]
+		switch {
+		case !exists:
+			diff.Added.Plugins = append(diff.Added.Plugins, config)
+		case !currentConfig.Equals(config):
+			diff.Changed.Plugins = append(diff.Changed.Plugins, config)
+		}
+	}
+
+	for ID, config := range currentPlugins {
+		if _, exists := nextPlugins[ID]; !exists {
+			diff.Removed.Plugins = append(diff.Removed.Plugins, config)
+		}
+	}
+
+	for _, plugins := range [][]PluginConfig{diff.Added.Plugins, diff.Removed.Plugins, diff.Changed.Plugins} {
+		sort.Slice(plugins, func(i, j int) bool { return plugins[i].ID < plugins[j].ID })
+	}
+	return diff
+}
+
+func getEnabledPlugins(config *Config) map[string]PluginConfig {
+	plugins := make(map[string]PluginConfig)
+	if config == nil {
+		return plugins
+	}
+	for _, plugin := range config.Plugins {
+		if plugin.Enable {
+			plugins[plugin.ID] = plugin
+		}
+	}
+	return plugins
+}
+
+// AddRouterDependents adds plugins of the next config to the changed plugins
+// if they keep a reference to a router that is added, removed or changed,
+// i.e. consumers bound to the router's stream, producers using it as
+// fallback stream and routers using it as target stream. As routers added
+// this way are replaced, too, their dependents are added as well.
+func (diff *ConfigDiff) AddRouterDependents(next *Config) {
+	streams := make(map[MessageStreamID]bool)
+	for _, routers := range [][]PluginConfig{diff.Added.GetRouters(), diff.Removed.GetRouters(), diff.Changed.GetRouters()} {
+		for _, config := range routers {
+			streams[getRouterStreamID(config)] = true
+		}
+	}
+	delete(streams, InvalidStreamID)
+	if len(streams) == 0 {
+		return // ### return, no router changed ###
+	}
+
+	skip := diff.GetRemovedOrChangedIDs()
+	for _, config := range diff.Added.Plugins {
+		skip[config.ID] = true
+	}
+
+	// Repeat until no more routers depend on a replaced router
+	for dependentFound := true; dependentFound; {
+		dependentFound = false
+		for _, config := range next.GetRouters() {
+			if skip[config.ID] || !dependsOnAny(getRouterTargets(config), streams) {
+				continue // ### continue, not affected ###
+			}
+			diff.Changed.Plugins = append(diff.Changed.Plugins, config)
+			skip[config.ID] = true
+			streams[getRouterStreamID(config)] = true
+			dependentFound = true
+		}
+	}
+
+	for _, config := range next.GetConsumers() {
+		reader := NewPluginConfigReaderWithError(&config)
+		boundStreams, _ := reader.GetStreamArray("Streams", []MessageStreamID{})
+		if !skip[config.ID] && dependsOnAny(boundStreams, streams) {
+			diff.Changed.Plugins = append(diff.Changed.Plugins, config)
+			skip[config.ID] = true
+		}
+	}
+
+	for _, config := range next.GetProducers() {
+		reader := NewPluginConfigReaderWithError(&config)
+		fallbackStream, _ := reader.GetStreamID("FallbackStream", InvalidStreamID)
+		if !skip[config.ID] && streams[fallbackStream] {
+			diff.Changed.Plugins = append(diff.Changed.Plugins, config)
+			skip[config.ID] = true
+		}
+	}
+
+	plugins := diff.Changed.Plugins
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].ID < plugins[j].ID })
+}
+
+func getRouterStreamID(config PluginConfig) MessageStreamID {
+	reader := NewPluginConfigReaderWithError(&config)
+	streamID, _ := reader.GetStreamID("Stream", InvalidStreamID)
+	return streamID
+}
+
+// getRouterTargets returns the streams a router passes messages to, i.e. the
+// routers it resolves when being started.
+func getRouterTargets(config PluginConfig) []MessageStreamID {
+	reader := NewPluginConfigReaderWithError(&config)
+	targets, _ := reader.GetStreamArray("TargetStreams", []MessageStreamID{})
+
+	for _, key := range []string{"ShadowStream", "DefaultStream"} {
+		if streamID, _ := reader.GetStreamID(key, InvalidStreamID); streamID != InvalidStreamID {
+			targets = append(targets, streamID)
+		}
+	}
+
+	weights, _ := reader.GetMap("Weights", tcontainer.NewMarshalMap())
+	for stream := range weights {
+		targets = append(targets, GetStreamID(stream))
+	}
+
+	rules, _ := reader.GetArray("Rules", []interface{}{})
+	for _, rule := range rules {
+		if values, err := tcontainer.ConvertToMarshalMap(rule, nil); err == nil {
+			if stream, err := values.String("Stream"); err == nil {
+				targets = append(targets, GetStreamID(stream))
+			}
+		}
+	}
+	return targets
+}
+
+func dependsOnAny(streamIDs []MessageStreamID, streams map[MessageStreamID]bool) bool {
+	for _, streamID := range streamIDs {
+		if streams[streamID] {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEmpty returns true if no plugin has been added, removed or changed.
+func (diff ConfigDiff) IsEmpty() bool {
+	return len(diff.Added.Plugins)+len(diff.Removed.Plugins)+len(diff.Changed.Plugins) == 0
+}
+
+// GetRemovedOrChangedIDs returns the IDs of all plugins that need to be
+// stopped when applying the diff.
+func (diff ConfigDiff) GetRemovedOrChangedIDs() map[string]bool {
+	IDs := make(map[string]bool)
+	for _, config := range diff.Removed.Plugins {
+		IDs[config.ID] = true
+	}
+	for _, config := range diff.Changed.Plugins {
+		IDs[config.ID] = true
+	}
+	return IDs
+}
+
+// Equals returns true if both configs have the same type, enable state and
+// settings.
+func (conf PluginConfig) Equals(other PluginConfig) bool {
+	return conf.Typename == other.Typename &&
+		conf.Enable == other.Enable &&
+		reflect.DeepEqual(conf.Settings, other.Settings)
+}
@@ -0,0 +1,127 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+func getPluginIDs(config Config) []string {
+	IDs := []string{}
+	for _, plugin := range config.Plugins {
+		IDs = append(IDs, plugin.ID)
+	}
+	return IDs
+}
+
+func TestDiffConfig(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	TypeRegistry.Register(TypeMockA{})
+	TypeRegistry.Register(TypeMockB{})
+	TypeRegistry.Register(TypeMockC{})
+
+	current, err := ReadConfig([]byte(`
+consumerA: {Type: core.TypeMockA, Streams: foo}
+producerA: {Type: core.TypeMockC, Streams: foo}
+producerB: {Type: core.TypeMockC, Streams: foo}
+producerC: {Type: core.TypeMockC, Streams: foo, Enable: false}
+`))
+	expect.NoError(err)
+
+	next, err := ReadConfig([]byte(`
+consumerA: {Type: core.TypeMockA, Streams: foo}
+producerA: {Type: core.TypeMockC, Streams: [foo, bar]}
+producerC: {Type: core.TypeMockC, Streams: foo}
+`))
+	expect.NoError(err)
+
+	diff := DiffConfig(current, current)
+	expect.True(diff.IsEmpty())
+
+	diff = DiffConfig(current, next)
+	expect.False(diff.IsEmpty())
+	expect.Equal([]string{"producerC"}, getPluginIDs(diff.Added))
+	expect.Equal([]string{"producerB"}, getPluginIDs(diff.Removed))
+	expect.Equal([]string{"producerA"}, getPluginIDs(diff.Changed))
+	expect.Equal(map[string]bool{"producerA": true, "producerB": true}, diff.GetRemovedOrChangedIDs())
+
+	// No router changed, so nothing depends on the changes
+	diff.AddRouterDependents(next)
+	expect.Equal([]string{"producerA"}, getPluginIDs(diff.Changed))
+}
+
+func TestDiffConfigRouterDependents(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	TypeRegistry.Register(TypeMockA{})
+	TypeRegistry.Register(TypeMockB{})
+	TypeRegistry.Register(TypeMockC{})
+
+	current, err := ReadConfig([]byte(`
+consumerA: {Type: core.TypeMockA, Streams: foo}
+consumerB: {Type: core.TypeMockA, Streams: bar}
+producerA: {Type: core.TypeMockC, Streams: bar, FallbackStream: foo}
+producerB: {Type: core.TypeMockC, Streams: bar}
+`))
+	expect.NoError(err)
+
+	next, err := ReadConfig([]byte(`
+routerFoo: {Type: core.TypeMockB, Stream: foo}
+consumerA: {Type: core.TypeMockA, Streams: foo}
+consumerB: {Type: core.TypeMockA, Streams: bar}
+producerA: {Type: core.TypeMockC, Streams: bar, FallbackStream: foo}
+producerB: {Type: core.TypeMockC, Streams: bar}
+`))
+	expect.NoError(err)
+
+	diff := DiffConfig(current, next)
+	expect.Equal([]string{"routerFoo"}, getPluginIDs(diff.Added))
+	expect.Equal(0, len(diff.Changed.Plugins))
+
+	diff.AddRouterDependents(next)
+	expect.Equal([]string{"consumerA", "producerA"}, getPluginIDs(diff.Changed))
+}
+
+func TestDiffConfigRouterTargets(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	TypeRegistry.Register(TypeMockB{})
+
+	current, err := ReadConfig([]byte(`
+routerFoo: {Type: core.TypeMockB, Stream: foo}
+routerBar: {Type: core.TypeMockB, Stream: bar, TargetStreams: foo}
+routerBaz: {Type: core.TypeMockB, Stream: baz, Weights: {bar: 1}}
+routerQux: {Type: core.TypeMockB, Stream: qux, Rules: [{Stream: baz}]}
+routerOther: {Type: core.TypeMockB, Stream: other, ShadowStream: qux2}
+`))
+	expect.NoError(err)
+
+	next, err := ReadConfig([]byte(`
+routerFoo: {Type: core.TypeMockB, Stream: foo, Filters: []}
+routerBar: {Type: core.TypeMockB, Stream: bar, TargetStreams: foo}
+routerBaz: {Type: core.TypeMockB, Stream: baz, Weights: {bar: 1}}
+routerQux: {Type: core.TypeMockB, Stream: qux, Rules: [{Stream: baz}]}
+routerOther: {Type: core.TypeMockB, Stream: other, ShadowStream: qux2}
+`))
+	expect.NoError(err)
+
+	// Routers are replaced if they pass messages to a replaced router
+	diff := DiffConfig(current, next)
+	diff.AddRouterDependents(next)
+	expect.Equal([]string{"routerBar", "routerBaz", "routerFoo", "routerQux"}, getPluginIDs(diff.Changed))
+}
@@ -31,6 +31,7 @@ type DirectProducer struct {
 func (prod *DirectProducer) Configure(conf PluginConfigReader) {
 	// We need to have an empty Configure method, otherwise
 	// SimpleProducer.Configure will be called twice as Configure is inherited.
+	prod.onPersistedMessage = prod.deliverMessage
 }
 
 // Enqueue will add the message to the internal channel so it can be processed
@@ -45,11 +46,17 @@ func (prod *DirectProducer) Enqueue(msg *Message, timeout time.Duration) {
 		return // ### return, closing down ###
 	}
 
-	if !prod.HasContinueAfterModulate(msg) {
+	if !prod.HasContinueAfterModulate(msg) || prod.persistMessage(msg) {
 		return
 	}
 
+	prod.deliverMessage(msg)
+}
+
+// deliverMessage passes a modulated message to the producer.
+func (prod *DirectProducer) deliverMessage(msg *Message) {
 	prod.onMessage(msg)
+	msg.acknowledgeDelivered()
 	MessageTrace(msg, prod.GetID(), "Enqueued by direct producer")
 }
 
@@ -57,9 +64,10 @@ func (prod *DirectProducer) Enqueue(msg *Message, timeout time.Duration) {
 // use cases. ControlLoop will be called in a separate go routine.
 // This function will block until a stop signal is received.
 func (prod *DirectProducer) MessageControlLoop(onMessage func(*Message)) {
+	// Messages may be passed as soon as the producer is active
+	prod.onMessage = onMessage
 	prod.setState(PluginStateActive)
 	go prod.ControlLoop()
-	prod.onMessage = onMessage
 }
 
 // TickerMessageControlLoop is like MessageLoop but executes a given function at
@@ -67,8 +75,8 @@ func (prod *DirectProducer) MessageControlLoop(onMessage func(*Message)) {
 // interval, the next tick will be delayed until onTick finishes.
 func (prod *DirectProducer) TickerMessageControlLoop(onMessage func(*Message),
 	interval time.Duration, onTimeOut func()) {
-	prod.setState(PluginStateActive)
 	prod.onMessage = onMessage
+	prod.setState(PluginStateActive)
 	prod.TickerControlLoop(interval, onTimeOut)
 }
 
@@ -14,6 +14,11 @@
 
 package core
 
+import (
+	"fmt"
+	"strings"
+)
+
 // A Filter defines an analysis step inside the message
 // A filter also have to implement the modulator interface
 type Filter interface {
@@ -26,15 +31,34 @@ type FilterArray []Filter
 // ApplyFilter calls ApplyFilter on every filter
 // Return FilterResultMessageReject in case of an error or if one filter rejects
 func (filters FilterArray) ApplyFilter(msg *Message) (FilterResult, error) {
-	for _, filter := range filters {
-		result, err := filter.ApplyFilter(msg)
-		if err != nil {
-			return result, err
-		}
+	result, _, err := ApplyFilterWithReason(filters, msg)
+	return result, err
+}
 
-		if result != FilterResultMessageAccept {
-			return result, nil
+// GetFilterReason returns the type name of a filter, e.g. "filter.Rate".
+// It is used to tell which filter rejected a message.
+func GetFilterReason(filter Filter) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", filter), "*")
+}
+
+// ApplyFilterWithReason calls ApplyFilter on the given filter. If the message
+// is rejected, the reason as returned by GetFilterReason is returned, too.
+// For FilterArrays the reason names the filter inside the array that
+// rejected the message.
+func ApplyFilterWithReason(filter Filter, msg *Message) (FilterResult, string, error) {
+	if filters, isArray := filter.(FilterArray); isArray {
+		for _, filter := range filters {
+			result, reason, err := ApplyFilterWithReason(filter, msg)
+			if err != nil || result != FilterResultMessageAccept {
+				return result, reason, err
+			}
 		}
+		return FilterResultMessageAccept, "", nil
+	}
+
+	result, err := filter.ApplyFilter(msg)
+	if err != nil || result != FilterResultMessageAccept {
+		return result, GetFilterReason(filter), err
 	}
-	return FilterResultMessageAccept, nil
+	return result, "", nil
 }
@@ -0,0 +1,65 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FilterAuditReasonKey is the metadata key audited messages store the
+	// rejecting filter in
+	FilterAuditReasonKey = "filtered_by"
+	// FilterAuditStreamKey is the metadata key audited messages store the
+	// stream they were rejected on in
+	FilterAuditStreamKey = "filtered_stream"
+)
+
+// FilterAudit is called for every message rejected by a filter. By default
+// this function does nothing.
+var FilterAudit = func(msg *Message, reason string) {}
+
+// ActivateFilterAudit sets a FilterAudit function that sends a copy of every
+// rejected message to the given stream. The copy is annotated with the
+// rejecting filter and the stream it was rejected on.
+func ActivateFilterAudit(stream string) {
+	auditStreamID := GetStreamID(stream)
+
+	FilterAudit = func(msg *Message, reason string) {
+		if msg.GetStreamID() == auditStreamID {
+			return // ### return, don't audit the audit stream ###
+		}
+
+		auditMsg := msg.Clone()
+		auditMsg.DetachAckCallback()
+		auditMsg.data.metadata = msg.data.metadata.Clone()
+
+		metadata := auditMsg.GetMetadata()
+		metadata.SetValue(FilterAuditReasonKey, []byte(reason))
+		metadata.SetValue(FilterAuditStreamKey, []byte(StreamRegistry.GetStreamName(msg.GetStreamID())))
+		auditMsg.SetStreamID(auditStreamID)
+
+		auditRouter := StreamRegistry.GetRouterOrFallback(auditStreamID)
+		if err := auditRouter.Enqueue(auditMsg); err != nil {
+			logrus.WithError(err).Error("Failed to send message to filter audit stream")
+		}
+	}
+}
+
+// DeactivateFilterAudit sets the FilterAudit function to default
+// This method is necessary for unit testing
+func DeactivateFilterAudit() {
+	FilterAudit = func(msg *Message, reason string) {}
+}
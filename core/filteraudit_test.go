@@ -0,0 +1,71 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+type mockRejectFilter struct {
+	SimpleFilter
+}
+
+func (filter *mockRejectFilter) ApplyFilter(msg *Message) (FilterResult, error) {
+	return FilterResultMessageReject(InvalidStreamID), nil
+}
+
+func TestFilterReason(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	filters := FilterArray{&mockFilter{}, &mockRejectFilter{}}
+	msg := NewMessage(nil, []byte("test"), nil, InvalidStreamID)
+
+	result, reason, err := ApplyFilterWithReason(filters, msg)
+	expect.NoError(err)
+	expect.Neq(FilterResultMessageAccept, result)
+	expect.Equal("core.mockRejectFilter", reason)
+
+	result, reason, _ = ApplyFilterWithReason(&mockFilter{}, msg)
+	expect.Equal(FilterResultMessageAccept, result)
+	expect.Equal("", reason)
+}
+
+func TestFilterAudit(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	auditRouter := getMockRouterMessageHelper("filterAudit")
+	StreamRegistry.Register(&auditRouter, auditRouter.streamID)
+
+	ActivateFilterAudit("filterAudit")
+	defer DeactivateFilterAudit()
+
+	streamID := StreamRegistry.GetStreamID("filterAuditSource")
+	msg := NewMessage(nil, []byte("test"), Metadata{"key": []byte("value")}, streamID)
+	modulator := NewFilterModulator(FilterArray{&mockRejectFilter{}})
+
+	expect.Equal(ModulateResultDiscard, modulator.Modulate(msg))
+	expect.True(auditRouter.messageEnqued)
+	expect.Equal("test", auditRouter.lastMessageData)
+
+	_, exists := msg.GetMetadata().TryGetValue(FilterAuditReasonKey)
+	expect.False(exists)
+
+	counter := NewCounter("stream_messages_filtered", MetricLabels{
+		"stream": "filterAuditSource",
+		"filter": "core.mockRejectFilter",
+	})
+	expect.Equal(int64(1), counter.Get())
+}
@@ -31,8 +31,10 @@ func NewFilterModulator(filter Filter) *FilterModulator {
 }
 
 // Modulate implementation for Filters
+// Rejected messages are counted per stream and filter and passed to
+// FilterAudit.
 func (filterModulator *FilterModulator) Modulate(msg *Message) ModulateResult {
-	result, err := filterModulator.ApplyFilter(msg)
+	result, reason, err := ApplyFilterWithReason(filterModulator.Filter, msg)
 	if err != nil {
 		logrus.Warning("FilterModulator with error:", err)
 	}
@@ -41,6 +43,9 @@ func (filterModulator *FilterModulator) Modulate(msg *Message) ModulateResult {
 		return ModulateResultContinue
 	}
 
+	CountMessageFiltered(msg.GetStreamID(), reason)
+	FilterAudit(msg, reason)
+
 	newStreamID := result.GetStreamID()
 	if newStreamID == InvalidStreamID {
 		return ModulateResultDiscard
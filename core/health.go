@@ -0,0 +1,305 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/tgo/thealthcheck"
+)
+
+const (
+	// HealthStatusOK is reported if all checked plugins are healthy
+	HealthStatusOK = "ok"
+	// HealthStatusStarting is reported by the readiness check before all
+	// plugins have been started
+	HealthStatusStarting = "starting"
+	// HealthStatusUnavailable is reported if at least one checked plugin is
+	// not healthy
+	HealthStatusUnavailable = "unavailable"
+)
+
+// PluginWithBacklog is an optional interface for producers that can report
+// the number of messages waiting to be sent.
+type PluginWithBacklog interface {
+	// GetBacklog returns the number of messages waiting to be sent
+	GetBacklog() int
+}
+
+// HealthReport holds the overall status of gollum and the health of all
+// plugins that have a state.
+type HealthReport struct {
+	Status  string         `json:"status"`
+	Plugins []PluginHealth `json:"plugins"`
+}
+
+// PluginHealth holds the health of a single plugin.
+// Connected is only set for consumers, Backlog only for producers implementing
+// PluginWithBacklog and SecondsSinceLastFlush only for producers that flushed
+// successfully at least once.
+type PluginHealth struct {
+	ID                    string   `json:"id"`
+	Type                  string   `json:"type"`
+	Kind                  string   `json:"kind"`
+	State                 string   `json:"state"`
+	Healthy               bool     `json:"healthy"`
+	Connected             *bool    `json:"connected,omitempty"`
+	Backlog               *int     `json:"backlog,omitempty"`
+	LastError             string   `json:"last_error,omitempty"`
+	SecondsSinceLastError *float64 `json:"seconds_since_last_error,omitempty"`
+	SecondsSinceLastFlush *float64 `json:"seconds_since_last_flush,omitempty"`
+}
+
+type pluginHealthEvent struct {
+	message string
+	time    time.Time
+}
+
+type healthRegistry struct {
+	lastErrors  map[string]pluginHealthEvent
+	lastFlushes map[string]time.Time
+	guard       *sync.RWMutex
+	ready       *int32
+	now         func() time.Time
+}
+
+// HealthRegistry tracks errors and flushes of all plugins and creates the
+// health reports for the "/healthz" and "/readyz" endpoints.
+// Errors logged by a plugin's logger are tracked if HealthRegistry has been
+// added as logrus hook.
+var HealthRegistry = healthRegistry{
+	lastErrors:  make(map[string]pluginHealthEvent),
+	lastFlushes: make(map[string]time.Time),
+	guard:       new(sync.RWMutex),
+	ready:       new(int32),
+	now:         time.Now,
+}
+
+var healthChecks = struct {
+	callbacks map[string]thealthcheck.CallbackFunc
+	guard     *sync.RWMutex
+}{
+	callbacks: make(map[string]thealthcheck.CallbackFunc),
+	guard:     new(sync.RWMutex),
+}
+
+// AddHealthCheckEndpoint registers a health check callback for the given
+// path. Adding a path again replaces the callback, e.g. when a plugin is
+// recreated by a config reload.
+func AddHealthCheckEndpoint(path string, callback thealthcheck.CallbackFunc) {
+	healthChecks.guard.Lock()
+	_, exists := healthChecks.callbacks[path]
+	healthChecks.callbacks[path] = callback
+	healthChecks.guard.Unlock()
+
+	if !exists {
+		thealthcheck.AddEndpoint(path, func() (code int, body string) {
+			healthChecks.guard.RLock()
+			current := healthChecks.callbacks[path]
+			healthChecks.guard.RUnlock()
+			return current()
+		})
+	}
+}
+
+// pluginStateHealthCheck returns a health check callback reporting the state
+// of the plugin registered for the given ID. If no plugin is registered for
+// this ID the given plugin is used.
+func pluginStateHealthCheck(ID string, plugin PluginWithState) thealthcheck.CallbackFunc {
+	return func() (code int, body string) {
+		current := plugin
+		if registered := PluginRegistry.GetPluginWithState(ID); registered != nil {
+			current = registered
+		}
+
+		state := current.GetState()
+		if state <= PluginStatePrepareStop {
+			return thealthcheck.StatusOK, fmt.Sprintf("ACTIVE: %s", stateToDescription[state])
+		}
+		return thealthcheck.StatusServiceUnavailable,
+			fmt.Sprintf("NOT_ACTIVE: %s", stateToDescription[state])
+	}
+}
+
+// SetReady marks gollum as ready after all plugins have been started or as
+// not ready when shutting down.
+func (registry *healthRegistry) SetReady(ready bool) {
+	if ready {
+		atomic.StoreInt32(registry.ready, 1)
+	} else {
+		atomic.StoreInt32(registry.ready, 0)
+	}
+}
+
+// IsReady returns true if all plugins have been started and gollum is not
+// shutting down.
+func (registry *healthRegistry) IsReady() bool {
+	return atomic.LoadInt32(registry.ready) == 1
+}
+
+// SetError stores the last error of the given plugin.
+func (registry *healthRegistry) SetError(pluginID string, message string) {
+	registry.guard.Lock()
+	registry.lastErrors[pluginID] = pluginHealthEvent{message, registry.now()}
+	registry.guard.Unlock()
+}
+
+// SetFlushed stores the time of the last successful flush of the given
+// plugin. A flush started at start is successful if the plugin did not
+// report an error since start.
+func (registry *healthRegistry) SetFlushed(pluginID string, start time.Time) {
+	registry.guard.Lock()
+	defer registry.guard.Unlock()
+
+	if lastError, hasError := registry.lastErrors[pluginID]; hasError && !lastError.time.Before(start) {
+		return // ### return, flush failed ###
+	}
+	registry.lastFlushes[pluginID] = registry.now()
+}
+
+// Levels returns the logrus levels tracked as plugin errors.
+func (registry *healthRegistry) Levels() []logrus.Level {
+	return []logrus.Level{logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel}
+}
+
+// Fire stores the message of a log entry as last error of the plugin that
+// logged it.
+func (registry *healthRegistry) Fire(entry *logrus.Entry) error {
+	pluginID, isPlugin := entry.Data["PluginID"].(string)
+	if !isPlugin || pluginID == "" {
+		return nil // ### return, not logged by a plugin ###
+	}
+
+	message := entry.Message
+	if err, hasError := entry.Data[logrus.ErrorKey]; hasError {
+		message = fmt.Sprintf("%s: %v", message, err)
+	}
+	registry.SetError(pluginID, message)
+	return nil
+}
+
+// GetReport returns the health of all plugins that have a state. If
+// readiness is true, plugins are only healthy if they are active and the
+// report is only ok if gollum is ready. Otherwise plugins are healthy unless
+// they died while gollum was running.
+func (registry *healthRegistry) GetReport(readiness bool) HealthReport {
+	ready := registry.IsReady()
+	report := HealthReport{
+		Status:  HealthStatusOK,
+		Plugins: []PluginHealth{},
+	}
+
+	if readiness && !ready {
+		report.Status = HealthStatusStarting
+	}
+
+	for _, ID := range PluginRegistry.GetPluginIDs() {
+		plugin := PluginRegistry.GetPluginWithState(ID)
+		if plugin == nil {
+			continue
+		}
+
+		health := registry.getPluginHealth(ID, plugin)
+		if readiness {
+			health.Healthy = plugin.GetState() == PluginStateActive
+		} else {
+			health.Healthy = !ready || plugin.GetState() != PluginStateDead
+		}
+
+		if !health.Healthy && report.Status == HealthStatusOK {
+			report.Status = HealthStatusUnavailable
+		}
+		report.Plugins = append(report.Plugins, health)
+	}
+	return report
+}
+
+func (registry *healthRegistry) getPluginHealth(ID string, plugin PluginWithState) PluginHealth {
+	now := registry.now()
+	state := plugin.GetState()
+	health := PluginHealth{
+		ID:    ID,
+		Type:  strings.TrimPrefix(fmt.Sprintf("%T", plugin), "*"),
+		Kind:  "plugin",
+		State: stateToDescription[state],
+	}
+
+	switch plugin.(type) {
+	case Consumer:
+		connected := state == PluginStateActive
+		health.Kind = "consumer"
+		health.Connected = &connected
+	case Producer:
+		health.Kind = "producer"
+	}
+
+	if withBacklog, hasBacklog := plugin.(PluginWithBacklog); hasBacklog {
+		backlog := withBacklog.GetBacklog()
+		health.Backlog = &backlog
+	}
+
+	registry.guard.RLock()
+	lastError, hasError := registry.lastErrors[ID]
+	lastFlush, hasFlushed := registry.lastFlushes[ID]
+	registry.guard.RUnlock()
+
+	if hasError {
+		seconds := now.Sub(lastError.time).Seconds()
+		health.LastError = lastError.message
+		health.SecondsSinceLastError = &seconds
+	}
+	if hasFlushed {
+		seconds := now.Sub(lastFlush).Seconds()
+		health.SecondsSinceLastFlush = &seconds
+	}
+	return health
+}
+
+// LivenessCheck is a health check callback returning the liveness report as
+// JSON. The check fails if a plugin died while gollum was running.
+func (registry *healthRegistry) LivenessCheck() (code int, body string) {
+	return registry.check(false)
+}
+
+// ReadinessCheck is a health check callback returning the readiness report as
+// JSON. The check fails until all plugins have been started and are active.
+func (registry *healthRegistry) ReadinessCheck() (code int, body string) {
+	return registry.check(true)
+}
+
+func (registry *healthRegistry) check(readiness bool) (code int, body string) {
+	report := registry.GetReport(readiness)
+	code = http.StatusOK
+	if report.Status != HealthStatusOK {
+		code = http.StatusServiceUnavailable
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+
+	// The health check server uses the body as format string, so "%" has to
+	// be escaped. The JSON escape sequence keeps the body valid JSON as "%"
+	// only appears inside strings.
+	return code, strings.Replace(string(data), "%", `\u0025`, -1)
+}
@@ -0,0 +1,115 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func getPluginHealth(report HealthReport, ID string) (PluginHealth, bool) {
+	for _, health := range report.Plugins {
+		if health.ID == ID {
+			return health, true
+		}
+	}
+	return PluginHealth{}, false
+}
+
+func TestHealthRegistryReport(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	defer HealthRegistry.SetReady(false)
+
+	consumer := getMockConsumer()
+	consumer.runState.SetState(PluginStateWaiting)
+	producer := getMockBufferedProducer()
+	producer.runState.SetState(PluginStateActive)
+	expect.True(PluginRegistry.RegisterUnique(&consumer, "healthConsumer"))
+	expect.True(PluginRegistry.RegisterUnique(&producer, "healthProducer"))
+
+	producer.messages.Push(getMockMessage("test"), 0)
+
+	// Readiness fails before gollum has been started
+	report := HealthRegistry.GetReport(true)
+	expect.Equal(HealthStatusStarting, report.Status)
+
+	HealthRegistry.SetReady(true)
+	report = HealthRegistry.GetReport(true)
+	expect.Equal(HealthStatusUnavailable, report.Status)
+
+	consumerHealth, found := getPluginHealth(report, "healthConsumer")
+	expect.True(found)
+	expect.Equal("consumer", consumerHealth.Kind)
+	expect.Equal("Waiting", consumerHealth.State)
+	expect.False(consumerHealth.Healthy)
+	expect.NotNil(consumerHealth.Connected)
+	expect.False(*consumerHealth.Connected)
+
+	producerHealth, found := getPluginHealth(report, "healthProducer")
+	expect.True(found)
+	expect.Equal("producer", producerHealth.Kind)
+	expect.True(producerHealth.Healthy)
+	expect.NotNil(producerHealth.Backlog)
+	expect.Equal(1, *producerHealth.Backlog)
+
+	// Waiting plugins are still alive
+	report = HealthRegistry.GetReport(false)
+	consumerHealth, _ = getPluginHealth(report, "healthConsumer")
+	expect.True(consumerHealth.Healthy)
+
+	consumer.runState.SetState(PluginStateDead)
+	report = HealthRegistry.GetReport(false)
+	expect.Equal(HealthStatusUnavailable, report.Status)
+	consumerHealth, _ = getPluginHealth(report, "healthConsumer")
+	expect.False(consumerHealth.Healthy)
+}
+
+func TestHealthRegistryErrorsAndFlushes(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	producer := getMockBatchedProducer()
+	producer.Batch = NewMessageBatch(10)
+	producer.runState.SetState(PluginStateActive)
+	expect.True(PluginRegistry.RegisterUnique(&producer, "healthBatchedProducer"))
+
+	start := time.Now()
+	HealthRegistry.SetFlushed("healthBatchedProducer", start)
+
+	entry := logrus.WithField("PluginID", "healthBatchedProducer").WithError(errors.New("100% broken"))
+	entry.Message = "Flush failed"
+	expect.NoError(HealthRegistry.Fire(entry))
+
+	// Flushes started before the last error are not successful
+	HealthRegistry.SetFlushed("healthBatchedProducer", start)
+
+	code, body := HealthRegistry.LivenessCheck()
+	expect.Equal(http.StatusOK, code)
+
+	report := HealthReport{}
+	expect.NoError(json.Unmarshal([]byte(body), &report))
+
+	health, found := getPluginHealth(report, "healthBatchedProducer")
+	expect.True(found)
+	expect.Equal("Flush failed: 100% broken", health.LastError)
+	expect.NotNil(health.SecondsSinceLastError)
+	expect.NotNil(health.SecondsSinceLastFlush)
+	expect.Leq(*health.SecondsSinceLastError, *health.SecondsSinceLastFlush)
+}
@@ -37,6 +37,9 @@ type Message struct {
 	origStreamID MessageStreamID
 	source       MessageSource
 	timestamp    time.Time
+	ack          *messageAck
+	fallback     bool
+	ackDeferred  bool
 }
 
 // NewMessage creates a new message from a given data stream by copying data.
@@ -68,6 +71,12 @@ func (msg *Message) GetCreationTime() time.Time {
 	return msg.timestamp
 }
 
+// SetCreationTime overrides the time when this message was created, e.g. with
+// the time of the event it describes.
+func (msg *Message) SetCreationTime(timestamp time.Time) {
+	msg.timestamp = timestamp
+}
+
 // GetStreamID returns the stream this message is currently routed to.
 func (msg *Message) GetStreamID() MessageStreamID {
 	return msg.streamID
@@ -183,6 +192,9 @@ func (msg *Message) ExtendPayload(size int) []byte {
 // The created timestamp is copied, too.
 func (msg *Message) Clone() *Message {
 	clone := *msg
+	clone.fallback = false
+	clone.ackDeferred = false
+	clone.ack.addShare()
 
 	clone.data.payload = make([]byte, len(msg.data.payload))
 	copy(clone.data.payload, msg.data.payload)
@@ -199,6 +211,9 @@ func (msg *Message) CloneOriginal() *Message {
 	}
 
 	clone := *msg
+	clone.fallback = false
+	clone.ackDeferred = false
+	clone.ack.addShare()
 	clone.data.payload = make([]byte, len(msg.orig.payload))
 	copy(clone.data.payload, msg.orig.payload)
 
@@ -237,3 +237,13 @@ func TestMessageSerialize(t *testing.T) {
 	expect.Equal(readMessage.orig.payload, testMessage.orig.payload)
 	expect.Equal(readMessage.orig.metadata, testMessage.orig.metadata)
 }
+
+func TestMessageSetCreationTime(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	msg := NewMessage(nil, []byte("test"), nil, InvalidStreamID)
+	timestamp := time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+	msg.SetCreationTime(timestamp)
+	expect.Equal(timestamp, msg.GetCreationTime())
+	expect.Equal(timestamp, msg.Clone().GetCreationTime())
+}
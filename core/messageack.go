@@ -0,0 +1,164 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// MessageAckCallback is called once a message has been accepted by a
+// producer (acked is true) or is known to be lost (acked is false).
+type MessageAckCallback func(acked bool)
+
+// messageAck is shared between a message and all of its clones so that the
+// callback is called only once. Each message and clone holds a share that is
+// released when it is acknowledged, rejected or sent to a fallback.
+// If all is set, the message is only accepted after all shares have been
+// released.
+type messageAck struct {
+	once     sync.Once
+	callback MessageAckCallback
+	shares   int32
+	all      int32
+}
+
+// SetAckCallback registers a callback that is notified as soon as this
+// message or one of its clones has been accepted by a producer. Messages are
+// accepted when a producer processed them without sending them to its
+// fallback, or when a modulator discarded them on purpose. Messages sent to a
+// fallback are accepted by the producer of the fallback stream.
+// If the message is routed to a stream with at-least-once delivery, see
+// SimpleRouter, the message has to be accepted by all producers it is passed
+// to instead.
+// Only the first notification is passed to callback. If a message is lost
+// without being noticed, e.g. because no producer listens to the stream, the
+// callback is never called.
+func (msg *Message) SetAckCallback(callback MessageAckCallback) {
+	msg.ack = &messageAck{callback: callback, shares: 1}
+}
+
+// HasAckCallback returns true if SetAckCallback has been called for this
+// message or the message it was cloned from.
+func (msg *Message) HasAckCallback() bool {
+	return msg.ack != nil
+}
+
+// DetachAckCallback removes the callback registered by SetAckCallback from
+// this message only. Use this for copies of a message that must not affect
+// the acknowledgement of the original message.
+func (msg *Message) DetachAckCallback() {
+	msg.ack.release()
+	msg.ack = nil
+}
+
+// RequireAllAcks changes the acknowledgement of this message and all of its
+// clones so that the message is only accepted after all producers it has
+// been passed to accepted it. Rejecting a single clone rejects the message.
+func (msg *Message) RequireAllAcks() {
+	if msg.ack != nil {
+		atomic.StoreInt32(&msg.ack.all, 1)
+	}
+}
+
+// RequiresAllAcks returns true if RequireAllAcks has been called for this
+// message or one of its clones.
+func (msg *Message) RequiresAllAcks() bool {
+	return msg.ack != nil && atomic.LoadInt32(&msg.ack.all) == 1
+}
+
+// DeferAcknowledge prevents producers from acknowledging the message after
+// it has been processed. Producers that buffer messages before writing them
+// call this so that the message is acknowledged once it has been written,
+// e.g. by using AcknowledgeAssembly.
+func (msg *Message) DeferAcknowledge() {
+	msg.ackDeferred = true
+}
+
+// Acknowledge notifies the callback registered by SetAckCallback that this
+// message has been accepted.
+func (msg *Message) Acknowledge() {
+	msg.notifyAck(true)
+}
+
+// Reject notifies the callback registered by SetAckCallback that this message
+// has been lost.
+func (msg *Message) Reject() {
+	msg.notifyAck(false)
+}
+
+// acknowledgeDelivered acknowledges a message after a producer processed it,
+// unless the producer sent the message to its fallback or deferred the
+// acknowledgement.
+func (msg *Message) acknowledgeDelivered() {
+	if !msg.fallback && !msg.ackDeferred {
+		msg.notifyAck(true)
+	}
+}
+
+func (msg *Message) notifyAck(acked bool) {
+	switch {
+	case msg.ack == nil:
+		return // ### return, no callback ###
+	case acked && msg.RequiresAllAcks():
+		msg.ack.release()
+	default:
+		atomic.AddInt32(&msg.ack.shares, -1)
+		msg.ack.notify(acked)
+	}
+}
+
+// addShare is called when a message is cloned.
+func (ack *messageAck) addShare() {
+	if ack != nil {
+		atomic.AddInt32(&ack.shares, 1)
+	}
+}
+
+// release releases a share without acknowledging it. If all shares have to be
+// acknowledged and this has been the last share, the message is accepted.
+func (ack *messageAck) release() {
+	if ack != nil && atomic.AddInt32(&ack.shares, -1) <= 0 && atomic.LoadInt32(&ack.all) == 1 {
+		ack.notify(true)
+	}
+}
+
+func (ack *messageAck) notify(acked bool) {
+	ack.once.Do(func() {
+		ack.callback(acked)
+	})
+}
+
+// AcknowledgeAssembly wraps an AssemblyFunc so that all messages of a batch
+// are acknowledged after the batch has been processed. Messages sent to a
+// fallback are not acknowledged.
+func AcknowledgeAssembly(assemble AssemblyFunc) AssemblyFunc {
+	return func(messages []*Message) {
+		assemble(messages)
+		for _, msg := range messages {
+			if !msg.fallback {
+				msg.notifyAck(true)
+			}
+		}
+	}
+}
+
+// ackMessageHandler wraps a message handler so that messages are acknowledged
+// after they have been processed.
+func ackMessageHandler(handleMessage func(*Message)) func(*Message) {
+	return func(msg *Message) {
+		handleMessage(msg)
+		msg.acknowledgeDelivered()
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package core
+
+import (
+	"testing"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestMessageAckOnce(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	msg := getMockMessage("test")
+
+	calls := 0
+	result := false
+	msg.SetAckCallback(func(acked bool) {
+		calls++
+		result = acked
+	})
+	expect.True(msg.HasAckCallback())
+
+	clone := msg.Clone()
+	clone.Acknowledge()
+	msg.Reject()
+
+	expect.Equal(1, calls)
+	expect.True(result)
+}
+
+func TestMessageAckFallback(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	msg := getMockMessage("test")
+
+	calls := 0
+	msg.SetAckCallback(func(acked bool) {
+		calls++
+	})
+
+	msg.fallback = true
+	msg.acknowledgeDelivered()
+	expect.Equal(0, calls)
+
+	clone := msg.CloneOriginal()
+	expect.False(clone.fallback)
+	clone.acknowledgeDelivered()
+	expect.Equal(1, calls)
+}
+
+func TestMessageAckAssembly(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	messages := []*Message{getMockMessage("a"), getMockMessage("b")}
+
+	acked := 0
+	for _, msg := range messages {
+		msg.SetAckCallback(func(bool) { acked++ })
+	}
+
+	assembled := 0
+	AcknowledgeAssembly(func(batch []*Message) {
+		assembled = len(batch)
+		expect.Equal(0, acked)
+	})(messages)
+
+	expect.Equal(2, assembled)
+	expect.Equal(2, acked)
+}
+
+func TestMessageWithoutAck(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	msg := getMockMessage("test")
+
+	expect.False(msg.HasAckCallback())
+	msg.Acknowledge()
+	msg.Reject()
+}
+
+func TestMessageAckDetach(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	msg := getMockMessage("test")
+
+	calls := 0
+	msg.SetAckCallback(func(acked bool) {
+		calls++
+	})
+
+	clone := msg.Clone()
+	clone.DetachAckCallback()
+	expect.False(clone.HasAckCallback())
+	expect.True(msg.HasAckCallback())
+
+	clone.Reject()
+	expect.Equal(0, calls)
+}
+
+func TestMessageAckAll(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	msg := getMockMessage("test")
+
+	calls := 0
+	result := false
+	msg.SetAckCallback(func(acked bool) {
+		calls++
+		result = acked
+	})
+	msg.RequireAllAcks()
+
+	clone := msg.Clone()
+	expect.True(clone.RequiresAllAcks())
+
+	msg.Acknowledge()
+	expect.Equal(0, calls)
+	clone.Acknowledge()
+	expect.Equal(1, calls)
+	expect.True(result)
+
+	// Rejecting a single clone rejects the message
+	msg = getMockMessage("test")
+	msg.SetAckCallback(func(acked bool) {
+		calls++
+		result = acked
+	})
+	msg.RequireAllAcks()
+
+	msg.Clone().Reject()
+	msg.Acknowledge()
+	expect.Equal(2, calls)
+	expect.False(result)
+}
+
+func TestMessageAckAllFallback(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	msg := getMockMessage("test")
+
+	calls := 0
+	msg.SetAckCallback(func(acked bool) {
+		calls++
+	})
+	msg.RequireAllAcks()
+
+	// Like SimpleProducer.TryFallback
+	fallback := msg.CloneOriginal()
+	msg.fallback = true
+	msg.ack.release()
+	msg.acknowledgeDelivered()
+	expect.Equal(0, calls)
+
+	// Detached clones are not waited for
+	msg.Clone().DetachAckCallback()
+	expect.Equal(0, calls)
+
+	fallback.acknowledgeDelivered()
+	expect.Equal(1, calls)
+}
+
+func TestMessageAckDeferred(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	msg := getMockMessage("test")
+
+	calls := 0
+	msg.SetAckCallback(func(acked bool) {
+		calls++
+	})
+
+	msg.DeferAcknowledge()
+	expect.False(msg.Clone().ackDeferred)
+
+	msg.acknowledgeDelivered()
+	expect.Equal(0, calls)
+
+	AcknowledgeAssembly(func([]*Message) {})([]*Message{msg})
+	expect.Equal(1, calls)
+}
+
+func TestRouteAtLeastOnce(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	router := getMockRouter()
+	msg := getMockMessage("test")
+	msg.SetAckCallback(func(bool) {})
+
+	expect.NoError(Route(msg, &router))
+	expect.False(msg.RequiresAllAcks())
+
+	router.atLeastOnce = true
+	expect.NoError(Route(msg, &router))
+	expect.True(msg.RequiresAllAcks())
+}
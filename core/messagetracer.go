@@ -85,7 +85,7 @@ func DeactivateMessageTrace() {
 
 // Dump creates a messageDump struct for the message trace
 func (mt *messageTracer) Dump(comment string) {
-	if mt.msg.streamID == LogInternalStreamID || mt.msg.streamID == TraceInternalStreamID {
+	if mt.msg.streamID == LogInternalStreamID || mt.msg.streamID == TraceInternalStreamID || mt.msg.streamID == MetricsInternalStreamID {
 		return
 	}
 
@@ -0,0 +1,497 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trivago/tgo"
+)
+
+// metricRateSamples is the number of seconds counter rates are averaged over
+const metricRateSamples = 10
+
+// MetricLabels maps label names to label values of a metric.
+type MetricLabels map[string]string
+
+// DefaultLatencyBuckets are histogram buckets in seconds suitable for flush,
+// upload or roundtrip durations.
+var DefaultLatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// MetricType describes how the values of a metric behave.
+type MetricType int
+
+const (
+	// MetricTypeCounter is used for values that only increase
+	MetricTypeCounter = MetricType(iota)
+	// MetricTypeGauge is used for values that may increase and decrease
+	MetricTypeGauge = MetricType(iota)
+	// MetricTypeRate is used for per second rates of counters
+	MetricTypeRate = MetricType(iota)
+	// MetricTypeHistogram is used for value distributions
+	MetricTypeHistogram = MetricType(iota)
+)
+
+// Metric holds the name and labels of a typed metric.
+// Typed metrics are not part of the JSON metric dump unless they have been
+// created with a legacy key. In that case the value is stored in the global
+// tgo.Metric store under this key, so the JSON metric dump keeps the names
+// used before typed metrics had been introduced.
+type Metric struct {
+	name       string
+	labels     MetricLabels
+	key        string
+	legacyKey  string
+	metricType MetricType
+	value      *int64
+}
+
+// Counter is a metric that can only be increased.
+// Each counter has a rate metric named "<name>_per_second" with the same
+// labels holding the number of counted values per second, averaged over the
+// last metricRateSamples seconds.
+type Counter struct {
+	Metric
+	rate      *Rate
+	samples   []int64
+	rateGuard *sync.Mutex
+}
+
+// Gauge is a metric that can be set to any value.
+type Gauge struct {
+	Metric
+}
+
+// Rate is a metric holding the per second rate of a counter.
+type Rate struct {
+	Metric
+}
+
+// Histogram is a metric counting observed values in buckets.
+// Histograms are not part of the JSON metric dump.
+type Histogram struct {
+	Metric
+	buckets []float64
+	counts  []uint64
+	count   *uint64
+	sumBits *uint64
+}
+
+// HistogramSnapshot holds the values of a histogram at a given time.
+// Counts are cumulative, i.e. Counts[i] is the number of observed values
+// less or equal to Buckets[i].
+type HistogramSnapshot struct {
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64
+}
+
+type metricRegistry struct {
+	metrics     map[string]interface{}
+	legacyKeys  map[string]bool
+	guard       *sync.RWMutex
+	rateUpdates *sync.Once
+}
+
+// MetricRegistry holds all typed metrics by their key
+var MetricRegistry = metricRegistry{
+	metrics:     make(map[string]interface{}),
+	legacyKeys:  make(map[string]bool),
+	guard:       new(sync.RWMutex),
+	rateUpdates: new(sync.Once),
+}
+
+// NewCounter returns the counter with the given name and labels. The counter
+// and its rate are created if they do not exist.
+func NewCounter(name string, labels MetricLabels) *Counter {
+	return NewLegacyCounter(name, labels, "", "")
+}
+
+// NewLegacyCounter returns the counter with the given name and labels like
+// NewCounter. If the counter is created by this call, its value and the value
+// of its rate are part of the JSON metric dump under the given legacy keys.
+// Empty keys are not part of the JSON metric dump.
+func NewLegacyCounter(name string, labels MetricLabels, legacyKey string, legacyRateKey string) *Counter {
+	metric := MetricRegistry.getOrCreate(newMetric(name, labels, MetricTypeCounter, legacyKey), func(metric Metric) interface{} {
+		return &Counter{
+			Metric:    metric,
+			samples:   make([]int64, 0, metricRateSamples+1),
+			rateGuard: new(sync.Mutex),
+		}
+	})
+
+	counter := metric.(*Counter)
+	counter.rateGuard.Lock()
+	if counter.rate == nil {
+		counter.rate = newRate(name+"_per_second", counter.labels, legacyRateKey)
+	}
+	counter.rateGuard.Unlock()
+
+	MetricRegistry.rateUpdates.Do(func() {
+		go func() {
+			for range time.Tick(time.Second) {
+				MetricRegistry.UpdateRates()
+			}
+		}()
+	})
+	return counter
+}
+
+func newRate(name string, labels MetricLabels, legacyKey string) *Rate {
+	metric := MetricRegistry.getOrCreate(newMetric(name, labels, MetricTypeRate, legacyKey), func(metric Metric) interface{} {
+		return &Rate{metric}
+	})
+	return metric.(*Rate)
+}
+
+// NewGauge returns the gauge with the given name and labels. The gauge is
+// created if it does not exist.
+func NewGauge(name string, labels MetricLabels) *Gauge {
+	return NewLegacyGauge(name, labels, "")
+}
+
+// NewLegacyGauge returns the gauge with the given name and labels like
+// NewGauge. If the gauge is created by this call, its value is part of the
+// JSON metric dump under the given legacy key.
+func NewLegacyGauge(name string, labels MetricLabels, legacyKey string) *Gauge {
+	metric := MetricRegistry.getOrCreate(newMetric(name, labels, MetricTypeGauge, legacyKey), func(metric Metric) interface{} {
+		return &Gauge{metric}
+	})
+	return metric.(*Gauge)
+}
+
+// NewHistogram returns the histogram with the given name and labels. The
+// histogram is created with the given, ascending upper bounds of its buckets
+// if it does not exist. If buckets is nil DefaultLatencyBuckets is used.
+func NewHistogram(name string, labels MetricLabels, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	metric := MetricRegistry.getOrCreate(newMetric(name, labels, MetricTypeHistogram, ""), func(metric Metric) interface{} {
+		return &Histogram{
+			Metric:  metric,
+			buckets: buckets,
+			counts:  make([]uint64, len(buckets)),
+			count:   new(uint64),
+			sumBits: new(uint64),
+		}
+	})
+	return metric.(*Histogram)
+}
+
+func newMetric(name string, labels MetricLabels, metricType MetricType, legacyKey string) Metric {
+	if labels == nil {
+		labels = MetricLabels{}
+	}
+	return Metric{
+		name:       name,
+		labels:     labels,
+		key:        getMetricKey(name, labels),
+		legacyKey:  legacyKey,
+		metricType: metricType,
+		value:      new(int64),
+	}
+}
+
+// getMetricKey returns name{label=value,...} with labels sorted by name.
+func getMetricKey(name string, labels MetricLabels) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, label := range names {
+		pairs[i] = label + "=" + labels[label]
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// GetName returns the name of the metric.
+func (metric Metric) GetName() string {
+	return metric.name
+}
+
+// GetLabels returns the labels of the metric.
+func (metric Metric) GetLabels() MetricLabels {
+	return metric.labels
+}
+
+// GetKey returns the name and labels of the metric as a single string.
+func (metric Metric) GetKey() string {
+	return metric.key
+}
+
+// GetLegacyKey returns the key of the metric in the JSON metric dump. The key
+// is empty if the metric is not part of the JSON metric dump.
+func (metric Metric) GetLegacyKey() string {
+	return metric.legacyKey
+}
+
+// GetType returns the type of the metric.
+func (metric Metric) GetType() MetricType {
+	return metric.metricType
+}
+
+func (metric Metric) add(value int64) {
+	if metric.legacyKey != "" {
+		tgo.Metric.Add(metric.legacyKey, value)
+	} else {
+		atomic.AddInt64(metric.value, value)
+	}
+}
+
+func (metric Metric) set(value int64) {
+	if metric.legacyKey != "" {
+		tgo.Metric.Set(metric.legacyKey, value)
+	} else {
+		atomic.StoreInt64(metric.value, value)
+	}
+}
+
+func (metric Metric) get() int64 {
+	if metric.legacyKey != "" {
+		value, _ := tgo.Metric.Get(metric.legacyKey)
+		return value
+	}
+	return atomic.LoadInt64(metric.value)
+}
+
+// Inc increases the counter by 1.
+func (counter *Counter) Inc() {
+	counter.add(1)
+}
+
+// Add increases the counter by the given value.
+func (counter *Counter) Add(value int64) {
+	counter.add(value)
+}
+
+// Get returns the current value of the counter.
+func (counter *Counter) Get() int64 {
+	return counter.get()
+}
+
+// GetRate returns the rate of the counter.
+func (counter *Counter) GetRate() *Rate {
+	return counter.rate
+}
+
+// updateRate samples the current value of the counter and updates its rate.
+// This function is expected to be called once per second.
+func (counter *Counter) updateRate() {
+	counter.rateGuard.Lock()
+	defer counter.rateGuard.Unlock()
+
+	counter.samples = append(counter.samples, counter.Get())
+	if len(counter.samples) > metricRateSamples+1 {
+		counter.samples = append(counter.samples[:0], counter.samples[1:]...)
+	}
+
+	numSamples := len(counter.samples)
+	if numSamples < 2 || counter.rate == nil {
+		return // ### return, not enough samples ###
+	}
+
+	delta := counter.samples[numSamples-1] - counter.samples[0]
+	counter.rate.set(delta / int64(numSamples-1))
+}
+
+// Set sets the gauge to the given value.
+func (gauge *Gauge) Set(value int64) {
+	gauge.set(value)
+}
+
+// SetF sets the gauge to the given value rounded to an integer.
+func (gauge *Gauge) SetF(value float64) {
+	gauge.set(int64(math.Floor(value + 0.5)))
+}
+
+// Inc increases the gauge by 1.
+func (gauge *Gauge) Inc() {
+	gauge.add(1)
+}
+
+// Dec decreases the gauge by 1.
+func (gauge *Gauge) Dec() {
+	gauge.add(-1)
+}
+
+// Add adds the given value to the gauge.
+func (gauge *Gauge) Add(value int64) {
+	gauge.add(value)
+}
+
+// Get returns the current value of the gauge.
+func (gauge *Gauge) Get() int64 {
+	return gauge.get()
+}
+
+// Get returns the current value of the rate.
+func (rate *Rate) Get() int64 {
+	return rate.get()
+}
+
+// Observe adds a value to the histogram.
+func (histogram *Histogram) Observe(value float64) {
+	if index := sort.SearchFloat64s(histogram.buckets, value); index < len(histogram.buckets) {
+		atomic.AddUint64(&histogram.counts[index], 1)
+	}
+	atomic.AddUint64(histogram.count, 1)
+
+	for {
+		oldBits := atomic.LoadUint64(histogram.sumBits)
+		newBits := math.Float64bits(math.Float64frombits(oldBits) + value)
+		if atomic.CompareAndSwapUint64(histogram.sumBits, oldBits, newBits) {
+			return
+		}
+	}
+}
+
+// ObserveDuration adds a duration in seconds to the histogram.
+func (histogram *Histogram) ObserveDuration(duration time.Duration) {
+	histogram.Observe(duration.Seconds())
+}
+
+// ObserveSince adds the time passed since start in seconds to the histogram.
+func (histogram *Histogram) ObserveSince(start time.Time) {
+	histogram.Observe(time.Since(start).Seconds())
+}
+
+// GetSnapshot returns the current values of the histogram.
+func (histogram *Histogram) GetSnapshot() HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		Buckets: histogram.buckets,
+		Counts:  make([]uint64, len(histogram.buckets)),
+		Count:   atomic.LoadUint64(histogram.count),
+		Sum:     math.Float64frombits(atomic.LoadUint64(histogram.sumBits)),
+	}
+
+	cumulative := uint64(0)
+	for i := range histogram.counts {
+		cumulative += atomic.LoadUint64(&histogram.counts[i])
+		snapshot.Counts[i] = cumulative
+	}
+	return snapshot
+}
+
+// getOrCreate returns the metric registered for the key of metric or calls
+// create and registers the result.
+func (registry *metricRegistry) getOrCreate(metric Metric, create func(Metric) interface{}) interface{} {
+	registry.guard.RLock()
+	existing, exists := registry.metrics[metric.key]
+	registry.guard.RUnlock()
+	if exists {
+		return existing
+	}
+
+	registry.guard.Lock()
+	defer registry.guard.Unlock()
+	if existing, exists := registry.metrics[metric.key]; exists {
+		return existing
+	}
+
+	if metric.legacyKey != "" {
+		tgo.Metric.New(metric.legacyKey)
+		registry.legacyKeys[metric.legacyKey] = true
+	}
+
+	created := create(metric)
+	registry.metrics[metric.key] = created
+	return created
+}
+
+// GetMetrics returns all registered metrics sorted by key. Elements are of
+// type *Counter, *Gauge, *Rate or *Histogram.
+func (registry *metricRegistry) GetMetrics() []interface{} {
+	registry.guard.RLock()
+	keys := make([]string, 0, len(registry.metrics))
+	for key := range registry.metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	metrics := make([]interface{}, len(keys))
+	for i, key := range keys {
+		metrics[i] = registry.metrics[key]
+	}
+	registry.guard.RUnlock()
+	return metrics
+}
+
+// UpdateRates updates the rates of all counters. This function is called
+// once per second after the first counter has been created.
+func (registry *metricRegistry) UpdateRates() {
+	for _, metric := range registry.GetMetrics() {
+		if counter, isCounter := metric.(*Counter); isCounter {
+			counter.updateRate()
+		}
+	}
+}
+
+// IsRegistered returns true if a typed metric with the given key or legacy
+// key exists.
+func (registry *metricRegistry) IsRegistered(key string) bool {
+	registry.guard.RLock()
+	_, exists := registry.metrics[key]
+	isLegacy := registry.legacyKeys[key]
+	registry.guard.RUnlock()
+	return exists || isLegacy
+}
+
+// Dump returns a JSON object holding the values of all typed metrics by
+// their key and all other metrics of the global tgo.Metric store by their
+// name. Histograms are not part of the dump.
+func (registry *metricRegistry) Dump() ([]byte, error) {
+	dump, err := tgo.Metric.Dump()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := make(map[string]int64)
+	if err := json.Unmarshal(dump, &snapshot); err != nil {
+		return nil, err
+	}
+
+	for key := range snapshot {
+		if registry.IsRegistered(key) {
+			delete(snapshot, key)
+		}
+	}
+
+	for _, metric := range registry.GetMetrics() {
+		switch typed := metric.(type) {
+		case *Counter:
+			snapshot[typed.key] = typed.Get()
+		case *Gauge:
+			snapshot[typed.key] = typed.Get()
+		case *Rate:
+			snapshot[typed.key] = typed.Get()
+		}
+	}
+	return json.Marshal(snapshot)
+}
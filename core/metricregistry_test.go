@@ -0,0 +1,142 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestMetricRegistryCounter(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	counter := NewCounter("registry_test", MetricLabels{"b": "2", "a": "1"})
+	expect.Equal("registry_test{a=1,b=2}", counter.GetKey())
+	expect.Equal(MetricTypeCounter, counter.GetType())
+
+	counter.Inc()
+	counter.Add(2)
+	expect.Equal(int64(3), counter.Get())
+
+	// Same name and labels return the same counter
+	sameCounter := NewCounter("registry_test", MetricLabels{"a": "1", "b": "2"})
+	expect.Equal(counter, sameCounter)
+	expect.Equal(int64(3), sameCounter.Get())
+
+	// Values are not part of the JSON metric store
+	_, err := tgo.Metric.Get("registry_test{a=1,b=2}")
+	expect.NotNil(err)
+	expect.True(MetricRegistry.IsRegistered(counter.GetKey()))
+}
+
+func TestMetricRegistryLegacyKeys(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	counter := NewLegacyCounter("registry_test_legacy", MetricLabels{"stream": "test"}, "Test:Legacy", "Test:LegacySec")
+	counter.Add(4)
+	expect.Equal("Test:Legacy", counter.GetLegacyKey())
+	expect.Equal("Test:LegacySec", counter.GetRate().GetLegacyKey())
+
+	value, err := tgo.Metric.Get("Test:Legacy")
+	expect.NoError(err)
+	expect.Equal(int64(4), value)
+	expect.True(MetricRegistry.IsRegistered("Test:Legacy"))
+
+	gauge := NewLegacyGauge("registry_test_legacy_gauge", nil, "Test:LegacyGauge")
+	gauge.Set(7)
+	value, err = tgo.Metric.Get("Test:LegacyGauge")
+	expect.NoError(err)
+	expect.Equal(int64(7), value)
+
+	// The JSON dump uses legacy keys only, Dump uses the labelled keys
+	legacyDump, err := tgo.Metric.Dump()
+	expect.NoError(err)
+	expect.Contains(string(legacyDump), `"Test:Legacy":4`)
+	expect.False(strings.Contains(string(legacyDump), "registry_test_legacy"))
+
+	dump, err := MetricRegistry.Dump()
+	expect.NoError(err)
+	expect.Contains(string(dump), `"registry_test_legacy{stream=test}":4`)
+	expect.False(strings.Contains(string(dump), "Test:Legacy"))
+}
+
+func TestMetricRegistryGauge(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	gauge := NewGauge("registry_test_gauge", nil)
+	expect.Equal("registry_test_gauge", gauge.GetKey())
+
+	gauge.Set(10)
+	gauge.Dec()
+	gauge.Add(-4)
+	expect.Equal(int64(5), gauge.Get())
+
+	gauge.SetF(1.6)
+	expect.Equal(int64(2), gauge.Get())
+}
+
+func TestMetricRegistryHistogram(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	histogram := NewHistogram("registry_test_seconds", MetricLabels{"plugin_id": "test"}, []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.1)
+	histogram.ObserveDuration(500 * time.Millisecond)
+	histogram.Observe(3)
+
+	snapshot := histogram.GetSnapshot()
+	expect.Equal([]float64{0.1, 1}, snapshot.Buckets)
+	expect.Equal([]uint64{2, 3}, snapshot.Counts)
+	expect.Equal(uint64(4), snapshot.Count)
+	expect.Equal(3.65, snapshot.Sum)
+}
+
+func TestMetricRegistryRate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	registered := NewCounter("registry_test_rate", MetricLabels{"a": "1"})
+	expect.Equal("registry_test_rate_per_second{a=1}", registered.GetRate().GetKey())
+	expect.Equal(MetricTypeRate, registered.GetRate().GetType())
+
+	// Use an unregistered counter so rates are not updated in the background
+	counter := &Counter{
+		Metric:    newMetric("registry_test_unregistered", nil, MetricTypeCounter, ""),
+		rate:      newRate("registry_test_unregistered_per_second", nil, ""),
+		rateGuard: new(sync.Mutex),
+	}
+	rate := counter.GetRate()
+
+	counter.updateRate()
+	expect.Equal(int64(0), rate.Get())
+
+	counter.Add(10)
+	counter.updateRate()
+	expect.Equal(int64(10), rate.Get())
+
+	counter.Add(30)
+	counter.updateRate()
+	expect.Equal(int64(20), rate.Get())
+
+	// Only the last metricRateSamples seconds are used
+	for i := 0; i < metricRateSamples; i++ {
+		counter.updateRate()
+	}
+	expect.Equal(int64(0), rate.Get())
+}
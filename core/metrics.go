@@ -18,9 +18,9 @@ import (
 	"fmt"
 	"github.com/trivago/tgo"
 	"sync"
-	"time"
 )
 
+// Keys used for core metrics in the JSON metric dump
 const (
 	metricRouters         = "Routers"
 	metricFallbackRouters = "Routers:Fallback"
@@ -29,14 +29,14 @@ const (
 	metricVersion         = "Version"
 )
 
-// MetricMessagesRoutedAvg is used as a key for storing message throughput
 const (
 	metricMessagesRouted       = "Messages:Routed"
-	MetricMessagesRoutedAvg    = "Messages:Routed:AvgPerSec"
+	metricMessagesRoutedAvg    = "Messages:Routed:AvgPerSec"
 	metricMessagesEnqued       = "Messages:Enqueued"
 	metricMessagesEnquedAvg    = "Messages:Enqueued:AvgPerSec"
 	metricMessagesDiscarded    = "Messages:Discarded"
 	metricMessagesDiscardedSec = "Messages:Discarded:AvgPerSec"
+	metricMessagesFiltered     = "Messages:Filtered"
 )
 
 const (
@@ -44,6 +44,7 @@ const (
 	metricStreamMessagesRoutedAvg    = "Stream:%s:Messages:Routed:AvgPerSec"
 	metricStreamMessagesDiscarded    = "Stream:%s:Messages:Discarded"
 	metricStreamMessagesDiscardedAvg = "Stream:%s:Messages:Discarded:AvgPerSec"
+	metricStreamMessagesFiltered     = "Stream:%s:Messages:Filtered:%s"
 )
 
 // MetricActiveWorkers metric string
@@ -63,67 +64,120 @@ const (
 	MetricPluginsDead        = "Plugins:State:Dead"
 )
 
+// Typed metrics of the core package. They are initialized in init() after
+// the global tgo.Metric store has been enabled.
+var (
+	routersMetric         *Gauge
+	fallbackRoutersMetric *Gauge
+	consMetric            *Gauge
+	prodsMetric           *Gauge
+	versionMetric         *Gauge
+
+	messagesRoutedMetric    *Counter
+	messagesEnquedMetric    *Counter
+	messagesDiscardedMetric *Counter
+	messagesFilteredMetric  *Counter
+
+	// MetricMessagesRoutedAvg holds the number of routed messages per second
+	MetricMessagesRoutedAvg *Rate
+
+	activeWorkersMetric *Gauge
+	// Has to be index parallel to PluginState*
+	stateToMetric []*Gauge
+)
+
 func init() {
 	tgo.EnableGlobalMetrics()
 	tgo.Metric.InitSystemMetrics()
 
-	tgo.Metric.New(metricVersion)
-	tgo.Metric.Set(metricVersion, GetVersionNumber())
-
-	tgo.Metric.New(metricRouters)
-	tgo.Metric.New(metricFallbackRouters)
-	tgo.Metric.New(metricCons)
-	tgo.Metric.New(metricProds)
+	versionMetric = NewLegacyGauge("version", nil, metricVersion)
+	versionMetric.Set(GetVersionNumber())
+
+	routersMetric = NewLegacyGauge("routers", nil, metricRouters)
+	fallbackRoutersMetric = NewLegacyGauge("fallback_routers", nil, metricFallbackRouters)
+	consMetric = NewLegacyGauge("consumers", nil, metricCons)
+	prodsMetric = NewLegacyGauge("producers", nil, metricProds)
+
+	legacyStateKeys := []string{
+		MetricPluginsInit,
+		MetricPluginsWaiting,
+		MetricPluginsActive,
+		MetricPluginsPrepareStop,
+		MetricPluginsStopping,
+		MetricPluginsDead,
+	}
+	for i, state := range stateToDescription {
+		stateToMetric = append(stateToMetric, NewLegacyGauge("plugins", MetricLabels{"state": state}, legacyStateKeys[i]))
+	}
+	activeWorkersMetric = NewLegacyGauge("plugin_workers", nil, MetricActiveWorkers)
 
-	tgo.Metric.New(MetricPluginsInit)
-	tgo.Metric.New(MetricPluginsWaiting)
-	tgo.Metric.New(MetricPluginsActive)
-	tgo.Metric.New(MetricPluginsPrepareStop)
-	tgo.Metric.New(MetricPluginsStopping)
-	tgo.Metric.New(MetricPluginsDead)
-	tgo.Metric.New(MetricActiveWorkers)
+	messagesRoutedMetric = NewLegacyCounter("messages", MetricLabels{"state": "routed"}, metricMessagesRouted, metricMessagesRoutedAvg)
+	messagesEnquedMetric = NewLegacyCounter("messages", MetricLabels{"state": "enqueued"}, metricMessagesEnqued, metricMessagesEnquedAvg)
+	messagesDiscardedMetric = NewLegacyCounter("messages", MetricLabels{"state": "discarded"}, metricMessagesDiscarded, metricMessagesDiscardedSec)
+	messagesFilteredMetric = NewLegacyCounter("messages", MetricLabels{"state": "filtered"}, metricMessagesFiltered, "")
 
-	tgo.Metric.New(metricMessagesRouted)
-	tgo.Metric.New(metricMessagesEnqued)
-	tgo.Metric.New(metricMessagesDiscarded)
-	tgo.Metric.NewRate(metricMessagesRouted, MetricMessagesRoutedAvg, time.Second, 10, 3, true)
-	tgo.Metric.NewRate(metricMessagesEnqued, metricMessagesEnquedAvg, time.Second, 10, 3, true)
-	tgo.Metric.NewRate(metricMessagesDiscarded, metricMessagesDiscardedSec, time.Second, 10, 3, true)
+	MetricMessagesRoutedAvg = messagesRoutedMetric.GetRate()
 }
 
 // CountMessageRouted increases the messages counter by 1
 func CountMessageRouted() {
-	tgo.Metric.Inc(metricMessagesRouted)
+	messagesRoutedMetric.Inc()
 }
 
 // CountMessageDiscarded increases the discarded messages counter by 1
 func CountMessageDiscarded() {
-	tgo.Metric.Inc(metricMessagesDiscarded)
+	messagesDiscardedMetric.Inc()
+}
+
+// CountMessageFiltered increases the filtered messages counter and the
+// counter for the given stream and reason by 1
+func CountMessageFiltered(streamID MessageStreamID, reason string) {
+	streamName := StreamRegistry.GetStreamName(streamID)
+	messagesFilteredMetric.Inc()
+	NewLegacyCounter("stream_messages_filtered", MetricLabels{
+		"stream": streamName,
+		"filter": reason,
+	}, fmt.Sprintf(metricStreamMessagesFiltered, streamName, reason), "").Inc()
 }
 
 // CountMessagesEnqueued increases the enqueued messages counter by 1
 func CountMessagesEnqueued() {
-	tgo.Metric.Inc(metricMessagesEnqued)
+	messagesEnquedMetric.Inc()
 }
 
 // CountProducers increases the producer counter by 1
 func CountProducers() {
-	tgo.Metric.Inc(metricProds)
+	prodsMetric.Inc()
 }
 
 // CountConsumers increases the consumer counter by 1
 func CountConsumers() {
-	tgo.Metric.Inc(metricCons)
+	consMetric.Inc()
 }
 
 // CountRouters increases the stream counter by 1
 func CountRouters() {
-	tgo.Metric.Inc(metricRouters)
+	routersMetric.Inc()
 }
 
 // CountFallbackRouters increases the fallback stream counter by 1
 func CountFallbackRouters() {
-	tgo.Metric.Inc(metricFallbackRouters)
+	fallbackRoutersMetric.Inc()
+}
+
+// UncountProducers decreases the producer counter by 1
+func UncountProducers() {
+	prodsMetric.Dec()
+}
+
+// UncountConsumers decreases the consumer counter by 1
+func UncountConsumers() {
+	consMetric.Dec()
+}
+
+// UncountFallbackRouters decreases the fallback stream counter by 1
+func UncountFallbackRouters() {
+	fallbackRoutersMetric.Dec()
 }
 
 var streamMetrics = map[MessageStreamID]StreamMetric{}
@@ -154,37 +208,31 @@ func GetStreamMetric(streamID MessageStreamID) StreamMetric {
 
 // StreamMetric class for stream based metrics
 type StreamMetric struct {
-	keyRouted    string
-	keyDiscarded string
+	routed    *Counter
+	discarded *Counter
 }
 
 func newStreamMetric(streamID MessageStreamID) StreamMetric {
 	streamName := StreamRegistry.GetStreamName(streamID)
 
 	metric := StreamMetric{
-		keyRouted:    fmt.Sprintf(metricStreamMessagesRouted, streamName),
-		keyDiscarded: fmt.Sprintf(metricStreamMessagesDiscarded, streamName),
+		routed: NewLegacyCounter("stream_messages", MetricLabels{"stream": streamName, "state": "routed"},
+			fmt.Sprintf(metricStreamMessagesRouted, streamName), fmt.Sprintf(metricStreamMessagesRoutedAvg, streamName)),
+		discarded: NewLegacyCounter("stream_messages", MetricLabels{"stream": streamName, "state": "discarded"},
+			fmt.Sprintf(metricStreamMessagesDiscarded, streamName), fmt.Sprintf(metricStreamMessagesDiscardedAvg, streamName)),
 	}
 
-	keyRoutedAvg := fmt.Sprintf(metricStreamMessagesRoutedAvg, streamName)
-	keyDiscardedAvg := fmt.Sprintf(metricStreamMessagesDiscardedAvg, streamName)
-
-	tgo.Metric.New(metric.keyRouted)
-	tgo.Metric.New(metric.keyDiscarded)
-	tgo.Metric.NewRate(metric.keyRouted, keyRoutedAvg, time.Second, 10, 3, true)
-	tgo.Metric.NewRate(metric.keyDiscarded, keyDiscardedAvg, time.Second, 10, 3, true)
-
 	return metric
 }
 
 // CountMessageRouted increases the messages counter by 1
 func (metric *StreamMetric) CountMessageRouted() {
-	tgo.Metric.Inc(metric.keyRouted)
+	metric.routed.Inc()
 }
 
 // CountMessageDiscarded increases the discarded messages counter by 1
 func (metric *StreamMetric) CountMessageDiscarded() {
-	tgo.Metric.Inc(metric.keyDiscarded)
+	metric.discarded.Inc()
 }
 
 // PluginMetric class for plugin based metrics
@@ -193,21 +241,21 @@ type PluginMetric struct {
 
 // Init increase the plugin state init count
 func (metric *PluginMetric) Init() {
-	tgo.Metric.Inc(MetricPluginsInit)
+	stateToMetric[PluginStateInitializing].Inc()
 }
 
 // UpdateStateMetric decrease the prev plugin state and increase the next plugin state
-func (metric *PluginMetric) UpdateStateMetric(prevState, nextState string) {
-	tgo.Metric.Dec(prevState)
-	tgo.Metric.Inc(nextState)
+func (metric *PluginMetric) UpdateStateMetric(prevState, nextState PluginState) {
+	stateToMetric[prevState].Dec()
+	stateToMetric[nextState].Inc()
 }
 
 // IncWorker increase the active worker count
 func (metric *PluginMetric) IncWorker() {
-	tgo.Metric.Inc(MetricActiveWorkers)
+	activeWorkersMetric.Inc()
 }
 
 // DecWorker decrease the active worker count
 func (metric *PluginMetric) DecWorker() {
-	tgo.Metric.Dec(MetricActiveWorkers)
+	activeWorkersMetric.Dec()
 }
@@ -0,0 +1,298 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/tgo"
+)
+
+const (
+	metricsPushStatsd    = "statsd"
+	metricsPushDogStatsd = "dogstatsd"
+	metricsPushGraphite  = "graphite"
+
+	// metricsPushMaxPacketSize is the maximum size of a statsd UDP packet
+	metricsPushMaxPacketSize = 1432
+)
+
+var metricsPushSanitizer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", ";", "_", "=", "_", " ", "_", "\n", "_")
+
+// MetricsPusher periodically sends all metrics to statsd, DogStatsD or
+// Graphite.
+//
+// Counters are sent as statsd counters holding the increase since the last
+// push. Gauges and rates are sent as gauges. Histograms are sent as
+// "<name>.count" and "<name>.sum" counters. Graphite receives the current
+// values of all metrics.
+//
+// Labels are sent as DogStatsD or Graphite tags. For statsd, label values are
+// appended to the metric name, separated by dots. Labels can be renamed or
+// dropped by a tag mapping.
+type MetricsPusher struct {
+	protocol      string
+	address       string
+	prefix        string
+	tagMapping    map[string]string
+	lastCounters  map[string]int64
+	lastHistogram map[string]HistogramSnapshot
+	now           func() time.Time
+}
+
+// NewMetricsPusher creates a pusher for the given target, e.g.
+// "statsd://localhost:8125", "dogstatsd://localhost:8125" or
+// "graphite://localhost:2003". Each name in tagMapping is a label that is
+// renamed to the given tag. Labels mapped to "" or "-" are not sent.
+func NewMetricsPusher(target string, prefix string, tagMapping map[string]string) (*MetricsPusher, error) {
+	parts := strings.SplitN(target, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("metrics push target %q must be of the form protocol://host:port", target)
+	}
+
+	switch parts[0] {
+	case metricsPushStatsd, metricsPushDogStatsd, metricsPushGraphite:
+	default:
+		return nil, fmt.Errorf("unknown metrics push protocol %q, expected statsd, dogstatsd or graphite", parts[0])
+	}
+
+	if tagMapping == nil {
+		tagMapping = map[string]string{}
+	}
+
+	return &MetricsPusher{
+		protocol:      parts[0],
+		address:       parts[1],
+		prefix:        prefix,
+		tagMapping:    tagMapping,
+		lastCounters:  make(map[string]int64),
+		lastHistogram: make(map[string]HistogramSnapshot),
+		now:           time.Now,
+	}, nil
+}
+
+// ParseMetricsTagMapping parses a comma separated list of label:tag pairs.
+func ParseMetricsTagMapping(mapping string) (map[string]string, error) {
+	tags := make(map[string]string)
+	if strings.TrimSpace(mapping) == "" {
+		return tags, nil
+	}
+
+	for _, pair := range strings.Split(mapping, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("tag mapping %q must be of the form label:tag", pair)
+		}
+		tags[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return tags, nil
+}
+
+// Start pushes all metrics once per interval. The returned function stops
+// pushing.
+func (pusher *MetricsPusher) Start(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+
+	go tgo.WithRecoverShutdown(func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := pusher.Push(); err != nil {
+					logrus.WithError(err).Warningf("Failed to push metrics to %s", pusher.address)
+				}
+			case <-stop:
+				ticker.Stop()
+				return
+			}
+		}
+	})
+
+	return func() {
+		close(stop)
+	}
+}
+
+// Push sends the current values of all metrics.
+func (pusher *MetricsPusher) Push() error {
+	lines, err := pusher.getLines()
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+
+	if pusher.protocol == metricsPushGraphite {
+		conn, err := net.DialTimeout("tcp", pusher.address, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+		return err
+	}
+
+	conn, err := net.Dial("udp", pusher.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, packet := range packMetricsLines(lines, metricsPushMaxPacketSize) {
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packMetricsLines joins lines to packets of at most maxSize bytes. Lines
+// longer than maxSize are sent as a packet of their own.
+func packMetricsLines(lines []string, maxSize int) [][]byte {
+	packets := [][]byte{}
+	packet := bytes.Buffer{}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > maxSize {
+			packets = append(packets, append([]byte{}, packet.Bytes()...))
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		packets = append(packets, packet.Bytes())
+	}
+	return packets
+}
+
+// getLines returns the lines to send for all typed and untyped metrics.
+func (pusher *MetricsPusher) getLines() ([]string, error) {
+	timestamp := pusher.now().Unix()
+	lines := []string{}
+
+	for _, metric := range MetricRegistry.GetMetrics() {
+		switch typed := metric.(type) {
+		case *Counter:
+			value := typed.Get()
+			if pusher.protocol != metricsPushGraphite {
+				value, pusher.lastCounters[typed.key] = value-pusher.lastCounters[typed.key], value
+			}
+			lines = append(lines, pusher.formatLine(typed.Metric, "", strconv.FormatInt(value, 10), "c", timestamp))
+
+		case *Gauge:
+			lines = append(lines, pusher.formatLine(typed.Metric, "", strconv.FormatInt(typed.Get(), 10), "g", timestamp))
+
+		case *Rate:
+			lines = append(lines, pusher.formatLine(typed.Metric, "", strconv.FormatInt(typed.Get(), 10), "g", timestamp))
+
+		case *Histogram:
+			snapshot := typed.GetSnapshot()
+			count, sum := snapshot.Count, snapshot.Sum
+			if pusher.protocol != metricsPushGraphite {
+				last := pusher.lastHistogram[typed.key]
+				count, sum = count-last.Count, sum-last.Sum
+				pusher.lastHistogram[typed.key] = snapshot
+			}
+			lines = append(lines,
+				pusher.formatLine(typed.Metric, ".count", strconv.FormatUint(count, 10), "c", timestamp),
+				pusher.formatLine(typed.Metric, ".sum", strconv.FormatFloat(sum, 'f', -1, 64), "c", timestamp))
+		}
+	}
+
+	// Metrics not registered as typed metric are sent as gauges
+	dump, err := tgo.Metric.Dump()
+	if err != nil {
+		return lines, err
+	}
+	snapshot := make(map[string]int64)
+	if err := json.Unmarshal(dump, &snapshot); err != nil {
+		return lines, err
+	}
+
+	keys := make([]string, 0, len(snapshot))
+	for key := range snapshot {
+		if !MetricRegistry.IsRegistered(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		metric := Metric{name: strings.Replace(key, ":", ".", -1)}
+		lines = append(lines, pusher.formatLine(metric, "", strconv.FormatInt(snapshot[key], 10), "g", timestamp))
+	}
+	return lines, nil
+}
+
+// formatLine renders a single metric line in the pusher's protocol.
+func (pusher *MetricsPusher) formatLine(metric Metric, suffix string, value string, statsdType string, timestamp int64) string {
+	name := pusher.prefix + metricsPushSanitizer.Replace(metric.name) + suffix
+	names, values := pusher.getTags(metric.labels)
+
+	switch pusher.protocol {
+	case metricsPushGraphite:
+		tags := ""
+		for i, tag := range names {
+			tags += ";" + tag + "=" + values[i]
+		}
+		return fmt.Sprintf("%s%s %s %d", name, tags, value, timestamp)
+
+	case metricsPushDogStatsd:
+		tags := make([]string, len(names))
+		for i, tag := range names {
+			tags[i] = tag + ":" + values[i]
+		}
+		line := fmt.Sprintf("%s:%s|%s", name, value, statsdType)
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		return line
+
+	default:
+		for _, labelValue := range values {
+			name += "." + strings.Replace(labelValue, ".", "_", -1)
+		}
+		return fmt.Sprintf("%s:%s|%s", name, value, statsdType)
+	}
+}
+
+// getTags returns the mapped and sanitized tag names and values of the given
+// labels, sorted by label name.
+func (pusher *MetricsPusher) getTags(labels MetricLabels) ([]string, []string) {
+	labelNames, labelValues := getSortedLabels(labels)
+	names := make([]string, 0, len(labelNames))
+	values := make([]string, 0, len(labelNames))
+
+	for i, label := range labelNames {
+		tag, isMapped := pusher.tagMapping[label]
+		if !isMapped {
+			tag = label
+		}
+		if tag == "" || tag == "-" {
+			continue
+		}
+		names = append(names, metricsPushSanitizer.Replace(tag))
+		values = append(values, metricsPushSanitizer.Replace(labelValues[i]))
+	}
+	return names, values
+}
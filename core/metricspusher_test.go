@@ -0,0 +1,134 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+func containsLine(lines []string, line string) bool {
+	for _, candidate := range lines {
+		if candidate == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMetricsPusherConfig(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	_, err := NewMetricsPusher("localhost:8125", "", nil)
+	expect.NotNil(err)
+	_, err = NewMetricsPusher("influx://localhost:8125", "", nil)
+	expect.NotNil(err)
+
+	tags, err := ParseMetricsTagMapping("stream:gollum_stream, plugin_id:-")
+	expect.NoError(err)
+	expect.Equal(map[string]string{"stream": "gollum_stream", "plugin_id": "-"}, tags)
+
+	_, err = ParseMetricsTagMapping("stream")
+	expect.NotNil(err)
+}
+
+func TestMetricsPusherStatsd(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	pusher, err := NewMetricsPusher("statsd://localhost:8125", "gollum.", nil)
+	expect.NoError(err)
+	pusher.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	counter := NewCounter("push_test", MetricLabels{"stream": "foo.bar", "plugin_id": "prod"})
+	counter.Add(5)
+
+	lines, err := pusher.getLines()
+	expect.NoError(err)
+	expect.True(containsLine(lines, "gollum.push_test.prod.foo_bar:5|c"))
+
+	// Counters are sent as increase since the last push
+	counter.Add(2)
+	lines, _ = pusher.getLines()
+	expect.True(containsLine(lines, "gollum.push_test.prod.foo_bar:2|c"))
+}
+
+func TestMetricsPusherDogStatsd(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	pusher, err := NewMetricsPusher("dogstatsd://localhost:8125", "gollum.", map[string]string{
+		"stream":    "gollum_stream",
+		"plugin_id": "-",
+	})
+	expect.NoError(err)
+	pusher.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	NewGauge("push_test_gauge", MetricLabels{"stream": "foo", "plugin_id": "prod"}).Set(7)
+	NewHistogram("push_test_seconds", MetricLabels{"stream": "foo"}, []float64{1}).Observe(0.5)
+
+	lines, err := pusher.getLines()
+	expect.NoError(err)
+	expect.True(containsLine(lines, "gollum.push_test_gauge:7|g|#gollum_stream:foo"))
+	expect.True(containsLine(lines, "gollum.push_test_seconds.count:1|c|#gollum_stream:foo"))
+	expect.True(containsLine(lines, "gollum.push_test_seconds.sum:0.5|c|#gollum_stream:foo"))
+}
+
+func TestMetricsPusherGraphite(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	pusher, err := NewMetricsPusher("graphite://localhost:2003", "gollum.", nil)
+	expect.NoError(err)
+	pusher.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	counter := NewCounter("push_test_graphite", MetricLabels{"stream": "foo"})
+	counter.Add(3)
+
+	lines, err := pusher.getLines()
+	expect.NoError(err)
+	expect.True(containsLine(lines, "gollum.push_test_graphite;stream=foo 3 1500000000"))
+
+	// Graphite receives absolute values
+	lines, _ = pusher.getLines()
+	expect.True(containsLine(lines, "gollum.push_test_graphite;stream=foo 3 1500000000"))
+}
+
+func TestMetricsPusherPush(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	expect.NoError(err)
+	defer listener.Close()
+
+	pusher, err := NewMetricsPusher("statsd://"+listener.LocalAddr().String(), "gollum.", nil)
+	expect.NoError(err)
+	pusher.now = func() time.Time { return time.Unix(1500000000, 0) }
+	NewCounter("push_test_udp", nil).Inc()
+	expect.NoError(pusher.Push())
+
+	received := ""
+	buffer := make([]byte, metricsPushMaxPacketSize)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	for !strings.Contains(received, "gollum.push_test_udp:1|c") {
+		size, _, err := listener.ReadFrom(buffer)
+		if !expect.NoError(err) {
+			return
+		}
+		expect.Leq(size, metricsPushMaxPacketSize)
+		received = string(buffer[:size])
+	}
+}
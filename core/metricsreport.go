@@ -0,0 +1,77 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/tgo"
+)
+
+type metricsReportSource struct{}
+
+// IsActive returns true
+func (source metricsReportSource) IsActive() bool {
+	return true
+}
+
+// IsBlocked returns false
+func (source metricsReportSource) IsBlocked() bool {
+	return false
+}
+
+// GetID returns the pluginID of the message source
+func (source metricsReportSource) GetID() string {
+	return "core.MetricsReport"
+}
+
+// StartMetricsReport sends a snapshot of all metrics as JSON object to the
+// "_GOLLUM_METRICS_" stream once per interval. The returned function stops
+// the report.
+func StartMetricsReport(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+
+	go tgo.WithRecoverShutdown(func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := ReportMetrics(); err != nil {
+					logrus.WithError(err).Error("Failed to report metrics")
+				}
+			case <-stop:
+				ticker.Stop()
+				return
+			}
+		}
+	})
+
+	return func() {
+		close(stop)
+	}
+}
+
+// ReportMetrics sends a snapshot of all metrics as JSON object to the
+// "_GOLLUM_METRICS_" stream.
+func ReportMetrics() error {
+	snapshot, err := MetricRegistry.Dump()
+	if err != nil {
+		return err
+	}
+
+	msg := NewMessage(metricsReportSource{}, snapshot, nil, MetricsInternalStreamID)
+	return StreamRegistry.GetRouterOrFallback(MetricsInternalStreamID).Enqueue(msg)
+}
@@ -0,0 +1,41 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestReportMetrics(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	metricsRouter := getMockRouterMessageHelper(MetricsInternalStream)
+	StreamRegistry.Register(&metricsRouter, MetricsInternalStreamID)
+
+	NewCounter("report_test", nil).Add(5)
+
+	expect.NoError(ReportMetrics())
+	expect.True(metricsRouter.messageEnqued)
+
+	snapshot := make(map[string]int64)
+	expect.NoError(json.Unmarshal([]byte(metricsRouter.lastMessageData), &snapshot))
+	expect.Equal(int64(5), snapshot["report_test"])
+
+	_, hasRate := snapshot["report_test_per_second"]
+	expect.True(hasRate)
+}
@@ -41,6 +41,16 @@ type ScopedModulator interface {
 	SetLogger(logger logrus.FieldLogger)
 }
 
+// StreamBoundModulator is an optional interface for modulators that can only
+// process messages already routed to a stream, e.g. because they send new
+// messages to the stream of a message. Such modulators cannot be used by
+// consumers.
+type StreamBoundModulator interface {
+	// RequiresStream returns true if messages passed to this modulator have
+	// to be routed to a stream.
+	RequiresStream() bool
+}
+
 // ModulateResult defines a set of results used to control the message flow
 // induced by Modulator actions.
 type ModulateResult int
@@ -68,3 +78,19 @@ func (modulators ModulatorArray) Modulate(msg *Message) ModulateResult {
 	}
 	return action
 }
+
+// GetStreamBound returns the first modulator of the array that requires
+// messages to be routed to a stream or nil. Formatters wrapped by a
+// FormatterModulator are checked, too.
+func (modulators ModulatorArray) GetStreamBound() interface{} {
+	for _, modulator := range modulators {
+		var candidate interface{} = modulator
+		if formatterModulator, isFormatter := modulator.(*FormatterModulator); isFormatter {
+			candidate = formatterModulator.Formatter
+		}
+		if bound, isBound := candidate.(StreamBoundModulator); isBound && bound.RequiresStream() {
+			return candidate
+		}
+	}
+	return nil
+}
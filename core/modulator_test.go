@@ -38,3 +38,26 @@ func TestModulate(t *testing.T) {
 	msg := NewMessage(nil, []byte("foo"), nil, InvalidStreamID)
 	expect.Equal(ModulateResultContinue, modulatorArray.Modulate(msg))
 }
+
+type mockStreamBoundFormatter struct {
+	SimpleFormatter
+}
+
+func (format *mockStreamBoundFormatter) ApplyFormatter(msg *Message) error {
+	return nil
+}
+
+func (format *mockStreamBoundFormatter) RequiresStream() bool {
+	return true
+}
+
+func TestModulatorArrayGetStreamBound(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	modulators := ModulatorArray{NewFormatterModulator(&mockFormatter{})}
+	expect.Nil(modulators.GetStreamBound())
+
+	bound := &mockStreamBoundFormatter{}
+	modulators = append(modulators, NewFormatterModulator(bound))
+	expect.Equal(bound, modulators.GetStreamBound())
+}
@@ -0,0 +1,174 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultilineFlushCallback is called by MultilineAggregator for every joined
+// message. The data passed is not reused by the aggregator.
+type MultilineFlushCallback func(data []byte, metadata Metadata)
+
+// MultilineConfig holds the settings of a MultilineAggregator.
+type MultilineConfig struct {
+	// Pattern is the regular expression matched against each line.
+	Pattern string
+	// Negate inverts the result of Pattern.
+	Negate bool
+	// What defines if matching lines belong to the "previous" or the "next"
+	// line.
+	What string
+	// Delimiter is inserted between joined lines.
+	Delimiter []byte
+	// MaxLines defines the number of lines after which a message is flushed
+	// even if more continuation lines follow. 0 disables this limit.
+	MaxLines int
+	// FlushTimeout defines the time after the last line after which a pending
+	// message is flushed. 0 disables the timeout.
+	FlushTimeout time.Duration
+}
+
+// MultilineAggregator joins continuation lines, e.g. the lines of a stack
+// trace, into single messages. Lines are matched against a pattern, using the
+// same semantics as the Logstash multiline codec:
+//
+//  - What "previous": lines matching Pattern are appended to the previous line.
+//  - What "next": lines matching Pattern are prepended to the next line.
+//  - Negate inverts the match, e.g. Pattern "^\S" with Negate set to true and
+//  What "previous" appends all lines starting with whitespace to the previous
+//  line.
+//
+// The metadata of a joined message is the metadata of its first line.
+// A MultilineAggregator should be used per source, so that lines of different
+// sources, e.g. different files, are not mixed up.
+type MultilineAggregator struct {
+	pattern  *regexp.Regexp
+	negate   bool
+	next     bool
+	config   MultilineConfig
+	onFlush  MultilineFlushCallback
+	buffer   []byte
+	metadata Metadata
+	numLines int
+	lastPush time.Time
+	timer    *time.Timer
+	guard    sync.Mutex
+}
+
+// NewMultilineAggregator creates a new aggregator calling onFlush for every
+// joined message.
+func NewMultilineAggregator(config MultilineConfig, onFlush MultilineFlushCallback) (*MultilineAggregator, error) {
+	pattern, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregator := &MultilineAggregator{
+		pattern: pattern,
+		negate:  config.Negate,
+		config:  config,
+		onFlush: onFlush,
+	}
+
+	switch what := strings.ToLower(config.What); what {
+	case "", "previous":
+	case "next":
+		aggregator.next = true
+	default:
+		return nil, fmt.Errorf("Unknown multiline mode '%s'", what)
+	}
+	return aggregator, nil
+}
+
+// Push adds a line to the aggregator. Pending messages are flushed if the
+// given line does not belong to them. The data is copied.
+func (agg *MultilineAggregator) Push(data []byte, metadata Metadata) {
+	agg.guard.Lock()
+	defer agg.guard.Unlock()
+
+	isContinuation := agg.pattern.Match(data) != agg.negate
+
+	if agg.next {
+		agg.append(data, metadata)
+		if !isContinuation {
+			agg.flush()
+		}
+	} else {
+		if !isContinuation {
+			agg.flush()
+		}
+		agg.append(data, metadata)
+	}
+
+	if agg.config.MaxLines > 0 && agg.numLines >= agg.config.MaxLines {
+		agg.flush()
+	}
+
+	if agg.numLines > 0 && agg.config.FlushTimeout > 0 {
+		agg.lastPush = time.Now()
+		if agg.timer == nil {
+			agg.timer = time.AfterFunc(agg.config.FlushTimeout, agg.onTimeout)
+		}
+	}
+}
+
+// Flush sends the pending message, if any.
+func (agg *MultilineAggregator) Flush() {
+	agg.guard.Lock()
+	defer agg.guard.Unlock()
+	agg.flush()
+}
+
+func (agg *MultilineAggregator) append(data []byte, metadata Metadata) {
+	if agg.numLines == 0 {
+		agg.metadata = metadata
+	} else {
+		agg.buffer = append(agg.buffer, agg.config.Delimiter...)
+	}
+	agg.buffer = append(agg.buffer, data...)
+	agg.numLines++
+}
+
+func (agg *MultilineAggregator) flush() {
+	if agg.numLines == 0 {
+		return
+	}
+
+	data, metadata := agg.buffer, agg.metadata
+	agg.buffer, agg.metadata, agg.numLines = nil, nil, 0
+	agg.onFlush(data, metadata)
+}
+
+func (agg *MultilineAggregator) onTimeout() {
+	agg.guard.Lock()
+	defer agg.guard.Unlock()
+
+	agg.timer = nil
+	if agg.numLines == 0 {
+		return
+	}
+
+	// Lines have been pushed since the timer was started
+	if remaining := agg.config.FlushTimeout - time.Since(agg.lastPush); remaining > 0 {
+		agg.timer = time.AfterFunc(remaining, agg.onTimeout)
+		return
+	}
+	agg.flush()
+}
@@ -0,0 +1,149 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+type multilineCollector struct {
+	messages []string
+	metadata []Metadata
+	guard    sync.Mutex
+}
+
+func (collector *multilineCollector) onFlush(data []byte, metadata Metadata) {
+	collector.guard.Lock()
+	defer collector.guard.Unlock()
+	collector.messages = append(collector.messages, string(data))
+	collector.metadata = append(collector.metadata, metadata)
+}
+
+func (collector *multilineCollector) get() []string {
+	collector.guard.Lock()
+	defer collector.guard.Unlock()
+	return append([]string{}, collector.messages...)
+}
+
+func pushLines(agg *MultilineAggregator, lines ...string) {
+	for _, line := range lines {
+		agg.Push([]byte(line), nil)
+	}
+}
+
+func TestMultilinePrevious(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	collector := &multilineCollector{}
+
+	agg, err := NewMultilineAggregator(MultilineConfig{
+		Pattern:   `^\s`,
+		What:      "previous",
+		Delimiter: []byte("\n"),
+	}, collector.onFlush)
+	expect.NoError(err)
+
+	agg.Push([]byte("Exception in thread main"), Metadata{"file": []byte("a.log")})
+	pushLines(agg, "\tat com.example.Foo.bar(Foo.java:10)", "\tat com.example.Main.main(Main.java:3)", "next message")
+	expect.Equal([]string{"Exception in thread main\n\tat com.example.Foo.bar(Foo.java:10)\n\tat com.example.Main.main(Main.java:3)"}, collector.get())
+	expect.Equal("a.log", collector.metadata[0].GetValueString("file"))
+
+	agg.Flush()
+	expect.Equal([]string{
+		"Exception in thread main\n\tat com.example.Foo.bar(Foo.java:10)\n\tat com.example.Main.main(Main.java:3)",
+		"next message",
+	}, collector.get())
+
+	agg.Flush()
+	expect.Equal(2, len(collector.get()))
+}
+
+func TestMultilineNegate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	collector := &multilineCollector{}
+
+	agg, err := NewMultilineAggregator(MultilineConfig{
+		Pattern:   `^\d{4}-\d{2}-\d{2}`,
+		Negate:    true,
+		Delimiter: []byte("|"),
+	}, collector.onFlush)
+	expect.NoError(err)
+
+	pushLines(agg, "2018-01-01 error", "Traceback:", "  File x.py", "2018-01-02 info", "2018-01-03 info")
+	expect.Equal([]string{"2018-01-01 error|Traceback:|  File x.py", "2018-01-02 info"}, collector.get())
+}
+
+func TestMultilineNext(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	collector := &multilineCollector{}
+
+	agg, err := NewMultilineAggregator(MultilineConfig{
+		Pattern:   `\\$`,
+		What:      "next",
+		Delimiter: []byte(" "),
+	}, collector.onFlush)
+	expect.NoError(err)
+
+	pushLines(agg, `a \`, `b \`, "c", "d")
+	expect.Equal([]string{`a \ b \ c`, "d"}, collector.get())
+}
+
+func TestMultilineMaxLines(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	collector := &multilineCollector{}
+
+	agg, err := NewMultilineAggregator(MultilineConfig{
+		Pattern:  `^\s`,
+		MaxLines: 2,
+	}, collector.onFlush)
+	expect.NoError(err)
+
+	pushLines(agg, "a", " 1", " 2", " 3")
+	expect.Equal([]string{"a 1", " 2 3"}, collector.get())
+}
+
+func TestMultilineFlushTimeout(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	collector := &multilineCollector{}
+
+	agg, err := NewMultilineAggregator(MultilineConfig{
+		Pattern:      `^\s`,
+		Delimiter:    []byte("\n"),
+		FlushTimeout: 50 * time.Millisecond,
+	}, collector.onFlush)
+	expect.NoError(err)
+
+	pushLines(agg, "a", " 1")
+	time.Sleep(20 * time.Millisecond)
+	pushLines(agg, " 2")
+	time.Sleep(20 * time.Millisecond)
+	expect.Equal(0, len(collector.get()))
+
+	time.Sleep(100 * time.Millisecond)
+	expect.Equal([]string{"a\n 1\n 2"}, collector.get())
+}
+
+func TestMultilineInvalidConfig(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	_, err := NewMultilineAggregator(MultilineConfig{Pattern: "("}, nil)
+	expect.NotNil(err)
+
+	_, err = NewMultilineAggregator(MultilineConfig{Pattern: "a", What: "after"}, nil)
+	expect.NotNil(err)
+}
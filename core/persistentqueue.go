@@ -0,0 +1,547 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	persistentRecordHeaderSize = 8
+	persistentSegmentSuffix    = ".segment"
+	persistentCheckpointFile   = "checkpoint"
+)
+
+var (
+	persistentQueues      = make(map[string]*PersistentQueue)
+	persistentQueuesGuard = new(sync.Mutex)
+)
+
+// PersistentQueue is a FIFO queue that stores messages in segment files so
+// that they survive restarts. Each record consists of the length and the
+// CRC32 checksum of the serialized message (both uint32, big endian)
+// followed by the serialized message.
+// Messages returned by Pop are committed when they are acknowledged, see
+// Message.SetAckCallback. Segments are removed once all of their records
+// have been committed. The first uncommitted record is stored in a
+// checkpoint file whenever a segment is removed and when the queue is closed.
+// All records after the checkpoint are replayed when the queue is opened
+// again, so messages may be delivered twice after a crash.
+// Push does not sync the segment file to disk. Files are synced when a
+// segment is rolled and when the queue is closed, so records pushed since
+// then are lost if the operating system crashes.
+type PersistentQueue struct {
+	path          string
+	owner         string
+	maxSize       int64
+	segmentSize   int64
+	size          int64
+	numUnread     int
+	segments      []*persistentSegment
+	writer        *os.File
+	reader        *os.File
+	readSegment   *persistentSegment
+	uncommitted   map[uint64]*persistentSegment
+	refCount      int
+	closed        bool
+	guard         *sync.Mutex
+	dataAvailable chan struct{}
+}
+
+// persistentSegment holds the state of a single segment file. Records are
+// numbered starting with firstSeq, which is also used as file name.
+type persistentSegment struct {
+	firstSeq     uint64
+	numRecords   uint64
+	numRead      uint64
+	numCommitted uint64
+	size         int64
+	readOffset   int64
+}
+
+// OpenPersistentQueue opens the queue stored in the given directory or
+// creates it if it does not exist. Segment files are rolled when reaching
+// segmentSize bytes, Push fails if all segments together would exceed
+// maxSize bytes. Records after the last checkpoint are read again, invalid
+// records at the end of a segment, e.g. after a crash, are removed.
+// A queue can be opened more than once by the same owner, e.g. when a
+// producer is replaced during a reload, in which case the already opened
+// queue is returned and the given sizes are ignored. Each call has to be
+// followed by a call to Close.
+func OpenPersistentQueue(path string, owner string, maxSize int64, segmentSize int64) (*PersistentQueue, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	persistentQueuesGuard.Lock()
+	defer persistentQueuesGuard.Unlock()
+
+	if queue, isOpen := persistentQueues[path]; isOpen {
+		if queue.owner != owner {
+			return nil, fmt.Errorf("Persistent queue %s is already used by %s", path, queue.owner)
+		}
+		queue.refCount++
+		return queue, nil
+	}
+
+	queue := &PersistentQueue{
+		path:          path,
+		owner:         owner,
+		maxSize:       maxSize,
+		segmentSize:   segmentSize,
+		uncommitted:   make(map[uint64]*persistentSegment),
+		refCount:      1,
+		guard:         new(sync.Mutex),
+		dataAvailable: make(chan struct{}, 1),
+	}
+	if err := queue.restore(); err != nil {
+		return nil, err
+	}
+
+	persistentQueues[path] = queue
+	return queue, nil
+}
+
+// restore reads all segments and the checkpoint from disk.
+func (queue *PersistentQueue) restore() error {
+	if err := os.MkdirAll(queue.path, 0755); err != nil {
+		return err
+	}
+
+	checkpoint, err := queue.readCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	// File names are zero padded, so they are sorted by sequence
+	files, err := ioutil.ReadDir(queue.path)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), persistentSegmentSuffix) {
+			continue // ### continue, no segment ###
+		}
+		firstSeq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), persistentSegmentSuffix), 10, 64)
+		if err != nil {
+			continue // ### continue, no segment ###
+		}
+
+		segment, err := queue.restoreSegment(firstSeq, checkpoint)
+		if err != nil {
+			return err
+		}
+
+		if segment.numCommitted == segment.numRecords {
+			if err := os.Remove(queue.getSegmentPath(firstSeq)); err != nil {
+				return err
+			}
+			continue // ### continue, fully committed ###
+		}
+
+		queue.segments = append(queue.segments, segment)
+		queue.size += segment.size
+		queue.numUnread += int(segment.numRecords - segment.numRead)
+	}
+
+	if len(queue.segments) > 0 {
+		last := queue.segments[len(queue.segments)-1]
+		queue.writer, err = os.OpenFile(queue.getSegmentPath(last.firstSeq), os.O_WRONLY|os.O_APPEND, 0644)
+		return err
+	}
+	return nil
+}
+
+// restoreSegment validates all records of a segment file and truncates the
+// file after the last valid record. Records before checkpoint are marked as
+// committed.
+func (queue *PersistentQueue) restoreSegment(firstSeq uint64, checkpoint uint64) (*persistentSegment, error) {
+	segmentPath := queue.getSegmentPath(firstSeq)
+	file, err := os.OpenFile(segmentPath, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	segment := &persistentSegment{firstSeq: firstSeq}
+	for {
+		data, err := readPersistentRecord(file)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || len(data) == 0 {
+			// Incomplete or corrupted records can only be recovered by
+			// dropping the rest of the segment.
+			if err := file.Truncate(segment.size); err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		recordSize := int64(persistentRecordHeaderSize + len(data))
+		if firstSeq+segment.numRecords < checkpoint {
+			segment.numRead++
+			segment.numCommitted++
+			segment.readOffset += recordSize
+		}
+		segment.numRecords++
+		segment.size += recordSize
+	}
+
+	return segment, nil
+}
+
+// Push serializes the message and appends it to the queue. An error is
+// returned if the queue is closed, full or the message could not be written.
+func (queue *PersistentQueue) Push(msg *Message) error {
+	data, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, persistentRecordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[persistentRecordHeaderSize:], data)
+	recordSize := int64(len(record))
+
+	queue.guard.Lock()
+	defer queue.guard.Unlock()
+
+	switch {
+	case queue.closed:
+		return fmt.Errorf("Persistent queue %s is closed", queue.path)
+	case queue.size+recordSize > queue.maxSize:
+		return fmt.Errorf("Persistent queue %s is full", queue.path)
+	}
+
+	segment, err := queue.getWriteSegment(recordSize)
+	if err != nil {
+		return err
+	}
+
+	if _, err := queue.writer.Write(record); err != nil {
+		// Remove partially written data so that following records stay
+		// readable.
+		queue.writer.Truncate(segment.size)
+		return err
+	}
+
+	segment.numRecords++
+	segment.size += recordSize
+	queue.size += recordSize
+	queue.numUnread++
+
+	select {
+	case queue.dataAvailable <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// getWriteSegment returns the last segment and creates a new one if there is
+// no segment or if the record does not fit into the last segment.
+func (queue *PersistentQueue) getWriteSegment(recordSize int64) (*persistentSegment, error) {
+	if len(queue.segments) > 0 {
+		last := queue.segments[len(queue.segments)-1]
+		if last.size == 0 || last.size+recordSize <= queue.segmentSize {
+			return last, nil
+		}
+	}
+	return queue.addSegment()
+}
+
+// addSegment creates a new segment after the last segment and uses it for
+// writing.
+func (queue *PersistentQueue) addSegment() (*persistentSegment, error) {
+	nextSeq := uint64(0)
+	if len(queue.segments) > 0 {
+		last := queue.segments[len(queue.segments)-1]
+		nextSeq = last.firstSeq + last.numRecords
+	} else if checkpoint, err := queue.readCheckpoint(); err == nil {
+		nextSeq = checkpoint
+	}
+
+	writer, err := os.OpenFile(queue.getSegmentPath(nextSeq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if queue.writer != nil {
+		queue.writer.Sync()
+		queue.writer.Close()
+	}
+	queue.writer = writer
+
+	segment := &persistentSegment{firstSeq: nextSeq}
+	queue.segments = append(queue.segments, segment)
+	return segment, nil
+}
+
+// Pop returns the next message of the queue. If no message arrives within
+// the given timeout or if the queue has been closed, nil is returned.
+// The message is committed as soon as it is acknowledged or rejected.
+// Records that cannot be read are skipped and returned as error.
+func (queue *PersistentQueue) Pop(timeout time.Duration) (*Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		msg, err := queue.read()
+		if msg != nil || err != nil {
+			return msg, err
+		}
+
+		select {
+		case <-queue.dataAvailable:
+		case <-timer.C:
+			return nil, nil // ### return, timeout ###
+		}
+	}
+}
+
+// read returns the next unread message or nil if there is none.
+func (queue *PersistentQueue) read() (*Message, error) {
+	queue.guard.Lock()
+	defer queue.guard.Unlock()
+
+	if queue.closed || queue.numUnread == 0 {
+		return nil, nil
+	}
+
+	var segment *persistentSegment
+	for _, segment = range queue.segments {
+		if segment.numRead < segment.numRecords {
+			break
+		}
+	}
+
+	if queue.readSegment != segment {
+		if queue.reader != nil {
+			queue.reader.Close()
+			queue.reader = nil
+		}
+		reader, err := os.Open(queue.getSegmentPath(segment.firstSeq))
+		if err != nil {
+			return nil, err
+		}
+		queue.reader = reader
+		queue.readSegment = segment
+	}
+
+	if _, err := queue.reader.Seek(segment.readOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := readPersistentRecord(queue.reader)
+	if err != nil {
+		// The length of a broken record cannot be trusted, so the rest of the
+		// segment is dropped just like restoreSegment does.
+		skipped := queue.skipSegment(segment)
+		return nil, fmt.Errorf("Skipped %d records of persistent queue %s: %s", skipped, queue.path, err)
+	}
+
+	seq := segment.firstSeq + segment.numRead
+	segment.numRead++
+	segment.readOffset += int64(persistentRecordHeaderSize + len(data))
+	queue.numUnread--
+	queue.uncommitted[seq] = segment
+
+	msg, err := DeserializeMessage(data)
+	if err != nil {
+		queue.commitLocked(seq)
+		return nil, fmt.Errorf("Skipped record %d of persistent queue %s: %s", seq, queue.path, err)
+	}
+
+	msg.SetAckCallback(func(acked bool) {
+		queue.commit(seq)
+	})
+	return msg, nil
+}
+
+// skipSegment marks all unread records of the given segment as committed and
+// returns their number. New records are written to a new segment.
+func (queue *PersistentQueue) skipSegment(segment *persistentSegment) uint64 {
+	skipped := segment.numRecords - segment.numRead
+	segment.numRead = segment.numRecords
+	segment.numCommitted += skipped
+	segment.readOffset = segment.size
+	queue.numUnread -= int(skipped)
+
+	// Records appended to the broken segment would be dropped on restore
+	if segment == queue.segments[len(queue.segments)-1] {
+		queue.addSegment()
+	}
+	queue.removeCommittedSegments()
+	return skipped
+}
+
+// commit marks the given record as processed and removes all segments at
+// the front of the queue that are fully committed.
+func (queue *PersistentQueue) commit(seq uint64) {
+	queue.guard.Lock()
+	defer queue.guard.Unlock()
+	queue.commitLocked(seq)
+}
+
+func (queue *PersistentQueue) commitLocked(seq uint64) {
+	segment, isUncommitted := queue.uncommitted[seq]
+	if !isUncommitted {
+		return // ### return, already committed ###
+	}
+	delete(queue.uncommitted, seq)
+	segment.numCommitted++
+	queue.removeCommittedSegments()
+}
+
+// removeCommittedSegments removes all segments at the front of the queue that
+// are fully committed and updates the checkpoint.
+func (queue *PersistentQueue) removeCommittedSegments() {
+	// The last segment is kept open for writing
+	removed := false
+	for len(queue.segments) > 1 && queue.segments[0].numCommitted == queue.segments[0].numRecords {
+		first := queue.segments[0]
+		if queue.readSegment == first {
+			queue.reader.Close()
+			queue.reader = nil
+			queue.readSegment = nil
+		}
+		os.Remove(queue.getSegmentPath(first.firstSeq))
+		queue.size -= first.size
+		queue.segments = queue.segments[1:]
+		removed = true
+	}
+
+	if removed {
+		queue.writeCheckpoint()
+	}
+}
+
+// GetNumQueued returns the number of messages that have not been returned by
+// Pop yet.
+func (queue *PersistentQueue) GetNumQueued() int {
+	queue.guard.Lock()
+	defer queue.guard.Unlock()
+	return queue.numUnread
+}
+
+// Close releases the queue. When all users of the queue have called Close,
+// pending data is written to disk and the checkpoint is updated. Messages
+// that have been returned by Pop but have not been committed will be read
+// again when the queue is opened the next time.
+func (queue *PersistentQueue) Close() error {
+	persistentQueuesGuard.Lock()
+	defer persistentQueuesGuard.Unlock()
+
+	queue.refCount--
+	if queue.refCount > 0 {
+		return nil // ### return, still in use ###
+	}
+	delete(persistentQueues, queue.path)
+
+	queue.guard.Lock()
+	defer queue.guard.Unlock()
+	queue.closed = true
+
+	if queue.reader != nil {
+		queue.reader.Close()
+	}
+	if queue.writer != nil {
+		queue.writer.Sync()
+		queue.writer.Close()
+	}
+	return queue.writeCheckpoint()
+}
+
+// getCheckpoint returns the sequence number of the first record that has
+// not been committed.
+func (queue *PersistentQueue) getCheckpoint() uint64 {
+	checkpoint := uint64(0)
+	for _, segment := range queue.segments {
+		if segment.numCommitted < segment.numRecords {
+			checkpoint = segment.firstSeq + segment.numRead
+			break
+		}
+		checkpoint = segment.firstSeq + segment.numRecords
+	}
+	for seq := range queue.uncommitted {
+		if seq < checkpoint {
+			checkpoint = seq
+		}
+	}
+	return checkpoint
+}
+
+func (queue *PersistentQueue) readCheckpoint() (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(queue.path, persistentCheckpointFile))
+	switch {
+	case os.IsNotExist(err):
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// writeCheckpoint replaces the checkpoint file so that it is never left
+// partially written.
+func (queue *PersistentQueue) writeCheckpoint() error {
+	if len(queue.segments) == 0 {
+		return nil // ### return, nothing to store ###
+	}
+
+	checkpointPath := filepath.Join(queue.path, persistentCheckpointFile)
+	data := []byte(strconv.FormatUint(queue.getCheckpoint(), 10))
+	if err := ioutil.WriteFile(checkpointPath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(checkpointPath+".tmp", checkpointPath)
+}
+
+func (queue *PersistentQueue) getSegmentPath(firstSeq uint64) string {
+	return filepath.Join(queue.path, fmt.Sprintf("%020d%s", firstSeq, persistentSegmentSuffix))
+}
+
+// readPersistentRecord reads a single record and validates its checksum.
+// io.EOF is returned if there are no more records.
+func readPersistentRecord(reader io.Reader) ([]byte, error) {
+	header := make([]byte, persistentRecordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("Incomplete record header")
+		}
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("Incomplete record: %s", err)
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("Checksum mismatch")
+	}
+	return data, nil
+}
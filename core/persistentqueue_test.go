@@ -0,0 +1,185 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+func pushPersistentTestMessages(expect ttesting.Expect, queue *PersistentQueue, payloads ...string) {
+	for _, payload := range payloads {
+		expect.NoError(queue.Push(NewMessage(nil, []byte(payload), nil, WildcardStreamID)))
+	}
+}
+
+func popPersistentTestMessage(expect ttesting.Expect, queue *PersistentQueue) *Message {
+	msg, err := queue.Pop(time.Second)
+	expect.NoError(err)
+	expect.NotNil(msg)
+	return msg
+}
+
+func TestPersistentQueue(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-persistentqueue")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	queue, err := OpenPersistentQueue(dir, "producer", 1<<20, 1<<20)
+	expect.NoError(err)
+
+	pushPersistentTestMessages(expect, queue, "first", "second", "third")
+	expect.Equal(3, queue.GetNumQueued())
+
+	msg := popPersistentTestMessage(expect, queue)
+	expect.Equal("first", msg.String())
+	expect.Equal(WildcardStreamID, msg.GetStreamID())
+	msg.Acknowledge()
+
+	// Popped but unacknowledged messages are read again after a restart
+	msg = popPersistentTestMessage(expect, queue)
+	expect.Equal("second", msg.String())
+	expect.NoError(queue.Close())
+
+	queue, err = OpenPersistentQueue(dir, "producer", 1<<20, 1<<20)
+	expect.NoError(err)
+	expect.Equal(2, queue.GetNumQueued())
+
+	msg = popPersistentTestMessage(expect, queue)
+	expect.Equal("second", msg.String())
+	msg.Acknowledge()
+	msg = popPersistentTestMessage(expect, queue)
+	expect.Equal("third", msg.String())
+	msg.Acknowledge()
+
+	msg, err = queue.Pop(10 * time.Millisecond)
+	expect.NoError(err)
+	expect.Nil(msg)
+
+	// Queues are shared by the same owner only
+	_, err = OpenPersistentQueue(dir, "other", 1<<20, 1<<20)
+	expect.NotNil(err)
+	shared, err := OpenPersistentQueue(dir, "producer", 1<<20, 1<<20)
+	expect.NoError(err)
+	expect.Equal(queue, shared)
+	expect.NoError(shared.Close())
+
+	expect.NoError(queue.Close())
+}
+
+func TestPersistentQueueSegments(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-persistentqueue")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	data, err := NewMessage(nil, []byte("message0"), nil, WildcardStreamID).Serialize()
+	expect.NoError(err)
+	recordSize := int64(persistentRecordHeaderSize + len(data))
+
+	// Two records fit into a segment, four into the queue
+	queue, err := OpenPersistentQueue(dir, "producer", 4*recordSize, 2*recordSize)
+	expect.NoError(err)
+
+	pushPersistentTestMessages(expect, queue, "message1", "message2", "message3", "message4")
+	expect.NotNil(queue.Push(NewMessage(nil, []byte("message5"), nil, WildcardStreamID)))
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.segment"))
+	expect.Equal(2, len(segments))
+
+	// Segments are removed once all records have been committed, the last
+	// segment is kept for writing.
+	msg1 := popPersistentTestMessage(expect, queue)
+	msg2 := popPersistentTestMessage(expect, queue)
+	msg2.Acknowledge()
+	msg1.Reject()
+
+	segments, _ = filepath.Glob(filepath.Join(dir, "*.segment"))
+	expect.Equal(1, len(segments))
+	pushPersistentTestMessages(expect, queue, "message5")
+	expect.NoError(queue.Close())
+
+	checkpoint, err := ioutil.ReadFile(filepath.Join(dir, "checkpoint"))
+	expect.NoError(err)
+	expect.Equal("2", string(checkpoint))
+}
+
+func TestPersistentQueueCorruption(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-persistentqueue")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	queue, err := OpenPersistentQueue(dir, "producer", 1<<20, 1<<20)
+	expect.NoError(err)
+	pushPersistentTestMessages(expect, queue, "complete", "incomplete")
+	expect.NoError(queue.Close())
+
+	// Simulate a crash while writing the last record
+	segment := filepath.Join(dir, "00000000000000000000.segment")
+	info, err := os.Stat(segment)
+	expect.NoError(err)
+	expect.NoError(os.Truncate(segment, info.Size()-3))
+
+	queue, err = OpenPersistentQueue(dir, "producer", 1<<20, 1<<20)
+	expect.NoError(err)
+	expect.Equal(1, queue.GetNumQueued())
+
+	pushPersistentTestMessages(expect, queue, "next")
+	expect.Equal("complete", popPersistentTestMessage(expect, queue).String())
+	expect.Equal("next", popPersistentTestMessage(expect, queue).String())
+	expect.NoError(queue.Close())
+}
+
+func TestPersistentQueueBrokenRecord(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-persistentqueue")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	queue, err := OpenPersistentQueue(dir, "producer", 1<<20, 1<<20)
+	expect.NoError(err)
+	pushPersistentTestMessages(expect, queue, "broken", "dropped")
+
+	// Break the checksum of the first record while the queue is open
+	segment, err := os.OpenFile(filepath.Join(dir, "00000000000000000000.segment"), os.O_WRONLY, 0644)
+	expect.NoError(err)
+	_, err = segment.WriteAt([]byte{0, 0, 0, 0}, 4)
+	expect.NoError(err)
+	segment.Close()
+
+	// The rest of the segment is skipped, so the queue does not get stuck
+	_, err = queue.Pop(time.Second)
+	expect.NotNil(err)
+	expect.Equal(0, queue.GetNumQueued())
+
+	pushPersistentTestMessages(expect, queue, "next")
+	expect.Equal("next", popPersistentTestMessage(expect, queue).String())
+	expect.NoError(queue.Close())
+
+	// The broken segment has been removed
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.segment"))
+	expect.Equal(1, len(segments))
+}
@@ -0,0 +1,194 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PipelineEdge connects a plugin to a stream.
+type PipelineEdge struct {
+	PluginID string
+	Typename string
+	// Kind is either "consumer", "producer" or "router"
+	Kind string
+	// Key is the config key the stream has been read from
+	Key string
+}
+
+// PipelineStream holds all plugins connected to a single stream.
+type PipelineStream struct {
+	Name string
+	// Router is nil if a fallback router is generated for this stream
+	Router *PipelineEdge
+	// Inputs holds all plugins that may send messages to this stream
+	Inputs []PipelineEdge
+	// Outputs holds all producers listening to this stream
+	Outputs []PipelineEdge
+}
+
+// PipelineGraph describes how the plugins of a config are connected by
+// streams. The graph is created from the streams read by each plugin, so all
+// plugins need to be configured before creating the graph.
+type PipelineGraph struct {
+	// Streams holds all streams sorted by name, except the wildcard stream
+	Streams []PipelineStream
+	// WildcardProducers holds all producers listening to all streams
+	WildcardProducers []PipelineEdge
+}
+
+// NewPipelineGraph creates the graph of all enabled plugins of the given
+// config.
+func NewPipelineGraph(conf *Config) PipelineGraph {
+	graph := PipelineGraph{}
+	streams := make(map[MessageStreamID]*PipelineStream)
+	getStream := func(streamID MessageStreamID) *PipelineStream {
+		stream, exists := streams[streamID]
+		if !exists {
+			stream = &PipelineStream{Name: streamID.GetName()}
+			streams[streamID] = stream
+		}
+		return stream
+	}
+
+	addPlugins := func(configs []PluginConfig, kind string, boundKey string) {
+		for _, config := range configs {
+			for _, key := range getSortedStreamKeys(config) {
+				for _, streamID := range config.GetStreams()[key] {
+					edge := PipelineEdge{config.ID, config.Typename, kind, key}
+					switch {
+					case key != boundKey || kind == "consumer":
+						getStream(streamID).Inputs = append(getStream(streamID).Inputs, edge)
+					case kind == "router":
+						getStream(streamID).Router = &edge
+					case streamID == WildcardStreamID:
+						graph.WildcardProducers = append(graph.WildcardProducers, edge)
+					default:
+						getStream(streamID).Outputs = append(getStream(streamID).Outputs, edge)
+					}
+				}
+			}
+		}
+	}
+
+	addPlugins(conf.GetRouters(), "router", "Stream")
+	addPlugins(conf.GetProducers(), "producer", "Streams")
+	addPlugins(conf.GetConsumers(), "consumer", "Streams")
+
+	for streamID, stream := range streams {
+		if streamID != WildcardStreamID {
+			graph.Streams = append(graph.Streams, *stream)
+		}
+	}
+	sort.Slice(graph.Streams, func(i, j int) bool {
+		return graph.Streams[i].Name < graph.Streams[j].Name
+	})
+	return graph
+}
+
+func getSortedStreamKeys(config PluginConfig) []string {
+	keys := make([]string, 0, len(config.GetStreams()))
+	for key := range config.GetStreams() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Check returns a warning for each stream that discards messages because no
+// producer listens to it, and for each router or producer bound to a stream
+// no plugin sends messages to. Streams used by gollum internally are not
+// checked for senders.
+func (graph PipelineGraph) Check() []string {
+	warnings := []string{}
+	for _, stream := range graph.Streams {
+		if len(stream.Inputs) == 0 {
+			switch GetStreamID(stream.Name) {
+			case LogInternalStreamID, MetricsInternalStreamID, TraceInternalStreamID:
+				continue // ### continue, sent to by gollum ###
+			}
+			if stream.Router != nil {
+				warnings = append(warnings, fmt.Sprintf("Router '%s' is bound to stream '%s' but no plugin sends messages to it",
+					stream.Router.PluginID, stream.Name))
+			}
+			for _, producer := range stream.Outputs {
+				warnings = append(warnings, fmt.Sprintf("Producer '%s' listens to stream '%s' but no plugin sends messages to it",
+					producer.PluginID, stream.Name))
+			}
+			continue
+		}
+
+		// Configured routers may forward messages to streams not known
+		// before runtime, so only generated routers are checked.
+		if stream.Router == nil && len(graph.getOutputs(stream)) == 0 && stream.hasBoundInput() {
+			warnings = append(warnings, fmt.Sprintf("Messages sent to stream '%s' are discarded as no producer listens to it", stream.Name))
+		}
+	}
+	return warnings
+}
+
+// getOutputs returns all producers listening to the given stream including
+// wildcard producers, which do not listen to the internal log and metrics
+// streams.
+func (graph PipelineGraph) getOutputs(stream PipelineStream) []PipelineEdge {
+	switch GetStreamID(stream.Name) {
+	case LogInternalStreamID, MetricsInternalStreamID:
+		return stream.Outputs
+	}
+	return append(append([]PipelineEdge{}, stream.Outputs...), graph.WildcardProducers...)
+}
+
+// hasBoundInput returns true if a consumer is bound to the stream or a router
+// sends messages to it. Other inputs, e.g. modulators, might only send
+// messages to the stream under certain conditions.
+func (stream PipelineStream) hasBoundInput() bool {
+	for _, input := range stream.Inputs {
+		isNested := strings.Contains(input.Key, "/")
+		if (input.Kind == "router" && !isNested) || (input.Kind == "consumer" && input.Key == "Streams") {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the graph as human readable text, listing the inputs ("<-")
+// and outputs ("->") of each stream.
+func (graph PipelineGraph) String() string {
+	buffer := bytes.NewBufferString("")
+	for _, stream := range graph.Streams {
+		if stream.Router == nil {
+			fmt.Fprintf(buffer, "%s (router.Broadcast, generated)\n", stream.Name)
+		} else {
+			fmt.Fprintf(buffer, "%s (%s %s)\n", stream.Name, stream.Router.Typename, stream.Router.PluginID)
+		}
+
+		for _, input := range stream.Inputs {
+			fmt.Fprintf(buffer, "  <- %s\n", input)
+		}
+		for _, output := range graph.getOutputs(stream) {
+			fmt.Fprintf(buffer, "  -> %s\n", output)
+		}
+	}
+	return buffer.String()
+}
+
+// String returns the kind, ID and type of the connected plugin as well as
+// the config key the stream has been read from.
+func (edge PipelineEdge) String() string {
+	return fmt.Sprintf("%s %s (%s) via %s", edge.Kind, edge.PluginID, edge.Typename, edge.Key)
+}
@@ -0,0 +1,111 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/trivago/tgo/ttesting"
+)
+
+func getPipelineStream(graph PipelineGraph, name string) (PipelineStream, bool) {
+	for _, stream := range graph.Streams {
+		if stream.Name == name {
+			return stream, true
+		}
+	}
+	return PipelineStream{}, false
+}
+
+func TestPipelineGraph(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	TypeRegistry.Register(TypeMockA{})
+	TypeRegistry.Register(TypeMockB{})
+	TypeRegistry.Register(TypeMockC{})
+
+	conf, err := ReadConfig([]byte(`
+graphConsumer: {Type: core.TypeMockA, Streams: [graphIn, graphDiscarded]}
+graphRouter: {Type: core.TypeMockB, Stream: graphIn}
+graphProducer: {Type: core.TypeMockC, Streams: graphIn, FallbackStream: graphFallback}
+graphOrphan: {Type: core.TypeMockC, Streams: graphNowhere}
+graphLog: {Type: core.TypeMockC, Streams: _GOLLUM_}
+graphDisabled: {Type: core.TypeMockC, Streams: graphDisabled, Enable: false}
+`))
+	expect.NoError(err)
+
+	// Streams are only known after plugins have been configured
+	graph := NewPipelineGraph(conf)
+	expect.Equal(0, len(graph.Streams))
+
+	// Read streams like the simple plugins do when being configured
+	for _, config := range conf.Plugins {
+		reader := NewPluginConfigReaderWithError(&config)
+		_, err := reader.GetStreamID("Stream", InvalidStreamID)
+		expect.NoError(err)
+		_, err = reader.GetStreamArray("Streams", []MessageStreamID{})
+		expect.NoError(err)
+		_, err = reader.GetStreamID("FallbackStream", InvalidStreamID)
+		expect.NoError(err)
+	}
+
+	graph = NewPipelineGraph(conf)
+	expect.Equal(5, len(graph.Streams))
+	expect.Equal("_GOLLUM_", graph.Streams[0].Name)
+
+	stream, found := getPipelineStream(graph, "graphIn")
+	expect.True(found)
+	expect.NotNil(stream.Router)
+	expect.Equal("graphRouter", stream.Router.PluginID)
+	expect.Equal(1, len(stream.Inputs))
+	expect.Equal(PipelineEdge{"graphConsumer", "core.TypeMockA", "consumer", "Streams"}, stream.Inputs[0])
+	expect.Equal(1, len(stream.Outputs))
+	expect.Equal("graphProducer", stream.Outputs[0].PluginID)
+
+	stream, found = getPipelineStream(graph, "graphFallback")
+	expect.True(found)
+	expect.Nil(stream.Router)
+	expect.Equal(PipelineEdge{"graphProducer", "core.TypeMockC", "producer", "FallbackStream"}, stream.Inputs[0])
+
+	_, found = getPipelineStream(graph, "graphDisabled")
+	expect.False(found)
+
+	expect.Equal([]string{
+		"Messages sent to stream 'graphDiscarded' are discarded as no producer listens to it",
+		"Producer 'graphOrphan' listens to stream 'graphNowhere' but no plugin sends messages to it",
+	}, graph.Check())
+
+	expect.True(strings.Contains(graph.String(), "graphIn (core.TypeMockB graphRouter)\n"+
+		"  <- consumer graphConsumer (core.TypeMockA) via Streams\n"+
+		"  -> producer graphProducer (core.TypeMockC) via Streams\n"))
+}
+
+func TestPipelineGraphWildcard(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	graph := PipelineGraph{
+		Streams: []PipelineStream{
+			{Name: "_GOLLUM_"},
+			{Name: "wildcardIn", Inputs: []PipelineEdge{{"consumer", "core.TypeMockA", "consumer", "Streams"}}},
+		},
+		WildcardProducers: []PipelineEdge{{"producer", "core.TypeMockC", "producer", "Streams"}},
+	}
+
+	// Wildcard producers do not listen to internal streams
+	expect.Equal(0, len(graph.getOutputs(graph.Streams[0])))
+	expect.Equal(1, len(graph.getOutputs(graph.Streams[1])))
+	expect.Equal(0, len(graph.Check()))
+}
@@ -61,16 +61,6 @@ const (
 )
 
 var (
-	// Has to be index parallel to PluginState*
-	stateToMetric = []string{
-		MetricPluginsInit,
-		MetricPluginsWaiting,
-		MetricPluginsActive,
-		MetricPluginsPrepareStop,
-		MetricPluginsStopping,
-		MetricPluginsDead,
-	}
-
 	// Has to be index parallel to PluginState*
 	stateToDescription = []string{
 		"Initializing",
@@ -132,7 +122,7 @@ func (state *PluginRunState) SetState(nextState PluginState) {
 	prevState := PluginState(atomic.SwapInt32(&state.state, int32(nextState)))
 
 	if nextState != prevState {
-		state.metric.UpdateStateMetric(stateToMetric[prevState], stateToMetric[nextState])
+		state.metric.UpdateStateMetric(prevState, nextState)
 	}
 }
 
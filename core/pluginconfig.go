@@ -15,6 +15,8 @@
 package core
 
 import (
+	"fmt"
+
 	"github.com/arbovm/levenshtein"
 	"github.com/sirupsen/logrus"
 	"github.com/trivago/tgo"
@@ -29,6 +31,7 @@ type PluginConfig struct {
 	Enable    bool
 	Settings  tcontainer.MarshalMap
 	validKeys map[string]bool
+	streams   map[string][]MessageStreamID
 }
 
 // NewPluginConfig creates a new plugin config with default values.
@@ -42,6 +45,7 @@ func NewPluginConfig(pluginID string, defaultTypename string) PluginConfig {
 		Typename:  defaultTypename,
 		Settings:  tcontainer.NewMarshalMap(),
 		validKeys: make(map[string]bool),
+		streams:   make(map[string][]MessageStreamID),
 	}
 }
 
@@ -90,8 +94,41 @@ func (conf *PluginConfig) registerKey(key string) string {
 	return key
 }
 
+// registerStreams stores the streams read from the given key. Invalid
+// streams are ignored.
+func (conf *PluginConfig) registerStreams(key string, streamIDs ...MessageStreamID) {
+	if conf.streams == nil {
+		return // ### return, not created by NewPluginConfig ###
+	}
+	validIDs := make([]MessageStreamID, 0, len(streamIDs))
+	for _, streamID := range streamIDs {
+		if streamID != InvalidStreamID {
+			validIDs = append(validIDs, streamID)
+		}
+	}
+	if len(validIDs) > 0 {
+		conf.streams[key] = validIDs
+	}
+}
+
+// registerNestedStreams stores the streams read by a nested plugin config
+// as "key/typename/nestedKey", e.g. "Modulators[0]/filter.Stream/Only".
+func (conf *PluginConfig) registerNestedStreams(key string, nested PluginConfig) {
+	for nestedKey, streamIDs := range nested.streams {
+		conf.registerStreams(fmt.Sprintf("%s/%s/%s", key, nested.Typename, nestedKey), streamIDs...)
+	}
+}
+
+// GetStreams returns all streams read from this config by key. Streams read
+// by nested plugins, e.g. modulators, are stored as "key/typename/nestedKey".
+// Streams are only known after a plugin has been configured with this config.
+func (conf PluginConfig) GetStreams() map[string][]MessageStreamID {
+	return conf.streams
+}
+
 func (conf PluginConfig) suggestKey(searchKey string) string {
-	closestDist := len(searchKey)
+	// Only suggest keys that are reasonably close to avoid misleading hints
+	closestDist := len(searchKey)/2 + 1
 	bestMatch := ""
 	searchKeyLower := strings.ToLower(searchKey)
 
@@ -121,7 +158,7 @@ func (conf PluginConfig) Validate() error {
 			if suggestion := conf.suggestKey(key); suggestion != "" {
 				errors.Pushf("Unknown configuration key '%s' in '%s'. Did you mean '%s'?", key, conf.Typename, suggestion)
 			} else {
-				errors.Pushf("Unknown configuration key '%s' in '%s", key, conf.Typename)
+				errors.Pushf("Unknown configuration key '%s' in '%s'", key, conf.Typename)
 			}
 		}
 	}
@@ -128,6 +128,14 @@ func (reader *PluginConfigReader) GetUint(key string, defaultValue uint64) uint6
 	return value
 }
 
+// GetFloat tries to read a float value from a PluginConfig.
+// If that value is not found defaultValue is returned.
+func (reader *PluginConfigReader) GetFloat(key string, defaultValue float64) float64 {
+	value, err := reader.WithError.GetFloat(key, defaultValue)
+	reader.Errors.Push(err)
+	return value
+}
+
 // GetBool tries to read a boolean value from a PluginConfig.
 // If that value is not found defaultValue is returned.
 func (reader *PluginConfigReader) GetBool(key string, defaultValue bool) bool {
@@ -331,6 +339,9 @@ func (reader *PluginConfigReader) configureField(fieldVal reflect.Value, key str
 		}
 		treflect.SetValue(fieldVal, value)
 
+	case reflect.Float32, reflect.Float64:
+		treflect.SetValue(fieldVal, reader.GetFloat(key, tags.GetFloat()))
+
 	case reflect.Array, reflect.Slice:
 		reader.configureArrayField(fieldVal, key, tags, logger)
 
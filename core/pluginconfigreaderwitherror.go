@@ -21,6 +21,7 @@ import (
 	"github.com/trivago/tgo/tcontainer"
 	"github.com/trivago/tgo/tstrings"
 	"net/url"
+	"strconv"
 )
 
 // PluginConfigReaderWithError is a read-only wrapper on top of a plugin config
@@ -130,6 +131,9 @@ func (reader PluginConfigReaderWithError) GetUint(key string, defaultValue uint6
 func (reader PluginConfigReaderWithError) GetFloat(key string, defaultValue float64) (float64, error) {
 	key = reader.config.registerKey(key)
 	if reader.HasValue(key) {
+		if strVal, err := reader.config.Settings.String(key); err == nil {
+			return strconv.ParseFloat(strVal, 64) // Allow string to number conversion
+		}
 		return reader.config.Settings.Float(key)
 	}
 	return defaultValue, nil
@@ -165,8 +169,11 @@ func (reader PluginConfigReaderWithError) GetStreamID(key string, defaultValue M
 		if err != nil {
 			return InvalidStreamID, err
 		}
-		return GetStreamID(value), nil
+		streamID := GetStreamID(value)
+		reader.config.registerStreams(key, streamID)
+		return streamID, nil
 	}
+	reader.config.registerStreams(key, defaultValue)
 	return defaultValue, nil
 }
 
@@ -194,7 +201,9 @@ func (reader PluginConfigReaderWithError) GetPlugin(key string, defaultType stri
 	if err != nil {
 		return nil, err
 	}
-	return NewPluginWithConfig(config)
+	plugin, err := NewPluginWithConfig(config)
+	reader.config.registerNestedStreams(key, config)
+	return plugin, err
 }
 
 // GetArray tries to read a untyped array from a PluginConfig.
@@ -234,7 +243,8 @@ func (reader PluginConfigReaderWithError) GetPluginArray(key string, defaultValu
 
 	// Iterate over all entries in the array.
 	// An entry can either be a string or a string -> map[string]interface{}
-	for _, typedConfigInterface := range namedConfigs {
+	for index, typedConfigInterface := range namedConfigs {
+		nestedKey := fmt.Sprintf("%s[%d]", key, index)
 		typedConfigMap := tcontainer.TryConvertToMarshalMap(typedConfigInterface, nil)
 		typedConfig, isMap := typedConfigMap.(tcontainer.MarshalMap)
 
@@ -247,6 +257,7 @@ func (reader PluginConfigReaderWithError) GetPluginArray(key string, defaultValu
 			// Only string given, initialize with empty config
 			pluginConfig, _ := NewNestedPluginConfig(typeNameStr, tcontainer.NewMarshalMap())
 			plugin, err := NewPluginWithConfig(pluginConfig)
+			reader.config.registerNestedStreams(nestedKey, pluginConfig)
 			if err != nil {
 				return nil, err
 			}
@@ -263,6 +274,7 @@ func (reader PluginConfigReaderWithError) GetPluginArray(key string, defaultValu
 
 			pluginConfig, _ := NewNestedPluginConfig(typename, configMap)
 			plugin, err := NewPluginWithConfig(pluginConfig)
+			reader.config.registerNestedStreams(nestedKey, pluginConfig)
 			if err != nil {
 				return pluginArray, err
 			}
@@ -399,9 +411,11 @@ func (reader PluginConfigReaderWithError) GetStreamArray(key string, defaultValu
 		for _, streamName := range values {
 			streamArray = append(streamArray, GetStreamID(streamName))
 		}
+		reader.config.registerStreams(key, streamArray...)
 		return streamArray, nil
 	}
 
+	reader.config.registerStreams(key, defaultValue...)
 	return defaultValue, nil
 }
 
@@ -443,6 +457,7 @@ func (reader PluginConfigReaderWithError) GetStreamRoutes(key string, defaultVal
 		return nil, err
 	}
 
+	allTargetIds := []MessageStreamID{}
 	for sourceName, targets := range value {
 		sourceStream := GetStreamID(sourceName)
 		targetIds := []MessageStreamID{}
@@ -451,7 +466,9 @@ func (reader PluginConfigReaderWithError) GetStreamRoutes(key string, defaultVal
 		}
 
 		streamRoute[sourceStream] = targetIds
+		allTargetIds = append(allTargetIds, targetIds...)
 	}
+	reader.config.registerStreams(key, allTargetIds...)
 
 	return streamRoute, nil
 }
@@ -27,6 +27,7 @@ type testPluginAutoConfig struct {
 	IntValue       int64             `config:"intValue"`
 	UintValue      uint64            `config:"uintValue"`
 	OctValue       int64             `config:"octValue"`
+	FloatValue     float64           `config:"floatValue"`
 	DurationValue  time.Duration     `config:"durationValue" metric:"sec"`
 	MbValue        int64             `config:"mbValue" metric:"kb"`
 	StringValue    string            `config:"stringValue"`
@@ -64,6 +65,7 @@ func TestConfigReaderAutoConfig(t *testing.T) {
 	values["intValue"] = int64(-1)
 	values["uintValue"] = uint64(2)
 	values["octValue"] = "017"
+	values["floatValue"] = 0.5
 	values["durationValue"] = int64(3)
 	values["mbValue"] = int64(4)
 	values["stringValue"] = "test"
@@ -100,6 +102,7 @@ func TestConfigReaderAutoConfig(t *testing.T) {
 	expect.Equal(int64(-1), myStruct.IntValue)
 	expect.Equal(uint64(2), myStruct.UintValue)
 	expect.Equal(int64(15), myStruct.OctValue)
+	expect.Equal(0.5, myStruct.FloatValue)
 	expect.Equal(3*time.Second, myStruct.DurationValue)
 	expect.Equal(int64(4096), myStruct.MbValue)
 	expect.Equal("test", myStruct.StringValue)
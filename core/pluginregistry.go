@@ -15,6 +15,7 @@
 package core
 
 import (
+	"sort"
 	"sync"
 )
 
@@ -43,6 +44,13 @@ func (registry *pluginRegistry) RegisterUnique(plugin Plugin, ID string) bool {
 	return false
 }
 
+// Unregister removes the plugin with the given ID from the registry.
+func (registry *pluginRegistry) Unregister(ID string) {
+	registry.guard.Lock()
+	delete(registry.plugins, ID)
+	registry.guard.Unlock()
+}
+
 // GetPlugin returns a plugin by name or nil if not found.
 func (registry *pluginRegistry) GetPlugin(ID string) Plugin {
 	registry.guard.RLock()
@@ -63,3 +71,16 @@ func (registry *pluginRegistry) GetPluginWithState(ID string) PluginWithState {
 	}
 	return nil
 }
+
+// GetPluginIDs returns the sorted IDs of all registered plugins.
+func (registry *pluginRegistry) GetPluginIDs() []string {
+	registry.guard.RLock()
+	IDs := make([]string, 0, len(registry.plugins))
+	for ID := range registry.plugins {
+		IDs = append(IDs, ID)
+	}
+	registry.guard.RUnlock()
+
+	sort.Strings(IDs)
+	return IDs
+}
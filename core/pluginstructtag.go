@@ -77,6 +77,21 @@ func (tag PluginStructTag) GetUint() uint64 {
 	return value
 }
 
+// GetFloat returns the default float value for an auto configured field.
+// When not set, 0 is returned.
+func (tag PluginStructTag) GetFloat() float64 {
+	tagValue, tagSet := reflect.StructTag(tag).Lookup(PluginStructTagDefault)
+	if !tagSet || len(tagValue) == 0 {
+		return 0
+	}
+
+	value, err := strconv.ParseFloat(tagValue, 64)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
 // GetString returns the default string value for an auto configured field.
 // When not set, "" is returned.
 func (tag PluginStructTag) GetString() string {
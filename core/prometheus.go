@@ -0,0 +1,315 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/trivago/tgo"
+)
+
+// prometheusPrefix is prepended to all exported metric names.
+const prometheusPrefix = "gollum_"
+
+// prometheusRule maps flat metric names matching expression to a prometheus
+// metric. The submatches of expression are used as values of labels.
+type prometheusRule struct {
+	expression *regexp.Regexp
+	name       string
+	labels     []string
+	counter    bool
+}
+
+// prometheusRules is checked in order, the first matching rule is used.
+// Metrics not matching any rule are converted by prometheusFallback.
+// Typed metrics from MetricRegistry are exported directly.
+var prometheusRules = []prometheusRule{
+	{regexp.MustCompile(`^Router:(.+):Target:(.+):Messages$`), "router_target_messages", []string{"plugin_id", "stream"}, true},
+	{regexp.MustCompile(`^RateLimited-(.+)$`), "rate_limited_messages", []string{"stream"}, true},
+	{regexp.MustCompile(`^RateLimitedSecAgo-(.+)$`), "rate_limited_seconds_ago", []string{"stream"}, false},
+	{regexp.MustCompile(`^Deduplicated-(.+)$`), "deduplicated_messages", []string{"stream"}, true},
+}
+
+// prometheusFallback splits names like "Spooling:ReadSec-stream" into the
+// metric name and a value used as "key" label.
+var prometheusFallback = regexp.MustCompile(`^([\w:]+?)(?:-(.+))?$`)
+
+// prometheusSample is a single value of a prometheus metric.
+type prometheusSample struct {
+	labels string
+	value  int64
+}
+
+// prometheusMetric is a named set of samples sharing the same type.
+type prometheusMetric struct {
+	counter bool
+	samples []prometheusSample
+}
+
+// PrometheusHandler is an http.Handler writing all metrics and the state of
+// all registered plugins in the prometheus text exposition format.
+type PrometheusHandler struct{}
+
+// ServeHTTP writes the current metrics to the response.
+func (handler PrometheusHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	dump, err := tgo.Metric.Dump()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	snapshot := make(map[string]int64)
+	if err := json.Unmarshal(dump, &snapshot); err != nil {
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WritePrometheusRegistry(response)
+	WritePrometheusMetrics(response, snapshot)
+	WritePrometheusPluginStates(response)
+}
+
+// WritePrometheusRegistry writes all typed metrics of MetricRegistry in the
+// prometheus text exposition format. Metric names are prefixed with "gollum_"
+// and counters end with "_total".
+func WritePrometheusRegistry(writer io.Writer) {
+	lastName := ""
+	for _, metric := range getSortedRegistryMetrics() {
+		name := prometheusPrefix + metric.GetName()
+		if metric.GetType() == MetricTypeCounter {
+			name += "_total"
+		}
+		if name != lastName {
+			fmt.Fprintf(writer, "# TYPE %s %s\n", name, getPrometheusType(metric.GetType()))
+			lastName = name
+		}
+
+		names, values := getSortedLabels(metric.GetLabels())
+		labels := formatPrometheusLabels(names, values)
+
+		if metric.GetType() != MetricTypeHistogram {
+			fmt.Fprintf(writer, "%s%s %d\n", name, labels, metric.get())
+			continue
+		}
+
+		snapshot := metric.histogram.GetSnapshot()
+		for i, bound := range snapshot.Buckets {
+			bucketLabels := formatPrometheusLabels(append(names, "le"), append(values, strconv.FormatFloat(bound, 'g', -1, 64)))
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", name, bucketLabels, snapshot.Counts[i])
+		}
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", name, formatPrometheusLabels(append(names, "le"), append(values, "+Inf")), snapshot.Count)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(snapshot.Sum, 'g', -1, 64))
+		fmt.Fprintf(writer, "%s_count%s %d\n", name, labels, snapshot.Count)
+	}
+}
+
+// registryMetric is a typed metric of MetricRegistry. histogram is only set
+// for metrics of type MetricTypeHistogram.
+type registryMetric struct {
+	Metric
+	histogram *Histogram
+}
+
+// getSortedRegistryMetrics returns all typed metrics sorted by name and key,
+// so samples of the same metric are written as one block.
+func getSortedRegistryMetrics() []registryMetric {
+	var metrics []registryMetric
+	for _, metric := range MetricRegistry.GetMetrics() {
+		switch typed := metric.(type) {
+		case *Counter:
+			metrics = append(metrics, registryMetric{Metric: typed.Metric})
+		case *Gauge:
+			metrics = append(metrics, registryMetric{Metric: typed.Metric})
+		case *Rate:
+			metrics = append(metrics, registryMetric{Metric: typed.Metric})
+		case *Histogram:
+			metrics = append(metrics, registryMetric{Metric: typed.Metric, histogram: typed})
+		}
+	}
+
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].GetName() < metrics[j].GetName()
+	})
+	return metrics
+}
+
+func getPrometheusType(metricType MetricType) string {
+	switch metricType {
+	case MetricTypeCounter:
+		return "counter"
+	case MetricTypeHistogram:
+		return "histogram"
+	default:
+		return "gauge"
+	}
+}
+
+func getSortedLabels(labels MetricLabels) ([]string, []string) {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
+	}
+	return names, values
+}
+
+// WritePrometheusMetrics converts the given flat metrics to prometheus
+// metrics and writes them in the text exposition format. Metrics registered
+// in MetricRegistry are skipped, use WritePrometheusRegistry to write them.
+// Metric names are prefixed with "gollum_" and counters end with "_total".
+// Stream, plugin and filter names are exported as labels.
+func WritePrometheusMetrics(writer io.Writer, snapshot map[string]int64) {
+	metrics := make(map[string]*prometheusMetric)
+	for key, value := range snapshot {
+		if MetricRegistry.IsRegistered(key) {
+			continue
+		}
+		name, labels, counter := getPrometheusName(key)
+		metric, exists := metrics[name]
+		if !exists {
+			metric = &prometheusMetric{counter: counter}
+			metrics[name] = metric
+		}
+		metric.samples = append(metric.samples, prometheusSample{labels, value})
+	}
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		metric := metrics[name]
+		metricType := "gauge"
+		if metric.counter {
+			metricType = "counter"
+		}
+		sort.Slice(metric.samples, func(i, j int) bool {
+			return metric.samples[i].labels < metric.samples[j].labels
+		})
+
+		fmt.Fprintf(writer, "# TYPE %s %s\n", name, metricType)
+		for _, sample := range metric.samples {
+			fmt.Fprintf(writer, "%s%s %d\n", name, sample.labels, sample.value)
+		}
+	}
+}
+
+// WritePrometheusPluginStates writes the state of all registered plugins as
+// "gollum_plugin_state" metric. The value is the numeric PluginState, i.e.
+// 2 for active plugins.
+func WritePrometheusPluginStates(writer io.Writer) {
+	IDs := PluginRegistry.GetPluginIDs()
+	if len(IDs) == 0 {
+		return // ### return, nothing to write ###
+	}
+
+	name := prometheusPrefix + "plugin_state"
+	fmt.Fprintf(writer, "# TYPE %s gauge\n", name)
+	for _, ID := range IDs {
+		plugin := PluginRegistry.GetPluginWithState(ID)
+		if plugin == nil {
+			continue
+		}
+
+		names := []string{"plugin_id", "plugin_type"}
+		values := []string{ID, strings.TrimPrefix(fmt.Sprintf("%T", plugin), "*")}
+		if withStream, hasStream := plugin.(interface{ GetStreamID() MessageStreamID }); hasStream {
+			names = append(names, "stream")
+			values = append(values, StreamRegistry.GetStreamName(withStream.GetStreamID()))
+		}
+		fmt.Fprintf(writer, "%s%s %d\n", name, formatPrometheusLabels(names, values), plugin.GetState())
+	}
+}
+
+// getPrometheusName returns the prometheus name, the formatted labels and the
+// type of the given flat metric name.
+func getPrometheusName(key string) (string, string, bool) {
+	for _, rule := range prometheusRules {
+		if match := rule.expression.FindStringSubmatch(key); match != nil {
+			name := prometheusPrefix + rule.name
+			if rule.counter {
+				name += "_total"
+			}
+			return name, formatPrometheusLabels(rule.labels, match[1:]), rule.counter
+		}
+	}
+
+	match := prometheusFallback.FindStringSubmatch(key)
+	if match == nil {
+		return prometheusPrefix + toPrometheusName(key), "", false
+	}
+	name := prometheusPrefix + toPrometheusName(match[1])
+	if match[2] == "" {
+		return name, "", false
+	}
+	return name, formatPrometheusLabels([]string{"key"}, match[2:]), false
+}
+
+// toPrometheusName converts a name like "Spooling:ReadSec" to snake case,
+// i.e. "spooling_read_sec".
+func toPrometheusName(key string) string {
+	name := bytes.Buffer{}
+	lastWasLower := false
+	for _, char := range key {
+		switch {
+		case unicode.IsUpper(char):
+			if lastWasLower {
+				name.WriteByte('_')
+			}
+			name.WriteRune(unicode.ToLower(char))
+			lastWasLower = false
+		case unicode.IsLetter(char) || unicode.IsDigit(char):
+			name.WriteRune(char)
+			lastWasLower = true
+		default:
+			if name.Len() > 0 && name.Bytes()[name.Len()-1] != '_' {
+				name.WriteByte('_')
+			}
+			lastWasLower = false
+		}
+	}
+	return strings.TrimSuffix(name.String(), "_")
+}
+
+// formatPrometheusLabels returns the label set {name="value",...} with all
+// values escaped.
+func formatPrometheusLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labels := make([]string, len(names))
+	for i, name := range names {
+		labels[i] = fmt.Sprintf(`%s="%s"`, name, escape.Replace(values[i]))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
@@ -0,0 +1,93 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/trivago/tgo"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestPrometheusNames(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	name, labels, counter := getPrometheusName("Deduplicated-foo")
+	expect.Equal("gollum_deduplicated_messages_total", name)
+	expect.Equal(`{stream="foo"}`, labels)
+	expect.True(counter)
+
+	name, labels, _ = getPrometheusName("Router:split:Target:bar:Messages")
+	expect.Equal("gollum_router_target_messages_total", name)
+	expect.Equal(`{plugin_id="split",stream="bar"}`, labels)
+
+	name, labels, counter = getPrometheusName("Kafka:AvgRoundtripMs-my-topic")
+	expect.Equal("gollum_kafka_avg_roundtrip_ms", name)
+	expect.Equal(`{key="my-topic"}`, labels)
+	expect.False(counter)
+
+	name, labels, _ = getPrometheusName("GoMemoryAllocated")
+	expect.Equal("gollum_go_memory_allocated", name)
+	expect.Equal("", labels)
+
+	expect.Equal(`{a="x\"y\\z"}`, formatPrometheusLabels([]string{"a"}, []string{`x"y\z`}))
+}
+
+func TestPrometheusWrite(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	buffer := bytes.Buffer{}
+	WritePrometheusMetrics(&buffer, map[string]int64{
+		"Deduplicated-b":        4,
+		"Deduplicated-a":        6,
+		"Scribe:WindowSize":     10,
+		"messages{state=routed}": 1,
+	})
+
+	expect.Equal(
+		"# TYPE gollum_deduplicated_messages_total counter\n"+
+			"gollum_deduplicated_messages_total{stream=\"a\"} 6\n"+
+			"gollum_deduplicated_messages_total{stream=\"b\"} 4\n"+
+			"# TYPE gollum_scribe_window_size gauge\n"+
+			"gollum_scribe_window_size 10\n",
+		buffer.String())
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	NewCounter("prometheus_test", MetricLabels{"stream": "test"}).Add(3)
+	NewHistogram("prometheus_test_seconds", nil, []float64{1, 2}).Observe(1.5)
+	tgo.Metric.New("Prometheus:Test-key")
+
+	response := httptest.NewRecorder()
+	PrometheusHandler{}.ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+
+	expect.Equal(200, response.Code)
+	body := response.Body.String()
+	expect.True(strings.Contains(body, "# TYPE gollum_prometheus_test_total counter\n"+
+		"gollum_prometheus_test_total{stream=\"test\"} 3\n"))
+	expect.True(strings.Contains(body, "# TYPE gollum_prometheus_test_seconds histogram\n"+
+		"gollum_prometheus_test_seconds_bucket{le=\"1\"} 0\n"+
+		"gollum_prometheus_test_seconds_bucket{le=\"2\"} 1\n"+
+		"gollum_prometheus_test_seconds_bucket{le=\"+Inf\"} 1\n"+
+		"gollum_prometheus_test_seconds_sum 1.5\n"+
+		"gollum_prometheus_test_seconds_count 1\n"))
+	expect.True(strings.Contains(body, "gollum_prometheus_test{key=\"key\"} 0\n"))
+	expect.False(strings.Contains(body, "prometheus_test{stream=test}"))
+}
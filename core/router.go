@@ -33,6 +33,10 @@ type Router interface {
 	// listening to messages on this stream.
 	AddProducer(producers ...Producer)
 
+	// RemoveProducer removes one or more producers from this stream, e.g.
+	// when a producer is stopped during a config reload.
+	RemoveProducer(producers ...Producer)
+
 	// Enqueue sends a given message to all registered end points.
 	// This function is called by Route() which should be preferred over this
 	// function when sending messages.
@@ -45,14 +49,42 @@ type Router interface {
 	Start() error
 }
 
+// RouterRoller is an optional interface for routers that need to react to
+// roll requests, e.g. to reload external resources.
+type RouterRoller interface {
+	// Roll is called when gollum receives a roll signal.
+	Roll()
+}
+
+// RouterStopper is an optional interface for routers that run background
+// tasks, e.g. to reload external resources periodically.
+type RouterStopper interface {
+	// Stop is called when the router is removed by a config reload or when
+	// gollum shuts down.
+	Stop()
+}
+
+// AtLeastOnceRouter is an optional interface for routers that can require
+// messages to be accepted by all producers they are passed to.
+type AtLeastOnceRouter interface {
+	// IsAtLeastOnce returns true if messages routed to this stream have to be
+	// accepted by all producers. See Message.RequireAllAcks.
+	IsAtLeastOnce() bool
+}
+
 // Route tries to enqueue a message to the given stream. This function also
 // handles redirections enforced by formatters.
 func Route(msg *Message, router Router) error {
 	if router == nil {
 		DiscardMessage(msg, "nil", fmt.Sprintf("Router for stream %s is nil", msg.GetStreamID().GetName()))
+		msg.Reject()
 		return nil
 	}
 
+	if ackRouter, isAckRouter := router.(AtLeastOnceRouter); isAckRouter && ackRouter.IsAtLeastOnce() {
+		msg.RequireAllAcks()
+	}
+
 	action := router.Modulate(msg)
 
 	streamName := msg.GetStreamID().GetName()
@@ -62,6 +94,7 @@ func Route(msg *Message, router Router) error {
 	case ModulateResultDiscard:
 		streamMetric.CountMessageDiscarded()
 		DiscardMessage(msg, router.GetID(), "Router discarded")
+		msg.Acknowledge()
 		return nil
 
 	case ModulateResultContinue:
@@ -69,7 +102,13 @@ func Route(msg *Message, router Router) error {
 		CountMessageRouted()
 		MessageTrace(msg, router.GetID(), "Routed")
 
-		return router.Enqueue(msg)
+		// Messages that require all producers to accept them must not get lost
+		// without notice, e.g. if no producer listens to the stream.
+		err := router.Enqueue(msg)
+		if err != nil && msg.RequiresAllAcks() {
+			msg.Reject()
+		}
+		return err
 
 	case ModulateResultFallback:
 		if msg.GetStreamID() == router.GetStreamID() {
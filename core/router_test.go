@@ -147,3 +147,30 @@ func TestRouteOriginal(t *testing.T) {
 	expect.Equal("foo", mockB.lastMessageData)
 
 }
+
+func TestRouterProducersConcurrentUpdate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	router := getMockRouter()
+	first := getMockBufferedProducer()
+	second := getMockBufferedProducer()
+
+	router.AddProducer(&first)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			router.AddProducer(&second)
+			router.RemoveProducer(&second)
+			StreamRegistry.RegisterWildcardProducer(&second)
+			StreamRegistry.UnregisterWildcardProducer(&second)
+		}
+	}()
+
+	// Lists returned to routing code are not modified by later updates
+	for i := 0; i < 100; i++ {
+		producers := router.GetProducers()
+		expect.Equal(Producer(&first), producers[0])
+		StreamRegistry.AddWildcardProducersToRouter(&router)
+	}
+	<-done
+}
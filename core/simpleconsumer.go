@@ -15,7 +15,6 @@
 package core
 
 import (
-	"fmt"
 	"sync"
 	"time"
 
@@ -58,6 +57,33 @@ import (
 // before they are fetched by the next free modulator go routine. If the
 // ModulatorRoutines parameter is set to 0 this parameter is ignored.
 // By default this parameter is set to 1024.
+//
+// - Aggregate/Pattern: Defines a regular expression used to join continuation
+// lines, e.g. the lines of a stack trace, into single messages. See
+// MultilineAggregator for details. Aggregation is applied to all
+// messages enqueued without a stream or ack callback. Lines of all sources of
+// a consumer are joined by the same aggregator, so consumers reading from
+// multiple sources should use their own MultilineAggregator per source.
+// Aggregation is disabled when empty.
+// By default this parameter is set to "".
+//
+// - Aggregate/Negate: Set to true to invert the result of Aggregate/Pattern.
+// By default this parameter is set to false.
+//
+// - Aggregate/What: Defines if lines matching Aggregate/Pattern belong to the
+// "previous" or the "next" line.
+// By default this parameter is set to "previous".
+//
+// - Aggregate/Delimiter: Defines the string inserted between joined lines.
+// By default this parameter is set to "\n".
+//
+// - Aggregate/MaxLines: Defines the maximum number of lines joined into one
+// message. Set to 0 to disable this limit.
+// By default this parameter is set to 500.
+//
+// - Aggregate/FlushTimeoutMs: Defines the time in milliseconds after which a
+// pending message is sent if no further line has been received.
+// By default this parameter is set to 1000.
 type SimpleConsumer struct {
 	id              string
 	control         chan PluginControl
@@ -69,6 +95,8 @@ type SimpleConsumer struct {
 	onStop          func()
 	enqueueMessage  func(*Message)
 	modulatorQueue  MessageQueue
+	multiline       *MultilineAggregator
+	atLeastOnce     bool
 	Logger          logrus.FieldLogger
 	shutdownTimeout time.Duration `config:"ShutdownTimeoutMs" default:"1000" metric:"ms"`
 }
@@ -94,15 +122,32 @@ func (cons *SimpleConsumer) Configure(conf PluginConfigReader) {
 		cons.enqueueMessage = cons.directEnqueue
 	}
 
+	if modulator := cons.modulators.GetStreamBound(); modulator != nil {
+		conf.Errors.Pushf("%T requires messages routed to a stream and cannot be used by consumers", modulator)
+	}
+
+	for _, router := range cons.routers {
+		if ackRouter, isAckRouter := router.(AtLeastOnceRouter); isAckRouter && ackRouter.IsAtLeastOnce() {
+			cons.atLeastOnce = true
+		}
+	}
+
+	if pattern := conf.GetString("Aggregate/Pattern", ""); pattern != "" {
+		var err error
+		cons.multiline, err = NewMultilineAggregator(MultilineConfig{
+			Pattern:      pattern,
+			Negate:       conf.GetBool("Aggregate/Negate", false),
+			What:         conf.GetString("Aggregate/What", "previous"),
+			Delimiter:    []byte(conf.GetString("Aggregate/Delimiter", "\n")),
+			MaxLines:     int(conf.GetInt("Aggregate/MaxLines", 500)),
+			FlushTimeout: time.Duration(conf.GetInt("Aggregate/FlushTimeoutMs", 1000)) * time.Millisecond,
+		}, cons.enqueueJoined)
+		conf.Errors.Push(err)
+	}
+
 	// Simple health check for the plugin state
 	//   Path: "/<plugin_id>/pluginState"
-	cons.AddHealthCheckAt("/pluginState", func() (code int, body string) {
-		if cons.IsActive() {
-			return thealthcheck.StatusOK, fmt.Sprintf("ACTIVE: %s", cons.runState.GetStateString())
-		}
-		return thealthcheck.StatusServiceUnavailable,
-			fmt.Sprintf("NOT_ACTIVE: %s", cons.runState.GetStateString())
-	})
+	cons.AddHealthCheckAt("/pluginState", pluginStateHealthCheck(cons.id, cons))
 }
 
 // GetLogger returns the logger scoped to this plugin
@@ -113,7 +158,7 @@ func (cons *SimpleConsumer) GetLogger() logrus.FieldLogger {
 // AddHealthCheckAt adds a health check at a subpath
 // (http://<addr>:<port>/<plugin_id><path>)
 func (cons *SimpleConsumer) AddHealthCheckAt(path string, callback thealthcheck.CallbackFunc) {
-	thealthcheck.AddEndpoint("/"+cons.GetID()+path, callback)
+	AddHealthCheckEndpoint("/"+cons.GetID()+path, callback)
 }
 
 // GetID returns the ID of this consumer
@@ -127,6 +172,14 @@ func (cons *SimpleConsumer) GetShutdownTimeout() time.Duration {
 	return cons.shutdownTimeout
 }
 
+// IsAtLeastOnce returns true if this consumer sends messages to a stream
+// with at-least-once delivery. Consumers supporting acknowledgements should
+// not advance their source position before messages have been acknowledged
+// in this case. See SimpleRouter.
+func (cons *SimpleConsumer) IsAtLeastOnce() bool {
+	return cons.atLeastOnce
+}
+
 // Control returns write access to this consumer's control channel.
 // See ConsumerControl* constants.
 func (cons *SimpleConsumer) Control() chan<- PluginControl {
@@ -205,10 +258,36 @@ func (cons *SimpleConsumer) Enqueue(data []byte) {
 
 // EnqueueWithMetadata works like EnqueueWithSequence and allows to set meta data directly
 func (cons *SimpleConsumer) EnqueueWithMetadata(data []byte, metaData Metadata) {
+	if cons.multiline != nil {
+		cons.multiline.Push(data, metaData)
+		return
+	}
 	msg := NewMessage(cons, data, metaData, InvalidStreamID)
 	cons.enqueueMessage(msg)
 }
 
+// enqueueJoined enqueues messages joined by the multiline aggregator.
+func (cons *SimpleConsumer) enqueueJoined(data []byte, metaData Metadata) {
+	msg := NewMessage(cons, data, metaData, InvalidStreamID)
+	cons.enqueueMessage(msg)
+}
+
+// EnqueueWithAck works like EnqueueWithMetadata and registers a callback
+// notified once the message has been accepted by a producer.
+// See Message.SetAckCallback.
+func (cons *SimpleConsumer) EnqueueWithAck(data []byte, metaData Metadata, onAck MessageAckCallback) {
+	msg := NewMessage(cons, data, metaData, InvalidStreamID)
+	msg.SetAckCallback(onAck)
+	cons.enqueueMessage(msg)
+}
+
+// EnqueueWithStream works like EnqueueWithMetadata but sends the message to
+// the given stream instead of the streams bound to this consumer.
+func (cons *SimpleConsumer) EnqueueWithStream(data []byte, metaData Metadata, streamID MessageStreamID) {
+	msg := NewMessage(cons, data, metaData, streamID)
+	cons.enqueueMessage(msg)
+}
+
 func (cons *SimpleConsumer) parallelEnqueue(msg *Message) {
 	cons.modulatorQueue.Push(msg, 0)
 }
@@ -226,6 +305,7 @@ func (cons *SimpleConsumer) directEnqueue(msg *Message) {
 	switch cons.modulators.Modulate(msg) {
 	case ModulateResultDiscard:
 		DiscardMessage(msg, cons.GetID(), "Consumer discarded")
+		msg.Acknowledge()
 		return
 
 	case ModulateResultFallback:
@@ -238,6 +318,19 @@ func (cons *SimpleConsumer) directEnqueue(msg *Message) {
 	CountMessagesEnqueued()
 	MessageTrace(msg, cons.GetID(), "Enqueued by consumer")
 
+	// Clones sent to other streams have to be accepted, too
+	if cons.atLeastOnce {
+		msg.RequireAllAcks()
+	}
+
+	// Messages with a stream set by the consumer bypass the bound routers
+	if streamID := msg.GetStreamID(); streamID != InvalidStreamID {
+		if err := Route(msg, StreamRegistry.GetRouterOrFallback(streamID)); err != nil {
+			cons.Logger.Error(err)
+		}
+		return
+	}
+
 	// Send message to all routers registered to this consumer
 	// Last message will not be cloned.
 	numRouters := len(cons.routers)
@@ -294,6 +387,10 @@ func (cons *SimpleConsumer) ControlLoop() {
 				}
 			}
 
+			if cons.multiline != nil {
+				cons.multiline.Flush()
+			}
+
 			if cons.modulatorQueue != nil {
 				close(cons.modulatorQueue)
 			}
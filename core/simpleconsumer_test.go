@@ -135,3 +135,59 @@ func TestSimpleConsumerStateMethods(t *testing.T) {
 	expect.True(mockSimpleConsumer.IsActiveOrStopping())
 	expect.True(mockSimpleConsumer.IsStopping())
 }
+
+func TestSimpleConsumerEnqueueWithStream(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	mockConf := NewPluginConfig("mockSimpleConsumerEnqueueWithStream", "mockSimpleConsumer")
+	mockConf.Override("Streams", []string{"testBoundStream"})
+
+	// Router needs to be configured to avoid unknown class errors
+	registerMockRouter("testBoundStream")
+
+	target := getMockRouterMessageHelper("testTargetStream")
+	StreamRegistry.Register(&target, target.GetStreamID())
+
+	mockSimpleConsumer, err := getSimpleConsumer(mockConf)
+	expect.NoError(err)
+
+	mockSimpleConsumer.EnqueueWithStream([]byte("foo"), nil, target.GetStreamID())
+	expect.True(target.messageEnqued)
+	expect.Equal("foo", target.lastMessageData)
+}
+
+func TestSimpleConsumerConfigureMultiline(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	mockConf := NewPluginConfig("mockSimpleConsumerConfigureMultiline", "mockSimpleConsumer")
+	mockConf.Override("Streams", []string{"testBoundStream"})
+	mockConf.Override("Aggregate/Pattern", `^\s`)
+
+	// Router needs to be configured to avoid unknown class errors
+	registerMockRouter("testBoundStream")
+
+	mockSimpleConsumer, err := getSimpleConsumer(mockConf)
+	expect.NoError(err)
+	expect.NotNil(mockSimpleConsumer.multiline)
+
+	mockConf = NewPluginConfig("mockSimpleConsumerConfigureMultilineInvalid", "mockSimpleConsumer")
+	mockConf.Override("Streams", []string{"testBoundStream"})
+	mockConf.Override("Aggregate/Pattern", `^\s`)
+	mockConf.Override("Aggregate/What", "after")
+	_, err = getSimpleConsumer(mockConf)
+	expect.NotNil(err)
+}
+
+func TestSimpleConsumerConfigureStreamBound(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	TypeRegistry.Register(mockStreamBoundFormatter{})
+
+	mockConf := NewPluginConfig("mockSimpleConsumerConfigureStreamBound", "mockSimpleConsumer")
+	mockConf.Override("Streams", []string{"testBoundStream"})
+	mockConf.Override("Modulators", []interface{}{"core.mockStreamBoundFormatter"})
+
+	registerMockRouter("testBoundStream")
+
+	_, err := getSimpleConsumer(mockConf)
+	expect.NotNil(err)
+}
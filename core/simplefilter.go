@@ -40,10 +40,9 @@ func (filter *SimpleFilter) SetLogger(logger logrus.FieldLogger) {
 }
 
 // Configure sets up all values required by SimpleFormatter.
-func (filter *SimpleFilter) Configure(conf PluginConfigReader) error {
+func (filter *SimpleFilter) Configure(conf PluginConfigReader) {
 	filter.Logger = conf.GetSubLogger("Filter")
 	//filter.filteredStreamID = GetStreamID(conf.GetString("FilteredStream", InvalidStream))
-	return nil
 }
 
 // GetLogger returns this plugin's scoped logger
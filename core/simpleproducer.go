@@ -15,7 +15,6 @@
 package core
 
 import (
-	"fmt"
 	"sync"
 	"time"
 
@@ -52,37 +51,70 @@ import (
 // it arrives at this producer. If a modulator changes the stream of a message
 // the message is NOT routed to this stream anymore.
 // By default this parameter is set to an empty list.
+//
+// - PersistentQueue/Path: Defines a directory used to store messages after
+// they have been modulated and before they are processed by the producer.
+// Messages are read back in order and removed once the producer has processed
+// them, so messages survive restarts and sinks that are slower than the
+// producer's inputs. Messages that were being processed during a crash may be
+// processed twice, messages buffered inside a producer may still be lost.
+// Messages are acknowledged once they have been written to the queue but
+// before they have been synced to disk, so they survive a crash of Gollum
+// but not a crash of the operating system or a power loss.
+// A directory can only be used by one producer. Setting this
+// parameter to "" disables the persistent queue.
+// By default this parameter is set to "".
+//
+// - PersistentQueue/MaxSizeMB: Defines the maximum number of megabytes stored
+// in the persistent queue. Messages that do not fit into the queue are sent to
+// the fallback.
+// By default this parameter is set to 1024.
+//
+// - PersistentQueue/SegmentSizeMB: Defines the size of each file of the
+// persistent queue in megabytes. Files are removed once all of their messages
+// have been processed.
+// By default this parameter is set to 64.
 type SimpleProducer struct {
-	id              string
-	control         chan PluginControl
-	runState        *PluginRunState
-	streams         []MessageStreamID `config:"Streams"`
-	modulators      ModulatorArray    `config:"Modulators"`
-	fallbackStream  Router            `config:"FallbackStream" default:""`
-	shutdownTimeout time.Duration     `config:"ShutdownTimeoutMs" default:"1000" metric:"ms"`
-	onRoll          func()
-	onPrepareStop   func()
-	onStop          func()
-	Logger          logrus.FieldLogger
+	id                    string
+	control               chan PluginControl
+	runState              *PluginRunState
+	streams               []MessageStreamID `config:"Streams"`
+	modulators            ModulatorArray    `config:"Modulators"`
+	fallbackStream        Router            `config:"FallbackStream" default:""`
+	shutdownTimeout       time.Duration     `config:"ShutdownTimeoutMs" default:"1000" metric:"ms"`
+	persistentPath        string            `config:"PersistentQueue/Path" default:""`
+	persistentMaxSize     int64             `config:"PersistentQueue/MaxSizeMB" default:"1024" metric:"mb"`
+	persistentSegmentSize int64             `config:"PersistentQueue/SegmentSizeMB" default:"64" metric:"mb"`
+	persistentQueue       *PersistentQueue
+	persistentOpen        *sync.Once
+	persistentWorker      *sync.WaitGroup
+	onRoll                func()
+	onPrepareStop         func()
+	onStop                func()
+	onPersistedMessage    func(*Message)
+	Logger                logrus.FieldLogger
 }
 
+// persistentQueuePollTimeout defines how long the persistent queue is polled
+// before checking the producer's state again.
+const persistentQueuePollTimeout = 100 * time.Millisecond
+
 // Configure initializes the standard producer config values.
 func (prod *SimpleProducer) Configure(conf PluginConfigReader) {
 	prod.id = conf.GetID()
 	prod.Logger = conf.GetLogger()
 	prod.runState = NewPluginRunState()
 	prod.control = make(chan PluginControl, 1)
+	prod.persistentOpen = new(sync.Once)
+	prod.persistentWorker = new(sync.WaitGroup)
+
+	if prod.persistentPath != "" && prod.persistentSegmentSize > prod.persistentMaxSize {
+		conf.Errors.Pushf("PersistentQueue/SegmentSizeMB must not be larger than PersistentQueue/MaxSizeMB")
+	}
 
 	// Simple health check for the plugin state
 	//   Path: "/<plugin_id>/pluginState"
-	prod.AddHealthCheckAt("/pluginState", func() (code int, body string) {
-		if prod.IsActive() {
-			return thealthcheck.StatusOK,
-				fmt.Sprintf("ACTIVE: %s", prod.runState.GetStateString())
-		}
-		return thealthcheck.StatusServiceUnavailable,
-			fmt.Sprintf("NOT_ACTIVE: %s", prod.runState.GetStateString())
-	})
+	prod.AddHealthCheckAt("/pluginState", pluginStateHealthCheck(prod.id, prod))
 }
 
 // GetLogger returns the logging scope of this plugin
@@ -97,7 +129,7 @@ func (prod *SimpleProducer) AddHealthCheck(callback thealthcheck.CallbackFunc) {
 
 // AddHealthCheckAt adds a health check at a subpath (http://<addr>:<port>/<plugin_id><path>)
 func (prod *SimpleProducer) AddHealthCheckAt(path string, callback thealthcheck.CallbackFunc) {
-	thealthcheck.AddEndpoint("/"+prod.GetID()+path, callback)
+	AddHealthCheckEndpoint("/"+prod.GetID()+path, callback)
 }
 
 // GetID returns the ID of this producer
@@ -203,6 +235,7 @@ func (prod *SimpleProducer) HasContinueAfterModulate(msg *Message) bool {
 	switch result := prod.Modulate(msg); result {
 	case ModulateResultDiscard:
 		DiscardMessage(msg, prod.GetID(), "Producer discarded")
+		msg.Acknowledge()
 		return false
 
 	case ModulateResultFallback:
@@ -221,11 +254,116 @@ func (prod *SimpleProducer) HasContinueAfterModulate(msg *Message) bool {
 	}
 }
 
-// TryFallback routes the message to the configured fallback stream.
+// TryFallback routes the message to the configured fallback stream. The
+// message is acknowledged by the producer of the fallback stream.
 func (prod *SimpleProducer) TryFallback(msg *Message) {
 	if err := RouteOriginal(msg, prod.fallbackStream); err != nil {
 		prod.Logger.WithError(err).Error("Failed to route to fallback")
 	}
+	msg.fallback = true
+	msg.ack.release()
+}
+
+// persistMessage stores the message in the persistent queue if one has been
+// configured. Messages are acknowledged once they have been stored and are
+// passed to the producer by the persistent queue loop. If false is returned
+// the message has to be processed directly.
+func (prod *SimpleProducer) persistMessage(msg *Message) bool {
+	if prod.persistentPath == "" || prod.onPersistedMessage == nil {
+		return false // ### return, disabled or not supported ###
+	}
+	queue := prod.getPersistentQueue()
+	if queue == nil {
+		return false // ### return, no queue ###
+	}
+
+	if err := queue.Push(msg); err != nil {
+		prod.Logger.WithError(err).Error("Failed to persist message")
+		prod.TryFallback(msg)
+		return true
+	}
+
+	msg.Acknowledge()
+	MessageTrace(msg, prod.GetID(), "Persisted by producer")
+	return true
+}
+
+// getPersistentQueue opens the persistent queue upon first use. Nil is
+// returned if no queue has been configured or if it could not be opened.
+func (prod *SimpleProducer) getPersistentQueue() *PersistentQueue {
+	prod.persistentOpen.Do(func() {
+		if prod.persistentPath == "" {
+			return // ### return, disabled ###
+		}
+		queue, err := OpenPersistentQueue(prod.persistentPath, prod.id, prod.persistentMaxSize, prod.persistentSegmentSize)
+		if err != nil {
+			prod.Logger.WithError(err).Error("Failed to open persistent queue, messages will not be persisted")
+			return
+		}
+		prod.persistentQueue = queue
+	})
+	return prod.persistentQueue
+}
+
+// persistentQueueLoop passes messages from the persistent queue to the
+// producer until the producer prepares to stop. Messages still stored in the
+// queue at this point are processed after the next start.
+func (prod *SimpleProducer) persistentQueueLoop() {
+	defer prod.persistentWorker.Done()
+	queue := prod.getPersistentQueue()
+	if queue == nil {
+		return // ### return, no queue ###
+	}
+
+	for prod.GetState() < PluginStatePrepareStop {
+		msg, err := queue.Pop(persistentQueuePollTimeout)
+		switch {
+		case err != nil:
+			prod.Logger.WithError(err).Error("Failed to read from persistent queue")
+			time.Sleep(persistentQueuePollTimeout)
+		case msg != nil:
+			prod.onPersistedMessage(msg)
+		}
+	}
+}
+
+// startPersistentQueue starts the persistent queue loop if a persistent queue
+// has been configured. The loop is registered as a worker, so
+// closePersistentQueue has to be called if true is returned.
+func (prod *SimpleProducer) startPersistentQueue() bool {
+	if prod.persistentPath == "" {
+		return false // ### return, disabled ###
+	}
+	if prod.onPersistedMessage == nil {
+		prod.Logger.Error("This producer does not support PersistentQueue")
+		return false
+	}
+
+	prod.AddWorker()
+	prod.persistentWorker.Add(1)
+	go prod.persistentQueueLoop()
+	return true
+}
+
+// stopPersistentQueue waits for the persistent queue loop to stop. The
+// producer has to be in PluginStatePrepareStop.
+func (prod *SimpleProducer) stopPersistentQueue() {
+	if prod.persistentPath != "" {
+		prod.persistentWorker.Wait()
+	}
+}
+
+// closePersistentQueue closes the persistent queue after the producer has
+// been stopped. The queue cannot be opened afterwards.
+func (prod *SimpleProducer) closePersistentQueue() {
+	defer prod.WorkerDone()
+	prod.persistentOpen.Do(func() {})
+	if prod.persistentQueue == nil {
+		return // ### return, no queue ###
+	}
+	if err := prod.persistentQueue.Close(); err != nil {
+		prod.Logger.WithError(err).Error("Failed to close persistent queue")
+	}
 }
 
 // ControlLoop listens to the control channel and triggers callbacks for these
@@ -234,6 +372,9 @@ func (prod *SimpleProducer) ControlLoop() {
 	prod.setState(PluginStateActive)
 	defer prod.setState(PluginStateDead)
 	defer prod.Logger.Debug("Stopped")
+	if prod.startPersistentQueue() {
+		defer prod.closePersistentQueue()
+	}
 
 	for {
 		command := <-prod.control
@@ -245,6 +386,7 @@ func (prod *SimpleProducer) ControlLoop() {
 		case PluginControlStopProducer:
 			prod.Logger.Debug("Preparing for stop")
 			prod.setState(PluginStatePrepareStop)
+			prod.stopPersistentQueue()
 
 			if prod.onPrepareStop != nil {
 				if !tgo.ReturnAfter(prod.shutdownTimeout*5, prod.onPrepareStop) {
@@ -18,6 +18,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/trivago/tgo/thealthcheck"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -38,13 +39,25 @@ import (
 // handled by the router. You can disable this behavior by setting it to "0".
 // By default this parameter is set to "0".
 //
+// - AtLeastOnce: When set to true, messages routed to this stream are only
+// acknowledged after all producers they are passed to have accepted them,
+// including producers of streams they are routed to afterwards. Producers
+// writing messages in batches accept them after the batch has been written.
+// Messages that cannot be passed to a producer are rejected. Consumers bound
+// to this stream that support acknowledgements, e.g. consumer.Kafka and
+// consumer.HTTP, hold back their source position until messages have been
+// acknowledged. See core.Message.SetAckCallback.
+// By default this parameter is set to false.
+//
 type SimpleRouter struct {
-	id        string
-	Producers []Producer
-	filters   FilterArray     `config:"Filters"`
-	timeout   time.Duration   `config:"TimeoutMs" default:"0" metric:"ms"`
-	streamID  MessageStreamID `config:"Stream"`
-	Logger    logrus.FieldLogger
+	id            string
+	Producers     []Producer
+	producerGuard sync.RWMutex
+	filters       FilterArray     `config:"Filters"`
+	timeout       time.Duration   `config:"TimeoutMs" default:"0" metric:"ms"`
+	streamID      MessageStreamID `config:"Stream"`
+	atLeastOnce   bool            `config:"AtLeastOnce" default:"false"`
+	Logger        logrus.FieldLogger
 }
 
 // Configure sets up all values required by SimpleRouter.
@@ -69,7 +82,7 @@ func (router *SimpleRouter) AddHealthCheck(callback thealthcheck.CallbackFunc) {
 
 // AddHealthCheckAt adds a health check at a subpath (http://<addr>:<port>/<plugin_id><path>)
 func (router *SimpleRouter) AddHealthCheckAt(path string, callback thealthcheck.CallbackFunc) {
-	thealthcheck.AddEndpoint("/"+router.GetID()+path, callback)
+	AddHealthCheckEndpoint("/"+router.GetID()+path, callback)
 }
 
 // GetID returns the ID of this router
@@ -82,6 +95,12 @@ func (router *SimpleRouter) GetStreamID() MessageStreamID {
 	return router.streamID
 }
 
+// IsAtLeastOnce returns true if messages routed to this stream have to be
+// accepted by all producers.
+func (router *SimpleRouter) IsAtLeastOnce() bool {
+	return router.atLeastOnce
+}
+
 // GetTimeout returns the timeout set for this router
 func (router *SimpleRouter) GetTimeout() time.Duration {
 	return router.timeout
@@ -89,19 +108,50 @@ func (router *SimpleRouter) GetTimeout() time.Duration {
 
 // AddProducer adds all producers to the list of known producers.
 // Duplicates will be filtered.
+// The list is replaced instead of being modified so that routers iterating
+// over the previous list are not affected.
 func (router *SimpleRouter) AddProducer(producers ...Producer) {
+	router.producerGuard.Lock()
+	defer router.producerGuard.Unlock()
+
+	extended := append(make([]Producer, 0, len(router.Producers)+len(producers)), router.Producers...)
+nextProd:
 	for _, prod := range producers {
-		for _, inListProd := range router.Producers {
+		for _, inListProd := range extended {
+			if inListProd == prod {
+				continue nextProd // ### continue, already in list ###
+			}
+		}
+		extended = append(extended, prod)
+	}
+	router.Producers = extended
+}
+
+// RemoveProducer removes all given producers from the list of known
+// producers. The list is replaced instead of being modified so that routers
+// iterating over the previous list are not affected.
+func (router *SimpleRouter) RemoveProducer(producers ...Producer) {
+	router.producerGuard.Lock()
+	defer router.producerGuard.Unlock()
+
+	remaining := make([]Producer, 0, len(router.Producers))
+nextProd:
+	for _, inListProd := range router.Producers {
+		for _, prod := range producers {
 			if inListProd == prod {
-				return // ### return, already in list ###
+				continue nextProd
 			}
 		}
-		router.Producers = append(router.Producers, prod)
+		remaining = append(remaining, inListProd)
 	}
+	router.Producers = remaining
 }
 
-// GetProducers returns the producers bound to this stream
+// GetProducers returns the producers bound to this stream. The returned list
+// is not modified by AddProducer or RemoveProducer.
 func (router *SimpleRouter) GetProducers() []Producer {
+	router.producerGuard.RLock()
+	defer router.producerGuard.RUnlock()
 	return router.Producers
 }
 
@@ -0,0 +1,209 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SimulationEvent describes a single step of a message passing through the
+// pipeline during a simulation.
+type SimulationEvent struct {
+	// PluginID is the plugin that processed the message. It is empty for
+	// filters, which are named in the comment.
+	PluginID string
+	// Stream is the stream the message was assigned to at this step
+	Stream string
+	// Comment describes what happened to the message
+	Comment string
+	// Payload is only set for messages delivered to a producer
+	Payload []byte
+}
+
+// Simulation passes messages through configured consumers, routers and
+// producers without starting them. Producers have to be replaced by
+// Simulation.WrapProducer, so that messages are modulated by the producer but
+// never sent. Each step of a message is recorded by using the MessageTrace
+// and FilterAudit hooks. Errors logged while a message is processed are
+// recorded, too.
+type Simulation struct {
+	events []SimulationEvent
+	guard  *sync.Mutex
+	active *int32
+}
+
+// simulatedProducer wraps a producer during a simulation.
+type simulatedProducer struct {
+	Producer
+	simulation *Simulation
+}
+
+// simulatedConsumer is implemented by all consumers based on SimpleConsumer.
+type simulatedConsumer interface {
+	Consumer
+	directEnqueue(msg *Message)
+}
+
+// NewSimulation creates a new simulation. Activate has to be called before
+// passing messages to the simulation.
+func NewSimulation() *Simulation {
+	return &Simulation{
+		events: []SimulationEvent{},
+		guard:  new(sync.Mutex),
+		active: new(int32),
+	}
+}
+
+// Activate replaces the MessageTrace and FilterAudit hooks and adds the
+// simulation as logrus hook. As these hooks are global, only one simulation
+// can be active and gollum must not run at the same time.
+func (sim *Simulation) Activate() {
+	atomic.StoreInt32(sim.active, 1)
+	MessageTrace = func(msg *Message, pluginID string, comment string) {
+		// Messages routed to a fallback stream keep their original stream,
+		// so routers report their own stream.
+		streamID := msg.GetStreamID()
+		if router, isRouter := PluginRegistry.GetPlugin(pluginID).(Router); isRouter {
+			streamID = router.GetStreamID()
+		}
+		sim.addEvent(SimulationEvent{
+			PluginID: pluginID,
+			Stream:   streamID.GetName(),
+			Comment:  comment,
+		})
+	}
+	FilterAudit = func(msg *Message, reason string) {
+		sim.addEvent(SimulationEvent{
+			Stream:  msg.GetStreamID().GetName(),
+			Comment: fmt.Sprintf("Rejected by %s", reason),
+		})
+	}
+	logrus.AddHook(sim)
+}
+
+// Deactivate restores the default MessageTrace and FilterAudit hooks and
+// stops recording log entries.
+func (sim *Simulation) Deactivate() {
+	atomic.StoreInt32(sim.active, 0)
+	DeactivateMessageTrace()
+	DeactivateFilterAudit()
+}
+
+// WrapProducer returns a producer that applies the modulators of the given
+// producer and records the resulting payload instead of sending it.
+func (sim *Simulation) WrapProducer(producer Producer) Producer {
+	return simulatedProducer{
+		Producer:   producer,
+		simulation: sim,
+	}
+}
+
+// Enqueue passes the given data to the consumer as if the consumer received
+// it and returns all recorded steps. Messages are processed synchronously,
+// i.e. consumer modulator routines and multiline settings are ignored.
+func (sim *Simulation) Enqueue(consumer Consumer, data []byte) ([]SimulationEvent, error) {
+	simConsumer, isSimulated := consumer.(simulatedConsumer)
+	if !isSimulated {
+		return nil, fmt.Errorf("Consumer '%T' does not support simulations", consumer)
+	}
+
+	sim.guard.Lock()
+	sim.events = []SimulationEvent{}
+	sim.guard.Unlock()
+
+	simConsumer.directEnqueue(NewMessage(consumer, data, nil, InvalidStreamID))
+
+	sim.guard.Lock()
+	defer sim.guard.Unlock()
+	return sim.events, nil
+}
+
+func (sim *Simulation) addEvent(event SimulationEvent) {
+	sim.guard.Lock()
+	sim.events = append(sim.events, event)
+	sim.guard.Unlock()
+}
+
+// Levels returns the logrus levels recorded during a simulation.
+func (sim *Simulation) Levels() []logrus.Level {
+	return []logrus.Level{logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+// Fire records a log entry as simulation step.
+func (sim *Simulation) Fire(entry *logrus.Entry) error {
+	if atomic.LoadInt32(sim.active) == 0 {
+		return nil // ### return, simulation is not active ###
+	}
+	pluginID, _ := entry.Data["PluginID"].(string)
+	message := entry.Message
+	if err, hasError := entry.Data[logrus.ErrorKey]; hasError {
+		message = fmt.Sprintf("%s: %v", message, err)
+	}
+
+	sim.addEvent(SimulationEvent{
+		PluginID: pluginID,
+		Comment:  fmt.Sprintf("%s: %s", entry.Level, message),
+	})
+	return nil
+}
+
+// Enqueue applies the producer's modulators and records the resulting
+// payload. Messages are never sent.
+func (prod simulatedProducer) Enqueue(msg *Message, timeout time.Duration) {
+	result := ModulateResultContinue
+	if modulator, isModulator := prod.Producer.(Modulator); isModulator {
+		result = modulator.Modulate(msg)
+	}
+
+	switch result {
+	case ModulateResultDiscard:
+		DiscardMessage(msg, prod.GetID(), "Producer discarded")
+
+	case ModulateResultFallback:
+		if err := Route(msg, msg.GetRouter()); err != nil {
+			logrus.WithField("PluginID", prod.GetID()).WithError(err).Error("Failed to route to fallback")
+		}
+
+	default:
+		prod.simulation.addEvent(SimulationEvent{
+			PluginID: prod.GetID(),
+			Stream:   msg.GetStreamID().GetName(),
+			Comment:  "Delivered",
+			Payload:  append([]byte{}, msg.GetPayload()...),
+		})
+	}
+}
+
+// String returns the step as a single line.
+func (event SimulationEvent) String() string {
+	pluginID := event.PluginID
+	if pluginID == "" {
+		pluginID = "-"
+	}
+	stream := event.Stream
+	if stream == "" {
+		stream = "-"
+	}
+
+	if event.Payload != nil {
+		return fmt.Sprintf("[%s] %s: %s %q", stream, pluginID, event.Comment, event.Payload)
+	}
+	return fmt.Sprintf("[%s] %s: %s", stream, pluginID, event.Comment)
+}
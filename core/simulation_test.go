@@ -0,0 +1,92 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/tgo/ttesting"
+)
+
+type mockBroadcastRouter struct {
+	SimpleRouter
+}
+
+func (router *mockBroadcastRouter) Enqueue(msg *Message) error {
+	for _, producer := range router.GetProducers() {
+		producer.Enqueue(msg.Clone(), router.GetTimeout())
+	}
+	return nil
+}
+
+func (router *mockBroadcastRouter) Start() error {
+	return nil
+}
+
+type mockUpperModulator struct{}
+
+func (modulator mockUpperModulator) Modulate(msg *Message) ModulateResult {
+	msg.StorePayload(bytes.ToUpper(msg.GetPayload()))
+	return ModulateResultContinue
+}
+
+func TestSimulation(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	router := mockBroadcastRouter{SimpleRouter{
+		id:       "simulationRouter",
+		filters:  FilterArray{},
+		timeout:  time.Second,
+		streamID: StreamRegistry.GetStreamID("simulationStream"),
+		Logger:   logrus.WithField("Scope", "testStreamLogScope"),
+	}}
+	expect.True(PluginRegistry.RegisterUnique(&router, router.id))
+
+	upperProducer := getMockBufferedProducer()
+	upperProducer.id = "simulationUpper"
+	upperProducer.modulators = ModulatorArray{mockUpperModulator{}}
+
+	rejectProducer := getMockBufferedProducer()
+	rejectProducer.id = "simulationReject"
+	rejectProducer.modulators = ModulatorArray{NewFilterModulator(&mockRejectFilter{})}
+
+	consumer := getMockConsumer()
+	consumer.id = "simulationConsumer"
+	consumer.routers = []Router{&router}
+
+	simulation := NewSimulation()
+	simulation.Activate()
+	defer simulation.Deactivate()
+
+	router.AddProducer(simulation.WrapProducer(&upperProducer), simulation.WrapProducer(&rejectProducer))
+
+	events, err := simulation.Enqueue(&consumer, []byte("test"))
+	expect.NoError(err)
+	expect.Equal([]SimulationEvent{
+		{PluginID: "simulationConsumer", Comment: "Enqueued by consumer"},
+		{PluginID: "simulationRouter", Stream: "simulationStream", Comment: "Routed"},
+		{PluginID: "simulationUpper", Stream: "simulationStream", Comment: "Delivered", Payload: []byte("TEST")},
+		{Stream: "simulationStream", Comment: "Rejected by core.mockRejectFilter"},
+		{PluginID: "simulationReject", Stream: "simulationStream", Comment: "Producer discarded"},
+	}, events)
+
+	// Wrapped producers never send messages
+	expect.Equal(0, upperProducer.GetBacklog())
+	expect.Equal(`[simulationStream] simulationUpper: Delivered "TEST"`, events[2].String())
+	expect.Equal("[-] simulationConsumer: Enqueued by consumer", events[0].String())
+}
@@ -16,6 +16,7 @@ package core
 
 import (
 	"hash/fnv"
+	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
@@ -29,20 +30,22 @@ var (
 // streamRegistry holds routers mapped by their MessageStreamID as well as a
 // reverse lookup of MessageStreamID to stream name.
 type streamRegistry struct {
-	routers     map[MessageStreamID]Router
-	name        map[MessageStreamID]string
-	nameGuard   *sync.RWMutex
-	streamGuard *sync.RWMutex
-	wildcard    []Producer
+	routers       map[MessageStreamID]Router
+	name          map[MessageStreamID]string
+	nameGuard     *sync.RWMutex
+	streamGuard   *sync.RWMutex
+	wildcard      []Producer
+	wildcardGuard *sync.RWMutex
 }
 
 // StreamRegistry is the global instance of streamRegistry used to store the
 // all registered routers.
 var StreamRegistry = streamRegistry{
-	routers:     make(map[MessageStreamID]Router),
-	streamGuard: new(sync.RWMutex),
-	name:        make(map[MessageStreamID]string),
-	nameGuard:   new(sync.RWMutex),
+	routers:       make(map[MessageStreamID]Router),
+	streamGuard:   new(sync.RWMutex),
+	name:          make(map[MessageStreamID]string),
+	nameGuard:     new(sync.RWMutex),
+	wildcardGuard: new(sync.RWMutex),
 }
 
 // GetStreamID is deprecated
@@ -71,7 +74,7 @@ func (registry *streamRegistry) GetStreamID(stream string) MessageStreamID {
 // GetStreamName does a reverse lookup for a given MessageStreamID and returns
 // the corresponding name. If the MessageStreamID is not registered, an empty
 // string is returned.
-func (registry streamRegistry) GetStreamName(streamID MessageStreamID) string {
+func (registry *streamRegistry) GetStreamName(streamID MessageStreamID) string {
 	switch streamID {
 	case LogInternalStreamID:
 		return LogInternalStream
@@ -85,6 +88,9 @@ func (registry streamRegistry) GetStreamName(streamID MessageStreamID) string {
 	case TraceInternalStreamID:
 		return TraceInternalStream
 
+	case MetricsInternalStreamID:
+		return MetricsInternalStream
+
 	default:
 		registry.nameGuard.RLock()
 		name, exists := registry.name[streamID]
@@ -98,13 +104,13 @@ func (registry streamRegistry) GetStreamName(streamID MessageStreamID) string {
 }
 
 // GetRouterByStreamName returns a registered stream by name. See GetRouter.
-func (registry streamRegistry) GetRouterByStreamName(name string) Router {
+func (registry *streamRegistry) GetRouterByStreamName(name string) Router {
 	streamID := registry.GetStreamID(name)
 	return registry.GetRouter(streamID)
 }
 
 // GetRouter returns a registered stream or nil
-func (registry streamRegistry) GetRouter(id MessageStreamID) Router {
+func (registry *streamRegistry) GetRouter(id MessageStreamID) Router {
 	registry.streamGuard.RLock()
 	stream, exists := registry.routers[id]
 	registry.streamGuard.RUnlock()
@@ -116,7 +122,7 @@ func (registry streamRegistry) GetRouter(id MessageStreamID) Router {
 }
 
 // IsStreamRegistered returns true if the stream for the given id is registered.
-func (registry streamRegistry) IsStreamRegistered(id MessageStreamID) bool {
+func (registry *streamRegistry) IsStreamRegistered(id MessageStreamID) bool {
 	registry.streamGuard.RLock()
 	_, exists := registry.routers[id]
 	registry.streamGuard.RUnlock()
@@ -125,7 +131,7 @@ func (registry streamRegistry) IsStreamRegistered(id MessageStreamID) bool {
 }
 
 // ForEachStream loops over all registered routers and calls the given function.
-func (registry streamRegistry) ForEachStream(callback func(streamID MessageStreamID, stream Router)) {
+func (registry *streamRegistry) ForEachStream(callback func(streamID MessageStreamID, stream Router)) {
 	registry.streamGuard.RLock()
 	defer registry.streamGuard.RUnlock()
 
@@ -137,6 +143,8 @@ func (registry streamRegistry) ForEachStream(callback func(streamID MessageStrea
 // WildcardProducersExist returns true if any producer is listening to the
 // wildcard stream.
 func (registry *streamRegistry) WildcardProducersExist() bool {
+	registry.wildcardGuard.RLock()
+	defer registry.wildcardGuard.RUnlock()
 	return len(registry.wildcard) > 0
 }
 
@@ -146,24 +154,52 @@ func (registry *streamRegistry) WildcardProducersExist() bool {
 // Duplicates will be filtered.
 // This state of this list is undefined during the configuration phase.
 func (registry *streamRegistry) RegisterWildcardProducer(producers ...Producer) {
+	registry.wildcardGuard.Lock()
+	defer registry.wildcardGuard.Unlock()
+
+	wildcard := append(make([]Producer, 0, len(registry.wildcard)+len(producers)), registry.wildcard...)
 nextProd:
 	for _, prod := range producers {
-		for _, existing := range registry.wildcard {
+		for _, existing := range wildcard {
 			if existing == prod {
 				continue nextProd
 			}
 		}
-		registry.wildcard = append(registry.wildcard, prod)
+		wildcard = append(wildcard, prod)
 	}
+	registry.wildcard = wildcard
+}
+
+// UnregisterWildcardProducer removes the given producers from the list of
+// known wildcard producers. Routers the producers have already been added to
+// are not changed.
+func (registry *streamRegistry) UnregisterWildcardProducer(producers ...Producer) {
+	registry.wildcardGuard.Lock()
+	defer registry.wildcardGuard.Unlock()
+
+	wildcard := make([]Producer, 0, len(registry.wildcard))
+nextProd:
+	for _, existing := range registry.wildcard {
+		for _, prod := range producers {
+			if existing == prod {
+				continue nextProd
+			}
+		}
+		wildcard = append(wildcard, existing)
+	}
+	registry.wildcard = wildcard
 }
 
 // AddWildcardProducersToRouter adds all known wildcard producers to a given
 // router. The state of the wildcard list is undefined during the configuration
 // phase.
-func (registry streamRegistry) AddWildcardProducersToRouter(router Router) {
+func (registry *streamRegistry) AddWildcardProducersToRouter(router Router) {
 	streamID := router.GetStreamID()
-	if streamID != LogInternalStreamID {
-		router.AddProducer(registry.wildcard...)
+	if streamID != LogInternalStreamID && streamID != MetricsInternalStreamID {
+		registry.wildcardGuard.RLock()
+		wildcard := registry.wildcard
+		registry.wildcardGuard.RUnlock()
+		router.AddProducer(wildcard...)
 	}
 }
 
@@ -197,6 +233,49 @@ func (registry *streamRegistry) Register(router Router, streamID MessageStreamID
 	}
 }
 
+// Replace registers a router plugin to a given stream id. A router already
+// registered for this stream is replaced and returned. Generated fallback
+// routers that are replaced are removed from the PluginRegistry.
+func (registry *streamRegistry) Replace(router Router, streamID MessageStreamID) Router {
+	registry.streamGuard.Lock()
+	previous, exists := registry.routers[streamID]
+	registry.routers[streamID] = router
+	registry.streamGuard.Unlock()
+
+	if !exists {
+		CountRouters()
+		return nil
+	}
+	registry.unregisterGenerated(previous)
+	return previous
+}
+
+// ReplaceWithFallback replaces the router registered for the given stream id
+// by a fallback router. The given producers are added to the fallback router
+// before it is registered. The previous router is returned. Nothing is done
+// if the registered router already is a fallback router.
+func (registry *streamRegistry) ReplaceWithFallback(streamID MessageStreamID, producers ...Producer) Router {
+	if router := registry.GetRouter(streamID); router != nil && strings.HasPrefix(router.GetID(), GeneratedRouterPrefix) {
+		return nil // ### return, already a fallback ###
+	}
+
+	fallback := registry.createFallback(streamID)
+	registry.AddWildcardProducersToRouter(fallback)
+	fallback.AddProducer(producers...)
+	CountFallbackRouters()
+
+	return registry.Replace(fallback, streamID)
+}
+
+// unregisterGenerated removes generated fallback routers from the
+// PluginRegistry so that they can be generated again.
+func (registry *streamRegistry) unregisterGenerated(router Router) {
+	if strings.HasPrefix(router.GetID(), GeneratedRouterPrefix) {
+		PluginRegistry.Unregister(router.GetID())
+		UncountFallbackRouters()
+	}
+}
+
 // GetRouterOrFallback returns the router for the given streamID if it is registered.
 // If no router is registered for the given streamID the default router is used.
 // The default router is equivalent to an unconfigured router.Broadcast with
@@ -22,11 +22,12 @@ import (
 
 func getMockStreamRegistry() streamRegistry {
 	return streamRegistry{
-		routers:     map[MessageStreamID]Router{},
-		name:        map[MessageStreamID]string{},
-		streamGuard: new(sync.RWMutex),
-		nameGuard:   new(sync.RWMutex),
-		wildcard:    []Producer{},
+		routers:       map[MessageStreamID]Router{},
+		name:          map[MessageStreamID]string{},
+		streamGuard:   new(sync.RWMutex),
+		nameGuard:     new(sync.RWMutex),
+		wildcard:      []Producer{},
+		wildcardGuard: new(sync.RWMutex),
 	}
 }
 
@@ -24,6 +24,8 @@ const (
 	LogInternalStream = "_GOLLUM_"
 	// TraceInternalStream is the name of the internal trace channel (-tm flag)
 	TraceInternalStream = "_TRACE_"
+	// MetricsInternalStream is the name of the internal metrics channel
+	MetricsInternalStream = "_GOLLUM_METRICS_"
 	// WildcardStream is the name of the "all routers" channel
 	WildcardStream = "*"
 )
@@ -37,4 +39,6 @@ var (
 	WildcardStreamID = GetStreamID(WildcardStream)
 	// TraceInternalStreamID is the ID of the "_TRACE_" stream
 	TraceInternalStreamID = GetStreamID(TraceInternalStream)
+	// MetricsInternalStreamID is the ID of the "_GOLLUM_METRICS_" stream
+	MetricsInternalStreamID = GetStreamID(MetricsInternalStream)
 )
@@ -105,6 +105,9 @@ func (asm *WriterAssembly) Write(messages []*Message) {
 			}
 		} else {
 			logrus.Error("Stream write error:", err)
+			for _, msg := range messages {
+				msg.Reject()
+			}
 		}
 		return // ### return, error handled ###
 	}
@@ -0,0 +1,256 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+)
+
+const metricDeduplicated = "Deduplicated-"
+
+// Dedupe filter plugin
+//
+// This plugin filters messages that have already been seen within a given
+// time window. Messages are identified by a hash of the payload or of
+// selected fields.
+//
+// To keep memory bounded, hashes are stored in two bloom filters. New hashes
+// are added to the current filter, which replaces the previous one after
+// each window. Duplicates are therefore detected for at least one and at most
+// two windows. A bloom filter may report a message as duplicate that has not
+// been seen before. The probability of this is defined by FalsePositiveRate
+// as long as no more than Capacity different messages pass per window.
+//
+// The number of filtered duplicates is counted per stream in the metric
+// "Deduplicated-<stream>" and written to the log every ReportIntervalSec.
+//
+// Parameters
+//
+// - WindowSec: Defines the time window in seconds duplicates are detected in.
+// By default this parameter is set to 60.
+//
+// - Fields: Defines a list of JSON fields identifying a message. Nested
+// fields can be addressed by using "/" as a separator. Messages that are not
+// valid JSON are identified by their payload.
+// By default this parameter is set to an empty list.
+//
+// - MetadataFields: Defines a list of metadata fields identifying a message.
+// If both Fields and MetadataFields are empty, the payload is used.
+// By default this parameter is set to an empty list.
+//
+// - Capacity: Defines the number of different messages expected per window.
+// By default this parameter is set to 100000.
+//
+// - FalsePositiveRate: Defines the probability of a message being filtered
+// although it is not a duplicate.
+// By default this parameter is set to 0.001.
+//
+// - ReportIntervalSec: Defines the interval in seconds the number of filtered
+// duplicates is logged in. Set to 0 to disable logging.
+// By default this parameter is set to 60.
+//
+// Examples
+//
+// This example filters events with an ID seen within the last 5 minutes:
+//
+//  exampleConsumer:
+//    Type: consumer.Kafka
+//    Streams: "*"
+//    Modulators:
+//      - filter.Dedupe:
+//        WindowSec: 300
+//        Fields:
+//          - event/id
+//        Capacity: 1000000
+type Dedupe struct {
+	core.SimpleFilter `gollumdoc:"embed_type"`
+	window            time.Duration `config:"WindowSec" default:"60" metric:"sec"`
+	reportInterval    time.Duration `config:"ReportIntervalSec" default:"60" metric:"sec"`
+	metadataFields    []string      `config:"MetadataFields"`
+	fields            [][]string
+	current           *dedupeBloom
+	previous          *dedupeBloom
+	rotated           time.Time
+	reported          time.Time
+	suppressed        map[core.MessageStreamID]int64
+	guard             *sync.Mutex
+}
+
+// dedupeBloom is a bloom filter using double hashing.
+type dedupeBloom struct {
+	bits   []uint64
+	size   uint64
+	hashes uint64
+}
+
+func init() {
+	core.TypeRegistry.Register(Dedupe{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Dedupe) Configure(conf core.PluginConfigReader) {
+	for _, field := range conf.GetStringArray("Fields", []string{}) {
+		filter.fields = append(filter.fields, strings.Split(field, "/"))
+	}
+
+	capacity := conf.GetInt("Capacity", 100000)
+	rate := conf.GetFloat("FalsePositiveRate", 0.001)
+	if capacity < 1 {
+		conf.Errors.Pushf("Capacity must be at least 1")
+		capacity = 1
+	}
+	if rate <= 0 || rate >= 1 {
+		conf.Errors.Pushf("FalsePositiveRate must be between 0 and 1")
+		rate = 0.001
+	}
+
+	filter.current = newDedupeBloom(capacity, rate)
+	filter.previous = newDedupeBloom(capacity, rate)
+	filter.rotated = time.Now()
+	filter.reported = time.Now()
+	filter.suppressed = make(map[core.MessageStreamID]int64)
+	filter.guard = new(sync.Mutex)
+}
+
+// ApplyFilter check if all Filter wants to reject the message
+func (filter *Dedupe) ApplyFilter(msg *core.Message) (core.FilterResult, error) {
+	h1, h2 := filter.hash(msg)
+	now := time.Now()
+
+	filter.guard.Lock()
+	defer filter.guard.Unlock()
+
+	if now.Sub(filter.rotated) >= filter.window {
+		filter.previous, filter.current = filter.current, filter.previous
+		filter.current.reset()
+		filter.rotated = now
+	}
+	if filter.reportInterval > 0 && now.Sub(filter.reported) >= filter.reportInterval {
+		filter.report(now)
+	}
+
+	if filter.current.contains(h1, h2) || filter.previous.contains(h1, h2) {
+		streamID := msg.GetStreamID()
+		filter.suppressed[streamID]++
+		tgo.Metric.Inc(metricDeduplicated + core.StreamRegistry.GetStreamName(streamID))
+		return filter.GetFilterResultMessageReject(), nil
+	}
+
+	filter.current.add(h1, h2)
+	return core.FilterResultMessageAccept, nil
+}
+
+// report logs the number of duplicates filtered since the last report.
+func (filter *Dedupe) report(now time.Time) {
+	for streamID, count := range filter.suppressed {
+		filter.Logger.Infof("Filtered %d duplicates of %s in %.0f seconds",
+			count, core.StreamRegistry.GetStreamName(streamID), now.Sub(filter.reported).Seconds())
+	}
+	filter.suppressed = make(map[core.MessageStreamID]int64)
+	filter.reported = now
+}
+
+// hash returns two 64 bit hashes of the fields identifying the message.
+func (filter *Dedupe) hash(msg *core.Message) (uint64, uint64) {
+	hash := fnv.New128a()
+	if len(filter.fields) == 0 && len(filter.metadataFields) == 0 {
+		hash.Write(msg.GetPayload())
+		return dedupeSplitHash(hash.Sum(nil))
+	}
+
+	if len(filter.fields) > 0 {
+		values := make(map[string]interface{})
+		decoder := json.NewDecoder(bytes.NewReader(msg.GetPayload()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&values); err != nil {
+			hash.Write(msg.GetPayload())
+		} else {
+			for _, path := range filter.fields {
+				data, _ := json.Marshal(dedupeLookup(values, path))
+				hash.Write(data)
+				hash.Write([]byte{0})
+			}
+		}
+	}
+
+	metadata := msg.TryGetMetadata()
+	for _, key := range filter.metadataFields {
+		hash.Write(metadata.GetValue(key))
+		hash.Write([]byte{0})
+	}
+	return dedupeSplitHash(hash.Sum(nil))
+}
+
+// dedupeLookup returns the value at the given path or nil.
+func dedupeLookup(values map[string]interface{}, path []string) interface{} {
+	var value interface{} = values
+	for _, key := range path {
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+func dedupeSplitHash(sum []byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:]) | 1
+}
+
+// newDedupeBloom creates a bloom filter for the given number of entries and
+// false positive rate.
+func newDedupeBloom(capacity int64, rate float64) *dedupeBloom {
+	size := uint64(math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	hashes := uint64(math.Max(1, math.Round(float64(size)/float64(capacity)*math.Ln2)))
+	return &dedupeBloom{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+func (bloom *dedupeBloom) add(h1, h2 uint64) {
+	for i := uint64(0); i < bloom.hashes; i++ {
+		bit := (h1 + i*h2) % bloom.size
+		bloom.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (bloom *dedupeBloom) contains(h1, h2 uint64) bool {
+	for i := uint64(0); i < bloom.hashes; i++ {
+		bit := (h1 + i*h2) % bloom.size
+		if bloom.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (bloom *dedupeBloom) reset() {
+	for i := range bloom.bits {
+		bloom.bits[i] = 0
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestFilterDedupePayload(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("", "filter.Dedupe")
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Dedupe)
+	expect.True(casted)
+
+	for i := 0; i < 1000; i++ {
+		msg := core.NewMessage(nil, []byte(fmt.Sprintf("message %d", i)), nil, core.InvalidStreamID)
+		result, err := filter.ApplyFilter(msg)
+		expect.NoError(err)
+		expect.Equal(core.FilterResultMessageAccept, result)
+	}
+
+	msg := core.NewMessage(nil, []byte("message 42"), nil, core.InvalidStreamID)
+	result, _ := filter.ApplyFilter(msg)
+	expect.Neq(core.FilterResultMessageAccept, result)
+	expect.Equal(int64(1), filter.suppressed[core.InvalidStreamID])
+}
+
+func TestFilterDedupeFields(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("", "filter.Dedupe")
+	conf.Override("Fields", []string{"event/id"})
+	conf.Override("MetadataFields", []string{"source"})
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Dedupe)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"event":{"id":1},"time":1}`), core.Metadata{"source": []byte("a")}, core.InvalidStreamID)
+	result, _ := filter.ApplyFilter(msg)
+	expect.Equal(core.FilterResultMessageAccept, result)
+
+	msg = core.NewMessage(nil, []byte(`{"event":{"id":1},"time":2}`), core.Metadata{"source": []byte("a")}, core.InvalidStreamID)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Neq(core.FilterResultMessageAccept, result)
+
+	msg = core.NewMessage(nil, []byte(`{"event":{"id":1},"time":3}`), core.Metadata{"source": []byte("b")}, core.InvalidStreamID)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Equal(core.FilterResultMessageAccept, result)
+
+	msg = core.NewMessage(nil, []byte(`{"event":{"id":2},"time":1}`), core.Metadata{"source": []byte("a")}, core.InvalidStreamID)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Equal(core.FilterResultMessageAccept, result)
+}
+
+func TestFilterDedupeWindow(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("", "filter.Dedupe")
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Dedupe)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+	result, _ := filter.ApplyFilter(msg)
+	expect.Equal(core.FilterResultMessageAccept, result)
+
+	// A message stays known in the previous window
+	filter.rotated = filter.rotated.Add(-filter.window)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Neq(core.FilterResultMessageAccept, result)
+
+	filter.rotated = filter.rotated.Add(-filter.window)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Equal(core.FilterResultMessageAccept, result)
+}
+
+func TestFilterDedupeBloomSize(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	bloom := newDedupeBloom(1000, 0.01)
+	expect.Equal(uint64(9586), bloom.size)
+	expect.Equal(uint64(7), bloom.hashes)
+	expect.Equal(150, len(bloom.bits))
+}
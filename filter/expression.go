@@ -0,0 +1,103 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+)
+
+// Expression filter plugin
+//
+// This filter evaluates an expression for each message and accepts the
+// message if the result is true. This allows combining conditions on the
+// payload, metadata, stream and time that would otherwise require a chain of
+// filters.
+//
+// The expression syntax follows CEL (https://github.com/google/cel-spec).
+// The following names can be used:
+//
+//  - payload: The payload as string.
+//  - json: The payload parsed as JSON. Fields are accessed by "json.a.b" or
+//  "json['a']", array elements by "json.items[0]".
+//  - meta: The metadata. Fields are accessed by "meta.key" or "meta['key']".
+//  - stream: The name of the stream the message is routed to.
+//  - timestamp: The creation time of the message in seconds since 1970.
+//  - now: The current time in seconds since 1970.
+//
+// Supported operators are "||", "&&", "!", "==", "!=", "<", "<=", ">",
+// ">=", "in" (list elements, map keys or substrings), "=~" (regular
+// expression match), "+", "-", "*", "/", "%" and parentheses. Lists are
+// written as "[a, b]", strings use single or double quotes.
+//
+// The functions has(x), size(x), contains(s, sub), startsWith(s, prefix),
+// endsWith(s, suffix), matches(s, regexp), lower(s), upper(s), string(x) and
+// number(x) can also be called as methods, e.g. "payload.contains('x')".
+//
+// Fields that do not exist never compare equal to anything. Strings are
+// compared as numbers if the other side is a number, so metadata can be
+// compared to numbers directly. Content that is not valid JSON has no json
+// fields.
+//
+// Parameters
+//
+// - Expression: Defines the expression to evaluate. If empty, all messages
+// are accepted.
+// By default this parameter is set to "".
+//
+// Examples
+//
+// This example accepts server errors and all messages with an error level:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - filter.Expression:
+//        Expression: "meta.level in ['error', 'fatal'] || json.status >= 500"
+type Expression struct {
+	core.SimpleFilter `gollumdoc:"embed_type"`
+	expression        expressionNode
+}
+
+func init() {
+	core.TypeRegistry.Register(Expression{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Expression) Configure(conf core.PluginConfigReader) {
+	text := conf.GetString("Expression", "")
+	if text == "" {
+		filter.Logger.Warning("No Expression set, all messages are accepted")
+		return
+	}
+
+	var err error
+	if filter.expression, err = parseExpression(text); err != nil {
+		conf.Errors.Pushf("Invalid expression '%s': %s", text, err)
+	}
+}
+
+// ApplyFilter check if all Filter wants to reject the message
+func (filter *Expression) ApplyFilter(msg *core.Message) (core.FilterResult, error) {
+	if filter.expression == nil {
+		return core.FilterResultMessageAccept, nil
+	}
+
+	ctx := &expressionContext{msg: msg}
+	if expressionTruthy(filter.expression(ctx)) {
+		return core.FilterResultMessageAccept, nil
+	}
+	return filter.GetFilterResultMessageReject(), nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestFilterExpression(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("", "filter.Expression")
+	conf.Override("Expression", `meta.level in ["error", "fatal"] && json.status >= 500`)
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Expression)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"status":503}`), core.Metadata{"level": []byte("error")}, core.InvalidStreamID)
+	result, err := filter.ApplyFilter(msg)
+	expect.NoError(err)
+	expect.Equal(core.FilterResultMessageAccept, result)
+
+	msg = core.NewMessage(nil, []byte(`{"status":200}`), core.Metadata{"level": []byte("error")}, core.InvalidStreamID)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Neq(core.FilterResultMessageAccept, result)
+
+	msg = core.NewMessage(nil, []byte(`{"status":503}`), core.Metadata{"level": []byte("info")}, core.InvalidStreamID)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Neq(core.FilterResultMessageAccept, result)
+
+	msg = core.NewMessage(nil, []byte(`not json`), nil, core.InvalidStreamID)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Neq(core.FilterResultMessageAccept, result)
+}
+
+func TestFilterExpressionSyntax(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	streamID := core.GetStreamID("expressionTest")
+	msg := core.NewMessage(nil, []byte(`{"user":{"name":"Ann"},"tags":["a","b"],"n":3}`), core.Metadata{"code": []byte("404")}, streamID)
+
+	accepted := []string{
+		`stream == "expressionTest"`,
+		`json.user.name.lower() == 'ann'`,
+		`json['user']['name'] =~ '^A'`,
+		`matches(payload, '"n":3')`,
+		`size(json.tags) == 2 && json.tags[-1] == 'b'`,
+		`"a" in json.tags && "user" in json && "code" in meta`,
+		`meta.code >= 400 && meta.code < 500`,
+		`(json.n + 1) * 2 == 8 && json.n % 2 == 1`,
+		`!has(json.missing) && has(json.user)`,
+		`json.missing != 1`,
+		`payload.contains("Ann") && payload.startsWith("{") && payload.endsWith("}")`,
+		`string(json.n) + "x" == "3x" && number(meta.code) == 404`,
+		`timestamp <= now && now - timestamp < 60`,
+	}
+	for _, expression := range accepted {
+		conf := core.NewPluginConfig("", "filter.Expression")
+		conf.Override("Expression", expression)
+
+		plugin, err := core.NewPluginWithConfig(conf)
+		expect.NoError(err)
+
+		filter, casted := plugin.(*Expression)
+		expect.True(casted)
+
+		result, _ := filter.ApplyFilter(msg)
+		if result != core.FilterResultMessageAccept {
+			t.Errorf("Expression %s rejected the message", expression)
+		}
+	}
+
+	rejected := []string{
+		`json.missing == 1`,
+		`json.user.name > 1`,
+		`-json.n > 0`,
+		`json.n / 0 == 0`,
+		`false || null`,
+	}
+	for _, expression := range rejected {
+		conf := core.NewPluginConfig("", "filter.Expression")
+		conf.Override("Expression", expression)
+
+		plugin, err := core.NewPluginWithConfig(conf)
+		expect.NoError(err)
+
+		filter, casted := plugin.(*Expression)
+		expect.True(casted)
+
+		result, _ := filter.ApplyFilter(msg)
+		if result == core.FilterResultMessageAccept {
+			t.Errorf("Expression %s accepted the message", expression)
+		}
+	}
+
+	for _, expression := range []string{`json.`, `unknown == 1`, `payload =~ json.x`, `size()`, `(1`, `'open`, `1 $ 2`} {
+		_, err := parseExpression(expression)
+		expect.NotNil(err)
+	}
+}
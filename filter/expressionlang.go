@@ -0,0 +1,761 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/trivago/gollum/core"
+)
+
+// expressionMissing is the value of fields that do not exist. It differs
+// from nil, which is the value of a JSON null.
+type expressionMissingType struct{}
+
+var expressionMissing = expressionMissingType{}
+
+// expressionNode evaluates a part of an expression for a message.
+type expressionNode func(ctx *expressionContext) interface{}
+
+// expressionContext holds the message an expression is evaluated for. The
+// content is parsed as JSON on first access.
+type expressionContext struct {
+	msg      *core.Message
+	document interface{}
+	parsed   bool
+}
+
+func (ctx *expressionContext) json() interface{} {
+	if !ctx.parsed {
+		ctx.parsed = true
+		ctx.document = expressionMissing
+		var document interface{}
+		if err := json.Unmarshal(ctx.msg.GetPayload(), &document); err == nil {
+			ctx.document = document
+		}
+	}
+	return ctx.document
+}
+
+type expressionToken struct {
+	kind  byte // 'n'umber, 's'tring, 'i'dentifier, 'o'perator or 0 for the end
+	text  string
+	value interface{}
+}
+
+// expressionOperators contains all operators, longer ones first.
+var expressionOperators = []string{
+	"||", "&&", "==", "!=", "<=", ">=", "=~",
+	"<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", ".",
+}
+
+type expressionParser struct {
+	tokens []expressionToken
+	pos    int
+}
+
+// parseExpression compiles an expression into a function evaluating it.
+func parseExpression(text string) (expressionNode, error) {
+	tokens, err := tokenizeExpression(text)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := expressionParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != 0 {
+		return nil, fmt.Errorf("unexpected '%s'", token.text)
+	}
+	return node, nil
+}
+
+func tokenizeExpression(text string) ([]expressionToken, error) {
+	tokens := []expressionToken{}
+	for pos := 0; pos < len(text); {
+		char := text[pos]
+		switch {
+		case char == ' ' || char == '\t' || char == '\n' || char == '\r':
+			pos++
+
+		case char >= '0' && char <= '9':
+			end := pos
+			for end < len(text) && (text[end] >= '0' && text[end] <= '9' || text[end] == '.') {
+				end++
+			}
+			value, err := strconv.ParseFloat(text[pos:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number '%s'", text[pos:end])
+			}
+			tokens = append(tokens, expressionToken{kind: 'n', text: text[pos:end], value: value})
+			pos = end
+
+		case char == '"' || char == '\'':
+			value := make([]byte, 0, 16)
+			end := pos + 1
+			for ; end < len(text) && text[end] != char; end++ {
+				if text[end] == '\\' && end+1 < len(text) {
+					end++
+				}
+				value = append(value, text[end])
+			}
+			if end >= len(text) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, expressionToken{kind: 's', text: text[pos : end+1], value: string(value)})
+			pos = end + 1
+
+		case char == '_' || char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z':
+			end := pos
+			for end < len(text) && (text[end] == '_' || text[end] >= 'a' && text[end] <= 'z' ||
+				text[end] >= 'A' && text[end] <= 'Z' || text[end] >= '0' && text[end] <= '9') {
+				end++
+			}
+			tokens = append(tokens, expressionToken{kind: 'i', text: text[pos:end]})
+			pos = end
+
+		default:
+			found := false
+			for _, operator := range expressionOperators {
+				if strings.HasPrefix(text[pos:], operator) {
+					tokens = append(tokens, expressionToken{kind: 'o', text: operator})
+					pos += len(operator)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character '%c'", char)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+func (parser *expressionParser) peek() expressionToken {
+	if parser.pos >= len(parser.tokens) {
+		return expressionToken{text: "end of expression"}
+	}
+	return parser.tokens[parser.pos]
+}
+
+// accept consumes the next token if it is the given operator or keyword.
+func (parser *expressionParser) accept(text string) bool {
+	if token := parser.peek(); (token.kind == 'o' || token.kind == 'i') && token.text == text {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+func (parser *expressionParser) expect(text string) error {
+	if !parser.accept(text) {
+		return fmt.Errorf("expected '%s' but found '%s'", text, parser.peek().text)
+	}
+	return nil
+}
+
+func (parser *expressionParser) parseOr() (expressionNode, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for parser.accept("||") {
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs := left
+		left = func(ctx *expressionContext) interface{} {
+			return expressionTruthy(lhs(ctx)) || expressionTruthy(right(ctx))
+		}
+	}
+	return left, nil
+}
+
+func (parser *expressionParser) parseAnd() (expressionNode, error) {
+	left, err := parser.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for parser.accept("&&") {
+		right, err := parser.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		lhs := left
+		left = func(ctx *expressionContext) interface{} {
+			return expressionTruthy(lhs(ctx)) && expressionTruthy(right(ctx))
+		}
+	}
+	return left, nil
+}
+
+func (parser *expressionParser) parseComparison() (expressionNode, error) {
+	left, err := parser.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">", "in", "=~"} {
+		if !parser.accept(operator) {
+			continue
+		}
+		if operator == "=~" {
+			expression, err := parser.parseRegexp()
+			if err != nil {
+				return nil, err
+			}
+			return func(ctx *expressionContext) interface{} {
+				text, isString := left(ctx).(string)
+				return isString && expression.MatchString(text)
+			}, nil
+		}
+
+		right, err := parser.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *expressionContext) interface{} {
+			return expressionCompare(operator, left(ctx), right(ctx))
+		}, nil
+	}
+	return left, nil
+}
+
+func (parser *expressionParser) parseRegexp() (*regexp.Regexp, error) {
+	token := parser.peek()
+	if token.kind != 's' {
+		return nil, fmt.Errorf("expected a regular expression string but found '%s'", token.text)
+	}
+	parser.pos++
+	return regexp.Compile(token.value.(string))
+}
+
+func (parser *expressionParser) parseAdditive() (expressionNode, error) {
+	left, err := parser.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator := parser.peek().text
+		if !parser.accept("+") && !parser.accept("-") {
+			return left, nil
+		}
+		right, err := parser.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = expressionArithmetic(operator, left, right)
+	}
+}
+
+func (parser *expressionParser) parseMultiplicative() (expressionNode, error) {
+	left, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator := parser.peek().text
+		if !parser.accept("*") && !parser.accept("/") && !parser.accept("%") {
+			return left, nil
+		}
+		right, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = expressionArithmetic(operator, left, right)
+	}
+}
+
+func (parser *expressionParser) parseUnary() (expressionNode, error) {
+	switch {
+	case parser.accept("!"):
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *expressionContext) interface{} {
+			return !expressionTruthy(operand(ctx))
+		}, nil
+
+	case parser.accept("-"):
+		operand, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *expressionContext) interface{} {
+			if number, isNumber := expressionNumber(operand(ctx)); isNumber {
+				return -number
+			}
+			return expressionMissing
+		}, nil
+	}
+	return parser.parsePostfix()
+}
+
+func (parser *expressionParser) parsePostfix() (expressionNode, error) {
+	node, err := parser.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case parser.accept("."):
+			token := parser.peek()
+			if token.kind != 'i' {
+				return nil, fmt.Errorf("expected a name after '.' but found '%s'", token.text)
+			}
+			parser.pos++
+
+			if parser.peek().text == "(" {
+				// Method call, the receiver is passed as first argument
+				if node, err = parser.parseCall(token.text, []expressionNode{node}); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			parent, key := node, token.text
+			node = func(ctx *expressionContext) interface{} {
+				return expressionMember(parent(ctx), key)
+			}
+
+		case parser.accept("["):
+			index, err := parser.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := parser.expect("]"); err != nil {
+				return nil, err
+			}
+			parent := node
+			node = func(ctx *expressionContext) interface{} {
+				return expressionMember(parent(ctx), index(ctx))
+			}
+
+		default:
+			return node, nil
+		}
+	}
+}
+
+func (parser *expressionParser) parsePrimary() (expressionNode, error) {
+	token := parser.peek()
+	parser.pos++
+
+	switch token.kind {
+	case 'n', 's':
+		value := token.value
+		return func(*expressionContext) interface{} { return value }, nil
+
+	case 'i':
+		if parser.peek().text == "(" {
+			return parser.parseCall(token.text, nil)
+		}
+		switch token.text {
+		case "true":
+			return func(*expressionContext) interface{} { return true }, nil
+		case "false":
+			return func(*expressionContext) interface{} { return false }, nil
+		case "null":
+			return func(*expressionContext) interface{} { return nil }, nil
+		case "payload":
+			return func(ctx *expressionContext) interface{} { return string(ctx.msg.GetPayload()) }, nil
+		case "stream":
+			return func(ctx *expressionContext) interface{} {
+				return core.StreamRegistry.GetStreamName(ctx.msg.GetStreamID())
+			}, nil
+		case "timestamp":
+			return func(ctx *expressionContext) interface{} {
+				return float64(ctx.msg.GetCreationTime().UnixNano()) / float64(time.Second)
+			}, nil
+		case "now":
+			return func(*expressionContext) interface{} {
+				return float64(time.Now().UnixNano()) / float64(time.Second)
+			}, nil
+		case "meta":
+			return func(ctx *expressionContext) interface{} {
+				if metadata := ctx.msg.TryGetMetadata(); metadata != nil {
+					return metadata
+				}
+				return core.Metadata{}
+			}, nil
+		case "json":
+			return func(ctx *expressionContext) interface{} { return ctx.json() }, nil
+		}
+		return nil, fmt.Errorf("unknown name '%s'", token.text)
+
+	case 'o':
+		switch token.text {
+		case "(":
+			node, err := parser.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, parser.expect(")")
+
+		case "[":
+			items := []expressionNode{}
+			for !parser.accept("]") {
+				if len(items) > 0 {
+					if err := parser.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				item, err := parser.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+			return func(ctx *expressionContext) interface{} {
+				list := make([]interface{}, len(items))
+				for i, item := range items {
+					list[i] = item(ctx)
+				}
+				return list
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected '%s'", token.text)
+}
+
+// parseCall parses the arguments of a function call and binds them to the
+// function of the given name.
+func (parser *expressionParser) parseCall(name string, args []expressionNode) (expressionNode, error) {
+	if err := parser.expect("("); err != nil {
+		return nil, err
+	}
+
+	if name == "matches" {
+		if len(args) == 0 {
+			receiver, err := parser.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := parser.expect(","); err != nil {
+				return nil, err
+			}
+			args = append(args, receiver)
+		}
+		expression, err := parser.parseRegexp()
+		if err != nil {
+			return nil, err
+		}
+		receiver := args[0]
+		return func(ctx *expressionContext) interface{} {
+			text, isString := receiver(ctx).(string)
+			return isString && expression.MatchString(text)
+		}, parser.expect(")")
+	}
+
+	for first := true; !parser.accept(")"); first = false {
+		if !first {
+			if err := parser.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	function, exists := expressionFunctions[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown function '%s'", name)
+	}
+	if len(args) != function.args {
+		return nil, fmt.Errorf("function '%s' expects %d arguments", name, function.args)
+	}
+
+	return func(ctx *expressionContext) interface{} {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			values[i] = arg(ctx)
+		}
+		return function.call(values)
+	}, nil
+}
+
+type expressionFunction struct {
+	args int
+	call func(args []interface{}) interface{}
+}
+
+// expressionFunctions contains all functions that can be called by
+// expressions, either as "name(a, b)" or as "a.name(b)".
+var expressionFunctions = map[string]expressionFunction{
+	"has": {1, func(args []interface{}) interface{} {
+		return args[0] != expressionMissing
+	}},
+	"size": {1, func(args []interface{}) interface{} {
+		switch value := args[0].(type) {
+		case string:
+			return float64(utf8.RuneCountInString(value))
+		case []interface{}:
+			return float64(len(value))
+		case map[string]interface{}:
+			return float64(len(value))
+		case core.Metadata:
+			return float64(len(value))
+		}
+		return expressionMissing
+	}},
+	"contains":   expressionStringFunction(strings.Contains),
+	"startsWith": expressionStringFunction(strings.HasPrefix),
+	"endsWith":   expressionStringFunction(strings.HasSuffix),
+	"lower": {1, func(args []interface{}) interface{} {
+		if text, isString := args[0].(string); isString {
+			return strings.ToLower(text)
+		}
+		return expressionMissing
+	}},
+	"upper": {1, func(args []interface{}) interface{} {
+		if text, isString := args[0].(string); isString {
+			return strings.ToUpper(text)
+		}
+		return expressionMissing
+	}},
+	"string": {1, func(args []interface{}) interface{} {
+		return expressionString(args[0])
+	}},
+	"number": {1, func(args []interface{}) interface{} {
+		if number, isNumber := expressionNumber(args[0]); isNumber {
+			return number
+		}
+		return expressionMissing
+	}},
+}
+
+func expressionStringFunction(function func(string, string) bool) expressionFunction {
+	return expressionFunction{2, func(args []interface{}) interface{} {
+		text, isString := args[0].(string)
+		other, otherIsString := args[1].(string)
+		return isString && otherIsString && function(text, other)
+	}}
+}
+
+func expressionArithmetic(operator string, left, right expressionNode) expressionNode {
+	return func(ctx *expressionContext) interface{} {
+		lhs, rhs := left(ctx), right(ctx)
+		if operator == "+" {
+			if text, isString := lhs.(string); isString {
+				if other, otherIsString := rhs.(string); otherIsString {
+					return text + other
+				}
+			}
+		}
+
+		a, aIsNumber := expressionNumber(lhs)
+		b, bIsNumber := expressionNumber(rhs)
+		if !aIsNumber || !bIsNumber {
+			return expressionMissing
+		}
+		switch operator {
+		case "+":
+			return a + b
+		case "-":
+			return a - b
+		case "*":
+			return a * b
+		case "/":
+			if b == 0 {
+				return expressionMissing
+			}
+			return a / b
+		default:
+			if b == 0 {
+				return expressionMissing
+			}
+			return math.Mod(a, b)
+		}
+	}
+}
+
+// expressionMember returns the field or element of a value.
+func expressionMember(value interface{}, key interface{}) interface{} {
+	switch container := value.(type) {
+	case core.Metadata:
+		if name, isString := key.(string); isString {
+			if data, exists := container.TryGetValue(name); exists {
+				return string(data)
+			}
+		}
+	case map[string]interface{}:
+		if name, isString := key.(string); isString {
+			if child, exists := container[name]; exists {
+				return child
+			}
+		}
+	case []interface{}:
+		if number, isNumber := key.(float64); isNumber {
+			index := int(number)
+			if index < 0 {
+				index += len(container)
+			}
+			if index >= 0 && index < len(container) {
+				return container[index]
+			}
+		}
+	}
+	return expressionMissing
+}
+
+// expressionCompare applies a comparison operator. Strings are compared as
+// numbers if the other side is a number, so that metadata can be compared
+// to numbers.
+func expressionCompare(operator string, left, right interface{}) bool {
+	if operator == "in" {
+		switch container := right.(type) {
+		case []interface{}:
+			for _, item := range container {
+				if expressionEqual(left, item) {
+					return true
+				}
+			}
+		case map[string]interface{}, core.Metadata:
+			return expressionMember(container, left) != expressionMissing
+		case string:
+			text, isString := left.(string)
+			return isString && strings.Contains(container, text)
+		}
+		return false
+	}
+
+	if left == expressionMissing || right == expressionMissing {
+		return operator == "!="
+	}
+
+	switch operator {
+	case "==":
+		return expressionEqual(left, right)
+	case "!=":
+		return !expressionEqual(left, right)
+	}
+
+	var order int
+	_, leftIsNumber := left.(float64)
+	_, rightIsNumber := right.(float64)
+	if leftIsNumber || rightIsNumber {
+		a, aIsNumber := expressionNumber(left)
+		b, bIsNumber := expressionNumber(right)
+		if !aIsNumber || !bIsNumber {
+			return false
+		}
+		switch {
+		case a < b:
+			order = -1
+		case a > b:
+			order = 1
+		}
+	} else {
+		a, aIsString := left.(string)
+		b, bIsString := right.(string)
+		if !aIsString || !bIsString {
+			return false
+		}
+		order = strings.Compare(a, b)
+	}
+
+	switch operator {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+func expressionEqual(left, right interface{}) bool {
+	_, leftIsNumber := left.(float64)
+	_, rightIsNumber := right.(float64)
+	if leftIsNumber || rightIsNumber {
+		a, aIsNumber := expressionNumber(left)
+		b, bIsNumber := expressionNumber(right)
+		return aIsNumber && bIsNumber && a == b
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+// expressionNumber converts numbers and strings holding a number to float64.
+func expressionNumber(value interface{}) (float64, bool) {
+	switch typedValue := value.(type) {
+	case float64:
+		return typedValue, true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(typedValue), 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func expressionString(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(typedValue)
+	case nil:
+		return "null"
+	case expressionMissingType:
+		return expressionMissing
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return expressionMissing
+	}
+	return string(data)
+}
+
+// expressionTruthy returns false for false, null, missing values, 0 and
+// empty strings, lists and maps.
+func expressionTruthy(value interface{}) bool {
+	switch typedValue := value.(type) {
+	case bool:
+		return typedValue
+	case nil, expressionMissingType:
+		return false
+	case float64:
+		return typedValue != 0
+	case string:
+		return typedValue != ""
+	case []interface{}:
+		return len(typedValue) > 0
+	case map[string]interface{}:
+		return len(typedValue) > 0
+	case core.Metadata:
+		return len(typedValue) > 0
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+)
+
+func evaluateTestExpression(t *testing.T, expression string, msg *core.Message) interface{} {
+	node, err := parseExpression(expression)
+	if err != nil {
+		t.Errorf("Expression %s failed to parse: %s", expression, err)
+		return nil
+	}
+	return node(&expressionContext{msg: msg})
+}
+
+func TestExpressionPrecedence(t *testing.T) {
+	msg := core.NewMessage(nil, []byte(`{"n":3,"tags":["a","b"]}`), nil, core.InvalidStreamID)
+
+	results := map[string]interface{}{
+		`1 + 2 * 3`:                      7.0,
+		`(1 + 2) * 3`:                    9.0,
+		`10 - 4 - 3`:                     3.0,
+		`12 / 3 / 2`:                     2.0,
+		`2 * 3 % 4`:                      2.0,
+		`-2 * 3`:                         -6.0,
+		`- -2`:                           2.0,
+		`json.n * 2 + 1`:                 7.0,
+		`1 + json.n * 2`:                 7.0,
+		`json.tags[0] + json.tags[1]`:    "ab",
+		`1 + 1 == 2`:                     true,
+		`2 * 3 > 5 && 1 < 2`:             true,
+		`!true || true`:                  true,
+		`!(true || true)`:                false,
+		`true || false && false`:         true,
+		`(true || false) && false`:       false,
+		`false && true || true`:          true,
+		`!json.missing`:                  true,
+		`!!json.n`:                       true,
+		`json.n in [1, 3] && !(1 in [])`: true,
+	}
+
+	for expression, expected := range results {
+		if value := evaluateTestExpression(t, expression, msg); !reflect.DeepEqual(expected, value) {
+			t.Errorf("Expression %s returned %#v instead of %#v", expression, value, expected)
+		}
+	}
+}
+
+func TestExpressionTypes(t *testing.T) {
+	msg := core.NewMessage(nil, []byte(`{"user":{"name":"Ann"},"n":3,"nil":null}`), core.Metadata{"code": []byte("404")}, core.InvalidStreamID)
+
+	results := map[string]interface{}{
+		// Conversions
+		`"1" + 1`:                2.0,
+		`meta.code + 1`:          405.0,
+		`meta.code == 404`:       true,
+		`"a" + "b"`:              "ab",
+		`string(json.user)`:      `{"name":"Ann"}`,
+		`string(json.nil)`:       "null",
+		`string(true)`:           "true",
+		`size("héllo")`:          5.0,
+		`json.user.name.upper()`: "ANN",
+		`null == json.nil`:       true,
+
+		// Type errors return a missing value or false
+		`"a" - 1`:                    expressionMissing,
+		`"a" * "b"`:                  expressionMissing,
+		`-"a"`:                       expressionMissing,
+		`json.user + 1`:              expressionMissing,
+		`5 % 0`:                      expressionMissing,
+		`size(1)`:                    expressionMissing,
+		`lower(1)`:                   expressionMissing,
+		`number("x")`:                expressionMissing,
+		`string(json.missing)`:       expressionMissing,
+		`json.user.name[0]`:          expressionMissing,
+		`json.user.name > 1`:         false,
+		`true < false`:               false,
+		`json.user < json.user`:      false,
+		`json.n =~ '3'`:              false,
+		`json.user.name.contains(1)`: false,
+		`"1" in 1`:                   false,
+		`1 in json.user`:             false,
+
+		// Missing values are never equal
+		`json.missing == json.missing`: false,
+		`json.missing != json.missing`: true,
+		`json.missing < 1`:             false,
+		`json.missing.child`:           expressionMissing,
+	}
+
+	for expression, expected := range results {
+		if value := evaluateTestExpression(t, expression, msg); !reflect.DeepEqual(expected, value) {
+			t.Errorf("Expression %s returned %#v instead of %#v", expression, value, expected)
+		}
+	}
+}
+
+func TestExpressionParseErrors(t *testing.T) {
+	invalid := []string{
+		``,
+		`()`,
+		`1 2`,
+		`1 +`,
+		`* 2`,
+		`1 < 2 < 3`,
+		`1 == 1 == true`,
+		`1.2.3`,
+		`"unterminated`,
+		`json[`,
+		`json.tags[0`,
+		`json.1`,
+		`[1, 2`,
+		`[1 2]`,
+		`unknown`,
+		`unknown(1)`,
+		`size(1, 2)`,
+		`has()`,
+		`matches(payload)`,
+		`matches(payload, json.x)`,
+		`payload =~ '('`,
+		`payload =~ 1`,
+		`1 # 2`,
+	}
+
+	for _, expression := range invalid {
+		if _, err := parseExpression(expression); err == nil {
+			t.Errorf("Expression %s did not fail to parse", expression)
+		}
+	}
+}
@@ -16,10 +16,13 @@ package filter
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/tgo/tcontainer"
+	"math"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 // JSON filter
@@ -41,6 +44,34 @@ import (
 // can be defined in the format accepted by tgo.MarshalMap.Path.
 // By default this parameter is set to an empty list.
 //
+// - Equals: Defines a list of field names and values. Messages are only
+// accepted if the specified field exists and is equal to the given value.
+// Numbers and booleans are compared by their string representation.
+// By default this parameter is set to an empty list.
+//
+// - Contains: Defines a list of field names and values. Messages are only
+// accepted if the specified field contains the given value. For strings this
+// is a substring, for arrays an element and for objects a key.
+// By default this parameter is set to an empty list.
+//
+// - Range: Defines a list of field names and numeric ranges in the form
+// "min:max". Messages are only accepted if the specified field is a number
+// or numeric string between min and max (both inclusive). Either bound may
+// be left empty, e.g. "500:" or ":0.5".
+// By default this parameter is set to an empty list.
+//
+// - Exists: Defines a list of field names that must exist for a message to
+// be accepted. Fields set to null do exist.
+// By default this parameter is set to an empty list.
+//
+// - Missing: Defines a list of field names that must not exist for a message
+// to be accepted.
+// By default this parameter is set to an empty list.
+//
+// All conditions have to be met for a message to be accepted. Other than
+// Accept, the conditions Equals, Contains and Range reject messages that do
+// not have the specified field.
+//
 // - ApplyTo: Defines which part of the message the filter is applied to.
 // When set to "", this filter is applied to the message's payload. All
 // other values denotes a metadata key.
@@ -58,13 +89,39 @@ import (
 //        Accept:
 //          source: ^www\d+\.
 //          data/active: true
+//
+// This example accepts server errors of the checkout service that took at
+// least a second:
+//
+//  ExampleConsumer:
+//    Type: consumer.Console
+//    Streams: console
+//    Modulators:
+//      - filter.JSON:
+//        Equals:
+//          service/name: checkout
+//        Range:
+//          status: "500:599"
+//          duration: "1.0:"
+//        Exists:
+//          - request/id
 type JSON struct {
 	core.SimpleFilter `gollumdoc:"embed_type"`
 	rejectValues      map[string]*regexp.Regexp
 	acceptValues      map[string]*regexp.Regexp
+	equalValues       map[string]string
+	containValues     map[string]string
+	rangeValues       map[string]jsonRange
+	existFields       []string `config:"Exists"`
+	missingFields     []string `config:"Missing"`
 	getAppliedContent core.GetAppliedContent
 }
 
+type jsonRange struct {
+	min float64
+	max float64
+}
+
 func init() {
 	core.TypeRegistry.Register(JSON{})
 }
@@ -92,27 +149,151 @@ func (filter *JSON) Configure(conf core.PluginConfigReader) {
 		}
 	}
 
+	filter.equalValues = conf.GetStringMap("Equals", make(map[string]string))
+	filter.containValues = conf.GetStringMap("Contains", make(map[string]string))
+	filter.rangeValues = make(map[string]jsonRange)
+
+	for key, val := range conf.GetStringMap("Range", make(map[string]string)) {
+		bounds, err := parseJSONRange(val)
+		if !conf.Errors.Push(err) {
+			filter.rangeValues[key] = bounds
+		}
+	}
+
 	applyTo := conf.GetString("ApplyTo", "")
 	filter.getAppliedContent = core.GetAppliedContentGetFunction(applyTo)
 }
 
+// parseJSONRange parses a range in the form "min:max" with optional bounds.
+func parseJSONRange(text string) (jsonRange, error) {
+	bounds := jsonRange{min: math.Inf(-1), max: math.Inf(1)}
+	colonIdx := strings.Index(text, ":")
+	if colonIdx < 0 {
+		return bounds, fmt.Errorf("range '%s' is not in the form min:max", text)
+	}
+
+	var err error
+	if minText := strings.TrimSpace(text[:colonIdx]); minText != "" {
+		if bounds.min, err = strconv.ParseFloat(minText, 64); err != nil {
+			return bounds, fmt.Errorf("range '%s' has an invalid minimum: %s", text, err)
+		}
+	}
+	if maxText := strings.TrimSpace(text[colonIdx+1:]); maxText != "" {
+		if bounds.max, err = strconv.ParseFloat(maxText, 64); err != nil {
+			return bounds, fmt.Errorf("range '%s' has an invalid maximum: %s", text, err)
+		}
+	}
+	return bounds, nil
+}
+
 func (filter *JSON) getValue(key string, values tcontainer.MarshalMap) (string, bool) {
 	if value, found := values.Value(key); found {
-		switch value.(type) {
-		case string:
-			return value.(string), true
+		return jsonValueToString(value)
+	}
 
-		case bool:
-			return strconv.FormatBool(value.(bool)), true
+	return "", false
+}
 
-		case float64:
-			return strconv.FormatFloat(value.(float64), 'f', -1, 64), true
-		}
+func jsonValueToString(value interface{}) (string, bool) {
+	switch value.(type) {
+	case string:
+		return value.(string), true
+
+	case bool:
+		return strconv.FormatBool(value.(bool)), true
+
+	case float64:
+		return strconv.FormatFloat(value.(float64), 'f', -1, 64), true
 	}
 
 	return "", false
 }
 
+func (filter *JSON) contains(key string, search string, values tcontainer.MarshalMap) bool {
+	value, found := values.Value(key)
+	if !found {
+		return false
+	}
+
+	switch value.(type) {
+	case string:
+		return strings.Contains(value.(string), search)
+
+	case []interface{}:
+		for _, item := range value.([]interface{}) {
+			if text, isScalar := jsonValueToString(item); isScalar && text == search {
+				return true
+			}
+		}
+
+	case map[string]interface{}:
+		_, exists := value.(map[string]interface{})[search]
+		return exists
+	}
+
+	return false
+}
+
+func (filter *JSON) inRange(key string, bounds jsonRange, values tcontainer.MarshalMap) bool {
+	value, found := values.Value(key)
+	if !found {
+		return false
+	}
+
+	var number float64
+	switch value.(type) {
+	case float64:
+		number = value.(float64)
+
+	case string:
+		var err error
+		if number, err = strconv.ParseFloat(strings.TrimSpace(value.(string)), 64); err != nil {
+			return false
+		}
+
+	default:
+		return false
+	}
+
+	return number >= bounds.min && number <= bounds.max
+}
+
+// matchesConditions returns true if all of Equals, Contains, Range, Exists
+// and Missing are met.
+func (filter *JSON) matchesConditions(values tcontainer.MarshalMap) bool {
+	for key, expected := range filter.equalValues {
+		if value, exists := filter.getValue(key, values); !exists || value != expected {
+			return false
+		}
+	}
+
+	for key, search := range filter.containValues {
+		if !filter.contains(key, search, values) {
+			return false
+		}
+	}
+
+	for key, bounds := range filter.rangeValues {
+		if !filter.inRange(key, bounds, values) {
+			return false
+		}
+	}
+
+	for _, key := range filter.existFields {
+		if _, exists := values.Value(key); !exists {
+			return false
+		}
+	}
+
+	for _, key := range filter.missingFields {
+		if _, exists := values.Value(key); exists {
+			return false
+		}
+	}
+
+	return true
+}
+
 // ApplyFilter check if all Filter wants to reject the message
 func (filter *JSON) ApplyFilter(msg *core.Message) (core.FilterResult, error) {
 	values := tcontainer.NewMarshalMap()
@@ -138,5 +319,9 @@ func (filter *JSON) ApplyFilter(msg *core.Message) (core.FilterResult, error) {
 		}
 	}
 
+	if !filter.matchesConditions(values) {
+		return filter.GetFilterResultMessageReject(), nil
+	}
+
 	return core.FilterResultMessageAccept, nil
 }
@@ -15,6 +15,7 @@
 package filter
 
 import (
+	"math"
 	"testing"
 
 	"github.com/trivago/gollum/core"
@@ -97,3 +98,55 @@ func TestFilterJSONFailure(t *testing.T) {
 	expect.Neq(core.FilterResultMessageAccept, result)
 	expect.NotNil(err)
 }
+
+func TestFilterJSONConditions(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	conf := core.NewPluginConfig("", "filter.JSON")
+
+	conf.Override("Equals", map[string]string{"service/name": "checkout", "debug": "false"})
+	conf.Override("Contains", map[string]string{"tags": "prod", "request": "id"})
+	conf.Override("Range", map[string]string{"status": "500:599", "duration": "1.0:"})
+	conf.Override("Exists", []string{"trace"})
+	conf.Override("Missing", []string{"test"})
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*JSON)
+	expect.True(casted)
+
+	accepted := `{"service":{"name":"checkout"},"debug":false,"tags":["prod","eu"],"request":{"id":1},"status":503,"duration":"1.5","trace":null}`
+	msg := core.NewMessage(nil, []byte(accepted), nil, core.InvalidStreamID)
+	result, _ := filter.ApplyFilter(msg)
+	expect.Equal(core.FilterResultMessageAccept, result)
+
+	rejected := []string{
+		`{"service":{"name":"cart"},"debug":false,"tags":["prod"],"request":{"id":1},"status":503,"duration":2,"trace":1}`,
+		`{"service":{"name":"checkout"},"debug":false,"tags":["production"],"request":{"id":1},"status":503,"duration":2,"trace":1}`,
+		`{"service":{"name":"checkout"},"debug":false,"tags":["prod"],"request":{},"status":503,"duration":2,"trace":1}`,
+		`{"service":{"name":"checkout"},"debug":false,"tags":["prod"],"request":{"id":1},"status":404,"duration":2,"trace":1}`,
+		`{"service":{"name":"checkout"},"debug":false,"tags":["prod"],"request":{"id":1},"status":503,"duration":"fast","trace":1}`,
+		`{"service":{"name":"checkout"},"debug":false,"tags":["prod"],"request":{"id":1},"status":503,"duration":2}`,
+		`{"service":{"name":"checkout"},"debug":false,"tags":["prod"],"request":{"id":1},"status":503,"duration":2,"trace":1,"test":true}`,
+		`{"service":{"name":"checkout"},"tags":["prod"],"request":{"id":1},"status":503,"duration":2,"trace":1}`,
+	}
+	for _, payload := range rejected {
+		msg := core.NewMessage(nil, []byte(payload), nil, core.InvalidStreamID)
+		result, _ := filter.ApplyFilter(msg)
+		expect.Neq(core.FilterResultMessageAccept, result)
+	}
+}
+
+func TestFilterJSONRange(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	bounds, err := parseJSONRange(":-0.5")
+	expect.NoError(err)
+	expect.True(math.IsInf(bounds.min, -1))
+	expect.Equal(-0.5, bounds.max)
+
+	_, err = parseJSONRange("10")
+	expect.NotNil(err)
+
+	_, err = parseJSONRange("a:b")
+	expect.NotNil(err)
+}
@@ -15,6 +15,10 @@
 package filter
 
 import (
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
 	"sync/atomic"
 
 	"github.com/trivago/gollum/core"
@@ -26,8 +30,34 @@ import (
 // This allows you to reduce the amount of messages; the plugin starts
 // blocking after a certain number of messages has been reached.
 //
+// Instead of counting messages, a percentage of messages can be selected
+// randomly or by the hash of a key. When sampling by key, all messages with
+// the same key, e.g. a request or trace ID, are either all passed or all
+// filtered.
+//
 // Parameters
 //
+// - SampleMode: Defines how messages are selected. "group" passes the first
+// SampleRatePerGroup messages of each SampleGroupSize messages. "random"
+// passes SamplePercentage percent of all messages randomly. "hash" passes
+// messages if the hash of SampleKey falls into SamplePercentage percent of
+// all hashes. Messages without SampleKey are sampled randomly.
+// By default this parameter is set to "group".
+//
+// - SamplePercentage: Defines the percentage of messages passed by the modes
+// "random" and "hash".
+// By default this parameter is set to 50.
+//
+// - SampleKey: Defines the metadata field used as key by mode "hash". If
+// empty, the payload is used.
+// By default this parameter is set to "".
+//
+// - SampleRateField: Defines a metadata field passed messages are annotated
+// with. It holds the number of messages represented by each passed message,
+// e.g. "10" when passing 10 percent. Downstream systems can use it to
+// extrapolate counts. If empty, no field is written.
+// By default this parameter is set to "".
+//
 // - SampleRatePerGroup: This value defines how many messages are passed through
 // the filter in each group.
 // By default this parameter is set to "1".
@@ -55,12 +85,29 @@ import (
 //          - foo
 //          - bar
 //
+// This example passes all messages of 5 percent of all traces:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - filter.Sample:
+//        SampleMode: hash
+//        SamplePercentage: 5
+//        SampleKey: trace_id
+//        SampleRateField: sample_rate
+//
 type Sample struct {
 	core.SimpleFilter
-	rate   uint64 `config:"SampleRatePerGroup" default:"1"`
-	group  uint64 `config:"SampleGroupSize" default:"2"`
-	count  *uint64
-	ignore map[core.MessageStreamID]bool
+	rate       uint64  `config:"SampleRatePerGroup" default:"1"`
+	group      uint64  `config:"SampleGroupSize" default:"2"`
+	percentage float64 `config:"SamplePercentage" default:"50"`
+	key        string  `config:"SampleKey"`
+	rateField  string  `config:"SampleRateField"`
+	mode       string
+	rateValue  []byte
+	count      *uint64
+	ignore     map[core.MessageStreamID]bool
 }
 
 func init() {
@@ -75,6 +122,23 @@ func (filter *Sample) Configure(conf core.PluginConfigReader) {
 	for _, stream := range ignore {
 		filter.ignore[stream] = true
 	}
+
+	filter.mode = strings.ToLower(conf.GetString("SampleMode", "group"))
+	switch filter.mode {
+	case "group":
+		if filter.rate > 0 {
+			filter.rateValue = []byte(sampleFormatRate(float64(filter.group) / float64(filter.rate)))
+		}
+	case "random", "hash":
+		if filter.percentage < 0 || filter.percentage > 100 {
+			conf.Errors.Pushf("SamplePercentage must be between 0 and 100")
+		}
+		if filter.percentage > 0 {
+			filter.rateValue = []byte(sampleFormatRate(100 / filter.percentage))
+		}
+	default:
+		conf.Errors.Pushf("Unknown sample mode '%s'", filter.mode)
+	}
 }
 
 // ApplyFilter check if all Filter wants to reject the message
@@ -84,12 +148,50 @@ func (filter *Sample) ApplyFilter(msg *core.Message) (core.FilterResult, error)
 		return core.FilterResultMessageAccept, nil // ### return, do not limit ###
 	}
 
-	// Accept the first n messages of each group, reject the rest
-	// Overflow is not really an issue here as it will take years to get one
-	index := (atomic.AddUint64(filter.count, 1) - 1) % filter.group
-	if index < filter.rate {
-		return core.FilterResultMessageAccept, nil // ### return, ok ###
+	if !filter.isSampled(msg) {
+		return filter.GetFilterResultMessageReject(), nil
+	}
+
+	if filter.rateField != "" {
+		msg.GetMetadata().SetValue(filter.rateField, filter.rateValue)
 	}
+	return core.FilterResultMessageAccept, nil
+}
+
+// isSampled returns true if the given message is passed.
+func (filter *Sample) isSampled(msg *core.Message) bool {
+	switch filter.mode {
+	case "random":
+		return rand.Float64()*100 < filter.percentage
+
+	case "hash":
+		var key []byte
+		if filter.key == "" {
+			key = msg.GetPayload()
+		} else if metadata := msg.TryGetMetadata(); metadata != nil {
+			key, _ = metadata.TryGetValue(filter.key)
+		}
+		if len(key) == 0 {
+			return rand.Float64()*100 < filter.percentage
+		}
+
+		// Map the hash to [0,100) so that a key keeps its decision when the
+		// percentage is raised.
+		hash := fnv.New64a()
+		hash.Write(key)
+		return float64(hash.Sum64()%1000000)/10000 < filter.percentage
+
+	default:
+		// Accept the first n messages of each group, reject the rest
+		// Overflow is not really an issue here as it will take years to get one
+		index := (atomic.AddUint64(filter.count, 1) - 1) % filter.group
+		return index < filter.rate
+	}
+}
 
-	return filter.GetFilterResultMessageReject(), nil
+// sampleFormatRate writes a sample rate with up to 3 decimal places.
+func sampleFormatRate(rate float64) string {
+	text := strconv.FormatFloat(rate, 'f', 3, 64)
+	text = strings.TrimRight(text, "0")
+	return strings.TrimSuffix(text, ".")
 }
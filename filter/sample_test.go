@@ -15,6 +15,7 @@
 package filter
 
 import (
+	"strconv"
 	"testing"
 
 	"github.com/trivago/gollum/core"
@@ -103,3 +104,62 @@ func TestFilterSampleIgnore(t *testing.T) {
 	expect.Equal(accept2, 5)
 	expect.Equal(deny2, 5)
 }
+
+func TestFilterSampleHash(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	conf := core.NewPluginConfig("", "filter.Sample")
+
+	conf.Override("SampleMode", "hash")
+	conf.Override("SamplePercentage", 20)
+	conf.Override("SampleKey", "trace")
+	conf.Override("SampleRateField", "rate")
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Sample)
+	expect.True(casted)
+
+	accept := 0
+	for trace := 0; trace < 1000; trace++ {
+		metadata := core.Metadata{"trace": []byte(strconv.Itoa(trace))}
+		first, _ := filter.ApplyFilter(core.NewMessage(nil, []byte("a"), metadata, 1))
+		second, _ := filter.ApplyFilter(core.NewMessage(nil, []byte("b"), metadata.Clone(), 1))
+		expect.Equal(first, second)
+
+		if first == core.FilterResultMessageAccept {
+			accept++
+			expect.Equal("5", metadata.GetValueString("rate"))
+		}
+	}
+	expect.Greater(accept, 150)
+	expect.Less(accept, 250)
+}
+
+func TestFilterSampleRandom(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	conf := core.NewPluginConfig("", "filter.Sample")
+
+	conf.Override("SampleMode", "random")
+	conf.Override("SamplePercentage", 0)
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Sample)
+	expect.True(casted)
+
+	for i := 0; i < 100; i++ {
+		result, _ := filter.ApplyFilter(core.NewMessage(nil, []byte{}, nil, 1))
+		expect.Neq(core.FilterResultMessageAccept, result)
+	}
+
+	conf.Override("SamplePercentage", 100)
+	conf.Override("SampleRateField", "rate")
+	plugin, err = core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	filter = plugin.(*Sample)
+
+	msg := core.NewMessage(nil, []byte{}, nil, 1)
+	result, _ := filter.ApplyFilter(msg)
+	expect.Equal(core.FilterResultMessageAccept, result)
+	expect.Equal("1", msg.GetMetadata().GetValueString("rate"))
+}
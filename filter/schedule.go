@@ -0,0 +1,276 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+// Schedule filter plugin
+//
+// This plugin passes messages only during configured time windows, e.g. to
+// suppress noisy debug streams outside of business hours. If Invert is set,
+// messages are filtered during the time windows instead, e.g. during
+// maintenance.
+//
+// Time windows are defined by cron expressions made of five fields: minute
+// (0-59), hour (0-23), day of month (1-31), month (1-12 or jan-dec) and day
+// of week (0-7 or sun-sat, 0 and 7 both being sunday). Each field can be "*",
+// a value, a range "a-b", a step "*/n" or "a-b/n" or a comma separated list
+// of these. A message matches if each field matches the time it is checked
+// at. As with cron, if both day of month and day of week are restricted, a
+// message matches if either of them matches.
+//
+// Parameters
+//
+// - Windows: Defines a list of cron expressions. Messages are passed if at
+// least one expression matches. If empty, all messages are passed.
+// By default this parameter is set to an empty list.
+//
+// - Timezone: Defines the timezone the expressions are evaluated in, e.g.
+// "Europe/Berlin".
+// By default this parameter is set to "Local".
+//
+// - Invert: When set to true, messages are filtered if at least one
+// expression matches.
+// By default this parameter is set to false.
+//
+// - UseMessageTime: When set to true, the creation time of the message is
+// checked instead of the current time.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example passes debug messages only on weekdays from 9:00 to 17:59:
+//
+//  debugConsumer:
+//    Type: consumer.Console
+//    Streams: debug
+//    Modulators:
+//      - filter.Schedule:
+//        Timezone: Europe/Berlin
+//        Windows:
+//          - "* 9-17 * * mon-fri"
+//
+// This example filters all messages during a nightly maintenance window:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - filter.Schedule:
+//        Invert: true
+//        Timezone: UTC
+//        Windows:
+//          - "0-29 2 * * *"
+type Schedule struct {
+	core.SimpleFilter `gollumdoc:"embed_type"`
+	invert            bool `config:"Invert"`
+	useMessageTime    bool `config:"UseMessageTime"`
+	windows           []scheduleWindow
+	location          *time.Location
+	now               func() time.Time
+}
+
+// scheduleWindow holds one bitmask per cron field.
+type scheduleWindow struct {
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	anyDay     bool
+}
+
+type scheduleField struct {
+	min   int
+	max   int
+	names []string
+}
+
+var scheduleFields = []scheduleField{
+	{min: 0, max: 59},
+	{min: 0, max: 23},
+	{min: 1, max: 31},
+	{min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+func init() {
+	core.TypeRegistry.Register(Schedule{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Schedule) Configure(conf core.PluginConfigReader) {
+	filter.now = time.Now
+
+	timezone := conf.GetString("Timezone", "Local")
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		conf.Errors.Pushf("Unknown timezone '%s': %s", timezone, err)
+		location = time.Local
+	}
+	filter.location = location
+
+	for _, expression := range conf.GetStringArray("Windows", []string{}) {
+		window, err := parseScheduleWindow(expression)
+		if err != nil {
+			conf.Errors.Pushf("Invalid window '%s': %s", expression, err)
+			continue
+		}
+		filter.windows = append(filter.windows, window)
+	}
+
+	if len(filter.windows) == 0 {
+		filter.Logger.Warning("No Windows set, all messages are accepted")
+	}
+}
+
+// ApplyFilter check if all Filter wants to reject the message
+func (filter *Schedule) ApplyFilter(msg *core.Message) (core.FilterResult, error) {
+	if len(filter.windows) == 0 {
+		return core.FilterResultMessageAccept, nil
+	}
+
+	checkTime := filter.now()
+	if filter.useMessageTime {
+		checkTime = msg.GetCreationTime()
+	}
+	checkTime = checkTime.In(filter.location)
+
+	matched := false
+	for _, window := range filter.windows {
+		if window.matches(checkTime) {
+			matched = true
+			break
+		}
+	}
+
+	if matched != filter.invert {
+		return core.FilterResultMessageAccept, nil
+	}
+	return filter.GetFilterResultMessageReject(), nil
+}
+
+func (window scheduleWindow) matches(t time.Time) bool {
+	if window.minute&(1<<uint(t.Minute())) == 0 ||
+		window.hour&(1<<uint(t.Hour())) == 0 ||
+		window.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dayOfMonth := window.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := window.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if window.anyDay {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// parseScheduleWindow parses a cron expression with five fields.
+func parseScheduleWindow(expression string) (scheduleWindow, error) {
+	window := scheduleWindow{}
+	parts := strings.Fields(expression)
+	if len(parts) != len(scheduleFields) {
+		return window, fmt.Errorf("expected %d fields, got %d", len(scheduleFields), len(parts))
+	}
+
+	masks := make([]uint64, len(parts))
+	for i, part := range parts {
+		mask, err := scheduleFields[i].parse(part)
+		if err != nil {
+			return window, err
+		}
+		masks[i] = mask
+	}
+
+	// Sunday can be written as 0 or 7
+	if masks[4]&(1<<7) != 0 {
+		masks[4] |= 1
+	}
+
+	window.minute = masks[0]
+	window.hour = masks[1]
+	window.dayOfMonth = masks[2]
+	window.month = masks[3]
+	window.dayOfWeek = masks[4]
+	window.anyDay = parts[2] == "*" || parts[4] == "*"
+	return window, nil
+}
+
+// parse returns a bitmask of all values matched by the given field.
+func (field scheduleField) parse(text string) (uint64, error) {
+	mask := uint64(0)
+	for _, item := range strings.Split(text, ",") {
+		step := 1
+		if slashIdx := strings.Index(item, "/"); slashIdx >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[slashIdx+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in '%s'", item)
+			}
+			item = item[:slashIdx]
+		}
+
+		first, last := field.min, field.max
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if first, err = field.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if last, err = field.value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if last < first {
+				return 0, fmt.Errorf("invalid range '%s'", item)
+			}
+		default:
+			var err error
+			if first, err = field.value(item); err != nil {
+				return 0, err
+			}
+			if step == 1 {
+				last = first
+			}
+		}
+
+		for value := first; value <= last; value += step {
+			mask |= 1 << uint(value)
+		}
+	}
+	return mask, nil
+}
+
+// value parses a number or name within the bounds of the field.
+func (field scheduleField) value(text string) (int, error) {
+	for i, name := range field.names {
+		if strings.EqualFold(text, name) {
+			return i + field.min, nil
+		}
+	}
+
+	value, err := strconv.Atoi(text)
+	if err != nil || value < field.min || value > field.max {
+		return 0, fmt.Errorf("'%s' must be between %d and %d", text, field.min, field.max)
+	}
+	return value, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestFilterSchedule(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("", "filter.Schedule")
+	conf.Override("Windows", []string{"* 9-17 * * mon-fri"})
+	conf.Override("Timezone", "America/New_York")
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Schedule)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+
+	// Monday 2018-03-05 14:30 UTC is 9:30 in New York
+	filter.now = func() time.Time { return time.Date(2018, 3, 5, 14, 30, 0, 0, time.UTC) }
+	result, _ := filter.ApplyFilter(msg)
+	expect.Equal(core.FilterResultMessageAccept, result)
+
+	filter.now = func() time.Time { return time.Date(2018, 3, 5, 13, 59, 0, 0, time.UTC) }
+	result, _ = filter.ApplyFilter(msg)
+	expect.Neq(core.FilterResultMessageAccept, result)
+
+	// Saturday
+	filter.now = func() time.Time { return time.Date(2018, 3, 10, 15, 0, 0, 0, time.UTC) }
+	result, _ = filter.ApplyFilter(msg)
+	expect.Neq(core.FilterResultMessageAccept, result)
+
+	filter.invert = true
+	result, _ = filter.ApplyFilter(msg)
+	expect.Equal(core.FilterResultMessageAccept, result)
+}
+
+func TestFilterScheduleExpressions(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	window, err := parseScheduleWindow("*/15 0,12 1 jan-mar,dec 7")
+	expect.NoError(err)
+	expect.Equal(uint64(1|1<<15|1<<30|1<<45), window.minute)
+	expect.Equal(uint64(1|1<<12), window.hour)
+	expect.Equal(uint64(1<<1|1<<2|1<<3|1<<12), window.month)
+	expect.False(window.anyDay)
+
+	// Either the first of the month or a sunday
+	expect.True(window.matches(time.Date(2018, 1, 1, 12, 45, 0, 0, time.UTC)))
+	expect.True(window.matches(time.Date(2018, 1, 7, 0, 0, 0, 0, time.UTC)))
+	expect.False(window.matches(time.Date(2018, 1, 8, 0, 0, 0, 0, time.UTC)))
+	expect.False(window.matches(time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)))
+
+	window, err = parseScheduleWindow("5-20/5 * * * *")
+	expect.NoError(err)
+	expect.Equal(uint64(1<<5|1<<10|1<<15|1<<20), window.minute)
+
+	for _, expression := range []string{"* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		_, err := parseScheduleWindow(expression)
+		expect.NotNil(err)
+	}
+}
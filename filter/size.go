@@ -0,0 +1,114 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"github.com/trivago/gollum/core"
+)
+
+// Size filter plugin
+//
+// This plugin filters messages by the size of their content. Instead of
+// dropping them, messages above or below the given thresholds can be routed
+// to alternate streams, e.g. to divert oversized events to a different
+// producer.
+//
+// Parameters
+//
+// - MaxBytes: Defines the maximum size of a message in bytes. Larger messages
+// are filtered. Set to 0 to disable this limit.
+// By default this parameter is set to 0.
+//
+// - MinBytes: Defines the minimum size of a message in bytes. Smaller
+// messages are filtered.
+// By default this parameter is set to 0.
+//
+// - AboveStream: Defines the stream messages larger than MaxBytes are routed
+// to. If empty, FilteredStream is used.
+// By default this parameter is set to "".
+//
+// - BelowStream: Defines the stream messages smaller than MinBytes are routed
+// to. If empty, FilteredStream is used.
+// By default this parameter is set to "".
+//
+// - ApplyTo: Defines which part of the message the size is measured of.
+// When set to "", the message's payload is used. All other values denote a
+// metadata key.
+// By default this parameter is set to "".
+//
+// Examples
+//
+// This example sends events larger than 1 MB to an overflow stream written to
+// S3, all other events are passed on to Kafka:
+//
+//  eventConsumer:
+//    Type: consumer.Kafka
+//    Streams: events
+//    Modulators:
+//      - filter.Size:
+//        MaxBytes: 1048576
+//        AboveStream: overflow
+//
+//  overflowProducer:
+//    Type: producer.AwsS3
+//    Streams: overflow
+type Size struct {
+	core.SimpleFilter `gollumdoc:"embed_type"`
+	maxBytes          int                  `config:"MaxBytes" default:"0"`
+	minBytes          int                  `config:"MinBytes" default:"0"`
+	aboveStreamID     core.MessageStreamID `config:"AboveStream"`
+	belowStreamID     core.MessageStreamID `config:"BelowStream"`
+	getAppliedContent core.GetAppliedContent
+}
+
+func init() {
+	core.TypeRegistry.Register(Size{})
+}
+
+// Configure initializes this filter with values from a plugin config.
+func (filter *Size) Configure(conf core.PluginConfigReader) {
+	if filter.maxBytes < 0 || filter.minBytes < 0 {
+		conf.Errors.Pushf("MaxBytes and MinBytes must not be negative")
+	}
+	if filter.maxBytes > 0 && filter.minBytes > filter.maxBytes {
+		conf.Errors.Pushf("MinBytes must not be larger than MaxBytes")
+	}
+
+	applyTo := conf.GetString("ApplyTo", "")
+	filter.getAppliedContent = core.GetAppliedContentGetFunction(applyTo)
+}
+
+// ApplyFilter check if all Filter wants to reject the message
+func (filter *Size) ApplyFilter(msg *core.Message) (core.FilterResult, error) {
+	size := len(filter.getAppliedContent(msg))
+
+	switch {
+	case filter.maxBytes > 0 && size > filter.maxBytes:
+		return filter.reject(filter.aboveStreamID), nil
+
+	case size < filter.minBytes:
+		return filter.reject(filter.belowStreamID), nil
+
+	default:
+		return core.FilterResultMessageAccept, nil
+	}
+}
+
+func (filter *Size) reject(streamID core.MessageStreamID) core.FilterResult {
+	if streamID == core.InvalidStreamID {
+		return filter.GetFilterResultMessageReject()
+	}
+	return core.FilterResultMessageReject(streamID)
+}
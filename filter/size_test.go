@@ -0,0 +1,74 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestFilterSize(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("", "filter.Size")
+	conf.Override("MaxBytes", 8)
+	conf.Override("MinBytes", 2)
+	conf.Override("AboveStream", "overflow")
+	conf.Override("FilteredStream", "filtered")
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Size)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("12345678"), nil, core.InvalidStreamID)
+	result, err := filter.ApplyFilter(msg)
+	expect.NoError(err)
+	expect.Equal(core.FilterResultMessageAccept, result)
+
+	msg = core.NewMessage(nil, []byte("123456789"), nil, core.InvalidStreamID)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Equal(core.GetStreamID("overflow"), result.GetStreamID())
+
+	msg = core.NewMessage(nil, []byte("1"), nil, core.InvalidStreamID)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Equal(core.GetStreamID("filtered"), result.GetStreamID())
+}
+
+func TestFilterSizeMetadata(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("", "filter.Size")
+	conf.Override("MinBytes", 1)
+	conf.Override("BelowStream", "empty")
+	conf.Override("ApplyTo", "body")
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	filter, casted := plugin.(*Size)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("payload"), core.Metadata{"body": []byte("")}, core.InvalidStreamID)
+	result, _ := filter.ApplyFilter(msg)
+	expect.Equal(core.GetStreamID("empty"), result.GetStreamID())
+
+	msg = core.NewMessage(nil, []byte(""), core.Metadata{"body": []byte("x")}, core.InvalidStreamID)
+	result, _ = filter.ApplyFilter(msg)
+	expect.Equal(core.FilterResultMessageAccept, result)
+}
@@ -22,23 +22,34 @@ import (
 )
 
 var (
-	flagHelp           = tflag.Switch("h", "help", "Print this help message.")
-	flagVersion        = tflag.Switch("v", "version", "Print version information and quit.")
-	flagExtVersion     = tflag.Switch("r", "runtime", "Print runtime information and quit.")
-	flagModules        = tflag.Switch("l", "list", "Print plugin information and quit.")
-	flagConfigFile     = tflag.String("c", "config", "", "Use a given configuration file.")
-	flagTestConfigFile = tflag.String("tc", "testconfig", "", "Test the given configuration file and exit.")
-	flagLoglevel       = tflag.Int("ll", "loglevel", 2, "Set the loglevel [0-3] as in {0=Error, 1=+Warning, 2=+Info, 3=+Debug}.")
-	flagLogColors      = tflag.String("lc", "log-colors", "auto", "Use Logrus's \"colored\" log format. One of \"never\", \"auto\" (default), \"always\"")
-	flagNumCPU         = tflag.Int("n", "numcpu", 0, "Number of CPUs to use. Set 0 for all CPUs.")
-	flagPidFile        = tflag.String("p", "pidfile", "", "Write the process id into a given file.")
-	flagMetricsAddress = tflag.String("m", "metrics", "", "Address to use for metric queries. Disabled by default.")
-	flagHealthCheck    = tflag.String("hc", "healthcheck", "", "Listening address ([IP]:PORT) to use for healthcheck HTTP endpoint. Disabled by default.")
-	flagCPUProfile     = tflag.String("pc", "profilecpu", "", "Write CPU profiler results to a given file.")
-	flagMemProfile     = tflag.String("pm", "profilemem", "", "Write heap profile results to a given file.")
-	flagProfile        = tflag.Switch("ps", "profilespeed", "Write msg/sec measurements to log.")
-	flagProfileTrace   = tflag.String("pt", "profiletrace", "", "Write profile trace results to a given file.")
-	flagTrace          = tflag.Switch("t", "trace", "Write message trace results _TRACE_ stream.")
+	flagHelp                = tflag.Switch("h", "help", "Print this help message.")
+	flagVersion             = tflag.Switch("v", "version", "Print version information and quit.")
+	flagExtVersion          = tflag.Switch("r", "runtime", "Print runtime information and quit.")
+	flagModules             = tflag.Switch("l", "list", "Print plugin information and quit.")
+	flagConfigFile          = tflag.String("c", "config", "", "Use a given configuration file.")
+	flagTestConfigFile      = tflag.String("tc", "testconfig", "", "Test the given configuration file and exit.")
+	flagCheckConfigFile     = tflag.String("ck", "check", "", "Configure all plugins of the given configuration file without starting them, check the stream wiring, print the pipeline and exit.")
+	flagSimulate            = tflag.String("sim", "simulate", "", "Pass each line of the given file (- for stdin) through the pipeline of the config given by -c without sending it, print the way of each message and exit.")
+	flagLoglevel            = tflag.Int("ll", "loglevel", 2, "Set the loglevel [0-3] as in {0=Error, 1=+Warning, 2=+Info, 3=+Debug}.")
+	flagLogColors           = tflag.String("lc", "log-colors", "auto", "Use Logrus's \"colored\" log format. One of \"never\", \"auto\" (default), \"always\"")
+	flagNumCPU              = tflag.Int("n", "numcpu", 0, "Number of CPUs to use. Set 0 for all CPUs.")
+	flagPidFile             = tflag.String("p", "pidfile", "", "Write the process id into a given file.")
+	flagMetricsAddress      = tflag.String("m", "metrics", "", "Address to use for metric queries. Disabled by default.")
+	flagMetricsReport       = tflag.Int("mr", "metricsreport", 10, "Interval in seconds in which a metrics snapshot is sent to the _GOLLUM_METRICS_ stream if it is used.")
+	flagMetricsPush         = tflag.String("mp", "metricspush", "", "Push metrics to statsd://, dogstatsd:// or graphite:// [IP]:PORT. Disabled by default.")
+	flagMetricsPushPrefix   = tflag.String("mpp", "metricspushprefix", "gollum.", "Prefix of all pushed metric names.")
+	flagMetricsPushInterval = tflag.Int("mpi", "metricspushinterval", 10, "Interval in seconds in which metrics are pushed.")
+	flagMetricsPushTags     = tflag.String("mpt", "metricspushtags", "", "Comma separated list of label:tag pairs renaming labels of pushed metrics. Use label:- to drop a label.")
+	flagPrometheus          = tflag.String("pr", "prometheus", "", "Listening address ([IP]:PORT) to use for the prometheus metrics HTTP endpoint. Disabled by default.")
+	flagPrometheusPath      = tflag.String("prp", "prometheuspath", "/metrics", "Path of the prometheus metrics HTTP endpoint.")
+	flagHealthCheck         = tflag.String("hc", "healthcheck", "", "Listening address ([IP]:PORT) to use for healthcheck HTTP endpoint. Disabled by default.")
+	flagAdmin               = tflag.String("a", "admin", "", "Listening address ([IP]:PORT) to use for the admin HTTP endpoint. POST /reload reloads the config. Disabled by default.")
+	flagCPUProfile          = tflag.String("pc", "profilecpu", "", "Write CPU profiler results to a given file.")
+	flagMemProfile          = tflag.String("pm", "profilemem", "", "Write heap profile results to a given file.")
+	flagProfile             = tflag.Switch("ps", "profilespeed", "Write msg/sec measurements to log.")
+	flagProfileTrace        = tflag.String("pt", "profiletrace", "", "Write profile trace results to a given file.")
+	flagTrace               = tflag.Switch("t", "trace", "Write message trace results _TRACE_ stream.")
+	flagFilterAudit         = tflag.String("fa", "filteraudit", "", "Send a copy of every filtered message, annotated with the rejecting filter, to the given stream.")
 )
 
 func parseFlags() {
@@ -0,0 +1,358 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/trivago/gollum/core"
+)
+
+// accessLogFormats contains the named formats known by format.AccessLog.
+var accessLogFormats = map[string]string{
+	"common":       `%h %l %u %t "%r" %>s %b`,
+	"combined":     `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"`,
+	"vhost":        `%v:%p %h %l %u %t "%r" %>s %O "%{Referer}i" "%{User-Agent}i"`,
+	"vhost_common": `%v %h %l %u %t "%r" %>s %b`,
+}
+
+// accessLogDirectives maps apache log format directives to field names.
+var accessLogDirectives = map[byte]string{
+	'a': "remote_addr",
+	'A': "local_addr",
+	'b': "bytes",
+	'B': "bytes",
+	'D': "duration_us",
+	'h': "remote_host",
+	'H': "protocol",
+	'I': "bytes_received",
+	'l': "ident",
+	'm': "method",
+	'O': "bytes_sent",
+	'p': "port",
+	'P': "pid",
+	'q': "query",
+	'r': "request",
+	's': "status",
+	't': "time",
+	'T': "duration",
+	'u': "user",
+	'U': "path",
+	'v': "vhost",
+	'V': "server_name",
+}
+
+// accessLogHeaderPrefixes maps apache log format directives with a name
+// argument to the prefix of the field name.
+var accessLogHeaderPrefixes = map[byte]string{
+	'i': "",
+	'o': "response_",
+	'C': "cookie_",
+	'e': "env_",
+	'n': "note_",
+}
+
+// accessLogNumeric contains the fields written as numbers.
+var accessLogNumeric = map[string]bool{
+	"bytes":                  true,
+	"bytes_received":         true,
+	"bytes_sent":             true,
+	"body_bytes_sent":        true,
+	"duration":               true,
+	"duration_us":            true,
+	"pid":                    true,
+	"port":                   true,
+	"request_length":         true,
+	"request_time":           true,
+	"status":                 true,
+	"upstream_response_time": true,
+	"upstream_connect_time":  true,
+	"upstream_header_time":   true,
+	"upstream_status":        true,
+	"server_port":            true,
+	"remote_port":            true,
+}
+
+// AccessLog formatter
+//
+// This formatter parses lines written by the Apache or Nginx web servers and
+// replaces them by a JSON object. Lines that do not match the format are
+// discarded.
+//
+// Fields are named after the directive used in the format. Apache directives
+// are named as follows: %h remote_host, %a remote_addr, %A local_addr,
+// %l ident, %u user, %t time, %r request, %s status, %b and %B bytes,
+// %O bytes_sent, %I bytes_received, %D duration_us, %T duration, %v vhost,
+// %V server_name, %p port, %P pid, %m method, %U path, %q query,
+// %H protocol. Request headers given as %{Name}i are named after the header
+// in lower case with "-" replaced by "_", e.g. "user_agent". Response headers
+// (%{Name}o), cookies (%{Name}C), environment variables (%{Name}e) and notes
+// (%{Name}n) are prefixed by "response_", "cookie_", "env_" and "note_".
+// Nginx variables like $remote_addr keep their names.
+//
+// Values set to "-" are not written. Sizes, durations, ports and status codes
+// are written as numbers. Timestamps are kept as written and can be converted
+// by format.TimestampParse using the layout "clf".
+//
+// Parameters
+//
+// - Format: Defines the format of the lines. This may be one of the names
+// "common", "combined", "vhost" (i.e. vhost_combined) or "vhost_common" or a
+// custom Apache LogFormat or Nginx log_format string.
+// By default this parameter is set to "combined".
+//
+// - SplitRequest: When set to true, the request line is additionally split
+// into the fields "method", "path" and "protocol".
+// By default this parameter is set to true.
+//
+// Examples
+//
+// This example parses the default log format of Nginx and converts the
+// timestamp to RFC3339:
+//
+//  exampleConsumer:
+//    Type: consumer.File
+//    Streams: "*"
+//    File: /var/log/nginx/access.log
+//    Modulators:
+//      - format.AccessLog:
+//        Format: '$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"'
+//      - format.TimestampParse:
+//        Field: time_local
+//        Layouts: [clf]
+type AccessLog struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	expression           *regexp.Regexp
+	fields               []string
+	splitRequest         bool `config:"SplitRequest" default:"true"`
+}
+
+func init() {
+	core.TypeRegistry.Register(AccessLog{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *AccessLog) Configure(conf core.PluginConfigReader) {
+	logFormat := conf.GetString("Format", "combined")
+	if named, exists := accessLogFormats[strings.ToLower(logFormat)]; exists {
+		logFormat = named
+	}
+
+	pattern, fields, err := compileAccessLogFormat(logFormat)
+	if err != nil {
+		conf.Errors.Pushf("Invalid format '%s': %s", logFormat, err)
+		return
+	}
+
+	format.fields = fields
+	format.expression, err = regexp.Compile(pattern)
+	conf.Errors.Push(err)
+}
+
+// ApplyFormatter update message payload
+func (format *AccessLog) ApplyFormatter(msg *core.Message) error {
+	content := bytes.TrimRight(format.GetAppliedContent(msg), "\r\n")
+
+	matches := format.expression.FindSubmatch(content)
+	if matches == nil {
+		err := fmt.Errorf("line does not match the format")
+		format.Logger.Warning("AccessLog failed to parse a message: ", err)
+		return err
+	}
+
+	values := make(map[string]interface{}, len(format.fields))
+	for index, field := range format.fields {
+		value := accessLogUnescape(matches[index+1])
+		if value == "-" || value == "" {
+			continue
+		}
+		if accessLogNumeric[field] {
+			if _, err := strconv.ParseFloat(value, 64); err == nil {
+				values[field] = json.Number(value)
+				continue
+			}
+		}
+		values[field] = value
+	}
+
+	if request, exists := values["request"].(string); exists && format.splitRequest {
+		if parts := strings.Split(request, " "); len(parts) == 3 {
+			values["method"] = parts[0]
+			values["path"] = parts[1]
+			values["protocol"] = parts[2]
+		}
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	format.SetAppliedContent(msg, data)
+	return nil
+}
+
+// compileAccessLogFormat converts an Apache or Nginx log format into a
+// regular expression and returns the names of its groups.
+func compileAccessLogFormat(logFormat string) (string, []string, error) {
+	pattern := bytes.NewBufferString("^")
+	fields := []string{}
+
+	for pos := 0; pos < len(logFormat); {
+		char := logFormat[pos]
+		var previous byte
+		if pos > 0 {
+			previous = logFormat[pos-1]
+		}
+
+		switch {
+		case char == '%' && pos+1 < len(logFormat) && logFormat[pos+1] == '%':
+			pattern.WriteString("%")
+			pos += 2
+
+		case char == '%':
+			field, end, err := accessLogParseDirective(logFormat, pos)
+			if err != nil {
+				return "", nil, err
+			}
+			pos = end
+			fields = append(fields, field)
+			if field == "time" && previous != '[' {
+				pattern.WriteString(`\[([^\]]*)\]`)
+			} else {
+				pattern.WriteString(accessLogValuePattern(previous))
+			}
+
+		case char == '$' && pos+1 < len(logFormat) && accessLogIsNameChar(logFormat[pos+1]):
+			end := pos + 1
+			for end < len(logFormat) && accessLogIsNameChar(logFormat[end]) {
+				end++
+			}
+			fields = append(fields, logFormat[pos+1:end])
+			pattern.WriteString(accessLogValuePattern(previous))
+			pos = end
+
+		case char == ' ':
+			pattern.WriteString(" +")
+			pos++
+
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(char)))
+			pos++
+		}
+	}
+
+	pattern.WriteString(`\s*$`)
+	return pattern.String(), fields, nil
+}
+
+// accessLogParseDirective parses the Apache directive starting at pos and
+// returns the field name and the position after the directive.
+func accessLogParseDirective(logFormat string, pos int) (string, int, error) {
+	pos++
+	name := ""
+
+	// Skip modifiers like "<", ">" or "!200,304"
+	for pos < len(logFormat) && strings.IndexByte("<>!,0123456789", logFormat[pos]) >= 0 {
+		pos++
+	}
+
+	if pos < len(logFormat) && logFormat[pos] == '{' {
+		end := strings.IndexByte(logFormat[pos:], '}')
+		if end < 0 {
+			return "", 0, fmt.Errorf("missing '}'")
+		}
+		name = logFormat[pos+1 : pos+end]
+		pos += end + 1
+	}
+
+	if pos >= len(logFormat) {
+		return "", 0, fmt.Errorf("incomplete directive at the end")
+	}
+	directive := logFormat[pos]
+	pos++
+
+	if name != "" {
+		if prefix, exists := accessLogHeaderPrefixes[directive]; exists {
+			return prefix + strings.Replace(strings.ToLower(name), "-", "_", -1), pos, nil
+		}
+		if directive == 't' {
+			return "time", pos, nil
+		}
+	}
+
+	if field, exists := accessLogDirectives[directive]; exists {
+		return field, pos, nil
+	}
+	return "", 0, fmt.Errorf("unknown directive '%%%c'", directive)
+}
+
+// accessLogValuePattern returns the pattern of a value depending on the
+// character in front of it.
+func accessLogValuePattern(previous byte) string {
+	switch previous {
+	case '"':
+		return `((?:[^"\\]|\\.)*)`
+	case '[':
+		return `([^\]]*)`
+	default:
+		return `(\S*)`
+	}
+}
+
+func accessLogIsNameChar(char byte) bool {
+	return char == '_' || char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char >= '0' && char <= '9'
+}
+
+// accessLogUnescape resolves the escape sequences \", \\ and \xhh written by
+// Apache and Nginx.
+func accessLogUnescape(value []byte) string {
+	if bytes.IndexByte(value, '\\') < 0 {
+		return string(value)
+	}
+
+	result := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 >= len(value) {
+			result = append(result, value[i])
+			continue
+		}
+		switch value[i+1] {
+		case 'x':
+			if i+3 < len(value) {
+				if char, err := strconv.ParseUint(string(value[i+2:i+4]), 16, 8); err == nil {
+					result = append(result, byte(char))
+					i += 3
+					continue
+				}
+			}
+			result = append(result, value[i])
+		case 'n':
+			result = append(result, '\n')
+			i++
+		case 't':
+			result = append(result, '\t')
+			i++
+		default:
+			result = append(result, value[i+1])
+			i++
+		}
+	}
+	return string(result)
+}
@@ -0,0 +1,90 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestAccessLogCombined(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.AccessLog")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*AccessLog)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"quoted\""`+"\n"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"bytes":2326,"method":"GET","path":"/apache_pb.gif","protocol":"HTTP/1.0","referer":"http://www.example.com/start.html",`+
+		`"remote_host":"127.0.0.1","request":"GET /apache_pb.gif HTTP/1.0","status":200,"time":"10/Oct/2000:13:55:36 -0700",`+
+		`"user":"frank","user_agent":"Mozilla/4.08 \"quoted\""}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte("not an access log line"), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
+
+func TestAccessLogVhost(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.AccessLog")
+	config.Override("Format", "vhost")
+	config.Override("SplitRequest", false)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*AccessLog)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`example.com:443 10.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "POST /login HTTP/1.1" 302 512 "-" "curl/7.58"`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"bytes_sent":512,"port":443,"remote_host":"10.0.0.1","request":"POST /login HTTP/1.1","status":302,`+
+		`"time":"10/Oct/2000:13:55:36 -0700","user_agent":"curl/7.58","vhost":"example.com"}`, msg.String())
+}
+
+func TestAccessLogNginx(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.AccessLog")
+	config.Override("Format", `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent rt=$request_time "$http_x_forwarded_for"`)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*AccessLog)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`192.168.1.5 - - [17/May/2018:08:05:32 +0000] "GET /a?b=\x22c\x22 HTTP/2.0" 404 0 rt=0.012 "1.2.3.4, 5.6.7.8"`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"body_bytes_sent":0,"http_x_forwarded_for":"1.2.3.4, 5.6.7.8","method":"GET","path":"/a?b=\"c\"","protocol":"HTTP/2.0",`+
+		`"remote_addr":"192.168.1.5","request":"GET /a?b=\"c\" HTTP/2.0","request_time":0.012,"status":404,"time_local":"17/May/2018:08:05:32 +0000"}`, msg.String())
+}
+
+func TestAccessLogInvalidFormat(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	_, _, err := compileAccessLogFormat(`%h %Z`)
+	expect.NotNil(err)
+
+	_, _, err = compileAccessLogFormat(`%{Referer`)
+	expect.NotNil(err)
+}
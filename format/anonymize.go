@@ -0,0 +1,272 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/trivago/gollum/core"
+)
+
+// Anonymize formatter
+//
+// This formatter pseudonymizes fields of JSON payloads and metadata. Values
+// are replaced by hex encoded hashes, so equal values still result in equal
+// hashes and can be joined. IP addresses can be truncated to a network
+// prefix instead.
+//
+// Parameters
+//
+// - Fields: Defines the fields of a JSON payload to hash. Nested fields can
+// be addressed by using "/" as a separator, e.g. "user/email". Values that
+// are not strings are hashed using their JSON representation.
+// By default this parameter is set to an empty list.
+//
+// - Metadata: Defines the metadata fields to hash.
+// By default this parameter is set to an empty list.
+//
+// - IPFields: Defines the fields of a JSON payload holding IP addresses to
+// truncate. Values that are not valid IP addresses are left unchanged.
+// By default this parameter is set to an empty list.
+//
+// - IPMetadata: Defines the metadata fields holding IP addresses to truncate.
+// By default this parameter is set to an empty list.
+//
+// - Algorithm: Defines the hash function to use. "hmac-sha256" calculates a
+// keyed HMAC-SHA256 using Key. "murmur3" calculates a 32-bit murmur3 hash
+// using Seed, which is faster but can easily be reversed for guessable
+// values.
+// By default this parameter is set to "hmac-sha256".
+//
+// - Key: Defines the secret key used by "hmac-sha256".
+// By default this parameter is set to "".
+//
+// - Seed: Defines the seed used by "murmur3".
+// By default this parameter is set to 0.
+//
+// - Length: Defines the number of hex characters to keep from the hash. Set
+// to 0 to keep the full hash.
+// By default this parameter is set to 0.
+//
+// - IPv4Prefix: Defines the number of bits kept from IPv4 addresses.
+// By default this parameter is set to 24.
+//
+// - IPv6Prefix: Defines the number of bits kept from IPv6 addresses.
+// By default this parameter is set to 64.
+//
+// Examples
+//
+// This example hashes user IDs and truncates client IPs:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Anonymize:
+//        Key: "secret"
+//        Fields:
+//          - user/id
+//          - user/email
+//        IPFields:
+//          - client_ip
+type Anonymize struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	fields               [][]string
+	ipFields             [][]string
+	metadataKeys         []string `config:"Metadata"`
+	ipMetadataKeys       []string `config:"IPMetadata"`
+	key                  []byte   `config:"Key"`
+	seed                 uint32   `config:"Seed" default:"0"`
+	length               int      `config:"Length" default:"0"`
+	ipv4Mask             net.IPMask
+	ipv6Mask             net.IPMask
+	hash                 func([]byte) string
+}
+
+func init() {
+	core.TypeRegistry.Register(Anonymize{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Anonymize) Configure(conf core.PluginConfigReader) {
+	for _, field := range conf.GetStringArray("Fields", []string{}) {
+		format.fields = append(format.fields, strings.Split(field, "/"))
+	}
+	for _, field := range conf.GetStringArray("IPFields", []string{}) {
+		format.ipFields = append(format.ipFields, strings.Split(field, "/"))
+	}
+
+	switch algorithm := strings.ToLower(conf.GetString("Algorithm", "hmac-sha256")); algorithm {
+	case "hmac-sha256":
+		format.hash = format.hashHMAC
+		if len(format.key) == 0 && (len(format.fields) > 0 || len(format.metadataKeys) > 0) {
+			format.Logger.Warning("No Key set, hashes of guessable values can be reversed")
+		}
+	case "murmur3":
+		format.hash = format.hashMurmur3
+	default:
+		conf.Errors.Pushf("Unknown algorithm '%s'", algorithm)
+	}
+
+	ipv4Prefix := int(conf.GetInt("IPv4Prefix", 24))
+	ipv6Prefix := int(conf.GetInt("IPv6Prefix", 64))
+	if ipv4Prefix < 0 || ipv4Prefix > 32 {
+		conf.Errors.Pushf("IPv4Prefix must be between 0 and 32")
+	} else {
+		format.ipv4Mask = net.CIDRMask(ipv4Prefix, 32)
+	}
+	if ipv6Prefix < 0 || ipv6Prefix > 128 {
+		conf.Errors.Pushf("IPv6Prefix must be between 0 and 128")
+	} else {
+		format.ipv6Mask = net.CIDRMask(ipv6Prefix, 128)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Anonymize) ApplyFormatter(msg *core.Message) error {
+	if len(format.fields) > 0 || len(format.ipFields) > 0 {
+		values := make(map[string]interface{})
+		if err := json.Unmarshal(format.GetAppliedContent(msg), &values); err != nil {
+			format.Logger.Warning("Anonymize failed to unmarshal a message: ", err)
+			return err
+		}
+
+		for _, path := range format.fields {
+			if parent, key := jsonTransformParent(values, path); parent != nil {
+				if value, exists := parent[key]; exists && value != nil {
+					if text, isString := value.(string); isString {
+						parent[key] = format.hash([]byte(text))
+					} else {
+						data, _ := json.Marshal(value)
+						parent[key] = format.hash(data)
+					}
+				}
+			}
+		}
+
+		for _, path := range format.ipFields {
+			if parent, key := jsonTransformParent(values, path); parent != nil {
+				if text, isString := parent[key].(string); isString {
+					parent[key] = format.truncateIP(text)
+				}
+			}
+		}
+
+		data, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		format.SetAppliedContent(msg, data)
+	}
+
+	if len(format.metadataKeys) > 0 || len(format.ipMetadataKeys) > 0 {
+		if metadata := msg.TryGetMetadata(); metadata != nil {
+			for _, key := range format.metadataKeys {
+				if value, exists := metadata.TryGetValue(key); exists {
+					metadata.SetValue(key, []byte(format.hash(value)))
+				}
+			}
+			for _, key := range format.ipMetadataKeys {
+				if value, exists := metadata.TryGetValueString(key); exists {
+					metadata.SetValue(key, []byte(format.truncateIP(value)))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (format *Anonymize) truncate(hash string) string {
+	if format.length > 0 && format.length < len(hash) {
+		return hash[:format.length]
+	}
+	return hash
+}
+
+func (format *Anonymize) hashHMAC(data []byte) string {
+	hash := hmac.New(sha256.New, format.key)
+	hash.Write(data)
+	return format.truncate(hex.EncodeToString(hash.Sum(nil)))
+}
+
+func (format *Anonymize) hashMurmur3(data []byte) string {
+	hash := make([]byte, 4)
+	binary.BigEndian.PutUint32(hash, murmur3Sum32(data, format.seed))
+	return format.truncate(hex.EncodeToString(hash))
+}
+
+func (format *Anonymize) truncateIP(value string) string {
+	ip := net.ParseIP(value)
+	switch {
+	case ip == nil:
+		return value
+	case ip.To4() != nil:
+		return ip.To4().Mask(format.ipv4Mask).String()
+	default:
+		return ip.Mask(format.ipv6Mask).String()
+	}
+}
+
+// murmur3Sum32 calculates the 32-bit x86 variant of MurmurHash3.
+func murmur3Sum32(data []byte, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	hash := seed
+	numBlocks := len(data) / 4
+	for i := 0; i < numBlocks; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = (k << 15) | (k >> 17)
+		k *= c2
+
+		hash ^= k
+		hash = (hash << 13) | (hash >> 19)
+		hash = hash*5 + 0xe6546b64
+	}
+
+	tail := data[numBlocks*4:]
+	k := uint32(0)
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = (k << 15) | (k >> 17)
+		k *= c2
+		hash ^= k
+	}
+
+	hash ^= uint32(len(data))
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+	return hash
+}
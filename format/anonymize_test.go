@@ -0,0 +1,135 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestAnonymizeHMAC(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Anonymize")
+	config.Override("Key", "secret")
+	config.Override("Fields", []interface{}{"user/email", "user/id", "missing"})
+	config.Override("Metadata", []interface{}{"user"})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Anonymize)
+	expect.True(casted)
+
+	hash := func(value string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	msg := core.NewMessage(nil, []byte(`{"user":{"email":"jane@example.com","id":42},"action":"login"}`), nil, core.InvalidStreamID)
+	msg.GetMetadata().SetValue("user", []byte("jane@example.com"))
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"action":"login","user":{"email":"`+hash("jane@example.com")+`","id":"`+hash("42")+`"}}`, msg.String())
+	expect.Equal(hash("jane@example.com"), msg.GetMetadata().GetValueString("user"))
+}
+
+func TestAnonymizeMurmur3(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Anonymize")
+	config.Override("Algorithm", "murmur3")
+	config.Override("Metadata", []interface{}{"a", "b"})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Anonymize)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("payload"), nil, core.InvalidStreamID)
+	msg.GetMetadata().SetValue("a", []byte("hello"))
+	msg.GetMetadata().SetValue("b", []byte("The quick brown fox jumps over the lazy dog"))
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("payload", msg.String())
+	expect.Equal("248bfa47", msg.GetMetadata().GetValueString("a"))
+	expect.Equal("2e4ff723", msg.GetMetadata().GetValueString("b"))
+}
+
+func TestAnonymizeLength(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Anonymize")
+	config.Override("Fields", []interface{}{"id"})
+	config.Override("Length", 8)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Anonymize)
+	expect.True(casted)
+
+	mac := hmac.New(sha256.New, nil)
+	mac.Write([]byte("a"))
+	hash := hex.EncodeToString(mac.Sum(nil))[:8]
+
+	msg := core.NewMessage(nil, []byte(`{"id":"a","other":1}`), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"id":"`+hash+`","other":1}`, msg.String())
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Anonymize")
+	config.Override("IPFields", []interface{}{"v4", "v6", "invalid"})
+	config.Override("IPMetadata", []interface{}{"ip"})
+	config.Override("IPv4Prefix", 16)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Anonymize)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"v4":"192.168.12.34","v6":"2001:db8:85a3:1:2:8a2e:370:7334","invalid":"localhost"}`), nil, core.InvalidStreamID)
+	msg.GetMetadata().SetValue("ip", []byte("10.1.2.3"))
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"invalid":"localhost","v4":"192.168.0.0","v6":"2001:db8:85a3:1::"}`, msg.String())
+	expect.Equal("10.1.0.0", msg.GetMetadata().GetValueString("ip"))
+}
+
+func TestAnonymizeInvalidConfig(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Anonymize")
+	config.Override("Algorithm", "md5")
+	_, err := core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("", "format.Anonymize")
+	config.Override("IPv4Prefix", 33)
+	_, err = core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
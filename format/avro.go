@@ -0,0 +1,337 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"gopkg.in/linkedin/goavro.v2"
+)
+
+// avroMagicByte starts every message using the Confluent wire format.
+const avroMagicByte = 0
+
+// Avro formatter
+//
+// This formatter converts between Avro binary encoded data and JSON. The
+// schema can be given inline, read from a file or fetched from a Confluent
+// compatible Schema Registry. Messages may use the Confluent wire format,
+// which prefixes the Avro data with a zero byte and the 4 byte schema ID.
+//
+// Parameters
+//
+// - Mode: Defines the conversion direction. Set to "decode" to convert Avro
+// to JSON or to "encode" to convert JSON to Avro.
+// By default this parameter is set to "decode".
+//
+// - Schema: Defines the Avro schema as JSON string.
+// By default this parameter is set to "".
+//
+// - SchemaFile: Defines a file to read the Avro schema from. This parameter
+// is ignored if Schema is set.
+// By default this parameter is set to "".
+//
+// - SchemaRegistry/URL: Defines the address of a Schema Registry, e.g.
+// "http://localhost:8081". If Schema and SchemaFile are empty, the schema is
+// fetched from the given subject. When decoding messages using the Confluent
+// wire format, the schema is fetched by the ID stored in each message.
+// Schemas are cached after they have been fetched.
+// By default this parameter is set to "".
+//
+// - SchemaRegistry/Subject: Defines the subject to fetch the schema from, e.g.
+// "logs-value".
+// By default this parameter is set to "".
+//
+// - SchemaRegistry/Version: Defines the version of the subject to fetch.
+// By default this parameter is set to "latest".
+//
+// - SchemaRegistry/Username: Defines the username for basic authentication.
+// By default this parameter is set to "".
+//
+// - SchemaRegistry/Password: Defines the password for basic authentication.
+// By default this parameter is set to "".
+//
+// - SchemaRegistry/TimeoutSec: Defines the timeout for requests to the Schema
+// Registry.
+// By default this parameter is set to 10.
+//
+// - ConfluentWireFormat: When set to true, encoded messages are written and
+// expected in the Confluent wire format.
+// By default this parameter is set to false.
+//
+// - SchemaID: Defines the schema ID written when encoding messages in the
+// Confluent wire format with a schema given by Schema or SchemaFile. If the
+// schema is fetched from a subject, the ID returned by the Schema Registry is
+// used.
+// By default this parameter is set to 0.
+//
+// - StandardJSON: When set to true, union values are read and written as
+// plain JSON values. When set to false, the Avro JSON encoding is used, which
+// wraps union values into an object naming their type, e.g. {"string":"a"}.
+// By default this parameter is set to true.
+//
+// Examples
+//
+// This example encodes JSON messages for a kafka topic using the latest schema
+// registered for the topic:
+//
+//  exampleProducer:
+//    Type: producer.Kafka
+//    Streams: logs
+//    Topics:
+//      logs: logs
+//    Modulators:
+//      - format.Avro:
+//        Mode: encode
+//        ConfluentWireFormat: true
+//        SchemaRegistry:
+//          URL: http://schema-registry:8081
+//          Subject: logs-value
+type Avro struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	encode               bool
+	confluentFormat      bool   `config:"ConfluentWireFormat" default:"false"`
+	schemaID             uint32 `config:"SchemaID" default:"0"`
+	standardJSON         bool   `config:"StandardJSON" default:"true"`
+	registryURL          string `config:"SchemaRegistry/URL"`
+	subject              string `config:"SchemaRegistry/Subject"`
+	version              string `config:"SchemaRegistry/Version" default:"latest"`
+	username             string `config:"SchemaRegistry/Username"`
+	password             string `config:"SchemaRegistry/Password"`
+	client               *http.Client
+	codec                *goavro.Codec
+	codecsByID           map[uint32]*goavro.Codec
+	guard                *sync.Mutex
+}
+
+func init() {
+	core.TypeRegistry.Register(Avro{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Avro) Configure(conf core.PluginConfigReader) {
+	format.codecsByID = make(map[uint32]*goavro.Codec)
+	format.guard = new(sync.Mutex)
+	format.registryURL = strings.TrimRight(format.registryURL, "/")
+	format.client = &http.Client{
+		Timeout: time.Duration(conf.GetInt("SchemaRegistry/TimeoutSec", 10)) * time.Second,
+	}
+
+	switch mode := strings.ToLower(conf.GetString("Mode", "decode")); mode {
+	case "decode":
+	case "encode":
+		format.encode = true
+	default:
+		conf.Errors.Pushf("Unknown mode '%s'", mode)
+	}
+
+	schema := conf.GetString("Schema", "")
+	if schemaFile := conf.GetString("SchemaFile", ""); schema == "" && schemaFile != "" {
+		data, err := ioutil.ReadFile(schemaFile)
+		if conf.Errors.Push(err) {
+			return // ### return, cannot read schema ###
+		}
+		schema = string(data)
+	}
+
+	switch {
+	case schema != "":
+		var err error
+		format.codec, err = format.newCodec(schema)
+		conf.Errors.Push(err)
+
+	case format.registryURL != "" && format.subject != "":
+		// Fetched on first use
+
+	case format.registryURL != "" && format.confluentFormat && !format.encode:
+		// Fetched by ID from each message
+
+	default:
+		format.Logger.Warning("No schema configured, messages will not be converted")
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Avro) ApplyFormatter(msg *core.Message) error {
+	var (
+		content = format.GetAppliedContent(msg)
+		data    []byte
+		err     error
+	)
+
+	if format.encode {
+		data, err = format.encodeAvro(content)
+	} else {
+		data, err = format.decodeAvro(content)
+	}
+
+	if err != nil {
+		format.Logger.Warning("Avro failed to convert a message: ", err)
+		return err
+	}
+
+	format.SetAppliedContent(msg, data)
+	return nil
+}
+
+func (format *Avro) encodeAvro(content []byte) ([]byte, error) {
+	codec, schemaID, err := format.getCodec()
+	if err != nil {
+		return nil, err
+	}
+
+	native, _, err := codec.NativeFromTextual(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix []byte
+	if format.confluentFormat {
+		prefix = make([]byte, 5)
+		prefix[0] = avroMagicByte
+		binary.BigEndian.PutUint32(prefix[1:], schemaID)
+	}
+	return codec.BinaryFromNative(prefix, native)
+}
+
+func (format *Avro) decodeAvro(content []byte) ([]byte, error) {
+	var (
+		codec *goavro.Codec
+		err   error
+	)
+
+	if format.confluentFormat {
+		if len(content) < 5 || content[0] != avroMagicByte {
+			return nil, fmt.Errorf("message is not in Confluent wire format")
+		}
+		schemaID := binary.BigEndian.Uint32(content[1:5])
+		content = content[5:]
+
+		if format.registryURL != "" {
+			codec, err = format.getCodecByID(schemaID)
+		} else {
+			codec, _, err = format.getCodec()
+		}
+	} else {
+		codec, _, err = format.getCodec()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	native, _, err := codec.NativeFromBinary(content)
+	if err != nil {
+		return nil, err
+	}
+	return codec.TextualFromNative(nil, native)
+}
+
+func (format *Avro) newCodec(schema string) (*goavro.Codec, error) {
+	if format.standardJSON {
+		return goavro.NewCodecForStandardJSONFull(schema)
+	}
+	return goavro.NewCodec(schema)
+}
+
+// getCodec returns the codec of the configured schema along with its ID. If
+// required, the schema is fetched from the Schema Registry.
+func (format *Avro) getCodec() (*goavro.Codec, uint32, error) {
+	format.guard.Lock()
+	defer format.guard.Unlock()
+
+	if format.codec != nil {
+		return format.codec, format.schemaID, nil
+	}
+	if format.registryURL == "" || format.subject == "" {
+		return nil, 0, fmt.Errorf("no schema configured")
+	}
+
+	var response struct {
+		ID     uint32 `json:"id"`
+		Schema string `json:"schema"`
+	}
+	path := fmt.Sprintf("/subjects/%s/versions/%s", url.PathEscape(format.subject), url.PathEscape(format.version))
+	if err := format.querySchemaRegistry(path, &response); err != nil {
+		return nil, 0, err
+	}
+
+	codec, err := format.newCodec(response.Schema)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	format.codec, format.schemaID = codec, response.ID
+	format.codecsByID[response.ID] = codec
+	return codec, response.ID, nil
+}
+
+// getCodecByID returns the codec of a schema registered with the given ID.
+func (format *Avro) getCodecByID(schemaID uint32) (*goavro.Codec, error) {
+	format.guard.Lock()
+	defer format.guard.Unlock()
+
+	if codec, cached := format.codecsByID[schemaID]; cached {
+		return codec, nil
+	}
+
+	var response struct {
+		Schema string `json:"schema"`
+	}
+	if err := format.querySchemaRegistry(fmt.Sprintf("/schemas/ids/%d", schemaID), &response); err != nil {
+		return nil, err
+	}
+
+	codec, err := format.newCodec(response.Schema)
+	if err != nil {
+		return nil, err
+	}
+	format.codecsByID[schemaID] = codec
+	return codec, nil
+}
+
+func (format *Avro) querySchemaRegistry(path string, response interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, format.registryURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if format.username != "" {
+		req.SetBasicAuth(format.username, format.password)
+	}
+
+	resp, err := format.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("schema registry returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, response)
+}
@@ -0,0 +1,124 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+const testAvroSchema = `{"type":"record","name":"Entry","fields":[` +
+	`{"name":"message","type":"string"},{"name":"count","type":"long"},` +
+	`{"name":"host","type":["null","string"],"default":null}]}`
+
+// expectAvroJSON compares JSON objects independent of the order of fields.
+func expectAvroJSON(expect ttesting.Expect, expected string, data []byte) {
+	var expectedValues, values map[string]interface{}
+	expect.NoError(json.Unmarshal([]byte(expected), &expectedValues))
+	expect.NoError(json.Unmarshal(data, &values))
+	expect.Equal(expectedValues, values)
+}
+
+func TestAvroRoundtrip(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Avro")
+	config.Override("Mode", "encode")
+	config.Override("Schema", testAvroSchema)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	encoder, casted := plugin.(*Avro)
+	expect.True(casted)
+
+	config = core.NewPluginConfig("", "format.Avro")
+	config.Override("Schema", testAvroSchema)
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	decoder, casted := plugin.(*Avro)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"message":"hello","count":3,"host":"example"}`), nil, core.InvalidStreamID)
+
+	err = encoder.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("\x0ahello\x06\x02\x0eexample", msg.String())
+
+	err = decoder.ApplyFormatter(msg)
+	expect.NoError(err)
+	expectAvroJSON(expect, `{"message":"hello","count":3,"host":"example"}`, msg.GetPayload())
+
+	msg = core.NewMessage(nil, []byte(`{"message":"hello"}`), nil, core.InvalidStreamID)
+	expect.NotNil(encoder.ApplyFormatter(msg))
+}
+
+func TestAvroSchemaRegistry(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/subjects/logs-value/versions/latest":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"id": 7, "schema": testAvroSchema})
+		case "/schemas/ids/7":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"schema": testAvroSchema})
+		default:
+			http.NotFound(resp, req)
+		}
+	}))
+	defer server.Close()
+
+	config := core.NewPluginConfig("", "format.Avro")
+	config.Override("Mode", "encode")
+	config.Override("ConfluentWireFormat", true)
+	config.Override("SchemaRegistry/URL", server.URL)
+	config.Override("SchemaRegistry/Subject", "logs-value")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	encoder, casted := plugin.(*Avro)
+	expect.True(casted)
+
+	config = core.NewPluginConfig("", "format.Avro")
+	config.Override("ConfluentWireFormat", true)
+	config.Override("SchemaRegistry/URL", server.URL)
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	decoder, casted := plugin.(*Avro)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"message":"hello","count":3,"host":null}`), nil, core.InvalidStreamID)
+
+	err = encoder.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("\x00\x00\x00\x00\x07\x0ahello\x06\x00", msg.String())
+
+	err = decoder.ApplyFormatter(msg)
+	expect.NoError(err)
+	expectAvroJSON(expect, `{"message":"hello","count":3,"host":null}`, msg.GetPayload())
+
+	msg = core.NewMessage(nil, []byte("\x00\x00\x00\x00\x08\x0ahello\x06\x00"), nil, core.InvalidStreamID)
+	expect.NotNil(decoder.ApplyFormatter(msg))
+}
@@ -0,0 +1,382 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+// Cast formatter
+//
+// This formatter converts the values of JSON or metadata fields to a given
+// type. This is useful for sinks with a strict schema that reject numbers or
+// booleans written as strings.
+//
+// The following types are supported:
+//
+//  - string: Numbers and booleans are written as text, objects and arrays as
+//  JSON.
+//  - int: Integral numbers, strings holding an integral number and booleans
+//  (1 and 0) are converted. Numbers with a fraction fail.
+//  - float: Numbers, strings holding a number and booleans are converted.
+//  - bool: Booleans, numbers (0 is false) and the strings "true", "false",
+//  "1", "0", "yes", "no", "on", "off", "t", "f", "y" and "n" are converted.
+//  - timestamp: Strings and numbers are parsed with Layouts and written using
+//  OutputLayout.
+//
+// Parameters
+//
+// - Fields: Defines a map of fields and the type to convert them to. Nested
+// JSON fields can be addressed by using "/" as a separator. When Target is
+// set to "metadata", fields are metadata keys.
+// By default this parameter is set to an empty map.
+//
+// - Target: Defines where fields are read from. "json" converts fields of a
+// JSON object in the content. "metadata" converts metadata fields. As
+// metadata holds text, converted values are written as text, too.
+// By default this parameter is set to "json".
+//
+// - OnError: Defines what happens to fields that cannot be converted. "keep"
+// leaves the value unchanged, "remove" removes the field and "drop" discards
+// the message. Fields that do not exist are ignored.
+// By default this parameter is set to "keep".
+//
+// - Defaults: Defines a map of fields and the value used if a field cannot
+// be converted. The value is converted to the type of the field. OnError is
+// only applied to fields without default.
+// By default this parameter is set to an empty map.
+//
+// - ErrorField: Defines a metadata field the names of all fields that could
+// not be converted are written to, separated by ",". If empty, no field is
+// written.
+// By default this parameter is set to "".
+//
+// - Layouts: Defines the layouts used to parse timestamps. Accepts the same
+// values as format.TimestampParse.
+// By default this parameter is set to [rfc3339, clf, datetime, unix].
+//
+// - OutputLayout: Defines the layout timestamps are written in. Numeric
+// layouts like "unixms" are written as numbers.
+// By default this parameter is set to "rfc3339".
+//
+// - Timezone: Defines the timezone of timestamps that do not contain
+// timezone information and of written timestamps.
+// By default this parameter is set to "UTC".
+//
+// Examples
+//
+// This example converts fields of an access log to match a table schema:
+//
+//  exampleProducer:
+//    Type: producer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Cast:
+//        Fields:
+//          status: int
+//          bytes: int
+//          duration: float
+//          cached: bool
+//          time: timestamp
+//        OutputLayout: unixms
+//        Defaults:
+//          bytes: "0"
+//        OnError: remove
+//        ErrorField: cast_errors
+type Cast struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	fields               []castField
+	toMetadata           bool
+	onError              string
+	errorField           string `config:"ErrorField"`
+	layouts              []string
+	outputLayout         string
+	location             *time.Location
+}
+
+type castField struct {
+	name         string
+	path         []string
+	kind         string
+	defaultValue interface{}
+}
+
+func init() {
+	core.TypeRegistry.Register(Cast{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Cast) Configure(conf core.PluginConfigReader) {
+	for _, layout := range conf.GetStringArray("Layouts", []string{"rfc3339", "clf", "datetime", "unix"}) {
+		format.layouts = append(format.layouts, timestampParseResolveLayout(layout))
+	}
+	format.outputLayout = timestampParseResolveLayout(conf.GetString("OutputLayout", "rfc3339"))
+
+	var err error
+	format.location, err = time.LoadLocation(conf.GetString("Timezone", "UTC"))
+	conf.Errors.Push(err)
+
+	switch target := strings.ToLower(conf.GetString("Target", "json")); target {
+	case "json":
+	case "metadata":
+		format.toMetadata = true
+	default:
+		conf.Errors.Pushf("Unknown target '%s'", target)
+	}
+
+	format.onError = strings.ToLower(conf.GetString("OnError", "keep"))
+	switch format.onError {
+	case "keep", "remove", "drop":
+	default:
+		conf.Errors.Pushf("Unknown error policy '%s'", format.onError)
+	}
+
+	defaults := conf.GetStringMap("Defaults", map[string]string{})
+	for name, kind := range conf.GetStringMap("Fields", map[string]string{}) {
+		field := castField{
+			name: name,
+			path: strings.Split(name, "/"),
+			kind: strings.ToLower(kind),
+		}
+
+		switch field.kind {
+		case "string", "int", "float", "bool", "timestamp":
+		default:
+			conf.Errors.Pushf("Unknown type '%s' for field %s", kind, name)
+			continue
+		}
+
+		if defaultValue, exists := defaults[name]; exists {
+			if field.defaultValue, err = format.convert(defaultValue, field.kind); err != nil {
+				conf.Errors.Pushf("Invalid default for field %s: %s", name, err)
+			}
+		}
+		format.fields = append(format.fields, field)
+	}
+
+	if len(format.fields) == 0 {
+		format.Logger.Warning("No Fields set, messages are not changed")
+	}
+
+	// Process fields in a fixed order so ErrorField is stable
+	sort.Slice(format.fields, func(i, j int) bool {
+		return format.fields[i].name < format.fields[j].name
+	})
+}
+
+// ApplyFormatter update message payload
+func (format *Cast) ApplyFormatter(msg *core.Message) error {
+	if len(format.fields) == 0 {
+		return nil
+	}
+
+	var failed []string
+	if format.toMetadata {
+		failed = format.castMetadata(msg)
+	} else {
+		var err error
+		if failed, err = format.castJSON(msg); err != nil {
+			return err
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	if format.errorField != "" {
+		msg.GetMetadata().SetValue(format.errorField, []byte(strings.Join(failed, ",")))
+	}
+	if format.onError == "drop" {
+		return fmt.Errorf("fields %s could not be converted", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+func (format *Cast) castJSON(msg *core.Message) ([]string, error) {
+	values := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(format.GetAppliedContent(msg)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		format.Logger.Warning("Cast failed to unmarshal a message: ", err)
+		return nil, err
+	}
+
+	failed := []string{}
+	for _, field := range format.fields {
+		parent, key := jsonTransformParent(values, field.path)
+		if parent == nil {
+			continue
+		}
+		value, exists := parent[key]
+		if !exists {
+			continue
+		}
+
+		converted, err := format.convert(value, field.kind)
+		switch {
+		case err == nil:
+			parent[key] = converted
+		case field.defaultValue != nil:
+			parent[key] = field.defaultValue
+		default:
+			failed = append(failed, field.name)
+			if format.onError == "remove" {
+				delete(parent, key)
+			}
+		}
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	format.SetAppliedContent(msg, data)
+	return failed, nil
+}
+
+func (format *Cast) castMetadata(msg *core.Message) []string {
+	metadata := msg.TryGetMetadata()
+	if metadata == nil {
+		return nil
+	}
+
+	failed := []string{}
+	for _, field := range format.fields {
+		value, exists := metadata.TryGetValue(field.name)
+		if !exists {
+			continue
+		}
+
+		converted, err := format.convert(string(value), field.kind)
+		switch {
+		case err == nil:
+			metadata.SetValue(field.name, []byte(castToText(converted)))
+		case field.defaultValue != nil:
+			metadata.SetValue(field.name, []byte(castToText(field.defaultValue)))
+		default:
+			failed = append(failed, field.name)
+			if format.onError == "remove" {
+				metadata.Delete(field.name)
+			}
+		}
+	}
+	return failed
+}
+
+// convert converts a decoded JSON value to the given type.
+func (format *Cast) convert(value interface{}, kind string) (interface{}, error) {
+	switch kind {
+	case "string":
+		return castToText(value), nil
+
+	case "int":
+		switch typedValue := value.(type) {
+		case bool:
+			if typedValue {
+				return json.Number("1"), nil
+			}
+			return json.Number("0"), nil
+		case json.Number, string:
+			text := strings.TrimSpace(castToText(typedValue))
+			if number, err := strconv.ParseInt(text, 10, 64); err == nil {
+				return json.Number(strconv.FormatInt(number, 10)), nil
+			}
+			number, err := strconv.ParseFloat(text, 64)
+			if err != nil || number != math.Trunc(number) || math.Abs(number) > 1<<63 {
+				return nil, fmt.Errorf("'%s' is not an integer", text)
+			}
+			return json.Number(strconv.FormatInt(int64(number), 10)), nil
+		}
+
+	case "float":
+		switch typedValue := value.(type) {
+		case bool:
+			if typedValue {
+				return json.Number("1"), nil
+			}
+			return json.Number("0"), nil
+		case json.Number, string:
+			text := strings.TrimSpace(castToText(typedValue))
+			number, err := strconv.ParseFloat(text, 64)
+			if err != nil || math.IsInf(number, 0) || math.IsNaN(number) {
+				return nil, fmt.Errorf("'%s' is not a number", text)
+			}
+			return json.Number(strconv.FormatFloat(number, 'f', -1, 64)), nil
+		}
+
+	case "bool":
+		switch typedValue := value.(type) {
+		case bool:
+			return typedValue, nil
+		case json.Number:
+			number, err := typedValue.Float64()
+			if err != nil {
+				return nil, err
+			}
+			return number != 0, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(typedValue)) {
+			case "true", "1", "yes", "on", "t", "y":
+				return true, nil
+			case "false", "0", "no", "off", "f", "n":
+				return false, nil
+			}
+			return nil, fmt.Errorf("'%s' is not a boolean", typedValue)
+		}
+
+	case "timestamp":
+		switch typedValue := value.(type) {
+		case json.Number, string:
+			text := strings.TrimSpace(castToText(typedValue))
+			timestamp, err := timestampParseText(text, format.layouts, format.location)
+			if err != nil {
+				return nil, err
+			}
+			output := timestampParseWrite(timestamp, format.outputLayout, format.location)
+			if _, isNumeric := timestampParseUnits[format.outputLayout]; isNumeric {
+				return json.Number(output), nil
+			}
+			return output, nil
+		}
+	}
+
+	return nil, fmt.Errorf("cannot convert %T to %s", value, kind)
+}
+
+// castToText returns the text representation of a decoded JSON value.
+func castToText(value interface{}) string {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue
+	case json.Number:
+		return typedValue.String()
+	case bool:
+		return strconv.FormatBool(typedValue)
+	case nil:
+		return ""
+	default:
+		data, _ := json.Marshal(typedValue)
+		return string(data)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestCastJSON(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Cast")
+	config.Override("Fields", map[string]string{
+		"status":       "int",
+		"ratio":        "float",
+		"cached":       "bool",
+		"code":         "string",
+		"time":         "timestamp",
+		"request/size": "int",
+		"missing":      "int",
+	})
+	config.Override("OutputLayout", "unixms")
+	config.Override("ErrorField", "errors")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Cast)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"status":"200","ratio":"0.5","cached":"yes","code":404,`+
+		`"time":"10/Oct/2000:13:55:36 -0700","request":{"size":"1.0"}}`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"cached":true,"code":"404","ratio":0.5,"request":{"size":1},"status":200,"time":971211336000}`, msg.String())
+	_, exists := msg.GetMetadata().TryGetValue("errors")
+	expect.False(exists)
+
+	msg = core.NewMessage(nil, []byte(`{"status":"2xx","ratio":"n/a","cached":"maybe"}`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"cached":"maybe","ratio":"n/a","status":"2xx"}`, msg.String())
+	expect.Equal("cached,ratio,status", msg.GetMetadata().GetValueString("errors"))
+}
+
+func TestCastErrorPolicies(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Cast")
+	config.Override("Fields", map[string]string{"status": "int", "bytes": "int"})
+	config.Override("Defaults", map[string]string{"bytes": "0"})
+	config.Override("OnError", "remove")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Cast)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"status":"2xx","bytes":"-"}`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"bytes":0}`, msg.String())
+
+	config = core.NewPluginConfig("", "format.Cast")
+	config.Override("Fields", map[string]string{"status": "int"})
+	config.Override("OnError", "drop")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted = plugin.(*Cast)
+	expect.True(casted)
+
+	msg = core.NewMessage(nil, []byte(`{"status":1.5}`), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
+
+func TestCastMetadata(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Cast")
+	config.Override("Fields", map[string]string{"status": "int", "cached": "bool", "time": "timestamp"})
+	config.Override("Target", "metadata")
+	config.Override("OnError", "remove")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Cast)
+	expect.True(casted)
+
+	metadata := core.Metadata{
+		"status": []byte(" 200 "),
+		"cached": []byte("0"),
+		"time":   []byte("yesterday"),
+	}
+	msg := core.NewMessage(nil, []byte("test"), metadata, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal("200", metadata.GetValueString("status"))
+	expect.Equal("false", metadata.GetValueString("cached"))
+	_, exists := metadata.TryGetValue("time")
+	expect.False(exists)
+	expect.Equal("test", msg.String())
+}
@@ -0,0 +1,277 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/trivago/gollum/core"
+)
+
+// CEF formatter
+//
+// This formatter renders JSON objects as ArcSight Common Event Format (CEF)
+// or IBM QRadar Log Event Extended Format (LEEF 1.0) for SIEM systems. Header
+// fields and extension values are escaped as required by the format. Payloads
+// that are not JSON objects are written to the "msg" extension.
+//
+// Parameters
+//
+// - Format: Defines the output format. Can be "cef" or "leef".
+// By default this parameter is set to "cef".
+//
+// - Vendor: Defines the device vendor written to the header.
+// By default this parameter is set to "trivago".
+//
+// - Product: Defines the device product written to the header.
+// By default this parameter is set to "gollum".
+//
+// - ProductVersion: Defines the device version written to the header. If
+// empty, the gollum version is used.
+// By default this parameter is set to "".
+//
+// - SignatureIDFrom: Defines the field holding the signature ID (CEF) or
+// event ID (LEEF).
+// By default this parameter is set to "event_id".
+//
+// - SignatureID: Defines the signature ID used if SignatureIDFrom is not set.
+// By default this parameter is set to "0".
+//
+// - NameFrom: Defines the field holding the event name. Only used for CEF.
+// By default this parameter is set to "message".
+//
+// - Name: Defines the event name used if NameFrom is not set.
+// By default this parameter is set to "event".
+//
+// - SeverityFrom: Defines the field holding the severity. Numeric values are
+// used as-is, names are mapped using SeverityMap.
+// By default this parameter is set to "level".
+//
+// - SeverityMap: Defines additional mappings from severity names to the
+// numeric severity from 0 to 10. Names are case insensitive. By default
+// debug and trace map to 1, info to 3, notice to 4, warn and warning to 6,
+// error to 8 and critical, alert, emergency, fatal and panic to 10.
+// By default this parameter is set to an empty map.
+//
+// - Severity: Defines the severity used if SeverityFrom is not set or cannot
+// be mapped.
+// By default this parameter is set to 3.
+//
+// - Extensions: Defines a map of extension keys to the fields to read their
+// values from, e.g. "src: client_ip". If empty, all fields not used in the
+// header are written as extensions using their field name.
+// By default this parameter is set to an empty map.
+//
+// Examples
+//
+// This example sends security events to a SIEM via syslog:
+//
+//  exampleProducer:
+//    Type: producer.Socket
+//    Streams: security
+//    Address: "tcp://siem:514"
+//    Modulators:
+//      - format.CEF:
+//        Vendor: example
+//        Product: auth
+//        SignatureIDFrom: rule
+//        NameFrom: description
+//        Extensions:
+//          src: client_ip
+//          suser: user
+//          act: action
+type CEF struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	leef                 bool
+	vendor               string `config:"Vendor" default:"trivago"`
+	product              string `config:"Product" default:"gollum"`
+	productVersion       string `config:"ProductVersion"`
+	signatureIDFrom      string `config:"SignatureIDFrom" default:"event_id"`
+	signatureID          string `config:"SignatureID" default:"0"`
+	nameFrom             string `config:"NameFrom" default:"message"`
+	name                 string `config:"Name" default:"event"`
+	severityFrom         string `config:"SeverityFrom" default:"level"`
+	severity             int    `config:"Severity" default:"3"`
+	severityMap          map[string]int
+	extensions           map[string]string
+}
+
+func init() {
+	core.TypeRegistry.Register(CEF{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *CEF) Configure(conf core.PluginConfigReader) {
+	switch outputFormat := strings.ToLower(conf.GetString("Format", "cef")); outputFormat {
+	case "cef":
+	case "leef":
+		format.leef = true
+	default:
+		conf.Errors.Pushf("Unknown format '%s'", outputFormat)
+	}
+
+	if format.productVersion == "" {
+		format.productVersion = core.GetVersionString()
+	}
+	format.extensions = conf.GetStringMap("Extensions", map[string]string{})
+
+	format.severityMap = map[string]int{
+		"trace":     1,
+		"debug":     1,
+		"info":      3,
+		"notice":    4,
+		"warn":      6,
+		"warning":   6,
+		"error":     8,
+		"critical":  10,
+		"alert":     10,
+		"emergency": 10,
+		"fatal":     10,
+		"panic":     10,
+	}
+	for name, value := range conf.GetStringMap("SeverityMap", map[string]string{}) {
+		severity, err := strconv.Atoi(value)
+		if err != nil || severity < 0 || severity > 10 {
+			conf.Errors.Pushf("Severity of '%s' must be a number from 0 to 10", name)
+			continue
+		}
+		format.severityMap[strings.ToLower(name)] = severity
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *CEF) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(content, &values); err != nil {
+		values = map[string]interface{}{"msg": string(content)}
+	}
+
+	signatureID := format.takeString(values, format.signatureIDFrom, format.signatureID)
+	severity := format.getSeverity(values)
+
+	var header []string
+	if format.leef {
+		header = []string{"LEEF:1.0", format.vendor, format.product, format.productVersion, signatureID}
+	} else {
+		name := format.takeString(values, format.nameFrom, format.name)
+		header = []string{"CEF:0", format.vendor, format.product, format.productVersion, signatureID, name, strconv.Itoa(severity)}
+	}
+	for i := 1; i < len(header); i++ {
+		header[i] = cefEscapeHeader(header[i])
+	}
+
+	extensions := format.getExtensions(values)
+	if format.leef {
+		extensions = append(extensions, "sev="+strconv.Itoa(severity))
+		format.SetAppliedContent(msg, []byte(strings.Join(header, "|")+"|"+strings.Join(extensions, "\t")))
+	} else {
+		format.SetAppliedContent(msg, []byte(strings.Join(header, "|")+"|"+strings.Join(extensions, " ")))
+	}
+	return nil
+}
+
+// takeString removes a field from values and returns it as string. If the
+// field does not exist, defaultValue is returned.
+func (format *CEF) takeString(values map[string]interface{}, key, defaultValue string) string {
+	value, exists := values[key]
+	if !exists || value == nil {
+		return defaultValue
+	}
+	delete(values, key)
+	return cefToString(value)
+}
+
+func (format *CEF) getSeverity(values map[string]interface{}) int {
+	value := format.takeString(values, format.severityFrom, "")
+	if severity, err := strconv.Atoi(value); err == nil && severity >= 0 && severity <= 10 {
+		return severity
+	}
+	if severity, mapped := format.severityMap[strings.ToLower(value)]; mapped {
+		return severity
+	}
+	return format.severity
+}
+
+func (format *CEF) getExtensions(values map[string]interface{}) []string {
+	escape := cefEscapeExtension
+	if format.leef {
+		escape = leefEscapeAttribute
+	}
+
+	var pairs []string
+	if len(format.extensions) > 0 {
+		for key, field := range format.extensions {
+			if value, exists := values[field]; exists && value != nil {
+				pairs = append(pairs, cefKey(key)+"="+escape(cefToString(value)))
+			}
+		}
+	} else {
+		for key, value := range values {
+			if value != nil {
+				pairs = append(pairs, cefKey(key)+"="+escape(cefToString(value)))
+			}
+		}
+	}
+
+	sort.Strings(pairs)
+	return pairs
+}
+
+func cefToString(value interface{}) string {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(typedValue)
+	default:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+}
+
+// cefKey removes all characters not allowed in extension keys.
+func cefKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '.' {
+			return r
+		}
+		return -1
+	}, key)
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer("\\", "\\\\", "|", "\\|", "\r", " ", "\n", " ")
+	cefExtensionEscaper = strings.NewReplacer("\\", "\\\\", "=", "\\=", "\r", "\\r", "\n", "\\n")
+	leefAttributeEscape = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+)
+
+func cefEscapeHeader(value string) string {
+	return cefHeaderEscaper.Replace(value)
+}
+
+func cefEscapeExtension(value string) string {
+	return cefExtensionEscaper.Replace(value)
+}
+
+func leefEscapeAttribute(value string) string {
+	return leefAttributeEscape.Replace(value)
+}
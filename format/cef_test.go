@@ -0,0 +1,82 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestCEF(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.CEF")
+	config.Override("Vendor", "ex|ample")
+	config.Override("ProductVersion", "1.0")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*CEF)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"event_id":42,"message":"login failed","level":"Error","src":"10.0.0.1","note":"a=b\nc\\d","empty":null}`),
+		nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`CEF:0|ex\|ample|gollum|1.0|42|login failed|8|note=a\=b\nc\\d src=10.0.0.1`, msg.String())
+}
+
+func TestCEFExtensions(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.CEF")
+	config.Override("ProductVersion", "1.0")
+	config.Override("SeverityMap", map[string]string{"suspicious": "7"})
+	config.Override("Extensions", map[string]string{"src": "client_ip", "suser": "user"})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*CEF)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"level":"suspicious","client_ip":"10.0.0.1","user":"bob","other":1}`),
+		nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`CEF:0|trivago|gollum|1.0|0|event|7|src=10.0.0.1 suser=bob`, msg.String())
+}
+
+func TestCEFLEEF(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.CEF")
+	config.Override("Format", "leef")
+	config.Override("ProductVersion", "1.0")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*CEF)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("plain\ttext"), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("LEEF:1.0|trivago|gollum|1.0|0|msg=plain text\tsev=3", msg.String())
+}
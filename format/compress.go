@@ -0,0 +1,152 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4"
+	"github.com/trivago/gollum/core"
+)
+
+// Compress formatter
+//
+// This formatter compresses the content of a message. Compressed messages
+// can be restored by format.Decompress.
+//
+// Parameters
+//
+// - Algorithm: Defines the compression algorithm to use. Valid values are
+// "gzip", "zstd", "snappy" and "lz4". Snappy uses the block format, lz4 uses
+// the frame format.
+// By default this parameter is set to "gzip".
+//
+// - Level: Defines the compression level. Only used by gzip (1-9) and zstd
+// (1-22). Set to 0 to use the default level of the algorithm.
+// By default this parameter is set to 0.
+//
+// Examples
+//
+// This example compresses messages before sending them to another gollum
+// instance:
+//
+//  exampleProducer:
+//    Type: producer.Socket
+//    Streams: "*"
+//    Address: "gollum02:5880"
+//    Modulators:
+//      - format.Compress:
+//        Algorithm: zstd
+//      - format.Runlength
+type Compress struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	level                int `config:"Level" default:"0"`
+	compress             func([]byte) ([]byte, error)
+}
+
+func init() {
+	core.TypeRegistry.Register(Compress{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Compress) Configure(conf core.PluginConfigReader) {
+	switch algorithm := strings.ToLower(conf.GetString("Algorithm", "gzip")); algorithm {
+	case "gzip":
+		if format.level == 0 {
+			format.level = gzip.DefaultCompression
+		}
+		if format.level < gzip.HuffmanOnly || format.level > gzip.BestCompression {
+			conf.Errors.Pushf("Invalid gzip level %d", format.level)
+		}
+		format.compress = format.compressGzip
+	case "zstd":
+		if format.level == 0 {
+			format.level = zstd.DefaultCompression
+		}
+		format.compress = format.compressZstd
+	case "snappy":
+		format.compress = compressSnappy
+	case "lz4":
+		format.compress = compressLZ4
+	default:
+		conf.Errors.Pushf("Unknown algorithm '%s'", algorithm)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Compress) ApplyFormatter(msg *core.Message) error {
+	compressed, err := format.compress(format.GetAppliedContent(msg))
+	if err != nil {
+		format.Logger.Warning("Compress failed to compress a message: ", err)
+		return err
+	}
+	format.SetAppliedContent(msg, compressed)
+	return nil
+}
+
+func (format *Compress) compressGzip(data []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+	writer, err := gzip.NewWriterLevel(buffer, format.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (format *Compress) compressZstd(data []byte) ([]byte, error) {
+	return zstd.CompressLevel(nil, data, format.level)
+}
+
+func compressSnappy(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func compressLZ4(data []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+	writer := lz4.NewWriter(buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// compressDetectAlgorithm returns the algorithm used to compress data based
+// on the magic bytes of the format. Snappy blocks cannot be detected.
+func compressDetectAlgorithm(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return "gzip", nil
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd", nil
+	case bytes.HasPrefix(data, []byte{0x04, 0x22, 0x4d, 0x18}):
+		return "lz4", nil
+	default:
+		return "", fmt.Errorf("unknown compression format")
+	}
+}
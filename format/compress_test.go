@@ -0,0 +1,127 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestCompressRoundtrip(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	payload := strings.Repeat("gollum compresses messages ", 100)
+
+	for _, algorithm := range []string{"gzip", "zstd", "snappy", "lz4"} {
+		config := core.NewPluginConfig("", "format.Compress")
+		config.Override("Algorithm", algorithm)
+
+		plugin, err := core.NewPluginWithConfig(config)
+		expect.NoError(err)
+
+		compress, casted := plugin.(core.Formatter)
+		expect.True(casted)
+
+		config = core.NewPluginConfig("", "format.Decompress")
+		config.Override("Algorithm", algorithm)
+
+		plugin, err = core.NewPluginWithConfig(config)
+		expect.NoError(err)
+
+		decompress, casted := plugin.(core.Formatter)
+		expect.True(casted)
+
+		msg := core.NewMessage(nil, []byte(payload), nil, core.InvalidStreamID)
+		err = compress.ApplyFormatter(msg)
+		expect.NoError(err)
+		expect.Less(len(msg.GetPayload()), len(payload))
+
+		err = decompress.ApplyFormatter(msg)
+		expect.NoError(err)
+		expect.Equal(payload, msg.String())
+	}
+}
+
+func TestDecompressAuto(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	payload := "detect me"
+
+	config := core.NewPluginConfig("", "format.Decompress")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	decompress, casted := plugin.(core.Formatter)
+	expect.True(casted)
+
+	for _, algorithm := range []string{"gzip", "zstd", "lz4"} {
+		config = core.NewPluginConfig("", "format.Compress")
+		config.Override("Algorithm", algorithm)
+		config.Override("Level", 1)
+
+		plugin, err = core.NewPluginWithConfig(config)
+		expect.NoError(err)
+
+		compress, casted := plugin.(core.Formatter)
+		expect.True(casted)
+
+		msg := core.NewMessage(nil, []byte(payload), nil, core.InvalidStreamID)
+		err := compress.ApplyFormatter(msg)
+		expect.NoError(err)
+
+		err = decompress.ApplyFormatter(msg)
+		expect.NoError(err)
+		expect.Equal(payload, msg.String())
+	}
+
+	msg := core.NewMessage(nil, []byte(payload), nil, core.InvalidStreamID)
+	err = decompress.ApplyFormatter(msg)
+	expect.NotNil(err)
+}
+
+func TestDecompressMaxBytes(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	payload := strings.Repeat("a", 1000)
+
+	for _, algorithm := range []string{"gzip", "zstd", "snappy", "lz4"} {
+		config := core.NewPluginConfig("", "format.Compress")
+		config.Override("Algorithm", algorithm)
+
+		plugin, err := core.NewPluginWithConfig(config)
+		expect.NoError(err)
+
+		compress, casted := plugin.(core.Formatter)
+		expect.True(casted)
+
+		config = core.NewPluginConfig("", "format.Decompress")
+		config.Override("Algorithm", algorithm)
+		config.Override("MaxBytes", 999)
+
+		plugin, err = core.NewPluginWithConfig(config)
+		expect.NoError(err)
+
+		decompress, casted := plugin.(core.Formatter)
+		expect.True(casted)
+
+		msg := core.NewMessage(nil, []byte(payload), nil, core.InvalidStreamID)
+		err = compress.ApplyFormatter(msg)
+		expect.NoError(err)
+
+		err = decompress.ApplyFormatter(msg)
+		expect.NotNil(err)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/trivago/gollum/core"
+)
+
+// CSV formatter
+//
+// This formatter converts between delimiter separated rows, e.g. CSV or TSV,
+// and JSON objects. Each message is expected to contain a single row.
+//
+// Parameters
+//
+// - Mode: Defines the conversion direction. Set to "parse" to convert a row
+// into a JSON object or to "serialize" to convert a JSON object into a row.
+// By default this parameter is set to "parse".
+//
+// - Columns: Defines the names of the columns in order of their appearance.
+// When parsing, columns without a name are ignored. When serializing, the
+// fields are written in the given order. Missing fields are written as
+// empty values, objects and arrays are written as JSON.
+// By default this parameter is set to an empty list.
+//
+// - HeaderRow: When set to true and Columns is empty, the first message
+// parsed is used as a header row defining the column names. The header row,
+// and all rows equal to it, are discarded.
+// By default this parameter is set to false.
+//
+// - Delimiter: Defines the string separating two values.
+// By default this parameter is set to ",".
+//
+// - Quote: Defines the character used to quote values containing the
+// delimiter, quotes or line breaks. Quotes inside quoted values are escaped by
+// doubling them. Set to "" to disable quoting.
+// By default this parameter is set to "\"".
+//
+// - QuoteAll: When set to true, all values are quoted when serializing.
+// By default this parameter is set to false.
+//
+// - TrimValues: When set to true, whitespace around unquoted values is
+// removed when parsing.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example parses CSV files using the first line as header:
+//
+//  exampleConsumer:
+//    Type: consumer.File
+//    Streams: "*"
+//    File: /var/log/export.csv
+//    Modulators:
+//      - format.CSV:
+//        HeaderRow: true
+//
+// This example writes JSON messages as semicolon separated rows:
+//
+//  exampleProducer:
+//    Type: producer.File
+//    Streams: "*"
+//    File: /tmp/export.csv
+//    Modulators:
+//      - format.CSV:
+//        Mode: serialize
+//        Delimiter: ";"
+//        Columns:
+//          - time
+//          - host
+//          - message
+type CSV struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	serialize            bool
+	columns              []string
+	header               []string
+	delimiter            string `config:"Delimiter" default:","`
+	quote                string `config:"Quote" default:"\""`
+	quoteAll             bool   `config:"QuoteAll" default:"false"`
+	trimValues           bool   `config:"TrimValues" default:"false"`
+	hasHeaderRow         bool   `config:"HeaderRow" default:"false"`
+	guard                *sync.RWMutex
+}
+
+func init() {
+	core.TypeRegistry.Register(CSV{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *CSV) Configure(conf core.PluginConfigReader) {
+	format.guard = new(sync.RWMutex)
+	format.columns = conf.GetStringArray("Columns", []string{})
+
+	switch mode := strings.ToLower(conf.GetString("Mode", "parse")); mode {
+	case "parse":
+	case "serialize":
+		format.serialize = true
+	default:
+		conf.Errors.Pushf("Unknown mode '%s'", mode)
+	}
+
+	if format.delimiter == "" {
+		conf.Errors.Pushf("Delimiter must not be empty")
+	}
+	if len(format.quote) > 1 {
+		conf.Errors.Pushf("Quote must be a single character")
+	}
+	if format.serialize && len(format.columns) == 0 {
+		format.Logger.Warning("No columns set, rows will be empty")
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *CSV) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+
+	if format.serialize {
+		values := make(map[string]interface{})
+		if err := json.Unmarshal(content, &values); err != nil {
+			format.Logger.Warning("CSV failed to unmarshal a message: ", err)
+			return err
+		}
+		format.SetAppliedContent(msg, []byte(format.formatRow(values)))
+		return nil
+	}
+
+	row, err := format.parseRow(strings.TrimRight(string(content), "\r\n"))
+	if err != nil {
+		format.Logger.Warning("CSV failed to parse a message: ", err)
+		return err
+	}
+
+	columns, err := format.getColumns(row)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]string, len(row))
+	for i, value := range row {
+		if i < len(columns) && columns[i] != "" {
+			values[columns[i]] = value
+		}
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	format.SetAppliedContent(msg, data)
+	return nil
+}
+
+// getColumns returns the column names to use for the given row. If the row
+// is a header row, an error is returned.
+func (format *CSV) getColumns(row []string) ([]string, error) {
+	if len(format.columns) > 0 || !format.hasHeaderRow {
+		return format.columns, nil
+	}
+
+	format.guard.RLock()
+	header := format.header
+	format.guard.RUnlock()
+
+	if header == nil {
+		format.guard.Lock()
+		if format.header == nil {
+			format.header = row
+			format.guard.Unlock()
+			return nil, fmt.Errorf("discarded CSV header row")
+		}
+		header = format.header
+		format.guard.Unlock()
+	}
+
+	if len(header) == len(row) {
+		isHeader := true
+		for i := range row {
+			if row[i] != header[i] {
+				isHeader = false
+				break
+			}
+		}
+		if isHeader {
+			return nil, fmt.Errorf("discarded CSV header row")
+		}
+	}
+	return header, nil
+}
+
+// parseRow splits a row into its values.
+func (format *CSV) parseRow(line string) ([]string, error) {
+	var values []string
+	for {
+		if format.quote != "" && strings.HasPrefix(format.leftTrim(line), format.quote) {
+			line = format.leftTrim(line)[1:]
+			value := ""
+			for {
+				end := strings.Index(line, format.quote)
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated quoted value")
+				}
+				value += line[:end]
+				line = line[end+1:]
+				if !strings.HasPrefix(line, format.quote) {
+					break
+				}
+				value += format.quote // escaped quote
+				line = line[1:]
+			}
+			values = append(values, value)
+
+			if format.trimValues {
+				line = strings.TrimLeft(line, " \t")
+			}
+			if line == "" {
+				return values, nil
+			}
+			if !strings.HasPrefix(line, format.delimiter) {
+				return nil, fmt.Errorf("unexpected characters after quoted value")
+			}
+			line = line[len(format.delimiter):]
+			continue
+		}
+
+		end := strings.Index(line, format.delimiter)
+		if end < 0 {
+			return append(values, format.trim(line)), nil
+		}
+		values = append(values, format.trim(line[:end]))
+		line = line[end+len(format.delimiter):]
+	}
+}
+
+func (format *CSV) leftTrim(value string) string {
+	if format.trimValues {
+		return strings.TrimLeft(value, " \t")
+	}
+	return value
+}
+
+func (format *CSV) trim(value string) string {
+	if format.trimValues {
+		return strings.TrimSpace(value)
+	}
+	return value
+}
+
+// formatRow writes the configured columns of a JSON object as a row.
+func (format *CSV) formatRow(values map[string]interface{}) string {
+	fields := make([]string, len(format.columns))
+	for i, column := range format.columns {
+		fields[i] = format.quoteValue(csvToString(values[column]))
+	}
+	return strings.Join(fields, format.delimiter)
+}
+
+func (format *CSV) quoteValue(value string) string {
+	if format.quote == "" {
+		return value
+	}
+	if !format.quoteAll &&
+		!strings.Contains(value, format.delimiter) &&
+		!strings.Contains(value, format.quote) &&
+		!strings.ContainsAny(value, "\r\n") {
+		return value
+	}
+	return format.quote + strings.Replace(value, format.quote, format.quote+format.quote, -1) + format.quote
+}
+
+func csvToString(value interface{}) string {
+	switch typedValue := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typedValue
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(typedValue)
+	default:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestCSVParse(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.CSV")
+	config.Override("Columns", []interface{}{"host", "", "message", "code"})
+	config.Override("TrimValues", true)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*CSV)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("example, skipped , \"hello, \"\"world\"\"\" ,200,extra\n"), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"code":"200","host":"example","message":"hello, \"world\""}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte(`a,"b`), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
+
+func TestCSVHeaderRow(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.CSV")
+	config.Override("HeaderRow", true)
+	config.Override("Delimiter", "\t")
+	config.Override("Quote", "")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*CSV)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("a\tb"), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+
+	msg = core.NewMessage(nil, []byte("\"1\"\t2"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"a":"\"1\"","b":"2"}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte("a\tb"), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
+
+func TestCSVSerialize(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.CSV")
+	config.Override("Mode", "serialize")
+	config.Override("Columns", []interface{}{"host", "missing", "message", "code", "tags"})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*CSV)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"host":"example","message":"hello, \"world\"","code":200,"tags":["a"]}`),
+		nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`example,,"hello, ""world""",200,"[""a""]"`, msg.String())
+}
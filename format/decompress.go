@@ -0,0 +1,148 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/DataDog/zstd"
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4"
+	"github.com/trivago/gollum/core"
+)
+
+// Decompress formatter
+//
+// This formatter decompresses the content of a message compressed by
+// format.Compress or any other source using the same algorithm. Messages that
+// cannot be decompressed are discarded.
+//
+// Parameters
+//
+// - Algorithm: Defines the compression algorithm used. Valid values are
+// "auto", "gzip", "zstd", "snappy" and "lz4". When set to "auto", gzip, zstd
+// and lz4 are detected by the header of the content. Snappy blocks cannot be
+// detected.
+// By default this parameter is set to "auto".
+//
+// - MaxBytes: Defines the maximum size of decompressed content in bytes.
+// Messages exceeding this size are discarded. Set to 0 to disable this
+// limit.
+// By default this parameter is set to 67108864.
+//
+// Examples
+//
+// This example decompresses messages sent by another gollum instance:
+//
+//  exampleConsumer:
+//    Type: consumer.Socket
+//    Streams: "*"
+//    Address: ":5880"
+//    Modulators:
+//      - format.Decompress
+type Decompress struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	algorithm            string
+	maxBytes             int `config:"MaxBytes" default:"67108864"`
+}
+
+func init() {
+	core.TypeRegistry.Register(Decompress{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Decompress) Configure(conf core.PluginConfigReader) {
+	format.algorithm = strings.ToLower(conf.GetString("Algorithm", "auto"))
+	switch format.algorithm {
+	case "auto", "gzip", "zstd", "snappy", "lz4":
+	default:
+		conf.Errors.Pushf("Unknown algorithm '%s'", format.algorithm)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Decompress) ApplyFormatter(msg *core.Message) error {
+	data, err := format.decompress(format.GetAppliedContent(msg))
+	if err != nil {
+		format.Logger.Warning("Decompress failed to decompress a message: ", err)
+		return err
+	}
+	format.SetAppliedContent(msg, data)
+	return nil
+}
+
+func (format *Decompress) decompress(data []byte) ([]byte, error) {
+	algorithm := format.algorithm
+	if algorithm == "auto" {
+		var err error
+		if algorithm, err = compressDetectAlgorithm(data); err != nil {
+			return nil, err
+		}
+	}
+
+	switch algorithm {
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return format.readAll(reader)
+
+	case "lz4":
+		return format.readAll(lz4.NewReader(bytes.NewReader(data)))
+
+	case "snappy":
+		size, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := format.checkSize(size); err != nil {
+			return nil, err
+		}
+		return snappy.Decode(nil, data)
+
+	default:
+		decompressed, err := zstd.Decompress(nil, data)
+		if err != nil {
+			return nil, err
+		}
+		return decompressed, format.checkSize(len(decompressed))
+	}
+}
+
+// readAll reads a decompressing reader until MaxBytes is exceeded.
+func (format *Decompress) readAll(reader io.Reader) ([]byte, error) {
+	if format.maxBytes <= 0 {
+		return ioutil.ReadAll(reader)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(format.maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	return data, format.checkSize(len(data))
+}
+
+func (format *Decompress) checkSize(size int) error {
+	if format.maxBytes > 0 && size > format.maxBytes {
+		return fmt.Errorf("decompressed content exceeds %d bytes", format.maxBytes)
+	}
+	return nil
+}
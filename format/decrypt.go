@@ -0,0 +1,171 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// decryptMaxCachedDataKeys limits the number of data keys unwrapped by AWS
+// KMS that are kept in memory.
+const decryptMaxCachedDataKeys = 1024
+
+// Decrypt formatter
+//
+// This formatter decrypts envelopes written by format.Encrypt. Envelopes
+// holding a data key wrapped by AWS KMS are decrypted by unwrapping the data
+// key using AWS KMS. Unwrapped data keys are cached. The AWS connection is
+// configured by the parameters of components.AwsMultiClient. All other
+// envelopes are decrypted using the key configured for the key ID stored in
+// the envelope. Messages that cannot be decrypted are discarded.
+//
+// Parameters
+//
+// - Keys: Defines a map of key IDs to hex encoded AES keys.
+// By default this parameter is set to an empty map.
+//
+// - Base64: When set to true, envelopes are expected to be base64 encoded.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example decrypts messages that have been encrypted using one of two
+// keys:
+//
+//  exampleConsumer:
+//    Type: consumer.Kafka
+//    Streams: sensitive
+//    Modulators:
+//      - format.Decrypt:
+//        Keys:
+//          "2018-01": "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+//          "2018-02": "0f0e0d0c0b0a09080706050403020100000102030405060708090a0b0c0d0e0f"
+type Decrypt struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+
+	// AwsMultiClient is public to make AwsMultiClient.Configure() callable (bug in treflect package)
+	AwsMultiClient components.AwsMultiClient `gollumdoc:"embed_type"`
+
+	base64    bool `config:"Base64" default:"false"`
+	keys      map[string]cipher.AEAD
+	kmsClient kmsiface.KMSAPI
+	dataKeys  map[string]cipher.AEAD
+	guard     sync.Mutex
+}
+
+func init() {
+	core.TypeRegistry.Register(Decrypt{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Decrypt) Configure(conf core.PluginConfigReader) {
+	format.keys = make(map[string]cipher.AEAD)
+	format.dataKeys = make(map[string]cipher.AEAD)
+
+	for keyID, key := range conf.GetStringMap("Keys", map[string]string{}) {
+		aead, err := encryptNewAEAD(key)
+		if err != nil {
+			conf.Errors.Pushf("Invalid key '%s': %s", keyID, err)
+			continue
+		}
+		format.keys[keyID] = aead
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Decrypt) ApplyFormatter(msg *core.Message) error {
+	data := format.GetAppliedContent(msg)
+	if format.base64 {
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		size, err := base64.StdEncoding.Decode(decoded, data)
+		if err != nil {
+			format.Logger.Warning("Decrypt failed to decode a message: ", err)
+			return err
+		}
+		data = decoded[:size]
+	}
+
+	envelope, err := parseEncryptEnvelope(data)
+	if err != nil {
+		format.Logger.Warning("Decrypt failed to parse a message: ", err)
+		return err
+	}
+
+	aead, err := format.getCipher(envelope)
+	if err != nil {
+		format.Logger.Warning("Decrypt failed to get a key: ", err)
+		return err
+	}
+
+	plaintext, err := aead.Open(nil, envelope.nonce, envelope.ciphertext, envelope.header)
+	if err != nil {
+		format.Logger.Warning("Decrypt failed to decrypt a message: ", err)
+		return err
+	}
+	format.SetAppliedContent(msg, plaintext)
+	return nil
+}
+
+// getCipher returns the cipher to decrypt the given envelope with.
+func (format *Decrypt) getCipher(envelope encryptEnvelope) (cipher.AEAD, error) {
+	if len(envelope.wrapped) == 0 {
+		aead, exists := format.keys[envelope.keyID]
+		if !exists {
+			return nil, fmt.Errorf("unknown key ID '%s'", envelope.keyID)
+		}
+		return aead, nil
+	}
+
+	format.guard.Lock()
+	defer format.guard.Unlock()
+
+	if aead, cached := format.dataKeys[string(envelope.wrapped)]; cached {
+		return aead, nil
+	}
+
+	if format.kmsClient == nil {
+		client, err := encryptNewKMSClient(&format.AwsMultiClient)
+		if err != nil {
+			return nil, err
+		}
+		format.kmsClient = client
+	}
+
+	result, err := format.kmsClient.Decrypt(&kms.DecryptInput{
+		CiphertextBlob: envelope.wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := encryptNewAEADFromKey(result.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(format.dataKeys) >= decryptMaxCachedDataKeys {
+		format.dataKeys = make(map[string]cipher.AEAD)
+	}
+	format.dataKeys[string(envelope.wrapped)] = aead
+	return aead, nil
+}
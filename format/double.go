@@ -15,15 +15,27 @@
 package format
 
 import (
+	"fmt"
+	"regexp"
+	"strconv"
+
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tcontainer"
 )
 
+// doubleTemplateField matches the branch references of a join template.
+var doubleTemplateField = regexp.MustCompile(`\$\{(\d+)\}`)
+
 // Double formatter plugin
 //
 // Double is a formatter that appends a delimiter string and a second copy of
 // the message's contents to the message. Independent sets of formatters may
 // be applied to both duplicates.
 //
+// Instead of two copies, an arbitrary number of branches can be defined.
+// Each branch processes its own copy of the message and writes the result
+// either to a part of the content or to a metadata field.
+//
 // Parameters
 //
 // - Separator: This value sets the separator string placed between both parts.
@@ -37,10 +49,26 @@ import (
 // of the delimiter) is passed through these filters.
 // This parameter is set to an empty list by default.
 //
-// - Left: An optional list of formatters. The second copy of the mssage (right
+// - Right: An optional list of formatters. The second copy of the mssage (right
 // of the delimiter) is passed through these filters.
 // This parameter is set to an empty list by default.
 //
+// - Branches: An optional list of branches replacing Left and Right. Each
+// branch may define a list of "Modulators" and a "Target". If Target is set,
+// the result of the branch is written to this metadata field instead of the
+// content. If a modulator of a branch discards the message, the message is
+// discarded.
+// This parameter is set to an empty list by default.
+//
+// - Template: Defines how the results of all branches are joined. Results
+// are referenced by "${n}", with n being the index of the branch. If empty,
+// the results of all branches without Target are joined by Separator.
+// This parameter is set to "" by default.
+//
+// - StreamBranch: Defines the index of the branch the final stream id is
+// taken from. Set to -1 to use the last branch. Only used if Branches is set.
+// This parameter is set to -1 by default.
+//
 // Examples
 //
 // This example creates a message of the form "<orig>|<base64>", where <orig> is
@@ -54,15 +82,42 @@ import (
 //        Separator: "|"
 //        Right:
 //          - format.Base64Encode
+//
+// This example creates a message of the form "<orig> (<base64>)" and stores
+// a hash of the original content in the metadata field "checksum".
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Double:
+//        Template: "${0} (${1})"
+//        Branches:
+//          - Modulators: []
+//          - Modulators:
+//              - format.Base64Encode
+//          - Target: checksum
+//            Modulators:
+//              - format.Identifier:
+//                  Generator: hash
 type Double struct {
 	core.SimpleFormatter `gollumdoc:"embed_type"`
 	separator            []byte              `config:"Separator" default:":"`
 	leftStreamID         bool                `config:"UseLeftStreamID" default:"false"`
 	left                 core.FormatterArray `config:"Left"`
 	right                core.FormatterArray `config:"Right"`
+	template             []byte              `config:"Template"`
+	streamBranch         int                 `config:"StreamBranch" default:"-1"`
+	branches             []doubleBranch
 	applyTo              string
 }
 
+// doubleBranch is one copy of the message processed by format.Double.
+type doubleBranch struct {
+	modulators core.ModulatorArray
+	target     string
+}
+
 func init() {
 	core.TypeRegistry.Register(Double{})
 }
@@ -70,50 +125,130 @@ func init() {
 // Configure initializes this formatter with values from a plugin config.
 func (format *Double) Configure(conf core.PluginConfigReader) {
 	format.applyTo = conf.GetString("ApplyTo", "")
+
+	for index, branchConfig := range conf.GetArray("Branches", []interface{}{}) {
+		branch, err := format.newBranch(branchConfig)
+		if err != nil {
+			conf.Errors.Pushf("Branch %d: %s", index, err)
+			continue
+		}
+		format.branches = append(format.branches, branch)
+	}
+
+	if len(format.branches) == 0 {
+		format.branches = []doubleBranch{
+			{modulators: doubleFormatterModulators(format.left)},
+			{modulators: doubleFormatterModulators(format.right)},
+		}
+		format.streamBranch = 1
+		if format.leftStreamID {
+			format.streamBranch = 0
+		}
+	}
+
+	if format.streamBranch < 0 {
+		format.streamBranch = len(format.branches) - 1
+	}
+	if format.streamBranch >= len(format.branches) {
+		conf.Errors.Pushf("StreamBranch %d does not exist", format.streamBranch)
+	}
+
+	for _, match := range doubleTemplateField.FindAllSubmatch(format.template, -1) {
+		if index, _ := strconv.Atoi(string(match[1])); index >= len(format.branches) {
+			conf.Errors.Pushf("Template references unknown branch %d", index)
+		}
+	}
 }
 
-// ApplyFormatter update message payload
-func (format *Double) ApplyFormatter(msg *core.Message) error {
-	leftMsg := msg.Clone()
-	rightMsg := msg.Clone()
+func (format *Double) newBranch(config interface{}) (doubleBranch, error) {
+	values, err := tcontainer.ConvertToMarshalMap(config, nil)
+	if err != nil {
+		return doubleBranch{}, err
+	}
+
+	branchConfig := core.NewPluginConfig("", "format.Double.Branches")
+	for key, value := range values {
+		branchConfig.Override(key, value)
+	}
+	reader := core.NewPluginConfigReaderWithError(&branchConfig)
 
-	// pre-process
-	if format.applyTo != "" {
-		leftMsg.StorePayload(format.GetAppliedContent(msg))
-		rightMsg.StorePayload(format.GetAppliedContent(msg))
+	branch := doubleBranch{}
+	if branch.target, err = reader.GetString("Target", ""); err != nil {
+		return branch, err
 	}
+	branch.modulators, err = reader.GetModulatorArray("Modulators", format.Logger, core.ModulatorArray{})
+	return branch, err
+}
 
-	// apply sub-formatter
-	if err := format.left.ApplyFormatter(leftMsg); err != nil {
-		return err
+// doubleFormatterModulators wraps formatters so that they can be used as
+// branch modulators.
+func doubleFormatterModulators(formatters core.FormatterArray) core.ModulatorArray {
+	modulators := make(core.ModulatorArray, 0, len(formatters))
+	for _, formatter := range formatters {
+		modulators = append(modulators, core.NewFormatterModulator(formatter))
 	}
+	return modulators
+}
 
-	if err := format.right.ApplyFormatter(rightMsg); err != nil {
-		return err
+// ApplyFormatter update message payload
+func (format *Double) ApplyFormatter(msg *core.Message) error {
+	results := make([][]byte, len(format.branches))
+	var streamID core.MessageStreamID
+
+	for index, branch := range format.branches {
+		branchMsg := msg.Clone()
+		branchMsg.DetachAckCallback() // branches are merged, not delivered
+
+		// pre-process
+		if format.applyTo != "" {
+			branchMsg.StorePayload(format.GetAppliedContent(msg))
+		}
+
+		// apply sub-modulators
+		if result := branch.modulators.Modulate(branchMsg); result != core.ModulateResultContinue {
+			return fmt.Errorf("branch %d discarded the message", index)
+		}
+
+		results[index] = branchMsg.GetPayload()
+		if index == format.streamBranch {
+			streamID = branchMsg.GetStreamID()
+		}
 	}
 
-	// update content
-	format.SetAppliedContent(msg, format.getCombinedContent(leftMsg.GetPayload(), rightMsg.GetPayload()))
+	// update content and metadata
+	for index, branch := range format.branches {
+		if branch.target != "" {
+			msg.GetMetadata().SetValue(branch.target, results[index])
+		}
+	}
+	format.SetAppliedContent(msg, format.getCombinedContent(results))
 
 	// handle streamID
-	if format.leftStreamID {
-		msg.SetStreamID(leftMsg.GetStreamID())
-	} else {
-		msg.SetStreamID(rightMsg.GetStreamID())
-	}
+	msg.SetStreamID(streamID)
 
 	// fin
 	return nil
 }
 
-func (format *Double) getCombinedContent(leftContent []byte, rightContent []byte) []byte {
-	size := len(leftContent) + len(format.separator) + len(rightContent)
-	content := make([]byte, 0, size)
-
-	content = append(content, leftContent...)
-	content = append(content, format.separator...)
-	content = append(content, rightContent...)
+func (format *Double) getCombinedContent(results [][]byte) []byte {
+	if len(format.template) > 0 {
+		return doubleTemplateField.ReplaceAllFunc(format.template, func(field []byte) []byte {
+			index, _ := strconv.Atoi(string(field[2 : len(field)-1]))
+			return results[index]
+		})
+	}
 
+	content := []byte{}
+	joined := 0
+	for index, branch := range format.branches {
+		if branch.target != "" {
+			continue
+		}
+		if joined > 0 {
+			content = append(content, format.separator...)
+		}
+		content = append(content, results[index]...)
+		joined++
+	}
 	return content
-
 }
@@ -76,3 +76,67 @@ func TestDoubleFormatterApplyTo(t *testing.T) {
 	expect.Equal("TEST_VALUE:VEVTVF9WQUxVRQ==", msg.GetMetadata().GetValueString("foo"))
 	expect.Equal("SOME_PAYLOAD_DATA", msg.String())
 }
+
+func TestDoubleFormatterBranches(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Double")
+	config.Override("Template", "${0} (${1})")
+	config.Override("StreamBranch", 0)
+	config.Override("Branches", []interface{}{
+		map[interface{}]interface{}{
+			"Modulators": []interface{}{
+				map[interface{}]interface{}{
+					"format.StreamRoute": map[interface{}]interface{}{"Delimiter": ":"},
+				},
+			},
+		},
+		map[interface{}]interface{}{
+			"Modulators": []interface{}{"format.Base64Encode"},
+		},
+		map[interface{}]interface{}{
+			"Target":     "copy",
+			"Modulators": []interface{}{},
+		},
+	})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Double)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("target:TEST"), nil, core.GetStreamID("source"))
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	expect.Equal("TEST (dGFyZ2V0OlRFU1Q=)", msg.String())
+	expect.Equal("target:TEST", msg.GetMetadata().GetValueString("copy"))
+	expect.Equal(core.GetStreamID("target"), msg.GetStreamID())
+}
+
+func TestDoubleFormatterBranchesJoin(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Double")
+	config.Override("Separator", "|")
+	config.Override("Branches", []interface{}{
+		map[interface{}]interface{}{"Target": "first"},
+		map[interface{}]interface{}{},
+		map[interface{}]interface{}{"Modulators": []interface{}{"format.Base64Encode"}},
+		map[interface{}]interface{}{},
+	})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Double)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("TEST"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	expect.Equal("TEST|VEVTVA==|TEST", msg.String())
+	expect.Equal("TEST", msg.GetMetadata().GetValueString("first"))
+}
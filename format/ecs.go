@@ -0,0 +1,233 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+// ecsDefaultMappings maps commonly used field names to ECS fields. If more
+// than one field maps to the same ECS field, the first one found wins.
+var ecsDefaultMappings = [][2]string{
+	{"@timestamp", "@timestamp"},
+	{"timestamp", "@timestamp"},
+	{"time", "@timestamp"},
+	{"ts", "@timestamp"},
+	{"level", "log.level"},
+	{"severity", "log.level"},
+	{"loglevel", "log.level"},
+	{"logger", "log.logger"},
+	{"message", "message"},
+	{"msg", "message"},
+	{"host", "host.name"},
+	{"hostname", "host.name"},
+	{"service", "service.name"},
+	{"method", "http.request.method"},
+	{"status", "http.response.status_code"},
+	{"status_code", "http.response.status_code"},
+	{"bytes", "http.response.body.bytes"},
+	{"referer", "http.request.referrer"},
+	{"referrer", "http.request.referrer"},
+	{"url", "url.original"},
+	{"uri", "url.original"},
+	{"path", "url.path"},
+	{"user_agent", "user_agent.original"},
+	{"useragent", "user_agent.original"},
+	{"client_ip", "client.ip"},
+	{"remote_addr", "client.ip"},
+	{"duration_ms", "event.duration"},
+	{"error", "error.message"},
+	{"err", "error.message"},
+	{"error_type", "error.type"},
+	{"stack", "error.stack_trace"},
+	{"stacktrace", "error.stack_trace"},
+	{"trace_id", "trace.id"},
+	{"span_id", "span.id"},
+}
+
+// ECS formatter
+//
+// This formatter maps fields of JSON objects to the Elastic Common Schema
+// (ECS), e.g. "level" to "log.level" or "status" to
+// "http.response.status_code". ECS fields are written as nested objects.
+// Payloads that are not JSON objects are stored in the "message" field.
+// Numeric timestamps are treated as unix timestamps in seconds or, if larger
+// than 1e11, in milliseconds and converted to RFC3339. Values of
+// "event.duration" mapped from "duration_ms" are converted to nanoseconds.
+//
+// The following fields are mapped by default. If more than one field maps to
+// the same ECS field, the first field in this list wins.
+//
+//  - @timestamp, timestamp, time, ts: @timestamp
+//  - level, severity, loglevel: log.level
+//  - logger: log.logger
+//  - message, msg: message
+//  - host, hostname: host.name
+//  - service: service.name
+//  - method: http.request.method
+//  - status, status_code: http.response.status_code
+//  - bytes: http.response.body.bytes
+//  - referer, referrer: http.request.referrer
+//  - url, uri: url.original
+//  - path: url.path
+//  - user_agent, useragent: user_agent.original
+//  - client_ip, remote_addr: client.ip
+//  - duration_ms: event.duration
+//  - error, err: error.message
+//  - error_type: error.type
+//  - stack, stacktrace: error.stack_trace
+//  - trace_id: trace.id
+//  - span_id: span.id
+//
+// Parameters
+//
+// - Mappings: Defines additional mappings from a field to an ECS field. Nested
+// fields can be addressed by using "/" as a separator, e.g. "request/ip".
+// Mappings defined here take precedence over the default mappings. Mapping a
+// field to "" removes it.
+// By default this parameter is set to an empty map.
+//
+// - UseDefaultMappings: Set to false to only apply the mappings defined by
+// Mappings.
+// By default this parameter is set to true.
+//
+// - KeepUnmapped: Set to false to remove all fields that have not been mapped.
+// By default this parameter is set to true.
+//
+// - Version: Defines the value written to "ecs.version". Set to "" to not
+// write this field.
+// By default this parameter is set to "8.11.0".
+//
+// Examples
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.ECS:
+//        Mappings:
+//          request/ip: source.ip
+//          internal_id: ""
+type ECS struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	mappings             [][2]string
+	keepUnmapped         bool   `config:"KeepUnmapped" default:"true"`
+	version              string `config:"Version" default:"8.11.0"`
+}
+
+func init() {
+	core.TypeRegistry.Register(ECS{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *ECS) Configure(conf core.PluginConfigReader) {
+	custom := conf.GetStringMap("Mappings", map[string]string{})
+	sources := make([]string, 0, len(custom))
+	for source := range custom {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	format.mappings = make([][2]string, 0, len(custom)+len(ecsDefaultMappings))
+	for _, source := range sources {
+		format.mappings = append(format.mappings, [2]string{source, custom[source]})
+	}
+
+	if conf.GetBool("UseDefaultMappings", true) {
+		for _, mapping := range ecsDefaultMappings {
+			if _, overridden := custom[mapping[0]]; !overridden {
+				format.mappings = append(format.mappings, mapping)
+			}
+		}
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *ECS) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(content, &values); err != nil {
+		values = map[string]interface{}{"message": string(content)}
+	}
+
+	result := make(map[string]interface{})
+	mapped := make(map[string]bool)
+
+	for _, mapping := range format.mappings {
+		source, target := mapping[0], mapping[1]
+		parent, key := jsonTransformParent(values, strings.Split(source, "/"))
+		if parent == nil {
+			continue
+		}
+		value, exists := parent[key]
+		if !exists {
+			continue
+		}
+		delete(parent, key)
+
+		if target == "" || mapped[target] {
+			continue // removed or already mapped
+		}
+		mapped[target] = true
+		jsonTransformSet(result, strings.Split(target, "."), ecsConvert(source, target, value))
+	}
+
+	if format.keepUnmapped {
+		for key, value := range values {
+			if _, exists := result[key]; !exists {
+				result[key] = value
+			}
+		}
+	}
+	if format.version != "" {
+		jsonTransformSet(result, []string{"ecs", "version"}, format.version)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		format.Logger.Warning("ECS failed to marshal a message: ", err)
+		return err
+	}
+	format.SetAppliedContent(msg, data)
+	return nil
+}
+
+// ecsConvert converts values to the type expected by ECS.
+func ecsConvert(source, target string, value interface{}) interface{} {
+	number, isNumber := value.(float64)
+	if !isNumber {
+		return value
+	}
+
+	switch {
+	case target == "@timestamp":
+		if number > 1e11 {
+			return time.Unix(0, int64(number*float64(time.Millisecond))).UTC().Format(time.RFC3339Nano)
+		}
+		return time.Unix(0, int64(number*float64(time.Second))).UTC().Format(time.RFC3339Nano)
+
+	case target == "event.duration" && strings.HasSuffix(source, "_ms"):
+		return int64(number * float64(time.Millisecond))
+
+	default:
+		return value
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestECS(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.ECS")
+	config.Override("Mappings", map[string]string{
+		"request/ip":  "source.ip",
+		"internal_id": "",
+	})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*ECS)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"timestamp":1500000000,"ts":"ignored","level":"warn","msg":"hello",`+
+		`"status":404,"duration_ms":1.5,"internal_id":1,"request":{"ip":"10.0.0.1"},"custom":true}`),
+		nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"@timestamp":"2017-07-14T02:40:00Z","custom":true,"ecs":{"version":"8.11.0"},"event":{"duration":1500000},`+
+		`"http":{"response":{"status_code":404}},"log":{"level":"warn"},"message":"hello","request":{},"source":{"ip":"10.0.0.1"}}`,
+		msg.String())
+}
+
+func TestECSPlainText(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.ECS")
+	config.Override("Version", "")
+	config.Override("KeepUnmapped", false)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*ECS)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`plain text`), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"message":"plain text"}`, msg.String())
+}
@@ -0,0 +1,282 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// encryptEnvelopeVersion is the first byte of every envelope written by
+// format.Encrypt.
+const encryptEnvelopeVersion = 1
+
+// encryptNonceSize is the size of the AES-GCM nonce stored in an envelope.
+const encryptNonceSize = 12
+
+// Encrypt formatter
+//
+// This formatter encrypts messages using AES-GCM. The result is an envelope
+// that can be decrypted by format.Decrypt. Each envelope is built as follows:
+//
+//  - 1 byte version, currently 1
+//  - 1 byte key ID length, followed by the key ID
+//  - 2 bytes (big endian) wrapped data key length, followed by the wrapped
+//  data key. The length is 0 if a configured key is used.
+//  - 12 bytes nonce
+//  - the ciphertext including the 16 byte authentication tag
+//
+// All bytes before the nonce are authenticated as additional data.
+//
+// Messages are either encrypted using the configured Key or, if KmsKeyID is
+// set, using data keys generated by AWS KMS. In the latter case the data key
+// wrapped by KMS is stored in the envelope and a new data key is generated
+// after DataKeyTTLSec seconds. The AWS connection is configured by the
+// parameters of components.AwsMultiClient.
+//
+// Parameters
+//
+// - Key: Defines the hex encoded AES key to use. The key must be 16, 24 or
+// 32 bytes long, i.e. 32, 48 or 64 hex characters.
+// By default this parameter is set to "".
+//
+// - KeyID: Defines the key ID written to the envelope so that format.Decrypt
+// can choose the matching key. Must not be longer than 255 characters.
+// By default this parameter is set to "default".
+//
+// - KmsKeyID: Defines the ID, ARN or alias of the AWS KMS key used to
+// generate data keys. If set, Key and KeyID are ignored and KmsKeyID is
+// written to the envelope as key ID.
+// By default this parameter is set to "".
+//
+// - DataKeyTTLSec: Defines the number of seconds a data key generated by AWS
+// KMS is used before a new one is generated.
+// By default this parameter is set to 3600.
+//
+// - Base64: When set to true, the envelope is base64 encoded.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example encrypts messages using a data key that is rotated hourly:
+//
+//  exampleProducer:
+//    Type: producer.Kafka
+//    Streams: sensitive
+//    Modulators:
+//      - format.Encrypt:
+//        KmsKeyID: "alias/gollum"
+//        Region: eu-west-1
+//        Credential:
+//          Type: environment
+type Encrypt struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+
+	// AwsMultiClient is public to make AwsMultiClient.Configure() callable (bug in treflect package)
+	AwsMultiClient components.AwsMultiClient `gollumdoc:"embed_type"`
+
+	keyID      string        `config:"KeyID" default:"default"`
+	kmsKeyID   string        `config:"KmsKeyID"`
+	dataKeyTTL time.Duration `config:"DataKeyTTLSec" default:"3600" metric:"sec"`
+	base64     bool          `config:"Base64" default:"false"`
+	aead       cipher.AEAD
+	kmsClient  kmsiface.KMSAPI
+	dataKey    encryptDataKey
+	guard      sync.Mutex
+}
+
+// encryptDataKey is a data key generated by AWS KMS.
+type encryptDataKey struct {
+	aead    cipher.AEAD
+	wrapped []byte
+	created time.Time
+}
+
+func init() {
+	core.TypeRegistry.Register(Encrypt{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Encrypt) Configure(conf core.PluginConfigReader) {
+	if format.kmsKeyID != "" {
+		format.keyID = format.kmsKeyID
+	} else if key := conf.GetString("Key", ""); key != "" {
+		var err error
+		format.aead, err = encryptNewAEAD(key)
+		conf.Errors.Push(err)
+	} else {
+		format.Logger.Warning("Neither Key nor KmsKeyID set, messages cannot be encrypted")
+	}
+
+	if len(format.keyID) > 255 {
+		conf.Errors.Pushf("Key ID must not be longer than 255 characters")
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Encrypt) ApplyFormatter(msg *core.Message) error {
+	aead, wrapped, err := format.getCipher()
+	if err != nil {
+		format.Logger.Warning("Encrypt failed to get a key: ", err)
+		return err
+	}
+
+	header := make([]byte, 0, 4+len(format.keyID)+len(wrapped))
+	header = append(header, encryptEnvelopeVersion, byte(len(format.keyID)))
+	header = append(header, format.keyID...)
+	header = append(header, byte(len(wrapped)>>8), byte(len(wrapped)))
+	header = append(header, wrapped...)
+
+	nonce := make([]byte, encryptNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	envelope := append(header, nonce...)
+	envelope = aead.Seal(envelope, nonce, format.GetAppliedContent(msg), header)
+
+	if format.base64 {
+		encoded := make([]byte, base64.StdEncoding.EncodedLen(len(envelope)))
+		base64.StdEncoding.Encode(encoded, envelope)
+		envelope = encoded
+	}
+	format.SetAppliedContent(msg, envelope)
+	return nil
+}
+
+// getCipher returns the cipher to use and the wrapped data key to store in
+// the envelope.
+func (format *Encrypt) getCipher() (cipher.AEAD, []byte, error) {
+	if format.kmsKeyID == "" {
+		if format.aead == nil {
+			return nil, nil, fmt.Errorf("no key configured")
+		}
+		return format.aead, nil, nil
+	}
+
+	format.guard.Lock()
+	defer format.guard.Unlock()
+
+	if format.dataKey.aead != nil && time.Since(format.dataKey.created) < format.dataKeyTTL {
+		return format.dataKey.aead, format.dataKey.wrapped, nil
+	}
+
+	if format.kmsClient == nil {
+		client, err := encryptNewKMSClient(&format.AwsMultiClient)
+		if err != nil {
+			return nil, nil, err
+		}
+		format.kmsClient = client
+	}
+
+	result, err := format.kmsClient.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(format.kmsKeyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(result.CiphertextBlob) > 0xFFFF {
+		return nil, nil, fmt.Errorf("wrapped data key is too long")
+	}
+
+	aead, err := encryptNewAEADFromKey(result.Plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	format.dataKey = encryptDataKey{
+		aead:    aead,
+		wrapped: result.CiphertextBlob,
+		created: time.Now(),
+	}
+	return aead, result.CiphertextBlob, nil
+}
+
+// encryptNewAEAD creates an AES-GCM cipher from a hex encoded key.
+func encryptNewAEAD(hexKey string) (cipher.AEAD, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex encoded: %s", err)
+	}
+	return encryptNewAEADFromKey(key)
+}
+
+// encryptNewAEADFromKey creates an AES-GCM cipher from a raw key.
+func encryptNewAEADFromKey(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, encryptNonceSize)
+}
+
+// encryptNewKMSClient creates an AWS KMS client using the given settings.
+func encryptNewKMSClient(client *components.AwsMultiClient) (kmsiface.KMSAPI, error) {
+	sess, err := client.NewSessionWithOptions()
+	if err != nil {
+		return nil, err
+	}
+	return kms.New(sess, client.GetConfig()), nil
+}
+
+// encryptEnvelope is a parsed envelope written by format.Encrypt.
+type encryptEnvelope struct {
+	keyID      string
+	wrapped    []byte
+	header     []byte
+	nonce      []byte
+	ciphertext []byte
+}
+
+// parseEncryptEnvelope splits an envelope into its parts.
+func parseEncryptEnvelope(data []byte) (encryptEnvelope, error) {
+	envelope := encryptEnvelope{}
+	if len(data) < 2 {
+		return envelope, fmt.Errorf("envelope is too short")
+	}
+	if data[0] != encryptEnvelopeVersion {
+		return envelope, fmt.Errorf("unknown envelope version %d", data[0])
+	}
+
+	keyIDEnd := 2 + int(data[1])
+	if len(data) < keyIDEnd+2 {
+		return envelope, fmt.Errorf("envelope is too short")
+	}
+	envelope.keyID = string(data[2:keyIDEnd])
+
+	wrappedEnd := keyIDEnd + 2 + int(binary.BigEndian.Uint16(data[keyIDEnd:]))
+	if len(data) < wrappedEnd+encryptNonceSize {
+		return envelope, fmt.Errorf("envelope is too short")
+	}
+	envelope.wrapped = data[keyIDEnd+2 : wrappedEnd]
+	envelope.header = data[:wrappedEnd]
+	envelope.nonce = data[wrappedEnd : wrappedEnd+encryptNonceSize]
+	envelope.ciphertext = data[wrappedEnd+encryptNonceSize:]
+	return envelope, nil
+}
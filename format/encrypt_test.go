@@ -0,0 +1,225 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+const (
+	testEncryptKey1 = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+	testEncryptKey2 = "0f0e0d0c0b0a0908070605040302010f"
+)
+
+// testEncryptKMS wraps data keys by reversing them.
+type testEncryptKMS struct {
+	kmsiface.KMSAPI
+	generated int
+	decrypted int
+}
+
+func (client *testEncryptKMS) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	client.generated++
+	key := bytes.Repeat([]byte{byte(client.generated)}, 32)
+	key[0] = 0xFF
+	return &kms.GenerateDataKeyOutput{
+		KeyId:          input.KeyId,
+		Plaintext:      key,
+		CiphertextBlob: testEncryptReverse(key),
+	}, nil
+}
+
+func (client *testEncryptKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	client.decrypted++
+	if input.CiphertextBlob[len(input.CiphertextBlob)-1] != 0xFF {
+		return nil, fmt.Errorf("invalid ciphertext")
+	}
+	return &kms.DecryptOutput{Plaintext: testEncryptReverse(input.CiphertextBlob)}, nil
+}
+
+func testEncryptReverse(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+	return reversed
+}
+
+func TestEncryptKey(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Encrypt")
+	config.Override("Key", testEncryptKey2)
+	config.Override("KeyID", "k2")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	encrypt, casted := plugin.(*Encrypt)
+	expect.True(casted)
+
+	config = core.NewPluginConfig("", "format.Decrypt")
+	config.Override("Keys", map[string]string{"k1": testEncryptKey1, "k2": testEncryptKey2})
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	decrypt, casted := plugin.(*Decrypt)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("secret data"), nil, core.InvalidStreamID)
+	expect.NoError(encrypt.ApplyFormatter(msg))
+
+	envelope := msg.GetPayload()
+	expect.Equal(byte(encryptEnvelopeVersion), envelope[0])
+	expect.Equal("k2", string(envelope[2:4]))
+	expect.Equal([]byte{0, 0}, envelope[4:6])
+	expect.Equal(6+encryptNonceSize+len("secret data")+16, len(envelope))
+
+	expect.NoError(decrypt.ApplyFormatter(msg))
+	expect.Equal("secret data", msg.String())
+
+	// Nonces must differ between messages
+	msg1 := core.NewMessage(nil, []byte("data"), nil, core.InvalidStreamID)
+	msg2 := core.NewMessage(nil, []byte("data"), nil, core.InvalidStreamID)
+	expect.NoError(encrypt.ApplyFormatter(msg1))
+	expect.NoError(encrypt.ApplyFormatter(msg2))
+	expect.False(bytes.Equal(msg1.GetPayload(), msg2.GetPayload()))
+}
+
+func TestEncryptBase64(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Encrypt")
+	config.Override("Key", testEncryptKey1)
+	config.Override("Base64", true)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	encrypt, casted := plugin.(*Encrypt)
+	expect.True(casted)
+
+	config = core.NewPluginConfig("", "format.Decrypt")
+	config.Override("Keys", map[string]string{"default": testEncryptKey1})
+	config.Override("Base64", true)
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	decrypt, casted := plugin.(*Decrypt)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("secret data"), nil, core.InvalidStreamID)
+	expect.NoError(encrypt.ApplyFormatter(msg))
+	expect.True(bytes.HasPrefix(msg.GetPayload(), []byte("AQdkZWZhdWx0")))
+
+	expect.NoError(decrypt.ApplyFormatter(msg))
+	expect.Equal("secret data", msg.String())
+}
+
+func TestEncryptKMS(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Encrypt")
+	config.Override("KmsKeyID", "alias/test")
+	config.Override("DataKeyTTLSec", 3600)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	encrypt, casted := plugin.(*Encrypt)
+	expect.True(casted)
+
+	config = core.NewPluginConfig("", "format.Decrypt")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	decrypt, casted := plugin.(*Decrypt)
+	expect.True(casted)
+
+	client := &testEncryptKMS{}
+	encrypt.kmsClient = client
+	decrypt.kmsClient = client
+
+	for i := 0; i < 3; i++ {
+		msg := core.NewMessage(nil, []byte("secret data"), nil, core.InvalidStreamID)
+		expect.NoError(encrypt.ApplyFormatter(msg))
+
+		envelope, err := parseEncryptEnvelope(msg.GetPayload())
+		expect.NoError(err)
+		expect.Equal("alias/test", envelope.keyID)
+		expect.Equal(32, len(envelope.wrapped))
+
+		expect.NoError(decrypt.ApplyFormatter(msg))
+		expect.Equal("secret data", msg.String())
+	}
+
+	expect.Equal(1, client.generated)
+	expect.Equal(1, client.decrypted)
+}
+
+func TestDecryptErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Encrypt")
+	config.Override("Key", testEncryptKey1)
+	config.Override("KeyID", "k1")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	encrypt, casted := plugin.(*Encrypt)
+	expect.True(casted)
+
+	config = core.NewPluginConfig("", "format.Decrypt")
+	config.Override("Keys", map[string]string{"k2": testEncryptKey1})
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	decrypt, casted := plugin.(*Decrypt)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("secret data"), nil, core.InvalidStreamID)
+	expect.NoError(encrypt.ApplyFormatter(msg))
+	expect.NotNil(decrypt.ApplyFormatter(msg))
+
+	decrypt.keys["k1"] = decrypt.keys["k2"]
+	payload := msg.GetPayload()
+	payload[len(payload)-1] ^= 1
+	expect.NotNil(decrypt.ApplyFormatter(msg))
+
+	msg = core.NewMessage(nil, []byte("plain"), nil, core.InvalidStreamID)
+	expect.NotNil(decrypt.ApplyFormatter(msg))
+
+	config = core.NewPluginConfig("", "format.Encrypt")
+	config.Override("Key", "0011")
+	_, err = core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("", "format.Encrypt")
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	expect.NotNil(plugin.(*Encrypt).ApplyFormatter(msg))
+}
@@ -15,21 +15,58 @@
 package format
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/trivago/gollum/core"
 )
 
+const (
+	hostnameEC2Endpoint = "http://169.254.169.254"
+	hostnameGCEEndpoint = "http://metadata.google.internal"
+)
+
 // Hostname formatter
 //
 // This formatter prefixes the message or metadata with the hostname of
-// the machine gollum is running on.
+// the machine gollum is running on. Instead of the hostname the fully
+// qualified domain name, the primary IP address or the ID of the cloud
+// instance can be used.
 //
 // Parameters
 //
 // - Separator: Defines the separator string placed between hostname and data.
 // By default this parameter is set to ":".
 //
+// - Identity: Defines the value used as hostname. "hostname" uses the name
+// reported by the kernel. "fqdn" resolves the fully qualified domain name of
+// the host. "ip" uses the IP address of the interface used for outgoing
+// traffic. "ec2" and "gce" use the instance ID reported by the AWS EC2 or
+// Google Compute Engine metadata service.
+// By default this parameter is set to "hostname".
+//
+// - Target: Defines a metadata field the hostname is written to. If set, the
+// content is not changed and Separator is ignored.
+// By default this parameter is set to "".
+//
+// - RefreshSec: Defines the number of seconds the hostname is cached before
+// it is resolved again.
+// By default this parameter is set to 600.
+//
+// - MetadataEndpoint: Defines the URL of the cloud metadata service. If
+// empty, the default endpoint of the EC2 or GCE metadata service is used.
+// By default this parameter is set to "".
+//
+// - MetadataTimeoutMs: Defines the maximum time in milliseconds to wait for
+// the cloud metadata service.
+// By default this parameter is set to 1000.
+//
 // Examples
 //
 // This example inserts the hostname into an existing JSON payload.
@@ -46,9 +83,27 @@ import (
 //      - format.Envelope:
 //        Prefix: "{\"host\":"
 //        Postfix: "}"
+//
+// This example stores the EC2 instance ID in the metadata field "instance".
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Hostname:
+//        Identity: ec2
+//        Target: instance
 type Hostname struct {
 	core.SimpleFormatter `gollumdoc:"embed_type"`
-	separator            []byte `config:"Separator" default:":"`
+	separator            []byte        `config:"Separator" default:":"`
+	target               string        `config:"Target"`
+	refresh              time.Duration `config:"RefreshSec" default:"600" metric:"sec"`
+	endpoint             string        `config:"MetadataEndpoint"`
+	resolve              func() (string, error)
+	client               *http.Client
+	hostname             string
+	resolved             time.Time
+	guard                *sync.Mutex
 }
 
 func init() {
@@ -57,10 +112,40 @@ func init() {
 
 // Configure initializes this formatter with values from a plugin config.
 func (format *Hostname) Configure(conf core.PluginConfigReader) {
+	format.guard = new(sync.Mutex)
+	format.client = &http.Client{
+		Timeout: time.Duration(conf.GetInt("MetadataTimeoutMs", 1000)) * time.Millisecond,
+	}
+
+	switch identity := strings.ToLower(conf.GetString("Identity", "hostname")); identity {
+	case "hostname":
+		format.resolve = os.Hostname
+	case "fqdn":
+		format.resolve = hostnameFQDN
+	case "ip":
+		format.resolve = hostnameIP
+	case "ec2":
+		if format.endpoint == "" {
+			format.endpoint = hostnameEC2Endpoint
+		}
+		format.resolve = format.ec2InstanceID
+	case "gce":
+		if format.endpoint == "" {
+			format.endpoint = hostnameGCEEndpoint
+		}
+		format.resolve = format.gceInstanceID
+	default:
+		conf.Errors.Pushf("Unknown identity '%s'", identity)
+	}
 }
 
 // ApplyFormatter update message payload
 func (format *Hostname) ApplyFormatter(msg *core.Message) error {
+	if format.target != "" {
+		msg.GetMetadata().SetValue(format.target, []byte(format.getHostname()))
+		return nil
+	}
+
 	content := format.getFinalContent(format.GetAppliedContent(msg))
 	format.SetAppliedContent(msg, content)
 
@@ -68,11 +153,7 @@ func (format *Hostname) ApplyFormatter(msg *core.Message) error {
 }
 
 func (format *Hostname) getFinalContent(content []byte) []byte {
-	hostname, err := os.Hostname()
-	if err != nil {
-		format.Logger.Error(err)
-		hostname = "unknown host"
-	}
+	hostname := format.getHostname()
 
 	dataSize := len(hostname) + len(format.separator) + len(content)
 	payload := make([]byte, dataSize)
@@ -83,3 +164,120 @@ func (format *Hostname) getFinalContent(content []byte) []byte {
 
 	return payload
 }
+
+// getHostname returns the cached hostname and resolves it if the cache
+// expired. If resolving fails, the last known hostname is used.
+func (format *Hostname) getHostname() string {
+	format.guard.Lock()
+	defer format.guard.Unlock()
+
+	if format.hostname != "" && time.Since(format.resolved) < format.refresh {
+		return format.hostname
+	}
+
+	hostname, err := format.resolve()
+	switch {
+	case err == nil:
+		format.hostname = hostname
+	case format.hostname == "":
+		format.Logger.Error(err)
+		return "unknown host"
+	default:
+		format.Logger.Warning("Hostname failed to refresh: ", err)
+	}
+	format.resolved = time.Now()
+	return format.hostname
+}
+
+// ec2InstanceID requests the instance ID from the EC2 metadata service. A
+// session token is used if the service supports IMDSv2.
+func (format *Hostname) ec2InstanceID() (string, error) {
+	headers := map[string]string{}
+
+	req, err := http.NewRequest(http.MethodPut, format.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	if token, err := format.request(req); err == nil {
+		headers["X-aws-ec2-metadata-token"] = token
+	}
+
+	if req, err = http.NewRequest(http.MethodGet, format.endpoint+"/latest/meta-data/instance-id", nil); err != nil {
+		return "", err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return format.request(req)
+}
+
+// gceInstanceID requests the instance ID from the GCE metadata service.
+func (format *Hostname) gceInstanceID() (string, error) {
+	req, err := http.NewRequest(http.MethodGet, format.endpoint+"/computeMetadata/v1/instance/id", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return format.request(req)
+}
+
+func (format *Hostname) request(req *http.Request) (string, error) {
+	resp, err := format.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", req.URL, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// hostnameFQDN resolves the fully qualified domain name of this host by a
+// reverse lookup of its addresses.
+func hostnameFQDN() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	addresses, err := net.LookupHost(hostname)
+	if err != nil {
+		return "", err
+	}
+	for _, address := range addresses {
+		names, err := net.LookupAddr(address)
+		if err == nil && len(names) > 0 {
+			return strings.TrimSuffix(names[0], "."), nil
+		}
+	}
+	return hostname, nil
+}
+
+// hostnameIP returns the IP address of the interface used for outgoing
+// traffic. If there is no default route, the first non-loopback address is
+// used.
+func hostnameIP() (string, error) {
+	// Connecting a UDP socket does not send any packets
+	if conn, err := net.Dial("udp", "192.0.2.1:9"); err == nil {
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+	}
+
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, address := range addresses {
+		if ipNet, isIPNet := address.(*net.IPNet); isIPNet && !ipNet.IP.IsLoopback() {
+			return ipNet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no IP address found")
+}
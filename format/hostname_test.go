@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/tgo/ttesting"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 )
 
@@ -86,3 +89,89 @@ func TestFormatterHostnameApplyTo(t *testing.T) {
 	hostname, _ := os.Hostname()
 	expect.Equal(hostname, msg.GetMetadata().GetValueString("foo"))
 }
+
+func TestFormatterHostnameTarget(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Hostname")
+	config.Override("Identity", "ip")
+	config.Override("Target", "ip")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Hostname)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	expect.Equal("test", msg.String())
+	expect.NotNil(net.ParseIP(msg.GetMetadata().GetValueString("ip")))
+}
+
+func TestFormatterHostnameEC2(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		switch {
+		case req.Method == http.MethodPut && req.URL.Path == "/latest/api/token":
+			resp.Write([]byte("token"))
+		case req.URL.Path == "/latest/meta-data/instance-id" && req.Header.Get("X-aws-ec2-metadata-token") == "token":
+			resp.Write([]byte("i-0123456789abcdef0"))
+		default:
+			resp.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	config := core.NewPluginConfig("", "format.Hostname")
+	config.Override("Identity", "ec2")
+	config.Override("MetadataEndpoint", server.URL)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Hostname)
+	expect.True(casted)
+
+	for i := 0; i < 2; i++ {
+		msg := core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+		err = formatter.ApplyFormatter(msg)
+		expect.NoError(err)
+		expect.Equal("i-0123456789abcdef0:test", msg.String())
+	}
+	expect.Equal(2, requests)
+}
+
+func TestFormatterHostnameGCE(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/computeMetadata/v1/instance/id" || req.Header.Get("Metadata-Flavor") != "Google" {
+			resp.WriteHeader(http.StatusForbidden)
+			return
+		}
+		resp.Write([]byte("4567"))
+	}))
+	defer server.Close()
+
+	config := core.NewPluginConfig("", "format.Hostname")
+	config.Override("Identity", "gce")
+	config.Override("MetadataEndpoint", server.URL)
+	config.Override("Target", "instance")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Hostname)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("4567", msg.GetMetadata().GetValueString("instance"))
+}
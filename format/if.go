@@ -0,0 +1,210 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/trivago/gollum/core"
+)
+
+// If formatter
+//
+// This formatter evaluates a condition for each message and applies one list
+// of formatters if the condition is true and another one if it is false.
+// This allows varying the formatting of messages without splitting them into
+// different streams.
+//
+// A condition consists of one or more checks. Checks that are not configured
+// are ignored. If no check is configured, the condition is always true.
+//
+// Parameters
+//
+// - Pattern: Defines a regular expression that has to match the content.
+// By default this parameter is set to "".
+//
+// - Metadata: Defines a map of metadata fields and the values they have to
+// be equal to.
+// By default this parameter is set to an empty map.
+//
+// - Streams: Defines a list of streams. The message has to be routed to one
+// of them.
+// By default this parameter is set to an empty list.
+//
+// - Expression: Defines a JMESPath expression evaluated on the content parsed
+// as JSON. The check passes if the result is not false, null or empty.
+// Content that is not valid JSON fails the check. The expression language is
+// described at http://jmespath.org/specification.html.
+// By default this parameter is set to "".
+//
+// - Match: Defines how checks are combined. "all" requires all checks to
+// pass, "any" requires at least one check to pass.
+// By default this parameter is set to "all".
+//
+// - Then: Defines the list of formatters applied if the condition is true.
+// By default this parameter is set to an empty list.
+//
+// - Else: Defines the list of formatters applied if the condition is false.
+// By default this parameter is set to an empty list.
+//
+// Examples
+//
+// This example base64 encodes binary messages coming from one stream and
+// adds a timestamp to all others:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.If:
+//        Streams: binary
+//        Metadata:
+//          encoding: raw
+//        Then:
+//          - format.Base64Encode
+//        Else:
+//          - format.Timestamp
+type If struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	pattern              *regexp.Regexp
+	metadata             map[string]string
+	streams              map[core.MessageStreamID]bool
+	expression           *jmespath.JMESPath
+	matchAny             bool
+	checks               []func(*core.Message) bool
+	then                 core.FormatterArray `config:"Then"`
+	otherwise            core.FormatterArray `config:"Else"`
+}
+
+func init() {
+	core.TypeRegistry.Register(If{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *If) Configure(conf core.PluginConfigReader) {
+	var err error
+	if pattern := conf.GetString("Pattern", ""); pattern != "" {
+		format.pattern, err = regexp.Compile(pattern)
+		conf.Errors.Push(err)
+	}
+	if expression := conf.GetString("Expression", ""); expression != "" {
+		format.expression, err = jmespath.Compile(expression)
+		conf.Errors.Push(err)
+	}
+
+	format.metadata = conf.GetStringMap("Metadata", map[string]string{})
+	format.streams = make(map[core.MessageStreamID]bool)
+	for _, streamID := range conf.GetStreamArray("Streams", []core.MessageStreamID{}) {
+		format.streams[streamID] = true
+	}
+
+	switch match := strings.ToLower(conf.GetString("Match", "all")); match {
+	case "all":
+	case "any":
+		format.matchAny = true
+	default:
+		conf.Errors.Pushf("Unknown match mode '%s'", match)
+	}
+
+	if format.pattern != nil {
+		format.checks = append(format.checks, format.matchPattern)
+	}
+	if len(format.metadata) > 0 {
+		format.checks = append(format.checks, format.matchMetadata)
+	}
+	if len(format.streams) > 0 {
+		format.checks = append(format.checks, format.matchStream)
+	}
+	if format.expression != nil {
+		format.checks = append(format.checks, format.matchExpression)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *If) ApplyFormatter(msg *core.Message) error {
+	if format.evaluate(msg) {
+		return format.then.ApplyFormatter(msg)
+	}
+	return format.otherwise.ApplyFormatter(msg)
+}
+
+// evaluate returns true if the condition is true for the given message.
+func (format *If) evaluate(msg *core.Message) bool {
+	if len(format.checks) == 0 {
+		return true
+	}
+	for _, check := range format.checks {
+		if check(msg) == format.matchAny {
+			return format.matchAny
+		}
+	}
+	return !format.matchAny
+}
+
+func (format *If) matchPattern(msg *core.Message) bool {
+	return format.pattern.Match(format.GetAppliedContent(msg))
+}
+
+func (format *If) matchMetadata(msg *core.Message) bool {
+	metadata := msg.TryGetMetadata()
+	if metadata == nil {
+		return false
+	}
+	for key, expected := range format.metadata {
+		value, exists := metadata.TryGetValue(key)
+		if !exists || string(value) != expected {
+			return false
+		}
+	}
+	return true
+}
+
+func (format *If) matchStream(msg *core.Message) bool {
+	return format.streams[msg.GetStreamID()]
+}
+
+func (format *If) matchExpression(msg *core.Message) bool {
+	var data interface{}
+	if err := json.Unmarshal(format.GetAppliedContent(msg), &data); err != nil {
+		return false
+	}
+	result, err := format.expression.Search(data)
+	if err != nil {
+		format.Logger.Warning("If failed to apply the expression: ", err)
+		return false
+	}
+	return ifIsTruthy(result)
+}
+
+// ifIsTruthy implements the JMESPath definition of true values.
+func ifIsTruthy(value interface{}) bool {
+	switch typedValue := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return typedValue
+	case string:
+		return typedValue != ""
+	case []interface{}:
+		return len(typedValue) > 0
+	case map[string]interface{}:
+		return len(typedValue) > 0
+	default:
+		return true
+	}
+}
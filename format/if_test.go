@@ -0,0 +1,98 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+var (
+	testIfThen = []interface{}{
+		map[interface{}]interface{}{
+			"format.Envelope": map[string]interface{}{"Prefix": "then:", "Postfix": ""},
+		},
+	}
+	testIfElse = []interface{}{
+		map[interface{}]interface{}{
+			"format.Envelope": map[string]interface{}{"Prefix": "else:", "Postfix": ""},
+		},
+	}
+)
+
+func TestIfPatternAndMetadata(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.If")
+	config.Override("Then", testIfThen)
+	config.Override("Else", testIfElse)
+	config.Override("Pattern", "^error")
+	config.Override("Metadata", map[string]string{"env": "prod"})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*If)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("error: failed"), core.Metadata{"env": []byte("prod")}, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("then:error: failed", msg.String())
+
+	msg = core.NewMessage(nil, []byte("error: failed"), core.Metadata{"env": []byte("dev")}, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("else:error: failed", msg.String())
+
+	msg = core.NewMessage(nil, []byte("info: ok"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("else:info: ok", msg.String())
+}
+
+func TestIfMatchAny(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.If")
+	config.Override("Then", testIfThen)
+	config.Override("Else", testIfElse)
+	config.Override("Streams", []string{"audit"})
+	config.Override("Expression", "user.admin")
+	config.Override("Match", "any")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*If)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"user":{"admin":true}}`), nil, core.GetStreamID("web"))
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`then:{"user":{"admin":true}}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte(`{"user":{"admin":false}}`), nil, core.GetStreamID("audit"))
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`then:{"user":{"admin":false}}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte(`not json`), nil, core.GetStreamID("web"))
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`else:not json`, msg.String())
+}
@@ -0,0 +1,282 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/trivago/gollum/core"
+)
+
+// JSONPath formatter
+//
+// This formatter evaluates path expressions on JSON content and stores the
+// results in metadata fields. The content is not changed.
+//
+// Paths can be written in JSONPath or GJSON style, e.g. "$.user.name",
+// "$['user']['name']", "items[0].id", "items.0.id", "items[-1]", "items[*].id"
+// or "items.#" for the number of elements. A "\" escapes a "." in GJSON style
+// field names. Paths containing a wildcard always return an array.
+//
+// Strings are stored without quotes, numbers are stored exactly as written in
+// the content and objects and arrays are stored as compact JSON. Fields that
+// do not exist or are null are not written.
+//
+// Parameters
+//
+// - Paths: Defines a map of metadata fields and the paths of the values to
+// store in them.
+// By default this parameter is set to an empty map.
+//
+// - Raw: When set to true, all values are stored as JSON, i.e. strings are
+// quoted. This allows to distinguish the string "1" from the number 1.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example stores the user ID, all tags and the number of items of each
+// message in metadata:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.JSONPath:
+//        Paths:
+//          user_id: $.user.id
+//          tags: $.tags[*].name
+//          item_count: items.#
+type JSONPath struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	paths                map[string][]jsonPathSegment
+	raw                  bool `config:"Raw" default:"false"`
+}
+
+type jsonPathSegmentType int
+
+const (
+	jsonPathField = jsonPathSegmentType(iota)
+	jsonPathIndex
+	jsonPathWildcard
+	jsonPathCount
+)
+
+type jsonPathSegment struct {
+	kind  jsonPathSegmentType
+	name  string
+	index int
+}
+
+func init() {
+	core.TypeRegistry.Register(JSONPath{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *JSONPath) Configure(conf core.PluginConfigReader) {
+	format.paths = make(map[string][]jsonPathSegment)
+	for key, path := range conf.GetStringMap("Paths", map[string]string{}) {
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			conf.Errors.Pushf("Invalid path '%s': %s", path, err)
+			continue
+		}
+		format.paths[key] = segments
+	}
+
+	if len(format.paths) == 0 {
+		format.Logger.Warning("No Paths set, messages are not changed")
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *JSONPath) ApplyFormatter(msg *core.Message) error {
+	if len(format.paths) == 0 {
+		return nil
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(format.GetAppliedContent(msg)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		format.Logger.Warning("JSONPath failed to unmarshal a message: ", err)
+		return err
+	}
+
+	metadata := msg.GetMetadata()
+	for key, segments := range format.paths {
+		value, found := evaluateJSONPath(document, segments)
+		if !found || value == nil {
+			continue
+		}
+
+		if text, isString := value.(string); isString && !format.raw {
+			metadata.SetValue(key, []byte(text))
+			continue
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			format.Logger.Warning("JSONPath failed to marshal a value: ", err)
+			continue
+		}
+		metadata.SetValue(key, data)
+	}
+	return nil
+}
+
+// parseJSONPath splits a path into segments.
+func parseJSONPath(path string) ([]jsonPathSegment, error) {
+	segments := []jsonPathSegment{}
+	path = strings.TrimPrefix(path, "$")
+
+	for pos := 0; pos < len(path); {
+		switch path[pos] {
+		case '.':
+			pos++
+
+		case '[':
+			end := strings.IndexByte(path[pos:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ']'")
+			}
+			selector := path[pos+1 : pos+end]
+			pos += end + 1
+
+			switch {
+			case selector == "*":
+				segments = append(segments, jsonPathSegment{kind: jsonPathWildcard})
+			case len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0]:
+				segments = append(segments, jsonPathSegment{kind: jsonPathField, name: selector[1 : len(selector)-1]})
+			default:
+				index, err := strconv.Atoi(selector)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index '%s'", selector)
+				}
+				segments = append(segments, jsonPathSegment{kind: jsonPathIndex, index: index})
+			}
+
+		default:
+			name := make([]byte, 0, len(path)-pos)
+			for ; pos < len(path) && path[pos] != '.' && path[pos] != '['; pos++ {
+				if path[pos] == '\\' && pos+1 < len(path) {
+					pos++
+				}
+				name = append(name, path[pos])
+			}
+
+			switch string(name) {
+			case "*":
+				segments = append(segments, jsonPathSegment{kind: jsonPathWildcard})
+			case "#":
+				segments = append(segments, jsonPathSegment{kind: jsonPathCount})
+			default:
+				segments = append(segments, jsonPathSegment{kind: jsonPathField, name: string(name)})
+			}
+		}
+	}
+	return segments, nil
+}
+
+// evaluateJSONPath returns the value addressed by the given segments. If the
+// path contains a wildcard, all matching values are returned as an array.
+func evaluateJSONPath(document interface{}, segments []jsonPathSegment) (interface{}, bool) {
+	values := []interface{}{document}
+	isList := false
+
+	for _, segment := range segments {
+		next := make([]interface{}, 0, len(values))
+		for _, value := range values {
+			switch segment.kind {
+			case jsonPathField:
+				switch typedValue := value.(type) {
+				case map[string]interface{}:
+					if child, exists := typedValue[segment.name]; exists {
+						next = append(next, child)
+					}
+				case []interface{}:
+					// GJSON style paths address array elements like fields
+					index, err := strconv.Atoi(segment.name)
+					if err != nil {
+						break
+					}
+					if child, exists := jsonPathElement(typedValue, index); exists {
+						next = append(next, child)
+					}
+				}
+
+			case jsonPathIndex:
+				if array, isArray := value.([]interface{}); isArray {
+					if child, exists := jsonPathElement(array, segment.index); exists {
+						next = append(next, child)
+					}
+				}
+
+			case jsonPathWildcard:
+				switch typedValue := value.(type) {
+				case map[string]interface{}:
+					keys := make([]string, 0, len(typedValue))
+					for key := range typedValue {
+						keys = append(keys, key)
+					}
+					sort.Strings(keys)
+					for _, key := range keys {
+						next = append(next, typedValue[key])
+					}
+				case []interface{}:
+					next = append(next, typedValue...)
+				}
+
+			case jsonPathCount:
+				switch typedValue := value.(type) {
+				case map[string]interface{}:
+					next = append(next, json.Number(strconv.Itoa(len(typedValue))))
+				case []interface{}:
+					next = append(next, json.Number(strconv.Itoa(len(typedValue))))
+				}
+			}
+		}
+
+		if segment.kind == jsonPathWildcard {
+			isList = true
+		}
+		values = next
+	}
+
+	switch {
+	case isList:
+		return values, true
+	case len(values) == 0:
+		return nil, false
+	default:
+		return values[0], true
+	}
+}
+
+// jsonPathElement returns the element at the given index. Negative indexes
+// count from the end of the array.
+func jsonPathElement(array []interface{}, index int) (interface{}, bool) {
+	if index < 0 {
+		index += len(array)
+	}
+	if index < 0 || index >= len(array) {
+		return nil, false
+	}
+	return array[index], true
+}
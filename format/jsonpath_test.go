@@ -0,0 +1,95 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+const jsonPathTestContent = `{"user":{"id":1234567890123456789,"name":"ann","ratio":1.50},` +
+	`"tags":[{"name":"a"},{"name":"b"}],"items":[1,2,3],"a.b":true,"none":null}`
+
+func TestJSONPath(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.JSONPath")
+	config.Override("Paths", map[string]string{
+		"id":      "$.user.id",
+		"name":    "$['user']['name']",
+		"ratio":   "user.ratio",
+		"user":    "user",
+		"tags":    "$.tags[*].name",
+		"first":   "items.0",
+		"last":    "items[-1]",
+		"count":   "items.#",
+		"escaped": `a\.b`,
+		"none":    "none",
+		"missing": "user.email",
+	})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*JSONPath)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(jsonPathTestContent), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+
+	metadata := msg.GetMetadata()
+	expect.Equal("1234567890123456789", metadata.GetValueString("id"))
+	expect.Equal("ann", metadata.GetValueString("name"))
+	expect.Equal("1.50", metadata.GetValueString("ratio"))
+	expect.Equal(`{"id":1234567890123456789,"name":"ann","ratio":1.50}`, metadata.GetValueString("user"))
+	expect.Equal(`["a","b"]`, metadata.GetValueString("tags"))
+	expect.Equal("1", metadata.GetValueString("first"))
+	expect.Equal("3", metadata.GetValueString("last"))
+	expect.Equal("3", metadata.GetValueString("count"))
+	expect.Equal("true", metadata.GetValueString("escaped"))
+
+	_, exists := metadata.TryGetValue("none")
+	expect.False(exists)
+	_, exists = metadata.TryGetValue("missing")
+	expect.False(exists)
+
+	expect.Equal(jsonPathTestContent, msg.String())
+}
+
+func TestJSONPathRaw(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.JSONPath")
+	config.Override("Paths", map[string]string{"name": "user.name"})
+	config.Override("Raw", true)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*JSONPath)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(jsonPathTestContent), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`"ann"`, msg.GetMetadata().GetValueString("name"))
+
+	msg = core.NewMessage(nil, []byte("not json"), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+
+	_, err = parseJSONPath("items[x]")
+	expect.NotNil(err)
+}
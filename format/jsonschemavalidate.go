@@ -0,0 +1,143 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/trivago/gollum/core"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// JSONSchemaValidate formatter
+//
+// This formatter validates JSON payloads against a JSON Schema (draft 4, 6
+// or 7). Valid messages are not changed. Invalid messages are either
+// discarded, annotated or routed to a quarantine stream.
+//
+// Parameters
+//
+// - Schema: Defines the JSON Schema as string.
+// By default this parameter is set to "".
+//
+// - SchemaFile: Defines a file to read the JSON Schema from. Only used if
+// Schema is not set. If neither is set, all messages are considered valid.
+// By default this parameter is set to "".
+//
+// - Action: Defines what happens to invalid messages. "drop" discards them,
+// "annotate" writes the validation errors to the metadata field ErrorField and
+// "route" does the same and routes them to QuarantineStream.
+// By default this parameter is set to "drop".
+//
+// - QuarantineStream: Defines the stream invalid messages are routed to by
+// action "route".
+// By default this parameter is set to "quarantine".
+//
+// - ErrorField: Defines the metadata field the validation errors are written
+// to. Multiple errors are separated by "; ".
+// By default this parameter is set to "validation_error".
+//
+// Examples
+//
+// This example routes orders that do not match the schema to the stream
+// "invalid_orders":
+//
+//  exampleConsumer:
+//    Type: consumer.Kafka
+//    Streams: orders
+//    Modulators:
+//      - format.JSONSchemaValidate:
+//        SchemaFile: /etc/gollum/order.schema.json
+//        Action: route
+//        QuarantineStream: invalid_orders
+type JSONSchemaValidate struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	schema               *gojsonschema.Schema
+	action               string
+	quarantineStreamID   core.MessageStreamID
+	errorField           string `config:"ErrorField" default:"validation_error"`
+}
+
+func init() {
+	core.TypeRegistry.Register(JSONSchemaValidate{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *JSONSchemaValidate) Configure(conf core.PluginConfigReader) {
+	schema := conf.GetString("Schema", "")
+	if schema == "" {
+		if path := conf.GetString("SchemaFile", ""); path != "" {
+			data, err := ioutil.ReadFile(path)
+			if conf.Errors.Push(err) {
+				return
+			}
+			schema = string(data)
+		}
+	}
+
+	if schema == "" {
+		format.Logger.Warning("Neither Schema nor SchemaFile set, all messages are valid")
+	} else {
+		var err error
+		format.schema, err = gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+		if err != nil {
+			conf.Errors.Pushf("Invalid schema: %s", err)
+		}
+	}
+
+	format.action = strings.ToLower(conf.GetString("Action", "drop"))
+	switch format.action {
+	case "drop", "annotate":
+	case "route":
+		format.quarantineStreamID = core.GetStreamID(conf.GetString("QuarantineStream", "quarantine"))
+	default:
+		conf.Errors.Pushf("Unknown action '%s'", format.action)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *JSONSchemaValidate) ApplyFormatter(msg *core.Message) error {
+	if format.schema == nil {
+		return nil
+	}
+
+	result, err := format.schema.Validate(gojsonschema.NewBytesLoader(format.GetAppliedContent(msg)))
+	var validationError string
+	switch {
+	case err != nil:
+		validationError = err.Error()
+	case result.Valid():
+		return nil
+	default:
+		errors := make([]string, 0, len(result.Errors()))
+		for _, resultError := range result.Errors() {
+			errors = append(errors, resultError.String())
+		}
+		validationError = strings.Join(errors, "; ")
+	}
+
+	switch format.action {
+	case "drop":
+		return fmt.Errorf("message does not match schema: %s", validationError)
+
+	case "route":
+		msg.SetStreamID(format.quarantineStreamID)
+	}
+
+	msg.GetMetadata().SetValue(format.errorField, []byte(validationError))
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+const testJSONSchema = `{
+	"type": "object",
+	"properties": {
+		"id": {"type": "integer"},
+		"name": {"type": "string"}
+	},
+	"required": ["id"]
+}`
+
+func TestJSONSchemaValidateDrop(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.JSONSchemaValidate")
+	config.Override("Schema", testJSONSchema)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*JSONSchemaValidate)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"id":1,"name":"test"}`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Nil(msg.TryGetMetadata())
+
+	msg = core.NewMessage(nil, []byte(`{"name":1}`), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+
+	msg = core.NewMessage(nil, []byte(`not json`), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
+
+func TestJSONSchemaValidateAnnotate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.JSONSchemaValidate")
+	config.Override("Schema", testJSONSchema)
+	config.Override("Action", "annotate")
+	config.Override("ErrorField", "error")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*JSONSchemaValidate)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"name":1}`), nil, core.GetStreamID("orders"))
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"name":1}`, msg.String())
+	expect.Equal(core.GetStreamID("orders"), msg.GetStreamID())
+	expect.Equal("(root): id is required; name: Invalid type. Expected: string, given: integer", msg.GetMetadata().GetValueString("error"))
+}
+
+func TestJSONSchemaValidateRoute(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.JSONSchemaValidate")
+	config.Override("Schema", testJSONSchema)
+	config.Override("Action", "route")
+	config.Override("QuarantineStream", "invalid")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*JSONSchemaValidate)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"id":1}`), nil, core.GetStreamID("orders"))
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(core.GetStreamID("orders"), msg.GetStreamID())
+
+	msg = core.NewMessage(nil, []byte(`{"id":"1"}`), nil, core.GetStreamID("orders"))
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(core.GetStreamID("invalid"), msg.GetStreamID())
+	expect.Equal("id: Invalid type. Expected: integer, given: string", msg.GetMetadata().GetValueString("validation_error"))
+}
+
+func TestJSONSchemaValidateInvalidConfig(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.JSONSchemaValidate")
+	config.Override("Schema", `{"type": 5}`)
+	_, err := core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("", "format.JSONSchemaValidate")
+	config.Override("Action", "ignore")
+	_, err = core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
@@ -0,0 +1,271 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tstrings"
+)
+
+// JSONTransform formatter
+//
+// This formatter reshapes JSON encoded data by applying a query expression
+// and a list of operations. The expression is applied first, operations are
+// applied to the result of the expression in order of their appearance.
+//
+// Parameters
+//
+// - Expression: Defines a JMESPath expression used to transform the payload,
+// e.g. "{host: meta.host, message: msg}". The result of the expression
+// replaces the payload. If empty, no expression is applied. The expression
+// language is described at http://jmespath.org/specification.html.
+// By default this parameter is set to "".
+//
+// - Operations: Defines an array of operations to be applied to a JSON object.
+// Operations start with the path of a field, followed by the name of the
+// operation followed by an argument if necessary. Path, operation and argument
+// are separated by using the ":" character, which can be escaped by "\:".
+// Nested fields are addressed by using "/" as a separator, e.g. "meta/host".
+// By default this parameter is set to an empty list.
+//
+//  - add: <value>
+//  Set the field to the given value. Missing parent objects are created. If
+//  the value is valid JSON, e.g. a number or an object, the decoded value is
+//  stored. Otherwise the value is stored as a string.
+//
+//  - rename: <new name>
+//  Rename the field. The field stays inside the same parent object.
+//
+//  - move: <new path>
+//  Move the field to the given path. Missing parent objects are created.
+//
+//  - copy: <new path>
+//  Copy the field to the given path. Missing parent objects are created.
+//
+//  - remove:
+//  Remove the field.
+//
+// Examples
+//
+// This example moves the nested field "request/host" to the top level, drops
+// the request headers and marks every message with its source:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.JSONTransform:
+//        Operations:
+//          - "request/host:move:host"
+//          - "request/headers:remove"
+//          - "source:add:console"
+//
+// This example picks and renames fields using an expression:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.JSONTransform:
+//        Expression: "{host: request.host, status: response.status}"
+type JSONTransform struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	expression           *jmespath.JMESPath
+	operations           []jsonTransformOperation
+}
+
+type jsonTransformOperation struct {
+	path      []string
+	operation string
+	argument  string
+}
+
+func init() {
+	core.TypeRegistry.Register(JSONTransform{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *JSONTransform) Configure(conf core.PluginConfigReader) {
+	if expression := conf.GetString("Expression", ""); expression != "" {
+		var err error
+		format.expression, err = jmespath.Compile(expression)
+		conf.Errors.Push(err)
+	}
+
+	operations := conf.GetStringArray("Operations", []string{})
+	format.operations = make([]jsonTransformOperation, 0, len(operations))
+
+	for _, op := range operations {
+		parts := strings.SplitN(strings.Replace(op, "\\:", "\r", -1), ":", 3)
+		for i, value := range parts {
+			parts[i] = strings.Replace(value, "\r", ":", -1)
+		}
+
+		if len(parts) < 2 || parts[0] == "" {
+			conf.Errors.Pushf("Invalid operation '%s'", op)
+			continue
+		}
+
+		operation := jsonTransformOperation{
+			path:      strings.Split(parts[0], "/"),
+			operation: strings.ToLower(parts[1]),
+		}
+		if len(parts) == 3 {
+			operation.argument = tstrings.Unescape(parts[2])
+		}
+
+		switch operation.operation {
+		case "remove":
+		case "add", "rename", "move", "copy":
+			if operation.argument == "" {
+				conf.Errors.Pushf("Operation '%s' requires an argument", op)
+				continue
+			}
+		default:
+			conf.Errors.Pushf("Unknown operation '%s' in '%s'", operation.operation, op)
+			continue
+		}
+
+		format.operations = append(format.operations, operation)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *JSONTransform) ApplyFormatter(msg *core.Message) error {
+	var data interface{}
+	if err := json.Unmarshal(format.GetAppliedContent(msg), &data); err != nil {
+		format.Logger.Warning("JSONTransform failed to unmarshal a message: ", err)
+		return err
+	}
+
+	if format.expression != nil {
+		var err error
+		if data, err = format.expression.Search(data); err != nil {
+			format.Logger.Warning("JSONTransform failed to apply the expression: ", err)
+			return err
+		}
+	}
+
+	if len(format.operations) > 0 {
+		values, isObject := data.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("JSONTransform operations require a JSON object")
+		}
+		for _, operation := range format.operations {
+			format.applyOperation(operation, values)
+		}
+	}
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		format.Logger.Warning("JSONTransform failed to marshal a message: ", err)
+		return err
+	}
+
+	format.SetAppliedContent(msg, content)
+	return nil
+}
+
+func (format *JSONTransform) applyOperation(operation jsonTransformOperation, values map[string]interface{}) {
+	if operation.operation == "add" {
+		var value interface{}
+		if err := json.Unmarshal([]byte(operation.argument), &value); err != nil {
+			value = operation.argument
+		}
+		jsonTransformSet(values, operation.path, value)
+		return // ### return, added ###
+	}
+
+	parent, key := jsonTransformParent(values, operation.path)
+	if parent == nil {
+		return // ### return, field does not exist ###
+	}
+	value, exists := parent[key]
+	if !exists {
+		return // ### return, field does not exist ###
+	}
+
+	switch operation.operation {
+	case "remove":
+		delete(parent, key)
+
+	case "rename":
+		delete(parent, key)
+		parent[operation.argument] = value
+
+	case "move":
+		delete(parent, key)
+		jsonTransformSet(values, strings.Split(operation.argument, "/"), value)
+
+	case "copy":
+		jsonTransformSet(values, strings.Split(operation.argument, "/"), jsonTransformCopy(value))
+	}
+}
+
+// jsonTransformParent returns the object holding the field at the given path
+// along with the name of the field.
+func jsonTransformParent(values map[string]interface{}, path []string) (map[string]interface{}, string) {
+	parent := values
+	for _, key := range path[:len(path)-1] {
+		child, isObject := parent[key].(map[string]interface{})
+		if !isObject {
+			return nil, ""
+		}
+		parent = child
+	}
+	return parent, path[len(path)-1]
+}
+
+// jsonTransformSet stores a value at the given path. Missing parent objects
+// are created, non-object values along the path are replaced.
+func jsonTransformSet(values map[string]interface{}, path []string, value interface{}) {
+	parent := values
+	for _, key := range path[:len(path)-1] {
+		child, isObject := parent[key].(map[string]interface{})
+		if !isObject {
+			child = make(map[string]interface{})
+			parent[key] = child
+		}
+		parent = child
+	}
+	parent[path[len(path)-1]] = value
+}
+
+// jsonTransformCopy creates a deep copy of a decoded JSON value.
+func jsonTransformCopy(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			copied[key] = jsonTransformCopy(item)
+		}
+		return copied
+
+	case []interface{}:
+		copied := make([]interface{}, len(typedValue))
+		for i, item := range typedValue {
+			copied[i] = jsonTransformCopy(item)
+		}
+		return copied
+
+	default:
+		return value
+	}
+}
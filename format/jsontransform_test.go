@@ -0,0 +1,90 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestJSONTransformOperations(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.JSONTransform")
+	config.Override("Operations", []interface{}{
+		"request/host:move:host",
+		"request/headers:remove",
+		"source:add:console",
+		"meta/count:add:3",
+		"status:rename:code",
+		"host:copy:meta/origin",
+	})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*JSONTransform)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"request":{"host":"example.com","headers":{"a":"b"}},"status":200}`),
+		nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"code":200,"host":"example.com","meta":{"count":3,"origin":"example.com"},"request":{},"source":"console"}`,
+		msg.String())
+}
+
+func TestJSONTransformExpression(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.JSONTransform")
+	config.Override("Expression", "{host: request.host, status: status}")
+	config.Override("Operations", []interface{}{"status:rename:code"})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*JSONTransform)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"request":{"host":"example.com"},"status":200}`),
+		nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"code":200,"host":"example.com"}`, msg.String())
+}
+
+func TestJSONTransformInvalid(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.JSONTransform")
+	config.Override("Operations", []interface{}{"field:unknown"})
+
+	_, err := core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("", "format.JSONTransform")
+	config.Override("Operations", []interface{}{"field:remove"})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*JSONTransform)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`[1,2]`), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
@@ -0,0 +1,249 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/trivago/gollum/core"
+)
+
+// Logfmt formatter
+//
+// This formatter converts between logfmt, i.e. lines of key=value pairs, and
+// JSON objects. Values containing spaces, quotes or "=" are quoted. Keys
+// without a value, e.g. "debug" in "level=info debug", are parsed as true.
+//
+// Parameters
+//
+// - Mode: Defines the conversion direction. Set to "parse" to convert logfmt
+// into a JSON object or to "serialize" to convert a JSON object into logfmt.
+// By default this parameter is set to "parse".
+//
+// - ToMetadata: When set to true, parsed values are stored as metadata using
+// the key as metadata key. The message is not changed otherwise.
+// By default this parameter is set to false.
+//
+// - Keys: Defines the keys to write when serializing in the given order. If
+// empty, all keys are written in alphabetical order.
+// By default this parameter is set to an empty list.
+//
+// Examples
+//
+// This example parses logfmt lines and stores the values as metadata:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Logfmt:
+//        ToMetadata: true
+//
+// This example writes JSON messages as logfmt, starting with time and level:
+//
+//  exampleProducer:
+//    Type: producer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Logfmt:
+//        Mode: serialize
+//        Keys:
+//          - time
+//          - level
+//          - msg
+type Logfmt struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	serialize            bool
+	toMetadata           bool     `config:"ToMetadata" default:"false"`
+	keys                 []string `config:"Keys"`
+}
+
+// logfmtPair is a single key value pair. A nil value marks a key without
+// value.
+type logfmtPair struct {
+	key   string
+	value *string
+}
+
+func init() {
+	core.TypeRegistry.Register(Logfmt{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Logfmt) Configure(conf core.PluginConfigReader) {
+	switch mode := strings.ToLower(conf.GetString("Mode", "parse")); mode {
+	case "parse":
+	case "serialize":
+		format.serialize = true
+	default:
+		conf.Errors.Pushf("Unknown mode '%s'", mode)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Logfmt) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+
+	if format.serialize {
+		values := make(map[string]interface{})
+		if err := json.Unmarshal(content, &values); err != nil {
+			format.Logger.Warning("Logfmt failed to unmarshal a message: ", err)
+			return err
+		}
+		format.SetAppliedContent(msg, []byte(format.formatLine(values)))
+		return nil
+	}
+
+	pairs, err := parseLogfmt(strings.TrimRight(string(content), "\r\n"))
+	if err != nil {
+		format.Logger.Warning("Logfmt failed to parse a message: ", err)
+		return err
+	}
+
+	if format.toMetadata {
+		metadata := msg.GetMetadata()
+		for _, pair := range pairs {
+			if pair.value == nil {
+				metadata.SetValue(pair.key, []byte("true"))
+			} else {
+				metadata.SetValue(pair.key, []byte(*pair.value))
+			}
+		}
+		return nil // ### return, payload unchanged ###
+	}
+
+	values := make(map[string]interface{}, len(pairs))
+	for _, pair := range pairs {
+		if pair.value == nil {
+			values[pair.key] = true
+		} else {
+			values[pair.key] = *pair.value
+		}
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	format.SetAppliedContent(msg, data)
+	return nil
+}
+
+func (format *Logfmt) formatLine(values map[string]interface{}) string {
+	keys := format.keys
+	if len(keys) == 0 {
+		keys = make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value, exists := values[key]
+		if !exists {
+			continue
+		}
+
+		var text string
+		switch typedValue := value.(type) {
+		case nil:
+			text = ""
+		case string:
+			text = typedValue
+		case float64:
+			text = strconv.FormatFloat(typedValue, 'f', -1, 64)
+		case bool:
+			text = strconv.FormatBool(typedValue)
+		default:
+			data, _ := json.Marshal(value)
+			text = string(data)
+		}
+
+		if text == "" || strings.ContainsAny(text, " =\"\t\r\n") {
+			text = strconv.Quote(text)
+		}
+		pairs = append(pairs, logfmtKey(key)+"="+text)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// logfmtKey removes characters not allowed in keys.
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// parseLogfmt splits a logfmt line into its key value pairs.
+func parseLogfmt(line string) ([]logfmtPair, error) {
+	var pairs []logfmtPair
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return pairs, nil
+		}
+
+		keyEnd := strings.IndexAny(line, "= \t")
+		if keyEnd == 0 {
+			return nil, fmt.Errorf("missing key")
+		}
+		if keyEnd < 0 || line[keyEnd] != '=' {
+			if keyEnd < 0 {
+				keyEnd = len(line)
+			}
+			pairs = append(pairs, logfmtPair{key: line[:keyEnd]})
+			line = line[keyEnd:]
+			continue
+		}
+
+		key := line[:keyEnd]
+		line = line[keyEnd+1:]
+
+		var value string
+		if strings.HasPrefix(line, "\"") {
+			end := 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted value of key %s", key)
+			}
+
+			var err error
+			if value, err = strconv.Unquote(line[:end+1]); err != nil {
+				return nil, fmt.Errorf("invalid quoted value of key %s: %s", key, err)
+			}
+			line = line[end+1:]
+		} else {
+			valueEnd := strings.IndexAny(line, " \t")
+			if valueEnd < 0 {
+				valueEnd = len(line)
+			}
+			value, line = line[:valueEnd], line[valueEnd:]
+		}
+		pairs = append(pairs, logfmtPair{key: key, value: &value})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestLogfmtParse(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Logfmt")
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Logfmt)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`level=info msg="hello \"world\"" debug empty= path=/a=b`+"\n"), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"debug":true,"empty":"","level":"info","msg":"hello \"world\"","path":"/a=b"}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte(`msg="open`), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
+
+func TestLogfmtToMetadata(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Logfmt")
+	config.Override("ToMetadata", true)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Logfmt)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`level=warn msg="a b"`), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`level=warn msg="a b"`, msg.String())
+	expect.Equal("warn", msg.GetMetadata().GetValueString("level"))
+	expect.Equal("a b", msg.GetMetadata().GetValueString("msg"))
+}
+
+func TestLogfmtSerialize(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Logfmt")
+	config.Override("Mode", "serialize")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Logfmt)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"msg":"hello \"world\"","level":"info","code":200,"ok":true,"tags":["a"],"empty":""}`),
+		nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`code=200 empty="" level=info msg="hello \"world\"" ok=true tags="[\"a\"]"`, msg.String())
+
+	config.Override("Keys", []interface{}{"level", "msg", "missing"})
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted = plugin.(*Logfmt)
+	expect.True(casted)
+
+	msg = core.NewMessage(nil, []byte(`{"msg":"hi","level":"info","code":200}`), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`level=info msg=hi`, msg.String())
+}
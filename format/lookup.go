@@ -0,0 +1,530 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core"
+)
+
+// Lookup formatter
+//
+// This formatter enriches messages with a value fetched from an external
+// source. The value is looked up by a key taken from the message and stored
+// in a metadata field.
+//
+// Lookups of the http and redis source are cached. Keys that do not exist are
+// cached, too, so that unknown keys do not cause a request per message. A
+// lookup that takes longer than TimeoutMs does not block the message any
+// longer. The message is passed on unchanged and the result is cached as
+// soon as it arrives. Concurrent lookups of the same key share one request.
+//
+// Parameters
+//
+// - Source: Defines where values are looked up. Valid values are "http",
+// "redis" and "file".
+// By default this parameter is set to "file".
+//
+// - Field: Defines the field of a JSON object holding the lookup key. Nested
+// fields can be addressed by using "/" as a separator, e.g. "user/id". If
+// empty, the whole content is used as key.
+// By default this parameter is set to "".
+//
+// - Target: Defines the metadata field the looked up value is stored in.
+// By default this parameter is set to "lookup".
+//
+// - DropIfMissing: When set to true, messages with a key that does not exist
+// in the source are discarded. Messages are never discarded because of
+// failed or timed out lookups.
+// By default this parameter is set to false.
+//
+// - TimeoutMs: Defines the maximum time in milliseconds a message waits for a
+// lookup to finish.
+// By default this parameter is set to 100.
+//
+// - CacheTTLSec: Defines the number of seconds a value is cached.
+// By default this parameter is set to 300.
+//
+// - NegativeCacheTTLSec: Defines the number of seconds a key that does not
+// exist is cached. Set to 0 to disable negative caching.
+// By default this parameter is set to 60.
+//
+// - CacheSize: Defines the maximum number of cached keys. If the cache is
+// full, a random entry is removed. Set to 0 to disable caching.
+// By default this parameter is set to 10000.
+//
+// - HTTP/URL: Defines the URL to request. Every "{key}" is replaced by the
+// URL encoded lookup key. The response body of a 200 response is used as
+// value. A 404 response marks the key as not existing.
+// By default this parameter is set to "".
+//
+// - HTTP/TimeoutSec: Defines the maximum time in seconds a request may take
+// before it is canceled.
+// By default this parameter is set to 10.
+//
+// - Redis/Address: Defines the "host:port" of the redis server.
+// By default this parameter is set to ":6379".
+//
+// - Redis/Password: Defines the password used to connect to redis.
+// By default this parameter is set to "".
+//
+// - Redis/Database: Defines the redis database to use.
+// By default this parameter is set to 0.
+//
+// - Redis/Hash: Defines the name of a redis hash to read values from via
+// HGET. If empty, values are read via GET.
+// By default this parameter is set to "".
+//
+// - Redis/KeyPrefix: Defines a prefix added to each key before reading it
+// from redis.
+// By default this parameter is set to "".
+//
+// - File/Path: Defines the file to read values from. The file is reloaded
+// when it has been modified. Lookups from files are not cached. If not set
+// when using the file source, messages are not changed.
+// By default this parameter is set to "".
+//
+// - File/Format: Defines the format of the file. Valid values are "json"
+// for a JSON object mapping keys to values and "csv" for rows holding the key
+// in the first and the value in the second column.
+// By default this parameter is set to "json".
+//
+// - File/Delimiter: Defines the delimiter used by csv files.
+// By default this parameter is set to ",".
+//
+// - File/ReloadSec: Defines the interval in seconds to check the file for
+// modifications.
+// By default this parameter is set to 60.
+//
+// Examples
+//
+// This example adds the name of a user looked up via HTTP to each message:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Lookup:
+//        Source: http
+//        Field: user/id
+//        Target: username
+//        TimeoutMs: 50
+//        HTTP:
+//          URL: "http://users.local/name?id={key}"
+//
+// This example adds the team owning a host based on a csv file:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Lookup:
+//        ApplyTo: host
+//        Target: team
+//        File:
+//          Path: /etc/gollum/teams.csv
+//          Format: csv
+type Lookup struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	field                []string
+	target               string        `config:"Target" default:"lookup"`
+	dropIfMissing        bool          `config:"DropIfMissing" default:"false"`
+	timeout              time.Duration `config:"TimeoutMs" default:"100" metric:"ms"`
+	ttl                  time.Duration `config:"CacheTTLSec" default:"300" metric:"sec"`
+	negativeTTL          time.Duration `config:"NegativeCacheTTLSec" default:"60" metric:"sec"`
+	cacheSize            int           `config:"CacheSize" default:"10000"`
+	source               lookupSource
+	cache                map[string]lookupEntry
+	pending              map[string]*lookupCall
+	guard                *sync.Mutex
+}
+
+// lookupSource is implemented by all sources of format.Lookup.
+type lookupSource interface {
+	get(key string) (value []byte, found bool, err error)
+}
+
+type lookupEntry struct {
+	value   []byte
+	found   bool
+	expires time.Time
+}
+
+// lookupCall is a lookup in progress. done is closed once the result is set.
+type lookupCall struct {
+	done  chan struct{}
+	value []byte
+	found bool
+	err   error
+}
+
+func init() {
+	core.TypeRegistry.Register(Lookup{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Lookup) Configure(conf core.PluginConfigReader) {
+	if field := conf.GetString("Field", ""); field != "" {
+		format.field = strings.Split(field, "/")
+	}
+
+	format.cache = make(map[string]lookupEntry)
+	format.pending = make(map[string]*lookupCall)
+	format.guard = new(sync.Mutex)
+
+	switch source := strings.ToLower(conf.GetString("Source", "file")); source {
+	case "http":
+		rawURL := conf.GetString("HTTP/URL", "")
+		if rawURL == "" {
+			conf.Errors.Pushf("HTTP/URL must be set")
+			return
+		}
+		format.source = &lookupHTTPSource{
+			url: rawURL,
+			client: &http.Client{
+				Timeout: time.Duration(conf.GetInt("HTTP/TimeoutSec", 10)) * time.Second,
+			},
+		}
+
+	case "redis":
+		format.source = &lookupRedisSource{
+			hash:   conf.GetString("Redis/Hash", ""),
+			prefix: conf.GetString("Redis/KeyPrefix", ""),
+			client: redis.NewClient(&redis.Options{
+				Addr:     conf.GetString("Redis/Address", ":6379"),
+				Password: conf.GetString("Redis/Password", ""),
+				DB:       int(conf.GetInt("Redis/Database", 0)),
+			}),
+		}
+
+	case "file":
+		delimiter := []rune(conf.GetString("File/Delimiter", ","))
+		if len(delimiter) != 1 {
+			conf.Errors.Pushf("File/Delimiter must be a single character")
+			return
+		}
+		fileSource := &lookupFileSource{
+			path:      conf.GetString("File/Path", ""),
+			csv:       strings.ToLower(conf.GetString("File/Format", "json")) == "csv",
+			delimiter: delimiter[0],
+			reload:    time.Duration(conf.GetInt("File/ReloadSec", 60)) * time.Second,
+			logger:    format.Logger,
+			guard:     new(sync.RWMutex),
+		}
+		if fileSource.path == "" {
+			format.Logger.Warning("No File/Path set, messages are not changed")
+			return
+		}
+		if conf.Errors.Push(fileSource.load()) {
+			return
+		}
+		format.source = fileSource
+		format.cacheSize = 0 // ### values are in memory already ###
+
+	default:
+		conf.Errors.Pushf("Unknown source '%s'", source)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Lookup) ApplyFormatter(msg *core.Message) error {
+	if format.source == nil {
+		return nil
+	}
+
+	key, err := format.getKey(format.GetAppliedContent(msg))
+	if err != nil {
+		format.Logger.Warning("Lookup failed to read the key: ", err)
+		return nil
+	}
+
+	value, found, err := format.lookup(key)
+	switch {
+	case err != nil:
+		format.Logger.Warning("Lookup failed: ", err)
+	case found:
+		msg.GetMetadata().SetValue(format.target, value)
+	case format.dropIfMissing:
+		return fmt.Errorf("key '%s' does not exist", key)
+	}
+	return nil
+}
+
+// getKey returns the lookup key stored in the given content.
+func (format *Lookup) getKey(content []byte) (string, error) {
+	if len(format.field) == 0 {
+		return string(bytes.TrimSpace(content)), nil
+	}
+
+	values := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return "", err
+	}
+
+	parent, key := jsonTransformParent(values, format.field)
+	if parent == nil || parent[key] == nil {
+		return "", fmt.Errorf("field %s not found", strings.Join(format.field, "/"))
+	}
+
+	switch value := parent[key].(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	default:
+		return "", fmt.Errorf("field %s is not a string or number", strings.Join(format.field, "/"))
+	}
+}
+
+// lookup returns the value of the given key from the cache or the source.
+// If the source does not answer in time an error is returned while the
+// lookup continues in the background.
+func (format *Lookup) lookup(key string) ([]byte, bool, error) {
+	format.guard.Lock()
+	if entry, cached := format.cache[key]; cached && time.Now().Before(entry.expires) {
+		format.guard.Unlock()
+		return entry.value, entry.found, nil
+	}
+
+	call, isPending := format.pending[key]
+	if !isPending {
+		call = &lookupCall{done: make(chan struct{})}
+		format.pending[key] = call
+		go format.fetch(key, call)
+	}
+	format.guard.Unlock()
+
+	timeout := time.NewTimer(format.timeout)
+	defer timeout.Stop()
+
+	select {
+	case <-call.done:
+		return call.value, call.found, call.err
+	case <-timeout.C:
+		return nil, false, fmt.Errorf("lookup of '%s' timed out", key)
+	}
+}
+
+// fetch requests a key from the source and caches the result.
+func (format *Lookup) fetch(key string, call *lookupCall) {
+	call.value, call.found, call.err = format.source.get(key)
+
+	format.guard.Lock()
+	delete(format.pending, key)
+	if call.err == nil {
+		format.store(key, call.value, call.found)
+	}
+	format.guard.Unlock()
+
+	close(call.done)
+}
+
+// store adds a result to the cache. The caller has to hold the guard.
+func (format *Lookup) store(key string, value []byte, found bool) {
+	ttl := format.ttl
+	if !found {
+		ttl = format.negativeTTL
+	}
+	if format.cacheSize <= 0 || ttl <= 0 {
+		return
+	}
+
+	if _, exists := format.cache[key]; !exists && len(format.cache) >= format.cacheSize {
+		for evictKey := range format.cache {
+			delete(format.cache, evictKey)
+			break
+		}
+	}
+	format.cache[key] = lookupEntry{
+		value:   value,
+		found:   found,
+		expires: time.Now().Add(ttl),
+	}
+}
+
+// lookupHTTPSource requests values from a HTTP endpoint.
+type lookupHTTPSource struct {
+	url    string
+	client *http.Client
+}
+
+func (source *lookupHTTPSource) get(key string) ([]byte, bool, error) {
+	resp, err := source.client.Get(strings.Replace(source.url, "{key}", url.QueryEscape(key), -1))
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		value, err := ioutil.ReadAll(resp.Body)
+		return value, err == nil, err
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("request returned %s", resp.Status)
+	}
+}
+
+// lookupRedisSource reads values from redis keys or a redis hash.
+type lookupRedisSource struct {
+	hash   string
+	prefix string
+	client *redis.Client
+}
+
+func (source *lookupRedisSource) get(key string) ([]byte, bool, error) {
+	var cmd *redis.StringCmd
+	if source.hash != "" {
+		cmd = source.client.HGet(source.hash, source.prefix+key)
+	} else {
+		cmd = source.client.Get(source.prefix + key)
+	}
+
+	value, err := cmd.Bytes()
+	switch {
+	case err == redis.Nil:
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	default:
+		return value, true, nil
+	}
+}
+
+// lookupFileSource reads values from a json or csv file that is reloaded
+// when modified.
+type lookupFileSource struct {
+	path      string
+	csv       bool
+	delimiter rune
+	reload    time.Duration
+	logger    logrus.FieldLogger
+	values    map[string][]byte
+	modTime   time.Time
+	checked   time.Time
+	guard     *sync.RWMutex
+}
+
+func (source *lookupFileSource) get(key string) ([]byte, bool, error) {
+	source.guard.RLock()
+	needsCheck := time.Since(source.checked) >= source.reload
+	source.guard.RUnlock()
+
+	if needsCheck {
+		if err := source.load(); err != nil {
+			source.logger.Warning("Lookup failed to reload file: ", err)
+		}
+	}
+
+	source.guard.RLock()
+	defer source.guard.RUnlock()
+	value, found := source.values[key]
+	return value, found, nil
+}
+
+// load reads the file if it has been modified since it was read last.
+func (source *lookupFileSource) load() error {
+	source.guard.Lock()
+	defer source.guard.Unlock()
+
+	source.checked = time.Now()
+	info, err := os.Stat(source.path)
+	if err != nil {
+		return err
+	}
+	if source.values != nil && info.ModTime().Equal(source.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(source.path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string][]byte
+	if source.csv {
+		values, err = source.parseCSV(data)
+	} else {
+		values, err = source.parseJSON(data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %s", source.path, err)
+	}
+
+	source.values = values
+	source.modTime = info.ModTime()
+	return nil
+}
+
+func (source *lookupFileSource) parseCSV(data []byte) (map[string][]byte, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = source.delimiter
+	reader.FieldsPerRecord = -1
+
+	values := make(map[string][]byte)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			continue
+		}
+		values[record[0]] = []byte(record[1])
+	}
+}
+
+func (source *lookupFileSource) parseJSON(data []byte) (map[string][]byte, error) {
+	object := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(object))
+	for key, value := range object {
+		if text, isString := value.(string); isString {
+			values[key] = []byte(text)
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = encoded
+	}
+	return values, nil
+}
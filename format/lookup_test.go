@@ -0,0 +1,177 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func writeTestLookupFile(expect ttesting.Expect, content string) string {
+	file, err := ioutil.TempFile("", "gollum-lookup")
+	expect.NoError(err)
+	defer file.Close()
+
+	_, err = file.WriteString(content)
+	expect.NoError(err)
+	return file.Name()
+}
+
+func TestLookupJSONFile(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	path := writeTestLookupFile(expect, `{"web01":"frontend","db01":{"team":"storage"}}`)
+	defer os.Remove(path)
+
+	config := core.NewPluginConfig("", "format.Lookup")
+	config.Override("Field", "host")
+	config.Override("Target", "team")
+	config.Override("DropIfMissing", true)
+	config.Override("File/Path", path)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Lookup)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"host":"web01"}`), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("frontend", msg.GetMetadata().GetValueString("team"))
+	expect.Equal(`{"host":"web01"}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte(`{"host":"db01"}`), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"team":"storage"}`, msg.GetMetadata().GetValueString("team"))
+
+	msg = core.NewMessage(nil, []byte(`{"host":"unknown"}`), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NotNil(err)
+}
+
+func TestLookupCSVFile(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	path := writeTestLookupFile(expect, "web01;frontend\ndb01;storage\n")
+	defer os.Remove(path)
+
+	config := core.NewPluginConfig("", "format.Lookup")
+	config.Override("ApplyTo", "host")
+	config.Override("File/Path", path)
+	config.Override("File/Format", "csv")
+	config.Override("File/Delimiter", ";")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Lookup)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{"host": []byte("db01")}, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("storage", msg.GetMetadata().GetValueString("lookup"))
+
+	msg = core.NewMessage(nil, []byte("test"), core.Metadata{"host": []byte("unknown")}, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	_, exists := msg.GetMetadata().TryGetValue("lookup")
+	expect.False(exists)
+}
+
+func TestLookupHTTPCache(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if req.URL.Query().Get("id") != "a b" {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp.Write([]byte("found"))
+	}))
+	defer server.Close()
+
+	config := core.NewPluginConfig("", "format.Lookup")
+	config.Override("Source", "http")
+	config.Override("HTTP/URL", server.URL+"/?id={key}")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Lookup)
+	expect.True(casted)
+
+	for i := 0; i < 3; i++ {
+		msg := core.NewMessage(nil, []byte("a b"), nil, core.InvalidStreamID)
+		err := formatter.ApplyFormatter(msg)
+		expect.NoError(err)
+		expect.Equal("found", msg.GetMetadata().GetValueString("lookup"))
+
+		msg = core.NewMessage(nil, []byte("missing"), nil, core.InvalidStreamID)
+		err = formatter.ApplyFormatter(msg)
+		expect.NoError(err)
+		_, exists := msg.GetMetadata().TryGetValue("lookup")
+		expect.False(exists)
+	}
+
+	expect.Equal(int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestLookupHTTPTimeout(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		resp.Write([]byte("slow"))
+	}))
+	defer server.Close()
+
+	config := core.NewPluginConfig("", "format.Lookup")
+	config.Override("Source", "http")
+	config.Override("TimeoutMs", 10)
+	config.Override("DropIfMissing", true)
+	config.Override("HTTP/URL", server.URL+"/{key}")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Lookup)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("key"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	_, exists := msg.GetMetadata().TryGetValue("lookup")
+	expect.False(exists)
+
+	// The late result is cached for the following messages
+	time.Sleep(300 * time.Millisecond)
+	msg = core.NewMessage(nil, []byte("key"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("slow", msg.GetMetadata().GetValueString("lookup"))
+}
@@ -0,0 +1,224 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/trivago/gollum/core"
+)
+
+// MaxSize formatter
+//
+// This formatter protects sinks rejecting large records by limiting the size
+// of messages. Oversized content is either truncated or split into multiple
+// messages.
+//
+// When splitting, all chunks but the last one are sent as new messages, in
+// order, to the stream the message is currently routed to. The original
+// message keeps the last chunk, so chunks are processed in order. Each chunk
+// carries metadata to reassemble the content. As messages have to be routed
+// to a stream, splitting is only possible in producer modulators. The chunks
+// pass the router of the stream again, i.e. they are passed to all producers
+// of the stream.
+//
+// Parameters
+//
+// - MaxBytes: Defines the maximum size of the content in bytes.
+// By default this parameter is set to 1048576.
+//
+// - Mode: Defines how oversized content is handled. Valid values are
+// "truncate" and "split".
+// By default this parameter is set to "truncate".
+//
+// - KeepUTF8: When set to true, content is not cut in the middle of a
+// multi-byte UTF-8 character. Chunks may be a few bytes smaller than MaxBytes
+// in this case.
+// By default this parameter is set to true.
+//
+// - SizeTarget: Defines the metadata field the original size of oversized
+// content is stored in. If empty, the size is not stored.
+// By default this parameter is set to "original_size".
+//
+// - Truncate/Marker: Defines the string appended to truncated content. The
+// marker counts towards MaxBytes.
+// By default this parameter is set to "...[truncated]".
+//
+// - Split/IDTarget: Defines the metadata field storing a random id shared by
+// all chunks of a message.
+// By default this parameter is set to "chunk_id".
+//
+// - Split/IndexTarget: Defines the metadata field storing the index of a
+// chunk starting at 0.
+// By default this parameter is set to "chunk_index".
+//
+// - Split/CountTarget: Defines the metadata field storing the number of
+// chunks of a message.
+// By default this parameter is set to "chunk_count".
+//
+// Examples
+//
+// This example splits messages larger than 900 KB before they are sent:
+//
+//  exampleProducer:
+//    Type: producer.AwsKinesis
+//    Streams: logs
+//    Modulators:
+//      - format.MaxSize:
+//        MaxBytes: 900000
+//        Mode: split
+type MaxSize struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	maxBytes             int    `config:"MaxBytes" default:"1048576"`
+	keepUTF8             bool   `config:"KeepUTF8" default:"true"`
+	sizeTarget           string `config:"SizeTarget" default:"original_size"`
+	marker               []byte `config:"Truncate/Marker" default:"...[truncated]"`
+	idTarget             string `config:"Split/IDTarget" default:"chunk_id"`
+	indexTarget          string `config:"Split/IndexTarget" default:"chunk_index"`
+	countTarget          string `config:"Split/CountTarget" default:"chunk_count"`
+	split                bool
+}
+
+func init() {
+	core.TypeRegistry.Register(MaxSize{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *MaxSize) Configure(conf core.PluginConfigReader) {
+	switch mode := strings.ToLower(conf.GetString("Mode", "truncate")); mode {
+	case "truncate":
+		if len(format.marker) >= format.maxBytes {
+			conf.Errors.Pushf("Truncate/Marker must be smaller than MaxBytes")
+		}
+	case "split":
+		format.split = true
+	default:
+		conf.Errors.Pushf("Unknown mode '%s'", mode)
+	}
+
+	if format.maxBytes <= 0 {
+		conf.Errors.Pushf("MaxBytes must be greater than 0")
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *MaxSize) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+	if len(content) <= format.maxBytes {
+		return nil
+	}
+
+	if !format.split {
+		format.truncate(msg, content)
+		return nil
+	}
+
+	if msg.GetStreamID() == core.InvalidStreamID {
+		return fmt.Errorf("MaxSize can only split messages routed to a stream")
+	}
+
+	chunks, err := format.splitMessage(msg, content)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := core.Route(chunk, chunk.GetRouter()); err != nil {
+			format.Logger.Warning("MaxSize failed to route a chunk: ", err)
+		}
+	}
+	return nil
+}
+
+// RequiresStream returns true if messages are split, as chunks are sent to
+// the stream of the message.
+func (format *MaxSize) RequiresStream() bool {
+	return format.split
+}
+
+func (format *MaxSize) truncate(msg *core.Message, content []byte) {
+	if format.sizeTarget != "" {
+		msg.GetMetadata().SetValue(format.sizeTarget, []byte(strconv.Itoa(len(content))))
+	}
+
+	size := format.cutIndex(content, format.maxBytes-len(format.marker))
+	truncated := make([]byte, 0, size+len(format.marker))
+	truncated = append(truncated, content[:size]...)
+	truncated = append(truncated, format.marker...)
+	format.SetAppliedContent(msg, truncated)
+}
+
+// splitMessage stores the last chunk in msg and returns new messages for
+// all previous chunks.
+func (format *MaxSize) splitMessage(msg *core.Message, content []byte) ([]*core.Message, error) {
+	originalSize := []byte(strconv.Itoa(len(content)))
+	parts := [][]byte{}
+	for len(content) > 0 {
+		size := format.cutIndex(content, format.maxBytes)
+		parts = append(parts, content[:size])
+		content = content[size:]
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	chunkID := []byte(hex.EncodeToString(id))
+	count := []byte(strconv.Itoa(len(parts)))
+
+	metadata := msg.GetMetadata()
+	if format.sizeTarget != "" {
+		metadata.SetValue(format.sizeTarget, originalSize)
+	}
+	metadata.SetValue(format.idTarget, chunkID)
+	metadata.SetValue(format.countTarget, count)
+
+	last := len(parts) - 1
+	chunks := make([]*core.Message, 0, last)
+	for i, part := range parts[:last] {
+		// Metadata is shared between clones so a new message is created
+		chunk := core.NewMessage(msg.GetSource(), msg.GetPayload(), metadata.Clone(), msg.GetStreamID())
+		chunk.SetCreationTime(msg.GetCreationTime())
+		chunk.GetMetadata().SetValue(format.indexTarget, []byte(strconv.Itoa(i)))
+		format.SetAppliedContent(chunk, append([]byte(nil), part...))
+		chunks = append(chunks, chunk)
+	}
+
+	metadata.SetValue(format.indexTarget, []byte(strconv.Itoa(last)))
+	format.SetAppliedContent(msg, append([]byte(nil), parts[last]...))
+	return chunks, nil
+}
+
+// cutIndex returns the number of bytes of content to keep so that the
+// result is not larger than limit.
+func (format *MaxSize) cutIndex(content []byte, limit int) int {
+	if limit >= len(content) {
+		return len(content)
+	}
+	if !format.keepUTF8 {
+		return limit
+	}
+
+	for size := limit; size > 0 && size > limit-utf8.UTFMax; size-- {
+		if utf8.RuneStart(content[size]) {
+			return size
+		}
+	}
+	return limit
+}
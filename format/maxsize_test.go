@@ -0,0 +1,130 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestMaxSizeTruncate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.MaxSize")
+	config.Override("MaxBytes", 10)
+	config.Override("Truncate/Marker", "...")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*MaxSize)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("0123456789"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("0123456789", msg.String())
+	_, exists := msg.GetMetadata().TryGetValue("original_size")
+	expect.False(exists)
+
+	msg = core.NewMessage(nil, []byte("0123456789abc"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("0123456...", msg.String())
+	expect.Equal("13", msg.GetMetadata().GetValueString("original_size"))
+}
+
+func TestMaxSizeTruncateUTF8(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.MaxSize")
+	config.Override("MaxBytes", 6)
+	config.Override("Truncate/Marker", "")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*MaxSize)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("aaaaaäb"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("aaaaa", msg.String())
+}
+
+type mockMaxSizeRouter struct {
+	core.SimpleRouter
+	messages []*core.Message
+}
+
+func (router *mockMaxSizeRouter) Enqueue(msg *core.Message) error {
+	router.messages = append(router.messages, msg)
+	return nil
+}
+
+func (router *mockMaxSizeRouter) Start() error {
+	return nil
+}
+
+func TestMaxSizeSplit(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.MaxSize")
+	config.Override("MaxBytes", 4)
+	config.Override("Mode", "split")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*MaxSize)
+	expect.True(casted)
+
+	expect.True(formatter.RequiresStream())
+
+	router := &mockMaxSizeRouter{}
+	streamID := core.StreamRegistry.GetStreamID("maxSizeSplit")
+	core.StreamRegistry.Register(router, streamID)
+
+	msg := core.NewMessage(nil, []byte("0123456789"), core.Metadata{"key": []byte("value")}, streamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+
+	// The original message is passed on after the formatter, so it has to
+	// hold the last chunk
+	received := append(router.messages, msg)
+	expect.Equal(3, len(received))
+
+	chunkID := msg.GetMetadata().GetValueString("chunk_id")
+	expect.Equal(16, len(chunkID))
+
+	expected := []string{"0123", "4567", "89"}
+	for i, chunk := range received {
+		metadata := chunk.GetMetadata()
+		expect.Equal(expected[i], chunk.String())
+		expect.Equal(string('0'+rune(i)), metadata.GetValueString("chunk_index"))
+		expect.Equal("3", metadata.GetValueString("chunk_count"))
+		expect.Equal("10", metadata.GetValueString("original_size"))
+		expect.Equal(chunkID, metadata.GetValueString("chunk_id"))
+		expect.Equal("value", metadata.GetValueString("key"))
+		expect.Equal(msg.GetCreationTime(), chunk.GetCreationTime())
+		expect.Equal(streamID, chunk.GetStreamID())
+	}
+
+	// Messages not routed to a stream cannot be split
+	msg = core.NewMessage(nil, []byte("0123456789"), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
@@ -0,0 +1,285 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+// MessageEnvelope formatter
+//
+// This formatter wraps the payload, metadata, stream name and creation time
+// of a message into a single JSON or MessagePack document, e.g. to store
+// metadata in files. The matching unwrap mode restores payload, metadata and
+// creation time from such a document. Unlike format.Serialize, the document
+// can be read by other tools.
+//
+// A wrapped message looks like this:
+//
+//  {"metadata":{"key":"value"},"payload":"data","stream":"name","timestamp":"2018-03-04T05:06:07.123Z"}
+//
+// Parameters
+//
+// - Mode: Defines the direction. Set to "wrap" to create a document or to
+// "unwrap" to restore a message from a document.
+// By default this parameter is set to "wrap".
+//
+// - Encoding: Defines the encoding of the document. Can be "json" or
+// "msgpack".
+// By default this parameter is set to "json".
+//
+// - Metadata: Defines the metadata keys to wrap. If empty, all metadata keys
+// are wrapped.
+// By default this parameter is set to an empty list.
+//
+// - EmbedJSON: When set to true, payloads that are valid JSON are embedded as
+// JSON value instead of a string. Unwrapping restores them as JSON text.
+// By default this parameter is set to false.
+//
+// - PayloadField: Defines the field holding the payload.
+// By default this parameter is set to "payload".
+//
+// - MetadataField: Defines the field holding the metadata. Set to "" to not
+// wrap or unwrap metadata.
+// By default this parameter is set to "metadata".
+//
+// - StreamField: Defines the field holding the stream name. Set to "" to not
+// wrap the stream name.
+// By default this parameter is set to "stream".
+//
+// - TimestampField: Defines the field holding the creation time of the
+// message in RFC3339 format. Set to "" to not wrap or unwrap the creation
+// time.
+// By default this parameter is set to "timestamp".
+//
+// - RestoreStream: When set to true, unwrapping routes the message to the
+// stream stored in the document.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example writes messages including their metadata to a file:
+//
+//  exampleProducer:
+//    Type: producer.File
+//    Streams: "*"
+//    File: /var/log/gollum/messages.log
+//    Modulators:
+//      - format.MessageEnvelope:
+//        EmbedJSON: true
+//      - format.Envelope:
+//        Postfix: "\n"
+//
+// This example restores messages written by the example above:
+//
+//  exampleConsumer:
+//    Type: consumer.File
+//    Streams: replay
+//    File: /var/log/gollum/messages.log
+//    Modulators:
+//      - format.MessageEnvelope:
+//        Mode: unwrap
+type MessageEnvelope struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	unwrap               bool
+	msgpack              bool
+	metadataKeys         []string `config:"Metadata"`
+	embedJSON            bool     `config:"EmbedJSON" default:"false"`
+	payloadField         string   `config:"PayloadField" default:"payload"`
+	metadataField        string   `config:"MetadataField" default:"metadata"`
+	streamField          string   `config:"StreamField" default:"stream"`
+	timestampField       string   `config:"TimestampField" default:"timestamp"`
+	restoreStream        bool     `config:"RestoreStream" default:"false"`
+}
+
+func init() {
+	core.TypeRegistry.Register(MessageEnvelope{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *MessageEnvelope) Configure(conf core.PluginConfigReader) {
+	switch mode := strings.ToLower(conf.GetString("Mode", "wrap")); mode {
+	case "wrap":
+	case "unwrap":
+		format.unwrap = true
+	default:
+		conf.Errors.Pushf("Unknown mode '%s'", mode)
+	}
+
+	switch encoding := strings.ToLower(conf.GetString("Encoding", "json")); encoding {
+	case "json":
+	case "msgpack":
+		format.msgpack = true
+	default:
+		conf.Errors.Pushf("Unknown encoding '%s'", encoding)
+	}
+
+	if format.payloadField == "" {
+		conf.Errors.Pushf("PayloadField must not be empty")
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *MessageEnvelope) ApplyFormatter(msg *core.Message) error {
+	if format.unwrap {
+		return format.unwrapMessage(msg)
+	}
+	return format.wrapMessage(msg)
+}
+
+func (format *MessageEnvelope) wrapMessage(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+	document := make(map[string]interface{})
+
+	document[format.payloadField] = string(content)
+	if format.embedJSON {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err == nil && !decoder.More() {
+			document[format.payloadField] = value
+		}
+	}
+
+	if format.metadataField != "" {
+		metadata := make(map[string]interface{})
+		if msgMetadata := msg.TryGetMetadata(); msgMetadata != nil {
+			if len(format.metadataKeys) == 0 {
+				for key, value := range msgMetadata {
+					metadata[key] = string(value)
+				}
+			} else {
+				for _, key := range format.metadataKeys {
+					if value, exists := msgMetadata.TryGetValue(key); exists {
+						metadata[key] = string(value)
+					}
+				}
+			}
+		}
+		document[format.metadataField] = metadata
+	}
+
+	if format.streamField != "" {
+		document[format.streamField] = core.StreamRegistry.GetStreamName(msg.GetStreamID())
+	}
+	if format.timestampField != "" {
+		document[format.timestampField] = msg.GetCreationTime().UTC().Format(time.RFC3339Nano)
+	}
+
+	var data []byte
+	var err error
+	if format.msgpack {
+		data, err = msgpackEncode(nil, document)
+	} else {
+		data, err = json.Marshal(document)
+	}
+	if err != nil {
+		format.Logger.Warning("MessageEnvelope failed to encode a message: ", err)
+		return err
+	}
+
+	format.SetAppliedContent(msg, data)
+	return nil
+}
+
+func (format *MessageEnvelope) unwrapMessage(msg *core.Message) error {
+	document, err := format.decode(format.GetAppliedContent(msg))
+	if err != nil {
+		format.Logger.Warning("MessageEnvelope failed to decode a message: ", err)
+		return err
+	}
+
+	payload, exists := document[format.payloadField]
+	if !exists {
+		err := fmt.Errorf("field %s not found", format.payloadField)
+		format.Logger.Warning("MessageEnvelope failed to unwrap a message: ", err)
+		return err
+	}
+
+	if format.timestampField != "" {
+		if text, isString := document[format.timestampField].(string); isString {
+			timestamp, err := time.Parse(time.RFC3339Nano, text)
+			if err != nil {
+				format.Logger.Warning("MessageEnvelope failed to parse a timestamp: ", err)
+				return err
+			}
+			msg.SetCreationTime(timestamp)
+		}
+	}
+
+	if format.metadataField != "" {
+		if values, isMap := document[format.metadataField].(map[string]interface{}); isMap && len(values) > 0 {
+			metadata := msg.GetMetadata()
+			for key, value := range values {
+				metadata.SetValue(key, messageEnvelopeToBytes(value))
+			}
+		}
+	}
+
+	if format.restoreStream && format.streamField != "" {
+		if name, isString := document[format.streamField].(string); isString && name != "" {
+			msg.SetStreamID(core.GetStreamID(name))
+		}
+	}
+
+	format.SetAppliedContent(msg, messageEnvelopeToBytes(payload))
+	return nil
+}
+
+func (format *MessageEnvelope) decode(data []byte) (map[string]interface{}, error) {
+	var value interface{}
+	if format.msgpack {
+		var remain []byte
+		var err error
+		if value, remain, err = msgpackDecode(data, 0); err != nil {
+			return nil, err
+		}
+		if len(remain) > 0 {
+			return nil, fmt.Errorf("%d bytes of trailing data", len(remain))
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+	}
+
+	document, isMap := value.(map[string]interface{})
+	if !isMap {
+		return nil, fmt.Errorf("document is not an object")
+	}
+	return document, nil
+}
+
+// messageEnvelopeToBytes converts strings and binary data to bytes. All other
+// values are converted to JSON.
+func messageEnvelopeToBytes(value interface{}) []byte {
+	switch typedValue := value.(type) {
+	case string:
+		return []byte(typedValue)
+	case []byte:
+		return typedValue
+	default:
+		data, _ := json.Marshal(value)
+		return data
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestMessageEnvelopeWrap(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.MessageEnvelope")
+	config.Override("Metadata", []interface{}{"key", "missing"})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*MessageEnvelope)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("data"), core.Metadata{"key": []byte("value"), "other": []byte("x")}, core.GetStreamID("test"))
+	msg.SetCreationTime(time.Date(2018, 3, 4, 5, 6, 7, 123000000, time.UTC))
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"metadata":{"key":"value"},"payload":"data","stream":"test","timestamp":"2018-03-04T05:06:07.123Z"}`, msg.String())
+}
+
+func TestMessageEnvelopeEmbedJSON(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.MessageEnvelope")
+	config.Override("EmbedJSON", true)
+	config.Override("StreamField", "")
+	config.Override("TimestampField", "")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*MessageEnvelope)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"id":12345678901234567890}`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"metadata":{},"payload":{"id":12345678901234567890}}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte(`{"id":1} trailing`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"metadata":{},"payload":"{\"id\":1} trailing"}`, msg.String())
+}
+
+func TestMessageEnvelopeRoundtrip(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	for _, encoding := range []string{"json", "msgpack"} {
+		config := core.NewPluginConfig("", "format.MessageEnvelope")
+		config.Override("Encoding", encoding)
+
+		plugin, err := core.NewPluginWithConfig(config)
+		expect.NoError(err)
+
+		wrap, casted := plugin.(*MessageEnvelope)
+		expect.True(casted)
+
+		config = core.NewPluginConfig("", "format.MessageEnvelope")
+		config.Override("Encoding", encoding)
+		config.Override("Mode", "unwrap")
+		config.Override("RestoreStream", true)
+
+		plugin, err = core.NewPluginWithConfig(config)
+		expect.NoError(err)
+
+		unwrap, casted := plugin.(*MessageEnvelope)
+		expect.True(casted)
+
+		timestamp := time.Date(2018, 3, 4, 5, 6, 7, 123456789, time.UTC)
+		msg := core.NewMessage(nil, []byte("data\n"), core.Metadata{"key": []byte("value")}, core.GetStreamID("original"))
+		msg.SetCreationTime(timestamp)
+		expect.NoError(wrap.ApplyFormatter(msg))
+
+		restored := core.NewMessage(nil, msg.GetPayload(), nil, core.GetStreamID("other"))
+		expect.NoError(unwrap.ApplyFormatter(restored))
+		expect.Equal("data\n", restored.String())
+		expect.Equal("value", restored.GetMetadata().GetValueString("key"))
+		expect.Equal(core.GetStreamID("original"), restored.GetStreamID())
+		expect.True(timestamp.Equal(restored.GetCreationTime()))
+	}
+}
+
+func TestMessageEnvelopeUnwrapErrors(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.MessageEnvelope")
+	config.Override("Mode", "unwrap")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*MessageEnvelope)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"payload":{"a":1}}`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"a":1}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte(`{"data":"x"}`), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+
+	msg = core.NewMessage(nil, []byte(`["payload"]`), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+
+	msg = core.NewMessage(nil, []byte(`{"payload":"x","timestamp":"yesterday"}`), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
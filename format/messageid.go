@@ -0,0 +1,306 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+const (
+	messageIDCrockford     = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	messageIDSnowflakeSeq  = 1<<12 - 1
+	messageIDSnowflakeNode = 1<<10 - 1
+)
+
+// MessageID formatter
+//
+// This formatter generates a unique ID for each message and stores it in a
+// metadata field. Optionally the ID is added to the content, too. Downstream
+// systems can use the ID to detect duplicates, e.g. when a message is sent
+// again after a failed delivery.
+//
+// Parameters
+//
+// - Generator: Defines the type of ID to generate.
+// By default this parameter is set to "uuid4".
+//
+//  - uuid4: A random UUID as defined by RFC 4122.
+//
+//  - uuid7: A UUID starting with the current unix time in milliseconds.
+//  These IDs are sortable by time.
+//
+//  - ulid: A 26 character ULID as defined by https://github.com/ulid/spec.
+//  IDs generated by the same formatter within one millisecond are
+//  monotonically increasing.
+//
+//  - snowflake: A 64 bit number holding 41 bits of milliseconds since Epoch,
+//  10 bits of NodeID and a 12 bit sequence number. Up to 4096 IDs per
+//  millisecond can be generated per node.
+//
+// - Target: Defines the metadata field the ID is written to.
+// By default this parameter is set to "id".
+//
+// - Payload: Defines how the ID is added to the content. "none" does not
+// change the content. "prefix" adds the ID and Separator in front of the
+// content. "json" adds the ID as field PayloadField to a JSON object.
+// By default this parameter is set to "none".
+//
+// - Separator: Defines the separator placed between ID and content when
+// Payload is set to "prefix".
+// By default this parameter is set to ":".
+//
+// - PayloadField: Defines the JSON field the ID is written to when Payload
+// is set to "json".
+// By default this parameter is set to "id".
+//
+// - NodeID: Defines the node ID used by the snowflake generator. Each gollum
+// instance generating snowflake IDs for the same system requires a unique
+// node ID between 0 and 1023.
+// By default this parameter is set to 0.
+//
+// - Epoch: Defines the unix time in milliseconds snowflake IDs are relative
+// to.
+// By default this parameter is set to 1288834974657.
+//
+// Examples
+//
+// This example adds a ULID to the metadata field "event_id" and to the JSON
+// content of each message:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.MessageID:
+//        Generator: ulid
+//        Target: event_id
+//        Payload: json
+//        PayloadField: event_id
+type MessageID struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	target               string `config:"Target" default:"id"`
+	separator            []byte `config:"Separator" default:":"`
+	payloadField         string `config:"PayloadField" default:"id"`
+	nodeID               int64  `config:"NodeID" default:"0"`
+	epoch                int64  `config:"Epoch" default:"1288834974657"`
+	payload              string
+	generate             func() ([]byte, error)
+	now                  func() time.Time
+	lastTime             int64
+	lastSeq              int64
+	lastULID             [16]byte
+	guard                *sync.Mutex
+}
+
+func init() {
+	core.TypeRegistry.Register(MessageID{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *MessageID) Configure(conf core.PluginConfigReader) {
+	format.guard = new(sync.Mutex)
+	format.now = time.Now
+
+	switch generator := strings.ToLower(conf.GetString("Generator", "uuid4")); generator {
+	case "uuid4":
+		format.generate = format.uuid4
+	case "uuid7":
+		format.generate = format.uuid7
+	case "ulid":
+		format.generate = format.ulid
+	case "snowflake":
+		if format.nodeID < 0 || format.nodeID > messageIDSnowflakeNode {
+			conf.Errors.Pushf("NodeID must be between 0 and %d", messageIDSnowflakeNode)
+		}
+		format.generate = format.snowflake
+	default:
+		conf.Errors.Pushf("Unknown generator '%s'", generator)
+	}
+
+	format.payload = strings.ToLower(conf.GetString("Payload", "none"))
+	switch format.payload {
+	case "none", "prefix", "json":
+	default:
+		conf.Errors.Pushf("Unknown payload mode '%s'", format.payload)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *MessageID) ApplyFormatter(msg *core.Message) error {
+	id, err := format.generate()
+	if err != nil {
+		return err
+	}
+
+	switch format.payload {
+	case "prefix":
+		content := format.GetAppliedContent(msg)
+		payload := make([]byte, 0, len(id)+len(format.separator)+len(content))
+		payload = append(payload, id...)
+		payload = append(payload, format.separator...)
+		format.SetAppliedContent(msg, append(payload, content...))
+
+	case "json":
+		values := make(map[string]interface{})
+		if err := json.Unmarshal(format.GetAppliedContent(msg), &values); err != nil {
+			format.Logger.Warning("MessageID failed to parse JSON: ", err)
+			break
+		}
+		values[format.payloadField] = string(id)
+		payload, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		format.SetAppliedContent(msg, payload)
+	}
+
+	msg.GetMetadata().SetValue(format.target, id)
+	return nil
+}
+
+func (format *MessageID) uuid4() ([]byte, error) {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		return nil, err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return messageIDFormatUUID(uuid), nil
+}
+
+func (format *MessageID) uuid7() ([]byte, error) {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[6:]); err != nil {
+		return nil, err
+	}
+	messageIDPutMillis(uuid[:6], format.now())
+	uuid[6] = uuid[6]&0x0f | 0x70
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return messageIDFormatUUID(uuid), nil
+}
+
+func (format *MessageID) ulid() ([]byte, error) {
+	format.guard.Lock()
+	defer format.guard.Unlock()
+
+	var id [16]byte
+	now := format.now()
+	millis := now.UnixNano() / int64(time.Millisecond)
+	messageIDPutMillis(id[:6], now)
+
+	if millis <= format.lastTime && messageIDIncrement(format.lastULID[6:]) {
+		// Keep IDs of the same millisecond ordered by incrementing the random
+		// part of the previous ID.
+		copy(id[:], format.lastULID[:])
+	} else {
+		if _, err := rand.Read(id[6:]); err != nil {
+			return nil, err
+		}
+		format.lastTime = millis
+	}
+	format.lastULID = id
+
+	return messageIDEncodeULID(id), nil
+}
+
+func (format *MessageID) snowflake() ([]byte, error) {
+	format.guard.Lock()
+	defer format.guard.Unlock()
+
+	millis := format.now().UnixNano()/int64(time.Millisecond) - format.epoch
+	if millis < format.lastTime {
+		// The clock went backwards, continue with the last known time.
+		millis = format.lastTime
+	}
+
+	if millis == format.lastTime {
+		format.lastSeq = (format.lastSeq + 1) & messageIDSnowflakeSeq
+		if format.lastSeq == 0 {
+			// All sequence numbers of this millisecond are used.
+			for millis <= format.lastTime {
+				time.Sleep(100 * time.Microsecond)
+				millis = format.now().UnixNano()/int64(time.Millisecond) - format.epoch
+			}
+		}
+	} else {
+		format.lastSeq = 0
+	}
+	format.lastTime = millis
+
+	id := millis<<22 | format.nodeID<<12 | format.lastSeq
+	return []byte(strconv.FormatInt(id, 10)), nil
+}
+
+// messageIDPutMillis writes the unix time in milliseconds as 48 bit big
+// endian number to the given buffer.
+func messageIDPutMillis(buffer []byte, now time.Time) {
+	millis := uint64(now.UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		buffer[i] = byte(millis)
+		millis >>= 8
+	}
+}
+
+// messageIDIncrement increments the given big endian number by one and
+// returns false if it overflows.
+func messageIDIncrement(number []byte) bool {
+	for i := len(number) - 1; i >= 0; i-- {
+		number[i]++
+		if number[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func messageIDFormatUUID(uuid [16]byte) []byte {
+	text := make([]byte, 36)
+	hex.Encode(text[0:8], uuid[0:4])
+	text[8] = '-'
+	hex.Encode(text[9:13], uuid[4:6])
+	text[13] = '-'
+	hex.Encode(text[14:18], uuid[6:8])
+	text[18] = '-'
+	hex.Encode(text[19:23], uuid[8:10])
+	text[23] = '-'
+	hex.Encode(text[24:], uuid[10:])
+	return text
+}
+
+// messageIDEncodeULID encodes 128 bits as 26 characters of Crockford's
+// base32. The first character holds the 3 most significant bits.
+func messageIDEncodeULID(id [16]byte) []byte {
+	text := make([]byte, 0, 26)
+	text = append(text, messageIDCrockford[id[0]>>5])
+
+	value, bits := uint16(id[0]&0x1f), uint(5)
+	for _, b := range id[1:] {
+		value = value<<8 | uint16(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			text = append(text, messageIDCrockford[(value>>bits)&0x1f])
+		}
+	}
+	return text
+}
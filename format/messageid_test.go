@@ -0,0 +1,129 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestMessageIDUUID(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	uuid4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	uuid7 := regexp.MustCompile(`^0174876e-8000-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	config := core.NewPluginConfig("", "format.MessageID")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*MessageID)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.True(uuid4.MatchString(msg.GetMetadata().GetValueString("id")))
+	expect.Equal("test", msg.String())
+
+	config = core.NewPluginConfig("", "format.MessageID")
+	config.Override("Generator", "uuid7")
+	config.Override("Payload", "prefix")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted = plugin.(*MessageID)
+	expect.True(casted)
+
+	formatter.now = func() time.Time { return time.Unix(1600000000, 0) }
+
+	msg = core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	id := msg.GetMetadata().GetValueString("id")
+	expect.True(uuid7.MatchString(id))
+	expect.Equal(id+":test", msg.String())
+}
+
+func TestMessageIDULID(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.MessageID")
+	config.Override("Generator", "ulid")
+	config.Override("Target", "event_id")
+	config.Override("Payload", "json")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*MessageID)
+	expect.True(casted)
+
+	formatter.now = func() time.Time { return time.Unix(1600000000, 0) }
+
+	msg := core.NewMessage(nil, []byte(`{"a":1}`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	first := msg.GetMetadata().GetValueString("event_id")
+	expect.Equal(26, len(first))
+	expect.Equal("01EJ3PX000", first[:10])
+	expect.Equal(`{"a":1,"id":"`+first+`"}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte(`{"a":1}`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	second := msg.GetMetadata().GetValueString("event_id")
+	expect.True(first < second)
+}
+
+func TestMessageIDSnowflake(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.MessageID")
+	config.Override("Generator", "snowflake")
+	config.Override("NodeID", 5)
+	config.Override("Epoch", 0)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*MessageID)
+	expect.True(casted)
+
+	now := time.Unix(1600000000, 0)
+	formatter.now = func() time.Time { return now }
+
+	ids := make([]int64, 3)
+	for i := range ids {
+		msg := core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+		expect.NoError(formatter.ApplyFormatter(msg))
+		id, err := strconv.ParseInt(msg.GetMetadata().GetValueString("id"), 10, 64)
+		expect.NoError(err)
+		ids[i] = id
+	}
+
+	expect.Equal(int64(1600000000000), ids[0]>>22)
+	expect.Equal(int64(5), ids[0]>>12&0x3ff)
+	expect.Equal(int64(0), ids[0]&0xfff)
+	expect.Equal(ids[0]+1, ids[1])
+	expect.Equal(ids[1]+1, ids[2])
+
+	now = now.Add(-time.Second)
+	msg := core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(strconv.FormatInt(ids[2]+1, 10), msg.GetMetadata().GetValueString("id"))
+}
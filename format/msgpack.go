@@ -0,0 +1,465 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+// msgpackMaxDepth limits the nesting of decoded arrays and maps.
+const msgpackMaxDepth = 256
+
+// Msgpack formatter
+//
+// This formatter converts between MessagePack and JSON. When decoding, binary
+// values are written as base64 encoded strings, map keys are converted to
+// strings and timestamps are written in RFC3339 format. Other extension types
+// are written as an object with the fields "type" and "data", the latter
+// being base64 encoded.
+//
+// Parameters
+//
+// - Mode: Defines the conversion direction. Set to "decode" to convert
+// MessagePack to JSON or to "encode" to convert JSON to MessagePack.
+// By default this parameter is set to "decode".
+//
+// Examples
+//
+// This example converts MessagePack encoded messages read from kafka to JSON:
+//
+//  exampleConsumer:
+//    Type: consumer.Kafka
+//    Streams: "*"
+//    Topic: agent-logs
+//    Modulators:
+//      - format.Msgpack:
+//        Mode: decode
+type Msgpack struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	encode               bool
+}
+
+func init() {
+	core.TypeRegistry.Register(Msgpack{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Msgpack) Configure(conf core.PluginConfigReader) {
+	switch mode := strings.ToLower(conf.GetString("Mode", "decode")); mode {
+	case "decode":
+	case "encode":
+		format.encode = true
+	default:
+		conf.Errors.Pushf("Unknown mode '%s'", mode)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Msgpack) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+
+	if format.encode {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			format.Logger.Warning("Msgpack failed to unmarshal a message: ", err)
+			return err
+		}
+
+		data, err := msgpackEncode(nil, value)
+		if err != nil {
+			format.Logger.Warning("Msgpack failed to encode a message: ", err)
+			return err
+		}
+		format.SetAppliedContent(msg, data)
+		return nil
+	}
+
+	value, remain, err := msgpackDecode(content, 0)
+	if err == nil && len(remain) > 0 {
+		err = fmt.Errorf("%d bytes of trailing data", len(remain))
+	}
+	if err != nil {
+		format.Logger.Warning("Msgpack failed to decode a message: ", err)
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		format.Logger.Warning("Msgpack failed to marshal a message: ", err)
+		return err
+	}
+	format.SetAppliedContent(msg, data)
+	return nil
+}
+
+// msgpackEncode appends the MessagePack encoding of a decoded JSON value to
+// the given buffer.
+func msgpackEncode(buffer []byte, value interface{}) ([]byte, error) {
+	switch typedValue := value.(type) {
+	case nil:
+		return append(buffer, 0xc0), nil
+
+	case bool:
+		if typedValue {
+			return append(buffer, 0xc3), nil
+		}
+		return append(buffer, 0xc2), nil
+
+	case json.Number:
+		if intValue, err := typedValue.Int64(); err == nil {
+			return msgpackEncodeInt(buffer, intValue), nil
+		}
+		if uintValue, err := strconv.ParseUint(typedValue.String(), 10, 64); err == nil {
+			return msgpackEncodeUint(buffer, uintValue), nil
+		}
+		floatValue, err := typedValue.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return msgpackEncodeFloat(buffer, floatValue), nil
+
+	case string:
+		length := len(typedValue)
+		switch {
+		case length < 32:
+			buffer = append(buffer, 0xa0|byte(length))
+		case length <= math.MaxUint8:
+			buffer = append(buffer, 0xd9, byte(length))
+		case length <= math.MaxUint16:
+			buffer = append(buffer, 0xda, 0, 0)
+			binary.BigEndian.PutUint16(buffer[len(buffer)-2:], uint16(length))
+		default:
+			buffer = append(buffer, 0xdb, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(buffer[len(buffer)-4:], uint32(length))
+		}
+		return append(buffer, typedValue...), nil
+
+	case []interface{}:
+		buffer = msgpackEncodeHeader(buffer, len(typedValue), 0x90, 0xdc)
+		for _, item := range typedValue {
+			var err error
+			if buffer, err = msgpackEncode(buffer, item); err != nil {
+				return nil, err
+			}
+		}
+		return buffer, nil
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(typedValue))
+		for key := range typedValue {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buffer = msgpackEncodeHeader(buffer, len(typedValue), 0x80, 0xde)
+		for _, key := range keys {
+			var err error
+			if buffer, err = msgpackEncode(buffer, key); err != nil {
+				return nil, err
+			}
+			if buffer, err = msgpackEncode(buffer, typedValue[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buffer, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported type %T", value)
+	}
+}
+
+// msgpackEncodeHeader writes the header of an array or map. The 32-bit
+// variant directly follows the 16-bit variant.
+func msgpackEncodeHeader(buffer []byte, length int, fixPrefix, prefix16 byte) []byte {
+	switch {
+	case length < 16:
+		return append(buffer, fixPrefix|byte(length))
+	case length <= math.MaxUint16:
+		buffer = append(buffer, prefix16, 0, 0)
+		binary.BigEndian.PutUint16(buffer[len(buffer)-2:], uint16(length))
+		return buffer
+	default:
+		buffer = append(buffer, prefix16+1, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buffer[len(buffer)-4:], uint32(length))
+		return buffer
+	}
+}
+
+func msgpackEncodeInt(buffer []byte, value int64) []byte {
+	switch {
+	case value >= 0:
+		return msgpackEncodeUint(buffer, uint64(value))
+	case value >= -32:
+		return append(buffer, byte(value))
+	case value >= math.MinInt8:
+		return append(buffer, 0xd0, byte(value))
+	case value >= math.MinInt16:
+		buffer = append(buffer, 0xd1, 0, 0)
+		binary.BigEndian.PutUint16(buffer[len(buffer)-2:], uint16(value))
+		return buffer
+	case value >= math.MinInt32:
+		buffer = append(buffer, 0xd2, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buffer[len(buffer)-4:], uint32(value))
+		return buffer
+	default:
+		buffer = append(buffer, 0xd3, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buffer[len(buffer)-8:], uint64(value))
+		return buffer
+	}
+}
+
+func msgpackEncodeUint(buffer []byte, value uint64) []byte {
+	switch {
+	case value < 128:
+		return append(buffer, byte(value))
+	case value <= math.MaxUint8:
+		return append(buffer, 0xcc, byte(value))
+	case value <= math.MaxUint16:
+		buffer = append(buffer, 0xcd, 0, 0)
+		binary.BigEndian.PutUint16(buffer[len(buffer)-2:], uint16(value))
+		return buffer
+	case value <= math.MaxUint32:
+		buffer = append(buffer, 0xce, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buffer[len(buffer)-4:], uint32(value))
+		return buffer
+	default:
+		buffer = append(buffer, 0xcf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buffer[len(buffer)-8:], value)
+		return buffer
+	}
+}
+
+func msgpackEncodeFloat(buffer []byte, value float64) []byte {
+	buffer = append(buffer, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(buffer[len(buffer)-8:], math.Float64bits(value))
+	return buffer
+}
+
+// msgpackDecode decodes the first MessagePack value of the given data and
+// returns the remaining data.
+func msgpackDecode(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+	if depth > msgpackMaxDepth {
+		return nil, nil, fmt.Errorf("maximum nesting depth exceeded")
+	}
+
+	prefix, data := data[0], data[1:]
+	switch {
+	case prefix <= 0x7f:
+		return int64(prefix), data, nil
+	case prefix >= 0xe0:
+		return int64(int8(prefix)), data, nil
+	case prefix&0xf0 == 0x80:
+		return msgpackDecodeMap(data, int(prefix&0x0f), depth)
+	case prefix&0xf0 == 0x90:
+		return msgpackDecodeArray(data, int(prefix&0x0f), depth)
+	case prefix&0xe0 == 0xa0:
+		return msgpackDecodeString(data, int(prefix&0x1f))
+	}
+
+	switch prefix {
+	case 0xc0:
+		return nil, data, nil
+	case 0xc2:
+		return false, data, nil
+	case 0xc3:
+		return true, data, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		length, data, err := msgpackReadLength(data, 1<<(prefix-0xc4))
+		if err != nil {
+			return nil, nil, err
+		}
+		return append([]byte(nil), data[:length]...), data[length:], nil
+
+	case 0xc7, 0xc8, 0xc9:
+		length, data, err := msgpackReadLength(data, 1<<(prefix-0xc7))
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeExt(data, length)
+
+	case 0xca:
+		bits, data, err := msgpackReadUint(data, 4)
+		return float64(math.Float32frombits(uint32(bits))), data, err
+	case 0xcb:
+		bits, data, err := msgpackReadUint(data, 8)
+		return math.Float64frombits(bits), data, err
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		value, data, err := msgpackReadUint(data, 1<<(prefix-0xcc))
+		return value, data, err
+
+	case 0xd0:
+		value, data, err := msgpackReadUint(data, 1)
+		return int64(int8(value)), data, err
+	case 0xd1:
+		value, data, err := msgpackReadUint(data, 2)
+		return int64(int16(value)), data, err
+	case 0xd2:
+		value, data, err := msgpackReadUint(data, 4)
+		return int64(int32(value)), data, err
+	case 0xd3:
+		value, data, err := msgpackReadUint(data, 8)
+		return int64(value), data, err
+
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return msgpackDecodeExt(data, 1<<(prefix-0xd4))
+
+	case 0xd9, 0xda, 0xdb:
+		length, data, err := msgpackReadLength(data, 1<<(prefix-0xd9))
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeString(data, length)
+
+	case 0xdc, 0xdd:
+		length, data, err := msgpackReadLength(data, 2<<(prefix-0xdc))
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeArray(data, length, depth)
+
+	case 0xde, 0xdf:
+		length, data, err := msgpackReadLength(data, 2<<(prefix-0xde))
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackDecodeMap(data, length, depth)
+
+	default:
+		return nil, nil, fmt.Errorf("invalid prefix 0x%x", prefix)
+	}
+}
+
+func msgpackReadUint(data []byte, size int) (uint64, []byte, error) {
+	if len(data) < size {
+		return 0, nil, fmt.Errorf("unexpected end of data")
+	}
+	value := uint64(0)
+	for _, b := range data[:size] {
+		value = value<<8 | uint64(b)
+	}
+	return value, data[size:], nil
+}
+
+// msgpackReadLength reads a length of the given size and makes sure that at
+// least this number of bytes follows.
+func msgpackReadLength(data []byte, size int) (int, []byte, error) {
+	length, data, err := msgpackReadUint(data, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	if uint64(len(data)) < length {
+		return 0, nil, fmt.Errorf("unexpected end of data")
+	}
+	return int(length), data, nil
+}
+
+func msgpackDecodeString(data []byte, length int) (interface{}, []byte, error) {
+	if len(data) < length {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+	return string(data[:length]), data[length:], nil
+}
+
+func msgpackDecodeArray(data []byte, length int, depth int) (interface{}, []byte, error) {
+	// Every element takes at least one byte
+	if len(data) < length {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+
+	array := make([]interface{}, length)
+	for i := range array {
+		var err error
+		if array[i], data, err = msgpackDecode(data, depth+1); err != nil {
+			return nil, nil, err
+		}
+	}
+	return array, data, nil
+}
+
+func msgpackDecodeMap(data []byte, length int, depth int) (interface{}, []byte, error) {
+	// Every key and value takes at least one byte
+	if len(data) < 2*length {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+
+	values := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		key, remain, err := msgpackDecode(data, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		value, remain, err := msgpackDecode(remain, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = remain
+
+		switch typedKey := key.(type) {
+		case string:
+			values[typedKey] = value
+		case []byte:
+			values[string(typedKey)] = value
+		default:
+			values[fmt.Sprint(key)] = value
+		}
+	}
+	return values, data, nil
+}
+
+func msgpackDecodeExt(data []byte, length int) (interface{}, []byte, error) {
+	if len(data) < length+1 {
+		return nil, nil, fmt.Errorf("unexpected end of data")
+	}
+	extType, extData, data := int8(data[0]), data[1:length+1], data[length+1:]
+
+	if extType == -1 {
+		var timestamp time.Time
+		switch length {
+		case 4:
+			timestamp = time.Unix(int64(binary.BigEndian.Uint32(extData)), 0)
+		case 8:
+			bits := binary.BigEndian.Uint64(extData)
+			timestamp = time.Unix(int64(bits&0x3ffffffff), int64(bits>>34))
+		case 12:
+			timestamp = time.Unix(int64(binary.BigEndian.Uint64(extData[4:])), int64(binary.BigEndian.Uint32(extData)))
+		default:
+			return nil, nil, fmt.Errorf("invalid timestamp of %d bytes", length)
+		}
+		return timestamp.UTC().Format(time.RFC3339Nano), data, nil
+	}
+
+	return map[string]interface{}{
+		"type": extType,
+		"data": append([]byte(nil), extData...),
+	}, data, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestMsgpackEncode(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Msgpack")
+	config.Override("Mode", "encode")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Msgpack)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"b":[1,-1,300,1.5],"a":null,"c":true}`), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("\x83\xa1a\xc0\xa1b\x94\x01\xff\xcd\x01\x2c\xcb\x3f\xf8\x00\x00\x00\x00\x00\x00\xa1c\xc3", msg.String())
+}
+
+func TestMsgpackRoundtrip(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Msgpack")
+	config.Override("Mode", "encode")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	encoder, casted := plugin.(*Msgpack)
+	expect.True(casted)
+
+	config = core.NewPluginConfig("", "format.Msgpack")
+	config.Override("Mode", "decode")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	decoder, casted := plugin.(*Msgpack)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"list":[1,-200,70000,-3000000000,18446744073709551615,0.25],"nested":{"text":"hello"},"off":false}`),
+		nil, core.InvalidStreamID)
+
+	err = encoder.ApplyFormatter(msg)
+	expect.NoError(err)
+	err = decoder.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"list":[1,-200,70000,-3000000000,18446744073709551615,0.25],"nested":{"text":"hello"},"off":false}`, msg.String())
+}
+
+func TestMsgpackDecode(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Msgpack")
+	config.Override("Mode", "decode")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Msgpack)
+	expect.True(casted)
+
+	// {1: bin "ab", "t": timestamp32(0), "x": ext(5, 0x01)}
+	msg := core.NewMessage(nil, []byte("\x83\x01\xc4\x02ab\xa1t\xd6\xff\x00\x00\x00\x00\xa1x\xd4\x05\x01"), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"1":"YWI=","t":"1970-01-01T00:00:00Z","x":{"data":"AQ==","type":5}}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte("\x92\x01"), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+
+	msg = core.NewMessage(nil, []byte("\x01\x02"), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
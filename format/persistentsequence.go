@@ -0,0 +1,195 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/trivago/gollum/core"
+)
+
+// PersistentSequence formatter
+//
+// This formatter assigns a sequence number to each message. In contrast to
+// format.Sequence the numbers are counted per stream and survive restarts of
+// gollum. Downstream systems can use them to detect lost or reordered
+// messages.
+//
+// To avoid writing to disk for each message, ranges of BatchSize numbers are
+// reserved in advance. After a restart counting continues after the last
+// reserved range, so numbers are never used twice but a gap of up to
+// BatchSize numbers is left.
+//
+// Parameters
+//
+// - File: Defines the file the reserved ranges are stored in. If empty, the
+// numbers are not persisted and start at 1 after each restart.
+// By default this parameter is set to "".
+//
+// - BatchSize: Defines the number of sequence numbers reserved at once.
+// By default this parameter is set to 1000.
+//
+// - PerStream: When set to false, all streams share one sequence.
+// By default this parameter is set to true.
+//
+// - Target: Defines the metadata field the sequence number is written to. If
+// empty, the number and Separator are added in front of the content.
+// By default this parameter is set to "seq".
+//
+// - Separator: Defines the separator string placed between number and
+// content when Target is empty.
+// By default this parameter is set to ":".
+//
+// Examples
+//
+// This example numbers all messages per stream and keeps the state in
+// /var/lib/gollum:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.PersistentSequence:
+//        File: /var/lib/gollum/sequence.json
+//        BatchSize: 10000
+type PersistentSequence struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	file                 string `config:"File"`
+	batchSize            int64  `config:"BatchSize" default:"1000"`
+	perStream            bool   `config:"PerStream" default:"true"`
+	target               string `config:"Target" default:"seq"`
+	separator            []byte `config:"Separator" default:":"`
+	sequences            map[string]*persistentSequenceRange
+	guard                *sync.Mutex
+}
+
+// persistentSequenceRange holds the next sequence number of a stream and the
+// first number that is not reserved yet.
+type persistentSequenceRange struct {
+	next     int64
+	reserved int64
+}
+
+func init() {
+	core.TypeRegistry.Register(PersistentSequence{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *PersistentSequence) Configure(conf core.PluginConfigReader) {
+	format.guard = new(sync.Mutex)
+	format.sequences = make(map[string]*persistentSequenceRange)
+
+	if format.batchSize < 1 {
+		conf.Errors.Pushf("BatchSize must be at least 1")
+	}
+	if format.file == "" {
+		format.Logger.Warning("No File set, sequence numbers are not persisted")
+		return
+	}
+
+	data, err := ioutil.ReadFile(format.file)
+	switch {
+	case os.IsNotExist(err):
+		return
+	case err != nil:
+		conf.Errors.Push(err)
+		return
+	}
+
+	reserved := make(map[string]int64)
+	if err := json.Unmarshal(data, &reserved); err != nil {
+		conf.Errors.Pushf("Failed to parse %s: %s", format.file, err)
+		return
+	}
+	for key, value := range reserved {
+		format.sequences[key] = &persistentSequenceRange{
+			next:     value,
+			reserved: value,
+		}
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *PersistentSequence) ApplyFormatter(msg *core.Message) error {
+	key := ""
+	if format.perStream {
+		key = core.StreamRegistry.GetStreamName(msg.GetStreamID())
+	}
+	seq := strconv.FormatInt(format.nextNumber(key), 10)
+
+	if format.target != "" {
+		msg.GetMetadata().SetValue(format.target, []byte(seq))
+		return nil
+	}
+
+	content := format.GetAppliedContent(msg)
+	payload := make([]byte, 0, len(seq)+len(format.separator)+len(content))
+	payload = append(payload, seq...)
+	payload = append(payload, format.separator...)
+	format.SetAppliedContent(msg, append(payload, content...))
+	return nil
+}
+
+// nextNumber returns the next sequence number for the given key and reserves
+// a new range if required.
+func (format *PersistentSequence) nextNumber(key string) int64 {
+	format.guard.Lock()
+	defer format.guard.Unlock()
+
+	sequence, exists := format.sequences[key]
+	if !exists {
+		sequence = &persistentSequenceRange{}
+		format.sequences[key] = sequence
+	}
+
+	sequence.next++
+	if sequence.next > sequence.reserved {
+		sequence.reserved = sequence.next + format.batchSize - 1
+		format.storeRanges()
+	}
+	return sequence.next
+}
+
+// storeRanges writes the reserved ranges of all sequences. The file is
+// replaced atomically so that a crash never leaves a partial state.
+func (format *PersistentSequence) storeRanges() {
+	if format.file == "" {
+		return
+	}
+
+	reserved := make(map[string]int64, len(format.sequences))
+	for key, sequence := range format.sequences {
+		reserved[key] = sequence.reserved
+	}
+
+	data, err := json.Marshal(reserved)
+	if err != nil {
+		format.Logger.WithError(err).Error("Failed to encode sequence ranges")
+		return
+	}
+
+	tempFile := format.file + ".tmp"
+	if err := ioutil.WriteFile(tempFile, data, 0644); err != nil {
+		format.Logger.WithError(err).Error("Failed to store sequence ranges")
+		return
+	}
+	if err := os.Rename(tempFile, format.file); err != nil {
+		format.Logger.WithError(err).Error("Failed to store sequence ranges")
+	}
+}
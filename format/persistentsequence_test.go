@@ -0,0 +1,90 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestPersistentSequenceRestart(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	dir, err := ioutil.TempDir("", "gollum-sequence")
+	expect.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := core.NewPluginConfig("", "format.PersistentSequence")
+	config.Override("File", filepath.Join(dir, "sequence.json"))
+	config.Override("BatchSize", 10)
+	streamA := core.GetStreamID("a")
+	streamB := core.GetStreamID("b")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*PersistentSequence)
+	expect.True(casted)
+
+	for _, expected := range []string{"1", "2", "3"} {
+		msg := core.NewMessage(nil, []byte("test"), nil, streamA)
+		expect.NoError(formatter.ApplyFormatter(msg))
+		expect.Equal(expected, msg.GetMetadata().GetValueString("seq"))
+	}
+	msg := core.NewMessage(nil, []byte("test"), nil, streamB)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal("1", msg.GetMetadata().GetValueString("seq"))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "sequence.json"))
+	expect.NoError(err)
+	expect.Equal(`{"a":10,"b":10}`, string(data))
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted = plugin.(*PersistentSequence)
+	expect.True(casted)
+
+	msg = core.NewMessage(nil, []byte("test"), nil, streamA)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal("11", msg.GetMetadata().GetValueString("seq"))
+}
+
+func TestPersistentSequencePayload(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.PersistentSequence")
+	config.Override("Target", "")
+	config.Override("PerStream", false)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*PersistentSequence)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), nil, core.GetStreamID("a"))
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal("1:test", msg.String())
+
+	msg = core.NewMessage(nil, []byte("test"), nil, core.GetStreamID("b"))
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal("2:test", msg.String())
+}
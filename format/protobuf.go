@@ -0,0 +1,669 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/trivago/gollum/core"
+)
+
+// Protobuf formatter
+//
+// This formatter converts between binary protobuf messages and JSON. The
+// message layout is read from a FileDescriptorSet, as generated by
+// "protoc --include_imports --descriptor_set_out=<file>".
+// When decoding, 64-bit integers are written as JSON numbers, bytes fields as
+// base64 encoded strings and enums by their name. Unknown fields are ignored.
+// When encoding, fields can be given by their JSON or their proto name.
+// Integers may be passed as strings, enums by name or number. Groups are not
+// supported.
+//
+// Parameters
+//
+// - DescriptorSetFile: Defines the path to a binary FileDescriptorSet
+// containing the message type and all of its dependencies.
+// By default this parameter is set to "".
+//
+// - MessageType: Defines the fully qualified name of the message type, e.g.
+// "mypackage.LogEntry".
+// By default this parameter is set to "".
+//
+// - Mode: Defines the conversion direction. Set to "decode" to convert
+// protobuf to JSON or to "encode" to convert JSON to protobuf.
+// By default this parameter is set to "decode".
+//
+// - UseProtoNames: When set to true, decoded fields are named like in the
+// .proto file instead of using their lowerCamelCase JSON name.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example decodes protobuf encoded log entries read from kafka:
+//
+//  exampleConsumer:
+//    Type: consumer.Kafka
+//    Streams: "*"
+//    Modulators:
+//      - format.Protobuf:
+//        DescriptorSetFile: /etc/gollum/logs.desc
+//        MessageType: logging.LogEntry
+//        Mode: decode
+type Protobuf struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	encode               bool
+	useProtoNames        bool `config:"UseProtoNames" default:"false"`
+	message              *descriptor.DescriptorProto
+	messages             map[string]*descriptor.DescriptorProto
+	enums                map[string]*descriptor.EnumDescriptorProto
+}
+
+func init() {
+	core.TypeRegistry.Register(Protobuf{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Protobuf) Configure(conf core.PluginConfigReader) {
+	format.messages = make(map[string]*descriptor.DescriptorProto)
+	format.enums = make(map[string]*descriptor.EnumDescriptorProto)
+
+	switch mode := strings.ToLower(conf.GetString("Mode", "decode")); mode {
+	case "decode":
+	case "encode":
+		format.encode = true
+	default:
+		conf.Errors.Pushf("Unknown mode '%s'", mode)
+	}
+
+	descriptorFile := conf.GetString("DescriptorSetFile", "")
+	if descriptorFile == "" {
+		format.Logger.Warning("No DescriptorSetFile set, messages will not be converted")
+		return // ### return, nothing to load ###
+	}
+
+	data, err := ioutil.ReadFile(descriptorFile)
+	if conf.Errors.Push(err) {
+		return // ### return, cannot read descriptors ###
+	}
+
+	descriptorSet := new(descriptor.FileDescriptorSet)
+	if err := proto.Unmarshal(data, descriptorSet); err != nil {
+		conf.Errors.Pushf("Failed to parse %s: %s", descriptorFile, err)
+		return // ### return, invalid descriptors ###
+	}
+
+	for _, file := range descriptorSet.GetFile() {
+		prefix := ""
+		if file.GetPackage() != "" {
+			prefix = "." + file.GetPackage()
+		}
+		format.registerTypes(prefix, file.GetMessageType(), file.GetEnumType())
+	}
+
+	messageType := conf.GetString("MessageType", "")
+	if !strings.HasPrefix(messageType, ".") {
+		messageType = "." + messageType
+	}
+	if format.message = format.messages[messageType]; format.message == nil {
+		conf.Errors.Pushf("Message type '%s' not found in %s", messageType[1:], descriptorFile)
+	}
+}
+
+func (format *Protobuf) registerTypes(prefix string, messages []*descriptor.DescriptorProto, enums []*descriptor.EnumDescriptorProto) {
+	for _, enum := range enums {
+		format.enums[prefix+"."+enum.GetName()] = enum
+	}
+	for _, message := range messages {
+		name := prefix + "." + message.GetName()
+		format.messages[name] = message
+		format.registerTypes(name, message.GetNestedType(), message.GetEnumType())
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Protobuf) ApplyFormatter(msg *core.Message) error {
+	if format.message == nil {
+		return fmt.Errorf("no protobuf message type loaded")
+	}
+
+	content := format.GetAppliedContent(msg)
+	if format.encode {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+
+		values := make(map[string]interface{})
+		if err := decoder.Decode(&values); err != nil {
+			format.Logger.Warning("Protobuf failed to unmarshal a message: ", err)
+			return err
+		}
+
+		data, err := format.encodeMessage(format.message, values)
+		if err != nil {
+			format.Logger.Warning("Protobuf failed to encode a message: ", err)
+			return err
+		}
+		format.SetAppliedContent(msg, data)
+		return nil
+	}
+
+	values, err := format.decodeMessage(format.message, content)
+	if err != nil {
+		format.Logger.Warning("Protobuf failed to decode a message: ", err)
+		return err
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		format.Logger.Warning("Protobuf failed to marshal a message: ", err)
+		return err
+	}
+	format.SetAppliedContent(msg, data)
+	return nil
+}
+
+func (format *Protobuf) fieldName(field *descriptor.FieldDescriptorProto) string {
+	if format.useProtoNames || field.GetJsonName() == "" {
+		return field.GetName()
+	}
+	return field.GetJsonName()
+}
+
+// mapEntry returns the descriptor of a map entry if the given field is a map.
+func (format *Protobuf) mapEntry(field *descriptor.FieldDescriptorProto) *descriptor.DescriptorProto {
+	if field.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+		return nil
+	}
+	if entry := format.messages[field.GetTypeName()]; entry != nil && entry.GetOptions().GetMapEntry() {
+		return entry
+	}
+	return nil
+}
+
+func (format *Protobuf) decodeMessage(message *descriptor.DescriptorProto, data []byte) (map[string]interface{}, error) {
+	fields := make(map[int32]*descriptor.FieldDescriptorProto)
+	for _, field := range message.GetField() {
+		fields[field.GetNumber()] = field
+	}
+
+	values := make(map[string]interface{})
+	err := protobufDecodeFields(data, func(number int32, wireType uint64, value []byte, scalar uint64) error {
+		field, known := fields[number]
+		if !known {
+			return nil // ### return, ignore unknown fields ###
+		}
+		name := format.fieldName(field)
+
+		if entry := format.mapEntry(field); entry != nil {
+			entryValues, err := format.decodeMessage(entry, value)
+			if err != nil {
+				return err
+			}
+			mapValue, _ := values[name].(map[string]interface{})
+			if mapValue == nil {
+				mapValue = make(map[string]interface{})
+				values[name] = mapValue
+			}
+			key := entryValues[format.fieldName(entry.GetField()[0])]
+			if key == nil {
+				key = ""
+			}
+			mapValue[fmt.Sprint(key)] = entryValues[format.fieldName(entry.GetField()[1])]
+			return nil // ### return, map entry ###
+		}
+
+		var decoded []interface{}
+		if wireType == proto.WireBytes && protobufIsPackable(field.GetType()) {
+			var err error
+			if decoded, err = format.decodePacked(field, value); err != nil {
+				return err
+			}
+		} else {
+			item, err := format.decodeValue(field, value, scalar)
+			if err != nil {
+				return err
+			}
+			decoded = []interface{}{item}
+		}
+
+		if field.GetLabel() != descriptor.FieldDescriptorProto_LABEL_REPEATED {
+			values[name] = decoded[len(decoded)-1]
+			return nil // ### return, single value ###
+		}
+
+		list, _ := values[name].([]interface{})
+		values[name] = append(list, decoded...)
+		return nil
+	})
+	return values, err
+}
+
+func (format *Protobuf) decodePacked(field *descriptor.FieldDescriptorProto, data []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(data) > 0 {
+		var (
+			scalar uint64
+			size   int
+		)
+		switch protobufWireType(field.GetType()) {
+		case proto.WireFixed32:
+			if size = 4; len(data) < size {
+				return nil, fmt.Errorf("invalid packed fixed32")
+			}
+			scalar = uint64(binary.LittleEndian.Uint32(data))
+		case proto.WireFixed64:
+			if size = 8; len(data) < size {
+				return nil, fmt.Errorf("invalid packed fixed64")
+			}
+			scalar = binary.LittleEndian.Uint64(data)
+		default:
+			if scalar, size = proto.DecodeVarint(data); size == 0 {
+				return nil, fmt.Errorf("invalid packed varint")
+			}
+		}
+		data = data[size:]
+
+		value, err := format.decodeValue(field, nil, scalar)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (format *Protobuf) decodeValue(field *descriptor.FieldDescriptorProto, value []byte, scalar uint64) (interface{}, error) {
+	switch field.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_INT32:
+		return int32(scalar), nil
+	case descriptor.FieldDescriptorProto_TYPE_INT64:
+		return int64(scalar), nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT32:
+		return uint32(scalar), nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return scalar, nil
+	case descriptor.FieldDescriptorProto_TYPE_SINT32:
+		return int32(uint32(scalar)>>1) ^ -int32(scalar&1), nil
+	case descriptor.FieldDescriptorProto_TYPE_SINT64:
+		return int64(scalar>>1) ^ -int64(scalar&1), nil
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return scalar != 0, nil
+	case descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		return uint32(scalar), nil
+	case descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return int32(uint32(scalar)), nil
+	case descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return int64(scalar), nil
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return math.Float32frombits(uint32(scalar)), nil
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return math.Float64frombits(scalar), nil
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		return string(value), nil
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		return append([]byte(nil), value...), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		if enum := format.enums[field.GetTypeName()]; enum != nil {
+			for _, enumValue := range enum.GetValue() {
+				if enumValue.GetNumber() == int32(scalar) {
+					return enumValue.GetName(), nil
+				}
+			}
+		}
+		return int32(scalar), nil
+
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		message := format.messages[field.GetTypeName()]
+		if message == nil {
+			return nil, fmt.Errorf("unknown message type %s", field.GetTypeName())
+		}
+		return format.decodeMessage(message, value)
+
+	default:
+		return nil, fmt.Errorf("unsupported type %s of field %s", field.GetType(), field.GetName())
+	}
+}
+
+func (format *Protobuf) encodeMessage(message *descriptor.DescriptorProto, values map[string]interface{}) ([]byte, error) {
+	buffer := proto.NewBuffer(nil)
+	for _, field := range message.GetField() {
+		value, exists := values[field.GetJsonName()]
+		if !exists || field.GetJsonName() == "" {
+			value, exists = values[field.GetName()]
+		}
+		if !exists || value == nil {
+			continue
+		}
+
+		if err := format.encodeField(buffer, field, value); err != nil {
+			return nil, fmt.Errorf("field %s: %s", field.GetName(), err)
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+func (format *Protobuf) encodeField(buffer *proto.Buffer, field *descriptor.FieldDescriptorProto, value interface{}) error {
+	if field.GetLabel() != descriptor.FieldDescriptorProto_LABEL_REPEATED {
+		return format.encodeSingle(buffer, field, value)
+	}
+
+	if entry := format.mapEntry(field); entry != nil {
+		mapValue, isMap := value.(map[string]interface{})
+		if !isMap {
+			return fmt.Errorf("expected an object")
+		}
+
+		keys := make([]string, 0, len(mapValue))
+		for key := range mapValue {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			data, err := format.encodeMessage(entry, map[string]interface{}{
+				entry.GetField()[0].GetName(): key,
+				entry.GetField()[1].GetName(): mapValue[key],
+			})
+			if err != nil {
+				return err
+			}
+			buffer.EncodeVarint(uint64(field.GetNumber())<<3 | proto.WireBytes)
+			buffer.EncodeRawBytes(data)
+		}
+		return nil // ### return, map encoded ###
+	}
+
+	list, isList := value.([]interface{})
+	if !isList {
+		return fmt.Errorf("expected an array")
+	}
+
+	if !protobufIsPackable(field.GetType()) {
+		for _, item := range list {
+			if err := format.encodeSingle(buffer, field, item); err != nil {
+				return err
+			}
+		}
+		return nil // ### return, repeated values encoded ###
+	}
+
+	packed := proto.NewBuffer(nil)
+	for _, item := range list {
+		if err := format.encodeScalar(packed, field, item); err != nil {
+			return err
+		}
+	}
+	buffer.EncodeVarint(uint64(field.GetNumber())<<3 | proto.WireBytes)
+	return buffer.EncodeRawBytes(packed.Bytes())
+}
+
+func (format *Protobuf) encodeSingle(buffer *proto.Buffer, field *descriptor.FieldDescriptorProto, value interface{}) error {
+	key := uint64(field.GetNumber())<<3 | protobufWireType(field.GetType())
+
+	switch field.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		buffer.EncodeVarint(key)
+		return buffer.EncodeStringBytes(protobufToString(value))
+
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		data, err := base64.StdEncoding.DecodeString(protobufToString(value))
+		if err != nil {
+			return err
+		}
+		buffer.EncodeVarint(key)
+		return buffer.EncodeRawBytes(data)
+
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		message := format.messages[field.GetTypeName()]
+		if message == nil {
+			return fmt.Errorf("unknown message type %s", field.GetTypeName())
+		}
+		values, isObject := value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("expected an object")
+		}
+		data, err := format.encodeMessage(message, values)
+		if err != nil {
+			return err
+		}
+		buffer.EncodeVarint(key)
+		return buffer.EncodeRawBytes(data)
+
+	case descriptor.FieldDescriptorProto_TYPE_GROUP:
+		return fmt.Errorf("groups are not supported")
+
+	default:
+		buffer.EncodeVarint(key)
+		return format.encodeScalar(buffer, field, value)
+	}
+}
+
+func (format *Protobuf) encodeScalar(buffer *proto.Buffer, field *descriptor.FieldDescriptorProto, value interface{}) error {
+	switch field.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		boolValue, isBool := value.(bool)
+		if !isBool {
+			var err error
+			if boolValue, err = strconv.ParseBool(protobufToString(value)); err != nil {
+				return err
+			}
+		}
+		if boolValue {
+			return buffer.EncodeVarint(1)
+		}
+		return buffer.EncodeVarint(0)
+
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		floatValue, err := protobufToFloat(value)
+		if err != nil {
+			return err
+		}
+		return buffer.EncodeFixed32(uint64(math.Float32bits(float32(floatValue))))
+
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		floatValue, err := protobufToFloat(value)
+		if err != nil {
+			return err
+		}
+		return buffer.EncodeFixed64(math.Float64bits(floatValue))
+
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_UINT64:
+		uintValue, err := strconv.ParseUint(protobufToString(value), 10, 64)
+		if err != nil {
+			return err
+		}
+		return buffer.EncodeVarint(uintValue)
+
+	case descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		uintValue, err := strconv.ParseUint(protobufToString(value), 10, 32)
+		if err != nil {
+			return err
+		}
+		return buffer.EncodeFixed32(uintValue)
+
+	case descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		uintValue, err := strconv.ParseUint(protobufToString(value), 10, 64)
+		if err != nil {
+			return err
+		}
+		return buffer.EncodeFixed64(uintValue)
+	}
+
+	var intValue int64
+	if field.GetType() == descriptor.FieldDescriptorProto_TYPE_ENUM {
+		var err error
+		if intValue, err = format.enumNumber(field, value); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if intValue, err = protobufToInt(value); err != nil {
+			return err
+		}
+	}
+
+	switch field.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_SINT32:
+		return buffer.EncodeZigzag32(uint64(intValue))
+	case descriptor.FieldDescriptorProto_TYPE_SINT64:
+		return buffer.EncodeZigzag64(uint64(intValue))
+	case descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return buffer.EncodeFixed32(uint64(uint32(int32(intValue))))
+	case descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return buffer.EncodeFixed64(uint64(intValue))
+	default:
+		return buffer.EncodeVarint(uint64(intValue))
+	}
+}
+
+func (format *Protobuf) enumNumber(field *descriptor.FieldDescriptorProto, value interface{}) (int64, error) {
+	name := protobufToString(value)
+	if number, err := strconv.ParseInt(name, 10, 32); err == nil {
+		return number, nil
+	}
+
+	if enum := format.enums[field.GetTypeName()]; enum != nil {
+		for _, enumValue := range enum.GetValue() {
+			if enumValue.GetName() == name {
+				return int64(enumValue.GetNumber()), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unknown enum value %s", name)
+}
+
+// protobufDecodeFields calls onField for each field of a protobuf message.
+// Length delimited fields are passed as value, all other fields as scalar.
+func protobufDecodeFields(data []byte, onField func(number int32, wireType uint64, value []byte, scalar uint64) error) error {
+	for len(data) > 0 {
+		key, size := proto.DecodeVarint(data)
+		if size == 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		data = data[size:]
+
+		var (
+			value  []byte
+			scalar uint64
+		)
+		switch key & 7 {
+		case proto.WireVarint:
+			scalar, size = proto.DecodeVarint(data)
+			if size == 0 {
+				return fmt.Errorf("invalid varint")
+			}
+
+		case proto.WireFixed64:
+			if size = 8; len(data) < size {
+				return fmt.Errorf("invalid fixed64")
+			}
+			scalar = binary.LittleEndian.Uint64(data)
+
+		case proto.WireFixed32:
+			if size = 4; len(data) < size {
+				return fmt.Errorf("invalid fixed32")
+			}
+			scalar = uint64(binary.LittleEndian.Uint32(data))
+
+		case proto.WireBytes:
+			length, lengthSize := proto.DecodeVarint(data)
+			if lengthSize == 0 || uint64(len(data)-lengthSize) < length {
+				return fmt.Errorf("invalid length delimited field")
+			}
+			value = data[lengthSize : lengthSize+int(length)]
+			size = lengthSize + int(length)
+
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+
+		data = data[size:]
+		if err := onField(int32(key>>3), key&7, value, scalar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func protobufWireType(fieldType descriptor.FieldDescriptorProto_Type) uint64 {
+	switch fieldType {
+	case descriptor.FieldDescriptorProto_TYPE_FIXED32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED32,
+		descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return proto.WireFixed32
+	case descriptor.FieldDescriptorProto_TYPE_FIXED64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64,
+		descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return proto.WireFixed64
+	case descriptor.FieldDescriptorProto_TYPE_STRING,
+		descriptor.FieldDescriptorProto_TYPE_BYTES,
+		descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		return proto.WireBytes
+	default:
+		return proto.WireVarint
+	}
+}
+
+func protobufIsPackable(fieldType descriptor.FieldDescriptorProto_Type) bool {
+	return protobufWireType(fieldType) != proto.WireBytes && fieldType != descriptor.FieldDescriptorProto_TYPE_GROUP
+}
+
+func protobufToString(value interface{}) string {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue
+	case json.Number:
+		return typedValue.String()
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func protobufToInt(value interface{}) (int64, error) {
+	intValue, err := strconv.ParseInt(protobufToString(value), 10, 64)
+	if err != nil {
+		// Allow numbers like 1e3 as long as they are integers
+		floatValue, floatErr := strconv.ParseFloat(protobufToString(value), 64)
+		if floatErr != nil || floatValue != math.Trunc(floatValue) {
+			return 0, err
+		}
+		intValue = int64(floatValue)
+	}
+	return intValue, nil
+}
+
+func protobufToFloat(value interface{}) (float64, error) {
+	switch name := protobufToString(value); name {
+	case "NaN":
+		return math.NaN(), nil
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	default:
+		return strconv.ParseFloat(name, 64)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func writeTestDescriptorSet(expect ttesting.Expect) string {
+	field := func(name, jsonName string, number int32, fieldType descriptor.FieldDescriptorProto_Type, repeated bool, typeName string) *descriptor.FieldDescriptorProto {
+		label := descriptor.FieldDescriptorProto_LABEL_OPTIONAL
+		if repeated {
+			label = descriptor.FieldDescriptorProto_LABEL_REPEATED
+		}
+		desc := &descriptor.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(jsonName),
+			Number:   proto.Int32(number),
+			Type:     fieldType.Enum(),
+			Label:    label.Enum(),
+		}
+		if typeName != "" {
+			desc.TypeName = proto.String(typeName)
+		}
+		return desc
+	}
+
+	descriptorSet := &descriptor.FileDescriptorSet{
+		File: []*descriptor.FileDescriptorProto{{
+			Name:    proto.String("test.proto"),
+			Package: proto.String("test"),
+			EnumType: []*descriptor.EnumDescriptorProto{{
+				Name: proto.String("Level"),
+				Value: []*descriptor.EnumValueDescriptorProto{
+					{Name: proto.String("INFO"), Number: proto.Int32(0)},
+					{Name: proto.String("ERROR"), Number: proto.Int32(1)},
+				},
+			}},
+			MessageType: []*descriptor.DescriptorProto{{
+				Name: proto.String("Entry"),
+				Field: []*descriptor.FieldDescriptorProto{
+					field("message", "message", 1, descriptor.FieldDescriptorProto_TYPE_STRING, false, ""),
+					field("level", "level", 2, descriptor.FieldDescriptorProto_TYPE_ENUM, false, ".test.Level"),
+					field("line_numbers", "lineNumbers", 3, descriptor.FieldDescriptorProto_TYPE_SINT64, true, ""),
+					field("labels", "labels", 4, descriptor.FieldDescriptorProto_TYPE_MESSAGE, true, ".test.Entry.LabelsEntry"),
+					field("source", "source", 5, descriptor.FieldDescriptorProto_TYPE_MESSAGE, false, ".test.Entry.Source"),
+					field("ratio", "ratio", 6, descriptor.FieldDescriptorProto_TYPE_DOUBLE, false, ""),
+				},
+				NestedType: []*descriptor.DescriptorProto{
+					{
+						Name: proto.String("LabelsEntry"),
+						Field: []*descriptor.FieldDescriptorProto{
+							field("key", "key", 1, descriptor.FieldDescriptorProto_TYPE_STRING, false, ""),
+							field("value", "value", 2, descriptor.FieldDescriptorProto_TYPE_STRING, false, ""),
+						},
+						Options: &descriptor.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+					{
+						Name: proto.String("Source"),
+						Field: []*descriptor.FieldDescriptorProto{
+							field("host_name", "hostName", 1, descriptor.FieldDescriptorProto_TYPE_STRING, false, ""),
+							field("pid", "pid", 2, descriptor.FieldDescriptorProto_TYPE_UINT32, false, ""),
+						},
+					},
+				},
+			}},
+		}},
+	}
+
+	data, err := proto.Marshal(descriptorSet)
+	expect.NoError(err)
+
+	file, err := ioutil.TempFile("", "gollum-protobuf")
+	expect.NoError(err)
+	defer file.Close()
+
+	_, err = file.Write(data)
+	expect.NoError(err)
+	return file.Name()
+}
+
+func TestProtobufRoundtrip(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	descriptorFile := writeTestDescriptorSet(expect)
+	defer os.Remove(descriptorFile)
+
+	config := core.NewPluginConfig("", "format.Protobuf")
+	config.Override("DescriptorSetFile", descriptorFile)
+	config.Override("MessageType", "test.Entry")
+	config.Override("Mode", "encode")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	encoder, casted := plugin.(*Protobuf)
+	expect.True(casted)
+
+	config = core.NewPluginConfig("", "format.Protobuf")
+	config.Override("DescriptorSetFile", descriptorFile)
+	config.Override("MessageType", "test.Entry")
+	config.Override("Mode", "decode")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	decoder, casted := plugin.(*Protobuf)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"message":"hello","level":"ERROR","line_numbers":[-1,2,"300"],`+
+		`"labels":{"b":"2","a":"1"},"source":{"hostName":"example","pid":42},"ratio":0.5,"unknown":true}`),
+		nil, core.InvalidStreamID)
+
+	err = encoder.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	err = decoder.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"labels":{"a":"1","b":"2"},"level":"ERROR","lineNumbers":[-1,2,300],`+
+		`"message":"hello","ratio":0.5,"source":{"hostName":"example","pid":42}}`, msg.String())
+}
+
+func TestProtobufDecode(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	descriptorFile := writeTestDescriptorSet(expect)
+	defer os.Remove(descriptorFile)
+
+	config := core.NewPluginConfig("", "format.Protobuf")
+	config.Override("DescriptorSetFile", descriptorFile)
+	config.Override("MessageType", ".test.Entry.Source")
+	config.Override("UseProtoNames", true)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Protobuf)
+	expect.True(casted)
+
+	// host_name = "a", pid = 7, unknown field 9 = 1
+	msg := core.NewMessage(nil, []byte{0x0a, 0x01, 'a', 0x10, 0x07, 0x48, 0x01}, nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"host_name":"a","pid":7}`, msg.String())
+
+	msg = core.NewMessage(nil, []byte{0x0a, 0x05, 'a'}, nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
+
+func TestProtobufInvalidType(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	descriptorFile := writeTestDescriptorSet(expect)
+	defer os.Remove(descriptorFile)
+
+	config := core.NewPluginConfig("", "format.Protobuf")
+	config.Override("DescriptorSetFile", descriptorFile)
+	config.Override("MessageType", "test.Missing")
+
+	_, err := core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
@@ -0,0 +1,273 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/trivago/gollum/core"
+)
+
+// redactRule finds one kind of sensitive data. Matches are only redacted if
+// validate is nil or returns true.
+type redactRule struct {
+	name     string
+	pattern  *regexp.Regexp
+	validate func(match []byte) bool
+}
+
+// redactDetectors contains the built-in detectors by name.
+var redactDetectors = map[string]redactRule{
+	"email": {
+		name:    "email",
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	},
+	"creditcard": {
+		name:     "creditcard",
+		pattern:  regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`),
+		validate: redactLuhnValid,
+	},
+	"ssn": {
+		name:     "ssn",
+		pattern:  regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+		validate: redactSSNValid,
+	},
+	"phone": {
+		name:    "phone",
+		pattern: regexp.MustCompile(`(?:\+\d{1,3}[ .\-]?)?(?:\(\d{3}\)|\b\d{3})[ .\-]?\d{3}[ .\-]?\d{4}\b`),
+	},
+	"ipv4": {
+		name:    "ipv4",
+		pattern: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`),
+	},
+}
+
+// redactDetectorOrder defines the order of the built-in detectors. Detectors
+// matching longer numbers are applied first.
+var redactDetectorOrder = []string{"email", "creditcard", "ssn", "phone", "ipv4"}
+
+// Redact formatter
+//
+// This formatter removes personally identifiable information (PII) from the
+// payload and selected metadata fields. Sensitive data is found by built-in
+// detectors and custom regular expressions.
+//
+// The following detectors are available:
+//
+//  - email: email addresses
+//  - creditcard: credit card numbers of 13 to 19 digits, optionally separated
+//  by spaces or dashes, passing the Luhn check
+//  - ssn: US social security numbers in the format 123-45-6789
+//  - phone: phone numbers like "+1 555 123 4567" or "(555) 123-4567"
+//  - ipv4: IPv4 addresses
+//
+// Parameters
+//
+// - Detectors: Defines the built-in detectors to apply. Detectors are applied
+// in the order listed above, followed by the custom rules.
+// By default this parameter is set to all detectors.
+//
+// - Rules: Defines a map of names to regular expressions used as additional
+// detectors. The name is used for tokenization. Rules are applied in
+// alphabetical order of their names.
+// By default this parameter is set to an empty map.
+//
+// - Mode: Defines how matches are replaced. "mask" replaces each match with
+// Replacement. "partial" replaces all but the last KeepLast characters with
+// MaskChar. "token" replaces each match with a token like "<email:1f2e3d4c5b6a7988>"
+// that is derived from the match using HMAC-SHA256, so that equal values
+// result in equal tokens.
+// By default this parameter is set to "mask".
+//
+// - Replacement: Defines the text used by mode "mask".
+// By default this parameter is set to "[REDACTED]".
+//
+// - MaskChar: Defines the character used by mode "partial".
+// By default this parameter is set to "*".
+//
+// - KeepLast: Defines the number of characters left visible by mode "partial".
+// By default this parameter is set to 4.
+//
+// - TokenKey: Defines the secret key used by mode "token". Without a key,
+// tokens of guessable values like phone numbers can be reversed by brute
+// force.
+// By default this parameter is set to "".
+//
+// - Metadata: Defines a list of metadata fields that are redacted in addition
+// to the payload, respectively the field set by ApplyTo.
+// By default this parameter is set to an empty list.
+//
+// Examples
+//
+// This example masks all but the last four digits of credit card numbers and
+// replaces email addresses with tokens:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Redact:
+//        Detectors: [creditcard]
+//        Mode: partial
+//      - format.Redact:
+//        Detectors: [email]
+//        Mode: token
+//        TokenKey: "secret"
+//        Metadata: [user]
+type Redact struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	rules                []redactRule
+	mode                 string
+	replacement          []byte   `config:"Replacement" default:"[REDACTED]"`
+	maskChar             string   `config:"MaskChar" default:"*"`
+	keepLast             int      `config:"KeepLast" default:"4"`
+	tokenKey             []byte   `config:"TokenKey"`
+	metadataKeys         []string `config:"Metadata"`
+}
+
+func init() {
+	core.TypeRegistry.Register(Redact{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Redact) Configure(conf core.PluginConfigReader) {
+	detectors := make(map[string]bool)
+	for _, name := range conf.GetStringArray("Detectors", redactDetectorOrder) {
+		name = strings.ToLower(name)
+		if _, exists := redactDetectors[name]; !exists {
+			conf.Errors.Pushf("Unknown detector '%s'", name)
+		}
+		detectors[name] = true
+	}
+	for _, name := range redactDetectorOrder {
+		if detectors[name] {
+			format.rules = append(format.rules, redactDetectors[name])
+		}
+	}
+
+	rules := conf.GetStringMap("Rules", map[string]string{})
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		pattern, err := regexp.Compile(rules[name])
+		if err != nil {
+			conf.Errors.Pushf("Invalid rule '%s': %s", name, err)
+			continue
+		}
+		format.rules = append(format.rules, redactRule{name: name, pattern: pattern})
+	}
+
+	format.mode = strings.ToLower(conf.GetString("Mode", "mask"))
+	switch format.mode {
+	case "mask":
+	case "partial":
+		if utf8.RuneCountInString(format.maskChar) != 1 {
+			conf.Errors.Pushf("MaskChar must be a single character")
+		}
+	case "token":
+		if len(format.tokenKey) == 0 {
+			format.Logger.Warning("No TokenKey set, tokens are plain SHA-256 hashes")
+		}
+	default:
+		conf.Errors.Pushf("Unknown mode '%s'", format.mode)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Redact) ApplyFormatter(msg *core.Message) error {
+	format.SetAppliedContent(msg, format.redact(format.GetAppliedContent(msg)))
+
+	if len(format.metadataKeys) > 0 {
+		if metadata := msg.TryGetMetadata(); metadata != nil {
+			for _, key := range format.metadataKeys {
+				if value, exists := metadata.TryGetValue(key); exists {
+					metadata.SetValue(key, format.redact(value))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (format *Redact) redact(data []byte) []byte {
+	for _, rule := range format.rules {
+		rule := rule
+		data = rule.pattern.ReplaceAllFunc(data, func(match []byte) []byte {
+			if rule.validate != nil && !rule.validate(match) {
+				return match
+			}
+			return format.replace(rule.name, match)
+		})
+	}
+	return data
+}
+
+func (format *Redact) replace(name string, match []byte) []byte {
+	switch format.mode {
+	case "partial":
+		runes := []rune(string(match))
+		masked := len(runes) - format.keepLast
+		if masked < 0 {
+			masked = len(runes)
+		}
+		return []byte(strings.Repeat(format.maskChar, masked) + string(runes[masked:]))
+
+	case "token":
+		hash := hmac.New(sha256.New, format.tokenKey)
+		hash.Write(match)
+		return []byte("<" + name + ":" + hex.EncodeToString(hash.Sum(nil)[:8]) + ">")
+
+	default:
+		return format.replacement
+	}
+}
+
+// redactLuhnValid returns true if the digits of the given number pass the
+// Luhn check used by credit card numbers.
+func redactLuhnValid(number []byte) bool {
+	sum, numDigits, double := 0, 0, false
+	for i := len(number) - 1; i >= 0; i-- {
+		if number[i] < '0' || number[i] > '9' {
+			continue
+		}
+		digit := int(number[i] - '0')
+		if double {
+			if digit *= 2; digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		numDigits++
+		double = !double
+	}
+	return numDigits >= 13 && numDigits <= 19 && sum%10 == 0
+}
+
+// redactSSNValid filters numbers that are never assigned as social security
+// numbers.
+func redactSSNValid(ssn []byte) bool {
+	area, group, serial := string(ssn[0:3]), string(ssn[4:6]), string(ssn[7:11])
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
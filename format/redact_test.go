@@ -0,0 +1,95 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestRedactMask(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Redact")
+	config.Override("Rules", map[string]string{"apikey": `key-[a-z0-9]+`})
+	config.Override("Metadata", []interface{}{"user"})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Redact)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("mail jane.doe@example.com card 4111 1111 1111 1111 "+
+		"other 4111 1111 1111 1112 ssn 123-45-6789 invalid 000-12-3456 call (555) 123-4567 "+
+		"from 192.168.0.1 with key-abc123"), nil, core.InvalidStreamID)
+	msg.GetMetadata().SetValue("user", []byte("jane@example.com"))
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("mail [REDACTED] card [REDACTED] other 4111 1111 1111 1112 ssn [REDACTED] "+
+		"invalid 000-12-3456 call [REDACTED] from [REDACTED] with [REDACTED]", msg.String())
+	expect.Equal("[REDACTED]", msg.GetMetadata().GetValueString("user"))
+}
+
+func TestRedactPartial(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Redact")
+	config.Override("Detectors", []interface{}{"creditcard"})
+	config.Override("Mode", "partial")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Redact)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("card 4111-1111-1111-1111 mail a@example.com"), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("card ***************1111 mail a@example.com", msg.String())
+}
+
+func TestRedactToken(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Redact")
+	config.Override("Detectors", []interface{}{"email"})
+	config.Override("Mode", "token")
+	config.Override("TokenKey", "secret")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Redact)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("a@example.com b@example.com a@example.com"), nil, core.InvalidStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	tokens := strings.Split(msg.String(), " ")
+	expect.Equal(3, len(tokens))
+	expect.True(strings.HasPrefix(tokens[0], "<email:"))
+	expect.Equal(tokens[0], tokens[2])
+	expect.False(tokens[0] == tokens[1])
+
+	config.Override("Detectors", []interface{}{"unknown"})
+	_, err = core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
@@ -0,0 +1,200 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/trivago/gollum/core"
+)
+
+// RegexExtract formatter
+//
+// This formatter matches the content of a message against a list of regular
+// expressions with named capture groups. The value of each named group of the
+// first matching expression is written to a metadata field or a JSON field of
+// the same name. Unnamed groups and groups that did not participate in the
+// match are ignored.
+//
+// Parameters
+//
+// - Patterns: Defines the list of regular expressions to try in the given
+// order. Named groups are defined as "(?P<name>...)". For details on the
+// regexp syntax see https://golang.org/pkg/regexp/syntax. If no pattern is
+// set, messages are not changed.
+// By default this parameter is set to an empty list.
+//
+// - Target: Defines where the groups are written to. "metadata" stores each
+// group in a metadata field. "json" replaces the content by a JSON object
+// holding all groups.
+// By default this parameter is set to "metadata".
+//
+// - Prefix: Defines a prefix added to the names of all fields written.
+// By default this parameter is set to "".
+//
+// - MessageField: Defines the JSON field the original content is stored in
+// when Target is set to "json". If empty, the original content is not kept.
+// By default this parameter is set to "message".
+//
+// - PatternField: Defines the metadata field the index of the matching
+// pattern is written to. If empty, the index is not written.
+// By default this parameter is set to "".
+//
+// - MissAction: Defines what happens to messages not matching any pattern.
+// "keep" passes them on unchanged, "drop" discards them, "annotate" sets the
+// metadata field MissField to "true" and "route" does the same and routes
+// them to MissStream.
+// By default this parameter is set to "keep".
+//
+// - MissField: Defines the metadata field set for messages not matching any
+// pattern by actions "annotate" and "route".
+// By default this parameter is set to "regex_miss".
+//
+// - MissStream: Defines the stream messages not matching any pattern are
+// routed to by action "route".
+// By default this parameter is set to "unmatched".
+//
+// Examples
+//
+// This example extracts fields from two different log line formats into
+// metadata and discards all other lines:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.RegexExtract:
+//        Patterns:
+//          - '^(?P<time>\S+) \[(?P<level>\w+)\] (?P<text>.*)$'
+//          - '^(?P<level>\w+): (?P<text>.*)$'
+//        MissAction: drop
+type RegexExtract struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	patterns             []*regexp.Regexp
+	toJSON               bool
+	prefix               string `config:"Prefix"`
+	messageField         string `config:"MessageField" default:"message"`
+	patternField         string `config:"PatternField"`
+	missAction           string
+	missField            string `config:"MissField" default:"regex_miss"`
+	missStreamID         core.MessageStreamID
+}
+
+func init() {
+	core.TypeRegistry.Register(RegexExtract{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *RegexExtract) Configure(conf core.PluginConfigReader) {
+	for _, pattern := range conf.GetStringArray("Patterns", []string{}) {
+		expression, err := regexp.Compile(pattern)
+		if err != nil {
+			conf.Errors.Pushf("Invalid pattern '%s': %s", pattern, err)
+			continue
+		}
+		format.patterns = append(format.patterns, expression)
+	}
+	if len(format.patterns) == 0 {
+		format.Logger.Warning("No Patterns set, messages are not changed")
+	}
+
+	switch target := strings.ToLower(conf.GetString("Target", "metadata")); target {
+	case "metadata":
+	case "json":
+		format.toJSON = true
+	default:
+		conf.Errors.Pushf("Unknown target '%s'", target)
+	}
+
+	format.missAction = strings.ToLower(conf.GetString("MissAction", "keep"))
+	switch format.missAction {
+	case "keep", "drop", "annotate":
+	case "route":
+		format.missStreamID = core.GetStreamID(conf.GetString("MissStream", "unmatched"))
+	default:
+		conf.Errors.Pushf("Unknown miss action '%s'", format.missAction)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *RegexExtract) ApplyFormatter(msg *core.Message) error {
+	if len(format.patterns) == 0 {
+		return nil
+	}
+	content := format.GetAppliedContent(msg)
+
+	for index, pattern := range format.patterns {
+		matches := pattern.FindSubmatchIndex(content)
+		if matches == nil {
+			continue
+		}
+
+		if format.patternField != "" {
+			msg.GetMetadata().SetValue(format.patternField, []byte(strconv.Itoa(index)))
+		}
+		if format.toJSON {
+			return format.writeJSON(msg, content, pattern, matches)
+		}
+		format.writeMetadata(msg, content, pattern, matches)
+		return nil
+	}
+
+	switch format.missAction {
+	case "keep":
+		return nil
+	case "drop":
+		return fmt.Errorf("message does not match any pattern")
+	case "route":
+		msg.SetStreamID(format.missStreamID)
+	}
+	msg.GetMetadata().SetValue(format.missField, []byte("true"))
+	return nil
+}
+
+func (format *RegexExtract) writeMetadata(msg *core.Message, content []byte, pattern *regexp.Regexp, matches []int) {
+	metadata := msg.GetMetadata()
+	for group, name := range pattern.SubexpNames() {
+		if name == "" || matches[group*2] < 0 {
+			continue
+		}
+		value := make([]byte, matches[group*2+1]-matches[group*2])
+		copy(value, content[matches[group*2]:matches[group*2+1]])
+		metadata.SetValue(format.prefix+name, value)
+	}
+}
+
+func (format *RegexExtract) writeJSON(msg *core.Message, content []byte, pattern *regexp.Regexp, matches []int) error {
+	values := make(map[string]interface{})
+	if format.messageField != "" {
+		values[format.messageField] = string(content)
+	}
+	for group, name := range pattern.SubexpNames() {
+		if name == "" || matches[group*2] < 0 {
+			continue
+		}
+		values[format.prefix+name] = string(content[matches[group*2]:matches[group*2+1]])
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	format.SetAppliedContent(msg, data)
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+var testRegexExtractPatterns = []string{
+	`^(?P<time>\S+) \[(?P<level>\w+)\] (?P<text>.*)$`,
+	`^(?P<level>\w+): (?P<text>.*?)(?: \((?P<code>\d+)\))?$`,
+}
+
+func TestRegexExtractMetadata(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.RegexExtract")
+	config.Override("Patterns", testRegexExtractPatterns)
+	config.Override("Prefix", "log_")
+	config.Override("PatternField", "pattern")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*RegexExtract)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("12:00:01 [WARN] disk full"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	metadata := msg.GetMetadata()
+	expect.Equal("12:00:01", metadata.GetValueString("log_time"))
+	expect.Equal("WARN", metadata.GetValueString("log_level"))
+	expect.Equal("disk full", metadata.GetValueString("log_text"))
+	expect.Equal("0", metadata.GetValueString("pattern"))
+	expect.Equal("12:00:01 [WARN] disk full", msg.String())
+
+	msg = core.NewMessage(nil, []byte("error: timeout"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	metadata = msg.GetMetadata()
+	expect.Equal("error", metadata.GetValueString("log_level"))
+	expect.Equal("timeout", metadata.GetValueString("log_text"))
+	expect.Equal("1", metadata.GetValueString("pattern"))
+	_, exists := metadata.TryGetValue("log_code")
+	expect.False(exists)
+}
+
+func TestRegexExtractJSON(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.RegexExtract")
+	config.Override("Patterns", testRegexExtractPatterns)
+	config.Override("Target", "json")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*RegexExtract)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("error: timeout (504)"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"code":"504","level":"error","message":"error: timeout (504)","text":"timeout"}`, msg.String())
+}
+
+func TestRegexExtractMiss(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.RegexExtract")
+	config.Override("Patterns", testRegexExtractPatterns)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*RegexExtract)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("no match"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Nil(msg.TryGetMetadata())
+
+	config = core.NewPluginConfig("", "format.RegexExtract")
+	config.Override("Patterns", testRegexExtractPatterns)
+	config.Override("MissAction", "drop")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted = plugin.(*RegexExtract)
+	expect.True(casted)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NotNil(err)
+
+	config = core.NewPluginConfig("", "format.RegexExtract")
+	config.Override("Patterns", testRegexExtractPatterns)
+	config.Override("MissAction", "route")
+	config.Override("MissStream", "other")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted = plugin.(*RegexExtract)
+	expect.True(casted)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(core.GetStreamID("other"), msg.GetStreamID())
+	expect.Equal("true", msg.GetMetadata().GetValueString("regex_miss"))
+}
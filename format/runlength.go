@@ -15,7 +15,9 @@
 package format
 
 import (
+	"encoding/binary"
 	"strconv"
+	"strings"
 
 	"github.com/trivago/gollum/core"
 )
@@ -27,6 +29,12 @@ import (
 //
 // Parameters
 //
+// - Framing: Defines how the length is written. "ascii" writes the length as
+// decimal number followed by Separator. "uint32" writes the length as 4 byte
+// big endian integer. "varint" writes the length as unsigned varint as used
+// by protocol buffers. No separator is written for binary framings.
+// By default this parameter is set to "ascii".
+//
 // - Separator: This value is used as separator.
 // By default this parameter is set to ":".
 //
@@ -51,10 +59,21 @@ import (
 //        ApplyTo: length
 //        StoreRunlengthOnly: true
 //
+// This example sends messages with a varint length prefix as expected by
+// readers of delimited protocol buffer streams.
+//
+//  exampleProducer:
+//    Type: producer.Socket
+//    Streams: "*"
+//    Modulators:
+//      - format.Runlength:
+//        Framing: varint
+//
 type Runlength struct {
 	core.SimpleFormatter `gollumdoc:"embed_type"`
 	separator            []byte `config:"Separator" default:":"`
 	storeRunlengthOnly   bool   `config:"StoreRunlengthOnly" default:"false"`
+	writeLength          func([]byte, int) []byte
 }
 
 func init() {
@@ -63,26 +82,49 @@ func init() {
 
 // Configure initializes this formatter with values from a plugin config.
 func (format *Runlength) Configure(conf core.PluginConfigReader) {
+	switch framing := strings.ToLower(conf.GetString("Framing", "ascii")); framing {
+	case "ascii":
+		format.writeLength = runlengthWriteASCII
+	case "uint32":
+		format.writeLength = runlengthWriteUint32
+		format.separator = nil
+	case "varint":
+		format.writeLength = runlengthWriteVarint
+		format.separator = nil
+	default:
+		conf.Errors.Pushf("Unknown framing '%s'", framing)
+	}
 }
 
 // ApplyFormatter update message payload
 func (format *Runlength) ApplyFormatter(msg *core.Message) error {
 	content := format.GetAppliedContent(msg)
-	contentLen := len(content)
-	lengthStr := strconv.Itoa(contentLen)
 
 	var payload []byte
 	if !format.storeRunlengthOnly {
-		dataSize := len(lengthStr) + len(format.separator) + contentLen
-		payload = make([]byte, dataSize)
-
-		offset := copy(payload, []byte(lengthStr))
-		offset += copy(payload[offset:], format.separator)
-		copy(payload[offset:], content)
+		payload = make([]byte, 0, binary.MaxVarintLen64+len(format.separator)+len(content))
+		payload = format.writeLength(payload, len(content))
+		payload = append(payload, format.separator...)
+		payload = append(payload, content...)
 	} else {
-		payload = []byte(lengthStr)
+		payload = format.writeLength(nil, len(content))
 	}
 
 	format.SetAppliedContent(msg, payload)
 	return nil
 }
+
+func runlengthWriteASCII(buffer []byte, length int) []byte {
+	return strconv.AppendInt(buffer, int64(length), 10)
+}
+
+func runlengthWriteUint32(buffer []byte, length int) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(length))
+	return append(buffer, header...)
+}
+
+func runlengthWriteVarint(buffer []byte, length int) []byte {
+	header := make([]byte, binary.MaxVarintLen64)
+	return append(buffer, header[:binary.PutUvarint(header, uint64(length))]...)
+}
@@ -80,3 +80,30 @@ func TestRunlengthApplyToAndStoreRunlengthOnly(t *testing.T) {
 	expect.Equal("PAYLOAD", string(msg.GetPayload()))
 	expect.Equal("4", msg.GetMetadata().GetValueString("foo"))
 }
+
+func TestRunlengthBinaryFraming(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	payload := make([]byte, 300)
+
+	tests := map[string][]byte{
+		"uint32": {0x00, 0x00, 0x01, 0x2c},
+		"varint": {0xac, 0x02},
+	}
+
+	for framing, header := range tests {
+		config := core.NewPluginConfig("", "format.Runlength")
+		config.Override("Framing", framing)
+		plugin, err := core.NewPluginWithConfig(config)
+		expect.NoError(err)
+
+		formatter, casted := plugin.(*Runlength)
+		expect.True(casted)
+
+		msg := core.NewMessage(nil, payload, nil, core.InvalidStreamID)
+		err = formatter.ApplyFormatter(msg)
+		expect.NoError(err)
+
+		expect.Equal(len(header)+len(payload), len(msg.GetPayload()))
+		expect.Equal(header, msg.GetPayload()[:len(header)])
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/trivago/gollum/core"
+)
+
+// Sanitize formatter
+//
+// This formatter removes ANSI escape sequences, e.g. color codes, and
+// non-printable control characters from the content. It can also replace
+// invalid UTF-8 and normalize line endings. This is useful for logs captured
+// from terminals.
+//
+// Parameters
+//
+// - StripANSI: When set to true, ANSI escape sequences are removed. This
+// covers CSI sequences like colors and cursor movement, OSC sequences like
+// window titles and all other escape sequences.
+// By default this parameter is set to true.
+//
+// - StripControl: When set to true, control characters other than tab and
+// line breaks are removed. This includes DEL and the C1 control characters.
+// By default this parameter is set to true.
+//
+// - ValidUTF8: When set to true, invalid UTF-8 byte sequences are replaced
+// by Replacement.
+// By default this parameter is set to true.
+//
+// - Replacement: Defines the string invalid UTF-8 byte sequences are
+// replaced by.
+// By default this parameter is set to "�".
+//
+// - LineEndings: Defines how line endings are written. "keep" does not
+// change them, "lf" converts "\r\n" and "\r" to "\n" and "crlf" converts
+// "\n" and "\r" to "\r\n".
+// By default this parameter is set to "lf".
+//
+// Examples
+//
+// This example removes colors and control characters from console output:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Sanitize:
+//        Replacement: "?"
+type Sanitize struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	stripANSI            bool   `config:"StripANSI" default:"true"`
+	stripControl         bool   `config:"StripControl" default:"true"`
+	validUTF8            bool   `config:"ValidUTF8" default:"true"`
+	replacement          []byte `config:"Replacement" default:"�"`
+	newline              []byte
+	keepLineEndings      bool
+}
+
+func init() {
+	core.TypeRegistry.Register(Sanitize{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Sanitize) Configure(conf core.PluginConfigReader) {
+	switch mode := strings.ToLower(conf.GetString("LineEndings", "lf")); mode {
+	case "keep":
+		format.keepLineEndings = true
+	case "lf":
+		format.newline = []byte("\n")
+	case "crlf":
+		format.newline = []byte("\r\n")
+	default:
+		conf.Errors.Pushf("Unknown line ending mode '%s'", mode)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Sanitize) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+	result := make([]byte, 0, len(content))
+
+	for i := 0; i < len(content); {
+		switch b := content[i]; {
+		case b == '\x1b' && format.stripANSI:
+			i = sanitizeSkipEscape(content, i)
+
+		case b == '\r' || b == '\n':
+			end := i + 1
+			if b == '\r' && end < len(content) && content[end] == '\n' {
+				end++
+			}
+			if format.keepLineEndings {
+				result = append(result, content[i:end]...)
+			} else {
+				result = append(result, format.newline...)
+			}
+			i = end
+
+		case b < utf8.RuneSelf:
+			if !format.stripControl || b >= ' ' && b != '\x7f' || b == '\t' {
+				result = append(result, b)
+			}
+			i++
+
+		default:
+			r, size := utf8.DecodeRune(content[i:])
+			switch {
+			case r == utf8.RuneError && size == 1:
+				if format.validUTF8 {
+					result = append(result, format.replacement...)
+				} else {
+					result = append(result, b)
+				}
+			case r >= '\u0080' && r <= '\u009f' && format.stripControl:
+			default:
+				result = append(result, content[i:i+size]...)
+			}
+			i += size
+		}
+	}
+
+	format.SetAppliedContent(msg, result)
+	return nil
+}
+
+// sanitizeSkipEscape returns the position after the escape sequence starting
+// at the given position. Unterminated sequences end with the content.
+func sanitizeSkipEscape(content []byte, pos int) int {
+	pos++
+	if pos >= len(content) {
+		return pos
+	}
+
+	switch introducer := content[pos]; {
+	case introducer == '[':
+		// CSI: parameter bytes, intermediate bytes and one final byte
+		pos++
+		for pos < len(content) && content[pos] >= 0x30 && content[pos] <= 0x3f {
+			pos++
+		}
+		for pos < len(content) && content[pos] >= 0x20 && content[pos] <= 0x2f {
+			pos++
+		}
+		if pos < len(content) && content[pos] >= 0x40 && content[pos] <= 0x7e {
+			pos++
+		}
+		return pos
+
+	case introducer == ']' || introducer == 'P' || introducer == 'X' || introducer == '^' || introducer == '_':
+		// OSC and other strings are terminated by BEL or ESC \
+		for pos++; pos < len(content); pos++ {
+			if content[pos] == '\a' {
+				return pos + 1
+			}
+			if content[pos] == '\x1b' && pos+1 < len(content) && content[pos+1] == '\\' {
+				return pos + 2
+			}
+		}
+		return pos
+
+	case introducer >= 0x20 && introducer <= 0x2f:
+		// nF sequences: intermediate bytes and one final byte
+		for pos < len(content) && content[pos] >= 0x20 && content[pos] <= 0x2f {
+			pos++
+		}
+		if pos < len(content) {
+			pos++
+		}
+		return pos
+
+	default:
+		return pos + 1
+	}
+}
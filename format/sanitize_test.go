@@ -0,0 +1,72 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestSanitize(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Sanitize")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Sanitize)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("\x1b]0;title\a\x1b[1;31mred\x1b[0m\tbell\a\x00 ok\x1b(B\r\nnext\rlast\xff\u0085ü"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal("red\tbell ok\nnext\nlast�ü", msg.String())
+}
+
+func TestSanitizeOptions(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Sanitize")
+	config.Override("StripANSI", false)
+	config.Override("ValidUTF8", false)
+	config.Override("LineEndings", "crlf")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Sanitize)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("\x1b[31mred\x00\xff\nnext\r\n"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal("[31mred\xff\r\nnext\r\n", msg.String())
+
+	config = core.NewPluginConfig("", "format.Sanitize")
+	config.Override("StripControl", false)
+	config.Override("LineEndings", "keep")
+	config.Override("Replacement", "?")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted = plugin.(*Sanitize)
+	expect.True(casted)
+
+	msg = core.NewMessage(nil, []byte("\x1b[31mred\x00\xff\nnext\r\n"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal("red\x00?\nnext\r\n", msg.String())
+}
@@ -0,0 +1,268 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Script formatter
+//
+// This formatter runs a Lua 5.1 script for each message. The script has to
+// define a function that is called with a table describing the message:
+//
+//  - payload: the message payload, respectively the field set by ApplyTo
+//  - metadata: a table holding all metadata fields
+//  - stream: the name of the stream the message is routed to
+//  - timestamp: the creation time of the message in seconds since 1970-01-01
+//
+// Changes made to this table are applied to the message. Changing the stream
+// routes the message to the given stream. If the function returns false, the
+// message is discarded.
+//
+// Scripts run in a sandbox that only provides the base, string, table and
+// math libraries. Functions accessing the file system, like dofile or require,
+// are not available. Each script instance runs single threaded, so global
+// variables can be used to keep state between messages of the same instance.
+// As multiple instances may run in parallel, state is not shared between all
+// messages.
+//
+// Parameters
+//
+// - Script: Defines the Lua source code.
+// By default this parameter is set to "".
+//
+// - ScriptFile: Defines a file to read the Lua source code from. Only used if
+// Script is not set. If neither is set, messages are not changed.
+// By default this parameter is set to "".
+//
+// - Function: Defines the name of the function called for each message.
+// By default this parameter is set to "process".
+//
+// - TimeoutMs: Defines the maximum time in milliseconds a script may run for
+// a single message. Messages exceeding this limit are discarded.
+// By default this parameter is set to 100.
+//
+// - MaxCallStackSize: Defines the maximum depth of nested function calls.
+// By default this parameter is set to 256.
+//
+// Examples
+//
+// This example drops debug messages and moves the user name into metadata:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Script:
+//        Script: |
+//          function process(msg)
+//            if string.find(msg.payload, "DEBUG") then
+//              return false
+//            end
+//            local user = string.match(msg.payload, "user=(%w+)")
+//            if user then
+//              msg.metadata.user = user
+//            end
+//          end
+type Script struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	source               string
+	function             string        `config:"Function" default:"process"`
+	timeout              time.Duration `config:"TimeoutMs" default:"100" metric:"ms"`
+	callStackSize        int           `config:"MaxCallStackSize" default:"256"`
+	states               sync.Pool
+}
+
+func init() {
+	core.TypeRegistry.Register(Script{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Script) Configure(conf core.PluginConfigReader) {
+	format.source = conf.GetString("Script", "")
+	if format.source == "" {
+		if path := conf.GetString("ScriptFile", ""); path != "" {
+			data, err := ioutil.ReadFile(path)
+			if conf.Errors.Push(err) {
+				return
+			}
+			format.source = string(data)
+		}
+	}
+
+	if format.source == "" {
+		format.Logger.Warning("Neither Script nor ScriptFile set, messages are not changed")
+		return
+	}
+
+	// Create the first state to report script errors during startup
+	state, err := format.newState()
+	if err != nil {
+		conf.Errors.Pushf("Failed to load script: %s", err)
+		return
+	}
+	format.states.Put(state)
+}
+
+// ApplyFormatter update message payload
+func (format *Script) ApplyFormatter(msg *core.Message) error {
+	if format.source == "" {
+		return nil
+	}
+
+	state, isState := format.states.Get().(*lua.LState)
+	if !isState {
+		var err error
+		if state, err = format.newState(); err != nil {
+			format.Logger.Warning("Script failed to load: ", err)
+			return err
+		}
+	}
+
+	keep, err := format.call(state, msg)
+	if err != nil {
+		// The state may be left in an inconsistent state, e.g. after a timeout
+		state.Close()
+		format.Logger.Warning("Script failed to process a message: ", err)
+		return err
+	}
+	format.states.Put(state)
+
+	if !keep {
+		return fmt.Errorf("message discarded by script")
+	}
+	return nil
+}
+
+func (format *Script) call(state *lua.LState, msg *core.Message) (bool, error) {
+	streamName := core.StreamRegistry.GetStreamName(msg.GetStreamID())
+	timestamp := float64(msg.GetCreationTime().UnixNano()) / float64(time.Second)
+
+	metadata := state.NewTable()
+	if msgMetadata := msg.TryGetMetadata(); msgMetadata != nil {
+		for key, value := range msgMetadata {
+			metadata.RawSetString(key, lua.LString(value))
+		}
+	}
+
+	table := state.NewTable()
+	table.RawSetString("payload", lua.LString(format.GetAppliedContent(msg)))
+	table.RawSetString("metadata", metadata)
+	table.RawSetString("stream", lua.LString(streamName))
+	table.RawSetString("timestamp", lua.LNumber(timestamp))
+
+	ctx, cancel := context.WithTimeout(context.Background(), format.timeout)
+	defer cancel()
+	state.SetContext(ctx)
+	defer state.RemoveContext()
+
+	err := state.CallByParam(lua.P{
+		Fn:      state.GetGlobal(format.function),
+		NRet:    1,
+		Protect: true,
+	}, table)
+	if err != nil {
+		return false, err
+	}
+
+	result := state.Get(-1)
+	state.Pop(1)
+	if result == lua.LFalse {
+		return false, nil
+	}
+
+	payload, isString := table.RawGetString("payload").(lua.LString)
+	if !isString {
+		return false, fmt.Errorf("payload must be a string")
+	}
+	format.SetAppliedContent(msg, []byte(payload))
+
+	newMetadata := make(core.Metadata)
+	if metadata, isTable := table.RawGetString("metadata").(*lua.LTable); isTable {
+		metadata.ForEach(func(key, value lua.LValue) {
+			newMetadata.SetValue(key.String(), []byte(value.String()))
+		})
+	}
+	if len(newMetadata) > 0 || msg.TryGetMetadata() != nil {
+		metadata := msg.GetMetadata()
+		for key := range metadata {
+			if _, exists := newMetadata[key]; !exists {
+				metadata.Delete(key)
+			}
+		}
+		for key, value := range newMetadata {
+			metadata.SetValue(key, value)
+		}
+	}
+
+	if stream, isString := table.RawGetString("stream").(lua.LString); isString && string(stream) != streamName {
+		msg.SetStreamID(core.GetStreamID(string(stream)))
+	}
+
+	if newTimestamp, isNumber := table.RawGetString("timestamp").(lua.LNumber); isNumber && float64(newTimestamp) != timestamp {
+		seconds, fraction := math.Modf(float64(newTimestamp))
+		msg.SetCreationTime(time.Unix(int64(seconds), int64(fraction*float64(time.Second))))
+	}
+	return true, nil
+}
+
+// newState creates a sandboxed Lua state and runs the script in it.
+func (format *Script) newState() (*lua.LState, error) {
+	state := lua.NewState(lua.Options{
+		SkipOpenLibs:  true,
+		CallStackSize: format.callStackSize,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		state.SetGlobal(name, lua.LNil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), format.timeout)
+	defer cancel()
+	state.SetContext(ctx)
+	defer state.RemoveContext()
+
+	if err := state.DoString(format.source); err != nil {
+		state.Close()
+		return nil, err
+	}
+	if _, isFunction := state.GetGlobal(format.function).(*lua.LFunction); !isFunction {
+		state.Close()
+		return nil, fmt.Errorf("function '%s' is not defined", format.function)
+	}
+	return state, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestScriptTransform(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Script")
+	config.Override("Script", `
+		count = 0
+		function process(msg)
+			count = count + 1
+			msg.payload = string.upper(msg.payload)
+			msg.metadata.user = string.match(msg.metadata.line, "user=(%w+)")
+			msg.metadata.line = nil
+			msg.metadata.count = count
+			msg.stream = "scripted"
+			msg.timestamp = 1520139967.5
+		end`)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Script)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("hello"), core.Metadata{"line": []byte("a user=jane b")}, core.GetStreamID("original"))
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	expect.Equal("HELLO", msg.String())
+	expect.Equal("jane", msg.GetMetadata().GetValueString("user"))
+	expect.Equal("1", msg.GetMetadata().GetValueString("count"))
+	_, exists := msg.GetMetadata().TryGetValue("line")
+	expect.False(exists)
+	expect.Equal(core.GetStreamID("scripted"), msg.GetStreamID())
+	expect.Equal(time.Unix(1520139967, 500000000).UnixNano(), msg.GetCreationTime().UnixNano())
+}
+
+func TestScriptDiscard(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Script")
+	config.Override("Script", `
+		function filter(msg)
+			return string.find(msg.payload, "DEBUG") == nil
+		end`)
+	config.Override("Function", "filter")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Script)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("INFO test"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal("INFO test", msg.String())
+
+	msg = core.NewMessage(nil, []byte("DEBUG test"), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
+
+func TestScriptTimeout(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Script")
+	config.Override("Script", `
+		function process(msg)
+			if msg.payload == "loop" then
+				while true do end
+			end
+		end`)
+	config.Override("TimeoutMs", 20)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Script)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("loop"), nil, core.InvalidStreamID)
+	start := time.Now()
+	expect.NotNil(formatter.ApplyFormatter(msg))
+	expect.Less(int64(time.Since(start)), int64(time.Second))
+
+	msg = core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+}
+
+func TestScriptSandbox(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	for _, script := range []string{
+		`dofile("/etc/passwd") function process(msg) end`,
+		`os.exit(1) function process(msg) end`,
+		`function other(msg) end`,
+		`function process(msg)`,
+	} {
+		config := core.NewPluginConfig("", "format.Script")
+		config.Override("Script", script)
+		_, err := core.NewPluginWithConfig(config)
+		expect.NotNil(err)
+	}
+}
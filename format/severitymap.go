@@ -0,0 +1,266 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/trivago/gollum/core"
+)
+
+// severityMapLevels contains the canonical levels known by format.SeverityMap
+// and their syslog severity.
+var severityMapLevels = map[string]int{
+	"trace": 7,
+	"debug": 7,
+	"info":  6,
+	"warn":  4,
+	"error": 3,
+	"fatal": 2,
+}
+
+// severityMapAliases maps common level names to canonical levels.
+var severityMapAliases = map[string]string{
+	"trc":           "trace",
+	"trace":         "trace",
+	"finest":        "trace",
+	"dbg":           "debug",
+	"debug":         "debug",
+	"fine":          "debug",
+	"inf":           "info",
+	"info":          "info",
+	"information":   "info",
+	"informational": "info",
+	"notice":        "info",
+	"wrn":           "warn",
+	"warn":          "warn",
+	"warning":       "warn",
+	"err":           "error",
+	"error":         "error",
+	"severe":        "error",
+	"crit":          "fatal",
+	"critical":      "fatal",
+	"ftl":           "fatal",
+	"fatal":         "fatal",
+	"panic":         "fatal",
+	"alert":         "fatal",
+	"emerg":         "fatal",
+	"emergency":     "fatal",
+}
+
+// severityMapSyslog maps syslog severities to canonical levels.
+var severityMapSyslog = []string{"fatal", "fatal", "fatal", "error", "warn", "info", "info", "debug"}
+
+// severityMapColors contains the ANSI colors used for each canonical level.
+var severityMapColors = map[string]string{
+	"trace": "\x1b[90m",
+	"debug": "\x1b[36m",
+	"info":  "\x1b[32m",
+	"warn":  "\x1b[33m",
+	"error": "\x1b[31m",
+	"fatal": "\x1b[1;31m",
+}
+
+// SeverityMap formatter
+//
+// This formatter detects the log level of a message and normalizes it to one
+// of the canonical levels "trace", "debug", "info", "warn", "error" and
+// "fatal". The level is written to a metadata field so that it can be used
+// for routing and filtering.
+//
+// Common names like "warning", "err", "crit" or "notice" as well as syslog
+// severities from 0 to 7 are recognized. Case is ignored.
+//
+// Parameters
+//
+// - Field: Defines the field of a JSON object holding the level. Nested
+// fields can be addressed by using "/" as a separator, e.g. "log/level". If
+// empty, the level is searched by using Pattern.
+// By default this parameter is set to "".
+//
+// - Pattern: Defines the regular expression used to find the level in the
+// content when Field is not set. The first capture group is used as level
+// or the whole match if there is no capture group.
+// By default this parameter is set to a pattern matching the first known
+// level name surrounded by word boundaries.
+//
+// - Aliases: Defines additional names mapped to a canonical level, e.g.
+// "W: warn". Names are case insensitive.
+// By default this parameter is set to an empty map.
+//
+// - Target: Defines the metadata field the canonical level is stored in.
+// By default this parameter is set to "level".
+//
+// - SyslogTarget: Defines the metadata field the syslog severity (0-7) of the
+// level is stored in. If empty, the syslog severity is not written.
+// By default this parameter is set to "".
+//
+// - Default: Defines the level used when no level was found. Set to "" to
+// leave messages without a level untouched.
+// By default this parameter is set to "".
+//
+// - Annotate: Defines how the content is annotated with the level. Valid
+// values are "" for no annotation, "prefix" to prepend "[LEVEL] " and
+// "color" to prepend the level and wrap the content in ANSI colors.
+// By default this parameter is set to "".
+//
+// Examples
+//
+// This example normalizes the level of JSON logs and marks errors in red:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.SeverityMap:
+//        Field: severity
+//        SyslogTarget: syslog_severity
+//        Default: info
+//        Annotate: color
+//        Aliases:
+//          "E": error
+//          "W": warn
+type SeverityMap struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	field                []string
+	pattern              *regexp.Regexp
+	aliases              map[string]string
+	target               string `config:"Target" default:"level"`
+	syslogTarget         string `config:"SyslogTarget"`
+	defaultLevel         string
+	annotate             string
+}
+
+func init() {
+	core.TypeRegistry.Register(SeverityMap{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *SeverityMap) Configure(conf core.PluginConfigReader) {
+	if field := conf.GetString("Field", ""); field != "" {
+		format.field = strings.Split(field, "/")
+	}
+
+	var err error
+	format.pattern, err = regexp.Compile(conf.GetString("Pattern",
+		`(?i)\b(trace|debug|info|notice|warn|warning|error|err|crit|critical|fatal|panic|alert|emerg|emergency)\b`))
+	conf.Errors.Push(err)
+
+	format.aliases = make(map[string]string, len(severityMapAliases))
+	for name, level := range severityMapAliases {
+		format.aliases[name] = level
+	}
+	for name, level := range conf.GetStringMap("Aliases", map[string]string{}) {
+		level = strings.ToLower(level)
+		if _, isCanonical := severityMapLevels[level]; !isCanonical {
+			conf.Errors.Pushf("Alias '%s' maps to unknown level '%s'", name, level)
+			continue
+		}
+		format.aliases[strings.ToLower(name)] = level
+	}
+
+	format.defaultLevel = strings.ToLower(conf.GetString("Default", ""))
+	if _, isCanonical := severityMapLevels[format.defaultLevel]; format.defaultLevel != "" && !isCanonical {
+		conf.Errors.Pushf("Unknown default level '%s'", format.defaultLevel)
+	}
+
+	format.annotate = strings.ToLower(conf.GetString("Annotate", ""))
+	switch format.annotate {
+	case "", "prefix", "color":
+	default:
+		conf.Errors.Pushf("Unknown annotation '%s'", format.annotate)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *SeverityMap) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+
+	level, found := format.normalize(format.detect(content))
+	if !found {
+		if format.defaultLevel == "" {
+			return nil
+		}
+		level = format.defaultLevel
+	}
+
+	metadata := msg.GetMetadata()
+	metadata.SetValue(format.target, []byte(level))
+	if format.syslogTarget != "" {
+		metadata.SetValue(format.syslogTarget, []byte(strconv.Itoa(severityMapLevels[level])))
+	}
+
+	switch format.annotate {
+	case "prefix":
+		format.SetAppliedContent(msg, append([]byte(fmt.Sprintf("[%s] ", strings.ToUpper(level))), content...))
+	case "color":
+		annotated := fmt.Sprintf("%s[%s] %s\x1b[0m", severityMapColors[level], strings.ToUpper(level), content)
+		format.SetAppliedContent(msg, []byte(annotated))
+	}
+	return nil
+}
+
+// detect returns the raw level found in the given content.
+func (format *SeverityMap) detect(content []byte) string {
+	if len(format.field) == 0 {
+		matches := format.pattern.FindSubmatch(content)
+		switch {
+		case len(matches) > 1:
+			return string(matches[1])
+		case len(matches) == 1:
+			return string(matches[0])
+		default:
+			return ""
+		}
+	}
+
+	values := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		format.Logger.Warning("SeverityMap failed to unmarshal a message: ", err)
+		return ""
+	}
+
+	parent, key := jsonTransformParent(values, format.field)
+	if parent == nil {
+		return ""
+	}
+	switch value := parent[key].(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	default:
+		return ""
+	}
+}
+
+// normalize maps a raw level to a canonical level.
+func (format *SeverityMap) normalize(raw string) (string, bool) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if level, exists := format.aliases[raw]; exists {
+		return level, true
+	}
+	if severity, err := strconv.Atoi(raw); err == nil && severity >= 0 && severity < len(severityMapSyslog) {
+		return severityMapSyslog[severity], true
+	}
+	return "", false
+}
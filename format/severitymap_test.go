@@ -0,0 +1,119 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestSeverityMapPattern(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.SeverityMap")
+	config.Override("SyslogTarget", "severity")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*SeverityMap)
+	expect.True(casted)
+
+	tests := map[string]string{
+		"2018-03-04 WARNING disk almost full": "warn",
+		"[crit] out of memory":                "fatal",
+		"Notice: user logged in":              "info",
+		"err: connection refused":             "error",
+	}
+
+	for payload, level := range tests {
+		msg := core.NewMessage(nil, []byte(payload), nil, core.InvalidStreamID)
+		err := formatter.ApplyFormatter(msg)
+		expect.NoError(err)
+		expect.Equal(level, msg.GetMetadata().GetValueString("level"))
+		expect.Equal(payload, msg.String())
+	}
+
+	msg := core.NewMessage(nil, []byte("no level here"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	_, exists := msg.GetMetadata().TryGetValue("level")
+	expect.False(exists)
+}
+
+func TestSeverityMapField(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.SeverityMap")
+	config.Override("Field", "log/level")
+	config.Override("SyslogTarget", "severity")
+	config.Override("Default", "info")
+	config.Override("Aliases", map[string]string{"W": "warn"})
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*SeverityMap)
+	expect.True(casted)
+
+	tests := map[string][2]string{
+		`{"log":{"level":"w"}}`:     {"warn", "4"},
+		`{"log":{"level":3}}`:       {"error", "3"},
+		`{"log":{"level":"FATAL"}}`: {"fatal", "2"},
+		`{"log":{}}`:                {"info", "6"},
+	}
+
+	for payload, expected := range tests {
+		msg := core.NewMessage(nil, []byte(payload), nil, core.InvalidStreamID)
+		err := formatter.ApplyFormatter(msg)
+		expect.NoError(err)
+		expect.Equal(expected[0], msg.GetMetadata().GetValueString("level"))
+		expect.Equal(expected[1], msg.GetMetadata().GetValueString("severity"))
+	}
+}
+
+func TestSeverityMapAnnotate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.SeverityMap")
+	config.Override("Annotate", "prefix")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*SeverityMap)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("debug: value is 1"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("[DEBUG] debug: value is 1", msg.String())
+
+	config = core.NewPluginConfig("", "format.SeverityMap")
+	config.Override("Annotate", "color")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted = plugin.(*SeverityMap)
+	expect.True(casted)
+
+	msg = core.NewMessage(nil, []byte("error"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("\x1b[31m[ERROR] error\x1b[0m", msg.String())
+}
@@ -0,0 +1,228 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+// Template formatter
+//
+// This formatter renders messages through a go template. The template
+// language is described in the go documentation:
+// https://golang.org/pkg/text/template/#hdr-Actions
+//
+// The following fields can be accessed from within the template:
+//
+//  - .Payload: the payload as a string
+//  - .Fields: the payload decoded as a JSON object, empty if the payload is
+//  not a JSON object
+//  - .Metadata: a map of all metadata values as strings
+//  - .Timestamp: the creation time of the message
+//  - .Hostname: the name of the host running gollum
+//  - .Stream: the name of the stream the message is currently routed to
+//
+// Besides the functions built into go templates, the following helper
+// functions are available:
+//
+//  - upper, lower, title, trim: change case or trim whitespace of a string
+//  - trimPrefix, trimSuffix <affix> <string>: remove an affix from a string
+//  - replace <old> <new> <string>: replace all occurrences of a string
+//  - contains, hasPrefix, hasSuffix <substring> <string>: test a string
+//  - split <separator> <string>: split a string into a list
+//  - join <separator> <list>: join a list into a string
+//  - default <default> <value>: return default if value is empty
+//  - quote <value>: return the value as a quoted string
+//  - toJson <value>: encode a value as JSON
+//  - b64enc, b64dec <string>: encode or decode base64
+//  - date <layout> <time>: format a time using a time.Format layout
+//  - unixEpoch <time>: return a time as unix timestamp in seconds
+//  - now: return the current time
+//  - env <name>: return the value of an environment variable
+//
+// Parameters
+//
+// - Template: Defines the go template to execute. If the template cannot be
+// executed the message is left unchanged.
+// By default this parameter is set to "{{.Payload}}".
+//
+// Examples
+//
+// This example writes messages with their timestamp, stream and the "level"
+// field of a JSON payload:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Template:
+//        Template: '{{date "2006-01-02 15:04:05" .Timestamp}} [{{.Stream}}] {{upper (default "info" .Fields.level)}} {{.Fields.message}}'
+type Template struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	template             *template.Template
+	hostname             string
+}
+
+type templateData struct {
+	Payload   string
+	Fields    map[string]interface{}
+	Metadata  map[string]string
+	Timestamp time.Time
+	Hostname  string
+	Stream    string
+}
+
+func init() {
+	core.TypeRegistry.Register(Template{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Template) Configure(conf core.PluginConfigReader) {
+	var err error
+	tpl := conf.GetString("Template", "{{.Payload}}")
+	format.template, err = template.New("Template").Funcs(templateFunctions).Parse(tpl)
+	conf.Errors.Push(err)
+
+	format.hostname, err = os.Hostname()
+	if err != nil {
+		format.Logger.WithError(err).Warning("Failed to read the hostname")
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *Template) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+	data := templateData{
+		Payload:   string(content),
+		Fields:    make(map[string]interface{}),
+		Metadata:  make(map[string]string),
+		Timestamp: msg.GetCreationTime(),
+		Hostname:  format.hostname,
+		Stream:    core.StreamRegistry.GetStreamName(msg.GetStreamID()),
+	}
+
+	if err := json.Unmarshal(content, &data.Fields); err != nil {
+		data.Fields = make(map[string]interface{})
+	}
+	if metadata := msg.TryGetMetadata(); metadata != nil {
+		for key, value := range metadata {
+			data.Metadata[key] = string(value)
+		}
+	}
+
+	var rendered bytes.Buffer
+	if err := format.template.Execute(&rendered, data); err != nil {
+		format.Logger.Warning("Template failed to render a message: ", err)
+		return err
+	}
+
+	format.SetAppliedContent(msg, rendered.Bytes())
+	return nil
+}
+
+// templateFunctions contains the helper functions available to templates.
+// Functions taking a string as the last argument allow pipelining, e.g.
+// {{.Payload | trimPrefix "x" | upper}}.
+var templateFunctions = template.FuncMap{
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      strings.Title,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, value string) string { return strings.TrimPrefix(value, prefix) },
+	"trimSuffix": func(suffix, value string) string { return strings.TrimSuffix(value, suffix) },
+	"replace":    func(old, new, value string) string { return strings.Replace(value, old, new, -1) },
+	"contains":   func(substr, value string) bool { return strings.Contains(value, substr) },
+	"hasPrefix":  func(prefix, value string) bool { return strings.HasPrefix(value, prefix) },
+	"hasSuffix":  func(suffix, value string) bool { return strings.HasSuffix(value, suffix) },
+	"split":      func(sep, value string) []string { return strings.Split(value, sep) },
+	"join":       templateJoin,
+	"default":    templateDefault,
+	"quote":      func(value interface{}) string { return strconv.Quote(templateToString(value)) },
+	"toJson":     templateToJSON,
+	"b64enc":     func(value string) string { return base64.StdEncoding.EncodeToString([]byte(value)) },
+	"b64dec":     templateBase64Decode,
+	"date":       func(layout string, value time.Time) string { return value.Format(layout) },
+	"unixEpoch":  func(value time.Time) int64 { return value.Unix() },
+	"now":        time.Now,
+	"env":        os.Getenv,
+}
+
+func templateToString(value interface{}) string {
+	switch typedValue := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typedValue
+	case []byte:
+		return string(typedValue)
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func templateJoin(sep string, list interface{}) string {
+	listValue := reflect.ValueOf(list)
+	if listValue.Kind() != reflect.Slice && listValue.Kind() != reflect.Array {
+		return templateToString(list)
+	}
+
+	items := make([]string, listValue.Len())
+	for i := range items {
+		items[i] = templateToString(listValue.Index(i).Interface())
+	}
+	return strings.Join(items, sep)
+}
+
+func templateDefault(defaultValue interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || value[0] == nil {
+		return defaultValue
+	}
+
+	valueMeta := reflect.ValueOf(value[0])
+	switch valueMeta.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if valueMeta.Len() == 0 {
+			return defaultValue
+		}
+	case reflect.Bool:
+		if !valueMeta.Bool() {
+			return defaultValue
+		}
+	}
+	return value[0]
+}
+
+func templateToJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+func templateBase64Decode(value string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	return string(data), err
+}
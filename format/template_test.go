@@ -0,0 +1,83 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"os"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestTemplate(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Template")
+	config.Override("Template", `{{upper (default "info" .Fields.level)}} {{.Fields.message | quote}} {{.Metadata.source}} {{join "," .Fields.tags}}`)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Template)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"message":"hello","tags":["a","b"]}`), core.Metadata{}, core.InvalidStreamID)
+	msg.GetMetadata().SetValue("source", []byte("test"))
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`INFO "hello" test a,b`, msg.String())
+}
+
+func TestTemplatePlainText(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Template")
+	config.Override("Template", `{{.Hostname}} {{.Payload | trimSuffix "!" | replace "l" "L"}} {{.Stream}}`)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Template)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("hello!"), nil, core.LogInternalStreamID)
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+
+	hostname, _ := os.Hostname()
+	expect.Equal(hostname+" heLLo "+core.LogInternalStream, msg.String())
+}
+
+func TestTemplateApplyTo(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Template")
+	config.Override("ApplyTo", "foo")
+	config.Override("Template", `{{b64enc .Payload}}`)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*Template)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("payload"), nil, core.InvalidStreamID)
+	msg.GetMetadata().SetValue("foo", []byte("bar"))
+
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("YmFy", msg.GetMetadata().GetValueString("foo"))
+	expect.Equal("payload", msg.String())
+}
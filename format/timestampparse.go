@@ -0,0 +1,309 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+// timestampParseLayouts contains the named layouts known by
+// format.TimestampParse.
+var timestampParseLayouts = map[string]string{
+	"rfc3339":     time.RFC3339Nano,
+	"rfc3339nano": time.RFC3339Nano,
+	"rfc1123":     time.RFC1123,
+	"rfc1123z":    time.RFC1123Z,
+	"rfc822":      time.RFC822,
+	"rfc822z":     time.RFC822Z,
+	"rfc850":      time.RFC850,
+	"ansic":       time.ANSIC,
+	"unixdate":    time.UnixDate,
+	"syslog":      time.Stamp,
+	"syslogmilli": time.StampMilli,
+	"syslogmicro": time.StampMicro,
+	"clf":         "02/Jan/2006:15:04:05 -0700",
+	"datetime":    "2006-01-02 15:04:05",
+}
+
+// timestampParseUnits contains the units of the numeric layouts known by
+// format.TimestampParse.
+var timestampParseUnits = map[string]time.Duration{
+	"unix":   time.Second,
+	"unixms": time.Millisecond,
+	"unixus": time.Microsecond,
+	"unixns": time.Nanosecond,
+}
+
+// TimestampParse formatter
+//
+// This formatter parses a timestamp by trying a list of layouts in the given
+// order and replaces it with the timestamp written in a common layout. If no
+// layout matches, the message is discarded.
+//
+// Layouts can be given as Go time layouts or by one of the following names:
+//
+//  - rfc3339, rfc3339nano: "2006-01-02T15:04:05.999999999Z07:00"
+//  - rfc1123: "Mon, 02 Jan 2006 15:04:05 MST"
+//  - rfc1123z: "Mon, 02 Jan 2006 15:04:05 -0700"
+//  - rfc822: "02 Jan 06 15:04 MST"
+//  - rfc822z: "02 Jan 06 15:04 -0700"
+//  - rfc850: "Monday, 02-Jan-06 15:04:05 MST"
+//  - ansic: "Mon Jan _2 15:04:05 2006"
+//  - unixdate: "Mon Jan _2 15:04:05 MST 2006"
+//  - syslog: "Jan _2 15:04:05"
+//  - syslogmilli: "Jan _2 15:04:05.000"
+//  - syslogmicro: "Jan _2 15:04:05.000000"
+//  - clf: "02/Jan/2006:15:04:05 -0700" as used by access logs
+//  - datetime: "2006-01-02 15:04:05"
+//  - unix, unixms, unixus, unixns: seconds, milliseconds, microseconds or
+//  nanoseconds since 1970-01-01 UTC. Seconds may contain a fraction.
+//
+// Timestamps without a year, like syslog timestamps, are assumed to be from
+// the current year unless this would place them more than one day in the
+// future. In this case the previous year is used.
+//
+// Parameters
+//
+// - Field: Defines the field of a JSON object holding the timestamp. Nested
+// fields can be addressed by using "/" as a separator, e.g. "event/time". If
+// empty, the whole content is parsed as timestamp.
+// By default this parameter is set to "".
+//
+// - Layouts: Defines the layouts to try in the given order.
+// By default this parameter is set to [rfc3339, syslog, clf, datetime, unix].
+//
+// - Timezone: Defines the timezone of timestamps that do not contain
+// timezone information. Must be a name of the IANA Time Zone database or
+// "Local".
+// By default this parameter is set to "UTC".
+//
+// - OutputLayout: Defines the layout of the written timestamp. Accepts the
+// same values as Layouts.
+// By default this parameter is set to "rfc3339".
+//
+// - OutputTimezone: Defines the timezone of the written timestamp.
+// By default this parameter is set to "UTC".
+//
+// - SetTimestamp: When set to true, the creation time of the message is set
+// to the parsed timestamp.
+// By default this parameter is set to false.
+//
+// Examples
+//
+// This example normalizes syslog and unix timestamps to RFC3339 and uses
+// them as message time:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.TimestampParse:
+//        Field: time
+//        Layouts:
+//          - rfc3339
+//          - syslog
+//          - unixms
+//        Timezone: Europe/Berlin
+//        SetTimestamp: true
+type TimestampParse struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	field                []string
+	layouts              []string
+	outputLayout         string
+	location             *time.Location
+	outputLocation       *time.Location
+	setTimestamp         bool `config:"SetTimestamp" default:"false"`
+}
+
+func init() {
+	core.TypeRegistry.Register(TimestampParse{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *TimestampParse) Configure(conf core.PluginConfigReader) {
+	if field := conf.GetString("Field", ""); field != "" {
+		format.field = strings.Split(field, "/")
+	}
+
+	for _, layout := range conf.GetStringArray("Layouts", []string{"rfc3339", "syslog", "clf", "datetime", "unix"}) {
+		format.layouts = append(format.layouts, timestampParseResolveLayout(layout))
+	}
+	if len(format.layouts) == 0 {
+		conf.Errors.Pushf("Layouts must not be empty")
+	}
+	format.outputLayout = timestampParseResolveLayout(conf.GetString("OutputLayout", "rfc3339"))
+
+	var err error
+	format.location, err = time.LoadLocation(conf.GetString("Timezone", "UTC"))
+	conf.Errors.Push(err)
+	format.outputLocation, err = time.LoadLocation(conf.GetString("OutputTimezone", "UTC"))
+	conf.Errors.Push(err)
+}
+
+// ApplyFormatter update message payload
+func (format *TimestampParse) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+
+	if len(format.field) == 0 {
+		timestamp, err := format.parse(string(bytes.TrimSpace(content)))
+		if err != nil {
+			format.Logger.Warning("TimestampParse failed to parse a timestamp: ", err)
+			return err
+		}
+		format.SetAppliedContent(msg, []byte(format.write(timestamp)))
+		format.updateMessage(msg, timestamp)
+		return nil
+	}
+
+	values := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		format.Logger.Warning("TimestampParse failed to unmarshal a message: ", err)
+		return err
+	}
+
+	parent, key := jsonTransformParent(values, format.field)
+	if parent == nil || parent[key] == nil {
+		err := fmt.Errorf("field %s not found", strings.Join(format.field, "/"))
+		format.Logger.Warning("TimestampParse failed to parse a timestamp: ", err)
+		return err
+	}
+
+	var text string
+	switch value := parent[key].(type) {
+	case string:
+		text = value
+	case json.Number:
+		text = value.String()
+	default:
+		err := fmt.Errorf("field %s is not a string or number", strings.Join(format.field, "/"))
+		format.Logger.Warning("TimestampParse failed to parse a timestamp: ", err)
+		return err
+	}
+
+	timestamp, err := format.parse(strings.TrimSpace(text))
+	if err != nil {
+		format.Logger.Warning("TimestampParse failed to parse a timestamp: ", err)
+		return err
+	}
+
+	output := format.write(timestamp)
+	if _, isNumeric := timestampParseUnits[format.outputLayout]; isNumeric {
+		parent[key] = json.Number(output)
+	} else {
+		parent[key] = output
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	format.SetAppliedContent(msg, data)
+	format.updateMessage(msg, timestamp)
+	return nil
+}
+
+func (format *TimestampParse) updateMessage(msg *core.Message, timestamp time.Time) {
+	if format.setTimestamp {
+		msg.SetCreationTime(timestamp)
+	}
+}
+
+// parse tries all layouts in order and returns the first timestamp parsed.
+func (format *TimestampParse) parse(text string) (time.Time, error) {
+	return timestampParseText(text, format.layouts, format.location)
+}
+
+// write formats a timestamp using the output layout.
+func (format *TimestampParse) write(timestamp time.Time) string {
+	return timestampParseWrite(timestamp, format.outputLayout, format.outputLocation)
+}
+
+// timestampParseText tries the given resolved layouts in order and returns
+// the first timestamp parsed. Timestamps without timezone are parsed in the
+// given location.
+func timestampParseText(text string, layouts []string, location *time.Location) (time.Time, error) {
+	for _, layout := range layouts {
+		if unit, isNumeric := timestampParseUnits[layout]; isNumeric {
+			if timestamp, ok := timestampParseNumber(text, unit); ok {
+				return timestamp, nil
+			}
+			continue
+		}
+
+		timestamp, err := time.ParseInLocation(layout, text, location)
+		if err != nil {
+			continue
+		}
+		if timestamp.Year() == 0 {
+			timestamp = timestampParseAddYear(timestamp, time.Now().In(location))
+		}
+		return timestamp, nil
+	}
+	return time.Time{}, fmt.Errorf("'%s' does not match any layout", text)
+}
+
+// timestampParseWrite formats a timestamp using the given resolved layout.
+func timestampParseWrite(timestamp time.Time, layout string, location *time.Location) string {
+	if unit, isNumeric := timestampParseUnits[layout]; isNumeric {
+		return strconv.FormatInt(timestamp.UnixNano()/int64(unit), 10)
+	}
+	return timestamp.In(location).Format(layout)
+}
+
+// timestampParseResolveLayout returns the layout registered for the given
+// name. Unknown names are treated as Go time layouts.
+func timestampParseResolveLayout(name string) string {
+	if layout, exists := timestampParseLayouts[strings.ToLower(name)]; exists {
+		return layout
+	}
+	if _, exists := timestampParseUnits[strings.ToLower(name)]; exists {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// timestampParseNumber parses a number of the given unit since the epoch.
+func timestampParseNumber(text string, unit time.Duration) (time.Time, bool) {
+	if value, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return time.Unix(0, value*int64(unit)).UTC(), true
+	}
+	if unit != time.Second {
+		return time.Time{}, false
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	seconds := int64(value)
+	return time.Unix(seconds, int64((value-float64(seconds))*float64(time.Second))).UTC(), true
+}
+
+// timestampParseAddYear sets the year of a timestamp parsed without year.
+func timestampParseAddYear(timestamp, now time.Time) time.Time {
+	withYear := timestamp.AddDate(now.Year(), 0, 0)
+	if withYear.Sub(now) > 24*time.Hour {
+		withYear = timestamp.AddDate(now.Year()-1, 0, 0)
+	}
+	return withYear
+}
@@ -0,0 +1,119 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestTimestampParseDefaultLayouts(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.TimestampParse")
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*TimestampParse)
+	expect.True(casted)
+
+	inputs := map[string]string{
+		"2018-03-04T05:06:07+02:00":  "2018-03-04T03:06:07Z",
+		"04/Mar/2018:05:06:07 +0100": "2018-03-04T04:06:07Z",
+		"2018-03-04 05:06:07":        "2018-03-04T05:06:07Z",
+		"1520139967":                 "2018-03-04T05:06:07Z",
+		"1520139967.5":               "2018-03-04T05:06:07.5Z",
+	}
+
+	for input, expected := range inputs {
+		msg := core.NewMessage(nil, []byte(input), nil, core.InvalidStreamID)
+		err = formatter.ApplyFormatter(msg)
+		expect.NoError(err)
+		expect.Equal(expected, msg.String())
+	}
+
+	msg := core.NewMessage(nil, []byte("yesterday"), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+	expect.Equal("yesterday", msg.String())
+}
+
+func TestTimestampParseField(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.TimestampParse")
+	config.Override("Field", "event/time")
+	config.Override("Layouts", []interface{}{"rfc3339", "unixms"})
+	config.Override("OutputLayout", "2006-01-02 15:04:05.000")
+	config.Override("OutputTimezone", "Europe/Berlin")
+	config.Override("SetTimestamp", true)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*TimestampParse)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"event":{"time":1520139967123},"id":12345678901234567890}`), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"event":{"time":"2018-03-04 06:06:07.123"},"id":12345678901234567890}`, msg.String())
+	expect.Equal(time.Unix(1520139967, 123000000).UnixNano(), msg.GetCreationTime().UnixNano())
+
+	msg = core.NewMessage(nil, []byte(`{"event":{}}`), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
+
+func TestTimestampParseUnixOutput(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.TimestampParse")
+	config.Override("Field", "time")
+	config.Override("Layouts", []interface{}{"Jan 2 2006 15:04"})
+	config.Override("Timezone", "America/New_York")
+	config.Override("OutputLayout", "unix")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+	formatter, casted := plugin.(*TimestampParse)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"time":"Mar 4 2018 00:06"}`), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal(`{"time":1520139960}`, msg.String())
+}
+
+func TestTimestampParseAddYear(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	now := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	syslog, err := time.Parse(time.Stamp, "Dec 31 23:59:59")
+	expect.NoError(err)
+	expect.Equal(time.Date(2017, 12, 31, 23, 59, 59, 0, time.UTC), timestampParseAddYear(syslog, now))
+
+	syslog, err = time.Parse(time.Stamp, "Jan  1 11:00:00")
+	expect.NoError(err)
+	expect.Equal(time.Date(2018, 1, 1, 11, 0, 0, 0, time.UTC), timestampParseAddYear(syslog, now))
+}
+
+func TestTimestampParseInvalidConfig(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.TimestampParse")
+	config.Override("Timezone", "Nowhere/Invalid")
+	_, err := core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
@@ -0,0 +1,220 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/trivago/gollum/core"
+)
+
+// URLParse formatter
+//
+// This formatter splits a URL into scheme, user, host, port, path, query and
+// fragment. Query parameters are decoded. Relative URLs like the request path
+// of an access log are supported, too. Messages holding an invalid URL are
+// discarded.
+//
+// Parameters
+//
+// - Field: Defines the field of a JSON object holding the URL. Nested fields
+// can be addressed by using "/" as a separator, e.g. "request/url". If empty,
+// the whole content is parsed as URL.
+// By default this parameter is set to "".
+//
+// - Target: Defines where the parts are written to. "metadata" stores each
+// part in a metadata field named Prefix followed by the name of the part.
+// The undecoded query is stored as Prefix followed by "query". Decoded query
+// parameters are stored as Prefix followed by "query_" and the name of
+// the parameter. Multiple values of a parameter are joined by ",". "json"
+// writes a JSON object holding all parts and an object of query parameters
+// to JSONField. Parameters given more than once are written as array.
+// By default this parameter is set to "metadata".
+//
+// - Prefix: Defines the prefix of the metadata fields written.
+// By default this parameter is set to "url_".
+//
+// - JSONField: Defines the field the JSON object is written to. Nested fields
+// can be addressed by using "/" as a separator. If empty, the field holding
+// the URL is replaced. If Field is empty, the content is always replaced.
+// By default this parameter is set to "".
+//
+// Examples
+//
+// This example replaces the URL in the field "request" by its parts:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.URLParse:
+//        Field: request
+//        Target: json
+//
+// This example stores the query parameters of a URL given as metadata in
+// further metadata fields:
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.URLParse:
+//        ApplyTo: url
+//        Prefix: ""
+type URLParse struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	field                []string
+	jsonField            []string
+	toJSON               bool
+	prefix               string `config:"Prefix" default:"url_"`
+}
+
+func init() {
+	core.TypeRegistry.Register(URLParse{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *URLParse) Configure(conf core.PluginConfigReader) {
+	if field := conf.GetString("Field", ""); field != "" {
+		format.field = strings.Split(field, "/")
+	}
+	if field := conf.GetString("JSONField", ""); field != "" {
+		format.jsonField = strings.Split(field, "/")
+	} else {
+		format.jsonField = format.field
+	}
+
+	switch target := strings.ToLower(conf.GetString("Target", "metadata")); target {
+	case "metadata":
+	case "json":
+		format.toJSON = true
+	default:
+		conf.Errors.Pushf("Unknown target '%s'", target)
+	}
+}
+
+// ApplyFormatter update message payload
+func (format *URLParse) ApplyFormatter(msg *core.Message) error {
+	content := format.GetAppliedContent(msg)
+
+	var values map[string]interface{}
+	rawURL := string(bytes.TrimSpace(content))
+
+	if len(format.field) > 0 {
+		values = make(map[string]interface{})
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&values); err != nil {
+			format.Logger.Warning("URLParse failed to unmarshal a message: ", err)
+			return err
+		}
+
+		parent, key := jsonTransformParent(values, format.field)
+		if parent == nil {
+			err := fmt.Errorf("field %s not found", strings.Join(format.field, "/"))
+			format.Logger.Warning("URLParse failed to parse a URL: ", err)
+			return err
+		}
+		text, isString := parent[key].(string)
+		if !isString {
+			err := fmt.Errorf("field %s is not a string", strings.Join(format.field, "/"))
+			format.Logger.Warning("URLParse failed to parse a URL: ", err)
+			return err
+		}
+		rawURL = strings.TrimSpace(text)
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		format.Logger.Warning("URLParse failed to parse a URL: ", err)
+		return err
+	}
+
+	if !format.toJSON {
+		format.writeMetadata(msg, parsed)
+		return nil
+	}
+
+	parts := urlParseParts(parsed)
+	if len(format.field) == 0 {
+		data, err := json.Marshal(parts)
+		if err != nil {
+			return err
+		}
+		format.SetAppliedContent(msg, data)
+		return nil
+	}
+
+	jsonTransformSet(values, format.jsonField, parts)
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	format.SetAppliedContent(msg, data)
+	return nil
+}
+
+func (format *URLParse) writeMetadata(msg *core.Message, parsed *url.URL) {
+	metadata := msg.GetMetadata()
+	for name, value := range urlParseParts(parsed) {
+		if name == "query" {
+			continue
+		}
+		metadata.SetValue(format.prefix+name, []byte(value.(string)))
+	}
+	if parsed.RawQuery != "" {
+		metadata.SetValue(format.prefix+"query", []byte(parsed.RawQuery))
+	}
+	for name, values := range parsed.Query() {
+		metadata.SetValue(format.prefix+"query_"+name, []byte(strings.Join(values, ",")))
+	}
+}
+
+// urlParseParts returns all non-empty parts of the given URL.
+func urlParseParts(parsed *url.URL) map[string]interface{} {
+	parts := make(map[string]interface{})
+	add := func(name, value string) {
+		if value != "" {
+			parts[name] = value
+		}
+	}
+
+	add("scheme", parsed.Scheme)
+	if parsed.User != nil {
+		add("user", parsed.User.Username())
+	}
+	add("host", parsed.Hostname())
+	add("port", parsed.Port())
+	add("path", parsed.Path)
+	add("fragment", parsed.Fragment)
+
+	if query := parsed.Query(); len(query) > 0 {
+		params := make(map[string]interface{}, len(query))
+		for name, values := range query {
+			if len(values) == 1 {
+				params[name] = values[0]
+			} else {
+				params[name] = values
+			}
+		}
+		parts["query"] = params
+	}
+	return parts
+}
@@ -0,0 +1,97 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestURLParseMetadata(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.URLParse")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*URLParse)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("https://ann@example.com:8443/a%20b?q=go+lang&tag=x&tag=y#top"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+
+	metadata := msg.GetMetadata()
+	expect.Equal("https", metadata.GetValueString("url_scheme"))
+	expect.Equal("ann", metadata.GetValueString("url_user"))
+	expect.Equal("example.com", metadata.GetValueString("url_host"))
+	expect.Equal("8443", metadata.GetValueString("url_port"))
+	expect.Equal("/a b", metadata.GetValueString("url_path"))
+	expect.Equal("top", metadata.GetValueString("url_fragment"))
+	expect.Equal("q=go+lang&tag=x&tag=y", metadata.GetValueString("url_query"))
+	expect.Equal("go lang", metadata.GetValueString("url_query_q"))
+	expect.Equal("x,y", metadata.GetValueString("url_query_tag"))
+
+	msg = core.NewMessage(nil, []byte("http://[::1"), nil, core.InvalidStreamID)
+	expect.NotNil(formatter.ApplyFormatter(msg))
+}
+
+func TestURLParseJSON(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.URLParse")
+	config.Override("Field", "request/url")
+	config.Override("Target", "json")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*URLParse)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte(`{"request":{"url":"/search?q=a&q=b"},"status":200}`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"request":{"url":{"path":"/search","query":{"q":["a","b"]}}},"status":200}`, msg.String())
+
+	config = core.NewPluginConfig("", "format.URLParse")
+	config.Override("Field", "url")
+	config.Override("Target", "json")
+	config.Override("JSONField", "url_parts")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted = plugin.(*URLParse)
+	expect.True(casted)
+
+	msg = core.NewMessage(nil, []byte(`{"url":"http://example.com/?a=1"}`), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"url":"http://example.com/?a=1","url_parts":{"host":"example.com","path":"/","query":{"a":"1"},"scheme":"http"}}`, msg.String())
+
+	config = core.NewPluginConfig("", "format.URLParse")
+	config.Override("Target", "json")
+
+	plugin, err = core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted = plugin.(*URLParse)
+	expect.True(casted)
+
+	msg = core.NewMessage(nil, []byte("ftp://example.com/file"), nil, core.InvalidStreamID)
+	expect.NoError(formatter.ApplyFormatter(msg))
+	expect.Equal(`{"host":"example.com","path":"/file","scheme":"ftp"}`, msg.String())
+}
@@ -0,0 +1,339 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/trivago/gollum/core"
+)
+
+// wasmMessageKey is the context key holding the message processed by a call
+// to a WebAssembly module.
+type wasmMessageKey struct{}
+
+// Wasm formatter
+//
+// This formatter passes each message to a WebAssembly module. This allows
+// custom processing logic written in any language compiling to WebAssembly
+// without recompiling gollum.
+//
+// The module has to export the following:
+//
+//  - memory: the linear memory used to exchange data
+//  - allocate(size i32) i32: returns a pointer to size bytes of memory that
+//  are used to pass the payload to the module
+//  - transform(ptr i32, len i32) i64: processes the payload stored at ptr and
+//  returns a pointer to the new payload in the upper 32 bits and its length in
+//  the lower 32 bits. Returning -1 discards the message.
+//  - deallocate(ptr i32, len i32): optional, called to release the input and
+//  output buffers after transform returned.
+//
+// The module can import the following functions from the module "gollum":
+//
+//  - get_metadata(key_ptr, key_len, buf_ptr, buf_len i32) i32: copies the
+//  metadata value of the given key to buf and returns its length. Returns -1
+//  if the key does not exist. If the value is larger than buf_len, nothing is
+//  copied.
+//  - set_metadata(key_ptr, key_len, value_ptr, value_len i32)
+//  - delete_metadata(key_ptr, key_len i32)
+//  - get_stream(buf_ptr, buf_len i32) i32: works like get_metadata for the
+//  name of the stream the message is routed to.
+//  - set_stream(name_ptr, name_len i32): routes the message to the given
+//  stream.
+//  - log(level, ptr, len i32): writes a message to the gollum log. Level 0 is
+//  debug, 1 is info, 2 is warning and 3 is error.
+//
+// Reactor modules exporting "_initialize" are initialized once per instance.
+// Each instance processes one message at a time. Additional instances are
+// created for messages processed in parallel, so state is not shared between
+// all messages.
+//
+// Parameters
+//
+// - Module: Defines the path to the WebAssembly module (.wasm). If not set,
+// messages are not changed.
+// By default this parameter is set to "".
+//
+// - TimeoutMs: Defines the maximum time in milliseconds a module may run for
+// a single message. Messages exceeding this limit are discarded.
+// By default this parameter is set to 100.
+//
+// - MaxMemoryPages: Defines the maximum size of the memory of a module
+// instance in pages of 64 KiB.
+// By default this parameter is set to 256.
+//
+// - EnableWASI: When set to true, the WebAssembly System Interface
+// (wasi_snapshot_preview1) is provided to modules. Modules do not have
+// access to the file system or environment variables.
+// By default this parameter is set to true.
+//
+// Examples
+//
+//  exampleConsumer:
+//    Type: consumer.Console
+//    Streams: "*"
+//    Modulators:
+//      - format.Wasm:
+//        Module: /etc/gollum/transform.wasm
+//        TimeoutMs: 50
+type Wasm struct {
+	core.SimpleFormatter `gollumdoc:"embed_type"`
+	timeout              time.Duration `config:"TimeoutMs" default:"100" metric:"ms"`
+	runtime              wazero.Runtime
+	compiled             wazero.CompiledModule
+	instances            sync.Pool
+}
+
+func init() {
+	core.TypeRegistry.Register(Wasm{})
+}
+
+// Configure initializes this formatter with values from a plugin config.
+func (format *Wasm) Configure(conf core.PluginConfigReader) {
+	path := conf.GetString("Module", "")
+	maxPages := conf.GetInt("MaxMemoryPages", 256)
+	enableWASI := conf.GetBool("EnableWASI", true)
+
+	if path == "" {
+		format.Logger.Warning("No Module set, messages are not changed")
+		return
+	}
+
+	binary, err := ioutil.ReadFile(path)
+	if conf.Errors.Push(err) {
+		return
+	}
+
+	ctx := context.Background()
+	format.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(uint32(maxPages)))
+
+	if enableWASI {
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, format.runtime); err != nil {
+			conf.Errors.Pushf("Failed to provide WASI: %s", err)
+			return
+		}
+	}
+	if err := format.instantiateHostModule(ctx); err != nil {
+		conf.Errors.Pushf("Failed to provide host functions: %s", err)
+		return
+	}
+
+	if format.compiled, err = format.runtime.CompileModule(ctx, binary); err != nil {
+		conf.Errors.Pushf("Failed to compile module: %s", err)
+		format.compiled = nil
+		return
+	}
+
+	// Create the first instance to report errors during startup
+	module, err := format.newInstance()
+	if err != nil {
+		conf.Errors.Pushf("Failed to instantiate module: %s", err)
+		format.compiled = nil
+		return
+	}
+	format.instances.Put(module)
+}
+
+// ApplyFormatter update message payload
+func (format *Wasm) ApplyFormatter(msg *core.Message) error {
+	if format.compiled == nil {
+		return nil
+	}
+
+	module, isModule := format.instances.Get().(api.Module)
+	if !isModule {
+		var err error
+		if module, err = format.newInstance(); err != nil {
+			format.Logger.Warning("Wasm failed to instantiate a module: ", err)
+			return err
+		}
+	}
+
+	keep, err := format.call(module, msg)
+	if err != nil {
+		// The instance may be left in an inconsistent state
+		module.Close(context.Background())
+		format.Logger.Warning("Wasm failed to process a message: ", err)
+		return err
+	}
+	format.instances.Put(module)
+
+	if !keep {
+		return fmt.Errorf("message discarded by module")
+	}
+	return nil
+}
+
+func (format *Wasm) call(module api.Module, msg *core.Message) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), wasmMessageKey{}, msg), format.timeout)
+	defer cancel()
+
+	content := format.GetAppliedContent(msg)
+	results, err := module.ExportedFunction("allocate").Call(ctx, uint64(len(content)))
+	if err != nil {
+		return false, err
+	}
+	inPtr := uint32(results[0])
+	if !module.Memory().Write(inPtr, content) {
+		return false, fmt.Errorf("allocated memory is out of range")
+	}
+
+	results, err = module.ExportedFunction("transform").Call(ctx, uint64(inPtr), uint64(len(content)))
+	if err != nil {
+		return false, err
+	}
+	if int64(results[0]) == -1 {
+		return false, format.deallocate(ctx, module, inPtr, uint32(len(content)))
+	}
+
+	outPtr, outLen := uint32(results[0]>>32), uint32(results[0])
+	output, inRange := module.Memory().Read(outPtr, outLen)
+	if !inRange {
+		return false, fmt.Errorf("returned payload is out of range")
+	}
+	format.SetAppliedContent(msg, append([]byte(nil), output...))
+
+	if err := format.deallocate(ctx, module, inPtr, uint32(len(content))); err != nil {
+		return false, err
+	}
+	if outPtr != inPtr {
+		if err := format.deallocate(ctx, module, outPtr, outLen); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (format *Wasm) deallocate(ctx context.Context, module api.Module, ptr, length uint32) error {
+	if deallocate := module.ExportedFunction("deallocate"); deallocate != nil {
+		_, err := deallocate.Call(ctx, uint64(ptr), uint64(length))
+		return err
+	}
+	return nil
+}
+
+func (format *Wasm) newInstance() (api.Module, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), format.timeout)
+	defer cancel()
+
+	module, err := format.runtime.InstantiateModule(ctx, format.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"allocate", "transform"} {
+		if module.ExportedFunction(name) == nil {
+			module.Close(ctx)
+			return nil, fmt.Errorf("function '%s' is not exported", name)
+		}
+	}
+	if module.Memory() == nil {
+		module.Close(ctx)
+		return nil, fmt.Errorf("memory is not exported")
+	}
+	return module, nil
+}
+
+// instantiateHostModule provides the functions modules can import from the
+// module "gollum".
+func (format *Wasm) instantiateHostModule(ctx context.Context) error {
+	readString := func(module api.Module, ptr, length uint32) string {
+		data, _ := module.Memory().Read(ptr, length)
+		return string(data)
+	}
+	writeValue := func(module api.Module, value []byte, ptr, length uint32) int32 {
+		if uint32(len(value)) <= length {
+			module.Memory().Write(ptr, value)
+		}
+		return int32(len(value))
+	}
+	getMessage := func(ctx context.Context) *core.Message {
+		msg, _ := ctx.Value(wasmMessageKey{}).(*core.Message)
+		return msg
+	}
+
+	_, err := format.runtime.NewHostModuleBuilder("gollum").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, module api.Module, keyPtr, keyLen, bufPtr, bufLen uint32) int32 {
+			if msg := getMessage(ctx); msg != nil {
+				if value, exists := msg.GetMetadata().TryGetValue(readString(module, keyPtr, keyLen)); exists {
+					return writeValue(module, value, bufPtr, bufLen)
+				}
+			}
+			return -1
+		}).
+		Export("get_metadata").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, module api.Module, keyPtr, keyLen, valuePtr, valueLen uint32) {
+			if msg := getMessage(ctx); msg != nil {
+				value, _ := module.Memory().Read(valuePtr, valueLen)
+				msg.GetMetadata().SetValue(readString(module, keyPtr, keyLen), append([]byte(nil), value...))
+			}
+		}).
+		Export("set_metadata").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, module api.Module, keyPtr, keyLen uint32) {
+			if msg := getMessage(ctx); msg != nil {
+				if metadata := msg.TryGetMetadata(); metadata != nil {
+					metadata.Delete(readString(module, keyPtr, keyLen))
+				}
+			}
+		}).
+		Export("delete_metadata").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, module api.Module, bufPtr, bufLen uint32) int32 {
+			if msg := getMessage(ctx); msg != nil {
+				name := core.StreamRegistry.GetStreamName(msg.GetStreamID())
+				return writeValue(module, []byte(name), bufPtr, bufLen)
+			}
+			return -1
+		}).
+		Export("get_stream").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, module api.Module, namePtr, nameLen uint32) {
+			if msg := getMessage(ctx); msg != nil {
+				msg.SetStreamID(core.GetStreamID(readString(module, namePtr, nameLen)))
+			}
+		}).
+		Export("set_stream").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, module api.Module, level, ptr, length uint32) {
+			text := readString(module, ptr, length)
+			switch level {
+			case 0:
+				format.Logger.Debug(text)
+			case 1:
+				format.Logger.Info(text)
+			case 2:
+				format.Logger.Warning(text)
+			default:
+				format.Logger.Error(text)
+			}
+		}).
+		Export("log").
+		Instantiate(ctx)
+	return err
+}
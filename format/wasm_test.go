@@ -0,0 +1,132 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package format
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+// testWasmModule stores the payload in the metadata key "wasm" using
+// set_metadata and removes the last byte of the payload. Empty payloads are
+// discarded.
+var testWasmModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x13, 0x03, 0x60,
+	0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x60, 0x04,
+	0x7f, 0x7f, 0x7f, 0x7f, 0x00, 0x02, 0x17, 0x01, 0x06, 0x67, 0x6f, 0x6c,
+	0x6c, 0x75, 0x6d, 0x0c, 0x73, 0x65, 0x74, 0x5f, 0x6d, 0x65, 0x74, 0x61,
+	0x64, 0x61, 0x74, 0x61, 0x00, 0x02, 0x03, 0x03, 0x02, 0x00, 0x01, 0x05,
+	0x03, 0x01, 0x00, 0x01, 0x07, 0x21, 0x03, 0x06, 0x6d, 0x65, 0x6d, 0x6f,
+	0x72, 0x79, 0x02, 0x00, 0x08, 0x61, 0x6c, 0x6c, 0x6f, 0x63, 0x61, 0x74,
+	0x65, 0x00, 0x01, 0x09, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x66, 0x6f, 0x72,
+	0x6d, 0x00, 0x02, 0x0a, 0x2a, 0x02, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0b,
+	0x22, 0x00, 0x20, 0x01, 0x45, 0x04, 0x7e, 0x42, 0x7f, 0x05, 0x41, 0x00,
+	0x41, 0x04, 0x20, 0x00, 0x20, 0x01, 0x10, 0x00, 0x20, 0x00, 0xad, 0x42,
+	0x20, 0x86, 0x20, 0x01, 0x41, 0x01, 0x6b, 0xad, 0x84, 0x0b, 0x0b, 0x0b,
+	0x0a, 0x01, 0x00, 0x41, 0x00, 0x0b, 0x04, 0x77, 0x61, 0x73, 0x6d,
+}
+
+func writeTestWasmModule(expect ttesting.Expect) string {
+	file, err := ioutil.TempFile("", "gollum-wasm")
+	expect.NoError(err)
+	defer file.Close()
+
+	_, err = file.Write(testWasmModule)
+	expect.NoError(err)
+	return file.Name()
+}
+
+func TestWasmTransform(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	moduleFile := writeTestWasmModule(expect)
+	defer os.Remove(moduleFile)
+
+	config := core.NewPluginConfig("", "format.Wasm")
+	config.Override("Module", moduleFile)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Wasm)
+	expect.True(casted)
+
+	for _, payload := range []string{"hello!", "world?"} {
+		msg := core.NewMessage(nil, []byte(payload), nil, core.InvalidStreamID)
+		err = formatter.ApplyFormatter(msg)
+		expect.NoError(err)
+
+		expect.Equal(payload[:5], msg.String())
+		expect.Equal(payload, msg.GetMetadata().GetValueString("wasm"))
+	}
+}
+
+func TestWasmDiscard(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	moduleFile := writeTestWasmModule(expect)
+	defer os.Remove(moduleFile)
+
+	config := core.NewPluginConfig("", "format.Wasm")
+	config.Override("Module", moduleFile)
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Wasm)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte{}, nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NotNil(err)
+}
+
+func TestWasmInvalidModule(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	file, err := ioutil.TempFile("", "gollum-wasm")
+	expect.NoError(err)
+	file.Write([]byte("not a module"))
+	file.Close()
+	defer os.Remove(file.Name())
+
+	config := core.NewPluginConfig("", "format.Wasm")
+	config.Override("Module", file.Name())
+
+	_, err = core.NewPluginWithConfig(config)
+	expect.NotNil(err)
+}
+
+func TestWasmWithoutModule(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	config := core.NewPluginConfig("", "format.Wasm")
+	config.Override("Module", "")
+
+	plugin, err := core.NewPluginWithConfig(config)
+	expect.NoError(err)
+
+	formatter, casted := plugin.(*Wasm)
+	expect.True(casted)
+
+	msg := core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)
+	err = formatter.ApplyFormatter(msg)
+	expect.NoError(err)
+	expect.Equal("test", msg.String())
+}
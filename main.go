@@ -15,8 +15,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"runtime"
 	"runtime/pprof"
@@ -36,6 +38,7 @@ import (
 	_ "github.com/trivago/gollum/router"
 	"github.com/trivago/tgo"
 	"github.com/trivago/tgo/thealthcheck"
+	"github.com/trivago/tgo/tmath"
 	"github.com/trivago/tgo/tnet"
 	"github.com/trivago/tgo/tos"
 	"golang.org/x/crypto/ssh/terminal"
@@ -85,6 +88,24 @@ func mainWithExitCode() int {
 		return tos.ExitError // ### exit, config failed to parse ###
 	}
 
+	if *flagCheckConfigFile != "" {
+		logrus.SetLevel(logrus.WarnLevel)
+		fmt.Println("Checking config", configFile)
+
+		if !checkConfig(config) {
+			return tos.ExitError // ### exit, config check failed ###
+		}
+		return tos.ExitSuccess // ### exit, config checked successfully ###
+	}
+
+	if *flagSimulate != "" {
+		logrus.SetLevel(logrus.WarnLevel)
+		if !simulate(config, *flagSimulate) {
+			return tos.ExitError // ### exit, simulation failed ###
+		}
+		return tos.ExitSuccess // ### exit, simulation done ###
+	}
+
 	if testConfigAndExit {
 		logrus.SetLevel(logrus.WarnLevel)
 		fmt.Println("Testing config", configFile)
@@ -103,6 +124,14 @@ func mainWithExitCode() int {
 		defer stop()
 	}
 
+	if stop := startPrometheusService(); stop != nil {
+		defer stop()
+	}
+
+	if stop := startMetricsPusher(); stop != nil {
+		defer stop()
+	}
+
 	if stop := startHealthCheckService(); stop != nil {
 		defer stop()
 	}
@@ -128,11 +157,19 @@ func mainWithExitCode() int {
 	}
 
 	coordinator.StartPlugins()
+
+	if stop := startAdminService(&coordinator); stop != nil {
+		defer stop()
+	}
+
 	coordinator.Run()
 	return tos.ExitSuccess
 }
 
 func getConfigFile() (configFile string, justTest bool) {
+	if *flagCheckConfigFile != "" {
+		return *flagCheckConfigFile, true
+	}
 	if *flagTestConfigFile != "" {
 		return *flagTestConfigFile, true
 	}
@@ -152,6 +189,36 @@ func testConfig(config *core.Config) bool {
 	return true
 }
 
+// checkConfig configures all plugins of the config without starting them,
+// prints the pipeline graph and warns about broken stream wiring.
+func checkConfig(config *core.Config) bool {
+	coordinator := NewCoordinator()
+	err := coordinator.Configure(config)
+
+	// Print all errors before the pipeline. Plugins are not started, so there
+	// is nothing to shut down.
+	logrusHookBuffer.SetTargetWriter(logger.FallbackLogDevice)
+	logrusHookBuffer.Purge()
+	if err != nil {
+		logrus.WithError(err).Error("Configure pass failed.")
+		return false
+	}
+
+	graph := core.NewPipelineGraph(config)
+	fmt.Print("\nPipeline:\n", graph.String())
+
+	warnings := graph.Check()
+	if len(warnings) > 0 {
+		fmt.Println("\nWarnings:")
+		for _, warning := range warnings {
+			fmt.Println(" ", warning)
+		}
+	}
+
+	fmt.Printf("\nConfig OK, %d warning(s).\n", len(warnings))
+	return true
+}
+
 // initLogrus initializes the logging framework
 func initLogrus() func() {
 	// Initialize logger.LogrusHookBuffer
@@ -227,6 +294,10 @@ func configureRuntime() {
 	if *flagTrace {
 		core.ActivateMessageTrace()
 	}
+
+	if *flagFilterAudit != "" {
+		core.ActivateFilterAudit(*flagFilterAudit)
+	}
 }
 
 // startMetricsService creates a metric endpoint if requested.
@@ -248,6 +319,112 @@ func startMetricsService() func() {
 	return server.Stop
 }
 
+// startPrometheusService creates a prometheus metrics endpoint if requested.
+// The returned function should be deferred if not nil.
+func startPrometheusService() func() {
+	if *flagPrometheus == "" {
+		return nil
+	}
+	address, err := parseAddress(*flagPrometheus)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to start prometheus service")
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(*flagPrometheusPath, core.PrometheusHandler{})
+	server := &http.Server{Addr: address, Handler: mux}
+
+	logrus.WithField("address", address).WithField("path", *flagPrometheusPath).Info("Starting prometheus service")
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("Prometheus service stopped")
+		}
+	}()
+	return func() {
+		server.Close()
+	}
+}
+
+// startAdminService creates the admin HTTP endpoint if requested.
+// The returned function should be deferred if not nil.
+func startAdminService(coordinator *Coordinator) func() {
+	if *flagAdmin == "" {
+		return nil
+	}
+	address, err := parseAddress(*flagAdmin)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to start admin service")
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writer.Header().Set("Allow", http.MethodPost)
+			http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		diff, err := coordinator.RequestReload()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string][]string{
+			"added":   getPluginIDs(diff.Added),
+			"removed": getPluginIDs(diff.Removed),
+			"changed": getPluginIDs(diff.Changed),
+		})
+	})
+	server := &http.Server{Addr: address, Handler: mux}
+
+	logrus.WithField("address", address).Info("Starting admin service")
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("Admin service stopped")
+		}
+	}()
+	return func() {
+		server.Close()
+	}
+}
+
+// getPluginIDs returns the IDs of all plugins in the given config.
+func getPluginIDs(config core.Config) []string {
+	IDs := make([]string, 0, len(config.Plugins))
+	for _, plugin := range config.Plugins {
+		IDs = append(IDs, plugin.ID)
+	}
+	return IDs
+}
+
+// startMetricsPusher periodically pushes metrics to statsd or graphite if
+// requested. The returned function should be deferred if not nil.
+func startMetricsPusher() func() {
+	if *flagMetricsPush == "" {
+		return nil
+	}
+
+	tags, err := core.ParseMetricsTagMapping(*flagMetricsPushTags)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to start metrics pusher")
+		return nil
+	}
+
+	pusher, err := core.NewMetricsPusher(*flagMetricsPush, *flagMetricsPushPrefix, tags)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to start metrics pusher")
+		return nil
+	}
+
+	interval := time.Duration(tmath.MaxI(1, *flagMetricsPushInterval)) * time.Second
+	logrus.WithField("target", *flagMetricsPush).Info("Starting metrics pusher")
+	return pusher.Start(interval)
+}
+
 // startHealthCheckService creates a health check endpoint if requested.
 // The returned function should be deferred if not nil.
 func startHealthCheckService() func() {
@@ -268,6 +445,12 @@ func startHealthCheckService() func() {
 	thealthcheck.AddEndpoint("/_PING_", func() (code int, body string) {
 		return thealthcheck.StatusOK, "PONG"
 	})
+
+	// Add kubernetes style liveness and readiness probes and track errors
+	// logged by plugins for these reports
+	logrus.AddHook(&core.HealthRegistry)
+	thealthcheck.AddEndpoint("/healthz", core.HealthRegistry.LivenessCheck)
+	thealthcheck.AddEndpoint("/readyz", core.HealthRegistry.ReadinessCheck)
 	return thealthcheck.Stop
 }
 
@@ -393,9 +576,6 @@ func printModules() {
 }
 
 func printProfile() {
-	msgSec, err := tgo.Metric.Get(core.MetricMessagesRoutedAvg)
-	if err == nil {
-		fmt.Printf("Processed %d msg/sec\n", msgSec)
-	}
+	fmt.Printf("Processed %d msg/sec\n", core.MetricMessagesRoutedAvg.Get())
 	time.AfterFunc(time.Second*3, printProfile)
 }
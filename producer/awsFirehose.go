@@ -17,14 +17,12 @@ package producer
 import (
 	"fmt"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/firehose"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/components"
-	"github.com/trivago/tgo"
 )
 
 // AwsFirehose producer plugin
@@ -78,11 +76,9 @@ type AwsFirehose struct {
 	delimiter         []byte        `config:"RecordMessageDelimiter" default:"\n"`
 	sendTimeLimit     time.Duration `config:"SendTimeframeMs" default:"1000" metric:"ms"`
 
-	client           *firehose.Firehose
-	streamMap        map[core.MessageStreamID]string
-	lastSendTime     time.Time
-	lastMetricUpdate time.Time
-	counters         map[string]*int64
+	client       *firehose.Firehose
+	streamMap    map[core.MessageStreamID]string
+	lastSendTime time.Time
 }
 
 const (
@@ -105,8 +101,6 @@ func (prod *AwsFirehose) Configure(conf core.PluginConfigReader) {
 	prod.streamMap = conf.GetStreamMap("StreamMapping", "default")
 
 	prod.lastSendTime = time.Now()
-	prod.counters = make(map[string]*int64)
-	prod.lastMetricUpdate = time.Now()
 
 	if prod.recordMaxMessages < 1 {
 		prod.recordMaxMessages = 1
@@ -119,12 +113,18 @@ func (prod *AwsFirehose) Configure(conf core.PluginConfigReader) {
 	}
 
 	for _, streamName := range prod.streamMap {
-		tgo.Metric.New(firehoseMetricMessages + streamName)
-		tgo.Metric.New(firehoseMetricMessagesSec + streamName)
-		prod.counters[streamName] = new(int64)
+		prod.getStreamMetric(streamName)
 	}
 }
 
+// getStreamMetric returns the counter of records sent to a firehose stream.
+func (prod *AwsFirehose) getStreamMetric(streamName string) *core.Counter {
+	return core.NewLegacyCounter("aws_firehose_records", core.MetricLabels{
+		"plugin_id": prod.GetID(),
+		"stream":    streamName,
+	}, firehoseMetricMessages+streamName, firehoseMetricMessagesSec+streamName)
+}
+
 // Produce writes to stdout or stderr.
 func (prod *AwsFirehose) Produce(workers *sync.WaitGroup) {
 	defer prod.WorkerDone()
@@ -169,9 +169,7 @@ func (prod *AwsFirehose) transformMessages(messages []*core.Message) {
 				streamName = core.StreamRegistry.GetStreamName(msg.GetStreamID())
 				prod.streamMap[msg.GetStreamID()] = streamName
 
-				tgo.Metric.New(firehoseMetricMessages + streamName)
-				tgo.Metric.New(firehoseMetricMessagesSec + streamName)
-				prod.counters[streamName] = new(int64)
+				prod.getStreamMetric(streamName)
 			}
 
 			// Create buffers for this firehose stream
@@ -217,7 +215,7 @@ func (prod *AwsFirehose) transformMessages(messages []*core.Message) {
 	// Send to AwsFirehose
 	for _, records := range streamRecords {
 		rsp, err := prod.client.PutRecordBatch(records.content)
-		atomic.AddInt64(prod.counters[*records.content.DeliveryStreamName], int64(len(records.content.Records)))
+		prod.getStreamMetric(*records.content.DeliveryStreamName).Add(int64(len(records.content.Records)))
 
 		if err != nil {
 			// Batch failed, fallback all
@@ -24,7 +24,6 @@ import (
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/components"
-	"github.com/trivago/tgo"
 )
 
 // AwsKinesis producer plugin
@@ -79,12 +78,10 @@ type AwsKinesis struct {
 	delimiter         []byte        `config:"RecordMessageDelimiter" default:"\n"`
 	sendTimeLimit     time.Duration `config:"SendTimeframeMs" default:"1000" metric:"ms"`
 
-	streamMap        map[core.MessageStreamID]string
-	client           *kinesis.Kinesis
-	lastSendTime     time.Time
-	counters         map[string]*int64
-	lastMetricUpdate time.Time
-	sequence         *int64
+	streamMap    map[core.MessageStreamID]string
+	client       *kinesis.Kinesis
+	lastSendTime time.Time
+	sequence     *int64
 }
 
 const (
@@ -105,8 +102,6 @@ func init() {
 // Configure initializes this producer with values from a plugin config.
 func (prod *AwsKinesis) Configure(conf core.PluginConfigReader) {
 	prod.lastSendTime = time.Now()
-	prod.counters = make(map[string]*int64)
-	prod.lastMetricUpdate = time.Now()
 	prod.sequence = new(int64)
 
 	if prod.recordMaxMessages < 1 {
@@ -121,12 +116,18 @@ func (prod *AwsKinesis) Configure(conf core.PluginConfigReader) {
 
 	prod.streamMap = conf.GetStreamMap("StreamMapping", "")
 	for _, streamName := range prod.streamMap {
-		metricName := kinesisMetricMessages + streamName
-		tgo.Metric.New(metricName)
-		tgo.Metric.NewRate(metricName, kinesisMetricMessagesSec+streamName, time.Second, 10, 3, true)
+		prod.getStreamMetric(streamName)
 	}
 }
 
+// getStreamMetric returns the counter of records sent to a kinesis stream.
+func (prod *AwsKinesis) getStreamMetric(streamName string) *core.Counter {
+	return core.NewLegacyCounter("aws_kinesis_records", core.MetricLabels{
+		"plugin_id": prod.GetID(),
+		"stream":    streamName,
+	}, kinesisMetricMessages+streamName, kinesisMetricMessagesSec+streamName)
+}
+
 // Produce writes to stdout or stderr.
 func (prod *AwsKinesis) Produce(workers *sync.WaitGroup) {
 	defer prod.WorkerDone()
@@ -174,9 +175,7 @@ func (prod *AwsKinesis) transformMessages(messages []*core.Message) {
 					streamName = core.StreamRegistry.GetStreamName(msg.GetStreamID())
 					prod.streamMap[msg.GetStreamID()] = streamName
 
-					metricName := kinesisMetricMessages + streamName
-					tgo.Metric.New(metricName)
-					tgo.Metric.NewRate(metricName, kinesisMetricMessagesSec+streamName, time.Second, 10, 3, true)
+					prod.getStreamMetric(streamName)
 				}
 			}
 
@@ -224,7 +223,7 @@ func (prod *AwsKinesis) transformMessages(messages []*core.Message) {
 	// Send to AwsKinesis
 	for _, records := range streamRecords {
 		result, err := prod.client.PutRecords(records.content)
-		atomic.AddInt64(prod.counters[*records.content.StreamName], int64(len(records.content.Records)))
+		prod.getStreamMetric(*records.content.StreamName).Add(int64(len(records.content.Records)))
 
 		if err != nil {
 			// Batch failed, fallback all
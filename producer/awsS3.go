@@ -241,7 +241,7 @@ func (prod *AwsS3) writeMessage(msg *core.Message) {
 		return // ### return, fallback ###
 	}
 
-	batchedFile.Batch.AppendOrFlush(msg, batchedFile.Flush, prod.IsActiveOrStopping, prod.TryFallback)
+	batchedFile.AppendOrFlush(msg, prod.IsActiveOrStopping, prod.TryFallback)
 }
 
 func (prod *AwsS3) writeBatchOnTimeOut() {
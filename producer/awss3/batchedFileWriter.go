@@ -17,10 +17,12 @@ package awss3
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/components"
 )
 
@@ -48,6 +50,8 @@ type BatchedFileWriter struct {
 	// need separate byte buffer for min 5mb part uploads.
 	// @see http://docs.aws.amazon.com/AmazonS3/latest/API/mpUploadComplete.html
 	activeBuffer *s3ByteBuffer
+
+	uploadDuration *core.Histogram // duration of part uploads
 }
 
 // NewBatchedFileWriter returns a BatchedFileWriter instance
@@ -68,6 +72,9 @@ func NewBatchedFileWriter(s3Client *s3.S3, bucket string, fileName string, logge
 		s3SubFolder: s3SubFolder,
 		fileName:    fileName,
 		logger:      logger,
+		uploadDuration: core.NewHistogram("aws_s3_upload_part_seconds", core.MetricLabels{
+			"bucket": s3Bucket,
+		}, nil),
 	}
 
 	batchedFileWriter.init()
@@ -160,7 +167,9 @@ func (w *BatchedFileWriter) uploadPartInput() (err error) {
 		UploadId:   w.s3UploadID,
 	}
 
+	start := time.Now()
 	result, err := w.s3Client.UploadPart(input)
+	w.uploadDuration.ObserveSince(start)
 	if err != nil {
 		w.logger.WithError(err).WithField("input", input).Errorf("Can't upload part '%d'", currentMultiPart)
 		return
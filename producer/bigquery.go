@@ -0,0 +1,608 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/tcontainer"
+)
+
+const (
+	bigQueryCreateWriteStream = "/google.cloud.bigquery.storage.v1.BigQueryWrite/CreateWriteStream"
+	bigQueryAppendRows        = "/google.cloud.bigquery.storage.v1.BigQueryWrite/AppendRows"
+	bigQueryFinalizeStream    = "/google.cloud.bigquery.storage.v1.BigQueryWrite/FinalizeWriteStream"
+	bigQueryStreamCommitted   = 1
+	bigQueryTableIdleTimeout  = time.Hour
+)
+
+// BigQuery producer
+//
+// This producer writes JSON encoded messages into Google BigQuery tables
+// using the Storage Write API. Rows are converted to protobuf messages
+// matching the schema of the target table and appended to a committed write
+// stream per table, so rows are visible as soon as they have been written.
+//
+// Every append is sent with the stream offset of its first row. If an append
+// is retried after its response got lost, BigQuery detects that the rows have
+// already been written and does not write them again. Streams are recreated
+// if their state is unknown, e.g. after all retries failed.
+//
+// Stream offsets are only kept in memory. After a restart new streams are
+// created, starting at offset 0, so rows of an append whose response got lost
+// right before shutting down may be written twice. Streams of tables that did
+// not receive rows for an hour, e.g. after TimeBasedName switched to a new
+// table, are finalized and dropped.
+//
+// JSON values are converted to the type of their column. TIMESTAMP and DATE
+// columns accept RFC3339 and "2006-01-02" formatted strings or seconds since
+// epoch, BYTES columns accept base64 encoded strings and JSON columns accept
+// any value. Keys not matching a column are ignored.
+//
+// Parameters
+//
+// - Project: Defines the Google Cloud project the dataset belongs to.
+// This parameter is required.
+// By default this parameter is set to "".
+//
+// - Dataset: Defines the dataset to write to. Every "*" will be replaced by
+// the name of the stream the message is sent on.
+// By default this parameter is set to "*".
+//
+// - Table: Defines the table to write to. Every "*" will be replaced by the
+// name of the stream the message is sent on.
+// By default this parameter is set to "*".
+//
+// - TimeBasedName: When set to true, Dataset and Table are treated as a
+// template for time.Format using the creation time of the message. You can
+// e.g. use "events_20060102" to write to daily tables.
+// By default this parameter is set to false.
+//
+// - Fields: Defines a map of column names to field paths inside the JSON
+// encoded payload. Field paths can be defined in the format accepted by
+// tgo.MarshalMap.Path. If neither Fields nor MetadataFields is set, the
+// payload is used as the row without modifications.
+// By default this parameter is set to an empty map.
+//
+// - MetadataFields: Defines a map of column names to metadata keys.
+// By default this parameter is set to an empty map.
+//
+// - RowsPerRequest: Defines the maximum number of rows sent in one append.
+// By default this parameter is set to 500.
+//
+// - Retry/Count: Defines the number of retries before rows are sent to the
+// fallback stream.
+// By default this parameter is set to 3.
+//
+// - Retry/DelayMs: Defines the number of milliseconds to wait between
+// retries.
+// By default this parameter is set to 1000.
+//
+// - Endpoint: Defines the address of the BigQuery Storage API.
+// By default this parameter is set to "bigquerystorage.googleapis.com:443".
+//
+// - TimeoutSec: Defines the timeout of a single call in seconds.
+// By default this parameter is set to 30.
+//
+// Examples
+//
+// This example writes JSON messages into daily tables per stream:
+//
+//  BigQueryOut:
+//    Type: producer.BigQuery
+//    Streams: ["access", "error"]
+//    Project: my-project
+//    Dataset: logs
+//    Table: "*_20060102"
+//    TimeBasedName: true
+//    Credential:
+//      File: /etc/gollum/service-account.json
+//    Fields:
+//      status: "response/status"
+//      path: "request/path"
+//    MetadataFields:
+//      host: "hostname"
+//
+type BigQuery struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+
+	// GoogleCredentials is public to make GoogleCredentials.Configure() callable
+	GoogleCredentials components.GoogleCredentials `gollumdoc:"embed_type"`
+
+	project        string        `config:"Project"`
+	dataset        string        `config:"Dataset" default:"*"`
+	table          string        `config:"Table" default:"*"`
+	timeBasedName  bool          `config:"TimeBasedName" default:"false"`
+	rowsPerRequest int           `config:"RowsPerRequest" default:"500"`
+	retryCount     int           `config:"Retry/Count" default:"3"`
+	retryDelay     time.Duration `config:"Retry/DelayMs" default:"1000" metric:"ms"`
+	endpoint       string        `config:"Endpoint" default:"bigquerystorage.googleapis.com:443"`
+	timeout        time.Duration `config:"TimeoutSec" default:"30" metric:"sec"`
+	fields         map[string]string
+	metadataFields map[string]string
+	client         *grpcClient
+	tables         map[string]*bigQueryTable
+	guard          *sync.Mutex
+}
+
+// bigQueryTable holds the write stream of a table. Appends to a stream have
+// to be sent in order, so guard is held while writing to the table.
+type bigQueryTable struct {
+	path     string
+	stream   *bigQueryWriteStream
+	lastUsed time.Time
+	guard    *sync.Mutex
+}
+
+// bigQueryWriteStream is a committed write stream of a table. Offset is the
+// offset of the next row to append.
+type bigQueryWriteStream struct {
+	name       string
+	fields     []bigQueryField
+	descriptor []byte
+	offset     int64
+}
+
+type bigQueryRowError struct {
+	index   int
+	message string
+}
+
+func init() {
+	core.TypeRegistry.Register(BigQuery{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *BigQuery) Configure(conf core.PluginConfigReader) {
+	prod.fields = conf.GetStringMap("Fields", map[string]string{})
+	prod.metadataFields = conf.GetStringMap("MetadataFields", map[string]string{})
+	prod.client = newGRPCClient(prod.endpoint, &tls.Config{}, prod.timeout, false)
+	prod.tables = make(map[string]*bigQueryTable)
+	prod.guard = new(sync.Mutex)
+
+	if prod.project == "" {
+		prod.Logger.Error("No project configured. Please check your config.")
+	}
+
+	if prod.rowsPerRequest < 1 {
+		prod.rowsPerRequest = 1
+		prod.Logger.Warning("RowsPerRequest was < 1. Defaulting to 1.")
+	}
+}
+
+func (prod *BigQuery) getTablePath(msg *core.Message) string {
+	dataset, table := prod.dataset, prod.table
+	if prod.timeBasedName {
+		dataset = msg.GetCreationTime().Format(dataset)
+		table = msg.GetCreationTime().Format(table)
+	}
+
+	streamName := core.StreamRegistry.GetStreamName(msg.GetStreamID())
+	dataset = strings.Replace(dataset, "*", streamName, -1)
+	table = strings.Replace(table, "*", streamName, -1)
+
+	return fmt.Sprintf("projects/%s/datasets/%s/tables/%s", prod.project, dataset, table)
+}
+
+func (prod *BigQuery) getRow(msg *core.Message) (map[string]interface{}, error) {
+	payload := tcontainer.NewMarshalMap()
+	if len(prod.fields) > 0 || len(prod.metadataFields) == 0 {
+		decoder := json.NewDecoder(bytes.NewReader(msg.GetPayload()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&payload); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(prod.fields) == 0 && len(prod.metadataFields) == 0 {
+		return payload, nil // ### return, use payload as is ###
+	}
+
+	row := make(map[string]interface{})
+	for column, path := range prod.fields {
+		if value, found := payload.Value(path); found {
+			row[column] = value
+		}
+	}
+
+	metadata := msg.GetMetadata()
+	for column, key := range prod.metadataFields {
+		if value, exists := metadata.TryGetValueString(key); exists {
+			row[column] = value
+		}
+	}
+	return row, nil
+}
+
+// getHeader returns the headers required for a call. Params are used by
+// Google to route the call.
+func (prod *BigQuery) getHeader(params string) (http.Header, error) {
+	token, err := prod.GoogleCredentials.GetToken()
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	header.Set("x-goog-request-params", params)
+	return header, nil
+}
+
+// createWriteStream creates a new committed write stream for the given table
+// and converts the table's schema to a protobuf descriptor.
+func (prod *BigQuery) createWriteStream(tablePath string) (*bigQueryWriteStream, error) {
+	writeStream := proto.NewBuffer(nil)
+	writeStream.EncodeVarint(2<<3 | proto.WireVarint)
+	writeStream.EncodeVarint(bigQueryStreamCommitted)
+
+	request := proto.NewBuffer(nil)
+	request.EncodeVarint(1<<3 | proto.WireBytes)
+	request.EncodeStringBytes(tablePath)
+	request.EncodeVarint(2<<3 | proto.WireBytes)
+	request.EncodeRawBytes(writeStream.Bytes())
+
+	header, err := prod.getHeader("parent=" + url.QueryEscape(tablePath))
+	if err != nil {
+		return nil, err
+	}
+
+	responses, err := prod.client.invoke(bigQueryCreateWriteStream, header, [][]byte{request.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) != 1 {
+		return nil, fmt.Errorf("expected 1 response, got %d", len(responses))
+	}
+
+	stream := &bigQueryWriteStream{}
+	err = bigQueryDecodeFields(responses[0], func(number int, value []byte, scalar uint64) error {
+		var err error
+		switch number {
+		case 1:
+			stream.name = string(value)
+		case 5:
+			stream.fields, err = parseBigQuerySchema(value)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stream.name == "" || len(stream.fields) == 0 {
+		return nil, fmt.Errorf("no write stream or table schema returned for %s", tablePath)
+	}
+
+	descriptor, err := newBigQueryDescriptor(stream.fields)
+	if err != nil {
+		return nil, err
+	}
+	stream.descriptor, err = proto.Marshal(descriptor)
+	return stream, err
+}
+
+// finalizeWriteStream marks the given stream as finalized so that no more
+// rows can be appended.
+func (prod *BigQuery) finalizeWriteStream(stream *bigQueryWriteStream) error {
+	request := proto.NewBuffer(nil)
+	request.EncodeVarint(1<<3 | proto.WireBytes)
+	request.EncodeStringBytes(stream.name)
+
+	header, err := prod.getHeader("name=" + url.QueryEscape(stream.name))
+	if err != nil {
+		return err
+	}
+	_, err = prod.client.invoke(bigQueryFinalizeStream, header, [][]byte{request.Bytes()})
+	return err
+}
+
+// getTable returns the entry of the given table and marks it as used.
+func (prod *BigQuery) getTable(tablePath string) *bigQueryTable {
+	prod.guard.Lock()
+	defer prod.guard.Unlock()
+
+	table, exists := prod.tables[tablePath]
+	if !exists {
+		table = &bigQueryTable{
+			path:  tablePath,
+			guard: new(sync.Mutex),
+		}
+		prod.tables[tablePath] = table
+	}
+	table.lastUsed = time.Now()
+	return table
+}
+
+// pruneTables removes all tables that have not been used for
+// bigQueryTableIdleTimeout and finalizes their streams.
+func (prod *BigQuery) pruneTables() {
+	idle := []*bigQueryTable{}
+
+	prod.guard.Lock()
+	for tablePath, table := range prod.tables {
+		if time.Since(table.lastUsed) > bigQueryTableIdleTimeout {
+			delete(prod.tables, tablePath)
+			idle = append(idle, table)
+		}
+	}
+	prod.guard.Unlock()
+
+	for _, table := range idle {
+		table.guard.Lock()
+		if table.stream != nil {
+			if err := prod.finalizeWriteStream(table.stream); err != nil {
+				prod.Logger.WithError(err).Warningf("Failed to finalize write stream %s", table.stream.name)
+			}
+			table.stream = nil
+		}
+		table.guard.Unlock()
+	}
+}
+
+func (prod *BigQuery) getWriteStream(table *bigQueryTable) (*bigQueryWriteStream, error) {
+	if table.stream != nil {
+		return table.stream, nil
+	}
+
+	stream, err := prod.createWriteStream(table.path)
+	if err != nil {
+		return nil, err
+	}
+	prod.Logger.Debugf("Created write stream %s", stream.name)
+	table.stream = stream
+	return stream, nil
+}
+
+// appendRows appends the given rows at the current offset of the given
+// stream. If rows are rejected, none of the rows have been written.
+func (prod *BigQuery) appendRows(stream *bigQueryWriteStream, rows [][]byte) ([]bigQueryRowError, error) {
+	protoRows := proto.NewBuffer(nil)
+	for _, row := range rows {
+		protoRows.EncodeVarint(1<<3 | proto.WireBytes)
+		protoRows.EncodeRawBytes(row)
+	}
+
+	protoSchema := proto.NewBuffer(nil)
+	protoSchema.EncodeVarint(1<<3 | proto.WireBytes)
+	protoSchema.EncodeRawBytes(stream.descriptor)
+
+	protoData := proto.NewBuffer(nil)
+	protoData.EncodeVarint(1<<3 | proto.WireBytes)
+	protoData.EncodeRawBytes(protoSchema.Bytes())
+	protoData.EncodeVarint(2<<3 | proto.WireBytes)
+	protoData.EncodeRawBytes(protoRows.Bytes())
+
+	offset := proto.NewBuffer(nil)
+	offset.EncodeVarint(1<<3 | proto.WireVarint)
+	offset.EncodeVarint(uint64(stream.offset))
+
+	request := proto.NewBuffer(nil)
+	request.EncodeVarint(1<<3 | proto.WireBytes)
+	request.EncodeStringBytes(stream.name)
+	request.EncodeVarint(2<<3 | proto.WireBytes)
+	request.EncodeRawBytes(offset.Bytes())
+	request.EncodeVarint(4<<3 | proto.WireBytes)
+	request.EncodeRawBytes(protoData.Bytes())
+
+	header, err := prod.getHeader("write_stream=" + url.QueryEscape(stream.name))
+	if err != nil {
+		return nil, err
+	}
+
+	responses, err := prod.client.invoke(bigQueryAppendRows, header, [][]byte{request.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) != 1 {
+		return nil, fmt.Errorf("expected 1 response, got %d", len(responses))
+	}
+
+	var (
+		rowErrors []bigQueryRowError
+		status    *grpcStatusError
+	)
+	err = bigQueryDecodeFields(responses[0], func(number int, value []byte, scalar uint64) error {
+		switch number {
+		case 2:
+			status = &grpcStatusError{}
+			return bigQueryDecodeFields(value, func(number int, value []byte, scalar uint64) error {
+				switch number {
+				case 1:
+					status.code = int(scalar)
+				case 2:
+					status.message = string(value)
+				}
+				return nil
+			})
+		case 4:
+			rowErrors = append(rowErrors, bigQueryRowError{})
+			return bigQueryDecodeFields(value, func(number int, value []byte, scalar uint64) error {
+				switch number {
+				case 1:
+					rowErrors[len(rowErrors)-1].index = int(scalar)
+				case 3:
+					rowErrors[len(rowErrors)-1].message = string(value)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	switch {
+	case err != nil:
+		return nil, err
+	case len(rowErrors) > 0:
+		return rowErrors, nil
+	case status != nil && status.code != grpcStatusOK:
+		return nil, *status
+	default:
+		return nil, nil
+	}
+}
+
+// encodeRows converts the given rows to the schema of the given stream. Rows
+// that cannot be converted are sent to the fallback.
+func (prod *BigQuery) encodeRows(stream *bigQueryWriteStream, rows []map[string]interface{}, messages []*core.Message) ([][]byte, []map[string]interface{}, []*core.Message) {
+	encoded := make([][]byte, 0, len(rows))
+	validRows := make([]map[string]interface{}, 0, len(rows))
+	validMessages := make([]*core.Message, 0, len(messages))
+
+	for idx, row := range rows {
+		data, err := encodeBigQueryRow(stream.fields, row)
+		if err != nil {
+			prod.Logger.WithError(err).Error("Failed to convert message to row")
+			prod.TryFallback(messages[idx])
+			continue
+		}
+		encoded = append(encoded, data)
+		validRows = append(validRows, row)
+		validMessages = append(validMessages, messages[idx])
+	}
+	return encoded, validRows, validMessages
+}
+
+// rejectRows sends all rows rejected by BigQuery to the fallback and returns
+// the remaining rows.
+func (prod *BigQuery) rejectRows(rowErrors []bigQueryRowError, rows []map[string]interface{}, messages []*core.Message) ([]map[string]interface{}, []*core.Message) {
+	rejected := make(map[int]bool)
+	for _, rowError := range rowErrors {
+		prod.Logger.Warningf("Row rejected: %s", rowError.message)
+		rejected[rowError.index] = true
+	}
+
+	validRows := make([]map[string]interface{}, 0, len(rows))
+	validMessages := make([]*core.Message, 0, len(messages))
+	for idx, msg := range messages {
+		if rejected[idx] {
+			prod.TryFallback(msg)
+			continue
+		}
+		validRows = append(validRows, rows[idx])
+		validMessages = append(validMessages, msg)
+	}
+	return validRows, validMessages
+}
+
+// writeRows appends the given rows to the given table. The guard of the
+// table has to be held by the caller.
+func (prod *BigQuery) writeRows(table *bigQueryTable, rows []map[string]interface{}, messages []*core.Message) {
+	var err error
+
+	for retry := 0; retry <= prod.retryCount && len(messages) > 0; retry++ {
+		if retry > 0 {
+			time.Sleep(prod.retryDelay)
+		}
+
+		var stream *bigQueryWriteStream
+		if stream, err = prod.getWriteStream(table); err != nil {
+			prod.Logger.WithError(err).Warningf("Failed to create write stream for %s", table.path)
+			continue
+		}
+
+		var (
+			encoded   [][]byte
+			rowErrors []bigQueryRowError
+		)
+		if encoded, rows, messages = prod.encodeRows(stream, rows, messages); len(encoded) == 0 {
+			return // ### return, no valid rows ###
+		}
+
+		rowErrors, err = prod.appendRows(stream, encoded)
+		if statusErr, isStatus := err.(grpcStatusError); isStatus && statusErr.code == grpcStatusAlreadyExists {
+			err = nil // A previous attempt has been written but its response got lost
+		}
+
+		switch {
+		case len(rowErrors) > 0:
+			rows, messages = prod.rejectRows(rowErrors, rows, messages)
+			err = fmt.Errorf("%d rows have been rejected", len(rowErrors))
+
+		case err == nil:
+			stream.offset += int64(len(encoded))
+			return // ### return, done ###
+
+		case isRetryableGRPCError(err):
+			// Retrying at the same offset does not write rows twice
+			prod.Logger.WithError(err).Warningf("Failed to append %d rows to %s", len(encoded), stream.name)
+
+		default:
+			// E.g. a changed table schema or an unexpected offset
+			prod.Logger.WithError(err).Warningf("Failed to append %d rows to %s, recreating stream", len(encoded), stream.name)
+			table.stream = nil
+		}
+	}
+
+	if len(messages) > 0 {
+		// The rows might have been written, so the offset of the stream is
+		// unknown and the stream can not be used anymore.
+		table.stream = nil
+		prod.Logger.WithError(err).Errorf("Giving up writing %d rows after %d retries", len(messages), prod.retryCount)
+		for _, msg := range messages {
+			prod.TryFallback(msg)
+		}
+	}
+}
+
+func (prod *BigQuery) sendBatch(messages []*core.Message) {
+	tableRows := make(map[string][]map[string]interface{})
+	tableMessages := make(map[string][]*core.Message)
+
+	for _, msg := range messages {
+		row, err := prod.getRow(msg)
+		if err != nil {
+			prod.Logger.WithError(err).Error("Failed to convert message to row")
+			prod.TryFallback(msg)
+			continue
+		}
+
+		tablePath := prod.getTablePath(msg)
+		tableRows[tablePath] = append(tableRows[tablePath], row)
+		tableMessages[tablePath] = append(tableMessages[tablePath], msg)
+	}
+
+	for tablePath, rows := range tableRows {
+		messages := tableMessages[tablePath]
+		table := prod.getTable(tablePath)
+
+		// Appends to a stream have to be sent in order
+		table.guard.Lock()
+		for start := 0; start < len(rows); start += prod.rowsPerRequest {
+			end := start + prod.rowsPerRequest
+			if end > len(rows) {
+				end = len(rows)
+			}
+			prod.writeRows(table, rows[start:end], messages[start:end])
+		}
+		table.guard.Unlock()
+	}
+
+	prod.pruneTables()
+}
+
+// Produce writes to BigQuery.
+func (prod *BigQuery) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.sendBatch })
+}
@@ -0,0 +1,393 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/trivago/tgo/tcontainer"
+)
+
+// Values of TableFieldSchema.Type
+const (
+	bigQueryTypeString     = 1
+	bigQueryTypeInt64      = 2
+	bigQueryTypeDouble     = 3
+	bigQueryTypeStruct     = 4
+	bigQueryTypeBytes      = 5
+	bigQueryTypeBool       = 6
+	bigQueryTypeTimestamp  = 7
+	bigQueryTypeDate       = 8
+	bigQueryTypeTime       = 9
+	bigQueryTypeDatetime   = 10
+	bigQueryTypeGeography  = 11
+	bigQueryTypeNumeric    = 12
+	bigQueryTypeBignumeric = 13
+	bigQueryTypeJSON       = 15
+)
+
+// Values of TableFieldSchema.Mode
+const (
+	bigQueryModeNullable = 1
+	bigQueryModeRequired = 2
+	bigQueryModeRepeated = 3
+)
+
+// bigQueryField is a column of a BigQuery table schema. Columns are written
+// as protobuf fields numbered by their position in the schema.
+type bigQueryField struct {
+	name   string
+	kind   uint64
+	mode   uint64
+	fields []bigQueryField
+}
+
+// bigQueryDecodeFields calls onField for each field of a protobuf message.
+// Length delimited fields are passed as value, all other fields as scalar.
+func bigQueryDecodeFields(data []byte, onField func(number int, value []byte, scalar uint64) error) error {
+	for len(data) > 0 {
+		key, size := proto.DecodeVarint(data)
+		if size == 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		data = data[size:]
+
+		var (
+			value  []byte
+			scalar uint64
+		)
+		switch key & 7 {
+		case proto.WireVarint:
+			scalar, size = proto.DecodeVarint(data)
+			if size == 0 {
+				return fmt.Errorf("invalid varint")
+			}
+
+		case proto.WireFixed64:
+			if size = 8; len(data) < size {
+				return fmt.Errorf("invalid fixed64")
+			}
+			scalar = binary.LittleEndian.Uint64(data)
+
+		case proto.WireFixed32:
+			if size = 4; len(data) < size {
+				return fmt.Errorf("invalid fixed32")
+			}
+			scalar = uint64(binary.LittleEndian.Uint32(data))
+
+		case proto.WireBytes:
+			length, lengthSize := proto.DecodeVarint(data)
+			if lengthSize == 0 || uint64(len(data)-lengthSize) < length {
+				return fmt.Errorf("invalid length delimited field")
+			}
+			value = data[lengthSize : lengthSize+int(length)]
+			size = lengthSize + int(length)
+
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+
+		data = data[size:]
+		if err := onField(int(key>>3), value, scalar); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBigQuerySchema converts a TableSchema message to a list of columns.
+func parseBigQuerySchema(data []byte) ([]bigQueryField, error) {
+	fields := []bigQueryField{}
+	err := bigQueryDecodeFields(data, func(number int, value []byte, scalar uint64) error {
+		if number != 1 {
+			return nil // ### return, not a field ###
+		}
+		field, err := parseBigQueryField(value)
+		fields = append(fields, field)
+		return err
+	})
+	return fields, err
+}
+
+// parseBigQueryField converts a TableFieldSchema message to a column.
+func parseBigQueryField(data []byte) (bigQueryField, error) {
+	field := bigQueryField{mode: bigQueryModeNullable}
+	err := bigQueryDecodeFields(data, func(number int, value []byte, scalar uint64) error {
+		switch number {
+		case 1:
+			field.name = string(value)
+		case 2:
+			field.kind = scalar
+		case 3:
+			if scalar != 0 {
+				field.mode = scalar
+			}
+		case 4:
+			nested, err := parseBigQueryField(value)
+			field.fields = append(field.fields, nested)
+			return err
+		}
+		return nil
+	})
+	return field, err
+}
+
+// newBigQueryDescriptor creates a self contained protobuf descriptor for rows
+// of the given schema. Nested messages are added to the top level message
+// as required by the Storage Write API.
+func newBigQueryDescriptor(fields []bigQueryField) (*descriptor.DescriptorProto, error) {
+	root := &descriptor.DescriptorProto{Name: proto.String("Row")}
+	err := addBigQueryMessageFields(root, root, fields)
+	return root, err
+}
+
+func addBigQueryMessageFields(root *descriptor.DescriptorProto, message *descriptor.DescriptorProto, fields []bigQueryField) error {
+	for idx, field := range fields {
+		fieldDesc := &descriptor.FieldDescriptorProto{
+			Name:   proto.String(field.name),
+			Number: proto.Int32(int32(idx + 1)),
+			Label:  descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+
+		switch field.mode {
+		case bigQueryModeRequired:
+			fieldDesc.Label = descriptor.FieldDescriptorProto_LABEL_REQUIRED.Enum()
+		case bigQueryModeRepeated:
+			fieldDesc.Label = descriptor.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		}
+
+		switch field.kind {
+		case bigQueryTypeString, bigQueryTypeJSON, bigQueryTypeNumeric, bigQueryTypeBignumeric,
+			bigQueryTypeGeography, bigQueryTypeDatetime, bigQueryTypeTime:
+			fieldDesc.Type = descriptor.FieldDescriptorProto_TYPE_STRING.Enum()
+		case bigQueryTypeInt64, bigQueryTypeTimestamp:
+			fieldDesc.Type = descriptor.FieldDescriptorProto_TYPE_INT64.Enum()
+		case bigQueryTypeDate:
+			fieldDesc.Type = descriptor.FieldDescriptorProto_TYPE_INT32.Enum()
+		case bigQueryTypeDouble:
+			fieldDesc.Type = descriptor.FieldDescriptorProto_TYPE_DOUBLE.Enum()
+		case bigQueryTypeBool:
+			fieldDesc.Type = descriptor.FieldDescriptorProto_TYPE_BOOL.Enum()
+		case bigQueryTypeBytes:
+			fieldDesc.Type = descriptor.FieldDescriptorProto_TYPE_BYTES.Enum()
+		case bigQueryTypeStruct:
+			nested := &descriptor.DescriptorProto{Name: proto.String(fmt.Sprintf("%s_%s", message.GetName(), field.name))}
+			if err := addBigQueryMessageFields(root, nested, field.fields); err != nil {
+				return err
+			}
+			root.NestedType = append(root.NestedType, nested)
+			fieldDesc.Type = descriptor.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+			fieldDesc.TypeName = nested.Name
+		default:
+			return fmt.Errorf("column %s has the unsupported type %d", field.name, field.kind)
+		}
+
+		message.Field = append(message.Field, fieldDesc)
+	}
+	return nil
+}
+
+// encodeBigQueryRow converts a JSON object to a protobuf message matching
+// the given schema. Keys not matching a column are ignored.
+func encodeBigQueryRow(fields []bigQueryField, row map[string]interface{}) ([]byte, error) {
+	message := proto.NewBuffer(nil)
+	for idx, field := range fields {
+		value, exists := row[field.name]
+		if !exists {
+			for key, keyValue := range row {
+				if strings.EqualFold(key, field.name) {
+					value, exists = keyValue, true
+					break
+				}
+			}
+		}
+
+		if !exists || value == nil {
+			if field.mode == bigQueryModeRequired {
+				return nil, fmt.Errorf("required column %s is not set", field.name)
+			}
+			continue
+		}
+
+		values, isList := value.([]interface{})
+		if !isList || field.mode != bigQueryModeRepeated {
+			values = []interface{}{value}
+		}
+
+		for _, value := range values {
+			if err := encodeBigQueryValue(message, idx+1, field, value); err != nil {
+				return nil, fmt.Errorf("column %s: %s", field.name, err.Error())
+			}
+		}
+	}
+	return message.Bytes(), nil
+}
+
+func encodeBigQueryValue(message *proto.Buffer, number int, field bigQueryField, value interface{}) error {
+	key := uint64(number) << 3
+
+	switch field.kind {
+	case bigQueryTypeInt64:
+		intValue, err := bigQueryToInt64(value)
+		if err != nil {
+			return err
+		}
+		message.EncodeVarint(key | proto.WireVarint)
+		message.EncodeVarint(uint64(intValue))
+
+	case bigQueryTypeDouble:
+		floatValue, err := bigQueryToFloat64(value)
+		if err != nil {
+			return err
+		}
+		message.EncodeVarint(key | proto.WireFixed64)
+		message.EncodeFixed64(math.Float64bits(floatValue))
+
+	case bigQueryTypeBool:
+		boolValue, err := strconv.ParseBool(bigQueryToString(value))
+		if err != nil {
+			return err
+		}
+		message.EncodeVarint(key | proto.WireVarint)
+		if boolValue {
+			message.EncodeVarint(1)
+		} else {
+			message.EncodeVarint(0)
+		}
+
+	case bigQueryTypeBytes:
+		// Bytes are base64 encoded in JSON
+		data, err := base64.StdEncoding.DecodeString(bigQueryToString(value))
+		if err != nil {
+			return err
+		}
+		message.EncodeVarint(key | proto.WireBytes)
+		message.EncodeRawBytes(data)
+
+	case bigQueryTypeTimestamp:
+		timestamp, err := bigQueryToTime(value, time.RFC3339Nano)
+		if err != nil {
+			return err
+		}
+		message.EncodeVarint(key | proto.WireVarint)
+		message.EncodeVarint(uint64(timestamp.UnixNano() / int64(time.Microsecond)))
+
+	case bigQueryTypeDate:
+		date, err := bigQueryToTime(value, "2006-01-02")
+		if err != nil {
+			return err
+		}
+		days := int32(date.Unix() / int64(24*time.Hour/time.Second))
+		message.EncodeVarint(key | proto.WireVarint)
+		message.EncodeVarint(uint64(days))
+
+	case bigQueryTypeJSON:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		message.EncodeVarint(key | proto.WireBytes)
+		message.EncodeRawBytes(data)
+
+	case bigQueryTypeStruct:
+		var row map[string]interface{}
+		switch object := value.(type) {
+		case map[string]interface{}:
+			row = object
+		case tcontainer.MarshalMap:
+			row = object
+		default:
+			return fmt.Errorf("%v is not an object", value)
+		}
+
+		nested, err := encodeBigQueryRow(field.fields, row)
+		if err != nil {
+			return err
+		}
+		message.EncodeVarint(key | proto.WireBytes)
+		message.EncodeRawBytes(nested)
+
+	default:
+		message.EncodeVarint(key | proto.WireBytes)
+		message.EncodeStringBytes(bigQueryToString(value))
+	}
+	return nil
+}
+
+func bigQueryToString(value interface{}) string {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue
+	case json.Number:
+		return typedValue.String()
+	case bool:
+		return strconv.FormatBool(typedValue)
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64)
+	default:
+		data, _ := json.Marshal(value)
+		return string(data)
+	}
+}
+
+func bigQueryToInt64(value interface{}) (int64, error) {
+	switch typedValue := value.(type) {
+	case float64:
+		return int64(typedValue), nil
+	case bool:
+		if typedValue {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		text := bigQueryToString(value)
+		if intValue, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return intValue, nil
+		}
+		floatValue, err := strconv.ParseFloat(text, 64)
+		return int64(floatValue), err
+	}
+}
+
+func bigQueryToFloat64(value interface{}) (float64, error) {
+	if floatValue, isFloat := value.(float64); isFloat {
+		return floatValue, nil
+	}
+	return strconv.ParseFloat(bigQueryToString(value), 64)
+}
+
+// bigQueryToTime parses strings with the given layout. Numbers are treated
+// as seconds since epoch.
+func bigQueryToTime(value interface{}, layout string) (time.Time, error) {
+	switch value.(type) {
+	case float64, json.Number:
+		seconds, err := bigQueryToFloat64(value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))).UTC(), nil
+	default:
+		return time.Parse(layout, bigQueryToString(value))
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// eventHubsBatchFormat is the AMQP message format of batched events.
+const eventHubsBatchFormat = 0x80013700
+
+// EventHubs producer
+//
+// This producer sends messages to an Azure Event Hub using AMQP 1.0. Messages
+// with the same partition key are sent as batched events. A batch is complete
+// once Event Hubs accepted it. Batches that still fail after all retries are
+// sent to the fallback stream.
+//
+// Parameters
+//
+// - PartitionKeyFrom: Defines the metadata key holding the partition key.
+// Events with the same key are stored in the same partition. If empty, or if
+// the key is not set, Event Hubs distributes events across partitions.
+// By default this parameter is set to "".
+//
+// - MaxBatchSizeKB: Defines the maximum size of a single batch sent to Event
+// Hubs. Event Hubs rejects batches larger than 1 MB (standard tier).
+// By default this parameter is set to 1000.
+//
+// - TimeoutSec: Defines the number of seconds to wait for Event Hubs to
+// accept a batch.
+// By default this parameter is set to 30.
+//
+// - Retry/Count: Defines the number of retries before messages are sent to
+// the fallback stream.
+// By default this parameter is set to 3.
+//
+// - Retry/DelayMs: Defines the number of milliseconds to wait before the first
+// retry. The delay is doubled with every retry.
+// By default this parameter is set to 500.
+//
+// Examples
+//
+// This example sends messages to the "logs" event hub, keeping the messages
+// of each host in one partition:
+//
+//  AzureOut:
+//    Type: producer.EventHubs
+//    Streams: logs
+//    ConnectionString: "Endpoint=sb://example.servicebus.windows.net/;SharedAccessKeyName=gollum;SharedAccessKey=secret;EntityPath=logs"
+//    PartitionKeyFrom: hostname
+//    Batch:
+//      MaxCount: 500
+//      TimeoutSec: 1
+type EventHubs struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	// EventHubsClient is public to make EventHubsClient.Configure() callable
+	EventHubsClient components.EventHubsClient `gollumdoc:"embed_type"`
+
+	partitionKeyFrom string        `config:"PartitionKeyFrom"`
+	maxBatchSize     int           `config:"MaxBatchSizeKB" default:"1000" metric:"kb"`
+	timeout          time.Duration `config:"TimeoutSec" default:"30" metric:"sec"`
+	retryCount       int           `config:"Retry/Count" default:"3"`
+	retryDelay       time.Duration `config:"Retry/DelayMs" default:"500" metric:"ms"`
+
+	conn   *amqp.Client
+	sender *amqp.Sender
+	guard  *sync.Mutex
+}
+
+// eventHubsBatch is a set of events sent as a single AMQP message.
+type eventHubsBatch struct {
+	partitionKey string
+	events       [][]byte
+	messages     []*core.Message
+	size         int
+}
+
+func init() {
+	core.TypeRegistry.Register(EventHubs{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *EventHubs) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+	prod.guard = new(sync.Mutex)
+
+	if !prod.EventHubsClient.IsConfigured() {
+		prod.Logger.Warning("No event hub configured")
+	}
+}
+
+// Produce writes to Event Hubs.
+func (prod *EventHubs) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.sendBatch })
+}
+
+func (prod *EventHubs) close() {
+	prod.DefaultClose()
+
+	prod.guard.Lock()
+	defer prod.guard.Unlock()
+	prod.disconnect()
+}
+
+func (prod *EventHubs) connect() error {
+	if prod.sender != nil {
+		return nil
+	}
+
+	conn, err := prod.EventHubsClient.Dial()
+	if err != nil {
+		return err
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	sender, err := session.NewSender(amqp.LinkTargetAddress(prod.EventHubsClient.GetHub()))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	prod.conn, prod.sender = conn, sender
+	return nil
+}
+
+func (prod *EventHubs) disconnect() {
+	if prod.conn != nil {
+		prod.conn.Close()
+	}
+	prod.conn, prod.sender = nil, nil
+}
+
+func (prod *EventHubs) sendBatch(messages []*core.Message) {
+	if !prod.EventHubsClient.IsConfigured() {
+		for _, msg := range messages {
+			prod.TryFallback(msg)
+		}
+		return // ### return, nowhere to send to ###
+	}
+
+	for _, batch := range prod.assembleBatches(messages) {
+		prod.send(batch)
+	}
+}
+
+// assembleBatches groups messages by partition key and splits the groups so
+// that no batch exceeds the maximum batch size.
+func (prod *EventHubs) assembleBatches(messages []*core.Message) []*eventHubsBatch {
+	var (
+		batches []*eventHubsBatch
+		current = make(map[string]*eventHubsBatch)
+	)
+
+	for _, msg := range messages {
+		partitionKey := ""
+		if prod.partitionKeyFrom != "" {
+			if metadata := msg.TryGetMetadata(); metadata != nil {
+				partitionKey = metadata.GetValueString(prod.partitionKeyFrom)
+			}
+		}
+
+		event := &amqp.Message{Data: [][]byte{msg.GetPayload()}}
+		if partitionKey != "" {
+			event.Annotations = amqp.Annotations{"x-opt-partition-key": partitionKey}
+		}
+		data, err := event.MarshalBinary()
+		if err != nil {
+			prod.Logger.WithError(err).Error("Failed to encode message")
+			prod.TryFallback(msg)
+			continue
+		}
+		if len(data) > prod.maxBatchSize {
+			prod.Logger.Errorf("Message of %d bytes exceeds MaxBatchSizeKB", len(data))
+			prod.TryFallback(msg)
+			continue
+		}
+
+		batch, exists := current[partitionKey]
+		if !exists || batch.size+len(data) > prod.maxBatchSize {
+			batch = &eventHubsBatch{partitionKey: partitionKey}
+			current[partitionKey] = batch
+			batches = append(batches, batch)
+		}
+		batch.events = append(batch.events, data)
+		batch.messages = append(batch.messages, msg)
+		batch.size += len(data)
+	}
+	return batches
+}
+
+func (prod *EventHubs) send(batch *eventHubsBatch) {
+	message := &amqp.Message{
+		Format: eventHubsBatchFormat,
+		Data:   batch.events,
+	}
+	if batch.partitionKey != "" {
+		message.Annotations = amqp.Annotations{"x-opt-partition-key": batch.partitionKey}
+	}
+
+	prod.guard.Lock()
+	defer prod.guard.Unlock()
+
+	var err error
+	delay := prod.retryDelay
+
+	for retry := 0; retry <= prod.retryCount; retry++ {
+		if retry > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		if err = prod.connect(); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), prod.timeout)
+			err = prod.sender.Send(ctx, message)
+			cancel()
+			if err == nil {
+				return // ### return, sent ###
+			}
+			prod.disconnect()
+		}
+		prod.Logger.WithError(err).Warningf("Failed to send %d messages", len(batch.messages))
+	}
+
+	prod.Logger.WithError(err).Errorf("Failed to send %d messages, sending to fallback", len(batch.messages))
+	for _, msg := range batch.messages {
+		prod.TryFallback(msg)
+	}
+}
@@ -285,7 +285,7 @@ func (prod *File) writeMessage(msg *core.Message) {
 		return // ### return, fallback ###
 	}
 
-	batchedFile.Batch.AppendOrFlush(msg, batchedFile.Flush, prod.IsActiveOrStopping, prod.TryFallback)
+	batchedFile.AppendOrFlush(msg, prod.IsActiveOrStopping, prod.TryFallback)
 }
 
 func (prod *File) close() {
@@ -0,0 +1,332 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/tnet"
+)
+
+const (
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+)
+
+var gelfInvalidFieldChars = regexp.MustCompile(`[^\w\.\-]`)
+
+// GELF producer plugin
+//
+// This producer sends messages in the Graylog Extended Log Format (GELF) 1.1
+// via UDP or TCP. The payload is sent as short_message. If the payload spans
+// multiple lines, the first line is used as short_message and the complete
+// payload is sent as full_message. Metadata fields are sent as additional
+// fields, i.e. prefixed with "_". Characters not allowed in GELF field names
+// are replaced by "_".
+//
+// Parameters
+//
+// - Address: Defines the address of the Graylog input. Use "udp://" or
+// "tcp://" as a prefix to choose the protocol.
+// By default this parameter is set to "udp://localhost:12201".
+//
+// - Compression: Defines the compression to use for UDP messages. Valid values
+// are "gzip", "zlib" and "none". TCP messages are never compressed.
+// By default this parameter is set to "gzip".
+//
+// - ChunkSize: Defines the maximum size in bytes of a UDP datagram. Messages
+// larger than this are split into chunks. Messages requiring more than 128
+// chunks are sent to the fallback.
+// By default this parameter is set to 1420.
+//
+// - Host: Defines the value of the host field. If empty, the host name of the
+// machine is used.
+// By default this parameter is set to "".
+//
+// - Level: Defines the syslog severity used as level. Names like "warning" or
+// numbers are accepted.
+// By default this parameter is set to "info".
+//
+// - LevelFrom: Defines a metadata field to read the level from. If the field
+// is missing or invalid, Level is used.
+// By default this parameter is set to "".
+//
+// - MetadataFields: Defines a list of metadata fields sent as additional
+// fields. If empty, all metadata fields are sent.
+// By default this parameter is set to an empty list.
+//
+// - ConnectTimeoutMs: Defines the timeout for establishing TCP connections.
+// By default this parameter is set to 2000.
+//
+// - TlsEnable: Enables TLS for TCP connections. See
+// core/components.NewTLSClientConfig for additional TLS settings.
+// By default this parameter is set to false.
+//
+// Examples
+//
+//  GraylogOut:
+//    Type: producer.GELF
+//    Streams: applogs
+//    Address: "udp://graylog:12201"
+//    LevelFrom: severity
+type GELF struct {
+	core.BufferedProducer `gollumdoc:"embed_type"`
+	compression           string        `config:"Compression" default:"gzip"`
+	chunkSize             int           `config:"ChunkSize" default:"1420"`
+	host                  string        `config:"Host"`
+	levelFrom             string        `config:"LevelFrom"`
+	metadataFields        []string      `config:"MetadataFields"`
+	connectTimeout        time.Duration `config:"ConnectTimeoutMs" default:"2000" metric:"ms"`
+	tlsEnable             bool          `config:"TlsEnable" default:"false"`
+	protocol              string
+	address               string
+	level                 int
+	tlsConfig             *tls.Config
+	connection            net.Conn
+}
+
+func init() {
+	core.TypeRegistry.Register(GELF{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *GELF) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+
+	prod.protocol, prod.address = tnet.ParseAddress(conf.GetString("Address", "udp://localhost:12201"), "udp")
+	if prod.protocol != "udp" && prod.protocol != "tcp" {
+		conf.Errors.Pushf("Address must use either udp or tcp")
+	}
+
+	var valid bool
+	if prod.level, valid = parseSyslogValue(conf.GetString("Level", "info"), syslogSeverities, 7); !valid {
+		conf.Errors.Pushf("Unknown level")
+	}
+
+	prod.compression = strings.ToLower(prod.compression)
+	switch prod.compression {
+	case "gzip", "zlib", "none":
+	default:
+		conf.Errors.Pushf("Compression must be one of gzip, zlib or none")
+	}
+
+	if prod.chunkSize <= gelfChunkHeaderSize {
+		conf.Errors.Pushf("ChunkSize must be larger than %d", gelfChunkHeaderSize)
+	}
+
+	if prod.host == "" {
+		prod.host, _ = os.Hostname()
+	}
+
+	if prod.tlsEnable {
+		tlsConfig, err := components.NewTLSClientConfig(conf)
+		conf.Errors.Push(err)
+		prod.tlsConfig = tlsConfig
+	}
+}
+
+func (prod *GELF) encode(msg *core.Message) ([]byte, error) {
+	payload := strings.TrimRight(string(msg.GetPayload()), "\r\n")
+	gelf := map[string]interface{}{
+		"version":       "1.1",
+		"host":          prod.host,
+		"short_message": payload,
+		"timestamp":     float64(msg.GetCreationTime().UnixNano()/int64(time.Millisecond)) / 1000,
+		"level":         prod.level,
+	}
+
+	if lineEnd := strings.IndexByte(payload, '\n'); lineEnd >= 0 {
+		gelf["short_message"] = strings.TrimRight(payload[:lineEnd], "\r")
+		gelf["full_message"] = payload
+	}
+
+	if metadata := msg.TryGetMetadata(); metadata != nil {
+		if prod.levelFrom != "" {
+			if level, valid := parseSyslogValue(metadata.GetValueString(prod.levelFrom), syslogSeverities, 7); valid {
+				gelf["level"] = level
+			}
+		}
+
+		addField := func(key string, value []byte) {
+			field := "_" + gelfInvalidFieldChars.ReplaceAllString(key, "_")
+			if field == "_id" {
+				field = "_id_" // _id is reserved
+			}
+			gelf[field] = string(value)
+		}
+
+		if len(prod.metadataFields) == 0 {
+			for key, value := range metadata {
+				addField(key, value)
+			}
+		} else {
+			for _, key := range prod.metadataFields {
+				if value, exists := metadata.TryGetValue(key); exists {
+					addField(key, value)
+				}
+			}
+		}
+	}
+
+	return json.Marshal(gelf)
+}
+
+func (prod *GELF) compress(data []byte) []byte {
+	buffer := bytes.Buffer{}
+	switch prod.compression {
+	case "gzip":
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(data)
+		writer.Close()
+	case "zlib":
+		writer := zlib.NewWriter(&buffer)
+		writer.Write(data)
+		writer.Close()
+	default:
+		return data
+	}
+	return buffer.Bytes()
+}
+
+// chunk splits data into GELF chunks if it exceeds the configured ChunkSize.
+func (prod *GELF) chunk(data []byte) ([][]byte, error) {
+	if len(data) <= prod.chunkSize {
+		return [][]byte{data}, nil
+	}
+
+	dataPerChunk := prod.chunkSize - gelfChunkHeaderSize
+	numChunks := (len(data) + dataPerChunk - 1) / dataPerChunk
+	if numChunks > gelfMaxChunks {
+		return nil, fmt.Errorf("message requires %d chunks, only %d are allowed", numChunks, gelfMaxChunks)
+	}
+
+	messageID := make([]byte, 8)
+	rand.Read(messageID)
+
+	chunks := make([][]byte, 0, numChunks)
+	for i := 0; i < numChunks; i++ {
+		start := i * dataPerChunk
+		end := start + dataPerChunk
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk := make([]byte, 0, gelfChunkHeaderSize+end-start)
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, messageID...)
+		chunk = append(chunk, byte(i), byte(numChunks))
+		chunks = append(chunks, append(chunk, data[start:end]...))
+	}
+	return chunks, nil
+}
+
+func (prod *GELF) tryConnect() bool {
+	if prod.connection != nil {
+		return true // ### return, connection active ###
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	dialer := &net.Dialer{Timeout: prod.connectTimeout}
+	if prod.protocol == "tcp" && prod.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", prod.address, prod.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(prod.protocol, prod.address)
+	}
+
+	if err != nil {
+		prod.Logger.Error("Connection error: ", err)
+		return false // ### return, connection failed ###
+	}
+
+	prod.connection = conn
+	return true
+}
+
+func (prod *GELF) closeConnection() {
+	if prod.connection != nil {
+		prod.connection.Close()
+		prod.connection = nil
+	}
+}
+
+func (prod *GELF) sendMessage(msg *core.Message) {
+	data, err := prod.encode(msg)
+	if err != nil {
+		prod.Logger.WithError(err).Error("Failed to encode message")
+		prod.TryFallback(msg)
+		return // ### return, invalid message ###
+	}
+
+	if !prod.tryConnect() {
+		prod.TryFallback(msg)
+		return // ### return, not connected ###
+	}
+
+	if prod.protocol == "tcp" {
+		// TCP messages are null byte delimited and must not be compressed
+		if _, err = prod.connection.Write(append(data, 0)); err != nil {
+			prod.Logger.WithError(err).Error("Write error")
+			prod.closeConnection()
+			prod.TryFallback(msg)
+		}
+		return // ### return, sent via TCP ###
+	}
+
+	chunks, err := prod.chunk(prod.compress(data))
+	if err != nil {
+		prod.Logger.WithError(err).Error("Message too large")
+		prod.TryFallback(msg)
+		return // ### return, message too large ###
+	}
+
+	for _, chunk := range chunks {
+		if _, err := prod.connection.Write(chunk); err != nil {
+			prod.Logger.WithError(err).Error("Write error")
+			prod.closeConnection()
+			prod.TryFallback(msg)
+			return // ### return, write failed ###
+		}
+	}
+}
+
+func (prod *GELF) close() {
+	defer prod.WorkerDone()
+	prod.DefaultClose()
+	prod.closeConnection()
+}
+
+// Produce sends messages to a GELF input.
+func (prod *GELF) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	prod.MessageControlLoop(prod.sendMessage)
+}
@@ -0,0 +1,213 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// GRPC producer
+//
+// This producer forwards messages to a gRPC endpoint using a client streaming
+// call. Each batch opens one call per gollum stream so that streams are
+// independent of each other. Flow control is handled by HTTP/2, i.e. sending
+// blocks if the server does not consume messages fast enough. The server has
+// to implement the following service:
+//
+//  syntax = "proto3";
+//  package gollum;
+//
+//  message Envelope {
+//    bytes payload = 1;
+//    map<string, bytes> metadata = 2;
+//    string stream = 3;
+//    int64 timestamp = 4; // creation time in unix nanoseconds
+//  }
+//
+//  message Ack {}
+//
+//  service Forwarder {
+//    rpc Forward(stream Envelope) returns (Ack);
+//  }
+//
+// A call is retried if the connection fails or if the server responds with
+// one of the status codes UNAVAILABLE, RESOURCE_EXHAUSTED, ABORTED or
+// DEADLINE_EXCEEDED. Other errors cause the messages to be sent to the
+// fallback.
+//
+// Parameters
+//
+// - Address: Defines the host and port of the gRPC server.
+// By default this parameter is set to "localhost:50051".
+//
+// - Method: Defines the full name of the client streaming method to call.
+// By default this parameter is set to "/gollum.Forwarder/Forward".
+//
+// - TimeoutSec: Defines the deadline for a single call in seconds.
+// By default this parameter is set to 30.
+//
+// - Retry/Count: Defines the number of retries before messages are sent to
+// the fallback stream.
+// By default this parameter is set to 3.
+//
+// - Retry/DelayMs: Defines the number of milliseconds to wait before the first
+// retry. The delay is doubled with every retry.
+// By default this parameter is set to 500.
+//
+// - TlsEnable: Enables TLS when connecting to the server.
+// By default this parameter is set to false.
+//
+// - TlsKeyLocation: Defines the path to the client's PEM-formatted private key
+// used for mutual TLS. Requires TlsCertificateLocation to be set, too.
+// By default this parameter is set to "".
+//
+// - TlsCertificateLocation: Defines the path to the client's PEM-formatted
+// certificate used for mutual TLS.
+// By default this parameter is set to "".
+//
+// - TlsCaLocation: Defines the path to the CA certificate(s) used to verify
+// the server. If not set, the system's root certificates are used.
+// By default this parameter is set to "".
+//
+// - TlsServerName: Defines the expected hostname of the server certificate.
+// By default this parameter is set to "".
+//
+// - TlsInsecureSkipVerify: Disables verification of the server's certificate
+// chain and host name.
+// By default this parameter is set to false.
+//
+// Examples
+//
+//  GrpcOut:
+//    Type: producer.GRPC
+//    Streams: "*"
+//    Address: "collector:50051"
+//    TlsEnable: true
+//    TlsCaLocation: /etc/ssl/collector-ca.pem
+//    Batch:
+//      MaxCount: 1024
+//      TimeoutSec: 1
+type GRPC struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	address              string        `config:"Address" default:"localhost:50051"`
+	method               string        `config:"Method" default:"/gollum.Forwarder/Forward"`
+	timeout              time.Duration `config:"TimeoutSec" default:"30" metric:"sec"`
+	retryCount           int           `config:"Retry/Count" default:"3"`
+	retryDelay           time.Duration `config:"Retry/DelayMs" default:"500" metric:"ms"`
+	tlsEnable            bool          `config:"TlsEnable" default:"false"`
+	client               *grpcClient
+}
+
+func init() {
+	core.TypeRegistry.Register(GRPC{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *GRPC) Configure(conf core.PluginConfigReader) {
+	var tlsConfig *tls.Config
+	if prod.tlsEnable {
+		var err error
+		tlsConfig, err = components.NewTLSClientConfig(conf)
+		if conf.Errors.Push(err) {
+			return
+		}
+	}
+	prod.client = newGRPCClient(prod.address, tlsConfig, prod.timeout, false)
+}
+
+// encodeEnvelope converts the given message to an Envelope protobuf message.
+func (prod *GRPC) encodeEnvelope(msg *core.Message) []byte {
+	envelope := proto.NewBuffer(nil)
+
+	envelope.EncodeVarint(1<<3 | proto.WireBytes)
+	envelope.EncodeRawBytes(msg.GetPayload())
+
+	if metadata := msg.TryGetMetadata(); metadata != nil {
+		for key, value := range metadata {
+			entry := proto.NewBuffer(nil)
+			entry.EncodeVarint(1<<3 | proto.WireBytes)
+			entry.EncodeStringBytes(key)
+			entry.EncodeVarint(2<<3 | proto.WireBytes)
+			entry.EncodeRawBytes(value)
+
+			envelope.EncodeVarint(2<<3 | proto.WireBytes)
+			envelope.EncodeRawBytes(entry.Bytes())
+		}
+	}
+
+	envelope.EncodeVarint(3<<3 | proto.WireBytes)
+	envelope.EncodeStringBytes(core.StreamRegistry.GetStreamName(msg.GetStreamID()))
+
+	envelope.EncodeVarint(4<<3 | proto.WireVarint)
+	envelope.EncodeVarint(uint64(msg.GetCreationTime().UnixNano()))
+
+	return envelope.Bytes()
+}
+
+func (prod *GRPC) sendMessages(messages []*core.Message) {
+	envelopes := make([][]byte, len(messages))
+	for i, msg := range messages {
+		envelopes[i] = prod.encodeEnvelope(msg)
+	}
+
+	var err error
+	delay := prod.retryDelay
+
+	for retry := 0; retry <= prod.retryCount; retry++ {
+		if retry > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = prod.client.call(prod.method, envelopes); err == nil || !isRetryableGRPCError(err) {
+			break
+		}
+		prod.Logger.WithError(err).Warningf("Failed to forward %d messages", len(messages))
+	}
+
+	if err != nil {
+		prod.Logger.WithError(err).Errorf("Failed to forward %d messages, sending to fallback", len(messages))
+		for _, msg := range messages {
+			prod.TryFallback(msg)
+		}
+	}
+}
+
+func (prod *GRPC) sendBatch(messages []*core.Message) {
+	streams := make(map[core.MessageStreamID][]*core.Message)
+	for _, msg := range messages {
+		streams[msg.GetStreamID()] = append(streams[msg.GetStreamID()], msg)
+	}
+
+	wg := new(sync.WaitGroup)
+	for _, streamMessages := range streams {
+		wg.Add(1)
+		go func(streamMessages []*core.Message) {
+			defer wg.Done()
+			prod.sendMessages(streamMessages)
+		}(streamMessages)
+	}
+	wg.Wait()
+}
+
+// Produce forwards messages to a gRPC server.
+func (prod *GRPC) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.sendBatch })
+}
@@ -0,0 +1,276 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	grpcStatusOK                = 0
+	grpcStatusDeadlineExceeded  = 4
+	grpcStatusAlreadyExists     = 6
+	grpcStatusResourceExhausted = 8
+	grpcStatusAborted           = 10
+	grpcStatusOutOfRange        = 11
+	grpcStatusUnavailable       = 14
+)
+
+// grpcClient implements the client side of the gRPC wire protocol on top of
+// HTTP/2. Messages have to be passed as serialized protobuf messages. Unary
+// calls are handled as client streaming calls with a single message.
+type grpcClient struct {
+	transport *http2.Transport
+	scheme    string
+	address   string
+	timeout   time.Duration
+	compress  bool
+	headers   http.Header
+}
+
+type grpcStatusError struct {
+	code    int
+	message string
+}
+
+func (err grpcStatusError) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", err.code, err.message)
+}
+
+// newGRPCClient creates a client connecting to the given address. If
+// tlsConfig is nil, a plaintext connection is used. The timeout is applied
+// to dialing and to each call.
+func newGRPCClient(address string, tlsConfig *tls.Config, timeout time.Duration, compress bool) *grpcClient {
+	// The vendored http2 transport does not send health check pings, so TCP
+	// keepalives are used to detect dead connections.
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	client := &grpcClient{
+		transport: &http2.Transport{},
+		scheme:    "https",
+		address:   address,
+		timeout:   timeout,
+		compress:  compress,
+		headers:   http.Header{},
+	}
+
+	if tlsConfig != nil {
+		client.transport.TLSClientConfig = tlsConfig
+		client.transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return tls.DialWithDialer(dialer, network, addr, cfg)
+		}
+	} else {
+		// Plaintext HTTP/2 without upgrade (h2c) as used by gRPC
+		client.scheme = "http"
+		client.transport.AllowHTTP = true
+		client.transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		}
+	}
+	return client
+}
+
+// frame returns the given message as length prefixed gRPC frame.
+func (client *grpcClient) frame(message []byte) ([]byte, error) {
+	compressed := byte(0)
+	if client.compress {
+		buffer := bytes.Buffer{}
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(message); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		message = buffer.Bytes()
+		compressed = 1
+	}
+
+	frame := make([]byte, 5, 5+len(message))
+	frame[0] = compressed
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...), nil
+}
+
+func (client *grpcClient) getStatus(header http.Header) (int, string, bool) {
+	status := header.Get("grpc-status")
+	if status == "" {
+		return 0, "", false
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return -1, status, true
+	}
+	message, _ := url.PathUnescape(header.Get("grpc-message"))
+	return code, message, true
+}
+
+// call sends the given messages to the given method using a single call.
+// The response message is discarded.
+func (client *grpcClient) call(method string, messages [][]byte) error {
+	_, err := client.invoke(method, nil, messages)
+	return err
+}
+
+// invoke sends the given messages to the given method using a single call
+// and returns all response messages. The given header is sent in addition
+// to the client's headers. The call is aborted if it does not finish within
+// the client's timeout.
+func (client *grpcClient) invoke(method string, header http.Header, messages [][]byte) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), client.timeout)
+	defer cancel()
+
+	body, writer := io.Pipe()
+	go func() {
+		for _, message := range messages {
+			frame, err := client.frame(message)
+			if err != nil {
+				writer.CloseWithError(err)
+				return // ### return, encoding failed ###
+			}
+			if _, err := writer.Write(frame); err != nil {
+				return // ### return, call aborted ###
+			}
+		}
+		writer.Close()
+	}()
+
+	callURL := url.URL{Scheme: client.scheme, Host: client.address, Path: method}
+	req, err := http.NewRequest(http.MethodPost, callURL.String(), body)
+	if err != nil {
+		body.CloseWithError(err)
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range client.headers {
+		req.Header[key] = values
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("grpc-timeout", fmt.Sprintf("%dm", int64(client.timeout/time.Millisecond)))
+	if client.compress {
+		req.Header.Set("grpc-encoding", "gzip")
+	}
+
+	resp, err := client.transport.RoundTrip(req)
+	if err != nil {
+		body.CloseWithError(err)
+		return nil, client.checkTimeout(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	// The response has to be read completely to receive the trailers
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		body.CloseWithError(err)
+		return nil, client.checkTimeout(ctx, err)
+	}
+	body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded with %s", resp.Status)
+	}
+
+	// Errors are either sent as trailers or as headers only response
+	code, message, found := client.getStatus(resp.Trailer)
+	if !found {
+		code, message, found = client.getStatus(resp.Header)
+	}
+	if !found {
+		return nil, fmt.Errorf("server did not send a grpc-status")
+	}
+	if code != grpcStatusOK {
+		return nil, grpcStatusError{code: code, message: message}
+	}
+	return client.unframe(data, resp.Header.Get("grpc-encoding"))
+}
+
+// checkTimeout closes the connections of the client if the call failed
+// because the deadline passed. This makes sure that the next call does not
+// reuse a connection that stopped responding.
+func (client *grpcClient) checkTimeout(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		client.transport.CloseIdleConnections()
+		return fmt.Errorf("grpc call did not finish within %v: %s", client.timeout, err)
+	}
+	return err
+}
+
+// unframe splits a response body into its length prefixed gRPC messages.
+func (client *grpcClient) unframe(data []byte, encoding string) ([][]byte, error) {
+	messages := [][]byte{}
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return nil, fmt.Errorf("incomplete grpc frame header")
+		}
+		length := int(binary.BigEndian.Uint32(data[1:5]))
+		if len(data)-5 < length {
+			return nil, fmt.Errorf("incomplete grpc frame")
+		}
+		message := data[5 : 5+length]
+
+		if data[0] == 1 {
+			if encoding != "gzip" {
+				return nil, fmt.Errorf("unsupported grpc encoding %q", encoding)
+			}
+			reader, err := gzip.NewReader(bytes.NewReader(message))
+			if err != nil {
+				return nil, err
+			}
+			if message, err = ioutil.ReadAll(reader); err != nil {
+				return nil, err
+			}
+		}
+
+		messages = append(messages, message)
+		data = data[5+length:]
+	}
+	return messages, nil
+}
+
+// isRetryableGRPCError returns true for transport errors and status codes
+// denoting a temporary problem.
+func isRetryableGRPCError(err error) bool {
+	statusErr, isStatus := err.(grpcStatusError)
+	if !isStatus {
+		return true
+	}
+
+	switch statusErr.code {
+	case grpcStatusUnavailable, grpcStatusResourceExhausted, grpcStatusAborted, grpcStatusDeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
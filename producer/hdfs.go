@@ -0,0 +1,648 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	krbclient "gopkg.in/jcmturner/gokrb5.v7/client"
+	krbconfig "gopkg.in/jcmturner/gokrb5.v7/config"
+	"gopkg.in/jcmturner/gokrb5.v7/credentials"
+	"gopkg.in/jcmturner/gokrb5.v7/keytab"
+	"gopkg.in/jcmturner/gokrb5.v7/spnego"
+)
+
+// HDFS producer plugin
+//
+// This producer writes messages to files in HDFS using the WebHDFS REST API.
+// HttpFS gateways are supported, too. Each batch is appended to the current
+// file of a stream. Files are rotated according to the rotation settings, in
+// which case a new file is created.
+// When a stream's first file is opened and a file with the same name already
+// exists, e.g. after a restart, data is appended to that file unless it
+// exceeds the rotation size.
+//
+// Parameters
+//
+// - NameNodes: Defines a list of WebHDFS or HttpFS URLs. When running a high
+// availability setup, list all NameNodes. Standby NameNodes are skipped.
+// By default this parameter is set to "http://localhost:9870".
+//
+// - Directory: Defines the directory to write files to. Every "*" will be
+// replaced by the name of the stream. Missing directories are created.
+// By default this parameter is set to "/gollum".
+//
+// - TimeBasedDirectory: When set to true, Directory is treated as a template
+// for time.Format using the time the file is created, e.g. "/logs/2006/01/02".
+// By default this parameter is set to false.
+//
+// - File: Defines the name pattern of the files to write. Every "*" will be
+// replaced by the name of the stream. If rotation is enabled, the rotation
+// timestamp is appended to the name before the file extension.
+// By default this parameter is set to "gollum_*.log".
+//
+// - Permission: Defines the octal permissions of newly created files.
+// By default this parameter is set to "644".
+//
+// - Replication: Defines the replication factor of newly created files.
+// If set to 0 the cluster's default is used.
+// By default this parameter is set to 0.
+//
+// - Authentication: Defines the authentication method to use. Valid values
+// are "none", "simple" (pseudo authentication sending User), "token"
+// (sending DelegationToken) and "kerberos" (SPNEGO).
+// By default this parameter is set to "none".
+//
+// - User: Defines the user name used for "simple" authentication.
+// By default this parameter is set to "gollum".
+//
+// - DelegationToken: Defines the delegation token used for "token"
+// authentication.
+// By default this parameter is set to "".
+//
+// - Kerberos/Config: Defines the path to the krb5.conf file.
+// By default this parameter is set to "/etc/krb5.conf".
+//
+// - Kerberos/Principal: Defines the user name of the Kerberos principal.
+// By default this parameter is set to "".
+//
+// - Kerberos/Realm: Defines the realm of the Kerberos principal. If empty,
+// the default realm of Kerberos/Config is used.
+// By default this parameter is set to "".
+//
+// - Kerberos/KeytabFile: Defines the keytab used to log in.
+// By default this parameter is set to "".
+//
+// - Kerberos/CCacheFile: Defines a credentials cache, e.g. created by kinit,
+// used to log in if no KeytabFile is set.
+// By default this parameter is set to "".
+//
+// - Kerberos/Password: Defines the password used to log in if neither
+// KeytabFile nor CCacheFile are set.
+// By default this parameter is set to "".
+//
+// - Kerberos/ServicePrincipal: Defines the service principal of the
+// NameNodes. If empty, "HTTP/<host>" is used.
+// By default this parameter is set to "".
+//
+// - Kerberos/DisablePAFXFAST: Set to true when using Active Directory as KDC.
+// By default this parameter is set to false.
+//
+// - TimeoutSec: Defines the timeout for a single request.
+// By default this parameter is set to 30.
+//
+// - TlsCaLocation: Path to the CA certificate(s) used to verify "https"
+// NameNodes. See core/components.NewTLSClientConfig for additional TLS
+// settings.
+// By default this parameter is set to "".
+//
+// Examples
+//
+// This example writes daily directories to a kerberized cluster:
+//
+//  DataLake:
+//    Type: producer.HDFS
+//    Streams: access_log
+//    NameNodes:
+//      - http://namenode1:9870
+//      - http://namenode2:9870
+//    Directory: "/data/*/2006-01-02"
+//    TimeBasedDirectory: true
+//    File: "access.log"
+//    Authentication: kerberos
+//    Kerberos:
+//      Principal: gollum
+//      KeytabFile: /etc/security/keytabs/gollum.keytab
+//    Rotation:
+//      Enable: true
+//      TimeoutMin: 60
+//      SizeMB: 256
+//
+type HDFS struct {
+	core.DirectProducer `gollumdoc:"embed_type"`
+
+	// Rotate is public to make RotateConfig.Configure() callable (bug in treflect package)
+	// BatchConfig is public to make BatchedWriterConfig.Configure() callable (bug in treflect package)
+	Rotate      components.RotateConfig        `gollumdoc:"embed_type"`
+	BatchConfig components.BatchedWriterConfig `gollumdoc:"embed_type"`
+
+	directory          string        `config:"Directory" default:"/gollum"`
+	timeBasedDirectory bool          `config:"TimeBasedDirectory" default:"false"`
+	fileNamePattern    string        `config:"File" default:"gollum_*.log"`
+	permission         string        `config:"Permission" default:"644"`
+	replication        int           `config:"Replication" default:"0"`
+	authentication     string        `config:"Authentication" default:"none"`
+	user               string        `config:"User" default:"gollum"`
+	delegationToken    string        `config:"DelegationToken"`
+	krbConfigFile      string        `config:"Kerberos/Config" default:"/etc/krb5.conf"`
+	krbPrincipal       string        `config:"Kerberos/Principal"`
+	krbRealm           string        `config:"Kerberos/Realm"`
+	krbKeytabFile      string        `config:"Kerberos/KeytabFile"`
+	krbCCacheFile      string        `config:"Kerberos/CCacheFile"`
+	krbPassword        string        `config:"Kerberos/Password"`
+	krbSPN             string        `config:"Kerberos/ServicePrincipal"`
+	krbDisablePAFXFAST bool          `config:"Kerberos/DisablePAFXFAST" default:"false"`
+	timeout            time.Duration `config:"TimeoutSec" default:"30" metric:"sec"`
+
+	nameNodes        []string
+	activeNameNode   int32
+	client           http.Client
+	krbClient        *krbclient.Client
+	filesByStream    map[core.MessageStreamID]*components.BatchedWriterAssembly
+	files            map[string]*components.BatchedWriterAssembly
+	batchedFileGuard *sync.RWMutex
+}
+
+// hdfsFile implements components.BatchedWriter by appending each write to
+// a file in HDFS. The file is created with the first write.
+type hdfsFile struct {
+	prod    *HDFS
+	path    string
+	size    int64
+	created bool
+}
+
+// hdfsError is returned for WebHDFS requests that failed with a
+// RemoteException.
+type hdfsError struct {
+	status    int
+	exception string
+	message   string
+}
+
+const (
+	hdfsAuthNone     = "none"
+	hdfsAuthSimple   = "simple"
+	hdfsAuthToken    = "token"
+	hdfsAuthKerberos = "kerberos"
+)
+
+func init() {
+	core.TypeRegistry.Register(HDFS{})
+}
+
+func (err hdfsError) Error() string {
+	if err.exception == "" {
+		return fmt.Sprintf("request failed with status %d: %s", err.status, err.message)
+	}
+	return fmt.Sprintf("%s: %s", err.exception, err.message)
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *HDFS) Configure(conf core.PluginConfigReader) {
+	prod.SetRollCallback(prod.rotateTargetFiles)
+	prod.SetStopCallback(prod.close)
+
+	prod.filesByStream = make(map[core.MessageStreamID]*components.BatchedWriterAssembly)
+	prod.files = make(map[string]*components.BatchedWriterAssembly)
+	prod.batchedFileGuard = new(sync.RWMutex)
+
+	prod.nameNodes = conf.GetStringArray("NameNodes", []string{"http://localhost:9870"})
+	if len(prod.nameNodes) == 0 {
+		conf.Errors.Pushf("At least one NameNode is required")
+	}
+
+	if _, err := strconv.ParseUint(prod.permission, 8, 16); err != nil {
+		conf.Errors.Pushf("Permission must be an octal number")
+	}
+
+	tlsConfig, err := components.NewTLSClientConfig(conf)
+	if conf.Errors.Push(err) {
+		return
+	}
+
+	// Redirects to DataNodes are followed manually so that the data is only
+	// sent once.
+	prod.client.Timeout = prod.timeout
+	prod.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	prod.client.Jar, _ = cookiejar.New(nil)
+	prod.client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	prod.authentication = strings.ToLower(prod.authentication)
+	switch prod.authentication {
+	case hdfsAuthNone, hdfsAuthSimple:
+	case hdfsAuthToken:
+		if prod.delegationToken == "" {
+			conf.Errors.Pushf("Token authentication requires a DelegationToken")
+		}
+	case hdfsAuthKerberos:
+		prod.configureKerberos(conf)
+	default:
+		conf.Errors.Pushf("Unknown authentication method: %s", prod.authentication)
+	}
+}
+
+func (prod *HDFS) configureKerberos(conf core.PluginConfigReader) {
+	krbConfig, err := krbconfig.Load(prod.krbConfigFile)
+	if conf.Errors.Push(err) {
+		return
+	}
+
+	if prod.krbRealm == "" {
+		prod.krbRealm = krbConfig.LibDefaults.DefaultRealm
+	}
+	settings := krbclient.DisablePAFXFAST(prod.krbDisablePAFXFAST)
+
+	switch {
+	case prod.krbKeytabFile != "":
+		kt, err := keytab.Load(prod.krbKeytabFile)
+		if conf.Errors.Push(err) {
+			return
+		}
+		prod.krbClient = krbclient.NewClientWithKeytab(prod.krbPrincipal, prod.krbRealm, kt, krbConfig, settings)
+
+	case prod.krbCCacheFile != "":
+		ccache, err := credentials.LoadCCache(prod.krbCCacheFile)
+		if conf.Errors.Push(err) {
+			return
+		}
+		prod.krbClient, err = krbclient.NewClientFromCCache(ccache, krbConfig, settings)
+		conf.Errors.Push(err)
+
+	case prod.krbPassword != "":
+		prod.krbClient = krbclient.NewClientWithPassword(prod.krbPrincipal, prod.krbRealm, prod.krbPassword, krbConfig, settings)
+
+	default:
+		conf.Errors.Pushf("Kerberos authentication requires Kerberos/KeytabFile, Kerberos/CCacheFile or Kerberos/Password")
+	}
+}
+
+// Produce writes messages to files in HDFS.
+func (prod *HDFS) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	prod.TickerMessageControlLoop(prod.writeMessage, prod.BatchConfig.BatchTimeout, prod.writeBatchOnTimeOut)
+}
+
+func (prod *HDFS) authenticate(req *http.Request) error {
+	if prod.krbClient == nil {
+		return nil
+	}
+	return spnego.SetSPNEGOHeader(prod.krbClient, req, prod.krbSPN)
+}
+
+func (prod *HDFS) readError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	remote := struct {
+		RemoteException struct {
+			Exception string `json:"exception"`
+			Message   string `json:"message"`
+		} `json:"RemoteException"`
+	}{}
+
+	if err := json.Unmarshal(body, &remote); err != nil || remote.RemoteException.Exception == "" {
+		return hdfsError{status: resp.StatusCode, message: strings.TrimSpace(string(body))}
+	}
+
+	return hdfsError{
+		status:    resp.StatusCode,
+		exception: remote.RemoteException.Exception,
+		message:   remote.RemoteException.Message,
+	}
+}
+
+// nameNodeRequest sends a body-less request to the active NameNode. If a
+// NameNode cannot be reached or is in standby, the next one is tried.
+// Responses with a status code >= 400 are converted to errors.
+func (prod *HDFS) nameNodeRequest(method, filePath string, query url.Values) (*http.Response, error) {
+	switch prod.authentication {
+	case hdfsAuthSimple:
+		query.Set("user.name", prod.user)
+	case hdfsAuthToken:
+		query.Set("delegation", prod.delegationToken)
+	}
+
+	var lastErr error
+	active := int(atomic.LoadInt32(&prod.activeNameNode))
+
+	for i := 0; i < len(prod.nameNodes); i++ {
+		idx := (active + i) % len(prod.nameNodes)
+
+		requestURL, err := url.Parse(prod.nameNodes[idx])
+		if err != nil {
+			return nil, err
+		}
+		requestURL.Path = strings.TrimRight(requestURL.Path, "/") + "/webhdfs/v1" + filePath
+		requestURL.RawQuery = query.Encode()
+
+		req, err := http.NewRequest(method, requestURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := prod.authenticate(req); err != nil {
+			return nil, err
+		}
+
+		resp, err := prod.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue // ### continue, try next NameNode ###
+		}
+
+		if resp.StatusCode >= 400 {
+			err := prod.readError(resp)
+			if remoteErr, isRemote := err.(hdfsError); isRemote && remoteErr.exception == "StandbyException" {
+				lastErr = err
+				continue // ### continue, try next NameNode ###
+			}
+			return nil, err
+		}
+
+		atomic.StoreInt32(&prod.activeNameNode, int32(idx))
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// upload sends data using the two step protocol of WebHDFS: the NameNode
+// redirects to the DataNode the data has to be sent to.
+func (prod *HDFS) upload(method, filePath string, query url.Values, data []byte) error {
+	resp, err := prod.nameNodeRequest(method, filePath, query)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return fmt.Errorf("%s %s did not redirect to a DataNode", query.Get("op"), filePath)
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest(method, location, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+
+		// HttpFS redirects to itself and may require authentication again
+		if attempt > 0 {
+			if err := prod.authenticate(req); err != nil {
+				return err
+			}
+		}
+
+		resp, err := prod.client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && prod.krbClient != nil && attempt == 0 {
+			resp.Body.Close()
+			continue // ### continue, retry with authentication ###
+		}
+
+		if resp.StatusCode >= 300 {
+			return prod.readError(resp)
+		}
+
+		resp.Body.Close()
+		return nil
+	}
+
+	return nil
+}
+
+// getFileSize returns the size of the given file or -1 if the file does not
+// exist.
+func (prod *HDFS) getFileSize(filePath string) (int64, error) {
+	resp, err := prod.nameNodeRequest("GET", filePath, url.Values{"op": {"GETFILESTATUS"}})
+	if err != nil {
+		if remoteErr, isRemote := err.(hdfsError); isRemote && remoteErr.status == http.StatusNotFound {
+			return -1, nil
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	status := struct {
+		FileStatus struct {
+			Length int64  `json:"length"`
+			Type   string `json:"type"`
+		} `json:"FileStatus"`
+	}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, err
+	}
+	if status.FileStatus.Type != "FILE" {
+		return 0, fmt.Errorf("%s is not a file", filePath)
+	}
+	return status.FileStatus.Length, nil
+}
+
+func (prod *HDFS) getBatchedFile(streamID core.MessageStreamID, forceRotate bool) (*components.BatchedWriterAssembly, error) {
+	prod.batchedFileGuard.RLock()
+	batchedFile, fileExists := prod.filesByStream[streamID]
+	prod.batchedFileGuard.RUnlock()
+	if fileExists {
+		if rotate, err := batchedFile.NeedsRotate(prod.Rotate, forceRotate); !rotate {
+			return batchedFile, err // ### return, already open or error ###
+		}
+	}
+
+	prod.batchedFileGuard.Lock()
+	defer prod.batchedFileGuard.Unlock()
+
+	// check again to avoid race conditions
+	if batchedFile, fileExists = prod.filesByStream[streamID]; fileExists {
+		if rotate, err := batchedFile.NeedsRotate(prod.Rotate, forceRotate); !rotate {
+			return batchedFile, err // ### return, already open or error ###
+		}
+	}
+
+	streamName := core.StreamRegistry.GetStreamName(streamID)
+	baseFileName := strings.Replace(prod.fileNamePattern, "*", streamName, -1)
+
+	batchedFile, fileExists = prod.files[baseFileName]
+	if !fileExists {
+		batchedFile = components.NewBatchedWriterAssembly(
+			prod.BatchConfig,
+			prod,
+			prod.TryFallback,
+			prod.Logger,
+		)
+		prod.files[baseFileName] = batchedFile
+	}
+	prod.filesByStream[streamID] = batchedFile
+
+	// Existing files are only continued when a file is opened for the first
+	// time. Rotation always starts a new file.
+	continueExisting := true
+	if batchedFile.HasWriter() {
+		oldWriter := batchedFile.GetWriterAndUnset()
+		prod.Logger.Info("Rotated ", oldWriter.Name())
+		oldWriter.Close()
+		continueExisting = false
+	}
+
+	writer, err := prod.newFile(streamName, baseFileName, continueExisting)
+	if err != nil {
+		return nil, err
+	}
+	batchedFile.SetWriter(writer)
+
+	return batchedFile, nil
+}
+
+func (prod *HDFS) newFile(streamName, baseFileName string, continueExisting bool) (*hdfsFile, error) {
+	now := time.Now()
+
+	directory := prod.directory
+	if prod.timeBasedDirectory {
+		directory = now.Format(directory)
+	}
+	directory = strings.Replace(directory, "*", streamName, -1)
+
+	fileExt := path.Ext(baseFileName)
+	fileName := baseFileName[:len(baseFileName)-len(fileExt)]
+	if prod.Rotate.Enabled {
+		fileName = fmt.Sprintf("%s_%s", fileName, now.Format(prod.Rotate.Timestamp))
+	}
+
+	counterFormat := "%s_%d%s"
+	if prod.Rotate.ZeroPad > 0 {
+		counterFormat = fmt.Sprintf("%%s_%%0%dd%%s", prod.Rotate.ZeroPad)
+	}
+
+	for counter := 0; ; counter++ {
+		filePath := path.Join("/", directory, fileName+fileExt)
+		if counter > 0 {
+			filePath = path.Join("/", directory, fmt.Sprintf(counterFormat, fileName, counter, fileExt))
+		}
+
+		size, err := prod.getFileSize(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case size < 0:
+			return &hdfsFile{prod: prod, path: filePath}, nil
+		case continueExisting && (!prod.Rotate.Enabled || size < prod.Rotate.SizeByte):
+			prod.Logger.Info("Appending to existing file ", filePath)
+			return &hdfsFile{prod: prod, path: filePath, size: size, created: true}, nil
+		}
+	}
+}
+
+func (prod *HDFS) writeMessage(msg *core.Message) {
+	batchedFile, err := prod.getBatchedFile(msg.GetStreamID(), false)
+	if err != nil {
+		prod.Logger.Error("Write error: ", err)
+		prod.TryFallback(msg)
+		return // ### return, fallback ###
+	}
+
+	batchedFile.AppendOrFlush(msg, prod.IsActiveOrStopping, prod.TryFallback)
+}
+
+func (prod *HDFS) writeBatchOnTimeOut() {
+	prod.batchedFileGuard.RLock()
+	defer prod.batchedFileGuard.RUnlock()
+
+	for _, batchedFile := range prod.files {
+		batchedFile.FlushOnTimeOut()
+	}
+}
+
+func (prod *HDFS) rotateTargetFiles() {
+	for streamID := range prod.filesByStream {
+		if _, err := prod.getBatchedFile(streamID, true); err != nil {
+			prod.Logger.Error("Rotate error: ", err)
+		}
+	}
+}
+
+func (prod *HDFS) close() {
+	defer prod.WorkerDone()
+
+	for _, batchedFile := range prod.files {
+		batchedFile.Close()
+	}
+
+	if prod.krbClient != nil {
+		prod.krbClient.Destroy()
+	}
+}
+
+// Write is part of the BatchedWriter interface
+func (file *hdfsFile) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	var err error
+	if file.created {
+		err = file.prod.upload("POST", file.path, url.Values{"op": {"APPEND"}}, data)
+	} else {
+		query := url.Values{
+			"op":         {"CREATE"},
+			"overwrite":  {"false"},
+			"permission": {file.prod.permission},
+		}
+		if file.prod.replication > 0 {
+			query.Set("replication", strconv.Itoa(file.prod.replication))
+		}
+		err = file.prod.upload("PUT", file.path, query, data)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	file.created = true
+	file.size += int64(len(data))
+	return len(data), nil
+}
+
+// Name is part of the BatchedWriter interface
+func (file *hdfsFile) Name() string {
+	return file.path
+}
+
+// Size is part of the BatchedWriter interface
+func (file *hdfsFile) Size() int64 {
+	return file.size
+}
+
+// IsAccessible is part of the BatchedWriter interface
+func (file *hdfsFile) IsAccessible() bool {
+	return true
+}
+
+// Close is part of the BatchedWriter interface. Data is written with every
+// call to Write, so there is nothing left to do.
+func (file *hdfsFile) Close() error {
+	return nil
+}
@@ -0,0 +1,396 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tcontainer"
+)
+
+// InfluxDB2 producer
+//
+// This producer writes data to InfluxDB 2.x or 3.x using the v2 write API.
+// Messages can either contain data in the InfluxDB line protocol or JSON
+// objects that are converted to line protocol using the Tags and Fields
+// settings.
+//
+// Parameters
+//
+// - URL: Defines the base URL of the InfluxDB server.
+// By default this parameter is set to "http://localhost:8086".
+//
+// - Org: Defines the organization to write to.
+// By default this parameter is set to "".
+//
+// - Bucket: Defines the bucket to write to. Every "*" will be replaced by the
+// name of the stream the message is sent on.
+// By default this parameter is set to "*".
+//
+// - Token: Defines the API token used for authentication.
+// By default this parameter is set to "".
+//
+// - Precision: Defines the precision of timestamps. Valid values are "ns",
+// "us", "ms" and "s".
+// By default this parameter is set to "ms".
+//
+// - Measurement: Defines the measurement used when converting JSON messages.
+// Every "*" will be replaced by the name of the stream the message is sent on.
+// By default this parameter is set to "*".
+//
+// - Tags: Defines a map of tag names to field paths inside the JSON encoded
+// payload. Field paths can be defined in the format accepted by
+// tgo.MarshalMap.Path.
+// By default this parameter is set to an empty map.
+//
+// - MetadataTags: Defines a map of tag names to metadata keys.
+// By default this parameter is set to an empty map.
+//
+// - Fields: Defines a map of field names to field paths inside the JSON
+// encoded payload. If this map is empty, messages are expected to be
+// formatted as line protocol and are written as is.
+// By default this parameter is set to an empty map.
+//
+// - TimeField: Defines a field path inside the JSON encoded payload holding
+// the timestamp of a point. The value can either be a RFC3339 formatted string
+// or a number given in Precision units. If empty or missing, the creation time
+// of the message is used.
+// By default this parameter is set to "".
+//
+// - Compress: Enables gzip compression of requests.
+// By default this parameter is set to true.
+//
+// - Retry/Count: Defines the number of retries before messages are sent to
+// the fallback stream.
+// By default this parameter is set to 3.
+//
+// - Retry/DelayMs: Defines the number of milliseconds to wait between retries
+// unless the server requests a specific delay.
+// By default this parameter is set to 1000.
+//
+// Examples
+//
+// This example converts JSON request logs to points of the measurement
+// "requests":
+//
+//  InfluxOut:
+//    Type: producer.InfluxDB2
+//    Streams: requests
+//    URL: "https://influx.example.com"
+//    Org: ops
+//    Bucket: web
+//    Token: "${INFLUX_TOKEN}"
+//    Measurement: requests
+//    Tags:
+//      host: "host"
+//      status: "response/status"
+//    Fields:
+//      duration: "duration_ms"
+//      bytes: "response/bytes"
+//    TimeField: "timestamp"
+type InfluxDB2 struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	url                  string        `config:"URL" default:"http://localhost:8086"`
+	org                  string        `config:"Org"`
+	bucket               string        `config:"Bucket" default:"*"`
+	token                string        `config:"Token"`
+	precision            string        `config:"Precision" default:"ms"`
+	measurement          string        `config:"Measurement" default:"*"`
+	timeField            string        `config:"TimeField"`
+	compress             bool          `config:"Compress" default:"true"`
+	retryCount           int           `config:"Retry/Count" default:"3"`
+	retryDelay           time.Duration `config:"Retry/DelayMs" default:"1000" metric:"ms"`
+	tags                 map[string]string
+	metadataTags         map[string]string
+	fields               map[string]string
+	precisionUnit        time.Duration
+	client               http.Client
+}
+
+type influxDB2Error struct {
+	status     int
+	retryAfter time.Duration
+	message    string
+}
+
+func init() {
+	core.TypeRegistry.Register(InfluxDB2{})
+}
+
+func (err influxDB2Error) Error() string {
+	return fmt.Sprintf("write failed with status %d: %s", err.status, err.message)
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *InfluxDB2) Configure(conf core.PluginConfigReader) {
+	prod.tags = conf.GetStringMap("Tags", map[string]string{})
+	prod.metadataTags = conf.GetStringMap("MetadataTags", map[string]string{})
+	prod.fields = conf.GetStringMap("Fields", map[string]string{})
+	prod.client.Timeout = 30 * time.Second
+	prod.url = strings.TrimRight(prod.url, "/")
+
+	switch prod.precision {
+	case "ns":
+		prod.precisionUnit = time.Nanosecond
+	case "us":
+		prod.precisionUnit = time.Microsecond
+	case "ms":
+		prod.precisionUnit = time.Millisecond
+	case "s":
+		prod.precisionUnit = time.Second
+	default:
+		conf.Errors.Pushf("Precision must be one of ns, us, ms or s")
+	}
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	influxStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+func (prod *InfluxDB2) formatFieldValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + influxStringEscaper.Replace(v) + `"`, true
+	case nil:
+		return "", false
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return `"` + influxStringEscaper.Replace(string(encoded)) + `"`, true
+	}
+}
+
+func (prod *InfluxDB2) getTimestamp(msg *core.Message, payload tcontainer.MarshalMap) int64 {
+	if prod.timeField != "" {
+		if value, found := payload.Value(prod.timeField); found {
+			switch v := value.(type) {
+			case float64:
+				return int64(v)
+			case string:
+				if parsed, err := time.Parse(time.RFC3339Nano, v); err == nil {
+					return parsed.UnixNano() / int64(prod.precisionUnit)
+				}
+			}
+		}
+	}
+	return msg.GetCreationTime().UnixNano() / int64(prod.precisionUnit)
+}
+
+// toLineProtocol converts a JSON message into a single line of the InfluxDB
+// line protocol.
+func (prod *InfluxDB2) toLineProtocol(msg *core.Message) ([]byte, error) {
+	payload := tcontainer.NewMarshalMap()
+	if err := json.Unmarshal(msg.GetPayload(), &payload); err != nil {
+		return nil, err
+	}
+
+	streamName := core.StreamRegistry.GetStreamName(msg.GetStreamID())
+	line := bytes.Buffer{}
+	line.WriteString(influxMeasurementEscaper.Replace(strings.Replace(prod.measurement, "*", streamName, -1)))
+
+	tags := make(map[string]string)
+	for tag, path := range prod.tags {
+		if value, found := payload.Value(path); found && value != nil {
+			tags[tag] = fmt.Sprint(value)
+		}
+	}
+	if metadata := msg.TryGetMetadata(); metadata != nil {
+		for tag, key := range prod.metadataTags {
+			if value, exists := metadata.TryGetValueString(key); exists {
+				tags[tag] = value
+			}
+		}
+	}
+
+	// Tags should be sorted for best write performance
+	tagNames := make([]string, 0, len(tags))
+	for tag, value := range tags {
+		if value != "" {
+			tagNames = append(tagNames, tag)
+		}
+	}
+	sort.Strings(tagNames)
+	for _, tag := range tagNames {
+		line.WriteByte(',')
+		line.WriteString(influxKeyEscaper.Replace(tag))
+		line.WriteByte('=')
+		line.WriteString(influxKeyEscaper.Replace(tags[tag]))
+	}
+
+	numFields := 0
+	for _, field := range sortedKeys(prod.fields) {
+		value, found := payload.Value(prod.fields[field])
+		if !found {
+			continue
+		}
+		if formatted, valid := prod.formatFieldValue(value); valid {
+			if numFields == 0 {
+				line.WriteByte(' ')
+			} else {
+				line.WriteByte(',')
+			}
+			line.WriteString(influxKeyEscaper.Replace(field))
+			line.WriteByte('=')
+			line.WriteString(formatted)
+			numFields++
+		}
+	}
+
+	if numFields == 0 {
+		return nil, fmt.Errorf("message does not contain any of the configured fields")
+	}
+
+	line.WriteByte(' ')
+	line.WriteString(strconv.FormatInt(prod.getTimestamp(msg, payload), 10))
+	line.WriteByte('\n')
+	return line.Bytes(), nil
+}
+
+func (prod *InfluxDB2) write(bucket string, data []byte) error {
+	body := data
+	if prod.compress {
+		buffer := bytes.Buffer{}
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(data)
+		writer.Close()
+		body = buffer.Bytes()
+	}
+
+	query := url.Values{}
+	query.Set("org", prod.org)
+	query.Set("bucket", bucket)
+	query.Set("precision", prod.precision)
+
+	req, err := http.NewRequest(http.MethodPost, prod.url+"/api/v2/write?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if prod.token != "" {
+		req.Header.Set("Authorization", "Token "+prod.token)
+	}
+	if prod.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := prod.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	writeErr := influxDB2Error{
+		status:  resp.StatusCode,
+		message: string(respBody),
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		writeErr.retryAfter = time.Duration(seconds) * time.Second
+	}
+	return writeErr
+}
+
+func (prod *InfluxDB2) writeWithRetry(bucket string, data []byte, messages []*core.Message) {
+	var err error
+	for retry := 0; retry <= prod.retryCount; retry++ {
+		if retry > 0 {
+			if writeErr, isWriteErr := err.(influxDB2Error); isWriteErr && writeErr.retryAfter > 0 {
+				time.Sleep(writeErr.retryAfter)
+			} else {
+				time.Sleep(prod.retryDelay)
+			}
+		}
+
+		if err = prod.write(bucket, data); err == nil {
+			return // ### return, success ###
+		}
+
+		// Client errors (e.g. malformed data) will not succeed on a retry
+		if writeErr, isWriteErr := err.(influxDB2Error); isWriteErr &&
+			writeErr.status >= 400 && writeErr.status < 500 && writeErr.status != http.StatusTooManyRequests {
+			break
+		}
+		prod.Logger.WithError(err).Warningf("Failed to write %d points to %s", len(messages), bucket)
+	}
+
+	prod.Logger.WithError(err).Errorf("Failed to write %d points to %s, sending to fallback", len(messages), bucket)
+	for _, msg := range messages {
+		prod.TryFallback(msg)
+	}
+}
+
+func (prod *InfluxDB2) sendBatch(messages []*core.Message) {
+	bucketData := make(map[string]*bytes.Buffer)
+	bucketMessages := make(map[string][]*core.Message)
+
+	for _, msg := range messages {
+		data := msg.GetPayload()
+		if len(prod.fields) > 0 {
+			var err error
+			if data, err = prod.toLineProtocol(msg); err != nil {
+				prod.Logger.WithError(err).Error("Failed to convert message to line protocol")
+				prod.TryFallback(msg)
+				continue
+			}
+		}
+
+		streamName := core.StreamRegistry.GetStreamName(msg.GetStreamID())
+		bucket := strings.Replace(prod.bucket, "*", streamName, -1)
+
+		buffer, exists := bucketData[bucket]
+		if !exists {
+			buffer = new(bytes.Buffer)
+			bucketData[bucket] = buffer
+		}
+		buffer.Write(data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			buffer.WriteByte('\n')
+		}
+		bucketMessages[bucket] = append(bucketMessages[bucket], msg)
+	}
+
+	for bucket, buffer := range bucketData {
+		prod.writeWithRetry(bucket, buffer.Bytes(), bucketMessages[bucket])
+	}
+}
+
+// Produce writes to InfluxDB.
+func (prod *InfluxDB2) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.sendBatch })
+}
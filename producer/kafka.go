@@ -21,11 +21,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	kafka "github.com/Shopify/sarama"
 	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
 	"github.com/trivago/tgo"
 )
 
@@ -33,6 +33,7 @@ const (
 	partRandom     = "random"
 	partRoundrobin = "roundrobin"
 	partHash       = "hash"
+	partMurmur2    = "murmur2"
 	compressNone   = "none"
 	compressGZIP   = "zip"
 	compressSnappy = "snappy"
@@ -66,16 +67,30 @@ const (
 // By default this parameter is set to "gollum".
 //
 // - Partitioner: Defines the distribution algorithm to use. Valid values are:
-// Random, Roundrobin and Hash.
+// Random, Roundrobin, Hash and Murmur2. "Murmur2" is a shortcut for "Hash" with
+// PartitionHasher set to "murmur2", which matches the default partitioner of
+// the Java client for messages with a key.
 // By default this parameter is set to "Roundrobin".
 //
 // - PartitionHasher: Defines the hash algorithm to use when Partitioner is set
-// to "Hash". Accepted values are "fnv1-a" and "murmur2".
+// to "Hash". Accepted values are "fnv-1a" and "murmur2". Messages without a
+// key are distributed randomly.
+// By default this parameter is set to "fnv-1a".
 //
 // - KeyFrom: Defines the metadata field that contains the string to be used as
 // the key passed to kafka. When set to an empty string no key is used.
 // By default this parameter is set to "".
 //
+// - TopicFrom: Defines the metadata field that contains the name of the topic
+// to write to. If the field is not set or empty, the topic is chosen based on
+// the Topics setting. When set to an empty string this feature is disabled.
+// By default this parameter is set to "".
+//
+// - HeadersFrom: Defines a list of metadata fields that are passed to kafka as
+// record headers. The header name equals the metadata key. Missing fields are
+// not sent. Headers require Version to be set to at least "0.11".
+// By default this parameter is set to an empty list.
+//
 // - Compression: Defines the compression algorithm to use.
 // Possible values are "none", "zip" and "snappy".
 // By default this parameter is set to "none".
@@ -152,7 +167,7 @@ const (
 // By default this parameter is set to false.
 //
 // - TlsKeyLocation: Path to the client's private key (PEM) used for TLS based
-// authentication.
+// authentication. Requires TlsCertificateLocation to be set, too.
 // By default this parameter is set to "".
 //
 // - TlsCertificateLocation: Path to the client's public key (PEM) used for TLS
@@ -160,7 +175,7 @@ const (
 // By default this parameter is set to "".
 //
 // - TlsCaLocation: Path to the CA certificate(s) used for verifying the
-// broker's key.
+// broker's key. If not set, the system's root certificates are used.
 // By default this parameter is set to "".
 //
 // - TlsServerName: Used to verify the hostname on the server's certificate
@@ -174,10 +189,37 @@ const (
 // - SaslEnable: Enables SASL based authentication.
 // By default this parameter is set to false.
 //
-// - SaslUsername: Sets the user name used for SASL/PLAIN authentication.
+// - SaslUsername: Sets the user name used for SASL/PLAIN and SASL/SCRAM
+// authentication.
+// By default this parameter is set to "".
+//
+// - SaslPassword: Sets the password used for SASL/PLAIN and SASL/SCRAM
+// authentication.
+// By default this parameter is set to "".
+//
+// - SaslMechanism: Defines the SASL mechanism to use. Valid values are
+// "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512" and "OAUTHBEARER". SCRAM and
+// OAUTHBEARER require Version to be set to at least "1.0".
+// By default this parameter is set to "PLAIN".
+//
+// - SaslOAuthTokenURL: Defines the URL of an OAuth2 token endpoint used to
+// fetch access tokens for OAUTHBEARER via the client credentials flow.
+// Tokens are refreshed before they expire.
+// By default this parameter is set to "".
+//
+// - SaslOAuthClientID: Defines the client ID sent to SaslOAuthTokenURL.
 // By default this parameter is set to "".
 //
-// - SaslPassword: Sets the password used for SASL/PLAIN authentication.
+// - SaslOAuthClientSecret: Defines the client secret sent to
+// SaslOAuthTokenURL.
+// By default this parameter is set to "".
+//
+// - SaslOAuthScopes: Defines the scopes requested from SaslOAuthTokenURL.
+// By default this parameter is set to an empty list.
+//
+// - SaslOAuthTokenFile: Defines a file containing the OAUTHBEARER access
+// token. The file is read on every new connection so it can be refreshed by
+// an external process. Ignored if SaslOAuthTokenURL is set.
 // By default this parameter is set to "".
 //
 // MessageBufferCount sets the internal channel size for the kafka client.
@@ -194,6 +236,21 @@ const (
 //      - "kafka02:9092"
 //      - "kafka03:9092"
 //      - "kafka04:9092"
+//
+// This config routes messages by the "topic" metadata field and partitions
+// them the same way the Java client would, using the "user" field as key.
+//
+//  kafkaRouter:
+//    Type: producer.Kafka
+//    Streams: events
+//    Version: "1.0"
+//    Servers:
+//      - "kafka01:9092"
+//    TopicFrom: topic
+//    KeyFrom: user
+//    HeadersFrom:
+//      - trace_id
+//    Partitioner: Murmur2
 type Kafka struct {
 	core.BufferedProducer `gollumdoc:"embed_type"`
 	topicGuard            *sync.RWMutex
@@ -206,14 +263,16 @@ type Kafka struct {
 	client                kafka.Client
 	config                *kafka.Config
 	producer              kafka.AsyncProducer
-	nilValueAllowed       bool   `config:"AllowNilValue" default:"false"`
-	keyField              string `config:"KeyFrom"`
+	nilValueAllowed       bool     `config:"AllowNilValue" default:"false"`
+	keyField              string   `config:"KeyFrom"`
+	topicField            string   `config:"TopicFrom"`
+	headerFields          []string `config:"HeadersFrom"`
 }
 
 type topicHandle struct {
 	name          string
-	rttSum        int64
-	delivered     int64
+	roundtrip     *core.Histogram
+	lastRoundtrip core.HistogramSnapshot
 	lastHeartBeat time.Time
 }
 
@@ -288,33 +347,32 @@ func (prod *Kafka) Configure(conf core.PluginConfigReader) {
 
 		keyFile := conf.GetString("TlsKeyLocation", "")
 		certFile := conf.GetString("TlsCertificateLocation", "")
-		if keyFile != "" && certFile != "" {
+		switch {
+		case keyFile != "" && certFile != "":
 			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 			if conf.Errors.Push(err) {
 				return
 			}
 			prod.config.Net.TLS.Config.Certificates = []tls.Certificate{cert}
-		} else if certFile == "" {
+		case keyFile != "":
 			conf.Errors.Pushf("Cannot specify TlsKeyLocation without TlsCertificateLocation")
 			return
-		} else if keyFile == "" {
+		case certFile != "":
 			conf.Errors.Pushf("Cannot specify TlsCertificateLocation without TlsKeyLocation")
 			return
 		}
 
-		caFile := conf.GetString("TlsCaLocation", "")
-		if caFile == "" {
-			conf.Errors.Pushf("TlsEnable is set to true, but no TlsCaLocation was specified")
-			return
-		}
-		caCert, err := ioutil.ReadFile(caFile)
-		if conf.Errors.Push(err) {
-			return
-		}
+		// Without a CA file the system's root certificates are used
+		if caFile := conf.GetString("TlsCaLocation", ""); caFile != "" {
+			caCert, err := ioutil.ReadFile(caFile)
+			if conf.Errors.Push(err) {
+				return
+			}
 
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		prod.config.Net.TLS.Config.RootCAs = caCertPool
+			caCertPool := x509.NewCertPool()
+			caCertPool.AppendCertsFromPEM(caCert)
+			prod.config.Net.TLS.Config.RootCAs = caCertPool
+		}
 
 		serverName := conf.GetString("TlsServerName", "")
 		if serverName != "" {
@@ -329,6 +387,7 @@ func (prod *Kafka) Configure(conf core.PluginConfigReader) {
 	if prod.config.Net.SASL.Enable {
 		prod.config.Net.SASL.User = conf.GetString("SaslUsername", "")
 		prod.config.Net.SASL.Password = conf.GetString("SaslPassword", "")
+		components.ConfigureKafkaSASLMechanism(conf, prod.config)
 	}
 
 	prod.config.Metadata.Retry.Max = int(conf.GetInt("ElectRetries", 3))
@@ -365,6 +424,8 @@ func (prod *Kafka) Configure(conf core.PluginConfigReader) {
 		prod.config.Producer.Partitioner = kafka.NewRandomPartitioner
 	case partRoundrobin:
 		prod.config.Producer.Partitioner = kafka.NewRoundRobinPartitioner
+	case partMurmur2:
+		prod.config.Producer.Partitioner = NewMurmur2HashPartitioner
 	default:
 		fallthrough
 	case partHash:
@@ -379,17 +440,24 @@ func (prod *Kafka) Configure(conf core.PluginConfigReader) {
 		}
 
 	}
+
+	if len(prod.headerFields) > 0 && !prod.config.Version.IsAtLeast(kafka.V0_11_0_0) {
+		conf.Errors.Pushf("HeadersFrom requires Version to be at least 0.11")
+	}
 }
 
-func (prod *Kafka) storeRTT(msg *core.Message) {
+func (prod *Kafka) storeRTT(msg *core.Message, topicName string) {
 	rtt := time.Since(msg.GetCreationTime())
 
 	prod.topicGuard.RLock()
-	topic := prod.topic[msg.GetStreamID()]
+	topic, exists := prod.topicHandles[topicName]
 	prod.topicGuard.RUnlock()
 
-	atomic.AddInt64(&topic.rttSum, rtt.Nanoseconds()/1000) // microseconds
-	atomic.AddInt64(&topic.delivered, 1)
+	if !exists {
+		return
+	}
+
+	topic.roundtrip.ObserveDuration(rtt)
 }
 
 func (prod *Kafka) pollResults() {
@@ -400,21 +468,21 @@ func (prod *Kafka) pollResults() {
 		select {
 		case result, hasMore := <-prod.producer.Successes():
 			if hasMore {
-				if msg, hasMsg := result.Metadata.(core.Message); hasMsg {
-					prod.storeRTT(&msg)
+				if msg, hasMsg := result.Metadata.(*core.Message); hasMsg {
+					prod.storeRTT(msg, result.Topic)
 				}
 			}
 
 		case err, hasMore := <-prod.producer.Errors():
 			if hasMore {
-				if msg, hasMsg := err.Msg.Metadata.(core.Message); hasMsg {
+				if msg, hasMsg := err.Msg.Metadata.(*core.Message); hasMsg {
 					prod.Logger.Warning("Kafka producer error on return: ", err)
-					prod.storeRTT(&msg)
-					if err == kafka.ErrMessageTooLarge {
+					prod.storeRTT(msg, err.Msg.Topic)
+					if err.Err == kafka.ErrMessageTooLarge {
 						prod.Logger.Error("Message discarded as too large.")
 						core.CountMessageDiscarded()
 					} else {
-						prod.TryFallback(&msg)
+						prod.TryFallback(msg)
 					}
 				}
 			}
@@ -428,17 +496,17 @@ func (prod *Kafka) pollResults() {
 	defer prod.topicGuard.RUnlock()
 
 	// Update metrics
-	for _, topic := range prod.topic {
-		rttSum := atomic.SwapInt64(&topic.rttSum, 0)
-		delivered := atomic.SwapInt64(&topic.delivered, 0)
-		topicName := topic.name
+	for _, topic := range prod.topicHandles {
+		roundtrip := topic.roundtrip.GetSnapshot()
+		delivered := roundtrip.Count - topic.lastRoundtrip.Count
 
 		avgRoundtripMs := int64(0)
 		if delivered > 0 {
-			avgRoundtripMs = rttSum / (delivered * 1000)
+			avgRoundtripMs = int64((roundtrip.Sum - topic.lastRoundtrip.Sum) * 1000 / float64(delivered))
 		}
 
-		tgo.Metric.Set(kafkaMetricRoundtrip+topicName, avgRoundtripMs)
+		topic.lastRoundtrip = roundtrip
+		tgo.Metric.Set(kafkaMetricRoundtrip+topic.name, avgRoundtripMs)
 	}
 }
 
@@ -446,20 +514,24 @@ func (prod *Kafka) registerNewTopic(topicName string, streamID core.MessageStrea
 	prod.topicGuard.Lock()
 	defer prod.topicGuard.Unlock()
 
-	if topic, exists := prod.topicHandles[topicName]; exists {
-		prod.topic[streamID] = topic
-		return topic
+	topic, exists := prod.topicHandles[topicName]
+	if !exists {
+		topic = &topicHandle{
+			name: topicName,
+			roundtrip: core.NewHistogram("kafka_roundtrip_seconds", core.MetricLabels{
+				"plugin_id": prod.GetID(),
+				"topic":     topicName,
+			}, nil),
+		}
+		prod.topicHandles[topicName] = topic
+		tgo.Metric.New(kafkaMetricRoundtrip + topicName)
 	}
 
-	topic := &topicHandle{
-		name: topicName,
+	// Topics taken from metadata are not bound to a stream
+	if streamID != core.InvalidStreamID {
+		prod.topic[streamID] = topic
 	}
 
-	prod.topicHandles[topicName] = topic
-	prod.topic[streamID] = topic
-
-	tgo.Metric.New(kafkaMetricRoundtrip + topicName)
-
 	return topic
 }
 
@@ -471,20 +543,7 @@ func (prod *Kafka) produceMessage(msg *core.Message) {
 		return // ### return, invalid data ###
 	}
 
-	prod.topicGuard.RLock()
-	topic, topicRegistered := prod.topic[msg.GetStreamID()]
-	prod.topicGuard.RUnlock()
-
-	if !topicRegistered {
-		var wildcardSet bool
-		topicName, isMapped := prod.streamToTopic[msg.GetStreamID()]
-		if !isMapped {
-			if topicName, wildcardSet = prod.streamToTopic[core.WildcardStreamID]; !wildcardSet {
-				topicName = core.StreamRegistry.GetStreamName(msg.GetStreamID())
-			}
-		}
-		topic = prod.registerNewTopic(topicName, msg.GetStreamID())
-	}
+	topic := prod.getTopic(msg)
 
 	if isConnected, err := prod.isConnected(topic.name); !isConnected {
 		prod.TryFallback(msg)
@@ -498,7 +557,8 @@ func (prod *Kafka) produceMessage(msg *core.Message) {
 	kafkaMsg := &kafka.ProducerMessage{
 		Topic:    topic.name,
 		Value:    kafka.ByteEncoder(msg.GetPayload()),
-		Metadata: &msg,
+		Headers:  prod.getKafkaMsgHeaders(msg),
+		Metadata: msg,
 	}
 
 	kafkaKey := prod.getKafkaMsgKey(msg)
@@ -519,6 +579,61 @@ func (prod *Kafka) produceMessage(msg *core.Message) {
 	}
 }
 
+func (prod *Kafka) getTopic(msg *core.Message) *topicHandle {
+	if len(prod.topicField) > 0 {
+		if metadata := msg.TryGetMetadata(); metadata != nil {
+			if topicName := metadata.GetValueString(prod.topicField); len(topicName) > 0 {
+				prod.topicGuard.RLock()
+				topic, topicRegistered := prod.topicHandles[topicName]
+				prod.topicGuard.RUnlock()
+
+				if !topicRegistered {
+					topic = prod.registerNewTopic(topicName, core.InvalidStreamID)
+				}
+				return topic
+			}
+		}
+	}
+
+	prod.topicGuard.RLock()
+	topic, topicRegistered := prod.topic[msg.GetStreamID()]
+	prod.topicGuard.RUnlock()
+
+	if !topicRegistered {
+		var wildcardSet bool
+		topicName, isMapped := prod.streamToTopic[msg.GetStreamID()]
+		if !isMapped {
+			if topicName, wildcardSet = prod.streamToTopic[core.WildcardStreamID]; !wildcardSet {
+				topicName = core.StreamRegistry.GetStreamName(msg.GetStreamID())
+			}
+		}
+		topic = prod.registerNewTopic(topicName, msg.GetStreamID())
+	}
+	return topic
+}
+
+func (prod *Kafka) getKafkaMsgHeaders(msg *core.Message) []kafka.RecordHeader {
+	if len(prod.headerFields) == 0 {
+		return nil
+	}
+
+	metadata := msg.TryGetMetadata()
+	if metadata == nil {
+		return nil
+	}
+
+	headers := make([]kafka.RecordHeader, 0, len(prod.headerFields))
+	for _, key := range prod.headerFields {
+		if value, exists := metadata.TryGetValue(key); exists {
+			headers = append(headers, kafka.RecordHeader{
+				Key:   []byte(key),
+				Value: value,
+			})
+		}
+	}
+	return headers
+}
+
 func (prod *Kafka) getKafkaMsgKey(msg *core.Message) []byte {
 	if len(prod.keyField) > 0 {
 		if metadata := msg.TryGetMetadata(); metadata != nil {
@@ -0,0 +1,424 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http"
+	otlpLogsMethod   = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+)
+
+var otlpSeverities = map[string]int{
+	"trace":    1,
+	"debug":    5,
+	"info":     9,
+	"notice":   10,
+	"warn":     13,
+	"warning":  13,
+	"error":    17,
+	"err":      17,
+	"crit":     21,
+	"critical": 21,
+	"fatal":    21,
+	"alert":    22,
+	"emerg":    23,
+}
+
+// OTLP producer
+//
+// This producer exports messages as OpenTelemetry log records using the OTLP
+// protocol, so that any OpenTelemetry collector can receive them. The payload
+// is used as the log body and all metadata fields are sent as attributes.
+// The name of the stream a message was sent on is added as the attribute
+// "gollum.stream".
+//
+// Parameters
+//
+// - Protocol: Defines the OTLP transport to use. Valid values are "grpc" and
+// "http" (protobuf encoded).
+// By default this parameter is set to "grpc".
+//
+// - Endpoint: Defines the collector endpoint. For "grpc" this is a host and
+// port, for "http" this is the full URL of the logs endpoint. If empty,
+// "localhost:4317" or "http://localhost:4318/v1/logs" is used, respectively.
+// By default this parameter is set to "".
+//
+// - Compression: Defines the compression to use. Valid values are "none" and
+// "gzip".
+// By default this parameter is set to "gzip".
+//
+// - Headers: Defines a map of additional headers sent with each request, e.g.
+// for authentication.
+// By default this parameter is set to an empty map.
+//
+// - ServiceName: Defines the value of the "service.name" resource attribute.
+// By default this parameter is set to "gollum".
+//
+// - ResourceAttributes: Defines a map of additional resource attributes.
+// By default this parameter is set to an empty map.
+//
+// - SeverityFrom: Defines a metadata field containing the severity of a
+// message. Common names like "debug", "info" or "error" are converted to the
+// matching OTLP severity number, numbers are used as is.
+// By default this parameter is set to "".
+//
+// - TraceIDFrom: Defines a metadata field containing a hex encoded trace ID.
+// By default this parameter is set to "".
+//
+// - SpanIDFrom: Defines a metadata field containing a hex encoded span ID.
+// By default this parameter is set to "".
+//
+// - TimeoutSec: Defines the timeout for a single export request in seconds.
+// By default this parameter is set to 10.
+//
+// - Retry/Count: Defines the number of retries before messages are sent to
+// the fallback stream.
+// By default this parameter is set to 3.
+//
+// - Retry/DelayMs: Defines the number of milliseconds to wait before the first
+// retry. The delay is doubled with every retry unless the server requests a
+// specific delay.
+// By default this parameter is set to 500.
+//
+// - TlsEnable: Enables TLS for the "grpc" protocol. For "http", TLS is used if
+// the endpoint starts with "https". See core/components.NewTLSClientConfig for
+// additional TLS settings.
+// By default this parameter is set to false.
+//
+// Examples
+//
+//  OtelOut:
+//    Type: producer.OTLP
+//    Streams: "*"
+//    Protocol: http
+//    Endpoint: "https://otel-collector:4318/v1/logs"
+//    ServiceName: frontend
+//    SeverityFrom: level
+//    ResourceAttributes:
+//      deployment.environment: production
+type OTLP struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	protocol             string        `config:"Protocol" default:"grpc"`
+	endpoint             string        `config:"Endpoint"`
+	compression          string        `config:"Compression" default:"gzip"`
+	serviceName          string        `config:"ServiceName" default:"gollum"`
+	severityFrom         string        `config:"SeverityFrom"`
+	traceIDFrom          string        `config:"TraceIDFrom"`
+	spanIDFrom           string        `config:"SpanIDFrom"`
+	timeout              time.Duration `config:"TimeoutSec" default:"10" metric:"sec"`
+	retryCount           int           `config:"Retry/Count" default:"3"`
+	retryDelay           time.Duration `config:"Retry/DelayMs" default:"500" metric:"ms"`
+	tlsEnable            bool          `config:"TlsEnable" default:"false"`
+	headers              map[string]string
+	resource             []byte
+	grpc                 *grpcClient
+	client               http.Client
+}
+
+type otlpHTTPError struct {
+	status     int
+	retryAfter time.Duration
+	message    string
+}
+
+func init() {
+	core.TypeRegistry.Register(OTLP{})
+}
+
+func (err otlpHTTPError) Error() string {
+	return fmt.Sprintf("export failed with status %d: %s", err.status, err.message)
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *OTLP) Configure(conf core.PluginConfigReader) {
+	prod.headers = conf.GetStringMap("Headers", map[string]string{})
+	resourceAttributes := conf.GetStringMap("ResourceAttributes", map[string]string{})
+	resourceAttributes["service.name"] = prod.serviceName
+
+	resource := proto.NewBuffer(nil)
+	for _, key := range sortedKeys(resourceAttributes) {
+		resource.EncodeVarint(1<<3 | proto.WireBytes)
+		resource.EncodeRawBytes(otlpKeyValue(key, []byte(resourceAttributes[key])))
+	}
+	prod.resource = resource.Bytes()
+
+	prod.compression = strings.ToLower(prod.compression)
+	if prod.compression != "none" && prod.compression != "gzip" {
+		conf.Errors.Pushf("Compression must be either none or gzip")
+	}
+
+	var tlsConfig *tls.Config
+	if prod.tlsEnable {
+		var err error
+		tlsConfig, err = components.NewTLSClientConfig(conf)
+		if conf.Errors.Push(err) {
+			return
+		}
+	}
+
+	switch strings.ToLower(prod.protocol) {
+	case otlpProtocolGRPC:
+		if prod.endpoint == "" {
+			prod.endpoint = "localhost:4317"
+		}
+		prod.grpc = newGRPCClient(prod.endpoint, tlsConfig, prod.timeout, prod.compression == "gzip")
+		for key, value := range prod.headers {
+			prod.grpc.headers.Set(key, value)
+		}
+
+	case otlpProtocolHTTP:
+		if prod.endpoint == "" {
+			prod.endpoint = "http://localhost:4318/v1/logs"
+		}
+		prod.client.Timeout = prod.timeout
+		if tlsConfig != nil {
+			prod.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		}
+
+	default:
+		conf.Errors.Pushf("Protocol must be either grpc or http")
+	}
+}
+
+// otlpAnyValue encodes a value as AnyValue. Valid UTF-8 is sent as string,
+// everything else as bytes.
+func otlpAnyValue(value []byte) []byte {
+	anyValue := proto.NewBuffer(nil)
+	if utf8.Valid(value) {
+		anyValue.EncodeVarint(1<<3 | proto.WireBytes)
+	} else {
+		anyValue.EncodeVarint(7<<3 | proto.WireBytes)
+	}
+	anyValue.EncodeRawBytes(value)
+	return anyValue.Bytes()
+}
+
+// otlpKeyValue encodes a KeyValue message.
+func otlpKeyValue(key string, value []byte) []byte {
+	keyValue := proto.NewBuffer(nil)
+	keyValue.EncodeVarint(1<<3 | proto.WireBytes)
+	keyValue.EncodeStringBytes(key)
+	keyValue.EncodeVarint(2<<3 | proto.WireBytes)
+	keyValue.EncodeRawBytes(otlpAnyValue(value))
+	return keyValue.Bytes()
+}
+
+func (prod *OTLP) getSeverity(metadata core.Metadata) (int, string) {
+	text, exists := metadata.TryGetValueString(prod.severityFrom)
+	if !exists {
+		return 0, ""
+	}
+	if number, err := strconv.Atoi(text); err == nil && number >= 0 && number <= 24 {
+		return number, text
+	}
+	return otlpSeverities[strings.ToLower(text)], text
+}
+
+// encodeLogRecord converts a message to a LogRecord.
+func (prod *OTLP) encodeLogRecord(msg *core.Message) []byte {
+	record := proto.NewBuffer(nil)
+	timestamp := uint64(msg.GetCreationTime().UnixNano())
+
+	record.EncodeVarint(1<<3 | proto.WireFixed64)
+	record.EncodeFixed64(timestamp)
+	record.EncodeVarint(11<<3 | proto.WireFixed64)
+	record.EncodeFixed64(uint64(time.Now().UnixNano()))
+
+	record.EncodeVarint(5<<3 | proto.WireBytes)
+	record.EncodeRawBytes(otlpAnyValue(msg.GetPayload()))
+
+	streamName := core.StreamRegistry.GetStreamName(msg.GetStreamID())
+	record.EncodeVarint(6<<3 | proto.WireBytes)
+	record.EncodeRawBytes(otlpKeyValue("gollum.stream", []byte(streamName)))
+
+	metadata := msg.TryGetMetadata()
+	if metadata == nil {
+		return record.Bytes()
+	}
+
+	for key, value := range metadata {
+		record.EncodeVarint(6<<3 | proto.WireBytes)
+		record.EncodeRawBytes(otlpKeyValue(key, value))
+	}
+
+	if prod.severityFrom != "" {
+		if number, text := prod.getSeverity(metadata); text != "" {
+			record.EncodeVarint(2<<3 | proto.WireVarint)
+			record.EncodeVarint(uint64(number))
+			record.EncodeVarint(3<<3 | proto.WireBytes)
+			record.EncodeStringBytes(text)
+		}
+	}
+
+	if prod.traceIDFrom != "" {
+		if traceID, err := hex.DecodeString(metadata.GetValueString(prod.traceIDFrom)); err == nil && len(traceID) == 16 {
+			record.EncodeVarint(9<<3 | proto.WireBytes)
+			record.EncodeRawBytes(traceID)
+		}
+	}
+
+	if prod.spanIDFrom != "" {
+		if spanID, err := hex.DecodeString(metadata.GetValueString(prod.spanIDFrom)); err == nil && len(spanID) == 8 {
+			record.EncodeVarint(10<<3 | proto.WireBytes)
+			record.EncodeRawBytes(spanID)
+		}
+	}
+
+	return record.Bytes()
+}
+
+// encodeRequest converts a list of messages to an ExportLogsServiceRequest.
+func (prod *OTLP) encodeRequest(messages []*core.Message) []byte {
+	scope := proto.NewBuffer(nil)
+	scope.EncodeVarint(1<<3 | proto.WireBytes)
+	scope.EncodeStringBytes("gollum")
+
+	scopeLogs := proto.NewBuffer(nil)
+	scopeLogs.EncodeVarint(1<<3 | proto.WireBytes)
+	scopeLogs.EncodeRawBytes(scope.Bytes())
+	for _, msg := range messages {
+		scopeLogs.EncodeVarint(2<<3 | proto.WireBytes)
+		scopeLogs.EncodeRawBytes(prod.encodeLogRecord(msg))
+	}
+
+	resourceLogs := proto.NewBuffer(nil)
+	resourceLogs.EncodeVarint(1<<3 | proto.WireBytes)
+	resourceLogs.EncodeRawBytes(prod.resource)
+	resourceLogs.EncodeVarint(2<<3 | proto.WireBytes)
+	resourceLogs.EncodeRawBytes(scopeLogs.Bytes())
+
+	request := proto.NewBuffer(nil)
+	request.EncodeVarint(1<<3 | proto.WireBytes)
+	request.EncodeRawBytes(resourceLogs.Bytes())
+	return request.Bytes()
+}
+
+func (prod *OTLP) exportHTTP(request []byte) error {
+	body := request
+	if prod.compression == "gzip" {
+		buffer := bytes.Buffer{}
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(request)
+		writer.Close()
+		body = buffer.Bytes()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, prod.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, value := range prod.headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if prod.compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := prod.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	httpErr := otlpHTTPError{
+		status:  resp.StatusCode,
+		message: string(respBody),
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		httpErr.retryAfter = time.Duration(seconds) * time.Second
+	}
+	return httpErr
+}
+
+func (prod *OTLP) isRetryable(err error) bool {
+	switch exportErr := err.(type) {
+	case otlpHTTPError:
+		switch exportErr.status {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		default:
+			return false
+		}
+	case grpcStatusError:
+		return isRetryableGRPCError(err)
+	default:
+		return true // transport errors
+	}
+}
+
+func (prod *OTLP) export(messages []*core.Message) {
+	request := prod.encodeRequest(messages)
+	delay := prod.retryDelay
+
+	var err error
+	for retry := 0; retry <= prod.retryCount; retry++ {
+		if retry > 0 {
+			if httpErr, isHTTPErr := err.(otlpHTTPError); isHTTPErr && httpErr.retryAfter > 0 {
+				time.Sleep(httpErr.retryAfter)
+			} else {
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+
+		if prod.grpc != nil {
+			err = prod.grpc.call(otlpLogsMethod, [][]byte{request})
+		} else {
+			err = prod.exportHTTP(request)
+		}
+
+		if err == nil || !prod.isRetryable(err) {
+			break
+		}
+		prod.Logger.WithError(err).Warningf("Failed to export %d log records", len(messages))
+	}
+
+	if err != nil {
+		prod.Logger.WithError(err).Errorf("Failed to export %d log records, sending to fallback", len(messages))
+		for _, msg := range messages {
+			prod.TryFallback(msg)
+		}
+	}
+}
+
+// Produce exports messages to an OpenTelemetry collector.
+func (prod *OTLP) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.export })
+}
@@ -27,32 +27,71 @@ import (
 // Redis producer
 //
 // This producer sends messages to a redis server. Different redis storage types
-// and database indexes are supported. This producer does not implement support
-// for redis 3.0 cluster.
+// and database indexes are supported. Redis 3.0 cluster and sentinel setups
+// are supported by setting Addresses or SentinelMaster.
 //
 // Parameters
 //
 // - Address: Stores the identifier to connect to.
 // This can either be any ip address and port like "localhost:6379" or a file
-// like "unix:///var/redis.socket". By default this is set to ":6379".
+// like "unix:///var/redis.socket". This value is ignored if Addresses is set.
+// By default this is set to ":6379".
+//
+// - Addresses: Defines a list of "host:port" seed addresses. If more than one
+// address is given a redis cluster client is used. If SentinelMaster is set
+// these addresses are treated as sentinel addresses.
+// By default this parameter is set to an empty list.
+//
+// - SentinelMaster: Defines the name of the sentinel master set. If set, a
+// sentinel backed failover client is used.
+// By default this parameter is set to "".
 //
 // - Database: Defines the redis database to connect to.
+// This value is ignored when using a redis cluster.
 //
-// - Key: Defines the redis key to store the values in.
-// This field is ignored when "KeyFormatter" is set.
+// - Key: Defines the redis key to store the values in. Every "*" will be
+// replaced by the name of the stream the message is sent on. This field is
+// ignored when KeyFrom is set and the metadata field exists.
 // By default this is set to "default".
 //
 // - Storage: Defines the type of the storage to use. Valid values are: "hash",
-// "list", "set", "sortedset", "string". By default this is set to "hash".
+// "list", "set", "sortedset", "string", "stream" and "publish". When set to
+// "stream" messages are added to a redis stream via XADD. When set to
+// "publish" messages are sent to the channel named by the key via PUBLISH.
+// When set to "sortedset" the field is used as score. Messages without a
+// numeric score are sent to the fallback.
+// By default this is set to "hash".
 //
 // - KeyFrom: Defines the name of the metadata field used as a key for messages
-// sent to redis. If the name is an empty string no key is sent. By default
-// this value is set to an empty string.
+// sent to redis. If the name is an empty string or the metadata field is not
+// set, Key is used. By default this value is set to an empty string.
 //
 // - FieldFrom: Defines the name of the metadata field used as a field for messages
 // sent to redis. If the name is an empty string no key is sent. By default
 // this value is set to an empty string.
 //
+// - Stream/Field: Defines the name of the stream entry field the message
+// payload is stored in when using the "stream" storage.
+// By default this parameter is set to "data".
+//
+// - Stream/MaxLen: Defines the maximum number of entries kept in a redis
+// stream. Setting this value to 0 disables trimming.
+// By default this parameter is set to 0.
+//
+// - Stream/ExactTrim: When set to false, "MAXLEN ~" is used for trimming
+// which is a lot more efficient but may keep slightly more entries than
+// Stream/MaxLen. Set to true to trim to the exact length.
+// By default this parameter is set to false.
+//
+// - Pipeline/Size: Defines the number of commands to collect before sending
+// them to redis in one roundtrip. Set to 0 to disable pipelining.
+// By default this parameter is set to 0.
+//
+// - Pipeline/TimeoutMs: Defines the maximum number of milliseconds commands
+// may stay in the pipeline before being sent. Only used if Pipeline/Size
+// is greater than 0.
+// By default this parameter is set to 100.
+//
 // Examples
 //
 // .
@@ -63,16 +102,51 @@ import (
 //     Key: "mykey"
 //     Storage: "hash"
 //
+// This example adds messages to a capped redis stream per gollum stream,
+// sending up to 100 commands per roundtrip to a redis cluster.
+//
+//   RedisStreamProducer:
+//     Type: producer.Redis
+//     Streams: "*"
+//     Addresses:
+//       - "redis01:6379"
+//       - "redis02:6379"
+//     Key: "gollum:*"
+//     Storage: "stream"
+//     Stream:
+//       MaxLen: 100000
+//     Pipeline:
+//       Size: 100
+//
 type Redis struct {
 	core.BufferedProducer `gollumdoc:"embed_type"`
 	address               string
 	protocol              string
-	password              string `config:"Password"`
-	database              int    `config:"Database" default:"0"`
-	key                   string `config:"KeyFrom"`
-	field                 string `config:"FieldFrom"`
-	client                *redis.Client
-	store                 func(msg *core.Message)
+	addresses             []string      `config:"Addresses"`
+	masterName            string        `config:"SentinelMaster"`
+	password              string        `config:"Password"`
+	database              int           `config:"Database" default:"0"`
+	keyTemplate           string        `config:"Key" default:"default"`
+	key                   string        `config:"KeyFrom"`
+	field                 string        `config:"FieldFrom"`
+	streamField           string        `config:"Stream/Field" default:"data"`
+	streamMaxLen          int64         `config:"Stream/MaxLen" default:"0"`
+	streamExactTrim       bool          `config:"Stream/ExactTrim" default:"false"`
+	pipelineSize          int           `config:"Pipeline/Size" default:"0"`
+	pipelineTimeout       time.Duration `config:"Pipeline/TimeoutMs" default:"100" metric:"ms"`
+	client                redis.UniversalClient
+	pipeline              redis.Pipeliner
+	pipelined             []*core.Message
+	pipelineStart         time.Time
+	pipelineGuard         *sync.Mutex
+	store                 func(target redisTarget, msg *core.Message) redis.Cmder
+}
+
+// redisTarget is implemented by redis clients and pipelines alike so that
+// commands can either be sent directly or be queued.
+type redisTarget interface {
+	redis.Cmdable
+	Process(cmd redis.Cmder) error
 }
 
 func init() {
@@ -84,6 +158,7 @@ func (prod *Redis) Configure(conf core.PluginConfigReader) {
 	prod.SetStopCallback(prod.close)
 
 	prod.protocol, prod.address = tnet.ParseAddress(conf.GetString("Address", ":6379"), "tcp")
+	prod.pipelineGuard = new(sync.Mutex)
 
 	switch strings.ToLower(conf.GetString("Storage", "hash")) {
 	case "hash":
@@ -94,6 +169,10 @@ func (prod *Redis) Configure(conf core.PluginConfigReader) {
 		prod.store = prod.storeSet
 	case "sortedset":
 		prod.store = prod.storeSortedSet
+	case "stream":
+		prod.store = prod.storeStream
+	case "publish":
+		prod.store = prod.storePublish
 	default:
 		fallthrough
 	case "string":
@@ -101,98 +180,199 @@ func (prod *Redis) Configure(conf core.PluginConfigReader) {
 	}
 }
 
-func (prod *Redis) getValueAndKey(msg *core.Message) (v, k []byte) {
-	meta := msg.GetMetadata()
-	key := meta.GetValue(prod.key)
+func (prod *Redis) getKey(msg *core.Message) []byte {
+	if prod.key != "" {
+		if key, exists := msg.GetMetadata().TryGetValue(prod.key); exists {
+			return key
+		}
+	}
+
+	streamName := core.StreamRegistry.GetStreamName(msg.GetStreamID())
+	return []byte(strings.Replace(prod.keyTemplate, "*", streamName, -1))
+}
 
-	return msg.GetPayload(), key
+func (prod *Redis) getValueAndKey(msg *core.Message) (v, k []byte) {
+	return msg.GetPayload(), prod.getKey(msg)
 }
 
 func (prod *Redis) getValueFieldAndKey(msg *core.Message) (v, f, k []byte) {
 	meta := msg.GetMetadata()
-	key := meta.GetValue(prod.key)
 	field := meta.GetValue(prod.field)
 
-	return msg.GetPayload(), field, key
+	return msg.GetPayload(), field, prod.getKey(msg)
 }
 
-func (prod *Redis) storeHash(msg *core.Message) {
+func (prod *Redis) storeHash(target redisTarget, msg *core.Message) redis.Cmder {
 	value, field, key := prod.getValueFieldAndKey(msg)
-	result := prod.client.HSet(string(key), string(field), string(value))
-	if result.Err() != nil {
-		prod.Logger.Error("Redis: ", result.Err())
-		prod.TryFallback(msg)
-	}
+	return target.HSet(string(key), string(field), string(value))
 }
 
-func (prod *Redis) storeList(msg *core.Message) {
+func (prod *Redis) storeList(target redisTarget, msg *core.Message) redis.Cmder {
 	value, key := prod.getValueAndKey(msg)
-
-	result := prod.client.RPush(string(key), string(value))
-	if result.Err() != nil {
-		prod.Logger.Error("Redis: ", result.Err())
-		prod.TryFallback(msg)
-	}
+	return target.RPush(string(key), string(value))
 }
 
-func (prod *Redis) storeSet(msg *core.Message) {
+func (prod *Redis) storeSet(target redisTarget, msg *core.Message) redis.Cmder {
 	value, key := prod.getValueAndKey(msg)
-
-	result := prod.client.SAdd(string(key), string(value))
-	if result.Err() != nil {
-		prod.Logger.Error("Redis: ", result.Err())
-		prod.TryFallback(msg)
-	}
+	return target.SAdd(string(key), string(value))
 }
 
-func (prod *Redis) storeSortedSet(msg *core.Message) {
+func (prod *Redis) storeSortedSet(target redisTarget, msg *core.Message) redis.Cmder {
 	value, scoreValue, key := prod.getValueFieldAndKey(msg)
 	score, err := strconv.ParseFloat(string(scoreValue), 64)
 	if err != nil {
-		prod.Logger.Error("Redis: ", err)
-		return // ### return, no valid score ###
+		// Messages without a command would be acknowledged otherwise
+		prod.Logger.Error("Redis: invalid score: ", err)
+		prod.TryFallback(msg)
+		return nil // ### return, no valid score ###
 	}
 
-	result := prod.client.ZAdd(string(key),
+	return target.ZAdd(string(key),
 		redis.Z{
 			Score:  score,
 			Member: string(value),
 		})
+}
 
-	if result.Err() != nil {
-		prod.Logger.Error("Redis: ", result.Err())
-		prod.TryFallback(msg)
+func (prod *Redis) storeString(target redisTarget, msg *core.Message) redis.Cmder {
+	value, key := prod.getValueAndKey(msg)
+	return target.Set(string(key), string(value), time.Duration(0))
+}
+
+func (prod *Redis) storeStream(target redisTarget, msg *core.Message) redis.Cmder {
+	value, key := prod.getValueAndKey(msg)
+
+	args := make([]interface{}, 0, 7)
+	args = append(args, "XADD", string(key))
+	if prod.streamMaxLen > 0 {
+		if prod.streamExactTrim {
+			args = append(args, "MAXLEN", prod.streamMaxLen)
+		} else {
+			args = append(args, "MAXLEN", "~", prod.streamMaxLen)
+		}
 	}
+	args = append(args, "*", prod.streamField, string(value))
+
+	cmd := redis.NewStringCmd(args...)
+	target.Process(cmd)
+	return cmd
 }
 
-func (prod *Redis) storeString(msg *core.Message) {
+func (prod *Redis) storePublish(target redisTarget, msg *core.Message) redis.Cmder {
 	value, key := prod.getValueAndKey(msg)
+	return target.Publish(string(key), string(value))
+}
 
-	result := prod.client.Set(string(key), string(value), time.Duration(0))
-	if result.Err() != nil {
-		prod.Logger.Error("Redis: ", result.Err())
-		prod.TryFallback(msg)
+func (prod *Redis) storeMessage(msg *core.Message) {
+	if prod.pipelineSize <= 0 {
+		if cmd := prod.store(prod.client, msg); cmd != nil && cmd.Err() != nil {
+			prod.Logger.Error("Redis: ", cmd.Err())
+			prod.TryFallback(msg)
+		}
+		return // ### return, not pipelined ###
+	}
+
+	prod.pipelineGuard.Lock()
+	defer prod.pipelineGuard.Unlock()
+
+	if len(prod.pipelined) == 0 {
+		prod.pipelineStart = time.Now()
+	}
+
+	// Messages are acknowledged once their command has been sent
+	if cmd := prod.store(prod.pipeline, msg); cmd != nil {
+		msg.DeferAcknowledge()
+		prod.pipelined = append(prod.pipelined, msg)
+	}
+
+	if len(prod.pipelined) >= prod.pipelineSize {
+		prod.execPipeline()
 	}
 }
 
+func (prod *Redis) execPipelineOnTimeOut() {
+	prod.pipelineGuard.Lock()
+	defer prod.pipelineGuard.Unlock()
+
+	if len(prod.pipelined) > 0 && time.Since(prod.pipelineStart) >= prod.pipelineTimeout {
+		prod.execPipeline()
+	}
+}
+
+// execPipeline sends all queued commands. The pipelineGuard has to be locked
+// when calling this function.
+func (prod *Redis) execPipeline() {
+	if len(prod.pipelined) == 0 {
+		return // ### return, nothing to do ###
+	}
+
+	cmds, err := prod.pipeline.Exec()
+	if err != nil {
+		prod.Logger.Error("Redis: ", err)
+	}
+
+	// Commands are returned in the order they have been queued, so every
+	// command can be mapped to the message it was created from. Messages
+	// without a command have not been sent.
+	for idx, msg := range prod.pipelined {
+		switch {
+		case idx >= len(cmds):
+			msg.Reject()
+		case cmds[idx].Err() != nil:
+			prod.TryFallback(msg)
+		default:
+			msg.Acknowledge()
+		}
+	}
+	prod.pipelined = prod.pipelined[:0]
+}
+
 func (prod *Redis) close() {
 	defer prod.WorkerDone()
 	prod.DefaultClose()
+
+	if prod.pipeline != nil {
+		prod.pipelineGuard.Lock()
+		prod.execPipeline()
+		prod.pipelineGuard.Unlock()
+		prod.pipeline.Close()
+	}
+	prod.client.Close()
 }
 
-// Produce writes to stdout or stderr.
-func (prod *Redis) Produce(workers *sync.WaitGroup) {
-	prod.client = redis.NewClient(&redis.Options{
-		Addr:     prod.address,
-		Network:  prod.protocol,
-		Password: prod.password,
-		DB:       prod.database,
+func (prod *Redis) newClient() redis.UniversalClient {
+	if len(prod.addresses) == 0 && prod.masterName == "" {
+		return redis.NewClient(&redis.Options{
+			Addr:     prod.address,
+			Network:  prod.protocol,
+			Password: prod.password,
+			DB:       prod.database,
+		})
+	}
+
+	return redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      prod.addresses,
+		MasterName: prod.masterName,
+		Password:   prod.password,
+		DB:         prod.database,
 	})
+}
+
+// Produce writes to redis.
+func (prod *Redis) Produce(workers *sync.WaitGroup) {
+	prod.client = prod.newClient()
 
 	if _, err := prod.client.Ping().Result(); err != nil {
 		prod.Logger.Error("Redis: ", err)
 	}
 
 	prod.AddMainWorker(workers)
-	prod.MessageControlLoop(prod.store)
+	if prod.pipelineSize <= 0 {
+		prod.MessageControlLoop(prod.storeMessage)
+		return // ### return, not pipelined ###
+	}
+
+	prod.pipeline = prod.client.Pipeline()
+	prod.pipelined = make([]*core.Message, 0, prod.pipelineSize)
+	prod.TickerMessageControlLoop(prod.storeMessage, prod.pipelineTimeout, prod.execPipelineOnTimeOut)
 }
@@ -20,7 +20,6 @@ import (
 	"github.com/artyom/scribe"
 	"github.com/artyom/thrift"
 	"github.com/trivago/gollum/core"
-	"github.com/trivago/tgo"
 	"github.com/trivago/tgo/tmath"
 	"sync"
 	"time"
@@ -78,6 +77,7 @@ type Scribe struct {
 	category             map[core.MessageStreamID]string
 	lastHeartBeat        time.Time
 	windowSize           int
+	windowSizeMetric     *core.Gauge
 	bufferSizeByte       int           `config:"ConnectionBufferSizeKB" default:"1024" metric:"kb"`
 	heartBeatInterval    time.Duration `config:"HeartBeatIntervalSec" default:"5" metric:"sec"`
 	maxWindowSize        int           `config:"WindowSize" default:"2048"`
@@ -114,16 +114,22 @@ func (prod *Scribe) Configure(conf core.PluginConfigReader) {
 	binProtocol := thrift.NewTBinaryProtocol(prod.transport, false, false)
 	prod.scribe = scribe.NewScribeClientProtocol(prod.transport, binProtocol, binProtocol)
 
-	tgo.Metric.New(scribeMetricWindowSize)
-	tgo.Metric.SetI(scribeMetricWindowSize, prod.windowSize)
+	prod.windowSizeMetric = core.NewLegacyGauge("scribe_window_size", core.MetricLabels{"plugin_id": prod.GetID()}, scribeMetricWindowSize)
+	prod.windowSizeMetric.Set(int64(prod.windowSize))
 
 	for _, category := range prod.category {
-		metricName := scribeMetricMessages + category
-		tgo.Metric.New(metricName)
-		tgo.Metric.NewRate(metricName, scribeMetricMessagesSec+category, time.Second, 10, 3, true)
+		prod.getCategoryMetric(category)
 	}
 }
 
+// getCategoryMetric returns the counter of messages sent to a category.
+func (prod *Scribe) getCategoryMetric(category string) *core.Counter {
+	return core.NewLegacyCounter("scribe_messages", core.MetricLabels{
+		"plugin_id": prod.GetID(),
+		"category":  category,
+	}, scribeMetricMessages+category, scribeMetricMessagesSec+category)
+}
+
 func (prod *Scribe) tryOpenConnection() bool {
 	if !prod.transport.IsOpen() {
 		if err := prod.transport.Open(); err != nil {
@@ -193,10 +199,7 @@ func (prod *Scribe) addCategory(streamID core.MessageStreamID) string {
 	}
 
 	category = core.StreamRegistry.GetStreamName(streamID)
-
-	metricName := scribeMetricMessages + category
-	tgo.Metric.New(metricName)
-	tgo.Metric.NewRate(metricName, scribeMetricMessagesSec+category, time.Second, 10, 3, true)
+	prod.getCategoryMetric(category)
 
 	prod.category[streamID] = category
 	return category
@@ -204,6 +207,7 @@ func (prod *Scribe) addCategory(streamID core.MessageStreamID) string {
 
 func (prod *Scribe) transformMessages(messages []*core.Message) {
 	logBuffer := make([]*scribe.LogEntry, len(messages))
+	categoryCounts := make(map[string]int64)
 
 	// Convert messages to scribe log format
 	for idx, msg := range messages {
@@ -220,7 +224,11 @@ func (prod *Scribe) transformMessages(messages []*core.Message) {
 			Message:  string(msg.GetPayload()),
 		}
 
-		tgo.Metric.Inc(scribeMetricMessages + category)
+		categoryCounts[category]++
+	}
+
+	for category, count := range categoryCounts {
+		prod.getCategoryMetric(category).Add(count)
 	}
 
 	// Try to send the whole batch.
@@ -257,7 +265,7 @@ func (prod *Scribe) transformMessages(messages []*core.Message) {
 		// Reduce window size to reduce load on server
 
 		prod.windowSize = tmath.MaxI(1, prod.windowSize/2)
-		tgo.Metric.SetI(scribeMetricWindowSize, prod.windowSize)
+		prod.windowSizeMetric.Set(int64(prod.windowSize))
 		time.Sleep(time.Duration(scribeMaxSleepTimeMs/scribeMaxRetries) * time.Millisecond)
 	}
 
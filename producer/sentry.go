@@ -0,0 +1,453 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tcontainer"
+)
+
+// Sentry producer plugin
+//
+// This producer converts log messages into Sentry events. The message payload
+// is expected to be JSON. Message text, level, exception details and other
+// event attributes are read from configurable fields. Messages that are not
+// JSON are sent with the payload as message text.
+// Only messages with a level equal to or above MinLevel are sent. Events can
+// be sampled and are rate limited. Events rejected by Sentry's rate limits
+// are dropped.
+//
+// Parameters
+//
+// - DSN: Defines the Sentry DSN, e.g. "https://<key>@sentry.example.com/<project>".
+// If no DSN is set, all messages are dropped.
+// By default this parameter is set to "".
+//
+// - MinLevel: Defines the minimum level of messages to send. Valid values
+// are "debug", "info", "warning", "error" and "fatal".
+// By default this parameter is set to "error".
+//
+// - Level: Defines the level used for messages without level field.
+// By default this parameter is set to "error".
+//
+// - Release: Defines the release used if the release field is not set.
+// By default this parameter is set to "".
+//
+// - Environment: Defines the environment used if the environment field is
+// not set.
+// By default this parameter is set to "".
+//
+// - Fields/Message: Defines the path of the message text.
+// By default this parameter is set to "message".
+//
+// - Fields/Level: Defines the path of the level.
+// By default this parameter is set to "level".
+//
+// - Fields/ExceptionType: Defines the path of the exception type.
+// By default this parameter is set to "exception/type".
+//
+// - Fields/ExceptionValue: Defines the path of the exception message.
+// By default this parameter is set to "exception/value".
+//
+// - Fields/Stacktrace: Defines the path of the stacktrace. This can be either
+// a string with one frame per line (most recent call first) or a list of
+// Sentry frame objects (most recent call last).
+// By default this parameter is set to "exception/stacktrace".
+//
+// - Fields/Release: Defines the path of the release.
+// By default this parameter is set to "release".
+//
+// - Fields/Environment: Defines the path of the environment.
+// By default this parameter is set to "environment".
+//
+// - Fields/ServerName: Defines the path of the host name. If not set, the
+// host name of the gollum host is used.
+// By default this parameter is set to "host".
+//
+// - Fields/Logger: Defines the path of the logger name.
+// By default this parameter is set to "logger".
+//
+// - Tags: Defines a map of Sentry tags to field paths.
+// By default this parameter is set to an empty list.
+//
+// - SampleRate: Defines the ratio of events to send, between 0 and 1.
+// By default this parameter is set to 1.
+//
+// - RateLimit/PerMin: Defines the maximum number of events per minute. Set to
+// 0 to disable rate limiting.
+// By default this parameter is set to 600.
+//
+// - TimeoutSec: Defines the timeout for a single request.
+// By default this parameter is set to 5.
+//
+// Examples
+//
+// This example sends errors of JSON formatted application logs to Sentry:
+//
+//  SentryOut:
+//    Type: producer.Sentry
+//    Streams: app_logs
+//    DSN: "https://abcdef@o1.ingest.sentry.io/42"
+//    Environment: production
+//    Fields:
+//      Message: "msg"
+//      Level: "severity"
+//      Stacktrace: "error/stack"
+//    Tags:
+//      service: "service/name"
+//    SampleRate: 0.5
+type Sentry struct {
+	core.BufferedProducer `gollumdoc:"embed_type"`
+	dsn                   string        `config:"DSN"`
+	minLevel              string        `config:"MinLevel" default:"error"`
+	defaultLevel          string        `config:"Level" default:"error"`
+	release               string        `config:"Release"`
+	environment           string        `config:"Environment"`
+	messageField          string        `config:"Fields/Message" default:"message"`
+	levelField            string        `config:"Fields/Level" default:"level"`
+	exceptionTypeField    string        `config:"Fields/ExceptionType" default:"exception/type"`
+	exceptionValueField   string        `config:"Fields/ExceptionValue" default:"exception/value"`
+	stacktraceField       string        `config:"Fields/Stacktrace" default:"exception/stacktrace"`
+	releaseField          string        `config:"Fields/Release" default:"release"`
+	environmentField      string        `config:"Fields/Environment" default:"environment"`
+	serverNameField       string        `config:"Fields/ServerName" default:"host"`
+	loggerField           string        `config:"Fields/Logger" default:"logger"`
+	sampleRate            float64       `config:"SampleRate" default:"1"`
+	rateLimit             int           `config:"RateLimit/PerMin" default:"600"`
+	timeout               time.Duration `config:"TimeoutSec" default:"5" metric:"sec"`
+	tags                  map[string]string
+	endpoint              string
+	authHeader            string
+	hostname              string
+	tokens                float64
+	lastRefill            time.Time
+	blockedUntil          time.Time
+	client                http.Client
+}
+
+var sentryLevels = map[string]int{
+	"debug":    0,
+	"trace":    0,
+	"info":     1,
+	"notice":   1,
+	"warning":  2,
+	"warn":     2,
+	"error":    3,
+	"err":      3,
+	"fatal":    4,
+	"critical": 4,
+	"crit":     4,
+	"alert":    4,
+	"emerg":    4,
+	"panic":    4,
+}
+
+var sentryLevelNames = []string{"debug", "info", "warning", "error", "fatal"}
+
+func init() {
+	core.TypeRegistry.Register(Sentry{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Sentry) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+	prod.tags = conf.GetStringMap("Tags", map[string]string{})
+	prod.client.Timeout = prod.timeout
+	prod.tokens = float64(prod.rateLimit)
+	prod.lastRefill = time.Now()
+	prod.hostname, _ = os.Hostname()
+
+	if _, known := sentryLevels[strings.ToLower(prod.minLevel)]; !known {
+		conf.Errors.Pushf("Unknown MinLevel: %s", prod.minLevel)
+	}
+	if _, known := sentryLevels[strings.ToLower(prod.defaultLevel)]; !known {
+		conf.Errors.Pushf("Unknown Level: %s", prod.defaultLevel)
+	}
+	if prod.sampleRate < 0 || prod.sampleRate > 1 {
+		conf.Errors.Pushf("SampleRate must be between 0 and 1")
+	}
+
+	if prod.dsn == "" {
+		prod.Logger.Warning("No DSN set. All messages will be dropped.")
+		return
+	}
+
+	dsn, err := url.Parse(prod.dsn)
+	if conf.Errors.Push(err) {
+		return
+	}
+
+	pathEnd := strings.LastIndex(dsn.Path, "/")
+	if dsn.User == nil || pathEnd < 0 || pathEnd == len(dsn.Path)-1 {
+		conf.Errors.Pushf("DSN must contain a public key and a project id")
+		return
+	}
+
+	project := dsn.Path[pathEnd+1:]
+	prod.endpoint = fmt.Sprintf("%s://%s%s/api/%s/envelope/", dsn.Scheme, dsn.Host, dsn.Path[:pathEnd], project)
+	prod.authHeader = fmt.Sprintf("Sentry sentry_version=7, sentry_client=gollum/%s, sentry_key=%s", core.GetVersionString(), dsn.User.Username())
+	if secret, hasSecret := dsn.User.Password(); hasSecret {
+		prod.authHeader += ", sentry_secret=" + secret
+	}
+}
+
+// Produce sends messages as events to Sentry.
+func (prod *Sentry) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	prod.MessageControlLoop(prod.sendMessage)
+}
+
+func sentryFieldString(fields tcontainer.MarshalMap, path string) string {
+	if path == "" {
+		return ""
+	}
+	value, found := fields.Value(path)
+	if !found || value == nil {
+		return ""
+	}
+	if text, isString := value.(string); isString {
+		return text
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+func (prod *Sentry) getLevel(fields tcontainer.MarshalMap) string {
+	level := strings.ToLower(sentryFieldString(fields, prod.levelField))
+	if number, known := sentryLevels[level]; known {
+		return sentryLevelNames[number]
+	}
+	return sentryLevelNames[sentryLevels[strings.ToLower(prod.defaultLevel)]]
+}
+
+// parseStacktrace converts a stacktrace into a list of Sentry frames with
+// the most recent call last.
+func (prod *Sentry) parseStacktrace(fields tcontainer.MarshalMap) []interface{} {
+	value, found := fields.Value(prod.stacktraceField)
+	if !found {
+		return nil
+	}
+
+	switch stacktrace := value.(type) {
+	case []interface{}:
+		return stacktrace
+
+	case string:
+		lines := strings.Split(strings.TrimSpace(stacktrace), "\n")
+		frames := make([]interface{}, 0, len(lines))
+		for i := len(lines) - 1; i >= 0; i-- {
+			if line := strings.TrimSpace(lines[i]); line != "" {
+				frames = append(frames, map[string]interface{}{"function": line})
+			}
+		}
+		return frames
+	}
+
+	return nil
+}
+
+func (prod *Sentry) newEvent(msg *core.Message, eventID string) (map[string]interface{}, string) {
+	fields := tcontainer.NewMarshalMap()
+	isJSON := json.Unmarshal(msg.GetPayload(), &fields) == nil
+
+	event := map[string]interface{}{
+		"event_id":  eventID,
+		"timestamp": float64(msg.GetCreationTime().UnixNano()) / float64(time.Second),
+		"platform":  "other",
+		"logger":    core.StreamRegistry.GetStreamName(msg.GetStreamID()),
+	}
+
+	if !isJSON {
+		level := sentryLevelNames[sentryLevels[strings.ToLower(prod.defaultLevel)]]
+		event["level"] = level
+		event["message"] = map[string]string{"formatted": msg.String()}
+		event["server_name"] = prod.hostname
+		setIfNotEmpty(event, "release", prod.release)
+		setIfNotEmpty(event, "environment", prod.environment)
+		return event, level
+	}
+
+	level := prod.getLevel(fields)
+	event["level"] = level
+	event["server_name"] = prod.hostname
+
+	if text := sentryFieldString(fields, prod.messageField); text != "" {
+		event["message"] = map[string]string{"formatted": text}
+	}
+	setIfNotEmpty(event, "logger", sentryFieldString(fields, prod.loggerField))
+	setIfNotEmpty(event, "server_name", sentryFieldString(fields, prod.serverNameField))
+
+	setIfNotEmpty(event, "release", prod.release)
+	setIfNotEmpty(event, "release", sentryFieldString(fields, prod.releaseField))
+	setIfNotEmpty(event, "environment", prod.environment)
+	setIfNotEmpty(event, "environment", sentryFieldString(fields, prod.environmentField))
+
+	exceptionType := sentryFieldString(fields, prod.exceptionTypeField)
+	exceptionValue := sentryFieldString(fields, prod.exceptionValueField)
+	frames := prod.parseStacktrace(fields)
+	if exceptionType != "" || exceptionValue != "" || len(frames) > 0 {
+		exception := map[string]interface{}{}
+		setIfNotEmpty(exception, "type", exceptionType)
+		setIfNotEmpty(exception, "value", exceptionValue)
+		if len(frames) > 0 {
+			exception["stacktrace"] = map[string]interface{}{"frames": frames}
+		}
+		event["exception"] = map[string]interface{}{"values": []interface{}{exception}}
+	}
+
+	if len(prod.tags) > 0 {
+		tags := map[string]interface{}{}
+		for tag, path := range prod.tags {
+			setIfNotEmpty(tags, tag, sentryFieldString(fields, path))
+		}
+		event["tags"] = tags
+	}
+
+	event["extra"] = fields
+	return event, level
+}
+
+// setIfNotEmpty sets a map value unless the value is an empty string.
+func setIfNotEmpty(target map[string]interface{}, key, value string) {
+	if value != "" {
+		target[key] = value
+	}
+}
+
+// allowEvent implements the token bucket used for rate limiting.
+func (prod *Sentry) allowEvent() bool {
+	now := time.Now()
+	if now.Before(prod.blockedUntil) {
+		return false
+	}
+	if prod.rateLimit <= 0 {
+		return true
+	}
+
+	prod.tokens += now.Sub(prod.lastRefill).Minutes() * float64(prod.rateLimit)
+	if prod.tokens > float64(prod.rateLimit) {
+		prod.tokens = float64(prod.rateLimit)
+	}
+	prod.lastRefill = now
+
+	if prod.tokens < 1 {
+		return false
+	}
+	prod.tokens--
+	return true
+}
+
+func (prod *Sentry) sendMessage(msg *core.Message) {
+	if prod.endpoint == "" {
+		return // ### return, no DSN ###
+	}
+
+	eventIDBytes := make([]byte, 16)
+	rand.Read(eventIDBytes)
+	eventID := hex.EncodeToString(eventIDBytes)
+
+	event, level := prod.newEvent(msg, eventID)
+	if sentryLevels[level] < sentryLevels[strings.ToLower(prod.minLevel)] {
+		return // ### return, level too low ###
+	}
+
+	if prod.sampleRate < 1 && mrand.Float64() >= prod.sampleRate {
+		return // ### return, not sampled ###
+	}
+
+	if !prod.allowEvent() {
+		prod.Logger.Debug("Rate limit reached, dropping event")
+		return // ### return, rate limited ###
+	}
+
+	if err := prod.sendEvent(eventID, event); err != nil {
+		prod.Logger.WithError(err).Error("Failed to send event")
+		prod.TryFallback(msg)
+	}
+}
+
+func (prod *Sentry) sendEvent(eventID string, event map[string]interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	envelopeHeader, _ := json.Marshal(map[string]string{
+		"event_id": eventID,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339),
+	})
+	itemHeader, _ := json.Marshal(map[string]interface{}{
+		"type":   "event",
+		"length": len(payload),
+	})
+
+	body := bytes.Buffer{}
+	body.Write(envelopeHeader)
+	body.WriteByte('\n')
+	body.Write(itemHeader)
+	body.WriteByte('\n')
+	body.Write(payload)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest("POST", prod.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", prod.authHeader)
+
+	resp, err := prod.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter := time.Minute
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		prod.blockedUntil = time.Now().Add(retryAfter)
+		prod.Logger.Warningf("Rate limited by Sentry for %v, dropping events", retryAfter)
+		return nil
+
+	case resp.StatusCode >= 300:
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+func (prod *Sentry) close() {
+	defer prod.WorkerDone()
+	prod.DefaultClose()
+}
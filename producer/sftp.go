@@ -0,0 +1,486 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP producer plugin
+//
+// This producer writes messages to local spool files and uploads them to a
+// remote SFTP server when they are rotated. Files are uploaded with a
+// temporary suffix and renamed after the upload succeeded so that readers on
+// the remote side never see incomplete files. Failed uploads are retried;
+// if all retries fail the spool file is kept locally.
+//
+// As files are uploaded on rotation, rotation is always enabled for this
+// producer.
+//
+// Parameters
+//
+// - Address: Defines the host and port of the SFTP server.
+// By default this parameter is set to "localhost:22".
+//
+// - User: Defines the user name used to log in.
+// By default this parameter is set to "gollum".
+//
+// - Password: Defines the password used to log in. Password authentication
+// is only used if this parameter is set.
+// By default this parameter is set to "".
+//
+// - PrivateKeyFile: Defines the path to a PEM encoded private key used to
+// log in.
+// By default this parameter is set to "".
+//
+// - PrivateKeyPassphrase: Defines the passphrase of an encrypted private key.
+// By default this parameter is set to "".
+//
+// - KnownHostsFile: Defines a known_hosts file used to verify the server's
+// host key. If empty, the host key is not verified.
+// By default this parameter is set to "".
+//
+// - RemoteDirectory: Defines the directory to upload files to. Every "*" will
+// be replaced by the name of the stream. Missing directories are created.
+// By default this parameter is set to "/".
+//
+// - TimeBasedDirectory: When set to true, RemoteDirectory is treated as a
+// template for time.Format using the time of the upload, e.g. "/2006/01/02".
+// By default this parameter is set to false.
+//
+// - File: Defines the name pattern of uploaded files. Every "*" will be
+// replaced by the name of the stream. The rotation timestamp is appended to
+// the name before the file extension.
+// By default this parameter is set to "gollum_*.log".
+//
+// - TempSuffix: Defines the suffix used while a file is uploaded.
+// By default this parameter is set to ".part".
+//
+// - SpoolDirectory: Defines the local directory used to buffer files before
+// they are uploaded. If empty, a directory in the system's temp folder is
+// used.
+// By default this parameter is set to "".
+//
+// - Retry/Count: Defines the number of retries for a failed upload.
+// By default this parameter is set to 3.
+//
+// - Retry/DelaySec: Defines the number of seconds to wait between retries.
+// By default this parameter is set to 5.
+//
+// Examples
+//
+// This example uploads hourly files to a vendor's SFTP server:
+//
+//  VendorUpload:
+//    Type: producer.SFTP
+//    Streams: exports
+//    Address: "sftp.vendor.com:22"
+//    User: acme
+//    PrivateKeyFile: /etc/gollum/vendor_id_rsa
+//    KnownHostsFile: /etc/gollum/known_hosts
+//    RemoteDirectory: "/incoming/2006-01-02"
+//    TimeBasedDirectory: true
+//    File: "export_*.csv"
+//    Rotation:
+//      TimeoutMin: 60
+//
+type SFTP struct {
+	core.DirectProducer `gollumdoc:"embed_type"`
+
+	// Rotate is public to make RotateConfig.Configure() callable (bug in treflect package)
+	// BatchConfig is public to make BatchedWriterConfig.Configure() callable (bug in treflect package)
+	Rotate      components.RotateConfig        `gollumdoc:"embed_type"`
+	BatchConfig components.BatchedWriterConfig `gollumdoc:"embed_type"`
+
+	address            string        `config:"Address" default:"localhost:22"`
+	user               string        `config:"User" default:"gollum"`
+	password           string        `config:"Password"`
+	privateKeyFile     string        `config:"PrivateKeyFile"`
+	keyPassphrase      string        `config:"PrivateKeyPassphrase"`
+	knownHostsFile     string        `config:"KnownHostsFile"`
+	remoteDirectory    string        `config:"RemoteDirectory" default:"/"`
+	timeBasedDirectory bool          `config:"TimeBasedDirectory" default:"false"`
+	fileNamePattern    string        `config:"File" default:"gollum_*.log"`
+	tempSuffix         string        `config:"TempSuffix" default:".part"`
+	spoolDirectory     string        `config:"SpoolDirectory"`
+	retryCount         int           `config:"Retry/Count" default:"3"`
+	retryDelay         time.Duration `config:"Retry/DelaySec" default:"5" metric:"sec"`
+
+	sshConfig        *ssh.ClientConfig
+	clientGuard      *sync.Mutex
+	sshClient        *ssh.Client
+	sftpClient       *sftp.Client
+	uploads          *sync.WaitGroup
+	filesByStream    map[core.MessageStreamID]*components.BatchedWriterAssembly
+	files            map[string]*components.BatchedWriterAssembly
+	batchedFileGuard *sync.RWMutex
+}
+
+// sftpSpoolFile implements components.BatchedWriter by writing to a local
+// file that is uploaded when the writer is closed.
+type sftpSpoolFile struct {
+	prod       *SFTP
+	file       *os.File
+	remoteDir  string
+	remoteName string
+	size       int64
+}
+
+func init() {
+	core.TypeRegistry.Register(SFTP{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *SFTP) Configure(conf core.PluginConfigReader) {
+	prod.SetRollCallback(prod.rotateTargetFiles)
+	prod.SetStopCallback(prod.close)
+
+	prod.filesByStream = make(map[core.MessageStreamID]*components.BatchedWriterAssembly)
+	prod.files = make(map[string]*components.BatchedWriterAssembly)
+	prod.batchedFileGuard = new(sync.RWMutex)
+	prod.clientGuard = new(sync.Mutex)
+	prod.uploads = new(sync.WaitGroup)
+	prod.Rotate.Enabled = true // force rotation
+
+	if prod.spoolDirectory == "" {
+		prod.spoolDirectory = filepath.Join(os.TempDir(), "gollum-sftp-"+prod.GetID())
+	}
+
+	prod.sshConfig = &ssh.ClientConfig{
+		User:    prod.user,
+		Timeout: 30 * time.Second,
+	}
+
+	if prod.password != "" {
+		prod.sshConfig.Auth = append(prod.sshConfig.Auth, ssh.Password(prod.password))
+	}
+
+	if prod.privateKeyFile != "" {
+		keyData, err := ioutil.ReadFile(prod.privateKeyFile)
+		if conf.Errors.Push(err) {
+			return
+		}
+
+		var signer ssh.Signer
+		if prod.keyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(prod.keyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(keyData)
+		}
+		if conf.Errors.Push(err) {
+			return
+		}
+		prod.sshConfig.Auth = append(prod.sshConfig.Auth, ssh.PublicKeys(signer))
+	}
+
+	if prod.knownHostsFile != "" {
+		callback, err := knownhosts.New(prod.knownHostsFile)
+		if conf.Errors.Push(err) {
+			return
+		}
+		prod.sshConfig.HostKeyCallback = callback
+	} else {
+		prod.Logger.Warning("No KnownHostsFile set. Host keys will not be verified.")
+		prod.sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+}
+
+// Produce writes messages to spool files that are uploaded on rotation.
+func (prod *SFTP) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	prod.TickerMessageControlLoop(prod.writeMessage, prod.BatchConfig.BatchTimeout, prod.writeBatchOnTimeOut)
+}
+
+func (prod *SFTP) getClient() (*sftp.Client, error) {
+	if prod.sftpClient != nil {
+		return prod.sftpClient, nil
+	}
+
+	sshClient, err := ssh.Dial("tcp", prod.address, prod.sshConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	prod.sshClient = sshClient
+	prod.sftpClient = sftpClient
+	return sftpClient, nil
+}
+
+func (prod *SFTP) closeClient() {
+	if prod.sftpClient != nil {
+		prod.sftpClient.Close()
+		prod.sftpClient = nil
+	}
+	if prod.sshClient != nil {
+		prod.sshClient.Close()
+		prod.sshClient = nil
+	}
+}
+
+func (prod *SFTP) uploadFile(localPath, remoteDir, remoteName string) error {
+	prod.clientGuard.Lock()
+	defer prod.clientGuard.Unlock()
+
+	client, err := prod.getClient()
+	if err != nil {
+		return err
+	}
+
+	if err := client.MkdirAll(remoteDir); err != nil {
+		prod.closeClient()
+		return err
+	}
+
+	local, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	finalPath := path.Join(remoteDir, remoteName)
+	tempPath := finalPath + prod.tempSuffix
+
+	remote, err := client.Create(tempPath)
+	if err != nil {
+		prod.closeClient()
+		return err
+	}
+
+	if _, err := io.Copy(remote, local); err != nil {
+		remote.Close()
+		prod.closeClient()
+		return err
+	}
+
+	if err := remote.Close(); err != nil {
+		prod.closeClient()
+		return err
+	}
+
+	if tempPath == finalPath {
+		return nil // ### return, no rename required ###
+	}
+
+	// Prefer the atomic posix-rename extension which also replaces existing files
+	if err := client.PosixRename(tempPath, finalPath); err != nil {
+		if err := client.Rename(tempPath, finalPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (prod *SFTP) upload(localPath, remoteDir, remoteName string) {
+	defer prod.uploads.Done()
+	logger := prod.Logger.WithField("file", path.Join(remoteDir, remoteName))
+
+	for retry := 0; retry <= prod.retryCount; retry++ {
+		if retry > 0 {
+			time.Sleep(prod.retryDelay)
+		}
+
+		err := prod.uploadFile(localPath, remoteDir, remoteName)
+		if err == nil {
+			logger.Info("Upload finished")
+			os.Remove(localPath)
+			return // ### return, done ###
+		}
+		logger.WithError(err).Warning("Upload failed")
+	}
+
+	logger.Errorf("Upload failed after %d retries, keeping %s", prod.retryCount, localPath)
+}
+
+func (prod *SFTP) getBatchedFile(streamID core.MessageStreamID, forceRotate bool) (*components.BatchedWriterAssembly, error) {
+	prod.batchedFileGuard.RLock()
+	batchedFile, fileExists := prod.filesByStream[streamID]
+	prod.batchedFileGuard.RUnlock()
+	if fileExists {
+		if rotate, err := batchedFile.NeedsRotate(prod.Rotate, forceRotate); !rotate {
+			return batchedFile, err // ### return, already open or error ###
+		}
+	}
+
+	prod.batchedFileGuard.Lock()
+	defer prod.batchedFileGuard.Unlock()
+
+	// check again to avoid race conditions
+	if batchedFile, fileExists = prod.filesByStream[streamID]; fileExists {
+		if rotate, err := batchedFile.NeedsRotate(prod.Rotate, forceRotate); !rotate {
+			return batchedFile, err // ### return, already open or error ###
+		}
+	}
+
+	streamName := core.StreamRegistry.GetStreamName(streamID)
+	baseFileName := strings.Replace(prod.fileNamePattern, "*", streamName, -1)
+
+	batchedFile, fileExists = prod.files[baseFileName]
+	if !fileExists {
+		batchedFile = components.NewBatchedWriterAssembly(
+			prod.BatchConfig,
+			prod,
+			prod.TryFallback,
+			prod.Logger,
+		)
+		prod.files[baseFileName] = batchedFile
+	}
+	prod.filesByStream[streamID] = batchedFile
+
+	if batchedFile.HasWriter() {
+		oldWriter := batchedFile.GetWriterAndUnset()
+		prod.Logger.Info("Rotated ", oldWriter.Name())
+		oldWriter.Close()
+	}
+
+	writer, err := prod.newSpoolFile(streamName, baseFileName)
+	if err != nil {
+		return nil, err
+	}
+	batchedFile.SetWriter(writer)
+
+	return batchedFile, nil
+}
+
+func (prod *SFTP) newSpoolFile(streamName, baseFileName string) (*sftpSpoolFile, error) {
+	now := time.Now()
+
+	remoteDir := prod.remoteDirectory
+	if prod.timeBasedDirectory {
+		remoteDir = now.Format(remoteDir)
+	}
+	remoteDir = strings.Replace(remoteDir, "*", streamName, -1)
+
+	fileExt := filepath.Ext(baseFileName)
+	remoteName := fmt.Sprintf("%s_%s%s", baseFileName[:len(baseFileName)-len(fileExt)], now.Format(prod.Rotate.Timestamp), fileExt)
+
+	if err := os.MkdirAll(prod.spoolDirectory, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(prod.spoolDirectory, remoteName+".")
+	if err != nil {
+		return nil, err
+	}
+
+	return &sftpSpoolFile{
+		prod:       prod,
+		file:       file,
+		remoteDir:  remoteDir,
+		remoteName: remoteName,
+	}, nil
+}
+
+func (prod *SFTP) writeMessage(msg *core.Message) {
+	batchedFile, err := prod.getBatchedFile(msg.GetStreamID(), false)
+	if err != nil {
+		prod.Logger.Error("Write error: ", err)
+		prod.TryFallback(msg)
+		return // ### return, fallback ###
+	}
+
+	batchedFile.AppendOrFlush(msg, prod.IsActiveOrStopping, prod.TryFallback)
+}
+
+func (prod *SFTP) writeBatchOnTimeOut() {
+	prod.batchedFileGuard.RLock()
+	defer prod.batchedFileGuard.RUnlock()
+
+	for _, batchedFile := range prod.files {
+		batchedFile.FlushOnTimeOut()
+	}
+}
+
+func (prod *SFTP) rotateTargetFiles() {
+	for streamID := range prod.filesByStream {
+		if _, err := prod.getBatchedFile(streamID, true); err != nil {
+			prod.Logger.Error("Rotate error: ", err)
+		}
+	}
+}
+
+func (prod *SFTP) close() {
+	defer prod.WorkerDone()
+
+	for _, batchedFile := range prod.files {
+		batchedFile.Close()
+	}
+
+	prod.uploads.Wait()
+	prod.clientGuard.Lock()
+	prod.closeClient()
+	prod.clientGuard.Unlock()
+}
+
+// Write is part of the BatchedWriter interface
+func (spool *sftpSpoolFile) Write(data []byte) (int, error) {
+	n, err := spool.file.Write(data)
+	spool.size += int64(n)
+	return n, err
+}
+
+// Name is part of the BatchedWriter interface
+func (spool *sftpSpoolFile) Name() string {
+	return path.Join(spool.remoteDir, spool.remoteName)
+}
+
+// Size is part of the BatchedWriter interface
+func (spool *sftpSpoolFile) Size() int64 {
+	return spool.size
+}
+
+// IsAccessible is part of the BatchedWriter interface
+func (spool *sftpSpoolFile) IsAccessible() bool {
+	return spool.file != nil
+}
+
+// Close closes the spool file and starts the upload in the background.
+// Empty files are not uploaded.
+func (spool *sftpSpoolFile) Close() error {
+	if spool.file == nil {
+		return nil
+	}
+
+	localPath := spool.file.Name()
+	err := spool.file.Close()
+	spool.file = nil
+
+	if spool.size == 0 {
+		return os.Remove(localPath)
+	}
+
+	spool.prod.uploads.Add(1)
+	go spool.prod.upload(localPath, spool.remoteDir, spool.remoteName)
+	return err
+}
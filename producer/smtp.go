@@ -0,0 +1,400 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+)
+
+// SMTP producer plugin
+//
+// This producer collects messages over a time window and sends them as a
+// single digest email. It is intended for low volume streams like audit logs
+// or alerts. If a digest cannot be sent, its messages are passed to the
+// fallback stream.
+//
+// Parameters
+//
+// - Address: Defines the host and port of the mail server.
+// By default this parameter is set to "localhost:25".
+//
+// - From: Defines the sender address.
+// By default this parameter is set to "gollum@localhost".
+//
+// - To: Defines a list of recipient addresses.
+// By default this parameter is set to "postmaster@localhost".
+//
+// - Subject: Defines the go template used to render the subject. See Body for
+// the available fields.
+// By default this parameter is set to "[gollum] {{.Count}} messages from {{.Streams}}".
+//
+// - Body: Defines the go template used to render the body. The fields .Count,
+// .Omitted, .Streams, .Start, .End and .Messages are available. Each entry of
+// .Messages provides .Payload, .Stream, .Metadata (a map of strings) and .Time.
+// By default this parameter renders one line per message.
+//
+// - WindowSec: Defines the number of seconds to collect messages for a digest.
+// The window starts with the first message after the last digest.
+// By default this parameter is set to 300.
+//
+// - MaxMessages: Defines the maximum number of messages included in a digest.
+// Additional messages are only counted.
+// By default this parameter is set to 1000.
+//
+// - Username: Defines the user name used for authentication. If empty, no
+// authentication is done.
+// By default this parameter is set to "".
+//
+// - Password: Defines the password used for authentication.
+// By default this parameter is set to "".
+//
+// - AuthMechanism: Defines the authentication mechanism. Valid values are
+// "plain" and "crammd5". Plain authentication requires TLS unless the server
+// is running on localhost.
+// By default this parameter is set to "plain".
+//
+// - TlsMode: Defines how TLS is used. Set to "starttls" to upgrade the
+// connection if the server supports it, to "tls" for implicit TLS, e.g. on
+// port 465, or to "none" to disable TLS. See core/components.NewTLSClientConfig
+// for additional TLS settings.
+// By default this parameter is set to "starttls".
+//
+// - TimeoutSec: Defines the timeout for connecting to the server.
+// By default this parameter is set to 30.
+//
+// Examples
+//
+// This example sends an hourly digest of audit events:
+//
+//  AuditMail:
+//    Type: producer.SMTP
+//    Streams: audit
+//    Address: "mail.example.com:587"
+//    From: "gollum@example.com"
+//    To:
+//      - "security@example.com"
+//    Subject: "Audit digest: {{.Count}} events"
+//    WindowSec: 3600
+//    Username: gollum
+//    Password: "${SMTP_PASSWORD}"
+type SMTP struct {
+	core.BufferedProducer `gollumdoc:"embed_type"`
+	address               string        `config:"Address" default:"localhost:25"`
+	from                  string        `config:"From" default:"gollum@localhost"`
+	window                time.Duration `config:"WindowSec" default:"300" metric:"sec"`
+	maxMessages           int           `config:"MaxMessages" default:"1000"`
+	username              string        `config:"Username"`
+	password              string        `config:"Password"`
+	authMechanism         string        `config:"AuthMechanism" default:"plain"`
+	tlsMode               string        `config:"TlsMode" default:"starttls"`
+	timeout               time.Duration `config:"TimeoutSec" default:"30" metric:"sec"`
+	to                    []string
+	subject               *template.Template
+	body                  *template.Template
+	tlsConfig             *tls.Config
+	messages              []*core.Message
+	count                 int
+	start                 time.Time
+	messageGuard          *sync.Mutex
+}
+
+// smtpDigest is passed to the subject and body templates.
+type smtpDigest struct {
+	Count    int
+	Omitted  int
+	Streams  string
+	Start    time.Time
+	End      time.Time
+	Messages []smtpMessage
+}
+
+// smtpMessage is a message of a digest.
+type smtpMessage struct {
+	Payload  string
+	Stream   string
+	Metadata map[string]string
+	Time     time.Time
+}
+
+const smtpDefaultBody = `{{range .Messages}}{{.Time.Format "2006-01-02 15:04:05"}} [{{.Stream}}] {{.Payload}}
+{{end}}{{if .Omitted}}... and {{.Omitted}} more
+{{end}}`
+
+func init() {
+	core.TypeRegistry.Register(SMTP{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *SMTP) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+	prod.messageGuard = new(sync.Mutex)
+	prod.to = conf.GetStringArray("To", []string{"postmaster@localhost"})
+	if len(prod.to) == 0 {
+		conf.Errors.Pushf("At least one recipient is required")
+	}
+
+	var err error
+	prod.subject, err = template.New("Subject").Parse(conf.GetString("Subject", "[gollum] {{.Count}} messages from {{.Streams}}"))
+	conf.Errors.Push(err)
+	prod.body, err = template.New("Body").Parse(conf.GetString("Body", smtpDefaultBody))
+	conf.Errors.Push(err)
+
+	prod.authMechanism = strings.ToLower(prod.authMechanism)
+	if prod.authMechanism != "plain" && prod.authMechanism != "crammd5" {
+		conf.Errors.Pushf("AuthMechanism must be either plain or crammd5")
+	}
+
+	prod.tlsMode = strings.ToLower(prod.tlsMode)
+	switch prod.tlsMode {
+	case "none":
+	case "starttls", "tls":
+		prod.tlsConfig, err = components.NewTLSClientConfig(conf)
+		if conf.Errors.Push(err) {
+			return
+		}
+		if prod.tlsConfig.ServerName == "" {
+			prod.tlsConfig.ServerName, _, _ = net.SplitHostPort(prod.address)
+		}
+	default:
+		conf.Errors.Pushf("TlsMode must be one of starttls, tls or none")
+	}
+
+	if prod.maxMessages < 1 {
+		prod.maxMessages = 1
+	}
+}
+
+// Produce sends message digests by email.
+func (prod *SMTP) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	prod.TickerMessageControlLoop(prod.collectMessage, time.Second, prod.sendOnTimeOut)
+}
+
+func (prod *SMTP) collectMessage(msg *core.Message) {
+	prod.messageGuard.Lock()
+	defer prod.messageGuard.Unlock()
+
+	if prod.count == 0 {
+		prod.start = time.Now()
+	}
+	if len(prod.messages) < prod.maxMessages {
+		prod.messages = append(prod.messages, msg)
+	}
+	prod.count++
+}
+
+func (prod *SMTP) sendOnTimeOut() {
+	prod.messageGuard.Lock()
+	ready := prod.count > 0 && time.Since(prod.start) >= prod.window
+	prod.messageGuard.Unlock()
+
+	if ready {
+		prod.sendDigest()
+	}
+}
+
+func (prod *SMTP) newDigest(messages []*core.Message, count int, start time.Time) smtpDigest {
+	digest := smtpDigest{
+		Count:    count,
+		Omitted:  count - len(messages),
+		Start:    start,
+		End:      time.Now(),
+		Messages: make([]smtpMessage, 0, len(messages)),
+	}
+
+	streams := make(map[string]bool)
+	for _, msg := range messages {
+		entry := smtpMessage{
+			Payload:  msg.String(),
+			Stream:   core.StreamRegistry.GetStreamName(msg.GetStreamID()),
+			Metadata: make(map[string]string),
+			Time:     msg.GetCreationTime(),
+		}
+		if metadata := msg.TryGetMetadata(); metadata != nil {
+			for key, value := range metadata {
+				entry.Metadata[key] = string(value)
+			}
+		}
+		streams[entry.Stream] = true
+		digest.Messages = append(digest.Messages, entry)
+	}
+
+	streamNames := make([]string, 0, len(streams))
+	for name := range streams {
+		streamNames = append(streamNames, name)
+	}
+	sort.Strings(streamNames)
+	digest.Streams = strings.Join(streamNames, ", ")
+
+	return digest
+}
+
+func (prod *SMTP) sendDigest() {
+	prod.messageGuard.Lock()
+	messages, count, start := prod.messages, prod.count, prod.start
+	prod.messages, prod.count = nil, 0
+	prod.messageGuard.Unlock()
+
+	if count == 0 {
+		return // ### return, nothing to send ###
+	}
+
+	mail, err := prod.composeMail(prod.newDigest(messages, count, start))
+	if err == nil {
+		err = prod.sendMail(mail)
+	}
+
+	if err != nil {
+		prod.Logger.WithError(err).Errorf("Failed to send digest of %d messages", count)
+		for _, msg := range messages {
+			prod.TryFallback(msg)
+		}
+		return // ### return, failed ###
+	}
+
+	prod.Logger.Debugf("Sent digest of %d messages", count)
+}
+
+func (prod *SMTP) composeMail(digest smtpDigest) ([]byte, error) {
+	subject := bytes.Buffer{}
+	if err := prod.subject.Execute(&subject, digest); err != nil {
+		return nil, err
+	}
+
+	mail := bytes.Buffer{}
+	fmt.Fprintf(&mail, "From: %s\r\n", prod.from)
+	fmt.Fprintf(&mail, "To: %s\r\n", strings.Join(prod.to, ", "))
+	fmt.Fprintf(&mail, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(&mail, "Date: %s\r\n", digest.End.Format(time.RFC1123Z))
+	mail.WriteString("MIME-Version: 1.0\r\n")
+	mail.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	mail.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	mail.WriteString("\r\n")
+
+	body := quotedprintable.NewWriter(&mail)
+	if err := prod.body.Execute(body, digest); err != nil {
+		return nil, err
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	return mail.Bytes(), nil
+}
+
+func (prod *SMTP) dial() (*smtp.Client, error) {
+	dialer := &net.Dialer{Timeout: prod.timeout}
+	host, _, _ := net.SplitHostPort(prod.address)
+
+	var conn net.Conn
+	var err error
+	if prod.tlsMode == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", prod.address, prod.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", prod.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		if err := client.Hello(hostname); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	if prod.tlsMode == "starttls" {
+		if supported, _ := client.Extension("STARTTLS"); supported {
+			if err := client.StartTLS(prod.tlsConfig); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+	}
+	return client, nil
+}
+
+func (prod *SMTP) sendMail(mail []byte) error {
+	client, err := prod.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if prod.username != "" {
+		host, _, _ := net.SplitHostPort(prod.address)
+		var auth smtp.Auth
+		switch prod.authMechanism {
+		case "crammd5":
+			auth = smtp.CRAMMD5Auth(prod.username, prod.password)
+		default:
+			auth = smtp.PlainAuth("", prod.username, prod.password, host)
+		}
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(prod.from); err != nil {
+		return err
+	}
+	for _, recipient := range prod.to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(mail); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+func (prod *SMTP) close() {
+	defer prod.WorkerDone()
+	prod.DefaultClose()
+	prod.sendDigest()
+}
@@ -0,0 +1,556 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tcontainer"
+)
+
+// Snowflake producer plugin
+//
+// This producer writes rows to Snowflake tables using the Snowpipe Streaming
+// REST API. Authentication uses key-pair authentication. Each stream is
+// written through its own channel, which is opened on first use and reopened
+// if it becomes invalid.
+// Messages are expected to be JSON objects. If Columns is not set, the keys
+// of the JSON object are used as column names.
+//
+// Parameters
+//
+// - Account: Defines the Snowflake account identifier, e.g. "myorg-myaccount".
+// If no account is set, all messages are sent to the fallback stream.
+// By default this parameter is set to "".
+//
+// - URL: Defines the URL of the account. If empty,
+// "https://<Account>.snowflakecomputing.com" is used.
+// By default this parameter is set to "".
+//
+// - User: Defines the user to authenticate as. A public key has to be
+// assigned to this user.
+// By default this parameter is set to "".
+//
+// - PrivateKeyFile: Defines the path to the unencrypted PEM encoded RSA
+// private key of User.
+// By default this parameter is set to "".
+//
+// - Database: Defines the database to write to.
+// By default this parameter is set to "".
+//
+// - Schema: Defines the schema to write to.
+// By default this parameter is set to "PUBLIC".
+//
+// - Pipe: Defines the pipe to write to. Every "*" will be replaced by the
+// name of the stream. The default pipe of a table is called
+// "<TABLE>-STREAMING".
+// By default this parameter is set to "*-STREAMING".
+//
+// - Channel: Defines the channel name. Every "*" will be replaced by the name
+// of the stream. Channel names must be unique per pipe, so every gollum
+// instance needs its own channel.
+// By default this parameter is set to "gollum_<hostname>_*".
+//
+// - Columns: Defines a map of column names to field paths inside the JSON
+// encoded payload.
+// By default this parameter is set to an empty map.
+//
+// - MetadataColumns: Defines a map of column names to metadata keys.
+// By default this parameter is set to an empty map.
+//
+// - Retry/Count: Defines the number of retries before messages are sent to
+// the fallback stream.
+// By default this parameter is set to 3.
+//
+// - Retry/DelayMs: Defines the number of milliseconds to wait between retries.
+// By default this parameter is set to 1000.
+//
+// Examples
+//
+// This example writes access logs to the table LOGS.PUBLIC.ACCESS_LOG:
+//
+//  SnowflakeOut:
+//    Type: producer.Snowflake
+//    Streams: access_log
+//    Account: "myorg-myaccount"
+//    User: GOLLUM
+//    PrivateKeyFile: /etc/gollum/snowflake_key.p8
+//    Database: LOGS
+//    Pipe: "ACCESS_LOG-STREAMING"
+//    Columns:
+//      TS: "timestamp"
+//      STATUS: "response/status"
+//      URL: "request/url"
+//    MetadataColumns:
+//      HOST: "hostname"
+//    Batch:
+//      TimeoutSec: 30
+type Snowflake struct {
+	core.BatchedProducer `gollumdoc:"embed_type"`
+	account              string        `config:"Account"`
+	accountURL           string        `config:"URL"`
+	user                 string        `config:"User"`
+	privateKeyFile       string        `config:"PrivateKeyFile"`
+	database             string        `config:"Database"`
+	schema               string        `config:"Schema" default:"PUBLIC"`
+	pipe                 string        `config:"Pipe" default:"*-STREAMING"`
+	channel              string        `config:"Channel"`
+	retryCount           int           `config:"Retry/Count" default:"3"`
+	retryDelay           time.Duration `config:"Retry/DelayMs" default:"1000" metric:"ms"`
+	columns              map[string]string
+	metadataColumns      map[string]string
+	privateKey           *rsa.PrivateKey
+	jwtIssuer            string
+	jwtSubject           string
+	ingestHost           string
+	token                string
+	tokenExpires         time.Time
+	authGuard            *sync.Mutex
+	channels             map[core.MessageStreamID]*snowflakeChannel
+	channelGuard         *sync.Mutex
+	client               http.Client
+}
+
+// snowflakeChannel holds the state of an open channel.
+type snowflakeChannel struct {
+	pipe              string
+	name              string
+	continuationToken string
+	offset            int64
+}
+
+type snowflakeError struct {
+	status  int
+	code    string
+	message string
+}
+
+// snowflakeTokenLifetime defines how long a scoped token is used before a new
+// one is requested.
+const snowflakeTokenLifetime = 50 * time.Minute
+
+func init() {
+	core.TypeRegistry.Register(Snowflake{})
+}
+
+func (err snowflakeError) Error() string {
+	if err.code != "" {
+		return fmt.Sprintf("request failed with status %d (%s): %s", err.status, err.code, err.message)
+	}
+	return fmt.Sprintf("request failed with status %d: %s", err.status, err.message)
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Snowflake) Configure(conf core.PluginConfigReader) {
+	prod.columns = conf.GetStringMap("Columns", map[string]string{})
+	prod.metadataColumns = conf.GetStringMap("MetadataColumns", map[string]string{})
+	prod.channels = make(map[core.MessageStreamID]*snowflakeChannel)
+	prod.authGuard = new(sync.Mutex)
+	prod.channelGuard = new(sync.Mutex)
+	prod.client.Timeout = 60 * time.Second
+
+	if prod.channel == "" {
+		hostname, _ := os.Hostname()
+		prod.channel = "gollum_" + hostname + "_*"
+	}
+
+	if prod.account == "" {
+		prod.Logger.Warning("No Account set. All messages will be sent to the fallback stream.")
+		return
+	}
+
+	if prod.accountURL == "" {
+		prod.accountURL = "https://" + prod.account + ".snowflakecomputing.com"
+	}
+	prod.accountURL = strings.TrimRight(prod.accountURL, "/")
+
+	if prod.user == "" || prod.database == "" {
+		conf.Errors.Pushf("User and Database are required")
+	}
+
+	keyData, err := ioutil.ReadFile(prod.privateKeyFile)
+	if conf.Errors.Push(err) {
+		return
+	}
+	prod.privateKey, err = parseRSAPrivateKey(keyData)
+	if conf.Errors.Push(err) {
+		return
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&prod.privateKey.PublicKey)
+	if conf.Errors.Push(err) {
+		return
+	}
+	fingerprint := sha256.Sum256(publicKey)
+
+	// Account locators must not contain region information
+	account := strings.ToUpper(strings.SplitN(prod.account, ".", 2)[0])
+	prod.jwtSubject = account + "." + strings.ToUpper(prod.user)
+	prod.jwtIssuer = prod.jwtSubject + ".SHA256:" + base64.StdEncoding.EncodeToString(fingerprint[:])
+}
+
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, isRSA := key.(*rsa.PrivateKey)
+	if !isRSA {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// newJWT creates a JWT used for key-pair authentication.
+func (prod *Snowflake) newJWT() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": prod.jwtIssuer,
+		"sub": prod.jwtSubject,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, prod.privateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (prod *Snowflake) readError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	details := struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{}
+
+	if err := json.Unmarshal(body, &details); err != nil || details.Message == "" {
+		details.Message = strings.TrimSpace(string(body))
+	}
+	return snowflakeError{status: resp.StatusCode, code: details.Code, message: details.Message}
+}
+
+// readTextOrField reads a response that is either plain text or a JSON
+// object containing the given field.
+func (prod *Snowflake) readTextOrField(resp *http.Response, field string) (string, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	text := strings.TrimSpace(string(body))
+	if strings.HasPrefix(text, "{") {
+		values := map[string]interface{}{}
+		if err := json.Unmarshal(body, &values); err != nil {
+			return "", err
+		}
+		value, _ := values[field].(string)
+		return value, nil
+	}
+	return text, nil
+}
+
+// getToken returns a scoped token for the ingest host and requests a new one
+// if required.
+func (prod *Snowflake) getToken() (string, error) {
+	prod.authGuard.Lock()
+	defer prod.authGuard.Unlock()
+
+	if prod.token != "" && time.Now().Before(prod.tokenExpires) {
+		return prod.token, nil
+	}
+
+	jwt, err := prod.newJWT()
+	if err != nil {
+		return "", err
+	}
+
+	if prod.ingestHost == "" {
+		req, err := http.NewRequest("GET", prod.accountURL+"/v2/streaming/hostname", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		req.Header.Set("X-Snowflake-Authorization-Token-Type", "KEYPAIR_JWT")
+
+		resp, err := prod.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return "", prod.readError(resp)
+		}
+		if prod.ingestHost, err = prod.readTextOrField(resp, "hostname"); err != nil {
+			return "", err
+		}
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"scope":      {prod.ingestHost},
+	}
+	req, err := http.NewRequest("POST", prod.accountURL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := prod.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", prod.readError(resp)
+	}
+
+	if prod.token, err = prod.readTextOrField(resp, "access_token"); err != nil {
+		return "", err
+	}
+	prod.tokenExpires = time.Now().Add(snowflakeTokenLifetime)
+	return prod.token, nil
+}
+
+func (prod *Snowflake) resetToken() {
+	prod.authGuard.Lock()
+	prod.token = ""
+	prod.authGuard.Unlock()
+}
+
+// request sends a request to the ingest host and decodes the JSON response
+// into result.
+func (prod *Snowflake) request(method, path string, query url.Values, contentType string, body []byte, result interface{}) error {
+	token, err := prod.getToken()
+	if err != nil {
+		return err
+	}
+
+	requestURL := url.URL{
+		Scheme:   "https",
+		Host:     prod.ingestHost,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequest(method, requestURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Snowflake-Authorization-Token-Type", "OAUTH")
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := prod.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		prod.resetToken()
+	}
+	if resp.StatusCode >= 300 {
+		return prod.readError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (prod *Snowflake) pipePath(pipe string) string {
+	return fmt.Sprintf("databases/%s/schemas/%s/pipes/%s", url.PathEscape(prod.database), url.PathEscape(prod.schema), url.PathEscape(pipe))
+}
+
+func (prod *Snowflake) openChannel(streamID core.MessageStreamID) (*snowflakeChannel, error) {
+	if channel, exists := prod.channels[streamID]; exists {
+		return channel, nil
+	}
+
+	streamName := core.StreamRegistry.GetStreamName(streamID)
+	channel := &snowflakeChannel{
+		pipe:   strings.Replace(prod.pipe, "*", streamName, -1),
+		name:   strings.Replace(prod.channel, "*", streamName, -1),
+		offset: time.Now().UnixNano(),
+	}
+
+	result := struct {
+		NextContinuationToken string `json:"next_continuation_token"`
+		ChannelStatus         struct {
+			LastCommittedOffsetToken string `json:"last_committed_offset_token"`
+		} `json:"channel_status"`
+	}{}
+
+	path := "/v2/streaming/" + prod.pipePath(channel.pipe) + "/channels/" + url.PathEscape(channel.name)
+	if err := prod.request("PUT", path, url.Values{}, "application/json", []byte("{}"), &result); err != nil {
+		return nil, err
+	}
+
+	// Offsets have to increase, even if the clock was turned back
+	if lastOffset, err := strconv.ParseInt(result.ChannelStatus.LastCommittedOffsetToken, 10, 64); err == nil && lastOffset >= channel.offset {
+		channel.offset = lastOffset + 1
+	}
+
+	channel.continuationToken = result.NextContinuationToken
+	prod.channels[streamID] = channel
+	prod.Logger.Infof("Opened channel %s on pipe %s", channel.name, channel.pipe)
+	return channel, nil
+}
+
+func (prod *Snowflake) appendRows(streamID core.MessageStreamID, rows []byte) error {
+	channel, err := prod.openChannel(streamID)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{
+		"continuationToken": {channel.continuationToken},
+		"offsetToken":       {strconv.FormatInt(channel.offset, 10)},
+	}
+	result := struct {
+		NextContinuationToken string `json:"next_continuation_token"`
+	}{}
+
+	path := "/v2/streaming/data/" + prod.pipePath(channel.pipe) + "/channels/" + url.PathEscape(channel.name) + "/rows"
+	if err := prod.request("POST", path, query, "application/x-ndjson", rows, &result); err != nil {
+		// The channel might have been invalidated, reopen it on retry
+		delete(prod.channels, streamID)
+		return err
+	}
+
+	channel.continuationToken = result.NextContinuationToken
+	channel.offset++
+	return nil
+}
+
+func (prod *Snowflake) toRow(msg *core.Message) ([]byte, error) {
+	payload := tcontainer.NewMarshalMap()
+	if err := json.Unmarshal(msg.GetPayload(), &payload); err != nil {
+		return nil, err
+	}
+
+	if len(prod.columns) == 0 && len(prod.metadataColumns) == 0 {
+		return msg.GetPayload(), nil
+	}
+
+	row := make(map[string]interface{})
+	for column, path := range prod.columns {
+		if value, found := payload.Value(path); found {
+			row[column] = value
+		}
+	}
+
+	if metadata := msg.TryGetMetadata(); metadata != nil {
+		for column, key := range prod.metadataColumns {
+			if value, exists := metadata.TryGetValueString(key); exists {
+				row[column] = value
+			}
+		}
+	}
+
+	return json.Marshal(row)
+}
+
+func (prod *Snowflake) appendWithRetry(streamID core.MessageStreamID, rows []byte, messages []*core.Message) {
+	var err error
+	for retry := 0; retry <= prod.retryCount; retry++ {
+		if retry > 0 {
+			time.Sleep(prod.retryDelay)
+		}
+
+		if err = prod.appendRows(streamID, rows); err == nil {
+			return // ### return, success ###
+		}
+		prod.Logger.WithError(err).Warningf("Failed to append %d rows", len(messages))
+	}
+
+	prod.Logger.WithError(err).Errorf("Failed to append %d rows, sending to fallback", len(messages))
+	for _, msg := range messages {
+		prod.TryFallback(msg)
+	}
+}
+
+func (prod *Snowflake) sendBatch(messages []*core.Message) {
+	if prod.privateKey == nil {
+		for _, msg := range messages {
+			prod.TryFallback(msg)
+		}
+		return // ### return, not configured ###
+	}
+
+	streamRows := make(map[core.MessageStreamID]*bytes.Buffer)
+	streamMessages := make(map[core.MessageStreamID][]*core.Message)
+
+	for _, msg := range messages {
+		row, err := prod.toRow(msg)
+		if err != nil {
+			prod.Logger.WithError(err).Error("Failed to convert message to a row")
+			prod.TryFallback(msg)
+			continue
+		}
+
+		streamID := msg.GetStreamID()
+		buffer, exists := streamRows[streamID]
+		if !exists {
+			buffer = new(bytes.Buffer)
+			streamRows[streamID] = buffer
+		}
+		buffer.Write(bytes.TrimSpace(row))
+		buffer.WriteByte('\n')
+		streamMessages[streamID] = append(streamMessages[streamID], msg)
+	}
+
+	// Continuation tokens require appends to a channel to be serialized
+	prod.channelGuard.Lock()
+	defer prod.channelGuard.Unlock()
+
+	for streamID, buffer := range streamRows {
+		prod.appendWithRetry(streamID, buffer.Bytes(), streamMessages[streamID])
+	}
+}
+
+// Produce writes to Snowflake.
+func (prod *Snowflake) Produce(workers *sync.WaitGroup) {
+	prod.BatchMessageLoop(workers, func() core.AssemblyFunc { return prod.sendBatch })
+}
@@ -26,7 +26,6 @@ import (
 	"time"
 
 	"github.com/trivago/gollum/core"
-	"github.com/trivago/tgo"
 	"github.com/trivago/tgo/tio"
 	"github.com/trivago/tgo/tmath"
 	"github.com/trivago/tgo/tstrings"
@@ -43,6 +42,8 @@ type spoolFile struct {
 	source      core.MessageSource
 	readCount   int64
 	writeCount  int64
+	readMetric  *core.Counter
+	writeMetric *core.Counter
 	readWorker  *sync.WaitGroup
 	roll        chan struct{}
 	reader      *tio.BufferedReader
@@ -66,13 +67,17 @@ func newSpoolFile(prod *Spooling, streamName string, source core.MessageSource)
 		roll:        make(chan struct{}, 1),
 	}
 
-	writeMetric := spoolingMetricWrite + streamName
-	tgo.Metric.New(writeMetric)
-	tgo.Metric.NewRate(writeMetric, spoolingMetricWriteSec+streamName, time.Second, 10, 3, true)
-
-	readMetric := spoolingMetricRead + streamName
-	tgo.Metric.New(readMetric)
-	tgo.Metric.NewRate(readMetric, spoolingMetricReadSec+streamName, time.Second, 10, 3, true)
+	spool.writeMetric = core.NewLegacyCounter("spooling_messages", core.MetricLabels{
+		"plugin_id": prod.GetID(),
+		"stream":    streamName,
+		"direction": "write",
+	}, spoolingMetricWrite+streamName, spoolingMetricWriteSec+streamName)
+
+	spool.readMetric = core.NewLegacyCounter("spooling_messages", core.MetricLabels{
+		"plugin_id": prod.GetID(),
+		"stream":    streamName,
+		"direction": "read",
+	}, spoolingMetricRead+streamName, spoolingMetricReadSec+streamName)
 	go spool.read()
 	return spool
 }
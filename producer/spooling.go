@@ -23,7 +23,6 @@ import (
 
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/gollum/core/components"
-	"github.com/trivago/tgo"
 )
 
 // Spooling producer
@@ -210,8 +209,8 @@ func (prod *Spooling) flush(force bool) {
 	for _, spool := range outfiles {
 		read, write := spool.getAndResetCounts()
 
-		tgo.Metric.Add(spoolingMetricRead+spool.streamName, read)
-		tgo.Metric.Add(spoolingMetricWrite+spool.streamName, write)
+		spool.readMetric.Add(read)
+		spool.writeMetric.Add(write)
 
 		if force || spool.batch.ReachedSizeThreshold(prod.batchMaxCount/2) || spool.batch.ReachedTimeThreshold(prod.batchTimeout) {
 			spool.flush()
@@ -0,0 +1,376 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tcontainer"
+)
+
+// Statsd producer plugin
+//
+// This producer derives metrics from the content of messages and sends them
+// to statsd or DogStatsD. Each configured metric can count matching messages
+// or emit the numeric value of a JSON field as counter, gauge, timer,
+// histogram, distribution or set. Metric lines are collected into packets that
+// are sent at least once per flush interval.
+//
+// Parameters
+//
+// - Address: Defines the host and port of the statsd server.
+// By default this parameter is set to "localhost:8125".
+//
+// - Network: Defines the network to use. Valid values are "udp", "tcp" and
+// "unixgram".
+// By default this parameter is set to "udp".
+//
+// - Prefix: Defines a string that is prepended to every metric name.
+// By default this parameter is set to "gollum.".
+//
+// - DogStatsD: Enables DogStatsD tags. If set to false, tags are not sent.
+// By default this parameter is set to false.
+//
+// - GlobalTags: Defines a map of tags added to every metric. Requires
+// DogStatsD.
+// By default this parameter is set to an empty list.
+//
+// - FlushIntervalMs: Defines the maximum number of milliseconds metric lines
+// are buffered before they are sent.
+// By default this parameter is set to 1000.
+//
+// - MaxPacketSize: Defines the maximum size of a packet in bytes.
+// By default this parameter is set to 1432.
+//
+// - Metrics: Defines a map of metric names to metric definitions. A metric
+// name may contain placeholders of the form "{path}" that are replaced by the
+// value of the given JSON field. Each definition supports the following keys.
+// "Type" is one of "counter", "gauge", "timer", "histogram", "distribution"
+// or "set" and defaults to "counter".
+// "Field" is the path of the JSON field holding the value. If not set,
+// counters are incremented by one and other types are skipped.
+// "Match" is a regular expression that has to match the payload.
+// "SampleRate" is a ratio between 0 and 1 used to sample counters, timers,
+// histograms and distributions.
+// "Tags" is a map of tag names to JSON field paths. Requires DogStatsD.
+// By default this parameter is set to an empty list.
+//
+// Examples
+//
+// This example counts HTTP responses by status and reports request durations
+// from JSON encoded access logs:
+//
+//  AccessMetrics:
+//    Type: producer.Statsd
+//    Streams: access_log
+//    Address: "localhost:8125"
+//    Prefix: "web."
+//    DogStatsD: true
+//    Metrics:
+//      "responses.{status}":
+//        Type: counter
+//      "request.duration":
+//        Type: timer
+//        Field: duration_ms
+//        SampleRate: 0.1
+//        Tags:
+//          method: request/method
+//      "errors":
+//        Match: "\"level\":\"error\""
+type Statsd struct {
+	core.BufferedProducer `gollumdoc:"embed_type"`
+	address               string        `config:"Address" default:"localhost:8125"`
+	network               string        `config:"Network" default:"udp"`
+	prefix                string        `config:"Prefix" default:"gollum."`
+	dogStatsD             bool          `config:"DogStatsD" default:"false"`
+	flushInterval         time.Duration `config:"FlushIntervalMs" default:"1000" metric:"ms"`
+	maxPacketSize         int           `config:"MaxPacketSize" default:"1432"`
+	globalTags            []string
+	metrics               []statsdMetric
+	conn                  net.Conn
+	packet                bytes.Buffer
+	packetGuard           *sync.Mutex
+	lastFlush             time.Time
+}
+
+// statsdMetric holds the definition of a metric derived from messages.
+type statsdMetric struct {
+	name       string
+	typeSuffix string
+	field      string
+	match      *regexp.Regexp
+	sampleRate float64
+	tags       map[string]string
+}
+
+var (
+	statsdTypes = map[string]string{
+		"counter":      "c",
+		"gauge":        "g",
+		"timer":        "ms",
+		"histogram":    "h",
+		"distribution": "d",
+		"set":          "s",
+	}
+	statsdPlaceholder = regexp.MustCompile(`\{([^}]+)\}`)
+	statsdSanitizer   = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+)
+
+func init() {
+	core.TypeRegistry.Register(Statsd{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Statsd) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+	prod.packetGuard = new(sync.Mutex)
+	prod.lastFlush = time.Now()
+
+	globalTags := conf.GetStringMap("GlobalTags", map[string]string{})
+	for _, key := range sortedKeys(globalTags) {
+		prod.globalTags = append(prod.globalTags, statsdSanitizer.Replace(key)+":"+statsdSanitizer.Replace(globalTags[key]))
+	}
+
+	switch prod.network {
+	case "udp", "tcp", "unixgram":
+	default:
+		conf.Errors.Pushf("Network must be one of udp, tcp or unixgram")
+	}
+
+	metrics := conf.GetMap("Metrics", tcontainer.NewMarshalMap())
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		settings, err := metrics.MarshalMap(name)
+		if err != nil {
+			conf.Errors.Pushf("Metric %s must be a map", name)
+			continue
+		}
+		if metric, err := prod.newMetric(name, settings); !conf.Errors.Push(err) {
+			prod.metrics = append(prod.metrics, metric)
+		}
+	}
+
+	if !prod.dogStatsD && len(prod.globalTags) > 0 {
+		prod.Logger.Warning("GlobalTags require DogStatsD and will not be sent")
+	}
+}
+
+func (prod *Statsd) newMetric(name string, settings tcontainer.MarshalMap) (statsdMetric, error) {
+	metric := statsdMetric{
+		name:       name,
+		sampleRate: 1,
+		tags:       map[string]string{},
+	}
+
+	metricType, _ := settings.String("Type")
+	if metricType == "" {
+		metricType = "counter"
+	}
+	typeSuffix, known := statsdTypes[strings.ToLower(metricType)]
+	if !known {
+		return metric, fmt.Errorf("Metric %s has an unknown type: %s", name, metricType)
+	}
+	metric.typeSuffix = typeSuffix
+
+	metric.field, _ = settings.String("Field")
+
+	if match, _ := settings.String("Match"); match != "" {
+		expression, err := regexp.Compile(match)
+		if err != nil {
+			return metric, fmt.Errorf("Metric %s has an invalid match expression: %s", name, err)
+		}
+		metric.match = expression
+	}
+
+	if sampleRate, err := settings.Float("SampleRate"); err == nil {
+		if sampleRate <= 0 || sampleRate > 1 {
+			return metric, fmt.Errorf("Metric %s must have a sample rate between 0 and 1", name)
+		}
+		metric.sampleRate = sampleRate
+	}
+
+	if tags, err := settings.StringMap("Tags"); err == nil {
+		metric.tags = tags
+	}
+
+	return metric, nil
+}
+
+// Produce sends metrics derived from messages to statsd.
+func (prod *Statsd) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	prod.TickerMessageControlLoop(prod.processMessage, prod.flushInterval, prod.flushOnTimeOut)
+}
+
+func statsdFieldString(fields tcontainer.MarshalMap, path string) (string, bool) {
+	value, found := fields.Value(path)
+	if !found || value == nil {
+		return "", false
+	}
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue, true
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64), true
+	default:
+		return fmt.Sprintf("%v", typedValue), true
+	}
+}
+
+// formatLine renders the statsd line of a metric for the given message
+// fields. If the metric does not apply, false is returned.
+func (prod *Statsd) formatLine(metric statsdMetric, fields tcontainer.MarshalMap) (string, bool) {
+	value := "1"
+	if metric.field != "" {
+		fieldValue, found := statsdFieldString(fields, metric.field)
+		if !found {
+			return "", false
+		}
+		if metric.typeSuffix != "s" {
+			if _, err := strconv.ParseFloat(fieldValue, 64); err != nil {
+				return "", false
+			}
+		}
+		value = statsdSanitizer.Replace(fieldValue)
+	} else if metric.typeSuffix != "c" {
+		return "", false
+	}
+
+	name := statsdPlaceholder.ReplaceAllStringFunc(metric.name, func(placeholder string) string {
+		fieldValue, _ := statsdFieldString(fields, placeholder[1:len(placeholder)-1])
+		if fieldValue == "" {
+			fieldValue = "unknown"
+		}
+		return statsdSanitizer.Replace(fieldValue)
+	})
+
+	line := bytes.Buffer{}
+	fmt.Fprintf(&line, "%s%s:%s|%s", prod.prefix, name, value, metric.typeSuffix)
+
+	if metric.sampleRate < 1 {
+		fmt.Fprintf(&line, "|@%s", strconv.FormatFloat(metric.sampleRate, 'f', -1, 64))
+	}
+
+	if prod.dogStatsD {
+		tags := append([]string{}, prod.globalTags...)
+		for _, tag := range sortedKeys(metric.tags) {
+			if tagValue, found := statsdFieldString(fields, metric.tags[tag]); found {
+				tags = append(tags, statsdSanitizer.Replace(tag)+":"+statsdSanitizer.Replace(tagValue))
+			}
+		}
+		if len(tags) > 0 {
+			line.WriteString("|#")
+			line.WriteString(strings.Join(tags, ","))
+		}
+	}
+
+	return line.String(), true
+}
+
+func (prod *Statsd) processMessage(msg *core.Message) {
+	fields := tcontainer.NewMarshalMap()
+	json.Unmarshal(msg.GetPayload(), &fields)
+
+	for _, metric := range prod.metrics {
+		if metric.match != nil && !metric.match.Match(msg.GetPayload()) {
+			continue // ### continue, no match ###
+		}
+		if metric.sampleRate < 1 && metric.typeSuffix != "g" && metric.typeSuffix != "s" && rand.Float64() >= metric.sampleRate {
+			continue // ### continue, not sampled ###
+		}
+		if line, applies := prod.formatLine(metric, fields); applies {
+			prod.appendLine(line)
+		}
+	}
+}
+
+func (prod *Statsd) appendLine(line string) {
+	prod.packetGuard.Lock()
+	defer prod.packetGuard.Unlock()
+
+	if prod.packet.Len() > 0 && prod.packet.Len()+len(line)+1 > prod.maxPacketSize {
+		prod.flush()
+	}
+	if prod.packet.Len() > 0 {
+		prod.packet.WriteByte('\n')
+	}
+	prod.packet.WriteString(line)
+}
+
+func (prod *Statsd) flushOnTimeOut() {
+	prod.packetGuard.Lock()
+	defer prod.packetGuard.Unlock()
+
+	if time.Since(prod.lastFlush) >= prod.flushInterval {
+		prod.flush()
+	}
+}
+
+// flush sends the current packet. The caller has to hold packetGuard.
+func (prod *Statsd) flush() {
+	prod.lastFlush = time.Now()
+	if prod.packet.Len() == 0 {
+		return // ### return, nothing to send ###
+	}
+	defer prod.packet.Reset()
+
+	if prod.conn == nil {
+		conn, err := net.Dial(prod.network, prod.address)
+		if err != nil {
+			prod.Logger.WithError(err).Error("Failed to connect to statsd")
+			return // ### return, metrics are lost ###
+		}
+		prod.conn = conn
+	}
+
+	// Stream connections require a terminating newline
+	if prod.network == "tcp" {
+		prod.packet.WriteByte('\n')
+	}
+
+	if _, err := prod.conn.Write(prod.packet.Bytes()); err != nil {
+		prod.Logger.WithError(err).Error("Failed to send metrics")
+		prod.conn.Close()
+		prod.conn = nil
+	}
+}
+
+func (prod *Statsd) close() {
+	defer prod.WorkerDone()
+	prod.DefaultClose()
+
+	prod.packetGuard.Lock()
+	defer prod.packetGuard.Unlock()
+	prod.flush()
+	if prod.conn != nil {
+		prod.conn.Close()
+	}
+}
@@ -0,0 +1,468 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/core/components"
+	"github.com/trivago/tgo/tmath"
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"ntp":      12,
+	"security": 13,
+	"console":  14,
+	"clock":    15,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg":         0,
+	"emergency":     0,
+	"panic":         0,
+	"alert":         1,
+	"crit":          2,
+	"critical":      2,
+	"fatal":         2,
+	"err":           3,
+	"error":         3,
+	"warn":          4,
+	"warning":       4,
+	"notice":        5,
+	"info":          6,
+	"informational": 6,
+	"debug":         7,
+	"trace":         7,
+}
+
+// Syslog producer plugin
+//
+// The syslog producer sends messages to a syslog server over TCP, optionally
+// secured by TLS. Messages are formatted according to RFC5424 or the legacy
+// BSD format described in RFC3164. Messages are buffered while the connection
+// is down and the connection is reestablished with the next batch.
+//
+// Parameters
+//
+// - Address: Defines the host and port of the syslog server.
+// By default this parameter is set to "localhost:514".
+//
+// - Format: Defines the message format. Valid values are "RFC5424" and
+// "RFC3164".
+// By default this parameter is set to "RFC5424".
+//
+// - Framing: Defines how messages are separated on the stream. Valid values
+// are "octet" for octet counting as described in RFC6587 and "newline" for
+// non-transparent framing using a line feed.
+// By default this parameter is set to "octet".
+//
+// - Facility: Defines the facility to use if FacilityFrom is not set or the
+// metadata field is missing. Facilities can be given as name (e.g. "local0")
+// or as number.
+// By default this parameter is set to "user".
+//
+// - Severity: Defines the severity to use if SeverityFrom is not set or the
+// metadata field is missing. Severities can be given as name (e.g. "warning")
+// or as number.
+// By default this parameter is set to "info".
+//
+// - FacilityFrom: Defines a metadata field to read the facility from.
+// By default this parameter is set to "".
+//
+// - SeverityFrom: Defines a metadata field to read the severity from.
+// By default this parameter is set to "".
+//
+// - Hostname: Defines the host name sent with each message. If empty, the
+// host name of the machine is used.
+// By default this parameter is set to "".
+//
+// - AppName: Defines the application name (or tag for RFC3164) sent with each
+// message.
+// By default this parameter is set to "gollum".
+//
+// - AppNameFrom: Defines a metadata field to read the application name from.
+// If the field is missing, AppName is used.
+// By default this parameter is set to "".
+//
+// - MsgIDFrom: Defines a metadata field to read the RFC5424 message ID from.
+// By default this parameter is set to "".
+//
+// - StructuredData/ID: Defines the ID of the RFC5424 structured data element
+// holding the metadata fields given by StructuredData/Fields.
+// By default this parameter is set to "meta@32473".
+//
+// - StructuredData/Fields: Defines a list of metadata fields to send as RFC5424
+// structured data parameters.
+// By default this parameter is set to an empty list.
+//
+// - ConnectTimeoutMs: Defines the time in milliseconds to wait for a
+// connection to be established.
+// By default this parameter is set to 2000.
+//
+// - TlsEnable: Enables TLS. See core/components.NewTLSClientConfig for the
+// TLS settings TlsKeyLocation, TlsCertificateLocation, TlsCaLocation,
+// TlsServerName and TlsInsecureSkipVerify.
+// By default this parameter is set to false.
+//
+// - Batch/MaxCount: Defines the maximum number of messages that can be
+// buffered, e.g. while the server is not reachable.
+// By default this parameter is set to 8192.
+//
+// - Batch/FlushCount: Defines the number of messages to be buffered before
+// they are sent. This setting is clamped to Batch/MaxCount.
+// By default this parameter is set to 4096.
+//
+// - Batch/TimeoutSec: Defines the maximum number of seconds to wait after the
+// last message arrived before a batch is sent.
+// By default this parameter is set to 1.
+//
+// Examples
+//
+// This example forwards messages to a SIEM collector using mutual TLS:
+//
+//  SyslogOut:
+//    Type: producer.Syslog
+//    Streams: audit
+//    Address: "siem.example.com:6514"
+//    Facility: local4
+//    SeverityFrom: level
+//    TlsEnable: true
+//    TlsCaLocation: /etc/ssl/siem-ca.pem
+//    TlsCertificateLocation: /etc/ssl/gollum.pem
+//    TlsKeyLocation: /etc/ssl/gollum.key
+//
+type Syslog struct {
+	core.BufferedProducer `gollumdoc:"embed_type"`
+	address               string        `config:"Address" default:"localhost:514"`
+	format                string        `config:"Format" default:"RFC5424"`
+	framing               string        `config:"Framing" default:"octet"`
+	facilityFrom          string        `config:"FacilityFrom"`
+	severityFrom          string        `config:"SeverityFrom"`
+	hostname              string        `config:"Hostname"`
+	appName               string        `config:"AppName" default:"gollum"`
+	appNameFrom           string        `config:"AppNameFrom"`
+	msgIDFrom             string        `config:"MsgIDFrom"`
+	sdID                  string        `config:"StructuredData/ID" default:"meta@32473"`
+	sdFields              []string      `config:"StructuredData/Fields"`
+	connectTimeout        time.Duration `config:"ConnectTimeoutMs" default:"2000" metric:"ms"`
+	tlsEnable             bool          `config:"TlsEnable" default:"false"`
+	batchTimeout          time.Duration `config:"Batch/TimeoutSec" default:"1" metric:"sec"`
+	batchMaxCount         int           `config:"Batch/MaxCount" default:"8192"`
+	batchFlushCount       int           `config:"Batch/FlushCount" default:"4096"`
+	facility              int
+	severity              int
+	procID                string
+	tlsConfig             *tls.Config
+	connection            net.Conn
+	batch                 core.MessageBatch
+}
+
+func init() {
+	core.TypeRegistry.Register(Syslog{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Syslog) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+
+	prod.batchFlushCount = tmath.MinI(prod.batchFlushCount, prod.batchMaxCount)
+	prod.batch = core.NewMessageBatch(prod.batchMaxCount)
+	prod.procID = strconv.Itoa(os.Getpid())
+
+	var valid bool
+	if prod.facility, valid = parseSyslogValue(conf.GetString("Facility", "user"), syslogFacilities, 23); !valid {
+		conf.Errors.Pushf("Unknown syslog facility")
+	}
+	if prod.severity, valid = parseSyslogValue(conf.GetString("Severity", "info"), syslogSeverities, 7); !valid {
+		conf.Errors.Pushf("Unknown syslog severity")
+	}
+
+	prod.format = strings.ToUpper(prod.format)
+	if prod.format != "RFC5424" && prod.format != "RFC3164" {
+		conf.Errors.Pushf("Format must be either RFC5424 or RFC3164")
+	}
+
+	prod.framing = strings.ToLower(prod.framing)
+	if prod.framing != "octet" && prod.framing != "newline" {
+		conf.Errors.Pushf("Framing must be either octet or newline")
+	}
+
+	if prod.hostname == "" {
+		if hostname, err := os.Hostname(); err == nil {
+			prod.hostname = hostname
+		} else {
+			prod.hostname = "-"
+		}
+	}
+
+	if prod.tlsEnable {
+		tlsConfig, err := components.NewTLSClientConfig(conf)
+		conf.Errors.Push(err)
+		prod.tlsConfig = tlsConfig
+	}
+}
+
+// parseSyslogValue converts a facility or severity given by name or number.
+func parseSyslogValue(value string, names map[string]int, max int) (int, bool) {
+	if number, err := strconv.Atoi(value); err == nil {
+		return number, number >= 0 && number <= max
+	}
+	number, known := names[strings.ToLower(value)]
+	return number, known
+}
+
+func (prod *Syslog) getMetadataValue(msg *core.Message, key string, defaultValue string) string {
+	if key != "" {
+		if metadata := msg.TryGetMetadata(); metadata != nil {
+			if value, exists := metadata.TryGetValueString(key); exists && value != "" {
+				return value
+			}
+		}
+	}
+	return defaultValue
+}
+
+func (prod *Syslog) getPriority(msg *core.Message) int {
+	facility, severity := prod.facility, prod.severity
+	if value := prod.getMetadataValue(msg, prod.facilityFrom, ""); value != "" {
+		if parsed, valid := parseSyslogValue(value, syslogFacilities, 23); valid {
+			facility = parsed
+		}
+	}
+	if value := prod.getMetadataValue(msg, prod.severityFrom, ""); value != "" {
+		if parsed, valid := parseSyslogValue(value, syslogSeverities, 7); valid {
+			severity = parsed
+		}
+	}
+	return facility*8 + severity
+}
+
+// syslogHeaderValue converts a value to a RFC5424 header field, i.e. a
+// printable US-ASCII string without spaces of the given maximum length.
+func syslogHeaderValue(value string, maxLen int) string {
+	if value == "" {
+		return "-"
+	}
+	cleaned := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(cleaned) > maxLen {
+		return cleaned[:maxLen]
+	}
+	return cleaned
+}
+
+func (prod *Syslog) writeStructuredData(buffer *bytes.Buffer, msg *core.Message) {
+	metadata := msg.TryGetMetadata()
+	if len(prod.sdFields) == 0 || metadata == nil {
+		buffer.WriteByte('-')
+		return
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	written := false
+	for _, key := range prod.sdFields {
+		value, exists := metadata.TryGetValueString(key)
+		if !exists {
+			continue
+		}
+		if !written {
+			buffer.WriteByte('[')
+			buffer.WriteString(prod.sdID)
+			written = true
+		}
+		buffer.WriteByte(' ')
+		buffer.WriteString(syslogHeaderValue(strings.Replace(key, "=", "_", -1), 32))
+		buffer.WriteString(`="`)
+		buffer.WriteString(escaper.Replace(value))
+		buffer.WriteByte('"')
+	}
+
+	if written {
+		buffer.WriteByte(']')
+	} else {
+		buffer.WriteByte('-')
+	}
+}
+
+// formatMessage returns the syslog representation of the given message
+// without framing.
+func (prod *Syslog) formatMessage(msg *core.Message) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, len(msg.GetPayload())+128))
+	appName := prod.getMetadataValue(msg, prod.appNameFrom, prod.appName)
+	timestamp := msg.GetCreationTime()
+
+	buffer.WriteByte('<')
+	buffer.WriteString(strconv.Itoa(prod.getPriority(msg)))
+	buffer.WriteByte('>')
+
+	if prod.format == "RFC3164" {
+		buffer.WriteString(timestamp.Format(time.Stamp))
+		buffer.WriteByte(' ')
+		buffer.WriteString(syslogHeaderValue(prod.hostname, 255))
+		buffer.WriteByte(' ')
+		buffer.WriteString(syslogHeaderValue(appName, 32))
+		buffer.WriteString("[" + prod.procID + "]: ")
+	} else {
+		buffer.WriteString("1 ")
+		buffer.WriteString(timestamp.Format("2006-01-02T15:04:05.000000Z07:00"))
+		buffer.WriteByte(' ')
+		buffer.WriteString(syslogHeaderValue(prod.hostname, 255))
+		buffer.WriteByte(' ')
+		buffer.WriteString(syslogHeaderValue(appName, 48))
+		buffer.WriteByte(' ')
+		buffer.WriteString(prod.procID)
+		buffer.WriteByte(' ')
+		buffer.WriteString(syslogHeaderValue(prod.getMetadataValue(msg, prod.msgIDFrom, ""), 32))
+		buffer.WriteByte(' ')
+		prod.writeStructuredData(buffer, msg)
+		buffer.WriteByte(' ')
+	}
+
+	buffer.Write(bytes.TrimRight(msg.GetPayload(), "\r\n"))
+	return buffer.Bytes()
+}
+
+func (prod *Syslog) tryConnect() bool {
+	if prod.connection != nil {
+		return true // ### return, connection active ###
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	dialer := &net.Dialer{Timeout: prod.connectTimeout}
+	if prod.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", prod.address, prod.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", prod.address)
+	}
+
+	if err != nil {
+		prod.Logger.Error("Connection error: ", err)
+		return false // ### return, connection failed ###
+	}
+
+	prod.connection = conn
+	return true
+}
+
+func (prod *Syslog) closeConnection() error {
+	if prod.connection != nil {
+		prod.connection.Close()
+		prod.connection = nil
+	}
+	return nil
+}
+
+func (prod *Syslog) writeBatch(messages []*core.Message) {
+	buffer := bytes.Buffer{}
+	for _, msg := range messages {
+		frame := prod.formatMessage(msg)
+		if prod.framing == "octet" {
+			buffer.WriteString(strconv.Itoa(len(frame)))
+			buffer.WriteByte(' ')
+			buffer.Write(frame)
+		} else {
+			buffer.Write(frame)
+			buffer.WriteByte('\n')
+		}
+	}
+
+	if _, err := prod.connection.Write(buffer.Bytes()); err != nil {
+		prod.Logger.Error("Write error: ", err)
+		prod.closeConnection()
+		prod.dropBatch(messages)
+	}
+}
+
+func (prod *Syslog) dropBatch(messages []*core.Message) {
+	for _, msg := range messages {
+		prod.TryFallback(msg)
+	}
+}
+
+func (prod *Syslog) sendMessage(msg *core.Message) {
+	prod.batch.AppendOrFlush(msg, prod.sendBatch, prod.IsActiveOrStopping, prod.TryFallback)
+}
+
+func (prod *Syslog) sendBatch() {
+	// Messages stay in the batch until the connection is back
+	if prod.tryConnect() {
+		prod.batch.Flush(prod.writeBatch)
+	} else if prod.IsStopping() {
+		prod.batch.Flush(prod.dropBatch)
+	}
+}
+
+func (prod *Syslog) sendBatchOnTimeOut() {
+	if prod.batch.ReachedTimeThreshold(prod.batchTimeout) || prod.batch.ReachedSizeThreshold(prod.batchFlushCount) {
+		prod.sendBatch()
+	}
+}
+
+func (prod *Syslog) close() {
+	defer func() {
+		prod.batch.AfterFlushDo(prod.closeConnection)
+		prod.WorkerDone()
+	}()
+
+	prod.DefaultClose()
+
+	if prod.tryConnect() {
+		prod.batch.Close(prod.writeBatch, prod.GetShutdownTimeout())
+	} else {
+		prod.batch.Close(prod.dropBatch, prod.GetShutdownTimeout())
+	}
+}
+
+// Produce writes to a buffer that is sent to the syslog server.
+func (prod *Syslog) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	prod.TickerMessageControlLoop(prod.sendMessage, prod.batchTimeout, prod.sendBatchOnTimeOut)
+}
@@ -0,0 +1,207 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tmath"
+)
+
+// UnixSocket producer plugin
+//
+// The unix socket producer writes messages to a unix domain socket, e.g. to
+// feed local daemons. Messages are buffered while the socket is not available
+// and the producer reconnects with the next batch.
+//
+// Parameters
+//
+// - Path: Defines the path of the socket to connect to.
+// By default this parameter is set to "/var/run/gollum.sock".
+//
+// - Mode: Defines the socket type to use. Valid values are "stream" and
+// "datagram". In datagram mode every message is sent as a separate datagram.
+// By default this parameter is set to "stream".
+//
+// - LengthPrefix: When enabled, every message is prefixed by its length as
+// a 4 byte unsigned integer in network byte order. This is required to
+// separate messages in stream mode if the payload is not delimited otherwise.
+// By default this parameter is set to false.
+//
+// - ConnectTimeoutMs: Defines the time in milliseconds to wait for a
+// connection to be established.
+// By default this parameter is set to 1000.
+//
+// - Batch/MaxCount: Defines the maximum number of messages that can be
+// buffered, e.g. while the socket is not available.
+// By default this parameter is set to 8192.
+//
+// - Batch/FlushCount: Defines the number of messages to be buffered before
+// they are written. This setting is clamped to Batch/MaxCount.
+// By default this parameter is set to 4096.
+//
+// - Batch/TimeoutSec: Defines the maximum number of seconds to wait after the
+// last message arrived before a batch is written.
+// By default this parameter is set to 1.
+//
+// Examples
+//
+//  LocalDaemon:
+//    Type: producer.UnixSocket
+//    Streams: metrics
+//    Path: /run/collector/input.sock
+//    Mode: datagram
+type UnixSocket struct {
+	core.BufferedProducer `gollumdoc:"embed_type"`
+	path                  string        `config:"Path" default:"/var/run/gollum.sock"`
+	mode                  string        `config:"Mode" default:"stream"`
+	lengthPrefix          bool          `config:"LengthPrefix" default:"false"`
+	connectTimeout        time.Duration `config:"ConnectTimeoutMs" default:"1000" metric:"ms"`
+	batchTimeout          time.Duration `config:"Batch/TimeoutSec" default:"1" metric:"sec"`
+	batchMaxCount         int           `config:"Batch/MaxCount" default:"8192"`
+	batchFlushCount       int           `config:"Batch/FlushCount" default:"4096"`
+	network               string
+	connection            net.Conn
+	batch                 core.MessageBatch
+}
+
+func init() {
+	core.TypeRegistry.Register(UnixSocket{})
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *UnixSocket) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+
+	prod.batchFlushCount = tmath.MinI(prod.batchFlushCount, prod.batchMaxCount)
+	prod.batch = core.NewMessageBatch(prod.batchMaxCount)
+
+	switch prod.mode {
+	case "stream":
+		prod.network = "unix"
+	case "datagram":
+		prod.network = "unixgram"
+	default:
+		conf.Errors.Pushf("Mode must be either stream or datagram")
+	}
+}
+
+func (prod *UnixSocket) tryConnect() bool {
+	if prod.connection != nil {
+		return true // ### return, connection active ###
+	}
+
+	conn, err := net.DialTimeout(prod.network, prod.path, prod.connectTimeout)
+	if err != nil {
+		prod.Logger.Error("Connection error: ", err)
+		return false // ### return, connection failed ###
+	}
+
+	prod.connection = conn
+	return true
+}
+
+func (prod *UnixSocket) closeConnection() error {
+	if prod.connection != nil {
+		prod.connection.Close()
+		prod.connection = nil
+	}
+	return nil
+}
+
+func (prod *UnixSocket) frame(payload []byte) []byte {
+	if !prod.lengthPrefix {
+		return payload
+	}
+	framed := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(framed, uint32(len(payload)))
+	return append(framed, payload...)
+}
+
+func (prod *UnixSocket) writeBatch(messages []*core.Message) {
+	if prod.network == "unixgram" {
+		for i, msg := range messages {
+			if _, err := prod.connection.Write(prod.frame(msg.GetPayload())); err != nil {
+				prod.Logger.Error("Write error: ", err)
+				prod.closeConnection()
+				prod.dropBatch(messages[i:])
+				return // ### return, write failed ###
+			}
+		}
+		return
+	}
+
+	buffer := bytes.Buffer{}
+	for _, msg := range messages {
+		buffer.Write(prod.frame(msg.GetPayload()))
+	}
+
+	if _, err := prod.connection.Write(buffer.Bytes()); err != nil {
+		prod.Logger.Error("Write error: ", err)
+		prod.closeConnection()
+		prod.dropBatch(messages)
+	}
+}
+
+func (prod *UnixSocket) dropBatch(messages []*core.Message) {
+	for _, msg := range messages {
+		prod.TryFallback(msg)
+	}
+}
+
+func (prod *UnixSocket) sendMessage(msg *core.Message) {
+	prod.batch.AppendOrFlush(msg, prod.sendBatch, prod.IsActiveOrStopping, prod.TryFallback)
+}
+
+func (prod *UnixSocket) sendBatch() {
+	// Messages stay in the batch until the socket is available
+	if prod.tryConnect() {
+		prod.batch.Flush(prod.writeBatch)
+	} else if prod.IsStopping() {
+		prod.batch.Flush(prod.dropBatch)
+	}
+}
+
+func (prod *UnixSocket) sendBatchOnTimeOut() {
+	if prod.batch.ReachedTimeThreshold(prod.batchTimeout) || prod.batch.ReachedSizeThreshold(prod.batchFlushCount) {
+		prod.sendBatch()
+	}
+}
+
+func (prod *UnixSocket) close() {
+	defer func() {
+		prod.batch.AfterFlushDo(prod.closeConnection)
+		prod.WorkerDone()
+	}()
+
+	prod.DefaultClose()
+
+	if prod.tryConnect() {
+		prod.batch.Close(prod.writeBatch, prod.GetShutdownTimeout())
+	} else {
+		prod.batch.Close(prod.dropBatch, prod.GetShutdownTimeout())
+	}
+}
+
+// Produce writes to a buffer that is sent to the unix socket.
+func (prod *UnixSocket) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	prod.TickerMessageControlLoop(prod.sendMessage, prod.batchTimeout, prod.sendBatchOnTimeOut)
+}
@@ -0,0 +1,419 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tcontainer"
+)
+
+// Webhook producer plugin
+//
+// This producer posts messages to chat webhooks like the ones provided by
+// Slack, Microsoft Teams or Discord and is intended to send alerts to humans.
+// Messages are rendered with a template and collected per channel. Messages
+// arriving within a short time window are coalesced into a single digest
+// post. Posts to a channel are rate limited. If the webhook itself rejects a
+// post with status 429 the channel is paused for the time requested by the
+// server.
+//
+// Parameters
+//
+// - URL: Defines the webhook URL to post to. Every "*" will be replaced by the
+// channel of the message.
+// By default this parameter is set to "http://localhost:8080/webhook".
+//
+// - Format: Defines the payload format. Valid values are "slack", "teams",
+// "discord" and "generic". The "generic" format posts a JSON object with the
+// fields "channel", "text" and "count".
+// By default this parameter is set to "slack".
+//
+// - Template: Defines the go template used to render a message. The fields
+// .Payload, .Stream, .Metadata (a map of strings), .Time and .Fields (the
+// payload parsed as JSON, if possible) are available.
+// By default this parameter is set to "{{.Payload}}".
+//
+// - Channel: Defines the default channel. For Slack this value is sent as the
+// channel to post to.
+// By default this parameter is set to "".
+//
+// - ChannelFrom: Defines a metadata key to read the channel from. If the key
+// is not set, Channel is used.
+// By default this parameter is set to "".
+//
+// - Username: Defines the name to post as, if supported by the service.
+// By default this parameter is set to "".
+//
+// - Digest/WindowSec: Defines the number of seconds to collect messages for a
+// channel before they are posted. Set to 0 to post messages as soon as the
+// rate limit allows.
+// By default this parameter is set to 10.
+//
+// - Digest/MaxMessages: Defines the maximum number of messages rendered into a
+// single digest. Additional messages are only counted.
+// By default this parameter is set to 20.
+//
+// - RateLimit/PerMin: Defines the maximum number of posts per channel and
+// minute. Messages are coalesced while the limit is reached. Set to 0 to
+// disable rate limiting.
+// By default this parameter is set to 20.
+//
+// - OnRateLimited: Defines what happens to a digest that has been rejected by
+// the service with status 429. Set to "drop" to discard the messages or to
+// "fallback" to send them to the fallback stream, e.g. to spool them.
+// By default this parameter is set to "drop".
+//
+// - TimeoutSec: Defines the timeout for a single post.
+// By default this parameter is set to 5.
+//
+// Examples
+//
+// This example posts errors to a Slack channel per service:
+//
+//  SlackAlerts:
+//    Type: producer.Webhook
+//    Streams: errors
+//    URL: "https://hooks.slack.com/services/T000/B000/XXXX"
+//    Format: slack
+//    ChannelFrom: team_channel
+//    Channel: "#alerts"
+//    Template: ":rotating_light: *{{.Fields.service}}*: {{.Fields.message}}"
+//    Digest:
+//      WindowSec: 30
+//    RateLimit:
+//      PerMin: 6
+//    OnRateLimited: fallback
+//    FallbackStream: alert_spool
+type Webhook struct {
+	core.BufferedProducer `gollumdoc:"embed_type"`
+	url                   string        `config:"URL" default:"http://localhost:8080/webhook"`
+	format                string        `config:"Format" default:"slack"`
+	channel               string        `config:"Channel"`
+	channelFrom           string        `config:"ChannelFrom"`
+	username              string        `config:"Username"`
+	digestWindow          time.Duration `config:"Digest/WindowSec" default:"10" metric:"sec"`
+	digestMaxMessages     int           `config:"Digest/MaxMessages" default:"20"`
+	rateLimit             int           `config:"RateLimit/PerMin" default:"20"`
+	onRateLimited         string        `config:"OnRateLimited" default:"drop"`
+	timeout               time.Duration `config:"TimeoutSec" default:"5" metric:"sec"`
+	template              *template.Template
+	digests               map[string]*webhookDigest
+	digestGuard           *sync.Mutex
+	client                http.Client
+}
+
+// webhookDigest collects the messages of a channel between two posts.
+type webhookDigest struct {
+	channel      string
+	messages     []*core.Message
+	lines        []string
+	count        int
+	firstMessage time.Time
+	tokens       float64
+	lastRefill   time.Time
+	blockedUntil time.Time
+}
+
+// webhookTemplateData is passed to the message template.
+type webhookTemplateData struct {
+	Payload  string
+	Stream   string
+	Metadata map[string]string
+	Fields   tcontainer.MarshalMap
+	Time     time.Time
+}
+
+type webhookError struct {
+	status     int
+	retryAfter time.Duration
+	message    string
+}
+
+func init() {
+	core.TypeRegistry.Register(Webhook{})
+}
+
+func (err webhookError) Error() string {
+	return fmt.Sprintf("post failed with status %d: %s", err.status, err.message)
+}
+
+// Configure initializes this producer with values from a plugin config.
+func (prod *Webhook) Configure(conf core.PluginConfigReader) {
+	prod.SetStopCallback(prod.close)
+	prod.digests = make(map[string]*webhookDigest)
+	prod.digestGuard = new(sync.Mutex)
+	prod.client.Timeout = prod.timeout
+
+	var err error
+	prod.template, err = template.New("Template").Parse(conf.GetString("Template", "{{.Payload}}"))
+	conf.Errors.Push(err)
+
+	prod.format = strings.ToLower(prod.format)
+	switch prod.format {
+	case "slack", "teams", "discord", "generic":
+	default:
+		conf.Errors.Pushf("Format must be one of slack, teams, discord or generic")
+	}
+
+	prod.onRateLimited = strings.ToLower(prod.onRateLimited)
+	if prod.onRateLimited != "drop" && prod.onRateLimited != "fallback" {
+		conf.Errors.Pushf("OnRateLimited must be either drop or fallback")
+	}
+
+	if prod.digestMaxMessages < 1 {
+		prod.digestMaxMessages = 1
+	}
+}
+
+// Produce posts messages to the webhook.
+func (prod *Webhook) Produce(workers *sync.WaitGroup) {
+	prod.AddMainWorker(workers)
+	prod.TickerMessageControlLoop(prod.collectMessage, time.Second, prod.postDigests)
+}
+
+func (prod *Webhook) render(msg *core.Message) string {
+	data := webhookTemplateData{
+		Payload:  msg.String(),
+		Stream:   core.StreamRegistry.GetStreamName(msg.GetStreamID()),
+		Metadata: make(map[string]string),
+		Time:     msg.GetCreationTime(),
+	}
+
+	if metadata := msg.TryGetMetadata(); metadata != nil {
+		for key, value := range metadata {
+			data.Metadata[key] = string(value)
+		}
+	}
+
+	if fields := tcontainer.NewMarshalMap(); json.Unmarshal(msg.GetPayload(), &fields) == nil {
+		data.Fields = fields
+	}
+
+	text := bytes.Buffer{}
+	if err := prod.template.Execute(&text, data); err != nil {
+		prod.Logger.WithError(err).Warning("Failed to render message, sending raw payload")
+		return msg.String()
+	}
+	return text.String()
+}
+
+func (prod *Webhook) collectMessage(msg *core.Message) {
+	channel := prod.channel
+	if prod.channelFrom != "" {
+		if metadata := msg.TryGetMetadata(); metadata != nil {
+			if value, exists := metadata.TryGetValueString(prod.channelFrom); exists {
+				channel = value
+			}
+		}
+	}
+
+	line := prod.render(msg)
+
+	prod.digestGuard.Lock()
+	digest, exists := prod.digests[channel]
+	if !exists {
+		digest = &webhookDigest{
+			channel:    channel,
+			tokens:     float64(prod.rateLimit),
+			lastRefill: time.Now(),
+		}
+		prod.digests[channel] = digest
+	}
+
+	if digest.count == 0 {
+		digest.firstMessage = time.Now()
+	}
+	if len(digest.lines) < prod.digestMaxMessages {
+		digest.lines = append(digest.lines, line)
+	}
+	digest.messages = append(digest.messages, msg)
+	digest.count++
+	prod.digestGuard.Unlock()
+
+	if prod.digestWindow == 0 {
+		prod.postDigests()
+	}
+}
+
+// takeReady removes the contents of all digests that can be posted and
+// returns them.
+func (prod *Webhook) takeReady(force bool) []webhookDigest {
+	prod.digestGuard.Lock()
+	defer prod.digestGuard.Unlock()
+
+	now := time.Now()
+	ready := []webhookDigest{}
+
+	for _, digest := range prod.digests {
+		if prod.rateLimit > 0 {
+			digest.tokens += now.Sub(digest.lastRefill).Minutes() * float64(prod.rateLimit)
+			if digest.tokens > float64(prod.rateLimit) {
+				digest.tokens = float64(prod.rateLimit)
+			}
+			digest.lastRefill = now
+		}
+
+		if digest.count == 0 {
+			continue // ### continue, nothing to send ###
+		}
+
+		if !force {
+			if now.Sub(digest.firstMessage) < prod.digestWindow || now.Before(digest.blockedUntil) {
+				continue // ### continue, keep collecting ###
+			}
+			if prod.rateLimit > 0 && digest.tokens < 1 {
+				continue // ### continue, rate limited ###
+			}
+		}
+
+		digest.tokens--
+		ready = append(ready, *digest)
+		digest.messages = nil
+		digest.lines = nil
+		digest.count = 0
+	}
+
+	return ready
+}
+
+func (prod *Webhook) postDigests() {
+	prod.postReady(false)
+}
+
+func (prod *Webhook) postReady(force bool) {
+	for _, digest := range prod.takeReady(force) {
+		err := prod.post(digest)
+		if err == nil {
+			continue // ### continue, done ###
+		}
+
+		logger := prod.Logger.WithField("channel", digest.channel)
+		if webhookErr, isWebhookErr := err.(webhookError); isWebhookErr && webhookErr.status == http.StatusTooManyRequests {
+			prod.digestGuard.Lock()
+			prod.digests[digest.channel].blockedUntil = time.Now().Add(webhookErr.retryAfter)
+			prod.digestGuard.Unlock()
+
+			logger.Warningf("Rate limited by webhook for %v", webhookErr.retryAfter)
+			if prod.onRateLimited == "drop" {
+				continue // ### continue, drop messages ###
+			}
+		} else {
+			logger.WithError(err).Error("Failed to post to webhook")
+		}
+
+		for _, msg := range digest.messages {
+			prod.TryFallback(msg)
+		}
+	}
+}
+
+func (prod *Webhook) digestText(digest webhookDigest) string {
+	if digest.count == 1 {
+		return digest.lines[0]
+	}
+
+	text := fmt.Sprintf("%d messages:\n%s", digest.count, strings.Join(digest.lines, "\n"))
+	if omitted := digest.count - len(digest.lines); omitted > 0 {
+		text += fmt.Sprintf("\n... and %d more", omitted)
+	}
+	return text
+}
+
+func (prod *Webhook) encodeBody(digest webhookDigest) ([]byte, error) {
+	text := prod.digestText(digest)
+	body := map[string]interface{}{}
+
+	switch prod.format {
+	case "slack":
+		body["text"] = text
+		if digest.channel != "" {
+			body["channel"] = digest.channel
+		}
+		if prod.username != "" {
+			body["username"] = prod.username
+		}
+
+	case "teams":
+		summary := strings.SplitN(text, "\n", 2)[0]
+		body["@type"] = "MessageCard"
+		body["@context"] = "https://schema.org/extensions"
+		body["summary"] = summary
+		body["text"] = strings.Replace(text, "\n", "\n\n", -1)
+
+	case "discord":
+		// Discord rejects messages longer than 2000 characters
+		if runes := []rune(text); len(runes) > 2000 {
+			text = string(runes[:1997]) + "..."
+		}
+		body["content"] = text
+		if prod.username != "" {
+			body["username"] = prod.username
+		}
+
+	default:
+		body["channel"] = digest.channel
+		body["text"] = text
+		body["count"] = digest.count
+	}
+
+	return json.Marshal(body)
+}
+
+func (prod *Webhook) post(digest webhookDigest) error {
+	body, err := prod.encodeBody(digest)
+	if err != nil {
+		return err
+	}
+
+	url := strings.Replace(prod.url, "*", digest.channel, -1)
+	resp, err := prod.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		return nil
+	}
+
+	message, _ := ioutil.ReadAll(resp.Body)
+	retryAfter := time.Minute
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+
+	return webhookError{
+		status:     resp.StatusCode,
+		retryAfter: retryAfter,
+		message:    strings.TrimSpace(string(message)),
+	}
+}
+
+func (prod *Webhook) close() {
+	defer prod.WorkerDone()
+	prod.DefaultClose()
+	prod.postReady(true)
+}
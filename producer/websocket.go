@@ -16,19 +16,28 @@ package producer
 
 import (
 	"net/http"
+	"regexp"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/trivago/gollum/core"
 	"github.com/trivago/tgo/tnet"
-	"github.com/trivago/tgo/tsync"
 )
 
 // Websocket producer plugin
 //
-// The websocket producer opens up a websocket.
+// The websocket producer opens up a websocket and broadcasts all messages to
+// the connected clients, e.g. to live-tail streams in a browser.
+// Clients can narrow down the messages they receive by passing the following
+// query parameters when connecting:
+//
+//  streams: A comma separated list of stream names to receive.
+//  filter:  A regular expression the payload has to match.
+//
+// Clients that cannot keep up with the message rate are disconnected as soon
+// as their send buffer is full so that they do not block other clients.
 //
 // Parameters
 //
@@ -46,6 +55,15 @@ import (
 // - IgnoreOrigin: Ignore origin check from websocket server.
 // By default this parameter is set to "false".
 //
+// - ClientBufferSize: This value defines the number of messages buffered per
+// client. Clients are disconnected if this buffer is full.
+// By default this parameter is set to "256".
+//
+// - WriteTimeoutMs: This value defines the maximum time in milliseconds to wait
+// for a message to be written to a client. Clients are disconnected if this
+// timeout is exceeded.
+// By default this parameter is set to "5000".
+//
 // Examples
 //
 // This example starts a default Websocket producer on port 8080:
@@ -54,21 +72,30 @@ import (
 //    Type: producer.Websocket
 //    Address: ":8080"
 //
+// Clients can connect to "ws://host:8080/?streams=errors,access&filter=timeout"
+// to only receive messages from the streams "errors" and "access" containing
+// the word "timeout".
+//
 type Websocket struct {
 	core.BufferedProducer `gollumdoc:"embed_type"`
 	listen                *tnet.StopListener
 	readTimeoutSec        time.Duration `config:"ReadTimeoutSec" default:"3" metric:"sec"`
+	writeTimeout          time.Duration `config:"WriteTimeoutMs" default:"5000" metric:"ms"`
+	clientBufferSize      int           `config:"ClientBufferSize" default:"256"`
 	upgrader              websocket.Upgrader
-	clients               [2]clientList
+	clientGuard           *sync.RWMutex
+	clients               map[*websocketClient]struct{}
 	address               string `config:"Address" default:":81"`
 	path                  string `config:"Path" default:"/"`
-	clientIdx             uint32
-	ignoreOrigin          bool `config:"IgnoreOrigin" default:"false"`
+	ignoreOrigin          bool   `config:"IgnoreOrigin" default:"false"`
 }
 
-type clientList struct {
-	conns     []*websocket.Conn
-	doneCount uint32
+type websocketClient struct {
+	conn      *websocket.Conn
+	streams   map[core.MessageStreamID]bool
+	filter    *regexp.Regexp
+	messages  chan []byte
+	closeOnce sync.Once
 }
 
 func init() {
@@ -80,74 +107,105 @@ func (prod *Websocket) Configure(conf core.PluginConfigReader) {
 	prod.SetStopCallback(prod.close)
 
 	prod.upgrader = websocket.Upgrader{}
+	prod.clientGuard = new(sync.RWMutex)
+	prod.clients = make(map[*websocketClient]struct{})
 
 	if prod.ignoreOrigin {
 		prod.upgrader.CheckOrigin = func(r *http.Request) bool { return prod.ignoreOrigin }
 	}
 }
 
-func (prod *Websocket) handleConnection(conn *websocket.Conn) {
-	idx := atomic.AddUint32(&prod.clientIdx, 1) >> 31
+// accepts returns true if the client wants to receive the given message.
+func (client *websocketClient) accepts(msg *core.Message) bool {
+	if len(client.streams) > 0 && !client.streams[msg.GetStreamID()] {
+		return false
+	}
+	return client.filter == nil || client.filter.Match(msg.GetPayload())
+}
+
+func (prod *Websocket) removeClient(client *websocketClient) {
+	client.closeOnce.Do(func() {
+		prod.clientGuard.Lock()
+		delete(prod.clients, client)
+		prod.clientGuard.Unlock()
+
+		close(client.messages)
+		client.conn.Close()
+	})
+}
+
+func (prod *Websocket) writeToClient(client *websocketClient) {
+	for payload := range client.messages {
+		client.conn.SetWriteDeadline(time.Now().Add(prod.writeTimeout))
+		if err := client.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+			prod.Logger.Debug("Websocket client write failed: ", err)
+			client.conn.Close()
+			break
+		}
+	}
+}
+
+func (prod *Websocket) handleConnection(conn *websocket.Conn, query map[string][]string) {
+	client := &websocketClient{
+		conn:     conn,
+		streams:  make(map[core.MessageStreamID]bool),
+		messages: make(chan []byte, prod.clientBufferSize),
+	}
+
+	for _, streams := range query["streams"] {
+		for _, stream := range strings.Split(streams, ",") {
+			if stream = strings.TrimSpace(stream); stream != "" {
+				client.streams[core.StreamRegistry.GetStreamID(stream)] = true
+			}
+		}
+	}
 
-	prod.clients[idx].conns = append(prod.clients[idx].conns, conn)
-	prod.clients[idx].doneCount++
+	if filter := query["filter"]; len(filter) > 0 && filter[0] != "" {
+		expr, err := regexp.Compile(filter[0])
+		if err != nil {
+			conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "invalid filter: "+err.Error()))
+			conn.Close()
+			return // ### return, invalid filter ###
+		}
+		client.filter = expr
+	}
+
+	prod.clientGuard.Lock()
+	prod.clients[client] = struct{}{}
+	prod.clientGuard.Unlock()
+
+	go prod.writeToClient(client)
 	conn.SetReadDeadline(time.Time{})
 
 	// Keep alive until connection is closed
 	for {
 		if _, _, err := conn.ReadMessage(); err != nil {
-			conn.Close()
+			prod.removeClient(client)
 			break
 		}
 	}
 }
 
 func (prod *Websocket) pushMessage(msg *core.Message) {
-	if prod.clientIdx&0x7FFFFFFF > 0 {
-		// There are new clients available
-		currentIdx := prod.clientIdx >> 31
-		activeIdx := (currentIdx + 1) & 1
-
-		// Store away the current client list and reset it
-		activeConns := &prod.clients[activeIdx]
-		oldConns := activeConns.conns
-		activeConns.conns = activeConns.conns[:]
-		activeConns.doneCount = 0
-
-		// Switch new and current client list
-		if currentIdx == 0 {
-			currentIdx = atomic.SwapUint32(&prod.clientIdx, 1<<31)
-		} else {
-			currentIdx = atomic.SwapUint32(&prod.clientIdx, 0)
-		}
-
-		// Wait for new list writer to finish
-		count := currentIdx & 0x7FFFFFFF
-		currentIdx = currentIdx >> 31
-		spin := tsync.NewSpinner(tsync.SpinPriorityHigh)
+	var slowClients []*websocketClient
 
-		for prod.clients[currentIdx].doneCount != count {
-			spin.Yield()
+	prod.clientGuard.RLock()
+	for client := range prod.clients {
+		if !client.accepts(msg) {
+			continue
+		}
+		select {
+		case client.messages <- msg.GetPayload():
+		default:
+			slowClients = append(slowClients, client)
 		}
-
-		// Add new connections to old connections
-		newConns := &prod.clients[currentIdx]
-		newConns.conns = append(oldConns, newConns.conns...)
 	}
+	prod.clientGuard.RUnlock()
 
-	// Process the active connections
-	activeIdx := ((prod.clientIdx >> 31) + 1) & 1
-	activeConns := &prod.clients[activeIdx]
-
-	for i := 0; i < len(activeConns.conns); i++ {
-		client := activeConns.conns[i]
-		if err := client.WriteMessage(websocket.TextMessage, msg.GetPayload()); err != nil {
-			activeConns.conns = append(activeConns.conns[:i], activeConns.conns[i+1:]...)
-			if closeErr := client.Close(); closeErr == nil {
-				prod.Logger.Error(err)
-			}
-			i--
-		}
+	for _, client := range slowClients {
+		prod.Logger.Warning("Disconnecting slow websocket client ", client.conn.RemoteAddr())
+		prod.removeClient(client)
 	}
 }
 
@@ -158,7 +216,7 @@ func (prod *Websocket) upgrade(w http.ResponseWriter, r *http.Request) {
 		// Return here to not track invalid connections
 		return
 	}
-	prod.handleConnection(conn)
+	prod.handleConnection(conn, r.URL.Query())
 }
 
 func (prod *Websocket) serve() {
@@ -170,9 +228,11 @@ func (prod *Websocket) serve() {
 		return // ### return, could not connect ###
 	}
 
-	http.HandleFunc(prod.path, prod.upgrade)
+	mux := http.NewServeMux()
+	mux.HandleFunc(prod.path, prod.upgrade)
 
 	srv := http.Server{
+		Handler:     mux,
 		ReadTimeout: prod.readTimeoutSec,
 	}
 
@@ -187,17 +247,23 @@ func (prod *Websocket) serve() {
 
 func (prod *Websocket) close() {
 	prod.DefaultClose()
-	prod.listen.Close()
+	if prod.listen != nil {
+		prod.listen.Close()
+	}
 
-	for _, client := range prod.clients[0].conns {
-		client.Close()
+	prod.clientGuard.RLock()
+	clients := make([]*websocketClient, 0, len(prod.clients))
+	for client := range prod.clients {
+		clients = append(clients, client)
 	}
-	for _, client := range prod.clients[1].conns {
-		client.Close()
+	prod.clientGuard.RUnlock()
+
+	for _, client := range clients {
+		prod.removeClient(client)
 	}
 }
 
-// Produce writes to stdout or stderr.
+// Produce writes to all connected websocket clients.
 func (prod *Websocket) Produce(workers *sync.WaitGroup) {
 	prod.AddMainWorker(workers)
 	go prod.serve()
@@ -0,0 +1,347 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+)
+
+// reloadResult is sent back to callers of RequestReload.
+type reloadResult struct {
+	diff core.ConfigDiff
+	err  error
+}
+
+// reloadedPlugins holds the plugins created for added or changed configs.
+type reloadedPlugins struct {
+	routers   []core.Router
+	producers []core.Producer
+	consumers []core.Consumer
+}
+
+// RequestReload asks the coordinator main loop to reload the config file and
+// waits for the result.
+func (co *Coordinator) RequestReload() (core.ConfigDiff, error) {
+	result := make(chan reloadResult, 1)
+	select {
+	case co.reloadRequests <- result:
+	case <-time.After(time.Second):
+		return core.ConfigDiff{}, fmt.Errorf("Gollum is not running")
+	}
+
+	reload := <-result
+	return reload.diff, reload.err
+}
+
+// Reload reads the given config file and applies all changes to the running
+// plugins. Plugins are replaced in an order that does not drop messages:
+// consumers of removed or changed configs are stopped first, then routers
+// are replaced and new producers are started. Replaced producers are detached
+// from all routers before they are stopped, which flushes their queues.
+// New consumers are started last.
+// A changed producer and its replacement run side by side until the old
+// instance has flushed its queue, so both may write to the same target for
+// a short time. Producers with the same PersistentQueue path share the queue
+// during that time, so each stored message is still processed only once.
+// If a new plugin fails to be configured no running plugin is changed.
+func (co *Coordinator) Reload(configFile string) (core.ConfigDiff, error) {
+	if co.state != coordinatorStateStartConsumers {
+		return core.ConfigDiff{}, fmt.Errorf("Plugins are not running")
+	}
+
+	config, err := core.ReadConfigFromFile(configFile)
+	if err != nil {
+		return core.ConfigDiff{}, err
+	}
+	if err := config.Validate(); err != nil {
+		return core.ConfigDiff{}, err
+	}
+
+	diff := core.DiffConfig(co.config, config)
+	diff.AddRouterDependents(config)
+	if diff.IsEmpty() {
+		logrus.Debug("Config unchanged, nothing to reload")
+		return diff, nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"added":   len(diff.Added.Plugins),
+		"removed": len(diff.Removed.Plugins),
+		"changed": len(diff.Changed.Plugins),
+	}).Info("Reloading config")
+
+	replaced := diff.GetRemovedOrChangedIDs()
+	plugins, err := co.configureReloaded(diff)
+	if err != nil {
+		return diff, err
+	}
+
+	co.stopReplacedConsumers(replaced)
+	co.replaceRouters(replaced, plugins.routers)
+	co.startReloadedProducers(plugins.producers)
+	co.stopReplacedProducers(replaced)
+	co.producers = append(co.producers, plugins.producers...)
+	co.startReloadedConsumers(plugins.consumers)
+
+	co.config = config
+	logrus.Info("Config reloaded")
+	return diff, nil
+}
+
+// configureReloaded creates the plugins of all added or changed configs.
+// Changed plugins are removed from the PluginRegistry while their replacement
+// is configured. If any plugin fails to be configured the registry is
+// restored and an error is returned.
+func (co *Coordinator) configureReloaded(diff core.ConfigDiff) (reloadedPlugins, error) {
+	plugins := reloadedPlugins{}
+	previous := make(map[string]core.Plugin)
+	for _, config := range diff.Changed.Plugins {
+		if plugin := core.PluginRegistry.GetPlugin(config.ID); plugin != nil {
+			previous[config.ID] = plugin
+			core.PluginRegistry.Unregister(config.ID)
+		}
+	}
+
+	configs := core.Config{Plugins: append(append([]core.PluginConfig{}, diff.Added.Plugins...), diff.Changed.Plugins...)}
+	errors := tgo.NewErrorStack()
+	errors.SetFormat(tgo.ErrorStackFormatCSV)
+
+	for _, config := range configs.GetRouters() {
+		if plugin, err := core.NewPluginWithConfig(config); errors.Push(err) {
+			logrus.WithError(err).Errorf("Failed to instantiate router '%s'", config.ID)
+		} else {
+			plugins.routers = append(plugins.routers, plugin.(core.Router))
+		}
+	}
+	for _, config := range configs.GetProducers() {
+		if plugin, err := core.NewPluginWithConfig(config); errors.Push(err) {
+			logrus.WithError(err).Errorf("Failed to instantiate producer '%s'", config.ID)
+		} else {
+			plugins.producers = append(plugins.producers, plugin.(core.Producer))
+		}
+	}
+	for _, config := range configs.GetConsumers() {
+		if plugin, err := core.NewPluginWithConfig(config); errors.Push(err) {
+			logrus.WithError(err).Errorf("Failed to instantiate consumer '%s'", config.ID)
+		} else {
+			plugins.consumers = append(plugins.consumers, plugin.(core.Consumer))
+		}
+	}
+
+	if err := errors.OrNil(); err != nil {
+		for _, config := range configs.Plugins {
+			core.PluginRegistry.Unregister(config.ID)
+		}
+		for ID, plugin := range previous {
+			core.PluginRegistry.RegisterUnique(plugin, ID)
+		}
+		return reloadedPlugins{}, err
+	}
+	return plugins, nil
+}
+
+// stopReplacedConsumers stops all consumers with the given IDs and waits
+// for them to stop.
+func (co *Coordinator) stopReplacedConsumers(IDs map[string]bool) {
+	running := make([]core.Consumer, 0, len(co.consumers))
+	stopped := []core.Consumer{}
+	for _, consumer := range co.consumers {
+		if consumer != co.logConsumer && IDs[consumer.GetID()] {
+			logrus.Debugf("Stopping consumer '%s'", consumer.GetID())
+			consumer.Control() <- core.PluginControlStopConsumer
+			stopped = append(stopped, consumer)
+		} else {
+			running = append(running, consumer)
+		}
+	}
+
+	for _, consumer := range stopped {
+		if !waitForPluginState(consumer, core.PluginStateDead, consumer.GetShutdownTimeout()*10) {
+			logrus.Errorf("Consumer '%s' found to be blocking", consumer.GetID())
+		}
+		unregisterStoppedPlugin(consumer.GetID(), consumer)
+		core.UncountConsumers()
+	}
+	co.consumers = running
+}
+
+// replaceRouters registers the new routers and replaces the removed or
+// changed routers that are still registered by fallback routers. All running
+// producers are attached to the new routers so that messages keep flowing
+// until replaced producers are stopped.
+// New routers are started after all routers have been replaced, so that
+// routers resolving their target streams on start find the new routers.
+func (co *Coordinator) replaceRouters(IDs map[string]bool, routers []core.Router) {
+	for _, router := range routers {
+		streamID := router.GetStreamID()
+		router.AddProducer(co.getProducersListeningTo(streamID)...)
+		core.StreamRegistry.AddWildcardProducersToRouter(router)
+		core.StreamRegistry.Replace(router, streamID)
+	}
+
+	running := make([]core.Router, 0, len(co.routers)+len(routers))
+	for _, router := range co.routers {
+		if !IDs[router.GetID()] {
+			running = append(running, router)
+			continue // ### continue, not replaced ###
+		}
+
+		// Routers bound to a stream that has no new router are replaced by a
+		// fallback router, just like streams without router at startup.
+		streamID := router.GetStreamID()
+		if core.StreamRegistry.GetRouter(streamID) == router {
+			core.StreamRegistry.ReplaceWithFallback(streamID, co.getProducersListeningTo(streamID)...)
+		}
+		if stopper, isStopper := router.(core.RouterStopper); isStopper {
+			stopper.Stop()
+		}
+		unregisterStoppedPlugin(router.GetID(), router)
+	}
+
+	for _, router := range routers {
+		logrus.Debug("Starting ", reflect.TypeOf(router))
+		if err := router.Start(); err != nil {
+			logrus.WithError(err).Errorf("Failed to start router of type '%s'", reflect.TypeOf(router))
+		}
+	}
+	co.routers = append(running, routers...)
+}
+
+// getProducersListeningTo returns all running producers bound to the given
+// stream.
+func (co *Coordinator) getProducersListeningTo(streamID core.MessageStreamID) []core.Producer {
+	producers := []core.Producer{}
+	for _, producer := range co.producers {
+		if listensTo(producer, streamID) {
+			producers = append(producers, producer)
+		}
+	}
+	return producers
+}
+
+// startReloadedProducers starts the given producers and attaches them to
+// their streams once they have been started.
+func (co *Coordinator) startReloadedProducers(producers []core.Producer) {
+	for _, producer := range producers {
+		producer := producer
+		core.CountProducers()
+		go tgo.WithRecoverShutdown(func() {
+			logrus.Debug("Starting ", reflect.TypeOf(producer))
+			producer.Produce(co.producerWorker)
+		})
+	}
+
+	wildcardStream := core.StreamRegistry.GetRouterOrFallback(core.WildcardStreamID)
+	for _, producer := range producers {
+		if !waitForPluginState(producer, core.PluginStateWaiting, producer.GetShutdownTimeout()*10) {
+			logrus.Warningf("Producer '%s' did not start in time", producer.GetID())
+		}
+
+		attachProducer(producer, wildcardStream)
+		if listensTo(producer, core.WildcardStreamID) {
+			core.StreamRegistry.ForEachStream(func(streamID core.MessageStreamID, router core.Router) {
+				core.StreamRegistry.AddWildcardProducersToRouter(router)
+			})
+		}
+	}
+}
+
+// stopReplacedProducers detaches all running producers with the given IDs
+// from all routers, stops them and waits for them to flush their queues.
+func (co *Coordinator) stopReplacedProducers(IDs map[string]bool) {
+	running := make([]core.Producer, 0, len(co.producers))
+	stopped := []core.Producer{}
+	for _, producer := range co.producers {
+		if IDs[producer.GetID()] {
+			stopped = append(stopped, producer)
+		} else {
+			running = append(running, producer)
+		}
+	}
+	if len(stopped) == 0 {
+		return // ### return, nothing to stop ###
+	}
+
+	core.StreamRegistry.UnregisterWildcardProducer(stopped...)
+	core.StreamRegistry.ForEachStream(func(streamID core.MessageStreamID, router core.Router) {
+		router.RemoveProducer(stopped...)
+	})
+
+	for _, producer := range stopped {
+		logrus.Debugf("Stopping producer '%s'", producer.GetID())
+		producer.Control() <- core.PluginControlStopProducer
+	}
+
+	for _, producer := range stopped {
+		if !waitForPluginState(producer, core.PluginStateDead, producer.GetShutdownTimeout()*10) {
+			logrus.Errorf("Producer '%s' found to be blocking", producer.GetID())
+		}
+		unregisterStoppedPlugin(producer.GetID(), producer)
+		core.UncountProducers()
+	}
+	co.producers = running
+}
+
+// startReloadedConsumers starts the given consumers.
+func (co *Coordinator) startReloadedConsumers(consumers []core.Consumer) {
+	for _, consumer := range consumers {
+		consumer := consumer
+		co.consumers = append(co.consumers, consumer)
+		core.CountConsumers()
+
+		go tgo.WithRecoverShutdown(func() {
+			logrus.Debug("Starting ", reflect.TypeOf(consumer))
+			consumer.Consume(co.consumerWorker)
+		})
+	}
+}
+
+// listensTo returns true if the producer is bound to the given stream.
+func listensTo(producer core.Producer, streamID core.MessageStreamID) bool {
+	for _, boundStreamID := range producer.Streams() {
+		if boundStreamID == streamID {
+			return true
+		}
+	}
+	return false
+}
+
+// unregisterStoppedPlugin removes a stopped plugin from the PluginRegistry
+// unless it has already been replaced by a new plugin with the same ID.
+func unregisterStoppedPlugin(ID string, plugin interface{}) {
+	if core.PluginRegistry.GetPlugin(ID) == plugin {
+		core.PluginRegistry.Unregister(ID)
+	}
+}
+
+// waitForPluginState waits until the given plugin has reached at least the
+// given state. False is returned if the state has not been reached within the
+// given timeout.
+func waitForPluginState(plugin core.PluginWithState, state core.PluginState, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for plugin.GetState() < state {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/logger"
+	"github.com/trivago/tgo/ttesting"
+)
+
+type mockReloadConsumer struct {
+	core.SimpleConsumer
+}
+
+func (cons *mockReloadConsumer) Consume(workers *sync.WaitGroup) {
+	cons.ControlLoop()
+}
+
+type mockReloadProducer struct {
+	core.DirectProducer
+}
+
+var mockReloadMessages = make(chan string, 10)
+
+func (prod *mockReloadProducer) Produce(workers *sync.WaitGroup) {
+	prod.MessageControlLoop(func(msg *core.Message) {
+		mockReloadMessages <- msg.String()
+	})
+}
+
+func writeReloadConfig(expect ttesting.Expect, path string, config string) {
+	expect.NoError(ioutil.WriteFile(path, []byte(config), 0644))
+}
+
+func TestReloadDistributeTarget(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	logrusHookBuffer = logger.NewLogrusHookBuffer()
+
+	core.TypeRegistry.Register(mockReloadConsumer{})
+	core.TypeRegistry.Register(mockReloadProducer{})
+
+	file, err := ioutil.TempFile("", "gollum-reload")
+	expect.NoError(err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	// The target router drops all messages until it is replaced
+	writeReloadConfig(expect, file.Name(), `
+consumer: {Type: gollum.mockReloadConsumer, Streams: reloadIn}
+distributor: {Type: router.Distribute, Stream: reloadIn, TargetStreams: reloadOut}
+target: {Type: router.Broadcast, Stream: reloadOut, Filters: [filter.None]}
+producer: {Type: gollum.mockReloadProducer, Streams: reloadOut}
+`)
+
+	config, err := core.ReadConfigFromFile(file.Name())
+	expect.NoError(err)
+
+	coordinator := NewCoordinator()
+	expect.NoError(coordinator.Configure(config))
+	coordinator.StartPlugins()
+	defer coordinator.Shutdown()
+
+	writeReloadConfig(expect, file.Name(), `
+consumer: {Type: gollum.mockReloadConsumer, Streams: reloadIn}
+distributor: {Type: router.Distribute, Stream: reloadIn, TargetStreams: reloadOut}
+target: {Type: router.Broadcast, Stream: reloadOut}
+producer: {Type: gollum.mockReloadProducer, Streams: reloadOut}
+`)
+
+	diff, err := coordinator.Reload(file.Name())
+	expect.NoError(err)
+	expect.Equal(3, len(diff.Changed.Plugins))
+
+	// The distributor has been replaced, too, and passes messages to the
+	// new target router.
+	producer := core.PluginRegistry.GetPluginWithState("producer")
+	expect.True(waitForPluginState(producer, core.PluginStateActive, time.Second))
+
+	streamID := core.GetStreamID("reloadIn")
+	msg := core.NewMessage(nil, []byte("reloaded"), nil, streamID)
+	expect.NoError(core.Route(msg, core.StreamRegistry.GetRouter(streamID)))
+
+	select {
+	case payload := <-mockReloadMessages:
+		expect.Equal("reloaded", payload)
+	case <-time.After(time.Second):
+		t.Error("Message has not been passed to the new target router")
+	}
+}
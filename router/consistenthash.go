@@ -0,0 +1,181 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/trivago/gollum/core"
+)
+
+// ConsistentHash router
+//
+// This router routes each message to exactly one of the streams listed in
+// TargetStreams. The stream is selected by a consistent hash of a metadata
+// field, so messages with the same key always end up on the same stream.
+// When streams are added to or removed from TargetStreams, only the keys of
+// the affected streams are moved to a different stream.
+//
+// Parameters
+//
+// - TargetStreams: List of streams to route the incoming messages to.
+//
+// - Key: Defines the metadata field used as hash key. If empty or if a
+// message does not have the field, the payload is used.
+// By default this parameter is set to "".
+//
+// - VirtualNodes: Defines the number of points each stream is placed on the
+// hash ring. More points spread keys more evenly.
+// By default this parameter is set to 100.
+//
+// Examples
+//
+// This example routes all messages of a user to the same of three streams:
+//
+//  userRouter:
+//    Type: router.ConsistentHash
+//    Stream: events
+//    Key: user_id
+//    TargetStreams:
+//      - events_0
+//      - events_1
+//      - events_2
+type ConsistentHash struct {
+	Broadcast      `gollumdoc:"embed_type"`
+	key            string `config:"Key"`
+	virtualNodes   int    `config:"VirtualNodes" default:"100"`
+	boundStreamIDs []core.MessageStreamID
+	routers        []core.Router
+	ring           consistentHashRing
+}
+
+// consistentHashRing maps hashes to the index of the closest point.
+type consistentHashRing struct {
+	points []uint64
+	owners []int
+}
+
+func init() {
+	core.TypeRegistry.Register(ConsistentHash{})
+}
+
+// Configure initializes this distributor with values from a plugin config.
+func (router *ConsistentHash) Configure(conf core.PluginConfigReader) {
+	router.boundStreamIDs = conf.GetStreamArray("TargetStreams", []core.MessageStreamID{})
+	if router.virtualNodes < 1 {
+		conf.Errors.Pushf("VirtualNodes must be at least 1")
+		router.virtualNodes = 1
+	}
+
+	names := make([]string, 0, len(router.boundStreamIDs))
+	for _, streamID := range router.boundStreamIDs {
+		names = append(names, core.StreamRegistry.GetStreamName(streamID))
+	}
+	router.ring = newConsistentHashRing(names, router.virtualNodes)
+}
+
+// Start the router
+func (router *ConsistentHash) Start() error {
+	for _, streamID := range router.boundStreamIDs {
+		targetRouter := core.StreamRegistry.GetRouterOrFallback(streamID)
+		router.routers = append(router.routers, targetRouter)
+	}
+	return nil
+}
+
+// Enqueue enques a message to the router
+func (router *ConsistentHash) Enqueue(msg *core.Message) error {
+	if len(router.routers) == 0 {
+		return core.NewModulateResultError(
+			"Router %s: no streams configured", router.GetID())
+	}
+
+	targetRouter := router.routers[router.ring.get(router.hash(msg))]
+	if router.GetStreamID() == targetRouter.GetStreamID() {
+		return router.Broadcast.Enqueue(msg)
+	}
+
+	msg.SetStreamID(targetRouter.GetStreamID())
+	return core.Route(msg, targetRouter)
+}
+
+func (router *ConsistentHash) hash(msg *core.Message) uint64 {
+	if router.key != "" {
+		if metadata := msg.TryGetMetadata(); metadata != nil {
+			if value, exists := metadata.TryGetValue(router.key); exists {
+				return consistentHashKey(value)
+			}
+		}
+	}
+	return consistentHashKey(msg.GetPayload())
+}
+
+// consistentHashKey returns a well distributed 64 bit hash of the given data.
+func consistentHashKey(data []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(data)
+
+	// fnv alone spreads similar keys badly, so mix the bits (splitmix64)
+	key := hash.Sum64()
+	key = (key ^ (key >> 30)) * 0xbf58476d1ce4e5b9
+	key = (key ^ (key >> 27)) * 0x94d049bb133111eb
+	return key ^ (key >> 31)
+}
+
+// newConsistentHashRing places virtualNodes points per name on a ring. Points
+// only depend on the name, so the position of a name is not affected by
+// other names.
+func newConsistentHashRing(names []string, virtualNodes int) consistentHashRing {
+	ring := consistentHashRing{
+		points: make([]uint64, 0, len(names)*virtualNodes),
+		owners: make([]int, 0, len(names)*virtualNodes),
+	}
+
+	for owner, name := range names {
+		for i := 0; i < virtualNodes; i++ {
+			ring.points = append(ring.points, consistentHashKey([]byte(name+"#"+strconv.Itoa(i))))
+			ring.owners = append(ring.owners, owner)
+		}
+	}
+
+	sort.Sort(ring)
+	return ring
+}
+
+// get returns the owner of the first point at or after the given hash.
+func (ring consistentHashRing) get(hash uint64) int {
+	idx := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i] >= hash
+	})
+	if idx == len(ring.points) {
+		idx = 0
+	}
+	return ring.owners[idx]
+}
+
+func (ring consistentHashRing) Len() int {
+	return len(ring.points)
+}
+
+func (ring consistentHashRing) Less(i, j int) bool {
+	return ring.points[i] < ring.points[j]
+}
+
+func (ring consistentHashRing) Swap(i, j int) {
+	ring.points[i], ring.points[j] = ring.points[j], ring.points[i]
+	ring.owners[i], ring.owners[j] = ring.owners[j], ring.owners[i]
+}
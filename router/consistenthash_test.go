@@ -0,0 +1,72 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestConsistentHashRing(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	names := []string{"a", "b", "c", "d"}
+	ring := newConsistentHashRing(names, 100)
+	smaller := newConsistentHashRing(names[:3], 100)
+
+	counts := make([]int, len(names))
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		hash := consistentHashKey([]byte(strconv.Itoa(i)))
+		owner := ring.get(hash)
+		counts[owner]++
+
+		// Keys of the remaining streams must not move
+		if owner != 3 {
+			expect.Equal(owner, smaller.get(hash))
+		} else {
+			moved++
+		}
+	}
+
+	for _, count := range counts {
+		expect.Geq(count, 1500)
+		expect.Leq(count, 3500)
+	}
+	expect.Equal(counts[3], moved)
+}
+
+func TestConsistentHashKey(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	conf := core.NewPluginConfig("", "router.ConsistentHash")
+	conf.Override("Stream", "consistentHashSource")
+	conf.Override("Key", "user")
+	conf.Override("TargetStreams", []string{"hash0", "hash1"})
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	router, casted := plugin.(*ConsistentHash)
+	expect.True(casted)
+
+	msg1 := core.NewMessage(nil, []byte("1"), core.Metadata{"user": []byte("alice")}, core.InvalidStreamID)
+	msg2 := core.NewMessage(nil, []byte("2"), core.Metadata{"user": []byte("alice")}, core.InvalidStreamID)
+	msg3 := core.NewMessage(nil, []byte("alice"), nil, core.InvalidStreamID)
+
+	expect.Equal(router.hash(msg1), router.hash(msg2))
+	expect.Equal(router.hash(msg1), router.hash(msg3))
+}
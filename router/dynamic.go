@@ -0,0 +1,272 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"gopkg.in/yaml.v2"
+)
+
+// Dynamic router
+//
+// This router routes messages by a routing table that is loaded from a file
+// or an HTTP endpoint. The table is reloaded periodically and when gollum
+// receives a roll signal (SIGHUP), so routing can be changed without a
+// restart. Target streams are looked up for each message, so routers replaced
+// by a config reload are used right away.
+//
+// The table is a YAML or JSON object mapping keys to a target stream or a
+// list of target streams. Messages are routed to the targets of the entry
+// matching their key, copies are sent to each target if there are several.
+// The entry "*" is used for messages without a matching entry. Messages
+// without any matching entry are sent to the producers of the router's own
+// stream.
+//
+// If the table cannot be loaded or parsed, the last valid table stays in use.
+//
+// Parameters
+//
+// - Source: Defines the path of the file or the http(s) URL the table is
+// loaded from.
+// By default this parameter is set to "".
+//
+// - Key: Defines the metadata field used as key. If empty, the name of the
+// stream the message was originally sent to is used.
+// By default this parameter is set to "".
+//
+// - ReloadIntervalSec: Defines the number of seconds between checks for
+// changes of the table. Set to 0 to only reload on roll signals.
+// By default this parameter is set to 30.
+//
+// Examples
+//
+// This example routes messages by their "tenant" metadata field:
+//
+//  tenantRouter:
+//    Type: router.Dynamic
+//    Stream: events
+//    Key: tenant
+//    Source: /etc/gollum/routes.yaml
+//
+// With routes.yaml containing:
+//
+//  acme: kafka_acme
+//  globex: [kafka_globex, s3_archive]
+//  "*": kafka_default
+type Dynamic struct {
+	Broadcast      `gollumdoc:"embed_type"`
+	source         string        `config:"Source"`
+	key            string        `config:"Key"`
+	reloadInterval time.Duration `config:"ReloadIntervalSec" default:"30" metric:"sec"`
+	table          atomic.Value
+	lastContent    []byte
+	reloadGuard    *sync.Mutex
+	client         *http.Client
+	stop           chan struct{}
+	stopOnce       *sync.Once
+}
+
+// dynamicTable maps keys to their target streams. Target routers are resolved
+// per message so that routers replaced by a config reload are picked up.
+type dynamicTable map[string][]core.MessageStreamID
+
+func init() {
+	core.TypeRegistry.Register(Dynamic{})
+}
+
+// Configure initializes this distributor with values from a plugin config.
+func (router *Dynamic) Configure(conf core.PluginConfigReader) {
+	router.table.Store(dynamicTable{})
+	router.reloadGuard = new(sync.Mutex)
+	router.client = &http.Client{Timeout: 10 * time.Second}
+	router.stop = make(chan struct{})
+	router.stopOnce = new(sync.Once)
+
+	if router.source == "" {
+		router.Logger.Warning("No Source set, messages are not rerouted")
+	}
+}
+
+// Start the router
+func (router *Dynamic) Start() error {
+	if router.source == "" {
+		return nil
+	}
+
+	err := router.reload(false)
+	if router.reloadInterval > 0 {
+		go router.reloadLoop()
+	}
+	return err
+}
+
+// Stop ends the periodic reload of the routing table.
+func (router *Dynamic) Stop() {
+	router.stopOnce.Do(func() {
+		close(router.stop)
+	})
+}
+
+func (router *Dynamic) reloadLoop() {
+	ticker := time.NewTicker(router.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-router.stop:
+			return // ### return, router stopped ###
+		case <-ticker.C:
+			if err := router.reload(false); err != nil {
+				router.Logger.WithError(err).Error("Failed to reload routing table")
+			}
+		}
+	}
+}
+
+// Roll reloads and parses the routing table, even if it has not changed.
+func (router *Dynamic) Roll() {
+	if router.source == "" {
+		return
+	}
+	if err := router.reload(true); err != nil {
+		router.Logger.WithError(err).Error("Failed to reload routing table")
+	}
+}
+
+// reload reads the table from the source and replaces the current table if
+// the content has changed or if force is set.
+func (router *Dynamic) reload(force bool) error {
+	router.reloadGuard.Lock()
+	defer router.reloadGuard.Unlock()
+
+	content, err := router.read()
+	if err != nil {
+		return err
+	}
+	if !force && router.lastContent != nil && bytes.Equal(content, router.lastContent) {
+		return nil // ### return, no changes ###
+	}
+
+	table, err := parseDynamicTable(content)
+	if err != nil {
+		return err
+	}
+
+	router.table.Store(table)
+	router.lastContent = content
+	router.Logger.Infof("Loaded routing table with %d entries from %s", len(table), router.source)
+	return nil
+}
+
+func (router *Dynamic) read() ([]byte, error) {
+	if !strings.HasPrefix(router.source, "http://") && !strings.HasPrefix(router.source, "https://") {
+		return ioutil.ReadFile(router.source)
+	}
+
+	response, err := router.client.Get(router.source)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", router.source, response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// parseDynamicTable parses a YAML or JSON object of keys and target streams.
+func parseDynamicTable(content []byte) (dynamicTable, error) {
+	entries := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+
+	table := make(dynamicTable)
+	for key, value := range entries {
+		var streams []string
+		switch value.(type) {
+		case string:
+			streams = []string{value.(string)}
+		case []interface{}:
+			for _, item := range value.([]interface{}) {
+				stream, isString := item.(string)
+				if !isString {
+					return nil, fmt.Errorf("target of '%s' is not a stream name", key)
+				}
+				streams = append(streams, stream)
+			}
+		default:
+			return nil, fmt.Errorf("target of '%s' is not a stream name or list", key)
+		}
+
+		for _, stream := range streams {
+			table[key] = append(table[key], core.GetStreamID(stream))
+		}
+	}
+	return table, nil
+}
+
+// Enqueue enques a message to the router
+func (router *Dynamic) Enqueue(msg *core.Message) error {
+	targets := router.getTargets(msg)
+	if len(targets) == 0 {
+		return router.Broadcast.Enqueue(msg)
+	}
+
+	lastTargetIdx := len(targets) - 1
+	for _, streamID := range targets[:lastTargetIdx] {
+		targetRouter := core.StreamRegistry.GetRouterOrFallback(streamID)
+		if err := router.route(msg.Clone(), targetRouter); err != nil {
+			router.Logger.WithError(err).Errorf("Failed to route message to %s", targetRouter.GetID())
+		}
+	}
+	return router.route(msg, core.StreamRegistry.GetRouterOrFallback(targets[lastTargetIdx]))
+}
+
+func (router *Dynamic) route(msg *core.Message, targetRouter core.Router) error {
+	if router.GetStreamID() == targetRouter.GetStreamID() {
+		return router.Broadcast.Enqueue(msg)
+	}
+
+	msg.SetStreamID(targetRouter.GetStreamID())
+	return core.Route(msg, targetRouter)
+}
+
+// getTargets returns the streams of the table entry matching the message.
+func (router *Dynamic) getTargets(msg *core.Message) []core.MessageStreamID {
+	table := router.table.Load().(dynamicTable)
+
+	var key string
+	if router.key == "" {
+		key = core.StreamRegistry.GetStreamName(msg.GetOrigStreamID())
+	} else {
+		key = msg.TryGetMetadata().GetValueString(router.key)
+	}
+
+	if targets, exists := table[key]; exists {
+		return targets
+	}
+	return table["*"]
+}
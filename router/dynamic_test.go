@@ -0,0 +1,141 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func getTestDynamicTargets(router *Dynamic, tenant string) []string {
+	msg := core.NewMessage(nil, []byte("test"), core.Metadata{"tenant": []byte(tenant)}, core.InvalidStreamID)
+	names := []string{}
+	for _, target := range router.getTargets(msg) {
+		names = append(names, target.GetName())
+	}
+	return names
+}
+
+func TestDynamicFile(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	file, err := ioutil.TempFile("", "gollum-dynamic")
+	expect.NoError(err)
+	defer os.Remove(file.Name())
+	file.WriteString("acme: dynamicAcme\nglobex: [dynamicGlobex, dynamicArchive]\n")
+	file.Close()
+
+	conf := core.NewPluginConfig("", "router.Dynamic")
+	conf.Override("Stream", "dynamicSource")
+	conf.Override("Key", "tenant")
+	conf.Override("Source", file.Name())
+	conf.Override("ReloadIntervalSec", 0)
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	router, casted := plugin.(*Dynamic)
+	expect.True(casted)
+
+	expect.NoError(router.Start())
+
+	expect.Equal([]string{"dynamicAcme"}, getTestDynamicTargets(router, "acme"))
+	expect.Equal([]string{"dynamicGlobex", "dynamicArchive"}, getTestDynamicTargets(router, "globex"))
+	expect.Equal(0, len(getTestDynamicTargets(router, "initech")))
+
+	// Invalid tables are ignored
+	ioutil.WriteFile(file.Name(), []byte("acme: [[1]]"), 0644)
+	router.Roll()
+	expect.Equal([]string{"dynamicAcme"}, getTestDynamicTargets(router, "acme"))
+
+	ioutil.WriteFile(file.Name(), []byte(`{"acme": "dynamicOther", "*": "dynamicDefault"}`), 0644)
+	router.Roll()
+	expect.Equal([]string{"dynamicOther"}, getTestDynamicTargets(router, "acme"))
+	expect.Equal([]string{"dynamicDefault"}, getTestDynamicTargets(router, "initech"))
+}
+
+func TestDynamicHTTP(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	target := "dynamicFirst"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"acme": "%s"}`, target)
+	}))
+	defer server.Close()
+
+	conf := core.NewPluginConfig("", "router.Dynamic")
+	conf.Override("Stream", "dynamicSource")
+	conf.Override("Key", "tenant")
+	conf.Override("Source", server.URL)
+	conf.Override("ReloadIntervalSec", 0)
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	router, casted := plugin.(*Dynamic)
+	expect.True(casted)
+
+	expect.NoError(router.Start())
+	expect.Equal([]string{"dynamicFirst"}, getTestDynamicTargets(router, "acme"))
+
+	target = "dynamicSecond"
+	expect.NoError(router.reload(false))
+	expect.Equal([]string{"dynamicSecond"}, getTestDynamicTargets(router, "acme"))
+}
+
+func TestDynamicStop(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	file, err := ioutil.TempFile("", "gollum-dynamic")
+	expect.NoError(err)
+	defer os.Remove(file.Name())
+	file.WriteString("acme: dynamicAcme\n")
+	file.Close()
+
+	conf := core.NewPluginConfig("", "router.Dynamic")
+	conf.Override("Stream", "dynamicSource")
+	conf.Override("Key", "tenant")
+	conf.Override("Source", file.Name())
+	conf.Override("ReloadIntervalSec", 0)
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	router, casted := plugin.(*Dynamic)
+	expect.True(casted)
+
+	router.reloadInterval = time.Millisecond
+	expect.NoError(router.Start())
+
+	ioutil.WriteFile(file.Name(), []byte("acme: dynamicReloaded\n"), 0644)
+	time.Sleep(50 * time.Millisecond)
+	expect.Equal([]string{"dynamicReloaded"}, getTestDynamicTargets(router, "acme"))
+
+	// The table is not reloaded after the router has been stopped
+	router.Stop()
+	router.Stop()
+	time.Sleep(10 * time.Millisecond)
+	ioutil.WriteFile(file.Name(), []byte("acme: dynamicStopped\n"), 0644)
+	time.Sleep(50 * time.Millisecond)
+	expect.Equal([]string{"dynamicReloaded"}, getTestDynamicTargets(router, "acme"))
+}
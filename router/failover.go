@@ -0,0 +1,165 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+// Failover router
+//
+// This router sends all messages to the first healthy stream of an ordered
+// list of streams. The first stream is the primary, all others are
+// secondaries used in the given order while the primary is unhealthy.
+//
+// A stream is healthy if it has producers and none of them is inactive,
+// blocked or has a message buffer filled above MaxQueueLoad. Once a stream
+// has been found unhealthy, it is not used for RecoveryProbeSec seconds.
+// After that it is checked again and used as soon as it is healthy, i.e. the
+// router switches back to the primary when it has recovered.
+//
+// If no stream is healthy, messages are sent to the primary stream.
+//
+// Parameters
+//
+// - TargetStreams: Defines the ordered list of streams to route messages to.
+// By default this parameter is set to an empty list.
+//
+// - MaxQueueLoad: Defines the fill level of a producer's message buffer
+// between 0 and 1 at which the producer is considered saturated.
+// By default this parameter is set to 0.9.
+//
+// - RecoveryProbeSec: Defines the number of seconds an unhealthy stream is
+// not used before it is checked again.
+// By default this parameter is set to 10.
+//
+// Examples
+//
+// This example sends messages to Kafka and switches to a file while the
+// Kafka producer is unable to keep up:
+//
+//  failoverRouter:
+//    Type: router.Failover
+//    Stream: events
+//    RecoveryProbeSec: 30
+//    TargetStreams:
+//      - kafka
+//      - file
+type Failover struct {
+	Broadcast      `gollumdoc:"embed_type"`
+	maxQueueLoad   float64       `config:"MaxQueueLoad" default:"0.9"`
+	recoveryProbe  time.Duration `config:"RecoveryProbeSec" default:"10" metric:"sec"`
+	boundStreamIDs []core.MessageStreamID
+	routers        []core.Router
+	downUntil      []time.Time
+	active         int
+	now            func() time.Time
+	guard          *sync.Mutex
+}
+
+func init() {
+	core.TypeRegistry.Register(Failover{})
+}
+
+// Configure initializes this distributor with values from a plugin config.
+func (router *Failover) Configure(conf core.PluginConfigReader) {
+	router.boundStreamIDs = conf.GetStreamArray("TargetStreams", []core.MessageStreamID{})
+	router.downUntil = make([]time.Time, len(router.boundStreamIDs))
+	router.now = time.Now
+	router.guard = new(sync.Mutex)
+}
+
+// Start the router
+func (router *Failover) Start() error {
+	for _, streamID := range router.boundStreamIDs {
+		targetRouter := core.StreamRegistry.GetRouterOrFallback(streamID)
+		router.routers = append(router.routers, targetRouter)
+	}
+	return nil
+}
+
+// Enqueue enques a message to the router
+func (router *Failover) Enqueue(msg *core.Message) error {
+	if len(router.routers) == 0 {
+		return core.NewModulateResultError(
+			"Router %s: no streams configured", router.GetID())
+	}
+
+	targetRouter := router.routers[router.selectTarget()]
+	if router.GetStreamID() == targetRouter.GetStreamID() {
+		return router.Broadcast.Enqueue(msg)
+	}
+
+	msg.SetStreamID(targetRouter.GetStreamID())
+	return core.Route(msg, targetRouter)
+}
+
+// selectTarget returns the index of the first healthy stream that is not
+// waiting for its recovery probe.
+func (router *Failover) selectTarget() int {
+	router.guard.Lock()
+	defer router.guard.Unlock()
+
+	now := router.now()
+	selected := 0
+	for index, targetRouter := range router.routers {
+		if now.Before(router.downUntil[index]) {
+			continue
+		}
+		if router.isHealthy(targetRouter) {
+			selected = index
+			break
+		}
+		router.downUntil[index] = now.Add(router.recoveryProbe)
+	}
+
+	if selected != router.active {
+		router.Logger.Warningf("Switching from stream %s to %s",
+			router.routers[router.active].GetStreamID().GetName(), router.routers[selected].GetStreamID().GetName())
+		router.active = selected
+	}
+	return selected
+}
+
+// isHealthy returns true if all producers of the given router are active,
+// not blocked and not saturated.
+func (router *Failover) isHealthy(targetRouter core.Router) bool {
+	withProducers, hasProducers := targetRouter.(interface {
+		GetProducers() []core.Producer
+	})
+	if !hasProducers {
+		return true // ### return, health unknown ###
+	}
+
+	producers := withProducers.GetProducers()
+	if len(producers) == 0 {
+		return false
+	}
+
+	for _, prod := range producers {
+		if !prod.IsActive() || prod.IsBlocked() {
+			return false
+		}
+		if buffered, isBuffered := prod.(interface{ GetQueueLoad() float64 }); isBuffered {
+			if buffered.GetQueueLoad() >= router.maxQueueLoad {
+				return false
+			}
+		}
+	}
+	return true
+}
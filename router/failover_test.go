@@ -0,0 +1,90 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+type mockFailoverProducer struct {
+	core.Producer
+	blocked bool
+	load    float64
+}
+
+func (prod *mockFailoverProducer) IsActive() bool {
+	return true
+}
+
+func (prod *mockFailoverProducer) IsBlocked() bool {
+	return prod.blocked
+}
+
+func (prod *mockFailoverProducer) GetQueueLoad() float64 {
+	return prod.load
+}
+
+func newTestFailoverTarget(expect ttesting.Expect, stream string, prod core.Producer) core.Router {
+	conf := core.NewPluginConfig("", "router.Broadcast")
+	conf.Override("Stream", stream)
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	router := plugin.(core.Router)
+	router.AddProducer(prod)
+	return router
+}
+
+func TestFailover(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	conf := core.NewPluginConfig("", "router.Failover")
+	conf.Override("RecoveryProbeSec", 10)
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	router, casted := plugin.(*Failover)
+	expect.True(casted)
+
+	primary := &mockFailoverProducer{}
+	secondary := &mockFailoverProducer{}
+	router.routers = []core.Router{
+		newTestFailoverTarget(expect, "failoverPrimary", primary),
+		newTestFailoverTarget(expect, "failoverSecondary", secondary),
+	}
+	router.downUntil = make([]time.Time, 2)
+
+	now := time.Now()
+	router.now = func() time.Time { return now }
+	expect.Equal(0, router.selectTarget())
+
+	primary.load = 0.95
+	expect.Equal(1, router.selectTarget())
+
+	// Primary stays unused until the probe period has passed
+	primary.load = 0
+	now = now.Add(5 * time.Second)
+	expect.Equal(1, router.selectTarget())
+
+	now = now.Add(5 * time.Second)
+	expect.Equal(0, router.selectTarget())
+
+	// Without healthy streams messages go to the primary
+	primary.blocked = true
+	secondary.blocked = true
+	expect.Equal(0, router.selectTarget())
+}
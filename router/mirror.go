@@ -0,0 +1,130 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"hash/fnv"
+	"math/rand"
+
+	"github.com/trivago/gollum/core"
+)
+
+// Mirror router
+//
+// This router sends all messages to the producers of its stream like
+// router.Broadcast and additionally sends copies of a share of all messages
+// to a shadow stream. This allows testing new producers or configurations
+// with live traffic.
+//
+// Copies do not take part in the acknowledgement of the original message
+// and errors on the shadow stream are only logged. To prevent a slow shadow
+// producer from blocking the router, set TimeoutMs of the shadow stream's
+// router to -1, so that copies are discarded if the producer is busy.
+//
+// Parameters
+//
+// - ShadowStream: Defines the stream copies are sent to. If empty, no copies
+// are sent.
+// By default this parameter is set to "".
+//
+// - SamplePercentage: Defines the percentage of messages copied to the
+// shadow stream.
+// By default this parameter is set to 100.
+//
+// - SampleKey: Defines a metadata field used to select messages. If set,
+// either all or no messages with the same value are copied. If empty or if
+// a message does not have the field, messages are selected randomly.
+// By default this parameter is set to "".
+//
+// Examples
+//
+// This example copies 10% of all users' messages to a canary producer:
+//
+//  mirrorRouter:
+//    Type: router.Mirror
+//    Stream: events
+//    ShadowStream: canary
+//    SamplePercentage: 10
+//    SampleKey: user_id
+//
+//  canaryRouter:
+//    Type: router.Broadcast
+//    Stream: canary
+//    TimeoutMs: -1
+type Mirror struct {
+	Broadcast      `gollumdoc:"embed_type"`
+	shadowStreamID core.MessageStreamID `config:"ShadowStream"`
+	percentage     float64              `config:"SamplePercentage" default:"100"`
+	key            string               `config:"SampleKey"`
+	shadowRouter   core.Router
+}
+
+func init() {
+	core.TypeRegistry.Register(Mirror{})
+}
+
+// Configure initializes this distributor with values from a plugin config.
+func (router *Mirror) Configure(conf core.PluginConfigReader) {
+	if router.percentage < 0 || router.percentage > 100 {
+		conf.Errors.Pushf("SamplePercentage must be between 0 and 100")
+	}
+	if router.shadowStreamID == router.GetStreamID() && router.shadowStreamID != core.InvalidStreamID {
+		conf.Errors.Pushf("ShadowStream must not be the router's own stream")
+	}
+}
+
+// Start the router
+func (router *Mirror) Start() error {
+	if router.shadowStreamID != core.InvalidStreamID {
+		router.shadowRouter = core.StreamRegistry.GetRouterOrFallback(router.shadowStreamID)
+	}
+	return nil
+}
+
+// Enqueue enques a message to the router
+func (router *Mirror) Enqueue(msg *core.Message) error {
+	var shadowMsg *core.Message
+	if router.shadowRouter != nil && router.isSampled(msg) {
+		shadowMsg = msg.Clone()
+		shadowMsg.DetachAckCallback()
+		shadowMsg.SetStreamID(router.shadowStreamID)
+	}
+
+	err := router.Broadcast.Enqueue(msg)
+
+	if shadowMsg != nil {
+		if shadowErr := core.Route(shadowMsg, router.shadowRouter); shadowErr != nil {
+			router.Logger.WithError(shadowErr).Warning("Failed to route message to shadow stream")
+		}
+	}
+	return err
+}
+
+// isSampled returns true if a copy of the message should be sent to the
+// shadow stream.
+func (router *Mirror) isSampled(msg *core.Message) bool {
+	if router.percentage >= 100 {
+		return true
+	}
+
+	if router.key != "" {
+		if value, exists := msg.TryGetMetadata().TryGetValue(router.key); exists {
+			hash := fnv.New64a()
+			hash.Write(value)
+			return float64(hash.Sum64()%1000000)/10000 < router.percentage
+		}
+	}
+	return rand.Float64()*100 < router.percentage
+}
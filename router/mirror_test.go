@@ -0,0 +1,94 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+type mockMirrorProducer struct {
+	core.Producer
+	messages []*core.Message
+}
+
+func (prod *mockMirrorProducer) Enqueue(msg *core.Message, timeout time.Duration) {
+	prod.messages = append(prod.messages, msg)
+}
+
+func TestMirror(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("", "router.Mirror")
+	conf.Override("Stream", "mirrorSource")
+	conf.Override("ShadowStream", "mirrorShadow")
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	router, casted := plugin.(*Mirror)
+	expect.True(casted)
+
+	primary := &mockMirrorProducer{}
+	shadow := &mockMirrorProducer{}
+	router.AddProducer(primary)
+	router.shadowRouter = newTestFailoverTarget(expect, "mirrorShadow", shadow)
+
+	acked := 0
+	msg := core.NewMessage(nil, []byte("test"), nil, core.GetStreamID("mirrorSource"))
+	msg.SetAckCallback(func(bool) { acked++ })
+
+	expect.NoError(router.Enqueue(msg))
+	expect.Equal(1, len(primary.messages))
+	expect.Equal(1, len(shadow.messages))
+	expect.Equal("test", shadow.messages[0].String())
+	expect.Equal(core.GetStreamID("mirrorShadow"), shadow.messages[0].GetStreamID())
+
+	shadow.messages[0].Acknowledge()
+	expect.Equal(0, acked)
+	primary.messages[0].Acknowledge()
+	expect.Equal(1, acked)
+}
+
+func TestMirrorSampleKey(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+
+	conf := core.NewPluginConfig("", "router.Mirror")
+	conf.Override("SamplePercentage", 50)
+	conf.Override("SampleKey", "user")
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+
+	router, casted := plugin.(*Mirror)
+	expect.True(casted)
+
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		user := []byte(fmt.Sprintf("user%d", i))
+		msg := core.NewMessage(nil, []byte("test"), core.Metadata{"user": user}, core.InvalidStreamID)
+		result := router.isSampled(msg)
+		expect.Equal(result, router.isSampled(msg))
+		if result {
+			sampled++
+		}
+	}
+	expect.Geq(sampled, 400)
+	expect.Leq(sampled, 600)
+}
@@ -0,0 +1,228 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/tcontainer"
+)
+
+// Rules router
+//
+// This router checks an ordered list of rules and routes each message to the
+// stream of the first rule matching the message. Messages not matching any
+// rule are routed to DefaultStream.
+//
+// Parameters
+//
+// - Rules: Defines an ordered list of rules. Each rule requires a "Stream" to
+// route matching messages to and at least one of the following conditions. A
+// rule matches if all of its conditions match. Unknown keys in a rule are
+// reported as errors. By default this parameter is set to an empty list.
+//  - Expression: An expression as accepted by filter.Expression.
+//  - Regex: A regular expression matched against the payload or the metadata
+//  field given by "ApplyTo".
+//  - Metadata: A map of metadata fields and the values they must be equal to.
+//  - Filters: A list of filters that all have to accept the message.
+//
+// - DefaultStream: Defines the stream messages not matching any rule are
+// routed to. If empty, these messages are sent to the producers of the
+// router's own stream.
+// By default this parameter is set to "".
+//
+// Examples
+//
+// This example sends server errors and messages of the payment service to
+// separate streams, all other messages go to "default":
+//
+//  ruleRouter:
+//    Type: router.Rules
+//    Stream: events
+//    DefaultStream: default
+//    Rules:
+//      - Stream: errors
+//        Expression: "json.status >= 500"
+//      - Stream: payment
+//        Metadata:
+//          service: payment
+//      - Stream: debug
+//        Regex: "^DEBUG"
+//        ApplyTo: message
+type Rules struct {
+	Broadcast       `gollumdoc:"embed_type"`
+	defaultStreamID core.MessageStreamID `config:"DefaultStream"`
+	rules           []routerRule
+	defaultRouter   core.Router
+}
+
+// routerRule is one entry of router.Rules.
+type routerRule struct {
+	streamID core.MessageStreamID
+	router   core.Router
+	metadata map[string]string
+	filters  core.FilterArray
+}
+
+func init() {
+	core.TypeRegistry.Register(Rules{})
+}
+
+// Configure initializes this distributor with values from a plugin config.
+func (router *Rules) Configure(conf core.PluginConfigReader) {
+	for index, ruleConfig := range conf.GetArray("Rules", []interface{}{}) {
+		rule, err := router.newRule(ruleConfig)
+		if err != nil {
+			conf.Errors.Pushf("Rule %d: %s", index, err)
+			continue
+		}
+		router.rules = append(router.rules, rule)
+	}
+}
+
+func (router *Rules) newRule(config interface{}) (routerRule, error) {
+	values, err := tcontainer.ConvertToMarshalMap(config, nil)
+	if err != nil {
+		return routerRule{}, err
+	}
+
+	// Settings are assigned directly, as Override would mark every key as valid
+	ruleConfig := core.NewPluginConfig("", "router.Rules.Rules")
+	for key, value := range values {
+		ruleConfig.Settings[key] = value
+	}
+	reader := core.NewPluginConfigReaderWithError(&ruleConfig)
+
+	rule := routerRule{}
+	if rule.streamID, err = reader.GetStreamID("Stream", core.InvalidStreamID); err != nil {
+		return rule, err
+	}
+	if rule.streamID == core.InvalidStreamID {
+		return rule, fmt.Errorf("no Stream set")
+	}
+	if rule.metadata, err = reader.GetStringMap("Metadata", map[string]string{}); err != nil {
+		return rule, err
+	}
+
+	expression, err := reader.GetString("Expression", "")
+	if err != nil {
+		return rule, err
+	}
+	if expression != "" {
+		filter, err := newRuleFilter("filter.Expression", map[string]interface{}{"Expression": expression})
+		if err != nil {
+			return rule, err
+		}
+		rule.filters = append(rule.filters, filter)
+	}
+
+	regex, err := reader.GetString("Regex", "")
+	if err != nil {
+		return rule, err
+	}
+	applyTo, err := reader.GetString("ApplyTo", "")
+	if err != nil {
+		return rule, err
+	}
+	if regex != "" {
+		filter, err := newRuleFilter("filter.RegExp", map[string]interface{}{"Expression": regex, "ApplyTo": applyTo})
+		if err != nil {
+			return rule, err
+		}
+		rule.filters = append(rule.filters, filter)
+	}
+
+	filters, err := reader.GetFilterArray("Filters", router.Logger, core.FilterArray{})
+	if err != nil {
+		return rule, err
+	}
+	rule.filters = append(rule.filters, filters...)
+
+	// Check after all keys have been read so that misspelled conditions are
+	// not silently ignored.
+	if err := ruleConfig.Validate(); err != nil {
+		return rule, err
+	}
+	if len(rule.metadata) == 0 && len(rule.filters) == 0 {
+		return rule, fmt.Errorf("no conditions set")
+	}
+	return rule, nil
+}
+
+// newRuleFilter creates a filter plugin from the given settings.
+func newRuleFilter(typename string, settings map[string]interface{}) (core.Filter, error) {
+	config := core.NewPluginConfig("", typename)
+	for key, value := range settings {
+		config.Override(key, value)
+	}
+
+	plugin, err := core.NewPluginWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	filter, isFilter := plugin.(core.Filter)
+	if !isFilter {
+		return nil, fmt.Errorf("%s is not a filter", typename)
+	}
+	return filter, nil
+}
+
+// Start the router
+func (router *Rules) Start() error {
+	for i := range router.rules {
+		router.rules[i].router = core.StreamRegistry.GetRouterOrFallback(router.rules[i].streamID)
+	}
+	if router.defaultStreamID != core.InvalidStreamID {
+		router.defaultRouter = core.StreamRegistry.GetRouterOrFallback(router.defaultStreamID)
+	}
+	return nil
+}
+
+// Enqueue enques a message to the router
+func (router *Rules) Enqueue(msg *core.Message) error {
+	targetRouter := router.getTarget(msg)
+	if targetRouter == nil || router.GetStreamID() == targetRouter.GetStreamID() {
+		return router.Broadcast.Enqueue(msg)
+	}
+
+	msg.SetStreamID(targetRouter.GetStreamID())
+	return core.Route(msg, targetRouter)
+}
+
+// getTarget returns the router of the first matching rule or the default
+// router.
+func (router *Rules) getTarget(msg *core.Message) core.Router {
+	for _, rule := range router.rules {
+		if rule.matches(msg) {
+			return rule.router
+		}
+	}
+	return router.defaultRouter
+}
+
+func (rule routerRule) matches(msg *core.Message) bool {
+	if len(rule.metadata) > 0 {
+		metadata := msg.TryGetMetadata()
+		for key, expected := range rule.metadata {
+			if value, exists := metadata.TryGetValue(key); !exists || string(value) != expected {
+				return false
+			}
+		}
+	}
+
+	result, err := rule.filters.ApplyFilter(msg)
+	return err == nil && result == core.FilterResultMessageAccept
+}
@@ -0,0 +1,97 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestRules(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	conf := core.NewPluginConfig("", "router.Rules")
+	conf.Override("Stream", "rulesSource")
+	conf.Override("DefaultStream", "rulesDefault")
+	conf.Override("Rules", []interface{}{
+		map[string]interface{}{
+			"Stream":     "rulesErrors",
+			"Expression": "json.status >= 500",
+		},
+		map[string]interface{}{
+			"Stream":   "rulesPayment",
+			"Metadata": map[string]string{"service": "payment"},
+		},
+		map[string]interface{}{
+			"Stream":  "rulesDebug",
+			"Regex":   "^DEBUG",
+			"ApplyTo": "message",
+		},
+	})
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	router, casted := plugin.(*Rules)
+	expect.True(casted)
+	expect.NoError(router.Start())
+
+	msg := core.NewMessage(nil, []byte(`{"status":503}`), core.Metadata{"service": []byte("payment")}, core.InvalidStreamID)
+	expect.Equal(core.GetStreamID("rulesErrors"), router.getTarget(msg).GetStreamID())
+
+	msg = core.NewMessage(nil, []byte(`{"status":200}`), core.Metadata{"service": []byte("payment")}, core.InvalidStreamID)
+	expect.Equal(core.GetStreamID("rulesPayment"), router.getTarget(msg).GetStreamID())
+
+	msg = core.NewMessage(nil, []byte(`{"status":200}`), core.Metadata{"message": []byte("DEBUG test")}, core.InvalidStreamID)
+	expect.Equal(core.GetStreamID("rulesDebug"), router.getTarget(msg).GetStreamID())
+
+	msg = core.NewMessage(nil, []byte(`DEBUG`), nil, core.InvalidStreamID)
+	expect.Equal(core.GetStreamID("rulesDefault"), router.getTarget(msg).GetStreamID())
+}
+
+func TestRulesInvalid(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	conf := core.NewPluginConfig("", "router.Rules")
+	conf.Override("Rules", []interface{}{
+		map[string]interface{}{"Expression": "true"},
+	})
+
+	_, err := core.NewPluginWithConfig(conf)
+	expect.NotNil(err)
+
+	conf = core.NewPluginConfig("", "router.Rules")
+	conf.Override("Rules", []interface{}{
+		map[string]interface{}{"Stream": "x", "Expression": "json."},
+	})
+
+	_, err = core.NewPluginWithConfig(conf)
+	expect.NotNil(err)
+
+	conf = core.NewPluginConfig("", "router.Rules")
+	conf.Override("Rules", []interface{}{
+		map[string]interface{}{"Stream": "x", "Regex": "^DEBUG", "Expresion": "true"},
+	})
+
+	_, err = core.NewPluginWithConfig(conf)
+	expect.NotNil(err)
+
+	conf = core.NewPluginConfig("", "router.Rules")
+	conf.Override("Rules", []interface{}{
+		map[string]interface{}{"Stream": "x"},
+	})
+
+	_, err = core.NewPluginWithConfig(conf)
+	expect.NotNil(err)
+}
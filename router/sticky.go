@@ -0,0 +1,173 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/trivago/gollum/core"
+)
+
+// Sticky router
+//
+// This router routes each message to one of the streams listed in
+// TargetStreams and pins the value of a metadata field, e.g. a session ID,
+// to the selected stream. All following messages with the same value are
+// routed to the same stream until no message with this value has been seen
+// for TTLSec seconds. New values are assigned to the streams in a round
+// robin fashion.
+//
+// Pinned values are stored in a table holding at most MaxEntries values. If
+// the table is full, the least recently used value is removed.
+//
+// Messages without the metadata field are assigned in a round robin fashion
+// without being pinned.
+//
+// Parameters
+//
+// - TargetStreams: List of streams to route the incoming messages to.
+//
+// - Key: Defines the metadata field holding the value to pin.
+// By default this parameter is set to "session".
+//
+// - TTLSec: Defines the number of seconds a value stays pinned after its
+// last message.
+// By default this parameter is set to 300.
+//
+// - MaxEntries: Defines the maximum number of pinned values.
+// By default this parameter is set to 100000.
+//
+// Examples
+//
+// This example routes all messages of a device to the same worker stream:
+//
+//  deviceRouter:
+//    Type: router.Sticky
+//    Stream: telemetry
+//    Key: device_id
+//    TTLSec: 600
+//    TargetStreams:
+//      - worker_0
+//      - worker_1
+type Sticky struct {
+	Broadcast      `gollumdoc:"embed_type"`
+	key            string        `config:"Key" default:"session"`
+	ttl            time.Duration `config:"TTLSec" default:"300" metric:"sec"`
+	maxEntries     int           `config:"MaxEntries" default:"100000"`
+	boundStreamIDs []core.MessageStreamID
+	routers        []core.Router
+	entries        map[string]*list.Element
+	lru            *list.List
+	next           int
+	now            func() time.Time
+	guard          *sync.Mutex
+}
+
+// stickyEntry is a value pinned to the index of a target stream.
+type stickyEntry struct {
+	key     string
+	index   int
+	expires time.Time
+}
+
+func init() {
+	core.TypeRegistry.Register(Sticky{})
+}
+
+// Configure initializes this distributor with values from a plugin config.
+func (router *Sticky) Configure(conf core.PluginConfigReader) {
+	router.boundStreamIDs = conf.GetStreamArray("TargetStreams", []core.MessageStreamID{})
+	if router.maxEntries < 1 {
+		conf.Errors.Pushf("MaxEntries must be at least 1")
+	}
+
+	router.entries = make(map[string]*list.Element)
+	router.lru = list.New()
+	router.now = time.Now
+	router.guard = new(sync.Mutex)
+}
+
+// Start the router
+func (router *Sticky) Start() error {
+	for _, streamID := range router.boundStreamIDs {
+		targetRouter := core.StreamRegistry.GetRouterOrFallback(streamID)
+		router.routers = append(router.routers, targetRouter)
+	}
+	return nil
+}
+
+// Enqueue enques a message to the router
+func (router *Sticky) Enqueue(msg *core.Message) error {
+	if len(router.routers) == 0 {
+		return core.NewModulateResultError(
+			"Router %s: no streams configured", router.GetID())
+	}
+
+	targetRouter := router.routers[router.getIndex(msg)]
+	if router.GetStreamID() == targetRouter.GetStreamID() {
+		return router.Broadcast.Enqueue(msg)
+	}
+
+	msg.SetStreamID(targetRouter.GetStreamID())
+	return core.Route(msg, targetRouter)
+}
+
+// getIndex returns the index of the stream pinned to the message's key and
+// pins a new one if required.
+func (router *Sticky) getIndex(msg *core.Message) int {
+	router.guard.Lock()
+	defer router.guard.Unlock()
+
+	value, hasKey := msg.TryGetMetadata().TryGetValue(router.key)
+	if !hasKey {
+		return router.nextIndex()
+	}
+
+	key := string(value)
+	now := router.now()
+
+	if element, exists := router.entries[key]; exists {
+		entry := element.Value.(*stickyEntry)
+		if now.Before(entry.expires) {
+			entry.expires = now.Add(router.ttl)
+			router.lru.MoveToFront(element)
+			return entry.index
+		}
+		router.lru.Remove(element)
+		delete(router.entries, key)
+	}
+
+	for router.lru.Len() >= router.maxEntries {
+		oldest := router.lru.Back()
+		router.lru.Remove(oldest)
+		delete(router.entries, oldest.Value.(*stickyEntry).key)
+	}
+
+	entry := &stickyEntry{
+		key:     key,
+		index:   router.nextIndex(),
+		expires: now.Add(router.ttl),
+	}
+	router.entries[key] = router.lru.PushFront(entry)
+	return entry.index
+}
+
+func (router *Sticky) nextIndex() int {
+	index := router.next % len(router.routers)
+	router.next = index + 1
+	return index
+}
@@ -0,0 +1,62 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestSticky(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	conf := core.NewPluginConfig("", "router.Sticky")
+	conf.Override("TargetStreams", []string{"sticky0", "sticky1", "sticky2"})
+	conf.Override("TTLSec", 60)
+	conf.Override("MaxEntries", 2)
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	router, casted := plugin.(*Sticky)
+	expect.True(casted)
+	expect.NoError(router.Start())
+
+	now := time.Now()
+	router.now = func() time.Time { return now }
+	session := func(id string) *core.Message {
+		return core.NewMessage(nil, []byte("test"), core.Metadata{"session": []byte(id)}, core.InvalidStreamID)
+	}
+
+	expect.Equal(0, router.getIndex(session("a")))
+	expect.Equal(1, router.getIndex(session("b")))
+	expect.Equal(0, router.getIndex(session("a")))
+
+	// Messages without key are not pinned
+	expect.Equal(2, router.getIndex(core.NewMessage(nil, []byte("test"), nil, core.InvalidStreamID)))
+
+	// "b" is the least recently used value and gets evicted
+	expect.Equal(0, router.getIndex(session("c")))
+	expect.Equal(0, router.getIndex(session("a")))
+	expect.Equal(1, router.getIndex(session("b")))
+
+	// Each message extends the TTL
+	now = now.Add(50 * time.Second)
+	expect.Equal(1, router.getIndex(session("b")))
+	now = now.Add(50 * time.Second)
+	expect.Equal(1, router.getIndex(session("b")))
+	expect.Equal(2, router.getIndex(session("a")))
+}
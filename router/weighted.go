@@ -0,0 +1,142 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo"
+)
+
+const metricWeightedTarget = "Router:%s:Target:%s:Messages"
+
+// Weighted router
+//
+// This router routes each message to exactly one of the streams listed in
+// Weights. Messages are split across the streams by the ratio of their
+// weights, e.g. to send a small share of traffic to an experimental producer.
+//
+// Streams are selected by smooth weighted round robin, so the ratio is exact
+// after each full cycle and streams are interleaved evenly instead of
+// receiving messages in bursts.
+//
+// The number of messages routed to each stream is counted in the metric
+// "Router:<router>:Target:<stream>:Messages".
+//
+// Parameters
+//
+// - Weights: Defines a map of stream names to weights. Weights must be
+// positive numbers and do not need to add up to 100.
+// By default this parameter is set to an empty map.
+//
+// Examples
+//
+// This example sends 95% of all messages to "prod" and 5% to "experimental":
+//
+//  splitRouter:
+//    Type: router.Weighted
+//    Stream: events
+//    Weights:
+//      prod: "95"
+//      experimental: "5"
+type Weighted struct {
+	Broadcast      `gollumdoc:"embed_type"`
+	boundStreamIDs []core.MessageStreamID
+	routers        []core.Router
+	weights        []int64
+	current        []int64
+	totalWeight    int64
+	metricKeys     []string
+	guard          *sync.Mutex
+}
+
+func init() {
+	core.TypeRegistry.Register(Weighted{})
+}
+
+// Configure initializes this distributor with values from a plugin config.
+func (router *Weighted) Configure(conf core.PluginConfigReader) {
+	router.guard = new(sync.Mutex)
+
+	weights := conf.GetStringMap("Weights", map[string]string{})
+	streams := make([]string, 0, len(weights))
+	for stream := range weights {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	for _, stream := range streams {
+		weight, err := strconv.ParseFloat(weights[stream], 64)
+		if err != nil || weight <= 0 {
+			conf.Errors.Pushf("Weight of stream %s must be a positive number", stream)
+			continue
+		}
+
+		// Weights are scaled to integers to keep the ratio exact
+		router.boundStreamIDs = append(router.boundStreamIDs, core.GetStreamID(stream))
+		router.weights = append(router.weights, int64(weight*1000))
+		router.totalWeight += int64(weight * 1000)
+		router.metricKeys = append(router.metricKeys, fmt.Sprintf(metricWeightedTarget, router.GetID(), stream))
+	}
+	router.current = make([]int64, len(router.weights))
+}
+
+// Start the router
+func (router *Weighted) Start() error {
+	for _, streamID := range router.boundStreamIDs {
+		targetRouter := core.StreamRegistry.GetRouterOrFallback(streamID)
+		router.routers = append(router.routers, targetRouter)
+	}
+	return nil
+}
+
+// Enqueue enques a message to the router
+func (router *Weighted) Enqueue(msg *core.Message) error {
+	if len(router.routers) == 0 {
+		return core.NewModulateResultError(
+			"Router %s: no streams configured", router.GetID())
+	}
+
+	index := router.next()
+	tgo.Metric.Inc(router.metricKeys[index])
+
+	targetRouter := router.routers[index]
+	if router.GetStreamID() == targetRouter.GetStreamID() {
+		return router.Broadcast.Enqueue(msg)
+	}
+
+	msg.SetStreamID(targetRouter.GetStreamID())
+	return core.Route(msg, targetRouter)
+}
+
+// next returns the index of the next stream by smooth weighted round robin.
+func (router *Weighted) next() int {
+	router.guard.Lock()
+	defer router.guard.Unlock()
+
+	selected := 0
+	for i, weight := range router.weights {
+		router.current[i] += weight
+		if router.current[i] > router.current[selected] {
+			selected = i
+		}
+	}
+	router.current[selected] -= router.totalWeight
+	return selected
+}
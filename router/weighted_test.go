@@ -0,0 +1,66 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/tgo/ttesting"
+)
+
+func TestWeighted(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	conf := core.NewPluginConfig("weightedTest", "router.Weighted")
+	conf.Override("Stream", "weightedSource")
+	conf.Override("Weights", map[string]string{"prod": "95", "experimental": "5"})
+
+	plugin, err := core.NewPluginWithConfig(conf)
+	expect.NoError(err)
+	router, casted := plugin.(*Weighted)
+	expect.True(casted)
+
+	// Streams are sorted by name
+	expect.Equal(core.GetStreamID("experimental"), router.boundStreamIDs[0])
+
+	counts := make([]int, 2)
+	longestRun := 0
+	run := 0
+	for i := 0; i < 100; i++ {
+		index := router.next()
+		counts[index]++
+		if index == 1 {
+			run++
+			if run > longestRun {
+				longestRun = run
+			}
+		} else {
+			run = 0
+		}
+	}
+
+	expect.Equal(5, counts[0])
+	expect.Equal(95, counts[1])
+	expect.Leq(longestRun, 20)
+}
+
+func TestWeightedInvalid(t *testing.T) {
+	expect := ttesting.NewExpect(t)
+	conf := core.NewPluginConfig("", "router.Weighted")
+	conf.Override("Weights", map[string]string{"a": "-1"})
+
+	_, err := core.NewPluginWithConfig(conf)
+	expect.NotNil(err)
+}
@@ -34,7 +34,7 @@ func translateSignal(sig os.Signal) signalType {
 		return signalExit
 
 	case syscall.SIGHUP:
-		return signalRoll
+		return signalReload
 	}
 
 	return signalNone
@@ -0,0 +1,107 @@
+// Copyright 2015-2018 trivago N.V.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trivago/gollum/core"
+	"github.com/trivago/gollum/logger"
+)
+
+// simulate configures all plugins of the config and passes each line of the
+// given input file through the pipeline. Use "-" to read from stdin.
+func simulate(config *core.Config, inputFile string) bool {
+	input := os.Stdin
+	if inputFile != "-" {
+		file, err := os.Open(inputFile)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to open simulation input")
+			return false
+		}
+		defer file.Close()
+		input = file
+	}
+
+	coordinator := NewCoordinator()
+	err := coordinator.Configure(config)
+
+	// Print all errors before the simulation. Plugins are not started, so
+	// there is nothing to shut down.
+	logrusHookBuffer.SetTargetWriter(logger.FallbackLogDevice)
+	logrusHookBuffer.Purge()
+	if err != nil {
+		logrus.WithError(err).Error("Configure pass failed.")
+		return false
+	}
+
+	if err := coordinator.Simulate(input, os.Stdout); err != nil {
+		logrus.WithError(err).Error("Simulation failed")
+		return false
+	}
+	return true
+}
+
+// Simulate passes each line of input as a message to all configured
+// consumers and writes the way of each message to output. Producers are
+// replaced so that no message is sent. Plugins must not be started.
+func (co *Coordinator) Simulate(input io.Reader, output io.Writer) error {
+	simulation := core.NewSimulation()
+	simulation.Activate()
+	defer simulation.Deactivate()
+
+	wildcardStream := core.StreamRegistry.GetRouterOrFallback(core.WildcardStreamID)
+	for idx, producer := range co.producers {
+		core.StreamRegistry.UnregisterWildcardProducer(producer)
+		core.StreamRegistry.ForEachStream(func(streamID core.MessageStreamID, router core.Router) {
+			router.RemoveProducer(producer)
+		})
+
+		co.producers[idx] = simulation.WrapProducer(producer)
+		attachProducer(co.producers[idx], wildcardStream)
+	}
+	core.StreamRegistry.AddAllWildcardProducersToAllRouters()
+
+	for _, router := range co.routers {
+		if err := router.Start(); err != nil {
+			logrus.WithError(err).Errorf("Failed to start router of type '%s'", reflect.TypeOf(router))
+		}
+	}
+
+	scanner := bufio.NewScanner(input)
+	for msgIdx := 1; scanner.Scan(); msgIdx++ {
+		for _, consumer := range co.consumers {
+			if consumer == co.logConsumer {
+				continue // ### continue, internal consumer ###
+			}
+
+			events, err := simulation.Enqueue(consumer, scanner.Bytes())
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(output, "Message %d received by %s: %q\n", msgIdx, consumer.GetID(), scanner.Bytes())
+			for _, event := range events {
+				fmt.Fprintf(output, "  %s\n", event)
+			}
+		}
+	}
+	return scanner.Err()
+}